@@ -5,6 +5,7 @@ import (
     "fmt"
     "log"
     "net/http"
+    "os"
 )
 
 type Response struct {
@@ -32,6 +33,9 @@ func main() {
     http.HandleFunc("/health", healthHandler)
 
     port := ":8080"
+    if p := os.Getenv("PORT"); p != "" {
+        port = ":" + p
+    }
     fmt.Printf("Server starting on port %s\n", port)
     log.Fatal(http.ListenAndServe(port, nil))
 }
\ No newline at end of file
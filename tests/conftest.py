@@ -9,6 +9,7 @@ import sys
 import json
 import tempfile
 import shutil
+import socket
 from pathlib import Path
 from typing import Generator, Dict, Any, List
 import pytest
@@ -1249,3 +1250,27 @@ def disable_venv_detection(monkeypatch):
     
     monkeypatch.setattr('omni_run.OmniRun.detect_environment', mock_detect)
 
+
+@pytest.fixture
+def busy_port():
+    """A loopback port this process listens on; yields the port."""
+    sock = socket.socket(socket.AF_INET, socket.SOCK_STREAM)
+    sock.bind(("127.0.0.1", 0))
+    sock.listen(1)
+    try:
+        yield sock.getsockname()[1]
+    finally:
+        sock.close()
+
+
+
+# ============================================================================
+# Helpers
+# ============================================================================
+
+def write_manifest(directory: Path, content: str) -> Path:
+    """Write content as the omni-run.yaml of directory (created if missing) and return its path."""
+    directory.mkdir(parents=True, exist_ok=True)
+    manifest = directory / "omni-run.yaml"
+    manifest.write_text(content)
+    return manifest
@@ -0,0 +1,178 @@
+"""
+Tests for the audit log in OmniRun.
+
+This module tests:
+- Appending entries with the user, parameters and source, and sending them to syslog
+- Recording control API and dashboard requests (and not omni-run's own), `up`, manifest reloads and `exec`
+- Querying the log with `omni-run audit` by service, user, action and time, as text and JSON
+"""
+
+import sys
+import json
+import socket
+from pathlib import Path
+
+from conftest import *
+
+
+def audit_lines(temp_dir: Path):
+    return [json.loads(line) for line in (temp_dir / ".omni-run" / "audit.jsonl").read_text().splitlines()]
+
+
+class TestAuditLog:
+    """Tests for writing entries."""
+
+    def test_user(self, monkeypatch):
+        """Test that the user comes from OMNI_RUN_USER, then the user behind sudo."""
+        from omni_run import audit_user
+
+        monkeypatch.setenv("OMNI_RUN_USER", "alice")
+        assert audit_user() == "alice"
+        monkeypatch.delenv("OMNI_RUN_USER")
+        monkeypatch.setenv("SUDO_USER", "bob")
+        assert audit_user() == "bob"
+
+    def _recorded(self, temp_dir, monkeypatch):
+        from omni_run import AuditLog
+
+        monkeypatch.delenv("OMNI_RUN_USER", raising=False)
+        monkeypatch.setenv("SUDO_USER", "bob")
+        audit = AuditLog(temp_dir / "logs" / "audit.jsonl")
+        audit.record("exec", "db", command=["psql", "-c", "select 1"], backend=None)
+        entry = audit.record("restart", "api", "carol", "control API", address="10.0.0.7")
+        with open(audit.path, "a") as f:
+            f.write("not json\n")
+        audit.record("up", services=[], profile="dev")
+        return audit, entry
+
+    def test_record_and_read(self, temp_dir, monkeypatch):
+        """Test the entry fields, left-out empty parameters, and lines that aren't entries."""
+        audit, entry = self._recorded(temp_dir, monkeypatch)
+        first, second, third = audit.entries()
+        assert (first.user, first.action, first.service, first.via, first.params) == (
+            "bob", "exec", "db", "cli", {"command": ["psql", "-c", "select 1"]})
+        assert third.params == {"profile": "dev"} and third.service is None
+        assert second.payload() == entry.payload()
+
+    def test_payload_and_describe(self, temp_dir, monkeypatch):
+        """Test an entry's JSON fields and the line describing it."""
+        audit, entry = self._recorded(temp_dir, monkeypatch)
+        assert set(entry.payload()) == {"timestamp", "user", "action", "service", "via", "params", "host", "pid"}
+        assert entry.describe() == "carol restart api via control API (address: 10.0.0.7)"
+        assert audit.entries()[0].describe() == "bob exec db (command: psql -c select 1)"
+
+    def test_syslog(self, temp_dir):
+        """Test that entries are also sent to syslog, on the auth facility by default."""
+        from omni_run import AuditLog
+
+        receiver = socket.socket(socket.AF_INET, socket.SOCK_DGRAM)
+        receiver.bind(("127.0.0.1", 0))
+        receiver.settimeout(5)
+        try:
+            audit = AuditLog.from_config({"audit": {"syslog": f"127.0.0.1:{receiver.getsockname()[1]}"}}, temp_dir)
+            audit.record("stop", user="dave", supervisor=42)
+            message = receiver.recv(4096).decode()
+        finally:
+            receiver.close()
+        assert message.startswith("<37>")  # auth (4) * 8 + notice (5)
+        assert message.endswith("omni-run: audit: dave stop (supervisor: 42)")
+        assert audit.path == temp_dir / ".omni-run" / "audit.jsonl" and audit.path.exists()
+        assert AuditLog.from_config({"audit": {"enabled": False}}, temp_dir) is None
+
+
+class TestAuditedOperations:
+    """Tests for the operations that are recorded."""
+
+    def test_requests(self, temp_dir, omni_runner):
+        """Test control API requests with their client, dashboard requests, and omni-run's own requests."""
+        from omni_run import ControlServer, LogPipeline, Orchestrator, load_manifest
+
+        write_manifest(temp_dir, "services:\n  api: {command: 'true'}\n")
+        orchestrator = Orchestrator(omni_runner, load_manifest(temp_dir / "omni-run.yaml"))
+        control = ControlServer(orchestrator, LogPipeline(console=False), port=0)
+        assert control.handle("POST", "/services/api/restart", {}, {"user": "alice", "address": "10.0.0.7"})[0] == 202
+        assert control.handle("GET", "/services/api", {})[0] == 200
+        orchestrator.request("stop", "api", via="dashboard")
+        orchestrator.request("restart", "api")  # e.g. a log trigger
+        control.handle("POST", "/shutdown", {})
+
+        entries = [(e["user"], e["action"], e["service"], e["via"], e["params"]) for e in audit_lines(temp_dir)]
+        assert entries[0] == ("alice", "restart", "api", "control API", {"address": "10.0.0.7"})
+        assert entries[1][1:] == ("stop", "api", "dashboard", {})
+        assert entries[2] == ("anonymous", "shutdown", None, "control API", {})
+        assert len(entries) == 3
+
+    def test_up_reload_and_exec(self, temp_dir, omni_runner, monkeypatch):
+        """Test that `up`, an applied manifest change and `exec` are recorded."""
+        from omni_run import load_manifest, Orchestrator, run_subcommand
+
+        monkeypatch.setenv("OMNI_RUN_USER", "erin")
+        write_manifest(temp_dir, "services:\n  api: {command: 'true'}\n")
+        orchestrator = Orchestrator(omni_runner, load_manifest(temp_dir / "omni-run.yaml"))
+        assert orchestrator.up() == 0
+        write_manifest(temp_dir, "services:\n  api: {command: 'true'}\n  web: {command: 'true'}\nmetrics: {enabled: true}\n")
+        assert orchestrator.reload_manifest(None, [], ["api"], []) == ["api", "web"]
+        assert run_subcommand(["exec", "-C", str(temp_dir), "api", "--", sys.executable, "-c", "pass"]) == 0
+
+        up, reload, exec_ = audit_lines(temp_dir)
+        assert (up["user"], up["action"], up["params"]) == ("erin", "up", {"services": ["api"]})
+        assert (reload["action"], reload["via"], reload["params"]) == (
+            "reload", "manifest", {"file": "omni-run.yaml", "added": ["web"], "pending": ["metrics"]})
+        assert (exec_["action"], exec_["service"], exec_["params"]) == (
+            "exec", "api", {"command": [sys.executable, "-c", "pass"]})
+
+
+class TestAuditCommand:
+    """Tests for `omni-run audit`."""
+
+    def _recorded(self, temp_dir):
+        from omni_run import AuditLog, AuditEntry
+        from datetime import datetime, timedelta
+
+        write_manifest(temp_dir, "services:\n  api: {command: 'true'}\n")
+        audit = AuditLog(temp_dir / ".omni-run" / "audit.jsonl")
+        audit.path.parent.mkdir()
+        old = AuditEntry("stop", "bob", timestamp=datetime.now() - timedelta(hours=3))
+        with open(audit.path, "w") as f:
+            f.write(json.dumps(old.payload()) + "\n")
+        audit.record("restart", "api", "alice", "control API", address="10.0.0.7")
+        audit.record("exec", "db", "bob", command=["psql"])
+        return ["-C", str(temp_dir)]
+
+    def test_nothing_recorded(self, temp_dir, capsys):
+        """Test `omni-run audit` before any operation is recorded."""
+        from omni_run import run_subcommand
+
+        write_manifest(temp_dir, "services:\n  api: {command: 'true'}\n")
+        assert run_subcommand(["audit", "-C", str(temp_dir)]) == 0
+        assert "No operations recorded" in capsys.readouterr().out
+
+    def test_table(self, temp_dir, capsys):
+        """Test the table of entries with their user, action, service and parameters."""
+        from omni_run import run_subcommand, ANSI_ESCAPE
+
+        assert run_subcommand(["audit"] + self._recorded(temp_dir)) == 0
+        lines = ANSI_ESCAPE.sub("", capsys.readouterr().out).splitlines()
+        assert len(lines) == 3
+        assert lines[1][19:] == "  alice        restart  api              via control API, address: 10.0.0.7"
+        assert lines[2].endswith("bob          exec     db               command: psql")
+
+    def test_filters_and_json(self, temp_dir, capsys):
+        """Test filtering by service, user, action, --since and count, as JSON lines."""
+        from omni_run import run_subcommand
+
+        root = self._recorded(temp_dir)
+        for extra, actions in [(["api"], ["restart"]), (["-u", "bob"], ["stop", "exec"]),
+                               (["-a", "stop", "-a", "exec"], ["stop", "exec"]), (["--since", "1h"], ["restart", "exec"]),
+                               (["-n", "1"], ["exec"])]:
+            assert run_subcommand(["audit", "--output", "json"] + root + extra) == 0
+            documents = [json.loads(line) for line in capsys.readouterr().out.splitlines()]
+            assert [d["action"] for d in documents] == actions
+            assert all(d["kind"] == "audit" and d["schema_version"] == 1 for d in documents)
+
+    def test_invalid_since(self, temp_dir, capsys):
+        """Test a --since that isn't a duration."""
+        from omni_run import run_subcommand
+
+        assert run_subcommand(["audit", "--since", "whenever"] + self._recorded(temp_dir)) == 1
+        assert "--since: expected a duration" in capsys.readouterr().out
@@ -0,0 +1,273 @@
+"""
+Tests for execution backends in OmniRun.
+
+This module tests:
+- Backend selection (host default, --backend, per-service override)
+- Generated Dockerfiles for Go, Node and Python
+- docker run argument construction (ports, env, container naming)
+- The wasm backend: choosing wasmtime or wazero, preopened directories, env and listening sockets
+"""
+
+import sys
+import subprocess
+import pytest
+from pathlib import Path
+from unittest.mock import patch, MagicMock
+
+from conftest import *
+
+
+class TestBackendSelection:
+    """Tests for choosing where services run."""
+
+    def test_host_is_default(self, temp_dir, omni_runner):
+        """Test that services run on the host unless configured otherwise."""
+        from omni_run import load_manifest, Orchestrator, HostBackend
+
+        manifest = load_manifest(write_manifest(temp_dir, "services:\n  api:\n    command: 'true'\n"))
+        orchestrator = Orchestrator(omni_runner, manifest)
+
+        assert isinstance(orchestrator.backend_for(orchestrator.services["api"]), HostBackend)
+
+    def test_service_override(self, temp_dir, omni_runner):
+        """Test that a service's backend: key beats the default."""
+        from omni_run import load_manifest, Orchestrator, DockerBackend, HostBackend
+
+        manifest = load_manifest(write_manifest(temp_dir, """
+services:
+  api:
+    command: 'true'
+    backend: host
+  web:
+    command: 'true'
+"""))
+        orchestrator = Orchestrator(omni_runner, manifest, backend="docker")
+
+        assert isinstance(orchestrator.backend_for(orchestrator.services["api"]), HostBackend)
+        assert isinstance(orchestrator.backend_for(orchestrator.services["web"]), DockerBackend)
+
+    def test_unknown_backend(self, temp_dir):
+        """Test that unknown backends are rejected at load time."""
+        from omni_run import load_manifest, ManifestError
+
+        with pytest.raises(ManifestError, match="services.api.backend"):
+            load_manifest(write_manifest(temp_dir, "services:\n  api:\n    command: 'true'\n    backend: vm\n"))
+
+
+class TestGeneratedDockerfiles:
+    """Tests for Dockerfile generation per runtime."""
+
+    def test_go_multi_stage(self, temp_dir):
+        """Test that Go builds in one stage and runs the binary in a slim one."""
+        from omni_run import detect_container_runtime, generate_dockerfile
+
+        (temp_dir / "go.mod").write_text("module example.com/app\n\ngo 1.21\n")
+
+        assert detect_container_runtime(temp_dir) == "go"
+        dockerfile = generate_dockerfile("go", temp_dir)
+        assert dockerfile.startswith("FROM golang:1.21-alpine AS build")
+        assert "COPY --from=build /out/app /app/app" in dockerfile
+
+    def test_node_uses_lockfile(self, temp_dir):
+        """Test that Node images install with the project's package manager."""
+        from omni_run import generate_dockerfile
+
+        (temp_dir / "package.json").write_text("{}")
+        (temp_dir / "yarn.lock").write_text("")
+
+        assert "RUN yarn install --frozen-lockfile" in generate_dockerfile("node", temp_dir)
+
+    def test_python_requirements_and_entry(self, temp_dir):
+        """Test that Python images install requirements and run the entry script."""
+        from omni_run import detect_container_runtime, generate_dockerfile
+
+        (temp_dir / "requirements.txt").write_text("flask\n")
+        (temp_dir / "app.py").write_text("print('hi')\n")
+
+        assert detect_container_runtime(temp_dir) == "python"
+        dockerfile = generate_dockerfile("python", temp_dir, "python:3.11-slim")
+        assert dockerfile.startswith("FROM python:3.11-slim")
+        assert "RUN pip install --no-cache-dir -r requirements.txt" in dockerfile
+        assert 'CMD ["python", "app.py"]' in dockerfile
+
+
+class TestDockerRun:
+    """Tests for the docker run invocation."""
+
+    def _prepare(self, temp_dir, omni_runner):
+        from omni_run import load_manifest, Orchestrator
+
+        (temp_dir / "api").mkdir()
+        (temp_dir / "api" / "go.mod").write_text("module example.com/api\n")
+        manifest = load_manifest(write_manifest(temp_dir, """
+services:
+  api:
+    path: api
+    backend: docker
+    env:
+      MODE: dev
+    ports:
+      http: auto
+"""))
+        orchestrator = Orchestrator(omni_runner, manifest)
+        service = orchestrator.services["api"]
+        orchestrator.allocate_ports(service)
+        calls = []
+
+        def fake_run(argv, **kwargs):
+            calls.append(argv)
+            return MagicMock(returncode=1 if argv[1:3] == ["image", "inspect"] else 0, stdout="", stderr="")
+
+        with patch("omni_run.shutil.which", return_value="/usr/bin/docker"), \
+             patch("omni_run.subprocess.run", side_effect=fake_run):
+            argv, cwd, env = orchestrator.backend_for(service).prepare(orchestrator, service)
+        return argv, calls, service.ports["http"]
+
+    def test_builds_missing_image(self, temp_dir, omni_runner):
+        """Test that an image that isn't there yet is built."""
+        _, calls, _ = self._prepare(temp_dir, omni_runner)
+        assert any(c[1] == "build" for c in calls)
+
+    def test_run_name_and_image(self, temp_dir, omni_runner):
+        """Test that the container is named after the stack and service and runs the built image."""
+        from omni_run import stack_id
+
+        argv, _, _ = self._prepare(temp_dir, omni_runner)
+        assert argv[:3] == ["docker", "run", "--rm"]
+        assert f"omni-run-{stack_id(temp_dir)}-api" in argv
+        assert argv[-1].startswith("omni-run/api:")
+
+    def test_ports_and_env(self, temp_dir, omni_runner):
+        """Test that the allocated port is published and passed as PORT, next to the manifest env."""
+        argv, _, port = self._prepare(temp_dir, omni_runner)
+        assert ["-p", f"{port}:{port}"] == argv[argv.index("-p"):argv.index("-p") + 2]
+        assert f"PORT={port}" in argv
+        assert "MODE=dev" in argv
+
+    def test_missing_docker_cli(self, temp_dir, omni_runner):
+        """Test that a missing docker CLI is reported clearly."""
+        from omni_run import load_manifest, Orchestrator, ManifestError
+
+        (temp_dir / "main.py").write_text("print('hi')\n")
+        manifest = load_manifest(write_manifest(temp_dir, "services:\n  api:\n    backend: docker\n"))
+        orchestrator = Orchestrator(omni_runner, manifest)
+
+        with patch("omni_run.shutil.which", return_value=None):
+            with pytest.raises(ManifestError, match="requires the `docker` CLI"):
+                orchestrator.start_service(orchestrator.services["api"])
+
+
+def fake_wasm_runtime(temp_dir: Path, monkeypatch, name: str) -> Path:
+    """Put a stand-in runtime on PATH that prints its arguments, one per line."""
+    bin_dir = temp_dir / "bin"
+    bin_dir.mkdir(exist_ok=True)
+    runtime = bin_dir / name
+    runtime.write_text("#!/bin/sh\nfor arg in \"$@\"; do echo \"arg $arg\"; done\n")
+    runtime.chmod(0o755)
+    monkeypatch.setenv("PATH", str(bin_dir))
+    return runtime
+
+
+@pytest.mark.skipif(sys.platform == "win32", reason="The stand-in runtime is a shell script")
+class TestWasmBackend:
+    """Tests for running WASI modules."""
+
+    def test_parse(self, temp_dir):
+        """Test that `wasm:` implies the backend, and directory mappings with and without a guest path."""
+        from omni_run import load_manifest
+
+        (temp_dir / "data").mkdir()
+        manifest = load_manifest(write_manifest(temp_dir, """
+services:
+  api: {command: api.wasm, wasm: {runtime: wazero, dirs: [data, "data:/srv/data"]}}
+  job: {backend: wasm}
+"""))
+        api = manifest.services["api"]
+        assert api.backend == "wasm" and api.wasm.runtime == "wazero"
+        assert api.wasm.dirs == [((temp_dir / "data").resolve(), "data"), ((temp_dir / "data").resolve(), "/srv/data")]
+        assert manifest.services["job"].wasm is None
+
+    def test_invalid(self, temp_dir):
+        """Test an unknown runtime, a missing directory and `wasm:` on another backend."""
+        from omni_run import load_manifest, ManifestError
+
+        for block, message in [("{wasm: {runtime: wasmer}}", "wasm.runtime: must be one of wasmtime, wazero"),
+                               ("{wasm: {dirs: missing}}", "wasm.dirs: .*missing is not a directory"),
+                               ("{backend: docker, wasm: {}}", "wasm: only applies to the wasm backend")]:
+            write_manifest(temp_dir, f"services:\n  api: {block}\n")
+            with pytest.raises(ManifestError, match=message):
+                load_manifest(temp_dir / "omni-run.yaml")
+
+    def test_wasmtime_arguments(self, temp_dir, omni_runner, monkeypatch):
+        """Test wasmtime's directory, env and listen flags for the module found in the service's directory."""
+        from omni_run import load_manifest, Orchestrator
+
+        (temp_dir / "data").mkdir()
+        (temp_dir / "api.wasm").write_bytes(b"\0asm")
+        wasmtime = fake_wasm_runtime(temp_dir, monkeypatch, "wasmtime")
+        manifest = load_manifest(write_manifest(temp_dir, """
+services:
+  api:
+    backend: wasm
+    env: {MODE: dev}
+    ports: {http: auto}
+    wasm: {dirs: "data:/data"}
+"""))
+        orchestrator = Orchestrator(omni_runner, manifest)
+        service = orchestrator.services["api"]
+        orchestrator.allocate_ports(service)
+        port = service.ports["http"]
+        argv, cwd, _ = orchestrator.backend_for(service).prepare(orchestrator, service)
+        assert argv[:4] == [str(wasmtime), "run", "--dir", f"{(temp_dir / 'data').resolve()}::/data"]
+        assert ["--env", "MODE=dev"] == argv[argv.index("MODE=dev") - 1:argv.index("MODE=dev") + 1]
+        assert f"PORT={port}" in argv and argv[-3:] == ["-S", f"tcplisten=127.0.0.1:{port}", str(temp_dir / "api.wasm")]
+        assert cwd == temp_dir
+
+    def test_wazero_arguments(self, temp_dir, omni_runner, monkeypatch):
+        """Test wazero's env and listen flags, and the module's own arguments after `--`."""
+        from omni_run import load_manifest, Orchestrator
+
+        (temp_dir / "api.wasm").write_bytes(b"\0asm")
+        wazero = fake_wasm_runtime(temp_dir, monkeypatch, "wazero")
+        manifest = load_manifest(write_manifest(temp_dir, """
+services:
+  api: {command: "api.wasm --port ${PORT}", ports: 8080, wasm: {runtime: wazero}}
+"""))
+        orchestrator = Orchestrator(omni_runner, manifest)
+        service = orchestrator.services["api"]
+        service.ports = {"http": 8080}
+        argv, _, _ = orchestrator.backend_for(service).prepare(orchestrator, service)
+        assert argv[0] == str(wazero) and "-env=PORT=8080" in argv
+        assert argv[-5:] == ["-listen=127.0.0.1:8080", str(temp_dir / "api.wasm"), "--", "--port", "8080"]
+
+    def test_several_modules(self, temp_dir, omni_runner, monkeypatch):
+        """Test that a directory with more than one module needs `command` to pick one."""
+        from omni_run import load_manifest, Orchestrator, ManifestError
+
+        (temp_dir / "api.wasm").write_bytes(b"\0asm")
+        (temp_dir / "other.wasm").write_bytes(b"\0asm")
+        fake_wasm_runtime(temp_dir, monkeypatch, "wasmtime")
+        orchestrator = Orchestrator(omni_runner, load_manifest(write_manifest(temp_dir, "services:\n  api: {backend: wasm}\n")))
+        with pytest.raises(ManifestError, match="set `command` to the .wasm module to run \\(found api.wasm, other.wasm"):
+            orchestrator.backend_for(orchestrator.services["api"]).prepare(orchestrator, orchestrator.services["api"])
+
+    def test_missing_runtime(self, temp_dir, omni_runner, monkeypatch):
+        """Test that starting a wasm service without either runtime on PATH fails."""
+        from omni_run import load_manifest, Orchestrator, ManifestError
+
+        (temp_dir / "api.wasm").write_bytes(b"\0asm")
+        monkeypatch.setenv("PATH", str(temp_dir / "nowhere"))
+        orchestrator = Orchestrator(omni_runner, load_manifest(write_manifest(temp_dir, "services:\n  api: {backend: wasm}\n")))
+        with pytest.raises(ManifestError, match="wasm backend requires `wasmtime` or `wazero` on PATH"):
+            orchestrator.start_service(orchestrator.services["api"])
+
+    def test_up(self, temp_dir, omni_runner, capsys, monkeypatch):
+        """Test that a module runs under the runtime with the usual lifecycle and output."""
+        from omni_run import load_manifest, Orchestrator
+
+        (temp_dir / "hello.wasm").write_bytes(b"\0asm")
+        fake_wasm_runtime(temp_dir, monkeypatch, "wasmtime")
+        manifest = load_manifest(write_manifest(temp_dir, "services:\n  hello: {command: hello.wasm world, wasm: true}\n"))
+        assert Orchestrator(omni_runner, manifest).up() == 0
+        out = capsys.readouterr().out
+        assert f"arg {temp_dir / 'hello.wasm'}" in out and "arg world" in out
@@ -0,0 +1,320 @@
+"""
+Tests for the compiled-artifact build cache in OmniRun.
+
+This module tests:
+- Turning go run / cargo run / release plans and Java files into build recipes
+- Cache keys over sources, toolchain versions and build environment
+- Sources outside the project: Go replace targets and go.work modules, Cargo path dependencies
+- Hits, rebuilds, failed builds and copied cargo artifacts
+- Statistics, `cache clean` and size-based eviction
+- Builds for orchestrated services
+"""
+
+import os
+import sys
+import time
+import pytest
+from pathlib import Path
+
+from conftest import *
+
+
+FAKE_GO = """#!/bin/sh
+if [ "$1" = version ]; then echo "go version go1.22.0 fake"; exit 0; fi
+echo build >> "$BUILD_LOG"
+[ -f broken ] && { echo "main.go:1: syntax error"; exit 2; }
+out="$3"
+printf '#!/bin/sh\\necho built %s\\n' "$(cat main.go)" > "$out"
+chmod +x "$out"
+"""
+
+
+def go_project(temp_dir: Path) -> Path:
+    project = temp_dir / "api"
+    project.mkdir()
+    (project / "go.mod").write_text("module api\n\ngo 1.22\n")
+    (project / "main.go").write_text("v1")
+    bin_dir = temp_dir / "bin"
+    bin_dir.mkdir()
+    (bin_dir / "go").write_text(FAKE_GO)
+    (bin_dir / "go").chmod(0o755)
+    return project
+
+
+def go_env(temp_dir: Path) -> dict:
+    return dict(os.environ, PATH=f"{temp_dir / 'bin'}{os.pathsep}{os.environ['PATH']}",
+                BUILD_LOG=str(temp_dir / "builds.log"))
+
+
+def builds(temp_dir: Path) -> int:
+    log = temp_dir / "builds.log"
+    return len(log.read_text().splitlines()) if log.exists() else 0
+
+
+def sized_recipe(project: Path, size: int):
+    from omni_run import BuildRecipe
+
+    project.mkdir(exist_ok=True)
+    (project / "main.go").write_text(str(size))
+    script = f"open({os.path.join('{out}', 'bin')!r}, 'w').write('x' * {size})"
+    return BuildRecipe("go", project, [sys.executable, "-c", script], ["{out}"], "bin")
+
+
+class TestBuildRecipes:
+    """Tests for deriving cacheable builds from launch plans."""
+
+    def test_go_run(self, temp_dir):
+        """Test that go run flags go to the build and trailing arguments to the binary."""
+        from omni_run import LaunchPlan, build_recipe
+
+        plan = LaunchPlan(runtime="go", command=["go", "run", "-tags", "dev", ".", "--port", "80"], cwd=temp_dir)
+        recipe = build_recipe(plan)
+        assert recipe.build == ["go", "build", "-o", os.path.join("{out}", temp_dir.name), "-tags", "dev", "."]
+        assert recipe.run == ["{out}", "--port", "80"]
+        assert build_recipe(LaunchPlan(runtime="go", command=["air"], cwd=temp_dir)) is None
+
+    def test_cargo(self, temp_dir):
+        """Test cargo run profiles, target directories and release-binary plans."""
+        from omni_run import LaunchPlan, build_recipe
+
+        binary = temp_dir / "target" / "debug" / "app"
+        plan = LaunchPlan(runtime="rust", command=["cargo", "run", "--release", "--", "-v"], cwd=temp_dir, binary=binary)
+        recipe = build_recipe(plan)
+        assert recipe.build == ["cargo", "build", "--release"]
+        assert recipe.run == ["{out}", "-v"]
+        assert recipe.produced == temp_dir / "target" / "release" / "app"
+
+        recipe = build_recipe(LaunchPlan(runtime="rust", command=["cargo", "run"], cwd=temp_dir, binary=binary),
+                              {"CARGO_TARGET_DIR": "/tmp/shared-target"})
+        assert recipe.produced == Path("/tmp/shared-target/debug/app")
+
+        release = LaunchPlan(runtime="rust", command=[str(binary)], cwd=temp_dir, binary=binary,
+                             build_command=["cargo", "build", "--release"])
+        assert build_recipe(release).build == ["cargo", "build", "--release"]
+        assert build_recipe(LaunchPlan(runtime="rust", command=["cargo", "run"], cwd=temp_dir)) is None
+
+    def test_java(self, temp_dir):
+        """Test the main class of a packaged single-file Java program."""
+        from omni_run import java_recipe
+
+        source = temp_dir / "Main.java"
+        source.write_text("package com.example;\n\npublic class Main {}\n")
+        recipe = java_recipe(source)
+        assert recipe.run == ["java", "-cp", "{out}", "com.example.Main"]
+        assert recipe.build[:2] == ["javac", "-d"]
+
+
+@pytest.mark.skipif(sys.platform == "win32", reason="Fake compilers are shell scripts")
+class TestBuildCache:
+    """Tests for cache hits, invalidation and housekeeping."""
+
+    def _built(self, temp_dir):
+        from omni_run import BuildCache, LaunchPlan, build_recipe
+
+        project = go_project(temp_dir)
+        cache = BuildCache(temp_dir / "cache")
+        recipe = build_recipe(LaunchPlan(runtime="go", command=["go", "run", "."], cwd=project))
+        argv = cache.prepare(recipe, go_env(temp_dir), lambda line: None)
+        assert builds(temp_dir) == 1
+        return project, cache, recipe, argv
+
+    def test_hit_skips_rebuild(self, temp_dir):
+        """Test that unchanged sources reuse the built artifact."""
+        import subprocess
+
+        project, cache, recipe, argv = self._built(temp_dir)
+        lines = []
+        assert subprocess.run(argv, capture_output=True, text=True).stdout.strip() == "built v1"
+        assert cache.prepare(recipe, go_env(temp_dir), lines.append) == argv
+        assert builds(temp_dir) == 1
+        assert any("build cache hit" in line for line in lines)
+
+    def test_other_files_ignored(self, temp_dir):
+        """Test that a file that isn't a build input doesn't invalidate the artifact."""
+        project, cache, recipe, argv = self._built(temp_dir)
+        (project / "README.md").write_text("not a build input")
+        cache.prepare(recipe, go_env(temp_dir), lambda line: None)
+        assert builds(temp_dir) == 1
+
+    def test_changed_source_rebuilds(self, temp_dir):
+        """Test that editing a source builds a new artifact."""
+        import subprocess
+
+        project, cache, recipe, argv = self._built(temp_dir)
+        (project / "main.go").write_text("v2")
+        argv = cache.prepare(recipe, go_env(temp_dir), lambda line: None)
+        assert builds(temp_dir) == 2
+        assert subprocess.run(argv, capture_output=True, text=True).stdout.strip() == "built v2"
+
+    def test_build_environment_rebuilds(self, temp_dir):
+        """Test that a change to the build environment (GOOS) is a separate entry, counted in the stats."""
+        project, cache, recipe, argv = self._built(temp_dir)
+        cache.prepare(recipe, dict(go_env(temp_dir), GOOS="windows"), lambda line: None)
+        cache.prepare(recipe, go_env(temp_dir), lambda line: None)
+        assert builds(temp_dir) == 2
+
+        stats = cache.stats()
+        assert (stats["hits"], stats["misses"], stats["entries"]) == (1, 2, 2)
+
+    def test_failed_build(self, temp_dir):
+        """Test that a failing build raises, streams its output and caches nothing."""
+        from omni_run import BuildCache, BuildError, LaunchPlan, build_recipe
+
+        project = go_project(temp_dir)
+        (project / "broken").touch()
+        cache = BuildCache(temp_dir / "cache")
+        lines = []
+        with pytest.raises(BuildError, match="go build exited with code 2"):
+            cache.prepare(build_recipe(LaunchPlan(runtime="go", command=["go", "run", "."], cwd=project)),
+                          go_env(temp_dir), lines.append)
+        assert "main.go:1: syntax error" in lines
+        assert cache.entries() == []
+        assert [p.name for p in (temp_dir / "cache").iterdir()] == ["stats.json"]
+
+    def test_copies_produced_artifact(self, temp_dir):
+        """Test that builds writing into the project (cargo) are copied into the cache."""
+        from omni_run import BuildCache, BuildRecipe
+
+        produced = temp_dir / "target" / "debug" / "app"
+        script = f"import pathlib; p = pathlib.Path({str(produced)!r}); p.parent.mkdir(parents=True, exist_ok=True); p.write_text('bin')"
+        recipe = BuildRecipe("rust", temp_dir, [sys.executable, "-c", script], ["{out}"], "app", produced=produced)
+
+        cache = BuildCache(temp_dir / "cache")
+        (argv,) = cache.prepare(recipe, emit=lambda line: None)
+        produced.unlink()
+        assert Path(argv).read_text() == "bin"
+        assert Path(argv).parent.parent == temp_dir / "cache"
+
+    def test_eviction(self, temp_dir):
+        """Test that the least recently used entries are evicted past max_size_mb."""
+        from omni_run import BuildCache
+
+        cache = BuildCache(temp_dir / "cache", max_size_mb=1)
+        for name in ("a", "b", "c"):
+            cache.prepare(sized_recipe(temp_dir / name, 400_000), emit=lambda line: None)
+            time.sleep(0.01)
+        assert sorted(Path(e["project"]).name for e in cache.entries()) == ["b", "c"]
+
+    def test_clean(self, temp_dir):
+        """Test cleaning by age, by project and everything, which also resets the statistics."""
+        from omni_run import BuildCache
+
+        cache = BuildCache(temp_dir / "cache")
+        for name in ("b", "c"):
+            cache.prepare(sized_recipe(temp_dir / name, 10), emit=lambda line: None)
+        assert cache.clean(older_than=3600) == (0, 0)
+        assert cache.clean(project=temp_dir / "b")[0] == 1
+        assert [Path(e["project"]).name for e in cache.entries()] == ["c"]
+        assert cache.clean()[0] == 1
+        assert cache.stats()["misses"] == 0
+
+    def test_cache_command(self, temp_dir, capsys):
+        """Test `omni-run cache` statistics and `cache clean`."""
+        from omni_run import BuildCache, BuildRecipe, run_subcommand
+
+        config = temp_dir / "config.yaml"
+        config.write_text(f"build_cache:\n  dir: {temp_dir / 'cache'}\n")
+        script = f"open({os.path.join('{out}', 'bin')!r}, 'w').write('x')"
+        BuildCache(temp_dir / "cache").prepare(BuildRecipe("go", temp_dir, [sys.executable, "-c", script], ["{out}"], "bin"),
+                                               emit=lambda line: None)
+
+        assert run_subcommand(["cache", "-C", str(temp_dir), "--config", str(config)]) == 0
+        out = capsys.readouterr().out
+        assert "Entries:  1" in out
+        assert "0 hits, 1 builds" in out
+        assert run_subcommand(["cache", "clean", "-C", str(temp_dir), "--config", str(config)]) == 0
+        assert "Removed 1 cached build " in capsys.readouterr().out
+        assert run_subcommand(["cache", "clean", "--older-than", "soon", "--config", str(config)]) == 2
+
+
+@pytest.mark.skipif(sys.platform == "win32", reason="Fake compilers are shell scripts")
+class TestExternalSources:
+    """Tests for build inputs outside the project directory."""
+
+    def test_go_replace(self, temp_dir):
+        """Test that a sibling module a `replace` points at is part of the key, and other siblings aren't."""
+        from omni_run import BuildCache, LaunchPlan, build_recipe
+
+        project = go_project(temp_dir)
+        (project / "go.mod").write_text("module api\n\ngo 1.22\n\nreplace example.com/shared => ../shared\n")
+        (temp_dir / "shared").mkdir()
+        (temp_dir / "shared" / "go.mod").write_text("module example.com/shared\n")
+        (temp_dir / "shared" / "shared.go").write_text("package shared\n")
+        (temp_dir / "other").mkdir()
+        (temp_dir / "other" / "other.go").write_text("package other\n")
+        cache = BuildCache(temp_dir / "cache")
+        recipe = build_recipe(LaunchPlan(runtime="go", command=["go", "run", "."], cwd=project))
+        before = cache.source_hash(recipe)
+
+        (temp_dir / "other" / "other.go").write_text("package other // edited\n")
+        assert cache.source_hash(recipe) == before
+        (temp_dir / "shared" / "shared.go").write_text("package shared // edited\n")
+        assert cache.source_hash(recipe) != before
+
+    def test_go_work(self, temp_dir):
+        """Test the go.work file and the modules it uses."""
+        from omni_run import BuildRecipe, external_build_inputs
+
+        for name in ("api", "lib"):
+            (temp_dir / name).mkdir()
+            (temp_dir / name / "go.mod").write_text(f"module {name}\n")
+        (temp_dir / "go.work").write_text("go 1.22\n\nuse (\n\t./api\n\t./lib\n)\n")
+        recipe = BuildRecipe("go", temp_dir / "api", ["go", "build"], ["{out}"], "api")
+        assert external_build_inputs(recipe) == ([(temp_dir / "lib").resolve()], [(temp_dir / "go.work").resolve()])
+
+    def test_cargo_path_dependency(self, temp_dir):
+        """Test path dependencies, followed in turn, and the workspace's manifest and lockfile."""
+        from omni_run import BuildRecipe, external_build_inputs
+
+        (temp_dir / "Cargo.toml").write_text('[workspace]\nmembers = ["crates/*"]\n')
+        (temp_dir / "Cargo.lock").write_text("version = 3\n")
+        crates = temp_dir / "crates"
+        for name, dependency in (("api", 'core = { path = "../core" }'), ("core", 'util = { path = "../util" }'),
+                                 ("util", "")):
+            (crates / name / "src").mkdir(parents=True)
+            (crates / name / "Cargo.toml").write_text(f'[package]\nname = "{name}"\n\n[dependencies]\n{dependency}\n')
+        recipe = BuildRecipe("rust", crates / "api", ["cargo", "build"], ["{out}"], "api")
+        dirs, files = external_build_inputs(recipe)
+        assert dirs == [(crates / "core").resolve(), (crates / "util").resolve()]
+        assert files == [(temp_dir / "Cargo.toml").resolve(), (temp_dir / "Cargo.lock").resolve()]
+
+
+class TestServiceBuilds:
+    """Tests for cached builds of orchestrated services."""
+
+    def test_service_builds_after_pre_start(self, temp_dir, omni_runner, capsys, monkeypatch):
+        """Test that a Go service is compiled once, after its pre_start hook, and reused on the next run."""
+        from omni_run import load_manifest, Orchestrator, BuildCache
+
+        project = go_project(temp_dir)
+        for key, value in go_env(temp_dir).items():
+            monkeypatch.setenv(key, value)
+        manifest = temp_dir / "omni-run.yaml"
+        manifest.write_text("services:\n  api:\n    path: api\n    hooks:\n      pre_start: echo generated > main.go\n")
+        omni_runner._build_cache = BuildCache(temp_dir / "cache")
+
+        assert Orchestrator(omni_runner, load_manifest(manifest)).up() == 0
+        out = capsys.readouterr().out
+        assert "built generated" in out
+        assert out.index("pre_start") < out.index("building: go build")
+
+        assert Orchestrator(omni_runner, load_manifest(manifest)).up() == 0
+        assert "build cache hit" in capsys.readouterr().out
+        assert builds(temp_dir) == 1
+
+    def test_failed_build_fails_service(self, temp_dir, omni_runner, capsys, monkeypatch):
+        """Test that a compile error marks the service failed instead of aborting `up`."""
+        from omni_run import load_manifest, Orchestrator, BuildCache
+
+        project = go_project(temp_dir)
+        (project / "broken").touch()
+        for key, value in go_env(temp_dir).items():
+            monkeypatch.setenv(key, value)
+        manifest = temp_dir / "omni-run.yaml"
+        manifest.write_text("services:\n  api:\n    path: api\n")
+        omni_runner._build_cache = BuildCache(temp_dir / "cache")
+
+        orchestrator = Orchestrator(omni_runner, load_manifest(manifest))
+        assert orchestrator.up() == 1
+        assert orchestrator.services["api"].reason == "build failed"
+        assert "build failed: go build exited with code 2" in capsys.readouterr().out
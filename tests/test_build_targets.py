@@ -0,0 +1,160 @@
+"""
+Tests for Bazel and Nx build targets in OmniRun.
+
+This module tests:
+- Resolving `target:` labels to a Bazel or Nx workspace, relative Bazel labels and invalid targets
+- Building a Bazel target before each start and running its executable with `args`
+- Running Nx targets with the workspace's nx, failed builds, and `omni-run explain`
+"""
+
+import os
+import sys
+import pytest
+from pathlib import Path
+
+from conftest import *
+
+
+def fake_bazel(temp_dir: Path, monkeypatch, build_exit: int = 0):
+    """Put a `bazel` on PATH whose build writes bazel-out/bin/<name> (a script printing its args) and logs calls."""
+    bin_dir = temp_dir / "bin"
+    bin_dir.mkdir(exist_ok=True)
+    script = bin_dir / "bazel"
+    script.write_text(f"""#!{sys.executable}
+import os, sys
+with open("bazel-calls.log", "a") as f:
+    f.write(" ".join(sys.argv[1:]) + "\\n")
+label = next(a for a in sys.argv[2:] if a.startswith("//"))
+name = label.rsplit(":", 1)[1]
+if sys.argv[1] == "cquery":
+    print("bazel-out/bin/" + name)
+    sys.exit(0)
+print("INFO: Build completed")
+if {build_exit}:
+    sys.exit({build_exit})
+os.makedirs("bazel-out/bin", exist_ok=True)
+with open("bazel-out/bin/" + name, "w") as f:
+    f.write("#!/bin/sh\\necho ran $0 \\"$@\\" in $(pwd) ws=$BUILD_WORKSPACE_DIRECTORY\\n")
+os.chmod("bazel-out/bin/" + name, 0o755)
+""")
+    script.chmod(0o755)
+    monkeypatch.setenv("PATH", f"{bin_dir}{os.pathsep}{os.environ['PATH']}")
+
+
+class TestTargetLabels:
+    """Tests for parsing `target:`."""
+
+    def test_workspaces_and_labels(self, temp_dir):
+        """Test Bazel and Nx workspace roots, `:name` labels in a package, and args."""
+        from omni_run import load_manifest
+
+        (temp_dir / "MODULE.bazel").write_text("")
+        (temp_dir / "services" / "worker").mkdir(parents=True)
+        (temp_dir / "web").mkdir()
+        (temp_dir / "web" / "nx.json").write_text("{}")
+        manifest = load_manifest(write_manifest(temp_dir, """
+services:
+  api: {target: '//services/api:server', args: [--port, 1]}
+  worker: {path: services/worker, target: ':worker'}
+  root: {target: ':tool'}
+  web: {path: web, target: 'web:serve:development'}
+"""))
+        targets = {n: (s.target.tool, s.target.label, s.target.root) for n, s in manifest.services.items()}
+        assert targets == {"api": ("bazel", "//services/api:server", temp_dir),
+                           "worker": ("bazel", "//services/worker:worker", temp_dir),
+                           "root": ("bazel", "//:tool", temp_dir),
+                           "web": ("nx", "web:serve:development", temp_dir / "web")}
+        assert manifest.services["api"].args == ["--port", "1"]
+
+    def test_invalid_targets(self, temp_dir):
+        """Test targets that aren't Bazel labels or Nx targets, and settings that don't go with them."""
+        from omni_run import load_manifest, ManifestError
+
+        (temp_dir / "MODULE.bazel").write_text("")
+        (temp_dir / "web").mkdir()
+        (temp_dir / "web" / "nx.json").write_text("{}")
+        for content, message in [
+                ("services:\n  a: {target: 'app:serve'}\n", "not a Bazel label .* no nx.json at or above"),
+                ("services:\n  a: {path: web, target: 'serve'}\n", "expected an Nx project:target"),
+                ("services:\n  a: {target: '//x:y', command: 'true'}\n", "either a build target or a command"),
+                ("services:\n  a: {command: 'true', args: [x]}\n", "services.a.args: only applies to services given by target:")]:
+            with pytest.raises(ManifestError, match=message):
+                load_manifest(write_manifest(temp_dir, content))
+
+    def test_no_bazel_workspace(self, temp_dir):
+        """Test a Bazel label outside any Bazel workspace."""
+        from omni_run import load_manifest, ManifestError
+
+        with pytest.raises(ManifestError, match="is a Bazel label, but there is no Bazel workspace"):
+            load_manifest(write_manifest(temp_dir, "services:\n  a: {target: '//x:y'}\n"))
+
+
+class TestTargetUp:
+    """Tests for building and running targets."""
+
+    def test_bazel_build_and_run(self, temp_dir, omni_runner, monkeypatch, capsys):
+        """Test `bazel build` with build_flags before the start, the cquery'd executable, args and the workspace env."""
+        from omni_run import load_manifest, Orchestrator, ANSI_ESCAPE
+
+        fake_bazel(temp_dir, monkeypatch)
+        (temp_dir / "WORKSPACE").write_text("")
+        (temp_dir / "services" / "api").mkdir(parents=True)
+        manifest = load_manifest(write_manifest(temp_dir, """
+services:
+  api:
+    path: services/api
+    target: ':server'
+    args: [--port, '${PORT}']
+    build_flags: [-c, opt]
+    ports: {http: 43123}
+"""))
+        assert Orchestrator(omni_runner, manifest).up() == 0
+        calls = (temp_dir / "bazel-calls.log").read_text().splitlines()
+        assert calls[0].startswith("cquery -c opt //services/api:server --output=starlark")
+        assert calls[1] == "build -c opt //services/api:server"
+        out = ANSI_ESCAPE.sub("", capsys.readouterr().out)
+        assert "api | building: bazel build -c opt //services/api:server" in out
+        assert f"api | ran {temp_dir}/bazel-out/bin/server --port 43123 in {temp_dir} ws={temp_dir}" in out
+
+    def _mixed(self, temp_dir, monkeypatch):
+        fake_bazel(temp_dir, monkeypatch, build_exit=1)
+        (temp_dir / "MODULE.bazel").write_text("")
+        (temp_dir / "nx.json").write_text("{}")
+        nx = temp_dir / "node_modules" / ".bin" / "nx"
+        nx.parent.mkdir(parents=True)
+        nx.write_text('#!/bin/sh\necho nx "$@"\n')
+        nx.chmod(0o755)
+        write_manifest(temp_dir, """
+services:
+  api: {target: '//services/api:server'}
+  web: {target: 'web:serve', build_flags: [--verbose]}
+""")
+
+    def test_failed_build(self, temp_dir, omni_runner, monkeypatch, capsys):
+        """Test that a failed Bazel build fails the service before it starts."""
+        from omni_run import load_manifest, Orchestrator, ANSI_ESCAPE
+
+        self._mixed(temp_dir, monkeypatch)
+        orchestrator = Orchestrator(omni_runner, load_manifest(temp_dir / "omni-run.yaml"))
+        assert orchestrator.up() == 1
+        assert orchestrator.services["api"].reason == "build failed"
+        assert "api | build failed: bazel build exited with code 1" in ANSI_ESCAPE.sub("", capsys.readouterr().out)
+
+    def test_nx_target(self, temp_dir, omni_runner, monkeypatch, capsys):
+        """Test that an Nx target runs with the workspace's own nx and its build_flags."""
+        from omni_run import load_manifest, Orchestrator, ANSI_ESCAPE
+
+        self._mixed(temp_dir, monkeypatch)
+        Orchestrator(omni_runner, load_manifest(temp_dir / "omni-run.yaml")).up()
+        assert "web | nx run web:serve --verbose" in ANSI_ESCAPE.sub("", capsys.readouterr().out)
+
+    def test_explain(self, temp_dir, monkeypatch, capsys):
+        """Test what `explain` shows for Bazel and Nx targets."""
+        from omni_run import run_subcommand, ANSI_ESCAPE
+
+        self._mixed(temp_dir, monkeypatch)
+        run_subcommand(["explain", "-C", str(temp_dir)])
+        out = ANSI_ESCAPE.sub("", capsys.readouterr().out)
+        assert "runtime:     bazel target //services/api:server (workspace" in out
+        assert "build:       bazel build //services/api:server (before each start)" in out
+        assert "runtime:     nx target web:serve" in out
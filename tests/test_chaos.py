@@ -0,0 +1,240 @@
+"""
+Tests for chaos mode (fault injection) in OmniRun.
+
+This module tests:
+- Parsing `chaos:` experiments, their defaults and invalid experiments
+- Picking services at random (repeatably with a seed), restart delays and proxy latency while a fault lasts
+- `up --chaos` killing a service on a schedule so its restart policy brings it back, and `up` without it
+"""
+
+import sys
+import time
+import threading
+import urllib.request
+import pytest
+from pathlib import Path
+
+from conftest import *
+
+
+class TestChaosConfig:
+    """Tests for the `chaos:` block."""
+
+    def _chaos(self, temp_dir):
+        from omni_run import load_manifest
+
+        return load_manifest(write_manifest(temp_dir, """
+services:
+  api: {command: 'true'}
+  worker: {command: 'true'}
+chaos:
+  seed: 7
+  experiments:
+    - {action: kill, schedule: '@every 2m', services: api, signal: SIGTERM, probability: 0.5}
+    - {name: slow restarts, action: delay_restart, schedule: '*/5 * * * *', delay: 10s, duration: 1m}
+    - {action: latency, schedule: '@every 30s', services: [api], latency: 200ms, jitter: 100ms}
+""")).chaos
+
+    def test_experiments(self, temp_dir):
+        """Test names, actions' settings, durations and defaults."""
+        chaos = self._chaos(temp_dir)
+        assert (chaos.enabled, chaos.seed, [e.name for e in chaos.experiments]) == (
+            False, 7, ["kill #1", "slow restarts", "latency #3"])
+        kill, slow, latency = chaos.experiments
+        assert (kill.services, kill.probability, kill.signal) == (["api"], 0.5, 15)
+        assert (slow.delay, slow.duration, slow.services) == (10.0, 60.0, [])
+        assert (latency.latency, latency.jitter, latency.duration) == (0.2, 0.1, 60.0)
+
+    def test_descriptions(self, temp_dir):
+        """Test how each experiment is described."""
+        kill, slow, latency = self._chaos(temp_dir).experiments
+        assert kill.describe() == "kill api with SIGTERM (@every 2m, 50% of the time)"
+        assert slow.describe() == "delay restarts of any service by 10s for 60s (*/5 * * * *)"
+        assert latency.describe() == "add 0.2s (+ up to 0.1s) latency to api for 60s (@every 30s)"
+
+    def test_invalid_experiments(self, temp_dir):
+        """Test unknown actions and services, missing schedules and values, and bad probabilities."""
+        from omni_run import load_manifest, ManifestError
+
+        for experiment, message in [
+                ("{action: explode, schedule: '@hourly'}", "chaos.experiments\\[0\\].action: must be one of"),
+                ("{action: kill}", "needs a schedule"),
+                ("{action: kill, schedule: 'often'}", "chaos.experiments\\[0\\].schedule: expected 5 fields"),
+                ("{action: kill, schedule: '@hourly', services: [db]}", "unknown service 'db'"),
+                ("{action: kill, schedule: '@hourly', probability: 0}", "probability: must be above 0"),
+                ("{action: latency, schedule: '@hourly'}", "latency needs a positive latency"),
+                ("{action: delay_restart, schedule: '@hourly', delay: soon}", "chaos.experiments\\[0\\]: ")]:
+            with pytest.raises(ManifestError, match=message):
+                load_manifest(write_manifest(temp_dir, f"services:\n  api: {{command: 'true'}}\n"
+                                                       f"chaos:\n  experiments: [{experiment}]\n"))
+
+
+@pytest.fixture
+def proxied_api(temp_dir, omni_runner):
+    """A healthy api behind the proxy with a latency experiment; yields the orchestrator and a timed request."""
+    from omni_run import load_manifest, Orchestrator, ReverseProxy
+
+    (temp_dir / "server.py").write_text("""
+import os
+from http.server import BaseHTTPRequestHandler, HTTPServer
+class Handler(BaseHTTPRequestHandler):
+    def do_GET(self):
+        self.send_response(200)
+        self.send_header("Content-Length", "2")
+        self.end_headers()
+        self.wfile.write(b"ok")
+HTTPServer(("127.0.0.1", int(os.environ["PORT"])), Handler).serve_forever()
+""")
+    manifest = load_manifest(write_manifest(temp_dir, f"""
+services:
+  api:
+    command: ["{sys.executable}", server.py]
+    ports: auto
+    health: {{type: tcp, port: http, interval: 100ms}}
+proxy:
+  address: 127.0.0.1:0
+  routes: [{{path: /, service: api}}]
+chaos:
+  experiments: [{{action: latency, schedule: '@hourly', latency: 600ms}}]
+"""))
+    orchestrator = Orchestrator(omni_runner, manifest)
+    orchestrator.start_service(orchestrator.services["api"])
+    proxy = ReverseProxy.from_config(orchestrator)
+    try:
+        deadline = time.time() + 10
+        while time.time() < deadline and not orchestrator.services["api"].health.healthy:
+            time.sleep(0.05)
+        proxy.start()
+
+        def timed():
+            started = time.time()
+            assert urllib.request.urlopen(f"http://127.0.0.1:{proxy.port}/", timeout=10).read() == b"ok"
+            return time.time() - started
+
+        yield orchestrator, timed
+    finally:
+        proxy.stop()
+        orchestrator.shutdown()
+
+
+class TestChaosRunner:
+    """Tests for injecting faults."""
+
+    def _runner(self, temp_dir, omni_runner, running=True):
+        from omni_run import load_manifest, Orchestrator, ChaosRunner
+
+        manifest = load_manifest(write_manifest(temp_dir, """
+services:
+  api: {command: 'true'}
+  worker: {command: 'true'}
+chaos:
+  seed: 1
+  experiments:
+    - {action: delay_restart, schedule: '@every 1s', delay: 5s, duration: 100ms}
+    - {action: latency, schedule: '@every 1s', services: [api], latency: 1s, jitter: 500ms}
+"""))
+        orchestrator = Orchestrator(omni_runner, manifest)
+        for service in orchestrator.services.values():
+            service.is_alive = lambda: running
+        return ChaosRunner(orchestrator, manifest.chaos), manifest.chaos.experiments
+
+    def test_nothing_running(self, temp_dir, omni_runner):
+        """Test that a fault with no running service to pick injects nothing."""
+        runner, (delay, _) = self._runner(temp_dir, omni_runner, running=False)
+        assert runner.inject(delay) is None
+
+    def test_restart_delay(self, temp_dir, omni_runner):
+        """Test that a fault picks one running service and delays only its restarts."""
+        runner, (delay, _) = self._runner(temp_dir, omni_runner)
+        hit = runner.inject(delay)
+        assert hit in ("api", "worker") and runner.restart_delay(hit) == 5.0
+        assert runner.restart_delay("api" if hit == "worker" else "worker") == 0
+
+    def test_latency(self, temp_dir, omni_runner):
+        """Test latency with jitter for the experiment's service, and the count of injected faults."""
+        runner, (delay, latency) = self._runner(temp_dir, omni_runner)
+        runner.inject(delay)
+        assert runner.inject(latency) == "api" and 1.0 <= runner.latency("api") <= 1.5
+        assert runner.injected == 2
+
+    def test_over_after_duration(self, temp_dir, omni_runner):
+        """Test that a fault stops once its duration is over, while a longer one goes on."""
+        runner, (delay, latency) = self._runner(temp_dir, omni_runner)
+        hit = runner.inject(delay)
+        runner.inject(latency)
+        time.sleep(0.15)
+        assert runner.restart_delay(hit) == 0 and runner.latency("api") > 0
+
+    def test_seed(self, temp_dir, omni_runner):
+        """Test that the same seed picks the same services."""
+        from omni_run import ChaosRunner
+
+        runner, (delay, _) = self._runner(temp_dir, omni_runner)
+        assert ChaosRunner(runner.orchestrator, runner.spec).inject(delay) == runner.inject(delay)
+
+    def test_latency_through_the_proxy(self, proxied_api):
+        """Test that the proxy holds requests to a service under a latency fault, and only then."""
+        from omni_run import ChaosRunner
+
+        orchestrator, timed = proxied_api
+        assert timed() < 0.5
+        orchestrator.chaos = ChaosRunner(orchestrator, orchestrator.manifest.chaos)
+        orchestrator.chaos.inject(orchestrator.manifest.chaos.experiments[0])
+        assert timed() >= 0.6
+
+
+@pytest.mark.skipif(sys.platform == "win32", reason="Uses POSIX process groups")
+class TestChaosUp:
+    """Tests for chaos mode during `up`."""
+
+    def _chaotic(self, temp_dir, omni_runner, capsys):
+        from omni_run import load_manifest, Orchestrator, ANSI_ESCAPE
+
+        write_manifest(temp_dir, f"""
+services:
+  api:
+    command: ["{sys.executable}", "-c", "import time; open('runs', 'a').write('x'); time.sleep(60)"]
+    restart: {{policy: on-failure, backoff: 50ms, jitter: 0}}
+chaos:
+  experiments: [{{action: kill, schedule: '@every 1s', services: api}}]
+""")
+        orchestrator = Orchestrator(omni_runner, load_manifest(temp_dir / "omni-run.yaml"))
+        outcome = {}
+        runner = threading.Thread(target=lambda: outcome.setdefault("code", orchestrator.up(chaos=True)))
+        runner.start()
+        try:
+            deadline = time.time() + 15
+            while time.time() < deadline and len((temp_dir / "runs").read_text() if (temp_dir / "runs").exists()
+                                                 else "") < 2:
+                time.sleep(0.1)
+        finally:
+            orchestrator.request_shutdown()
+            runner.join(timeout=20)
+        return ANSI_ESCAPE.sub("", capsys.readouterr().out)
+
+    def test_kill_and_restart(self, temp_dir, omni_runner, capsys):
+        """Test that `up --chaos` kills the service on schedule and its restart policy restarts it."""
+        out = self._chaotic(temp_dir, omni_runner, capsys)
+        assert len((temp_dir / "runs").read_text()) >= 2
+        assert "api | chaos: kill #1: sending SIGKILL to pid" in out
+        assert "restarting in" in out
+
+    def test_experiments_reported(self, temp_dir, omni_runner, capsys):
+        """Test that the experiments are listed when `up` starts and the faults counted when it ends."""
+        out = self._chaotic(temp_dir, omni_runner, capsys)
+        assert "Chaos mode: faults are injected while services run:" in out
+        assert "  kill #1: kill api with SIGKILL (@every 1s)" in out
+        assert "Chaos mode injected" in out
+
+    def test_not_without_chaos(self, temp_dir, omni_runner, capsys):
+        """Test that experiments only run with `--chaos` or `enabled: true`."""
+        from omni_run import load_manifest, Orchestrator
+
+        write_manifest(temp_dir, f"""
+services:
+  api: {{command: ["{sys.executable}", "-c", "import time; time.sleep(1.5)"]}}
+chaos:
+  experiments: [{{action: kill, schedule: '@every 1s'}}]
+""")
+        assert Orchestrator(omni_runner, load_manifest(temp_dir / "omni-run.yaml")).up() == 0
+        assert "chaos" not in capsys.readouterr().out.lower()
@@ -0,0 +1,156 @@
+"""
+Tests for `omni-run ci` in OmniRun.
+
+This module tests:
+- Plain timestamped output, with each service's output grouped in manifest order
+- JUnit reports of services, the command and smoke checks
+- Running a command against the stack, exit code propagation, teardown and GitHub Actions output
+- Runs without a command ending with the first service to exit, and the startup timeout
+"""
+
+import re
+import sys
+import pytest
+import xml.etree.ElementTree as ET
+from pathlib import Path
+
+from conftest import *
+
+
+def process_alive(pid: int) -> bool:
+    import os
+    try:
+        os.kill(pid, 0)
+    except OSError:
+        return False
+    return True
+
+
+class TestCiOutput:
+    """Tests for the console output and reports of CI runs."""
+
+    def test_grouped_output(self, temp_dir, capsys):
+        """Test that service lines are held and printed per service, and lifecycle and command lines are not."""
+        from omni_run import CiLogPipeline, CI_COMMAND_LOG
+
+        logs = CiLogPipeline(log_dir=None)
+        for service in ("web", "api", CI_COMMAND_LOG):
+            logs.register(service, "\033[92m")
+        logs.write("web", "\033[1mGET /\033[0m 200")
+        logs.write("api", "listening")
+        logs.status("api", "\033[91mcrashed\033[0m")
+        logs.write(CI_COMMAND_LOG, "1 passed")
+        logs.write("web", "GET /health 200")
+        live = capsys.readouterr().out.splitlines()
+        assert [line[13:] for line in live] == ["api     | crashed", "command | 1 passed"]
+        assert all(re.match(r"\d\d:\d\d:\d\d\.\d{3} ", line) for line in live)
+
+        logs.annotate = True
+        logs.flush_groups(["api", "web"])
+        out = [line if line.startswith("::") else line[13:] for line in capsys.readouterr().out.splitlines()]
+        assert out == ["::group::api (1 lines)", "api     | listening", "::endgroup::", "::group::web (2 lines)",
+                       "web     | GET / 200", "web     | GET /health 200", "::endgroup::"]
+
+    def test_junit_report(self, temp_dir):
+        """Test a suite per group with failures, skipped cases and failure output."""
+        from omni_run import CiCase, write_junit_report
+
+        report = temp_dir / "reports" / "junit.xml"
+        write_junit_report(report, [CiCase("services", "api", True, "running", 2.5),
+                                    CiCase("services", "worker", None, "not started"),
+                                    CiCase("command", "pytest", False, "exited with code 1", 4.0, ["E  assert 1 == 2"])],
+                           7.25)
+        root = ET.parse(report).getroot()
+        assert (root.tag, root.get("tests"), root.get("failures"), root.get("time")) == ("testsuites", "3", "1", "7.250")
+        services, command = root.findall("testsuite")
+        assert (services.get("name"), services.get("skipped"), services.get("time")) == ("services", "1", "2.500")
+        assert services.find("testcase[@name='worker']/skipped").get("message") == "not started"
+        failure = command.find("testcase/failure")
+        assert (failure.get("message"), failure.text) == ("exited with code 1", "E  assert 1 == 2")
+
+
+@pytest.mark.skipif(sys.platform == "win32", reason="Uses POSIX sleep processes as services")
+class TestCiCommand:
+    """Tests for `omni-run ci`."""
+
+    def _failed(self, temp_dir, monkeypatch, capsys):
+        from omni_run import run_subcommand
+
+        write_manifest(temp_dir, f"""
+services:
+  api:
+    command: ["{sys.executable}", "-c", "import os, time; open('api.pid', 'w').write(str(os.getpid())); print('api up', flush=True); time.sleep(60)"]
+    ports: auto
+""")
+        monkeypatch.setenv("GITHUB_ACTIONS", "true")
+        monkeypatch.setenv("GITHUB_STEP_SUMMARY", str(temp_dir / "summary.md"))
+        check = "import sys; print('testing port ${service.api.port}'); sys.exit(3)"
+        assert run_subcommand(["ci", "-C", str(temp_dir), "--junit-report", str(temp_dir / "junit.xml"),
+                               "--", sys.executable, "-c", check]) == 3
+        return capsys.readouterr().out
+
+    def test_plain_grouped_output(self, temp_dir, monkeypatch, capsys):
+        """Test output without colors, the command's lines with the stack's environment, and grouped service output."""
+        from omni_run import Colors
+
+        colors = Colors.FAIL
+        out = self._failed(temp_dir, monkeypatch, capsys)
+        assert Colors.FAIL == colors and "\033[" not in out
+        assert re.search(r"command \| testing port \d+", out)
+        assert "::group::api (1 lines)" in out and "::endgroup::" in out
+
+    def test_command_exit_code(self, temp_dir, monkeypatch, capsys):
+        """Test that the command's exit code is the run's, with the failure reported."""
+        out = self._failed(temp_dir, monkeypatch, capsys)
+        assert "failed   command: " in out and "exited with code 3" in out
+        assert "omni-run ci failed with exit code 3" in out
+
+    def test_github_actions(self, temp_dir, monkeypatch, capsys):
+        """Test the error annotation and the step summary under GitHub Actions."""
+        out = self._failed(temp_dir, monkeypatch, capsys)
+        assert "::error title=command: " in out
+        summary = (temp_dir / "summary.md").read_text()
+        assert "| ❌ | command: " in summary and "failed (exit code 3)" in summary
+
+    def test_teardown(self, temp_dir, monkeypatch, capsys):
+        """Test that the stack is stopped once the command is done."""
+        self._failed(temp_dir, monkeypatch, capsys)
+        assert not process_alive(int((temp_dir / "api.pid").read_text()))
+
+    def test_command_junit_report(self, temp_dir, monkeypatch, capsys):
+        """Test the report's test cases for the services and the failed command."""
+        self._failed(temp_dir, monkeypatch, capsys)
+        root = ET.parse(temp_dir / "junit.xml").getroot()
+        assert [(c.get("classname"), c.find("failure") is not None) for c in root.iter("testcase")] == [
+            ("services", False), ("command", True)]
+
+    def test_without_command(self, temp_dir, capsys):
+        """Test that the run ends with the first service to exit, with its code."""
+        from omni_run import run_subcommand
+
+        write_manifest(temp_dir, f"""
+services:
+  api: {{command: ["{sys.executable}", "-c", "import time; time.sleep(60)"]}}
+  tests:
+    command: ["{sys.executable}", "-c", "import time; time.sleep(0.3); print('3 passed'); raise SystemExit(4)"]
+    depends_on: [api]
+""")
+        assert run_subcommand(["ci", "-C", str(temp_dir)]) == 4
+        out = capsys.readouterr().out
+        assert "---- tests (1 lines) ----" in out and "tests | 3 passed" in out
+        assert "failed   services: tests: exited with code 4" in out
+
+    def test_startup_timeout(self, temp_dir, capsys):
+        """Test a stack that doesn't become ready within --startup-timeout."""
+        from omni_run import run_subcommand
+
+        write_manifest(temp_dir, f"""
+services:
+  api:
+    command: ["{sys.executable}", "-c", "import time; time.sleep(60)"]
+    health: {{command: 'false', interval: 0.1}}
+""")
+        assert run_subcommand(["ci", "-C", str(temp_dir), "--startup-timeout", "1s", "--", "true"]) == 1
+        out = capsys.readouterr().out
+        assert "The stack did not become ready: timed out after 1s waiting for api" in out
+        assert "failed   services: api: not ready (starting)" in out
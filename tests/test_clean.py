@@ -0,0 +1,215 @@
+"""
+Tests for the workspace directory and `omni-run clean` in OmniRun.
+
+This module tests:
+- Where a project's workspace lives, with and without OMNI_RUN_HOME, and configured paths under it
+- Creating the workspace with its own .gitignore, and `init` adding it to the project's .gitignore
+- `omni-run clean`: what it removes and keeps, --dry-run, --snapshots, logs elsewhere and a running stack
+"""
+
+import os
+import sys
+import pytest
+from pathlib import Path
+
+from conftest import *
+
+
+class TestWorkspaceDir:
+    """Tests for locating and creating the workspace directory."""
+
+    def test_location(self, temp_dir, monkeypatch):
+        """Test the default location, and paths under .omni-run/ in it, relative to the project or absolute."""
+        from omni_run import workspace_dir, workspace_path
+
+        monkeypatch.delenv("OMNI_RUN_HOME", raising=False)
+        assert workspace_dir(temp_dir) == temp_dir / ".omni-run"
+        assert workspace_path(temp_dir, ".omni-run/logs") == temp_dir / ".omni-run" / "logs"
+        assert workspace_path(temp_dir, "logs") == temp_dir / "logs"
+        assert workspace_path(temp_dir, "/var/log/app") == Path("/var/log/app")
+
+    def _home(self, temp_dir, monkeypatch):
+        from omni_run import stack_id
+
+        monkeypatch.setenv("OMNI_RUN_HOME", str(temp_dir / "home"))
+        return temp_dir / "home" / "projects" / stack_id(temp_dir)
+
+    def test_home(self, temp_dir, monkeypatch):
+        """Test the location under OMNI_RUN_HOME, with .omni-run/ paths following it."""
+        from omni_run import workspace_dir, workspace_path
+
+        project = self._home(temp_dir, monkeypatch)
+        assert workspace_dir(temp_dir) == project
+        assert workspace_path(temp_dir, ".omni-run/logs") == project / "logs"
+        assert workspace_path(temp_dir, "logs") == temp_dir / "logs"
+
+    def test_configured_paths(self, temp_dir, monkeypatch):
+        """Test that the default log, failure and audit paths follow OMNI_RUN_HOME."""
+        from omni_run import load_manifest, Janitor, AuditLog
+
+        project = self._home(temp_dir, monkeypatch)
+        write_manifest(temp_dir, "services:\n  api: {command: ./api}\n")
+        janitor = Janitor.from_config({}, load_manifest(temp_dir / "omni-run.yaml"))
+        assert (janitor.log_dir, janitor.failures_dir) == (project / "logs", project / "failures")
+        assert AuditLog.from_config({}, temp_dir).path == project / "audit.jsonl"
+
+    def test_ensure_workspace(self, temp_dir, monkeypatch):
+        """Test creating the workspace with a .gitignore of its own, outside the project under OMNI_RUN_HOME."""
+        from omni_run import ensure_workspace
+
+        project = self._home(temp_dir, monkeypatch)
+        assert ensure_workspace(temp_dir) == project
+        assert (project / ".gitignore").read_text().splitlines()[-1] == "*"
+        assert not (temp_dir / ".omni-run").exists()
+
+    def test_not_a_repository(self, temp_dir, monkeypatch):
+        """Test that nothing is ignored outside a git repository without a .gitignore."""
+        from omni_run import ignore_workspace
+
+        monkeypatch.delenv("OMNI_RUN_HOME", raising=False)
+        assert not ignore_workspace(temp_dir)
+
+    def _repository(self, temp_dir, monkeypatch):
+        monkeypatch.delenv("OMNI_RUN_HOME", raising=False)
+        (temp_dir / ".git").mkdir()
+        (temp_dir / "app.py").write_text("print('hi')\n")
+        (temp_dir / "requirements.txt").write_text("flask\n")
+
+    def test_init_gitignore(self, temp_dir, monkeypatch, capsys):
+        """Test that `init` adds the stanza to the project's .gitignore, once."""
+        from omni_run import run_subcommand, ignore_workspace
+
+        self._repository(temp_dir, monkeypatch)
+        (temp_dir / ".gitignore").write_text("node_modules")
+        assert run_subcommand(["init", "-C", str(temp_dir)]) == 0
+        assert f"Added .omni-run/ to {temp_dir / '.gitignore'}" in capsys.readouterr().out
+        assert (temp_dir / ".gitignore").read_text() == (
+            "node_modules\n\n# omni-run: logs, state and caches (`omni-run clean` removes them)\n/.omni-run/\n")
+        assert not ignore_workspace(temp_dir)
+
+    def test_covering_patterns(self, temp_dir, monkeypatch):
+        """Test patterns that already cover the workspace."""
+        from omni_run import ignore_workspace
+
+        self._repository(temp_dir, monkeypatch)
+        for patterns in (".omni-run\n", ".*\n!.env\n"):
+            (temp_dir / ".gitignore").write_text(patterns)
+            assert not ignore_workspace(temp_dir)
+
+    def test_no_gitignore(self, temp_dir, monkeypatch):
+        """Test `init --no-gitignore`."""
+        from omni_run import run_subcommand
+
+        self._repository(temp_dir, monkeypatch)
+        assert run_subcommand(["init", "-C", str(temp_dir), "--force", "--no-gitignore"]) == 0
+        assert not (temp_dir / ".gitignore").exists()
+
+    def test_home_not_ignored(self, temp_dir, monkeypatch):
+        """Test that a workspace under OMNI_RUN_HOME needs no .gitignore entry."""
+        from omni_run import ignore_workspace
+
+        self._repository(temp_dir, monkeypatch)
+        monkeypatch.setenv("OMNI_RUN_HOME", str(temp_dir / "home"))
+        assert not ignore_workspace(temp_dir)
+
+
+class TestClean:
+    """Tests for `omni-run clean`."""
+
+    def _populate(self, workspace: Path):
+        for name in ("logs/api.log", "logs/api.log.1", "failures/api-1/output.log", "state.db", "state.db-wal",
+                     "services.json", "supervisor.log", "state.json.tmp", "snapshots/bug.tar.gz", "notes.txt"):
+            (workspace / name).parent.mkdir(parents=True, exist_ok=True)
+            (workspace / name).write_text("x" * 10)
+
+    def _populated(self, temp_dir, monkeypatch):
+        monkeypatch.delenv("OMNI_RUN_HOME", raising=False)
+        write_manifest(temp_dir, "services:\n  api: {command: ./api}\n")
+        workspace = temp_dir / ".omni-run"
+        self._populate(workspace)
+        return workspace
+
+    def test_dry_run(self, temp_dir, monkeypatch, capsys):
+        """Test that --dry-run lists what would be removed and kept, and removes nothing."""
+        from omni_run import run_subcommand, ANSI_ESCAPE
+
+        workspace = self._populated(temp_dir, monkeypatch)
+        assert run_subcommand(["clean", "-C", str(temp_dir), "--dry-run"]) == 0
+        out = ANSI_ESCAPE.sub("", capsys.readouterr().out)
+        assert "Would remove .omni-run/logs (20B)" in out and "Would remove .omni-run/state.json.tmp (10B)" in out
+        assert "Kept .omni-run/notes.txt: not created by omni-run" in out and "snapshots" not in out
+        assert "Would remove 7 item(s), 80B" in out
+        assert (workspace / "logs" / "api.log").exists()
+
+    def test_clean(self, temp_dir, monkeypatch, capsys):
+        """Test that what omni-run created is removed, and snapshots and other files kept."""
+        from omni_run import run_subcommand
+
+        workspace = self._populated(temp_dir, monkeypatch)
+        assert run_subcommand(["clean", "-C", str(temp_dir)]) == 0
+        assert "Removed 7 item(s), 80B" in capsys.readouterr().out
+        assert sorted(p.name for p in workspace.iterdir()) == ["notes.txt", "snapshots"]
+
+    def test_snapshots(self, temp_dir, monkeypatch, capsys):
+        """Test that --snapshots removes them too, and the emptied workspace."""
+        from omni_run import run_subcommand
+
+        workspace = self._populated(temp_dir, monkeypatch)
+        (workspace / "notes.txt").unlink()
+        assert run_subcommand(["clean", "-C", str(temp_dir), "--snapshots"]) == 0
+        assert "Removed .omni-run/snapshots (10B)" in capsys.readouterr().out
+        assert not workspace.exists()
+
+    def test_nothing_to_clean(self, temp_dir, monkeypatch, capsys):
+        """Test a project without a workspace."""
+        from omni_run import run_subcommand
+
+        monkeypatch.delenv("OMNI_RUN_HOME", raising=False)
+        write_manifest(temp_dir, "services:\n  api: {command: ./api}\n")
+        assert run_subcommand(["clean", "-C", str(temp_dir)]) == 0
+        assert "Nothing to clean in .omni-run" in capsys.readouterr().out
+
+    def _cleaned_elsewhere(self, temp_dir, monkeypatch, capsys):
+        from omni_run import run_subcommand, workspace_dir
+
+        monkeypatch.setenv("OMNI_RUN_HOME", str(temp_dir / "home"))
+        write_manifest(temp_dir, "services:\n  api: {command: ./api}\n")
+        config = temp_dir / "config.yaml"
+        config.write_text("logs: {dir: logs}\n")
+        (temp_dir / "logs").mkdir()
+        for name in ("api.log", "api.log.1", "other.txt"):
+            (temp_dir / "logs" / name).write_text("x" * 10)
+        workspace_dir(temp_dir).mkdir(parents=True)
+        (temp_dir / "keep").mkdir()
+        (temp_dir / "keep" / "data").write_text("important")
+        (workspace_dir(temp_dir) / "sync").symlink_to(temp_dir / "keep")
+        assert run_subcommand(["clean", "-C", str(temp_dir), "--config", str(config)]) == 0
+        return capsys.readouterr().out
+
+    @pytest.mark.skipif(sys.platform == "win32", reason="Uses a symlink")
+    def test_logs_elsewhere(self, temp_dir, monkeypatch, capsys):
+        """Test that service logs outside the workspace are removed, and other files there kept."""
+        out = self._cleaned_elsewhere(temp_dir, monkeypatch, capsys)
+        assert "Removed logs/api.log (10B)" in out and "Removed 3 item(s), 20B" in out
+        assert sorted(p.name for p in (temp_dir / "logs").iterdir()) == ["other.txt"]
+
+    @pytest.mark.skipif(sys.platform == "win32", reason="Uses a symlink")
+    def test_symlink_not_followed(self, temp_dir, monkeypatch, capsys):
+        """Test that a symlink in the workspace under OMNI_RUN_HOME is removed without following it."""
+        from omni_run import workspace_dir
+
+        self._cleaned_elsewhere(temp_dir, monkeypatch, capsys)
+        assert (temp_dir / "keep" / "data").read_text() == "important" and not workspace_dir(temp_dir).exists()
+
+    def test_running(self, temp_dir, monkeypatch, capsys):
+        """Test that nothing is removed while a supervisor runs."""
+        import omni_run
+        from omni_run import run_subcommand
+
+        monkeypatch.delenv("OMNI_RUN_HOME", raising=False)
+        monkeypatch.setattr(omni_run, "read_supervisor_pid", lambda state_dir: 4242)
+        write_manifest(temp_dir, "services:\n  api: {command: ./api}\n")
+        self._populate(temp_dir / ".omni-run")
+        assert run_subcommand(["clean", "-C", str(temp_dir)]) == 1
+        assert "supervisor pid 4242; stop them (`omni-run stop`) before cleaning" in capsys.readouterr().out
+        assert (temp_dir / ".omni-run" / "state.db").exists()
@@ -0,0 +1,136 @@
+"""
+Tests for shell completion in OmniRun.
+
+This module tests:
+- Completing subcommands, options and option choices from the CLI parser
+- Completing service, task and profile names from the project's manifest
+- Reading names without loading (or validating) the manifest
+- The `__complete` protocol and the generated bash/zsh/fish/powershell scripts
+"""
+
+import sys
+import shutil
+import subprocess
+import pytest
+from pathlib import Path
+
+from conftest import *
+
+
+MANIFEST = """
+services:
+  api:
+    command: [go, run, .]
+  web:
+    command: npm run dev
+    path: web
+sidecars:
+  db: postgres:16
+tasks:
+  generate: protoc api.proto
+  build: {command: go build ./..., depends_on: generate}
+profiles:
+  staging: {}
+"""
+
+
+def values(candidates):
+    return [value for value, _ in candidates]
+
+
+class TestCompleteArguments:
+    """Tests for complete_arguments against the real parser."""
+
+    def test_subcommands_and_options(self):
+        """Test subcommand names with their help, global options before them and per-command options."""
+        from omni_run import complete_arguments
+
+        top = dict(complete_arguments([""]))
+        assert {"up", "task", "logs", "completion"} <= set(top)
+        assert top["up"] == "Start all manifest services with dependency ordering"
+        assert values(complete_arguments(["st"])) == ["start", "status", "static", "stop"]
+        assert "--profile" in values(complete_arguments(["--"]))
+        assert "--abort-on-exit" not in values(complete_arguments(["--"]))
+
+        assert values(complete_arguments(["up", "--ab"])) == ["--abort-on-exit"]
+        assert "--supervised" not in values(complete_arguments(["up", "--"]))
+        assert values(complete_arguments(["up", "--log-level", ""])) == ["debug", "info", "warn", "error"]
+        assert values(complete_arguments(["completion", "z"])) == ["zsh"]
+        assert values(complete_arguments(["-v", "cache", ""])) == ["stats", "clean"]
+
+    def test_manifest_names(self, temp_dir):
+        """Test services, tasks and profiles from the manifest found via -C."""
+        from omni_run import complete_arguments
+
+        (temp_dir / "omni-run.yaml").write_text(MANIFEST)
+        (temp_dir / ".env.local").write_text("")
+        (temp_dir / ".env.test.local").write_text("")
+        root = ["-C", str(temp_dir)]
+
+        services = dict(complete_arguments(root + ["up", ""]))
+        assert services == {"api": "go run .", "web": "npm run dev", "db": "sidecar postgres:16"}
+        assert values(complete_arguments(root + ["up", "api", ""])) == ["web", "db"]
+        assert values(complete_arguments(root + ["exec", "w"])) == ["web"]
+        assert values(complete_arguments(root + ["exec", "web", ""])) == []
+        assert values(complete_arguments(root + ["task", "-j", "2", ""])) == ["generate", "build"]
+        assert values(complete_arguments(root + ["up", "--profile", ""])) == ["staging", "test"]
+        assert values(complete_arguments(root + ["--profile", "s"])) == ["staging"]
+
+    def test_lazy_manifest_read(self, temp_dir, monkeypatch):
+        """Test that names come from plain YAML, even when the manifest would not load."""
+        import omni_run
+        from omni_run import complete_arguments
+
+        (temp_dir / "omni-run.yaml").write_text(MANIFEST + "  broken: {unknown_key: 1}\nservices_typo: {}\n")
+        monkeypatch.setattr(omni_run, "load_manifest", lambda *a, **k: pytest.fail("manifest was loaded"))
+        monkeypatch.setattr(omni_run.OmniRun, "__init__", lambda *a, **k: pytest.fail("runtime was initialized"))
+        assert values(complete_arguments(["-C", str(temp_dir), "task", ""])) == ["generate", "build"]
+
+        (temp_dir / "omni-run.yaml").write_text("services: [not, a, mapping\n")
+        assert values(complete_arguments(["-C", str(temp_dir), "up", ""])) == []
+
+
+class TestCompletionProtocol:
+    """Tests for `omni-run __complete` and the generated scripts."""
+
+    def test_complete_main(self, temp_dir, capsys):
+        """Test that the index selects the current word and that an empty word past the end is completed."""
+        from omni_run import complete_main
+
+        (temp_dir / "omni-run.yaml").write_text(MANIFEST)
+        assert complete_main(["4", "-C", str(temp_dir), "task", "gen", "ignored"]) == 0
+        assert capsys.readouterr().out == "generate\tprotoc api.proto\n"
+        assert complete_main(["4", "-C", str(temp_dir), "logs"]) == 0
+        assert capsys.readouterr().out.splitlines()[0] == "api\tgo run ."
+        assert complete_main(["not-a-number"]) == 0
+        assert capsys.readouterr().out == ""
+
+    def test_completion_scripts(self, capsys):
+        """Test that every shell's script calls back into __complete."""
+        from omni_run import run_subcommand
+
+        for shell, marker in [("bash", "complete -o default -F _omni_run_complete omni-run"),
+                              ("zsh", "compdef _omni_run omni-run"),
+                              ("fish", "complete -c omni-run -f -a '(__omni_run_complete)'"),
+                              ("powershell", "Register-ArgumentCompleter -Native -CommandName omni-run")]:
+            assert run_subcommand(["completion", shell]) == 0
+            script = capsys.readouterr().out
+            assert marker in script
+            assert "omni-run __complete" in script
+
+    @pytest.mark.skipif(shutil.which("bash") is None or sys.platform == "win32", reason="Needs bash")
+    def test_bash_script(self, temp_dir):
+        """Test the bash completion function end to end, with omni-run on PATH."""
+        from omni_run import COMPLETION_SCRIPTS
+
+        (temp_dir / "omni-run.yaml").write_text(MANIFEST)
+        bin_dir = temp_dir / "bin"
+        bin_dir.mkdir()
+        (bin_dir / "omni-run").write_text(
+            f"#!/bin/sh\nexec {sys.executable} {Path(__file__).resolve().parent.parent / 'omni_run.py'} \"$@\"\n")
+        (bin_dir / "omni-run").chmod(0o755)
+        script = COMPLETION_SCRIPTS["bash"] + (
+            'COMP_WORDS=(omni-run task ""); COMP_CWORD=2; _omni_run_complete; printf "%s\\n" "${COMPREPLY[@]}"\n')
+        result = subprocess.run(["bash", "-c", script], cwd=temp_dir, capture_output=True, text=True,
+                                env={"PATH": f"{bin_dir}:/usr/bin:/bin"})
+        assert result.stdout.split() == ["generate", "build"]
@@ -0,0 +1,140 @@
+"""
+Tests for the HTTP control API in OmniRun.
+
+This module tests:
+- Routing for service listing, health and buffered logs
+- Queued start/stop/restart actions and shutdown
+- Bearer token authentication
+- Server-Sent Event log streams against a live orchestrator
+"""
+
+import json
+import sys
+import threading
+import time
+import urllib.error
+import urllib.request
+import pytest
+from pathlib import Path
+
+from conftest import *
+
+
+def make_control(omni_runner, temp_dir, manifest_text, token=None):
+    from omni_run import ControlServer, LogPipeline, Orchestrator, load_manifest
+
+    (temp_dir / "omni-run.yaml").write_text(manifest_text)
+    logs = LogPipeline(console=False, buffer=50)
+    orchestrator = Orchestrator(omni_runner, load_manifest(temp_dir / "omni-run.yaml"), logs)
+    return ControlServer(orchestrator, logs, port=0, token=token)
+
+
+def call(server, method, path, token=None):
+    request = urllib.request.Request(server.url + path, method=method, data=b"" if method == "POST" else None)
+    if token:
+        request.add_header("Authorization", f"Bearer {token}")
+    try:
+        with urllib.request.urlopen(request, timeout=5) as response:
+            return response.status, json.loads(response.read())
+    except urllib.error.HTTPError as e:
+        return e.code, json.loads(e.read())
+
+
+@pytest.fixture
+def live_ticker(omni_runner, temp_dir):
+    """A control server in front of `up` running a service that prints a line every 0.1s; yields it and the `up` thread."""
+    control = make_control(omni_runner, temp_dir,
+                           "services:\n  ticker:\n    command: \"while true; do echo tick; sleep 0.1; done\"\n")
+    runner = threading.Thread(target=control.orchestrator.up, kwargs={"persistent": True})
+    control.start()
+    runner.start()
+    yield control, runner
+    control.orchestrator.request_shutdown()
+    control.stop()
+    runner.join(timeout=10)
+
+
+class TestControlRouting:
+    """Tests for request routing without a network round trip."""
+
+    def test_list_and_get(self, omni_runner, temp_dir):
+        """Test the service list, a single service and health views."""
+        control = make_control(omni_runner, temp_dir, "services:\n  api:\n    command: 'true'\n  db:\n    command: 'true'\n")
+
+        status, body = control.handle("GET", "/services", {})
+        assert status == 200
+        assert [s["name"] for s in body["services"]] == ["api", "db"]
+
+        status, body = control.handle("GET", "/services/api", {})
+        assert (status, body["state"], body["health"]) == (200, "pending", None)
+        assert control.handle("GET", "/services/api/health", {})[1]["state"] == "pending"
+        assert control.handle("GET", "/services/nope", {})[0] == 404
+        assert control.handle("GET", "/elsewhere", {})[0] == 404
+
+    def test_buffered_logs(self, omni_runner, temp_dir):
+        """Test that logs come from the in-memory buffer and honor ?lines."""
+        control = make_control(omni_runner, temp_dir, "services:\n  api:\n    command: 'true'\n")
+        for i in range(5):
+            control.logs.write("api", f"line {i}")
+
+        status, body = control.handle("GET", "/services/api/logs", {"lines": "2"})
+        assert status == 200
+        assert [entry["line"] for entry in body["lines"]] == ["line 3", "line 4"]
+        with pytest.raises(ValueError):
+            control.handle("GET", "/services/api/logs", {"lines": "many"})
+
+    def test_actions_are_queued(self, omni_runner, temp_dir):
+        """Test that POSTed actions reach the orchestrator's command queue."""
+        control = make_control(omni_runner, temp_dir, "services:\n  api:\n    command: 'true'\n")
+
+        assert control.handle("POST", "/services/api/restart", {}) == (202, {"service": "api", "queued": "restart"})
+        assert control.orchestrator.commands.get_nowait() == ("restart", "api")
+        assert control.handle("POST", "/services/api/explode", {})[0] == 405
+        assert control.handle("POST", "/shutdown", {})[0] == 202
+        assert control.orchestrator._shutdown_requested.is_set()
+
+
+class TestControlServer:
+    """Tests for the API over HTTP."""
+
+    def test_token_required(self, omni_runner, temp_dir):
+        """Test that a configured token is enforced."""
+        control = make_control(omni_runner, temp_dir, "services:\n  api:\n    command: 'true'\n", token="s3cret")
+        control.start()
+        try:
+            assert call(control, "GET", "/services")[0] == 401
+            assert call(control, "GET", "/services", token="wrong")[0] == 401
+            assert call(control, "GET", "/services", token="s3cret")[0] == 200
+        finally:
+            control.stop()
+
+    @pytest.mark.skipif(sys.platform == "win32", reason="POSIX shell loop")
+    def test_stream_logs(self, live_ticker):
+        """Test that followed logs arrive as Server-Sent Events while `up` runs."""
+        control, runner = live_ticker
+        with urllib.request.urlopen(control.url + "/services/ticker/logs?follow=1&lines=0", timeout=5) as stream:
+            assert stream.headers["Content-Type"] == "text/event-stream"
+            events = []
+            while len(events) < 2:
+                line = stream.readline().decode()
+                if line.startswith("data: "):
+                    events.append(json.loads(line[6:]))
+        assert all(event["service"] == "ticker" for event in events)
+
+    @pytest.mark.skipif(sys.platform == "win32", reason="POSIX shell loop")
+    def test_stop_service(self, live_ticker):
+        """Test that a POSTed stop stops the service in the running stack."""
+        control, runner = live_ticker
+        assert call(control, "POST", "/services/ticker/stop")[0] == 202
+        deadline = time.time() + 5
+        while call(control, "GET", "/services/ticker")[1]["state"] != "stopped" and time.time() < deadline:
+            time.sleep(0.05)
+        assert call(control, "GET", "/services/ticker")[1]["state"] == "stopped"
+
+    @pytest.mark.skipif(sys.platform == "win32", reason="POSIX shell loop")
+    def test_shutdown(self, live_ticker):
+        """Test that a POSTed shutdown ends `up`."""
+        control, runner = live_ticker
+        assert call(control, "POST", "/shutdown")[0] == 202
+        runner.join(timeout=10)
+        assert not runner.is_alive()
@@ -0,0 +1,189 @@
+"""
+Tests for background supervision in OmniRun.
+
+This module tests:
+- Supervisor pidfiles and stale-state handling
+- Persisted service state and restart history
+- Log tailing and following
+- start --detach / status / stop round trips
+"""
+
+import os
+import sys
+import time
+import threading
+import pytest
+from pathlib import Path
+
+from conftest import *
+
+
+SLEEPER = f'["{sys.executable}", "-u", "-c", "import time\\nprint(\'up\')\\ntime.sleep(60)"]'
+
+
+class TestSupervisorState:
+    """Tests for pidfile and state persistence."""
+
+    def test_pid_alive(self):
+        """Test liveness checks for the current and a missing process."""
+        from omni_run import pid_alive
+
+        assert pid_alive(os.getpid())
+        assert not pid_alive(None)
+
+    def test_stale_pidfile_is_cleared(self, temp_dir):
+        """Test that a pidfile for a dead process is ignored and removed."""
+        import subprocess
+        from omni_run import read_supervisor_pid, SUPERVISOR_PIDFILE
+
+        dead = subprocess.Popen([sys.executable, "-c", "pass"])
+        dead.wait()
+        (temp_dir / SUPERVISOR_PIDFILE).write_text(str(dead.pid))
+
+        assert read_supervisor_pid(temp_dir) is None
+        assert not (temp_dir / SUPERVISOR_PIDFILE).exists()
+
+    def test_claim_refuses_second_supervisor(self, temp_dir):
+        """Test that only one live supervisor may own a workspace."""
+        import subprocess
+        from omni_run import claim_supervisor, release_supervisor, ManifestError, SUPERVISOR_PIDFILE
+
+        other = subprocess.Popen([sys.executable, "-c", "import time; time.sleep(30)"])
+        try:
+            (temp_dir / SUPERVISOR_PIDFILE).write_text(str(other.pid))
+            with pytest.raises(ManifestError, match="already running"):
+                claim_supervisor(temp_dir)
+        finally:
+            other.kill()
+            other.wait()
+
+        claim_supervisor(temp_dir)
+        assert (temp_dir / SUPERVISOR_PIDFILE).read_text() == str(os.getpid())
+        release_supervisor(temp_dir)
+        assert not (temp_dir / SUPERVISOR_PIDFILE).exists()
+
+    def test_up_persists_state(self, temp_dir, omni_runner, capsys):
+        """Test that the orchestrator writes final service state and releases its pidfile."""
+        from omni_run import load_manifest, Orchestrator, read_supervisor_state, SUPERVISOR_PIDFILE
+
+        (temp_dir / "omni-run.yaml").write_text(f"""
+services:
+  once:
+    command: ["{sys.executable}", "-c", "print('done')"]
+""")
+        state_dir = temp_dir / ".omni-run"
+        orchestrator = Orchestrator(omni_runner, load_manifest(temp_dir / "omni-run.yaml"), state_dir=state_dir)
+
+        assert orchestrator.up() == 0
+        state = read_supervisor_state(state_dir)
+        assert state["services"]["once"]["state"] == "exited"
+        assert state["services"]["once"]["exit_code"] == 0
+        assert not (state_dir / SUPERVISOR_PIDFILE).exists()
+
+
+    def test_status_shows_restart_history(self, temp_dir, capsys):
+        """Test that status reports restart counts and recent restarts from persisted state."""
+        from omni_run import run_subcommand, write_supervisor_state
+
+        (temp_dir / "omni-run.yaml").write_text("services:\n  api:\n    command: 'true'\n")
+        (temp_dir / ".omni-run").mkdir()
+        write_supervisor_state(temp_dir / ".omni-run", {"services": {"api": {
+            "state": "failed", "pid": None, "exit_code": 1, "ports": {}, "started_at": None,
+            "reason": "crash loop: gave up after 1 restarts", "restarts": 1,
+            "restart_history": [{"at": "2024-05-01T12:30:45.000001", "exit_code": 1, "delay": 1.04}]
+        }}})
+
+        assert run_subcommand(["status", "-C", str(temp_dir)]) == 3
+        out = capsys.readouterr().out
+        assert "RESTARTS" in out
+        assert "12:30:45  exited with code 1, restarted after 1.0s" in out
+        assert "crash loop: gave up after 1 restarts" in out
+
+class TestLogFollowing:
+    """Tests for reading service log files."""
+
+    def test_tail_lines(self, temp_dir):
+        """Test that only the last lines are returned."""
+        from omni_run import tail_lines
+
+        log = temp_dir / "a.log"
+        log.write_text("".join(f"{i}\n" for i in range(10)))
+
+        assert tail_lines(log, 3) == ["7", "8", "9"]
+        assert tail_lines(temp_dir / "missing.log", 3) == []
+
+    def test_follow_picks_up_appends_and_rotation(self, temp_dir):
+        """Test that following sees new lines, including after the file is rotated."""
+        from omni_run import follow_logs
+
+        log = temp_dir / "api.log"
+        log.write_text("old\n")
+        seen = []
+        stop = threading.Event()
+        thread = threading.Thread(target=follow_logs, args=({"api": log}, lambda n, l: seen.append(l), 0.05, stop))
+        thread.start()
+        try:
+            time.sleep(0.2)
+            with open(log, "a") as f:
+                f.write("new\n")
+            time.sleep(0.2)
+            os.replace(log, temp_dir / "api.log.1")
+            log.write_text("rotated\n")
+            time.sleep(0.3)
+        finally:
+            stop.set()
+            thread.join(timeout=2)
+
+        assert seen == ["new", "rotated"]
+
+
+@pytest.fixture
+def detached(temp_dir):
+    """A stack started with `start --detach`, its sleeper running; yields the -C arguments and the sleeper's pid."""
+    from omni_run import run_subcommand, read_supervisor_state, read_supervisor_pid
+
+    (temp_dir / "omni-run.yaml").write_text(f"services:\n  sleeper:\n    command: {SLEEPER}\n")
+    root = ["-C", str(temp_dir)]
+    assert run_subcommand(["start", "--detach"] + root) == 0
+    deadline = time.time() + 10
+    while time.time() < deadline:
+        info = read_supervisor_state(temp_dir / ".omni-run").get("services", {}).get("sleeper", {})
+        if info.get("state") == "running":
+            break
+        time.sleep(0.1)
+    yield root, info["pid"]
+    if read_supervisor_pid(temp_dir / ".omni-run"):
+        run_subcommand(["stop"] + root)
+
+
+@pytest.mark.skipif(sys.platform == "win32", reason="Uses POSIX signals")
+class TestDetachedLifecycle:
+    """Tests for start --detach, status, logs and stop."""
+
+    def test_status(self, detached, capsys):
+        """Test that status lists the detached stack's service."""
+        from omni_run import run_subcommand
+
+        root, _ = detached
+        capsys.readouterr()
+        assert run_subcommand(["status"] + root) == 0
+        assert "sleeper" in capsys.readouterr().out
+
+    def test_logs(self, detached, capsys):
+        """Test that logs reads what the detached service printed."""
+        from omni_run import run_subcommand
+
+        root, _ = detached
+        time.sleep(0.5)
+        capsys.readouterr()
+        assert run_subcommand(["logs", "sleeper"] + root) == 0
+        assert "[stdout] up" in capsys.readouterr().out
+
+    def test_stop(self, detached):
+        """Test that stop ends the service, after which status reports nothing running."""
+        from omni_run import run_subcommand, pid_alive
+
+        root, service_pid = detached
+        assert run_subcommand(["stop"] + root) == 0
+        assert not pid_alive(service_pid)
+        assert run_subcommand(["status"] + root) == 3
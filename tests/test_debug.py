@@ -0,0 +1,182 @@
+"""
+Tests for `omni-run debug` in OmniRun.
+
+This module tests:
+- Picking the debugger from the launch command, and commands it can't debug
+- debugpy, Node inspector and Delve command lines, the debug port and waiting for a debugger
+- Attach information, .vscode/launch.json configurations and running a service under debugpy
+"""
+
+import os
+import sys
+import json
+import pytest
+from pathlib import Path
+
+from conftest import *
+
+
+def fake_debugpy(temp_dir: Path) -> Path:
+    """A `debugpy` package that records its arguments and runs the program as debugpy would."""
+    package = temp_dir / "site" / "debugpy"
+    package.mkdir(parents=True)
+    (package / "__init__.py").write_text("")
+    (package / "__main__.py").write_text("""
+import runpy, sys
+with open("debugpy-args.txt", "w") as f:
+    f.write(" ".join(sys.argv[1:]))
+args = sys.argv[1:]
+while args[0].startswith("--"):
+    args = args[2:] if args[0] == "--listen" else args[1:]
+sys.argv = args
+runpy.run_path(args[0], run_name="__main__")
+""")
+    return package.parent
+
+
+class TestDebugCommands:
+    """Tests for wrapping launch commands."""
+
+    def test_runtimes(self, temp_dir):
+        """Test which debugger each command gets, --runtime, and commands that can't be debugged."""
+        from omni_run import DebugSession, ManifestError
+
+        session = DebugSession("api")
+        assert session.runtime_of(["/venv/bin/python3.12", "app.py"]) == "python"
+        assert session.runtime_of(["uvicorn", "app:app"]) == "python"
+        assert session.runtime_of(["node", "server.js"]) == "node"
+        assert session.runtime_of(["go", "run", "."]) == "go"
+        assert DebugSession("api", runtime="go").runtime_of(["./bin/api"]) == "go"
+        with pytest.raises(ManifestError, match="cannot debug through npm; give the service a `node ...`"):
+            session.runtime_of(["npm", "run", "dev"])
+        with pytest.raises(ManifestError, match="services.api: cannot tell which debugger runs `./server`"):
+            session.runtime_of(["./server"])
+
+    def test_node_and_ports(self, temp_dir):
+        """Test --inspect and --inspect-brk, the default port, a taken default, and a port kept across restarts."""
+        from omni_run import DebugSession, PortAllocator
+
+        ports = PortAllocator()
+        session = DebugSession("web")
+        ports.reserved.add(9229)  # As if another service had it
+        argv = session.wrap(["node", "--enable-source-maps", "server.js"], {}, ports)
+        port = session.address[1]
+        assert port != 9229 and argv == ["node", f"--inspect=127.0.0.1:{port}", "--enable-source-maps", "server.js"]
+        assert session.wrap(["node", "server.js"], {}, ports)[1] == f"--inspect=127.0.0.1:{port}"
+
+        free = ports.free_port()
+        ports.release([free])
+        waiting = DebugSession("web", port=free, host="0.0.0.0", wait=True)
+        assert waiting.wrap(["tsx", "src/main.ts"], {}, ports) == ["tsx", f"--inspect-brk=0.0.0.0:{free}", "src/main.ts"]
+
+    def test_python(self, temp_dir):
+        """Test debugpy with interpreter options, console scripts by their shebang, and debugpy missing."""
+        from omni_run import DebugSession, PortAllocator, ManifestError
+
+        env = dict(os.environ, PYTHONPATH=str(fake_debugpy(temp_dir)))
+        session = DebugSession("api", port=45678, wait=True)
+        assert session.wrap([sys.executable, "-u", "app.py", "--reload"], env, PortAllocator()) == [
+            sys.executable, "-u", "-m", "debugpy", "--listen", "127.0.0.1:45678", "--wait-for-client", "app.py", "--reload"]
+
+        script = temp_dir / "bin" / "uvicorn"
+        script.parent.mkdir()
+        script.write_text(f"#!/usr/bin/env {sys.executable}\nimport uvicorn\n")
+        script.chmod(0o755)
+        env["PATH"] = f"{script.parent}{os.pathsep}{env['PATH']}"
+        assert DebugSession("api", port=45679).wrap(["uvicorn", "app:app"], env, PortAllocator()) == [
+            sys.executable, "-m", "debugpy", "--listen", "127.0.0.1:45679", "-m", "uvicorn", "app:app"]
+
+        env["PYTHONPATH"] = ""
+        with pytest.raises(ManifestError, match=f"debugpy is not installed for {sys.executable}; install it with"):
+            DebugSession("api", port=45680).wrap([sys.executable, "app.py"], env, PortAllocator())
+
+    @pytest.mark.skipif(sys.platform == "win32", reason="Uses a shell script as dlv")
+    def test_delve(self, temp_dir):
+        """Test `dlv debug` for go run (build flags, files, program args), `dlv exec` and dlv missing."""
+        from omni_run import DebugSession, PortAllocator, ManifestError
+
+        dlv = temp_dir / "bin" / "dlv"
+        dlv.parent.mkdir()
+        dlv.write_text("#!/bin/sh\n")
+        dlv.chmod(0o755)
+        env = {"PATH": str(dlv.parent)}
+        server = ["--headless", "--listen=127.0.0.1:42345", "--api-version=2", "--accept-multiclient"]
+
+        session = DebugSession("api", port=42345)
+        assert session.wrap(["go", "run", "-tags=dev", "main.go", "util.go", "--verbose"], env, PortAllocator()) == [
+            str(dlv), "debug", "main.go", "util.go"] + server + ["--continue", "--build-flags", "-tags=dev", "--", "--verbose"]
+        assert session.wrap(["go", "run", "./cmd/api"], env, PortAllocator()) == [
+            str(dlv), "debug", "./cmd/api"] + server + ["--continue"]
+        binary = DebugSession("api", port=42345, wait=True, runtime="go")
+        assert binary.wrap(["./bin/api", "-p", "1"], env, PortAllocator()) == [
+            str(dlv), "exec", "./bin/api"] + server + ["--", "-p", "1"]
+        with pytest.raises(ManifestError, match="dlv \\(Delve\\) is not on PATH; install it with `go install"):
+            DebugSession("api", port=42346).wrap(["go", "run", "."], {"PATH": str(temp_dir)}, PortAllocator())
+
+
+class TestDebugRun:
+    """Tests for `omni-run debug <service>`."""
+
+    def test_attach_info(self):
+        """Test attach configurations per runtime, and the lines telling where to attach."""
+        from omni_run import DebugSession
+
+        session = DebugSession("api", address=("127.0.0.1", 5678))
+        assert session.launch_config("python") == {"name": "omni-run: api", "type": "debugpy", "request": "attach",
+                                                  "connect": {"host": "127.0.0.1", "port": 5678}}
+        assert session.launch_config("go")["mode"] == "remote"
+        lines = DebugSession("web", wait=True, address=("127.0.0.1", 9229)).attach_lines("node")
+        assert lines[0] == "debugger: the Node inspector listening on 127.0.0.1:9229 (the program waits until a debugger attaches)"
+        assert json.loads(lines[-1][len("VS Code: "):])["restart"] is True
+
+    def test_vscode_launch(self, temp_dir):
+        """Test adding the configuration to .vscode/launch.json and updating it next to the user's own."""
+        from omni_run import DebugSession
+
+        session = DebugSession("api", address=("127.0.0.1", 5678))
+        launch = temp_dir / ".vscode" / "launch.json"
+        assert session.write_vscode(temp_dir, "python") == 'added "omni-run: api" to .vscode/launch.json'
+        data = json.loads(launch.read_text())
+        data["configurations"][0]["connect"]["port"] = 1
+        data["configurations"].insert(0, {"name": "mine", "type": "node", "request": "launch"})
+        launch.write_text(json.dumps(data))
+        session.write_vscode(temp_dir, "python")
+        data = json.loads(launch.read_text())
+        assert [(c["name"], c.get("connect", {}).get("port")) for c in data["configurations"]] == [
+            ("mine", None), ("omni-run: api", 5678)]
+
+    def test_vscode_launch_with_comments(self, temp_dir):
+        """Test that a launch.json with comments is left alone."""
+        from omni_run import DebugSession
+
+        launch = temp_dir / ".vscode" / "launch.json"
+        launch.parent.mkdir()
+        launch.write_text("{\n  // my configurations\n}\n")
+        session = DebugSession("api", address=("127.0.0.1", 5678))
+        assert "is not plain JSON (comments?)" in session.write_vscode(temp_dir, "python")
+        assert launch.read_text() == "{\n  // my configurations\n}\n"
+
+    def test_debug_service(self, temp_dir, capsys):
+        """Test that `omni-run debug` runs the service under debugpy with its dependency, and prints where to attach."""
+        from omni_run import run_subcommand, ANSI_ESCAPE
+
+        site = fake_debugpy(temp_dir)
+        (temp_dir / "app.py").write_text("print('app ran')\n")
+        write_manifest(temp_dir, f"""
+services:
+  db: {{command: ["{sys.executable}", "-c", "print('db ran')"]}}
+  api:
+    command: ["{sys.executable}", app.py]
+    env: {{PYTHONPATH: '{site}'}}
+    depends_on: [db]
+  web: {{command: ["{sys.executable}", "-c", "print('web ran')"]}}
+""")
+        assert run_subcommand(["debug", "api", "-C", str(temp_dir), "--vscode"]) == 0
+        out = ANSI_ESCAPE.sub("", capsys.readouterr().out)
+        assert "db  | db ran" in out and "api | app ran" in out and "web ran" not in out
+        args = (temp_dir / "debugpy-args.txt").read_text().split()
+        assert args[0] == "--listen" and args[2] == "app.py"
+        port = int(args[1].rsplit(":", 1)[1])
+        assert f"api | debugger: debugpy listening on 127.0.0.1:{port}" in out
+        assert 'api | added "omni-run: api" to .vscode/launch.json' in out
+        assert json.loads((temp_dir / ".vscode" / "launch.json").read_text())["configurations"][0]["connect"]["port"] == port
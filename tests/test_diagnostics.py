@@ -0,0 +1,244 @@
+"""
+Tests for flaky-start detection and diagnostics hints in OmniRun.
+
+This module tests:
+- Startup outcomes in the state store: failures in a row, resets and hints
+- Diagnostics hints: port conflicts, missing and non-executable programs, refused connections, runtime errors
+- `up` printing hints once a service has failed to start `failures.diagnose_after` times, and `status` showing them
+"""
+
+import os
+import sys
+import time
+import pytest
+from datetime import datetime
+from pathlib import Path
+
+from conftest import *
+
+
+def failed(orchestrator, name, lines, exit_code=1, argv=None):
+    """Make a service look like it just exited with its last output."""
+    service = orchestrator.services[name]
+    service.output.extend((time.time(), "stderr", line) for line in lines)
+    service.exit_code, service.argv = exit_code, argv or ["./server"]
+    return service
+
+
+class TestStartupHistory:
+    """Tests for what the state store records about starts."""
+
+    def test_failures_in_a_row(self, temp_dir):
+        """Test counting failed starts until the last good one, per service."""
+        from omni_run import StateStore, STATE_DB
+
+        store = StateStore(temp_dir / STATE_DB)
+        now = datetime.now()
+        assert store.start_failures("api") == 0 and store.startups("api") == []
+        assert store.record_startup("api", now, False, 1, 0.2) == 1
+        assert store.record_startup("api", now, True, seconds=3) == 0
+        for expected in (1, 2, 3):
+            assert store.record_startup("api", now, False, 2, 0.1, "exited early") == expected
+        assert store.start_failures("worker") == 0
+        store.close()
+
+    def test_hints_on_latest_start(self, temp_dir):
+        """Test that recorded hints go with the latest start, alongside its exit code and reason."""
+        from omni_run import StateStore, STATE_DB
+
+        store = StateStore(temp_dir / STATE_DB)
+        for _ in range(2):
+            store.record_startup("api", datetime.now(), False, 2, 0.1, "exited early")
+        store.record_hints("api", ["port 8080 is already in use"])
+        startups = store.startups("api", limit=2)
+        assert [s["ok"] for s in startups] == [False, False]
+        assert startups[-1]["exit_code"] == 2 and startups[-1]["reason"] == "exited early"
+        assert startups[-1]["hints"] == ["port 8080 is already in use"] and startups[0]["hints"] == []
+        store.close()
+
+    def test_history_trimmed(self, temp_dir):
+        """Test that only the last STATE_STARTUP_HISTORY starts are kept."""
+        from omni_run import StateStore, STATE_DB, STATE_STARTUP_HISTORY
+
+        store = StateStore(temp_dir / STATE_DB)
+        for _ in range(STATE_STARTUP_HISTORY + 3):
+            store.record_startup("api", datetime.now(), False)
+        assert len(store.startups("api", limit=1000)) == STATE_STARTUP_HISTORY
+        store.close()
+
+
+class TestDiagnostics:
+    """Tests for the hints diagnose_start_failure gives."""
+
+    def _programs(self, temp_dir, omni_runner):
+        from omni_run import load_manifest, Orchestrator
+
+        (temp_dir / "server").write_text("#!/bin/sh\n")
+        manifest = load_manifest(write_manifest(temp_dir, """
+services:
+  api: {command: ./server, ports: {http: auto}}
+  plain: {command: ./server}
+  shell: {command: 'true'}
+  gone: {command: 'true'}
+"""))
+        orchestrator = Orchestrator(omni_runner, manifest)
+        orchestrator.services["api"].ports = {"http": 41234}
+        return orchestrator
+
+    def test_busy_port(self, temp_dir, omni_runner, busy_port):
+        """Test a busy port and its owner, when the service was given another one as $PORT."""
+        from omni_run import diagnose_start_failure
+
+        orchestrator = self._programs(temp_dir, omni_runner)
+        service = failed(orchestrator, "api", [f"Error: listen EADDRINUSE: address already in use :::{busy_port}"])
+        hints = diagnose_start_failure(orchestrator, service)
+        owner = f"pid {os.getpid()}" if sys.platform.startswith("linux") else ""
+        assert hints[0].startswith(f"port {busy_port} is already in use") and owner in hints[0]
+        assert hints[0].endswith("but omni-run gave the service http=41234: have it listen on $PORT")
+        assert not any("chmod" in hint for hint in hints)
+
+    def test_undeclared_port(self, temp_dir, omni_runner, busy_port):
+        """Test that a service without ports is told to declare the one it listens on."""
+        from omni_run import diagnose_start_failure
+
+        orchestrator = self._programs(temp_dir, omni_runner)
+        service = failed(orchestrator, "plain", [f"OSError: [Errno 98] Address already in use (port {busy_port})"])
+        assert "declare the port under ports:" in diagnose_start_failure(orchestrator, service)[0]
+
+    def test_missing_programs(self, temp_dir, omni_runner):
+        """Test a program a shell command can't find, and a command path that doesn't exist."""
+        from omni_run import diagnose_start_failure
+
+        orchestrator = self._programs(temp_dir, omni_runner)
+        service = failed(orchestrator, "shell", ["sh: 1: webpack-dev-server: not found"], 127, ["/bin/sh", "-c", "x"])
+        assert diagnose_start_failure(orchestrator, service) == [
+            "`webpack-dev-server` is not on the service's PATH: install it, or give its full path in command:"]
+        service = failed(orchestrator, "gone", [], 127, ["./bin/missing"])
+        assert diagnose_start_failure(orchestrator, service)[0].startswith("./bin/missing does not exist in ")
+
+    def test_not_executable(self, temp_dir, omni_runner):
+        """Test that a program without the executable bit gets a chmod hint."""
+        from omni_run import diagnose_start_failure
+
+        orchestrator = self._programs(temp_dir, omni_runner)
+        service = failed(orchestrator, "gone", ["/bin/sh: ./server: Permission denied"], 126, ["./server"])
+        service.cwd = temp_dir
+        assert "./server is not executable: run `chmod +x ./server`" in diagnose_start_failure(orchestrator, service)
+
+    def _dependencies(self, temp_dir, omni_runner):
+        from omni_run import load_manifest, Orchestrator
+
+        manifest = load_manifest(write_manifest(temp_dir, f"""
+services:
+  db: {{command: 'true', ports: {{pg: 5432}}}}
+  api: {{command: '{sys.executable} app.py'}}
+  web: {{command: 'true', depends_on: [db]}}
+"""))
+        orchestrator = Orchestrator(omni_runner, manifest)
+        orchestrator.services["db"].ports = {"pg": 5432}
+        return orchestrator
+
+    def test_python_hints(self, temp_dir, omni_runner):
+        """Test a refused connection to a service it doesn't depend on, and a missing Python module."""
+        from omni_run import diagnose_start_failure
+
+        orchestrator = self._dependencies(temp_dir, omni_runner)
+        service = failed(orchestrator, "api", [
+            "Traceback (most recent call last):",
+            "ModuleNotFoundError: No module named 'flask'",
+            "psycopg2.OperationalError: connection to server at 127.0.0.1:5432 failed: Connection refused"],
+            argv=[sys.executable, "app.py"])
+        assert diagnose_start_failure(orchestrator, service) == [
+            "it connects to db (port 5432), which it doesn't depend on: add `depends_on: {db: service_healthy}`",
+            "Python can't import flask: install the service's dependencies (`omni-run install api`) and check "
+            "which interpreter runs it"]
+
+    def test_node_hints(self, temp_dir, omni_runner):
+        """Test connecting to a dependency before it is ready, and a missing Node module."""
+        from omni_run import diagnose_start_failure
+
+        orchestrator = self._dependencies(temp_dir, omni_runner)
+        service = failed(orchestrator, "web", ["Error: connect ECONNREFUSED 127.0.0.1:5432",
+                                               "Error: Cannot find module 'express'"], argv=["node", "-v"])
+        hints = diagnose_start_failure(orchestrator, service)
+        assert hints[-2].startswith("it connects to db (port 5432) before db accepts connections")
+        assert hints[-1].startswith("Node can't find express")
+
+    def test_killed_by_signal(self, temp_dir, omni_runner):
+        """Test a service killed by a signal without any output."""
+        from omni_run import diagnose_start_failure
+
+        orchestrator = self._dependencies(temp_dir, omni_runner)
+        service = failed(orchestrator, "web", [], -9, argv=["node"])
+        service.output.clear()
+        assert diagnose_start_failure(orchestrator, service)[-1].startswith("it was killed with SIGKILL")
+
+
+class TestFlakyStarts:
+    """Tests for `up` and `status`."""
+
+    def _failing(self, temp_dir):
+        (temp_dir / "app.py").write_text("import sys\nprint('ModuleNotFoundError: No module named \\'yaml2\\'')\n"
+                                         "sys.exit(3)\n")
+        write_manifest(temp_dir, f"""
+services:
+  api:
+    command: ["{sys.executable}", app.py]
+    restart: {{policy: on-failure, max_restarts: 1, backoff: 50ms, jitter: 0}}
+""")
+        return ["-C", str(temp_dir)]
+
+    def _failed_twice(self, temp_dir, capsys):
+        from omni_run import run_subcommand
+
+        root = self._failing(temp_dir)
+        assert run_subcommand(["up"] + root) == 1
+        assert run_subcommand(["up"] + root) == 1
+        capsys.readouterr()
+        return root
+
+    def test_up_prints_hints(self, temp_dir, capsys):
+        """Test that hints are printed once, after the third failed start in a row."""
+        from omni_run import run_subcommand, ANSI_ESCAPE
+
+        root = self._failing(temp_dir)
+        assert run_subcommand(["up"] + root) == 1
+        out = ANSI_ESCAPE.sub("", capsys.readouterr().out)
+        assert "diagnostics" not in out  # Two failed starts so far
+
+        assert run_subcommand(["up"] + root) == 1
+        out = ANSI_ESCAPE.sub("", capsys.readouterr().out)
+        assert out.count("failed to start 3 times in a row; diagnostics:") == 1
+        assert "  - Python can't import yaml2: install the service's dependencies (`omni-run install api`)" in out
+
+    def test_outcomes_recorded(self, temp_dir, capsys):
+        """Test the recorded starts, and that hints go with the start that printed them."""
+        from omni_run import StateStore, WORKSPACE_DIR
+
+        self._failed_twice(temp_dir, capsys)
+        store = StateStore.open(temp_dir / WORKSPACE_DIR)
+        assert store.start_failures("api") == 4
+        assert [s["exit_code"] for s in store.startups("api", limit=10)] == [3, 3, 3, 3]
+        assert store.startups("api")[-1]["hints"] == []  # Hints go with the start that printed them
+        assert store.startups("api")[-2]["hints"][0].startswith("Python can't import yaml2")
+        store.close()
+
+    def test_status_shows_hints(self, temp_dir, capsys):
+        """Test that `status` lists a service failing to start and its hints."""
+        from omni_run import run_subcommand, ANSI_ESCAPE
+
+        run_subcommand(["status"] + self._failed_twice(temp_dir, capsys))
+        out = ANSI_ESCAPE.sub("", capsys.readouterr().out)
+        assert "Failing to start:" in out and "4 start(s) in a row failed, last with exit code 3" in out
+        assert "- Python can't import yaml2" in out
+
+    def test_good_start_resets(self, temp_dir, capsys):
+        """Test that a good start resets the failures in a row."""
+        from omni_run import run_subcommand, StateStore, WORKSPACE_DIR
+
+        root = self._failed_twice(temp_dir, capsys)
+        write_manifest(temp_dir, f"services:\n  api: {{command: ['{sys.executable}', '-c', 'pass']}}\n")
+        assert run_subcommand(["up"] + root) == 0
+        store = StateStore.open(temp_dir / WORKSPACE_DIR)
+        assert store.start_failures("api") == 0
+        store.close()
@@ -7,6 +7,10 @@ This module tests:
 - Framework detection
 - Environment detection
 - Task runner detection
+- Maven and Gradle launch strategies
+- .NET project, solution and published-output launches
+- PHP (Laravel, Symfony, built-in server) and Ruby (Rails, Rack) launches
+- Static sites served by `omni-run static`
 """
 
 import os
@@ -430,3 +434,320 @@ class TestRelativePathCalculation:
         app_prog = next(p for p in programs if p.name == "app.py")
         assert app_prog.relative_path == "src/app.py"
 
+
+
+class TestRuntimeDetection:
+    """Tests for project-level runtime detection and launch plans."""
+    
+    def test_detect_cargo_project(self, rust_simple_program, omni_runner):
+        """Test that a Cargo.toml is detected as a Rust runtime."""
+        plan = omni_runner.detect_runtime(rust_simple_program.parent)
+        
+        assert plan is not None
+        assert plan.runtime == "rust"
+        assert plan.command[:2] == ["cargo", "run"]
+        assert "Cargo.toml" in plan.markers
+    
+    def test_cargo_binary_from_bin_section(self, temp_dir, omni_runner):
+        """Test that the binary name is resolved from [[bin]] targets."""
+        (temp_dir / "Cargo.toml").write_text('''
+[package]
+name = "workspace-tools"
+version = "0.1.0"
+
+[[bin]]
+name = "api-server"
+path = "src/bin/api.rs"
+''')
+        plan = omni_runner.detect_runtime(temp_dir)
+        
+        assert plan.command == ["cargo", "run", "--bin", "api-server"]
+        assert plan.binary.name == "api-server"
+    
+    def test_cargo_release_runs_built_binary(self, temp_dir, omni_runner):
+        """Test that release mode builds once and runs the compiled binary."""
+        (temp_dir / "Cargo.toml").write_text('[package]\nname = "fast-app"\nversion = "0.1.0"\n')
+        omni_runner.config['rust_release'] = True
+        
+        plan = omni_runner.detect_runtime(temp_dir)
+        
+        assert plan.build_command == ["cargo", "build", "--release"]
+        assert plan.command == [str(temp_dir.resolve() / "target" / "release" / "fast-app")]
+    
+    def test_port_injection_matches_go(self, go_simple_program, omni_runner):
+        """Test that Go plans receive the same PORT and health URL wiring."""
+        omni_runner.config['port'] = 8081
+        
+        plan = omni_runner.detect_runtime(go_simple_program.parent)
+        
+        assert plan.runtime == "go"
+        assert plan.env["PORT"] == "8081"
+        assert plan.health_url == "http://127.0.0.1:8081/health"
+    
+    def test_no_runtime_for_plain_scripts(self, python_simple_script, omni_runner):
+        """Test that directories without runtime markers yield no plan."""
+        assert omni_runner.detect_runtime(python_simple_script.parent) is None
+
+
+def write_jar(path: Path, main_class=None):
+    import zipfile
+    path.parent.mkdir(parents=True, exist_ok=True)
+    with zipfile.ZipFile(path, "w") as jar:
+        manifest = "Manifest-Version: 1.0\n" + (f"Main-Class: {main_class}\n" if main_class else "")
+        jar.writestr("META-INF/MANIFEST.MF", manifest)
+
+
+class TestJvmDetection:
+    """Tests for Maven and Gradle run strategies."""
+
+    def test_spring_boot_maven_uses_wrapper(self, temp_dir, omni_runner, monkeypatch):
+        """Test that a Spring Boot pom runs spring-boot:run through mvnw with JAVA_OPTS as jvmArguments."""
+        monkeypatch.setenv("JAVA_OPTS", "-Xmx256m -Dfoo=bar")
+        (temp_dir / "pom.xml").write_text("<project><parent><artifactId>spring-boot-starter-parent</artifactId>"
+                                          "</parent></project>")
+        (temp_dir / "mvnw").write_text("#!/bin/sh\n")
+
+        plan = omni_runner.detect_runtime(temp_dir)
+
+        assert plan.runtime == "java"
+        assert plan.command == ["./mvnw", "spring-boot:run", "-Dspring-boot.run.jvmArguments=-Xmx256m -Dfoo=bar"]
+        assert plan.markers == ["pom.xml"]
+        assert plan.env["JAVA_OPTS"] == "-Xmx256m -Dfoo=bar"
+
+    def test_gradle_application_run(self, temp_dir, omni_runner, monkeypatch):
+        """Test that the Gradle application plugin runs `gradle run`, with an init script for JAVA_OPTS."""
+        import omni_run
+
+        script = temp_dir / "home" / "java-opts.gradle"
+        monkeypatch.setattr(omni_run, "JAVA_OPTS_INIT_SCRIPT", script)
+        monkeypatch.delenv("JAVA_OPTS", raising=False)
+        (temp_dir / "build.gradle.kts").write_text('plugins {\n    application\n}\napplication {\n'
+                                                   '    mainClass.set("com.example.AppKt")\n}\n')
+
+        assert omni_runner.detect_runtime(temp_dir).command == ["gradle", "run"]
+        assert not script.exists()
+
+        omni_runner.config["java_opts"] = "-Xss2m"
+        plan = omni_runner.detect_runtime(temp_dir)
+        assert plan.command == ["gradle", "--init-script", str(script), "run"]
+        assert "tasks.withType(JavaExec)" in script.read_text()
+        assert plan.env["JAVA_OPTS"] == "-Xss2m"
+
+    def test_built_jar(self, temp_dir, omni_runner, monkeypatch):
+        """Test that a built jar runs with `java -jar`, or `-cp` and the declared main class if not executable."""
+        monkeypatch.setenv("JAVA_OPTS", "-Xmx1g")
+        (temp_dir / "pom.xml").write_text("<project><artifactId>tool</artifactId></project>")
+        write_jar(temp_dir / "target" / "tool-1.0.jar", "com.example.Tool")
+        write_jar(temp_dir / "target" / "tool-1.0-sources.jar")
+
+        plan = omni_runner.detect_runtime(temp_dir)
+        assert plan.command == ["java", "-Xmx1g", "-jar", str(temp_dir.resolve() / "target" / "tool-1.0.jar")]
+
+        gradle = temp_dir / "lib"
+        (gradle / "build.gradle").parent.mkdir()
+        (gradle / "build.gradle").write_text("jar {\n    manifest { attributes('Built-By': 'me') }\n}\n"
+                                             "ext.mainClassName = 'org.acme.Main'\n")
+        write_jar(gradle / "build" / "libs" / "lib.jar")
+        plan = omni_runner.detect_runtime(gradle)
+        assert plan.command == ["java", "-Xmx1g", "-cp", str(gradle.resolve() / "build" / "libs" / "lib.jar"),
+                                "org.acme.Main"]
+
+    def test_maven_exec_with_scanned_main_class(self, temp_dir, omni_runner, monkeypatch):
+        """Test that without a jar the main class is found in src/main/java and run with exec:java."""
+        monkeypatch.delenv("JAVA_OPTS", raising=False)
+        omni_runner.config["java_opts"] = "-ea"
+        (temp_dir / "pom.xml").write_text("<project><artifactId>app</artifactId></project>")
+        source = temp_dir / "src" / "main" / "java" / "com" / "example"
+        source.mkdir(parents=True)
+        (source / "Util.java").write_text("package com.example;\nclass Util {}\n")
+        (source / "App.java").write_text("package com.example;\npublic class App {\n"
+                                         "    public static void main(String[] args) {}\n}\n")
+
+        plan = omni_runner.detect_runtime(temp_dir)
+
+        assert plan.command == ["mvn", "-q", "compile", "exec:java", "-Dexec.mainClass=com.example.App"]
+        assert plan.env["MAVEN_OPTS"] == "-ea"
+
+    def test_library_is_not_runnable(self, temp_dir, omni_runner):
+        """Test that a pom without a main class or jar yields no plan."""
+        (temp_dir / "pom.xml").write_text("<project><packaging>pom</packaging><modules><module>a</module></modules></project>")
+
+        assert omni_runner.detect_runtime(temp_dir) is None
+
+
+WEB_CSPROJ = '<Project Sdk="Microsoft.NET.Sdk.Web">\n  <PropertyGroup>\n    <TargetFramework>net8.0</TargetFramework>\n  </PropertyGroup>\n</Project>\n'
+LIB_CSPROJ = '<Project Sdk="Microsoft.NET.Sdk">\n  <PropertyGroup>\n    <TargetFramework>net8.0</TargetFramework>\n  </PropertyGroup>\n</Project>\n'
+
+
+class TestDotnetDetection:
+    """Tests for .NET project detection and launch."""
+
+    def test_web_project_runs_with_aspnetcore_urls(self, temp_dir, omni_runner):
+        """Test that a web .csproj runs `dotnet run` and an injected port reaches ASPNETCORE_URLS."""
+        (temp_dir / "Api.csproj").write_text(WEB_CSPROJ)
+        omni_runner.config["port"] = 5123
+
+        plan = omni_runner.detect_runtime(temp_dir)
+
+        assert plan.runtime == "dotnet"
+        assert plan.command == ["dotnet", "run"]
+        assert plan.markers == ["Api.csproj"]
+        assert plan.env["PORT"] == "5123"
+        assert plan.env["ASPNETCORE_URLS"] == "http://localhost:5123"
+
+    def test_solution_picks_first_runnable_project(self, temp_dir, omni_runner):
+        """Test that a .sln runs its first non-library project, under dotnet watch in watch mode."""
+        for name, content in [("Core", LIB_CSPROJ), ("Api", WEB_CSPROJ)]:
+            (temp_dir / "src" / name).mkdir(parents=True)
+            (temp_dir / "src" / name / f"{name}.csproj").write_text(content)
+        (temp_dir / "Shop.sln").write_text(
+            'Microsoft Visual Studio Solution File, Format Version 12.00\n'
+            'Project("{FAE04EC0-301F-11D3-BF4B-00C04F79EFBC}") = "Core", "src\\Core\\Core.csproj", "{1}"\nEndProject\n'
+            'Project("{FAE04EC0-301F-11D3-BF4B-00C04F79EFBC}") = "Api", "src\\Api\\Api.csproj", "{2}"\nEndProject\n')
+
+        assert omni_runner.detect_runtime(temp_dir).command == ["dotnet", "run", "--project", "src/Api/Api.csproj"]
+        omni_runner.config["watch_mode"] = True
+        assert omni_runner.detect_runtime(temp_dir).command == ["dotnet", "watch", "--project", "src/Api/Api.csproj", "run"]
+        assert omni_runner.detect_runtime(temp_dir / "src" / "Core") is None
+
+    def test_published_output(self, temp_dir, omni_runner):
+        """Test that published output runs as `dotnet <app>.dll`, by itself or when dotnet_published is set."""
+        (temp_dir / "Worker.csproj").write_text('<Project Sdk="Microsoft.NET.Sdk">\n  <PropertyGroup>\n'
+                                                '    <OutputType>Exe</OutputType>\n  </PropertyGroup>\n</Project>\n')
+        publish = temp_dir / "bin" / "Release" / "net8.0" / "publish"
+        publish.mkdir(parents=True)
+        (publish / "My.Worker.dll").write_bytes(b"MZ")
+        (publish / "My.Worker.runtimeconfig.json").write_text("{}")
+
+        assert omni_runner.detect_runtime(temp_dir).command == ["dotnet", "run"]
+        omni_runner.config["dotnet_published"] = True
+        plan = omni_runner.detect_runtime(temp_dir)
+        assert plan.command == ["dotnet", str(publish / "My.Worker.dll")]
+        assert plan.cwd == publish
+        assert omni_runner.detect_runtime(publish).command == ["dotnet", str(publish / "My.Worker.dll")]
+
+    def test_workspace_discovery_matches_globs(self, temp_dir):
+        """Test that workspace discovery finds projects by glob markers such as *.csproj."""
+        from omni_run import OmniRun, WorkspaceDiscovery
+
+        (temp_dir / "svc").mkdir()
+        (temp_dir / "svc" / "Svc.csproj").write_text(WEB_CSPROJ)
+
+        projects = WorkspaceDiscovery(OmniRun(str(temp_dir)), temp_dir).discover()
+        assert [p.rel for p in projects] == ["svc"]
+        assert (projects[0].runtime, projects[0].command) == ("dotnet", ["dotnet", "run"])
+
+
+class TestPhpRubyDetection:
+    """Tests for Composer and Bundler project detection and launch."""
+
+    def write_composer(self, path: Path, require):
+        import json
+        path.mkdir(parents=True, exist_ok=True)
+        (path / "composer.json").write_text(json.dumps({"require": require}))
+
+    def test_laravel(self, temp_dir, omni_runner):
+        """Test artisan serve for Laravel, given the allocated port when there is one."""
+        from omni_run import dev_server_port_args
+
+        self.write_composer(temp_dir, {"laravel/framework": "^11.0"})
+        (temp_dir / "artisan").write_text("<?php\n")
+        plan = omni_runner.detect_runtime(temp_dir)
+        assert (plan.runtime, plan.command, plan.dev_server) == ("php", ["php", "artisan", "serve"], "artisan")
+        assert dev_server_port_args(plan, {"PORT": "8123"}) == ["--host", "127.0.0.1", "--port", "8123"]
+        assert dev_server_port_args(plan, {}) == []
+
+    def _symfony(self, temp_dir):
+        self.write_composer(temp_dir, {"symfony/framework-bundle": "^7.0"})
+        (temp_dir / "public").mkdir()
+        (temp_dir / "public" / "index.php").write_text("<?php\n")
+
+    def test_symfony_serve(self, temp_dir, omni_runner, monkeypatch):
+        """Test symfony serve when the symfony CLI is installed."""
+        import shutil
+        from omni_run import dev_server_port_args
+
+        self._symfony(temp_dir)
+        monkeypatch.setattr(shutil, "which", lambda name: "/usr/bin/" + name)
+        plan = omni_runner.detect_runtime(temp_dir)
+        assert plan.command == ["symfony", "serve"]
+        assert dev_server_port_args(plan, {"PORT": "9000"}) == ["--no-tls", "--port", "9000"]
+
+    def test_php_built_in_server(self, temp_dir, omni_runner, monkeypatch):
+        """Test PHP's built-in server for public/ without the symfony CLI, on its default port."""
+        import shutil
+        from omni_run import dev_server_port_args
+
+        self._symfony(temp_dir)
+        monkeypatch.setattr(shutil, "which", lambda name: None)
+        plan = omni_runner.detect_runtime(temp_dir)
+        assert plan.command == ["php", "-t", "public"]
+        assert dev_server_port_args(plan, {}) == ["-S", "127.0.0.1:8000"]
+
+    def test_php_library(self, temp_dir, omni_runner):
+        """Test that a composer.json without a framework or public/ isn't runnable."""
+        self.write_composer(temp_dir, {"php": ">=8.1"})
+        assert omni_runner.detect_runtime(temp_dir) is None
+
+    def test_rails(self, temp_dir, omni_runner):
+        """Test rails server through bundle exec, or bin/rails when the project has it."""
+        from omni_run import dev_server_port_args
+
+        (temp_dir / "Gemfile").write_text('source "https://rubygems.org"\ngem "rails", "~> 7.1"\n')
+        plan = omni_runner.detect_runtime(temp_dir)
+        assert (plan.runtime, plan.command) == ("ruby", ["bundle", "exec", "rails", "server"])
+        assert plan.env["RAILS_ENV"] == "development"
+        assert dev_server_port_args(plan, {"PORT": "3001"}) == ["-p", "3001", "-b", "127.0.0.1"]
+        (temp_dir / "bin").mkdir()
+        (temp_dir / "bin" / "rails").write_text("#!/usr/bin/env ruby\n")
+        assert omni_runner.detect_runtime(temp_dir).command == ["bin/rails", "server"]
+
+    def test_rackup(self, temp_dir, omni_runner):
+        """Test rackup for a config.ru, and nothing for a Gemfile without a server."""
+        (temp_dir / "Gemfile").write_text("gem 'sinatra'\n")
+        (temp_dir / "config.ru").write_text("run App\n")
+        plan = omni_runner.detect_runtime(temp_dir)
+        assert (plan.command, plan.dev_server) == (["bundle", "exec", "rackup"], "rackup")
+        assert (plan.env["RACK_ENV"], plan.env["APP_ENV"]) == ("development", "development")
+
+        (temp_dir / "config.ru").unlink()
+        assert omni_runner.detect_runtime(temp_dir) is None
+
+    def test_service_launch(self, temp_dir, omni_runner):
+        """Test that a service's allocated port reaches the server, and the built-in server's default without one."""
+        from omni_run import load_manifest, Orchestrator
+
+        self.write_composer(temp_dir / "site", {})
+        (temp_dir / "site" / "index.php").write_text("<?php echo 'hi';\n")
+        manifest = temp_dir / "omni-run.yaml"
+        manifest.write_text("services:\n  site: {path: site, ports: {http: 8090}}\n  plain: {path: site}\n")
+        orchestrator = Orchestrator(omni_runner, load_manifest(manifest))
+        services = orchestrator.manifest.services
+        argv, _, env = orchestrator.resolve_launch(services["site"], {"http": 8090})
+        assert argv == ["php", "-S", "127.0.0.1:8090"] and env["PORT"] == "8090"
+        assert orchestrator.resolve_launch(services["plain"])[0] == ["php", "-S", "127.0.0.1:8000"]
+
+
+class TestStaticSiteDetection:
+    """Tests for plain static sites."""
+
+    def test_detect_and_launch(self, temp_dir, omni_runner):
+        """Test the serve launch for an index.html, framework projects taking precedence, and the port reaching it."""
+        from omni_run import load_manifest, Orchestrator, self_command
+
+        site = temp_dir / "site"
+        site.mkdir()
+        (site / "index.html").write_text("<h1>hi</h1>\n")
+        plan = omni_runner.detect_runtime(site)
+        assert (plan.runtime, plan.command, plan.cwd) == ("static", self_command() + ["static", "."], site)
+        assert omni_runner.detect_runtime(temp_dir) is None
+
+        (site / "package.json").write_text('{"scripts": {"dev": "vite"}, "devDependencies": {"vite": "^5.0"}}')
+        assert omni_runner.detect_runtime(site).runtime == "node"
+        (site / "package.json").unlink()
+
+        manifest = temp_dir / "omni-run.yaml"
+        manifest.write_text("services:\n  web: {path: site, ports: {http: 8091}}\n")
+        orchestrator = Orchestrator(omni_runner, load_manifest(manifest))
+        argv, cwd, env = orchestrator.resolve_launch(orchestrator.manifest.services["web"], {"http": 8091})
+        assert argv[-2:] == ["static", "."] and cwd == site and env["PORT"] == "8091"
@@ -0,0 +1,291 @@
+"""
+Tests for .env loading and layered environment resolution in OmniRun.
+
+This module tests:
+- .env parsing (quotes, comments, export, multi-line values)
+- ${VAR} expansion
+- Layer precedence (.env, .env.local, .env.<profile>, manifest overrides)
+- The `env --resolve` and `exec` commands
+- `env --diff` against the environment recorded by the last run, with secrets redacted
+"""
+
+import sys
+import pytest
+from pathlib import Path
+
+from conftest import *
+
+
+class TestDotenvParsing:
+    """Tests for parsing individual .env files."""
+
+    def test_parse_basic(self, temp_dir):
+        """Test comments, export prefixes and inline comments."""
+        from omni_run import parse_dotenv
+
+        env_file = temp_dir / ".env"
+        env_file.write_text("# comment\nexport A=1\nB = two words # trailing\n\nC=\n")
+
+        assert parse_dotenv(env_file) == [("A", "1", True), ("B", "two words", True), ("C", "", True)]
+
+    def test_parse_quotes(self, temp_dir):
+        """Test single quotes stay literal and double quotes handle escapes."""
+        from omni_run import parse_dotenv
+
+        env_file = temp_dir / ".env"
+        env_file.write_text("A='${NOPE} # kept'\nB=\"line1\\nline2\"\nC=\"multi\nline\"\n")
+
+        entries = {k: (v, expand) for k, v, expand in parse_dotenv(env_file)}
+        assert entries["A"] == ("${NOPE} # kept", False)
+        assert entries["B"] == ("line1\nline2", True)
+        assert entries["C"] == ("multi\nline", True)
+
+    def test_expansion(self):
+        """Test ${VAR}, ${VAR:-default}, $VAR and escaped dollars."""
+        from omni_run import expand_env_references
+
+        env = {"HOST": "localhost", "EMPTY": ""}
+
+        assert expand_env_references("http://${HOST}:${PORT:-8080}", env) == "http://localhost:8080"
+        assert expand_env_references("$HOST/${EMPTY:-x}", env) == "localhost/x"
+        assert expand_env_references("\\$HOST ${MISSING}", env) == "$HOST "
+
+
+class TestEnvironmentLayering:
+    """Tests for merging environment layers."""
+
+    def test_layer_precedence(self, temp_dir):
+        """Test that later layers win and references see earlier layers."""
+        from omni_run import OmniRun
+
+        (temp_dir / ".env").write_text("A=base\nB=${A}-b\n")
+        (temp_dir / ".env.local").write_text("A=local\n")
+        (temp_dir / ".env.staging").write_text("C=${A}\n")
+        launcher = OmniRun(str(temp_dir))
+        launcher.profile = "staging"
+
+        resolver = launcher.resolve_environment()
+
+        assert resolver.env["A"] == "local"
+        assert resolver.env["B"] == "base-b"
+        assert resolver.env["C"] == "local"
+        assert resolver.sources["C"] == ".env.staging"
+        assert [f.name for f in resolver.files] == [".env", ".env.local", ".env.staging"]
+
+    def test_profile_layers_ignored_without_profile(self, temp_dir):
+        """Test that .env.<profile> only applies when that profile is active."""
+        from omni_run import OmniRun
+
+        (temp_dir / ".env.prod").write_text("A=prod\n")
+        launcher = OmniRun(str(temp_dir))
+        launcher.profile = None
+
+        assert "A" not in launcher.resolve_environment().overridden()
+
+    def test_manifest_overrides(self, temp_dir):
+        """Test that env_file and env in the manifest override .env layers."""
+        from omni_run import OmniRun, load_manifest, Orchestrator
+
+        (temp_dir / ".env").write_text("DB_HOST=db\nLEVEL=info\n")
+        (temp_dir / "api").mkdir()
+        (temp_dir / "api" / "secrets.env").write_text("TOKEN=abc\n")
+        (temp_dir / "omni-run.yaml").write_text("""
+services:
+  api:
+    path: api
+    command: "true"
+    env_file: secrets.env
+    env:
+      LEVEL: debug
+      DATABASE_URL: postgres://${DB_HOST}/app
+""")
+        manifest = load_manifest(temp_dir / "omni-run.yaml")
+        orchestrator = Orchestrator(OmniRun(str(temp_dir)), manifest)
+
+        resolver = orchestrator.resolve_env(manifest.services["api"])
+
+        assert resolver.env["TOKEN"] == "abc"
+        assert resolver.env["LEVEL"] == "debug"
+        assert resolver.env["DATABASE_URL"] == "postgres://db/app"
+        assert resolver.sources["LEVEL"] == "manifest"
+
+    def test_missing_env_file(self, temp_dir):
+        """Test that a missing env_file is a manifest error."""
+        from omni_run import load_manifest, ManifestError
+
+        (temp_dir / "omni-run.yaml").write_text("services:\n  api:\n    command: 'true'\n    env_file: nope.env\n")
+
+        with pytest.raises(ManifestError, match="services.api.env_file"):
+            load_manifest(temp_dir / "omni-run.yaml")
+
+
+class TestEnvCommand:
+    """Tests for `omni-run env`."""
+
+    def test_resolve_prints_sources(self, temp_dir, capsys):
+        """Test that --resolve prints merged values with their source."""
+        from omni_run import run_subcommand
+
+        (temp_dir / ".env").write_text("GREETING='hello world'\n")
+
+        assert run_subcommand(["env", "--resolve", "-C", str(temp_dir)]) == 0
+        out = capsys.readouterr().out
+        assert "GREETING='hello world'" in out
+        assert "# .env" in out
+
+    def test_lists_layers(self, temp_dir, capsys):
+        """Test that plain `env` lists the files in precedence order."""
+        from omni_run import run_subcommand
+
+        (temp_dir / ".env").write_text("A=1\n")
+        (temp_dir / ".env.dev").write_text("A=2\n")
+
+        assert run_subcommand(["env", "--profile", "dev", "-C", str(temp_dir)]) == 0
+        out = capsys.readouterr().out
+        assert out.index(".env\n") < out.index(".env.dev")
+
+    def test_service_named_diff(self, temp_dir, capsys):
+        """Test that a service called `diff` resolves like any other."""
+        from omni_run import run_subcommand
+
+        (temp_dir / "omni-run.yaml").write_text("services:\n  diff:\n    command: 'true'\n    env: {MODE: side-by-side}\n")
+
+        assert run_subcommand(["env", "diff", "--resolve", "-C", str(temp_dir)]) == 0
+        assert "MODE=side-by-side" in capsys.readouterr().out
+
+    def _recorded(self, temp_dir, omni_runner, capsys):
+        from omni_run import load_manifest, Orchestrator
+
+        manifest = temp_dir / "omni-run.yaml"
+        manifest.write_text(f"services:\n  api:\n    command: [\"{sys.executable}\", \"-c\", \"pass\"]\n"
+                            "    env: {LOG_LEVEL: info, OLD_FLAG: '1', API_TOKEN: first}\n")
+        Orchestrator(omni_runner, load_manifest(manifest), state_dir=temp_dir / ".omni-run").up()
+        capsys.readouterr()
+        return manifest
+
+    def _changed(self, temp_dir, omni_runner, capsys):
+        manifest = self._recorded(temp_dir, omni_runner, capsys)
+        manifest.write_text(manifest.read_text().replace("info", "debug").replace("OLD_FLAG: '1'", "NEW_FLAG: '2'")
+                            .replace("first", "second"))
+
+    def test_diff_without_recorded_run(self, temp_dir, capsys):
+        """Test that --diff before any `up` says there is nothing to compare with."""
+        from omni_run import run_subcommand
+
+        (temp_dir / "omni-run.yaml").write_text("services:\n  api:\n    command: 'true'\n")
+        assert run_subcommand(["env", "--diff", "-C", str(temp_dir)]) == 1
+        assert "No recorded run" in capsys.readouterr().out
+
+    def test_diff_without_changes(self, temp_dir, omni_runner, capsys):
+        """Test a service whose environment is the one it last started with."""
+        from omni_run import run_subcommand
+
+        self._recorded(temp_dir, omni_runner, capsys)
+        assert run_subcommand(["env", "--diff", "api", "-C", str(temp_dir)]) == 0
+        assert "  no changes" in capsys.readouterr().out
+
+    def test_diff_with_last_run(self, temp_dir, omni_runner, capsys):
+        """Test added, removed and changed variables since `up`, with a changed secret masked."""
+        from omni_run import run_subcommand, ANSI_ESCAPE
+
+        self._changed(temp_dir, omni_runner, capsys)
+        assert run_subcommand(["env", "--diff", "-C", str(temp_dir)]) == 0
+        out = ANSI_ESCAPE.sub("", capsys.readouterr().out)
+        assert out.startswith("api (last started ")
+        assert "  ~ API_TOKEN=****** (changed)\n  ~ LOG_LEVEL=info -> debug\n  + NEW_FLAG=2\n  - OLD_FLAG=1\n" in out
+        assert "first" not in out and "second" not in out
+
+    def test_diff_json(self, temp_dir, omni_runner, capsys):
+        """Test the changes as JSON, sorted by key, with the secret's values masked."""
+        import json
+        from omni_run import run_subcommand, SECRET_MASK
+
+        self._changed(temp_dir, omni_runner, capsys)
+        assert run_subcommand(["env", "--diff", "--output", "json", "-C", str(temp_dir)]) == 0
+        changes = json.loads(capsys.readouterr().out)["services"]["api"]["changes"]
+        assert changes[0] == {"change": "changed", "key": "API_TOKEN", "secret": True,
+                              "previous": SECRET_MASK, "current": SECRET_MASK}
+        assert [c["key"] for c in changes] == ["API_TOKEN", "LOG_LEVEL", "NEW_FLAG", "OLD_FLAG"]
+
+    def test_diff_unknown_service(self, temp_dir, omni_runner, capsys):
+        """Test that --diff for a service the manifest doesn't have fails."""
+        from omni_run import run_subcommand
+
+        self._recorded(temp_dir, omni_runner, capsys)
+        assert run_subcommand(["env", "--diff", "nope", "-C", str(temp_dir)]) == 1
+
+    @pytest.mark.skipif(sys.platform == "win32", reason="Checks POSIX file permissions")
+    def test_recorded_secret_is_keyed(self, temp_dir, omni_runner):
+        """Test that a secret is recorded as an HMAC under the workspace's own key, not a plain hash."""
+        import hashlib
+        import hmac
+        from omni_run import load_manifest, Orchestrator, StateStore
+
+        manifest = temp_dir / "omni-run.yaml"
+        manifest.write_text(f"services:\n  api:\n    command: [\"{sys.executable}\", \"-c\", \"pass\"]\n"
+                            "    env: {API_TOKEN: first}\n")
+        Orchestrator(omni_runner, load_manifest(manifest), state_dir=temp_dir / ".omni-run").up()
+        key_file = temp_dir / ".omni-run" / "env.key"
+        assert key_file.stat().st_mode & 0o777 == 0o600
+        key = bytes.fromhex(key_file.read_text().strip())
+        recorded = StateStore.open(temp_dir / ".omni-run").env("api")["values"]["API_TOKEN"]
+        assert recorded == "hmac-sha256:" + hmac.new(key, b"first", hashlib.sha256).hexdigest()
+        assert hashlib.sha256(b"first").hexdigest() not in recorded
+
+
+class TestExecCommand:
+    """Tests for `omni-run exec`."""
+
+    def _manifest(self, temp_dir):
+        (temp_dir / "api").mkdir()
+        (temp_dir / "api" / ".env").write_text("DATABASE_URL=postgres://localhost/app\n")
+        (temp_dir / "omni-run.yaml").write_text("""
+services:
+  api:
+    path: api
+    command: "true"
+    env:
+      MODE: dev
+    ports:
+      http: 8123
+""")
+
+    def test_runs_with_service_environment(self, temp_dir):
+        """Test that the command gets the service's env, working directory and ports."""
+        import json
+        from omni_run import run_subcommand
+
+        self._manifest(temp_dir)
+        out = temp_dir / "out.json"
+        script = (f"import json, os; json.dump({{'cwd': os.getcwd(), 'env': dict(os.environ)}}, "
+                  f"open({str(out)!r}, 'w')); raise SystemExit(3)")
+
+        assert run_subcommand(["exec", "-C", str(temp_dir), "api", "--", sys.executable, "-c", script]) == 3
+        seen = json.loads(out.read_text())
+        assert Path(seen["cwd"]).resolve() == (temp_dir / "api").resolve()
+        assert seen["env"]["DATABASE_URL"] == "postgres://localhost/app"
+        assert seen["env"]["MODE"] == "dev"
+        assert seen["env"]["PORT_HTTP"] == "8123"
+        assert seen["env"]["OMNI_RUN_SERVICE"] == "api"
+
+    def test_uses_ports_of_running_stack(self, temp_dir):
+        """Test that ports recorded by a running supervisor are injected."""
+        import json
+        from omni_run import run_subcommand
+
+        self._manifest(temp_dir)
+        (temp_dir / ".omni-run").mkdir()
+        (temp_dir / ".omni-run" / "state.json").write_text(json.dumps({"services": {"api": {"ports": {"http": 9345}}}}))
+        out = temp_dir / "port.txt"
+        script = f"import os; open({str(out)!r}, 'w').write(os.environ['PORT'])"
+
+        assert run_subcommand(["exec", "-C", str(temp_dir), "api", "--", sys.executable, "-c", script]) == 0
+        assert out.read_text() == "9345"
+
+    def test_unknown_service(self, temp_dir, capsys):
+        """Test that an unknown service is reported."""
+        from omni_run import run_subcommand
+
+        self._manifest(temp_dir)
+        assert run_subcommand(["exec", "-C", str(temp_dir), "web", "--", "true"]) == 1
+        assert "Unknown service 'web'" in capsys.readouterr().out
@@ -0,0 +1,258 @@
+"""
+Tests for lifecycle events and notifications in OmniRun.
+
+This module tests:
+- The event bus and event payloads
+- Notification sink configuration, event and service filters
+- Webhook, Slack and Discord delivery, retries and the end-of-run summary
+- Desktop notifier selection
+- Events published and recorded to .omni-run/events.jsonl during `up`
+- The `omni-run events` subcommand
+"""
+
+import sys
+import json
+import time
+import threading
+import pytest
+from pathlib import Path
+
+from conftest import *
+
+
+def event(type="crashed", service="api", message="exited with code 1"):
+    from omni_run import LifecycleEvent
+    return LifecycleEvent(type=type, service=service, message=message, pid=42, exit_code=1)
+
+
+class CaptureServer:
+    """A local HTTP server that records POST bodies as JSON, optionally failing every request."""
+
+    def __init__(self, status=204):
+        from http.server import BaseHTTPRequestHandler, HTTPServer
+        bodies = self.bodies = []
+
+        class Handler(BaseHTTPRequestHandler):
+            def do_POST(self):
+                bodies.append(json.loads(self.rfile.read(int(self.headers["Content-Length"]))))
+                self.send_response(status)
+                self.end_headers()
+
+            def log_message(self, *args):
+                pass
+
+        self.server = HTTPServer(("127.0.0.1", 0), Handler)
+        self.url = f"http://127.0.0.1:{self.server.server_port}"
+        threading.Thread(target=self.server.serve_forever, daemon=True).start()
+
+    def close(self):
+        self.server.shutdown()
+        self.server.server_close()
+
+
+class TestEventBus:
+    """Tests for publishing events."""
+
+    def test_subscribers_and_payload(self):
+        """Test that every subscriber gets each event even when one raises, and payloads round-trip."""
+        from omni_run import EventBus, LifecycleEvent
+
+        bus, seen = EventBus(), []
+
+        def broken(e):
+            raise RuntimeError("boom")
+
+        bus.subscribe(broken)
+        bus.subscribe(seen.append)
+        bus.publish(event())
+        bus.unsubscribe(seen.append)
+        bus.publish(event("healthy"))
+        assert [e.type for e in seen] == ["crashed"]
+
+        payload = seen[0].payload()
+        assert (payload["type"], payload["service"], payload["pid"], payload["exit_code"]) == ("crashed", "api", 42, 1)
+        assert LifecycleEvent.from_payload(json.loads(json.dumps(payload))).payload() == payload
+        assert seen[0].describe() == "api crashed: exited with code 1"
+
+
+class TestNotificationSinks:
+    """Tests for configuring and delivering notifications."""
+
+    def test_config_and_filters(self, temp_dir):
+        """Test defaults per type, event and service filters, and configuration errors."""
+        from omni_run import create_notification_sinks, ManifestError
+
+        webhook, slack = create_notification_sinks("notifications", [
+            {"type": "webhook", "url": "http://x", "services": "api"},
+            {"type": "slack", "url": "http://x", "events": ["healthy", "crashed"]}], temp_dir)
+        assert webhook.accepts(event("started")) and not webhook.accepts(event(service="web"))
+        assert slack.accepts(event("healthy")) and not slack.accepts(event("restarted"))
+        desktop, = create_notification_sinks("notifications", {"type": "desktop"}, temp_dir)
+        assert desktop.accepts(event("crashed")) and not desktop.accepts(event("started"))
+        assert desktop.title == f"omni-run ({temp_dir.name})"
+
+        for block, message in [({"type": "email"}, r"notifications\[0\].type: must be one of webhook, slack"),
+                               ({"type": "discord"}, r"notifications\[0\]: webhook notifications need a url"),
+                               ({"type": "webhook", "url": "http://x", "events": ["boot"]},
+                                r"unknown event\(s\) boot \(supported: started, healthy")]:
+            with pytest.raises(ManifestError, match=message):
+                create_notification_sinks("notifications", block)
+
+    def test_webhook_slack_and_discord_delivery(self):
+        """Test the JSON body each type posts."""
+        from omni_run import create_notification_sinks
+
+        server = CaptureServer()
+        try:
+            sinks = create_notification_sinks("notifications", [
+                {"type": "webhook", "url": server.url, "headers": {"X-Token": "t"}},
+                {"type": "slack", "url": server.url, "title": "dev"},
+                {"type": "discord", "url": server.url, "title": "dev"}])
+            for sink in sinks:
+                sink.start()
+                sink(event())
+                sink.close()
+                assert sink.summary() is None
+        finally:
+            server.close()
+        assert server.bodies[0]["type"] == "crashed" and server.bodies[0]["pid"] == 42
+        assert server.bodies[1] == {"text": "dev: api crashed: exited with code 1"}
+        assert server.bodies[2] == {"content": "dev: api crashed: exited with code 1"}
+
+    def test_retries_and_summary(self):
+        """Test that failed deliveries are retried, then reported at the end of the run."""
+        from omni_run import create_notification_sinks
+
+        server = CaptureServer(status=500)
+        try:
+            sink, = create_notification_sinks("notifications", {"type": "webhook", "url": server.url, "retries": 1})
+            sink.start()
+            sink(event())
+            sink.close()
+        finally:
+            server.close()
+        assert len(server.bodies) == 2
+        assert sink.summary() == f"notifications webhook: 1 event not delivered (last error: HTTP 500 from {server.url})"
+
+    def test_desktop_notifier(self, monkeypatch):
+        """Test notify-send on Linux, osascript on macOS and the error without a notifier."""
+        import omni_run
+        from omni_run import desktop_notify_command, DesktopNotificationSink
+
+        monkeypatch.setattr(omni_run.shutil, "which", lambda name: f"/usr/bin/{name}")
+        monkeypatch.setattr(omni_run.platform, "system", lambda: "Linux")
+        assert desktop_notify_command("dev", "api crashed") == ["notify-send", "--app-name=omni-run", "dev", "api crashed"]
+        monkeypatch.setattr(omni_run.platform, "system", lambda: "Darwin")
+        assert desktop_notify_command("dev", 'say "hi"') == [
+            "osascript", "-e", 'display notification "say \\"hi\\"" with title "dev"']
+
+        monkeypatch.setattr(omni_run.shutil, "which", lambda name: None)
+        sink = DesktopNotificationSink({"type": "desktop"})
+        sink._deliver(event())
+        assert sink.summary() == "notifications desktop: 1 event not delivered (last error: no desktop notifier found (needs notify-send or osascript))"
+
+
+@pytest.mark.skipif(sys.platform == "win32", reason="Uses POSIX shell commands")
+class TestOrchestratorEvents:
+    """Tests for events published while `up` runs."""
+
+    def _up(self, temp_dir, omni_runner):
+        from omni_run import load_manifest, Orchestrator
+
+        server = CaptureServer()
+        try:
+            manifest = load_manifest(write_manifest(temp_dir, f"""
+services:
+  web:
+    command: sleep 1
+    health: {{type: exec, command: "true", interval: 100ms}}
+  crasher:
+    command: exit 2
+    restart: {{policy: on-failure, max_restarts: 1, backoff: 50ms, jitter: 0}}
+notifications:
+  - {{type: webhook, url: "{server.url}", events: [crashed, restarted]}}
+"""))
+            assert Orchestrator(omni_runner, manifest).up() == 1
+        finally:
+            server.close()
+        lines = (temp_dir / ".omni-run" / "events.jsonl").read_text().splitlines()
+        return [json.loads(line) for line in lines], server.bodies
+
+    def test_up_records_events(self, temp_dir, omni_runner):
+        """Test started/healthy/exited and crashed/restarted events in the log."""
+        events, bodies = self._up(temp_dir, omni_runner)
+        by_service = lambda name: [e["type"] for e in events if e["service"] == name]
+        assert by_service("web") == ["started", "healthy", "exited"]
+        assert by_service("crasher") == ["started", "crashed", "restarted", "crashed"]
+        crashed = next(e for e in events if e["type"] == "crashed")
+        assert crashed["exit_code"] == 2 and crashed["message"] == "exited with code 2"
+
+    def test_up_notifies_webhook(self, temp_dir, omni_runner):
+        """Test that the webhook receives only the event types it subscribed to."""
+        events, bodies = self._up(temp_dir, omni_runner)
+        assert [(b["service"], b["type"]) for b in bodies] == [
+            ("crasher", "crashed"), ("crasher", "restarted"), ("crasher", "crashed")]
+        assert bodies[1]["restarts"] == 1
+
+    def test_stop_publishes_stopped(self, temp_dir, omni_runner):
+        """Test that stopping a running service publishes a stopped event."""
+        from omni_run import load_manifest, Orchestrator
+
+        orchestrator = Orchestrator(omni_runner, load_manifest(write_manifest(temp_dir, "services:\n  api: {command: sleep 30}\n")))
+        seen = []
+        orchestrator.events.subscribe(seen.append)
+        service = orchestrator.services["api"]
+        orchestrator.start_service(service)
+        orchestrator.stop_service(service, timeout=5)
+        assert [e.type for e in seen] == ["started", "stopped"]
+        assert seen[0].message == f"pid {service.process.pid}"
+        assert not (temp_dir / ".omni-run" / "events.jsonl").exists()
+
+
+class TestEventsCommand:
+    """Tests for the `omni-run events` subcommand."""
+
+    def _record(self, temp_dir):
+        from omni_run import EventLog
+
+        log = EventLog(temp_dir / ".omni-run" / "events.jsonl")
+        for e in [event("started", "api", "pid 1"), event("started", "web", "pid 2"),
+                  event("crashed", "api"), event("restarted", "api", "restart 1, pid 3")]:
+            log(e)
+        log.close()
+
+    def test_nothing_recorded(self, temp_dir, capsys):
+        """Test the message before any event is recorded."""
+        from omni_run import run_subcommand
+
+        write_manifest(temp_dir, "services:\n  api: {command: 'true'}\n")
+        assert run_subcommand(["events", "-C", str(temp_dir)]) == 0
+        assert "No events recorded in" in capsys.readouterr().out
+
+    def test_history(self, temp_dir, capsys):
+        """Test printing the last -n events."""
+        from omni_run import run_subcommand
+
+        self._record(temp_dir)
+        assert run_subcommand(["events", "-C", str(temp_dir), "-n", "3"]) == 0
+        out = capsys.readouterr().out.splitlines()
+        assert len(out) == 3
+        assert out[0].endswith("web: pid 2") and "crashed" in out[1] and out[2].endswith("api: restart 1, pid 3")
+
+    def test_filters(self, temp_dir, capsys):
+        """Test filtering by service and by several types."""
+        from omni_run import run_subcommand
+
+        self._record(temp_dir)
+        assert run_subcommand(["events", "-C", str(temp_dir), "api", "-t", "started", "-t", "crashed"]) == 0
+        out = capsys.readouterr().out.splitlines()
+        assert len(out) == 2 and out[0].endswith("api: pid 1")
+
+    def test_json(self, temp_dir, capsys):
+        """Test an event as a JSON line."""
+        from omni_run import run_subcommand
+
+        self._record(temp_dir)
+        assert run_subcommand(["events", "-C", str(temp_dir), "web", "--output", "json"]) == 0
+        document = json.loads(capsys.readouterr().out)
+        assert (document["kind"], document["schema_version"], document["type"], document["pid"]) == ("event", 1, "started", 42)
@@ -454,3 +454,63 @@ class TestExecutionEnvironmentVars:
         finally:
             del os_mod.environ["TEST_VAR"]
 
+
+
+class TestWatchMode:
+    """Tests for watch mode file matching and change detection."""
+    
+    def test_gitignore_patterns(self):
+        """Test gitignore-style matching of relative paths."""
+        from omni_run import is_path_ignored
+        
+        patterns = ["*.log", "build/", "/vendor", "!keep.log"]
+        
+        assert is_path_ignored("debug.log", patterns)
+        assert not is_path_ignored("keep.log", patterns)
+        assert is_path_ignored("build/out.py", patterns)
+        assert not is_path_ignored("src/build", patterns)  # build/ only matches directories
+        assert is_path_ignored("vendor/lib.go", patterns)
+        assert not is_path_ignored("pkg/vendor/lib.go", patterns)  # anchored to root
+    
+    def test_watcher_respects_include_and_gitignore(self, temp_dir):
+        """Test that only included, non-ignored files are watched."""
+        from omni_run import FileWatcher
+        
+        (temp_dir / ".gitignore").write_text("generated/\n")
+        watcher = FileWatcher(temp_dir, ["*.go"], exclude=["*_test.go"])
+        
+        assert watcher.matches(temp_dir / "main.go")
+        assert not watcher.matches(temp_dir / "main_test.go")
+        assert not watcher.matches(temp_dir / "generated" / "api.go")
+        assert not watcher.matches(temp_dir / "README.md")
+    
+    def test_poll_detects_changes(self, temp_dir):
+        """Test that polling reports created and deleted files."""
+        from omni_run import FileWatcher
+        
+        (temp_dir / "app.py").write_text("print('v1')\n")
+        watcher = FileWatcher(temp_dir, ["*.py"])
+        watcher.poll()
+        
+        (temp_dir / "worker.py").write_text("print('new')\n")
+        (temp_dir / "app.py").unlink()
+        
+        assert watcher.poll() == ["app.py", "worker.py"]
+        assert watcher.poll() == []
+    
+    def test_wait_for_changes_times_out(self, temp_dir):
+        """Test that waiting without changes returns an empty batch."""
+        from omni_run import FileWatcher
+        
+        watcher = FileWatcher(temp_dir, ["*.py"], poll_interval=0.05)
+        watcher._snapshot = watcher._scan()
+        
+        assert watcher.wait_for_changes(timeout=0.1) == []
+    
+    def test_default_globs_per_language(self):
+        """Test that compiled languages watch their manifests too."""
+        from omni_run import WATCH_DEFAULT_GLOBS
+        
+        assert "*.go" in WATCH_DEFAULT_GLOBS["Go"]
+        assert "go.mod" in WATCH_DEFAULT_GLOBS["Go"]
+        assert "Cargo.toml" in WATCH_DEFAULT_GLOBS["Rust"]
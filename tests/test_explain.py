@@ -0,0 +1,111 @@
+"""
+Tests for `omni-run explain` in OmniRun.
+
+This module tests:
+- Explaining manifest services: start order, runtime and markers, ports, command, health and env
+- Explaining a project directory without a manifest
+- That nothing is launched or recorded
+"""
+
+import pytest
+from pathlib import Path
+
+from conftest import *
+
+
+MANIFEST = """
+services:
+  db:
+    command: "sleep 100"
+    ports: {pg: 5432}
+    health: {type: tcp, port: pg}
+  api:
+    path: api
+    ports: {http: auto}
+    depends_on: {db: service_healthy}
+    health: {path: /healthz, port: http}
+    env: {DB_URL: "postgres://localhost:${service.db.port}"}
+"""
+
+
+def make_project(temp_dir: Path) -> Path:
+    api = temp_dir / "api"
+    api.mkdir()
+    (api / "go.mod").write_text("module example.com/api\n\ngo 1.21\n")
+    (api / "main.go").write_text("package main\n\nfunc main() {}\n")
+    (api / "package.json").write_text('{"name": "api", "scripts": {"start": "node ."}}\n')
+    (temp_dir / "omni-run.yaml").write_text(MANIFEST)
+    return temp_dir
+
+
+class TestExplainManifest:
+    """Tests for explaining manifest services."""
+
+    def test_explains_each_service(self, temp_dir, capsys):
+        """Test the start order, detected runtime, ports, command, health, dependencies and env."""
+        from omni_run import run_subcommand
+
+        make_project(temp_dir)
+        assert run_subcommand(["explain", "-C", str(temp_dir)]) == 0
+        out = capsys.readouterr().out
+
+        assert "Start order: db -> api" in out
+        assert "`command` is set in the manifest" in out
+        assert "pg=5432 (fixed 5432) -> PORT_PG" in out
+        assert "health:      tcp 127.0.0.1:5432" in out
+        assert "detected by `go` in the directory itself" in out
+        assert "markers:     api/go.mod" in out
+        assert "also matched: `node` -> node" in out
+        assert "command:     go run ." in out
+        assert "depends on:  db (service_healthy)" in out
+        assert "+ DB_URL=postgres://localhost:5432" in out
+        assert "# manifest" in out
+
+    def test_selected_service_and_nothing_recorded(self, temp_dir, capsys):
+        """Test that selecting a service explains its dependencies too and leaves no state behind."""
+        from omni_run import run_subcommand
+
+        make_project(temp_dir)
+        assert run_subcommand(["explain", "db", "-C", str(temp_dir)]) == 0
+        out = capsys.readouterr().out
+        assert "Start order: db\n" in out
+        assert "\napi" not in out
+        assert not (temp_dir / ".omni-run").exists()
+
+        assert run_subcommand(["explain", "nope", "-C", str(temp_dir)]) == 1
+        assert "Unknown service" in capsys.readouterr().out
+
+    def test_secrets_masked(self, temp_dir, capsys, monkeypatch):
+        """Test that values resolved from secret:// references are masked in the environment diff."""
+        from omni_run import run_subcommand, SECRET_MASK
+
+        monkeypatch.setenv("EXPLAIN_TOKEN", "hunter2")
+        (temp_dir / "omni-run.yaml").write_text(
+            "services:\n  web:\n    command: 'true'\n    env: {TOKEN: 'secret://env/EXPLAIN_TOKEN'}\n")
+        assert run_subcommand(["explain", "-C", str(temp_dir)]) == 0
+        out = capsys.readouterr().out
+        assert f"TOKEN={SECRET_MASK}" in out
+        assert "hunter2" not in out
+
+
+class TestExplainDirectory:
+    """Tests for explaining a directory without a manifest."""
+
+    def test_detected_project(self, temp_dir, capsys):
+        """Test that the detected runtime, markers and command are shown."""
+        from omni_run import run_subcommand
+
+        (temp_dir / "go.mod").write_text("module example.com/x\n\ngo 1.21\n")
+        (temp_dir / "main.go").write_text("package main\n\nfunc main() {}\n")
+        assert run_subcommand(["explain", "-C", str(temp_dir)]) == 0
+        out = capsys.readouterr().out
+        assert "no omni-run.yaml" in out
+        assert "markers:     go.mod" in out
+        assert "command:     go run ." in out
+
+    def test_nothing_detected(self, temp_dir, capsys):
+        """Test the exit status when no runtime is detected."""
+        from omni_run import run_subcommand
+
+        assert run_subcommand(["explain", "-C", str(temp_dir)]) == 1
+        assert "none detected" in capsys.readouterr().out
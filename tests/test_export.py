@@ -0,0 +1,171 @@
+"""
+Tests for `omni-run export k8s` in OmniRun.
+
+This module tests:
+- Reading images and published ports out of `docker run` commands
+- Deployments, Services, ConfigMaps and Secrets for host services and sidecars
+- Templates rewritten as cluster DNS names and container ports, probes, limits and notes
+- Writing plain manifests and a Helm chart skeleton, and refusing to overwrite
+"""
+
+import yaml
+from pathlib import Path
+
+from conftest import *
+
+
+MANIFEST = """
+services:
+  api:
+    command: ["./api", "--listen", ":${PORT}"]
+    ports: {http: 8080, admin: auto}
+    env:
+      LOG_LEVEL: debug
+      API_TOKEN: dev-token
+      STRIPE_KEY: secret://vault/stripe#key
+      SELF_URL: http://localhost:${env.PORT}
+    health: {port: http, path: /healthz, interval: 2s, failure_threshold: 5}
+    limits: {cpu: 0.5, memory: 256M}
+    stop_timeout: 20s
+    depends_on: db
+  web:
+    command: npm run dev
+    ports: 3000-3100
+    env:
+      API_URL: http://${service.api.host}:${service.api.port}/v1
+    health: http://localhost:3000/ready
+sidecars:
+  db: postgres:16
+"""
+
+
+def export(temp_dir, names=None, **options):
+    from omni_run import load_manifest, KubernetesExporter
+
+    manifest = load_manifest(write_manifest(temp_dir, MANIFEST))
+    exporter = KubernetesExporter(manifest, **options)
+    documents = list(yaml.safe_load_all(exporter.render(names or list(manifest.services))))
+    return {(d["kind"], d["metadata"]["name"]): d for d in documents}, exporter.notes
+
+
+class TestDockerRun:
+    """Tests for reading `docker run` commands."""
+
+    def test_parse(self):
+        """Test options with and without values, published ports and the image's arguments."""
+        from omni_run import parse_docker_run
+
+        assert parse_docker_run(["docker", "run", "--rm", "--name", "x", "-p", "127.0.0.1:${PORT}:5432",
+                                 "-e", "POSTGRES_PASSWORD", "--publish=${PORT_ADMIN}:9000/tcp", "-p", "8125:8125",
+                                 "postgres:16", "-c", "fsync=off"]) == (
+            "postgres:16", ["-c", "fsync=off"], {"PORT": 5432, "PORT_ADMIN": 9000, "2": 8125})
+        assert parse_docker_run(["./api"]) is None
+        assert parse_docker_run(["docker", "run", "--rm"]) is None
+
+
+class TestKubernetesObjects:
+    """Tests for the objects each service becomes."""
+
+    def test_host_service(self, temp_dir):
+        """Test the Deployment's image, command, environment, ports, probe, limits and grace period."""
+        from omni_run import k8s_name
+
+        objects, notes = export(temp_dir, ["api"], registry="ghcr.io/acme/", tag="1.4.0", namespace="staging")
+        assert set(objects) == {("ConfigMap", "api-env"), ("Secret", "api-secrets"), ("Deployment", "api"),
+                                ("Service", "api")}
+        deployment = objects[("Deployment", "api")]
+        assert deployment["metadata"]["namespace"] == "staging"
+        pod = deployment["spec"]["template"]["spec"]
+        container = pod["containers"][0]
+        assert container["image"] == f"ghcr.io/acme/{k8s_name(temp_dir.name)}-api:1.4.0"
+        assert container["command"] == ["./api", "--listen", ":$(PORT)"]
+        assert container["env"] == [{"name": "SELF_URL", "value": "http://localhost:$(PORT)"}]
+        assert container["ports"] == [{"name": "http", "containerPort": 8080}, {"name": "admin", "containerPort": 8081}]
+        assert container["readinessProbe"] == {"httpGet": {"path": "/healthz", "port": "http"}, "periodSeconds": 2,
+                                               "timeoutSeconds": 2, "failureThreshold": 5}
+        assert container["resources"] == {"limits": {"cpu": "0.5", "memory": "256Mi"}}
+        assert pod["terminationGracePeriodSeconds"] == 20
+
+    def test_environment_split(self, temp_dir):
+        """Test plain variables in a ConfigMap, secrets in a Secret, and a note for an unresolved reference."""
+        objects, notes = export(temp_dir, ["api"])
+        config = objects[("ConfigMap", "api-env")]["data"]
+        assert (config["PORT"], config["LOG_LEVEL"], config["OMNI_SERVICE_DB_HOST"]) == ("8080", "debug", "db")
+        assert config["DATABASE_URL"] == "postgresql://postgres:postgres@db:5432/app"
+        assert objects[("Secret", "api-secrets")]["stringData"] == {"API_TOKEN": "dev-token", "STRIPE_KEY": ""}
+        assert any("STRIPE_KEY: secret://vault/stripe#key is not resolved" in note for note in notes)
+
+    def test_service_and_notes(self, temp_dir):
+        """Test the Service's ports and a note for settings Kubernetes has no equivalent for."""
+        objects, notes = export(temp_dir, ["api"])
+        assert objects[("Service", "api")]["spec"]["ports"][0] == {"name": "http", "port": 8080, "targetPort": "http"}
+        assert "api: not exported: depends_on" in notes
+
+    def test_templates_and_sidecars(self, temp_dir):
+        """Test templates pointing at cluster Services, URL probes, range ports and a sidecar's image."""
+        objects, _ = export(temp_dir, discovery=False)
+        web = objects[("Deployment", "web")]["spec"]["template"]["spec"]["containers"][0]
+        assert web["command"] == ["/bin/sh", "-c", "npm run dev"]
+        assert web["ports"] == [{"name": "http", "containerPort": 3000}]
+        assert web["readinessProbe"]["httpGet"] == {"path": "/ready", "port": 3000}
+        config = objects[("ConfigMap", "web-env")]["data"]
+        assert config["API_URL"] == "http://api:8080/v1"
+        assert not any(key.startswith("OMNI_SERVICE_") for key in config)
+
+        db = objects[("Deployment", "db")]["spec"]["template"]["spec"]["containers"][0]
+        assert db["image"] == "postgres:16" and "command" not in db and "args" not in db
+        assert db["readinessProbe"]["exec"]["command"][0] == "pg_isready"
+        assert objects[("ConfigMap", "db-env")]["data"] == {"POSTGRES_USER": "postgres", "POSTGRES_DB": "app"}
+        assert objects[("Secret", "db-secrets")]["stringData"] == {"POSTGRES_PASSWORD": "postgres"}
+        assert objects[("Service", "db")]["spec"]["ports"] == [{"name": "postgres", "port": 5432, "targetPort": "postgres"}]
+
+
+class TestExportCommand:
+    """Tests for `omni-run export k8s`."""
+
+    def test_stdout(self, temp_dir, capsys):
+        """Test the documents for the named services on stdout under a generated-by comment."""
+        from omni_run import run_subcommand
+
+        write_manifest(temp_dir, MANIFEST)
+        assert run_subcommand(["export", "k8s", "web", "-C", str(temp_dir)]) == 0
+        out = capsys.readouterr().out
+        assert out.startswith("# Generated by `omni-run export k8s` from omni-run.yaml\n")
+        assert [d["kind"] for d in yaml.safe_load_all(out)] == ["ConfigMap", "Deployment", "Service"]
+
+    def test_output_file(self, temp_dir, capsys):
+        """Test writing to -o with notes on the console, and not overwriting the file."""
+        from omni_run import run_subcommand, ANSI_ESCAPE
+
+        write_manifest(temp_dir, MANIFEST)
+        target = temp_dir / "k8s.yaml"
+        assert run_subcommand(["export", "k8s", "-o", str(target), "-C", str(temp_dir)]) == 0
+        assert "note: api: not exported: depends_on" in ANSI_ESCAPE.sub("", capsys.readouterr().out)
+        assert run_subcommand(["export", "k8s", "-o", str(target), "-C", str(temp_dir)]) == 1
+        assert "already exists" in capsys.readouterr().out
+
+    def test_unknown_service(self, temp_dir, capsys):
+        """Test that an unknown service name is an error."""
+        from omni_run import run_subcommand
+
+        write_manifest(temp_dir, MANIFEST)
+        assert run_subcommand(["export", "k8s", "nope", "-C", str(temp_dir)]) == 1
+        assert "Unknown service(s): nope" in capsys.readouterr().out
+
+    def test_helm(self, temp_dir, capsys):
+        """Test a Helm chart with values for images and replicas, which isn't overwritten either."""
+        from omni_run import run_subcommand, k8s_name
+
+        write_manifest(temp_dir, MANIFEST)
+        root = ["-C", str(temp_dir)]
+        assert run_subcommand(["export", "k8s", "api", "db", "--helm"] + root) == 0
+        chart = temp_dir / "chart"
+        assert sorted(str(p.relative_to(chart)) for p in chart.rglob("*.yaml")) == [
+            "Chart.yaml", "templates/api.yaml", "templates/db.yaml", "values.yaml"]
+        assert yaml.safe_load((chart / "values.yaml").read_text()) == {
+            "services": {"api": {"image": f"{k8s_name(temp_dir.name)}-api:latest", "replicas": 1},
+                         "db": {"image": "postgres:16", "replicas": 1}}}
+        template = (chart / "templates" / "api.yaml").read_text()
+        assert "replicas: {{ (index .Values.services \"api\").replicas }}\n" in template
+        assert "image: {{ (index .Values.services \"api\").image }}\n" in template
+        assert run_subcommand(["export", "k8s", "--helm"] + root) == 1
@@ -0,0 +1,222 @@
+"""
+Tests for getting sources into docker backend containers in OmniRun.
+
+This module tests:
+- `docker.sync` and per-service `sync:` settings: modes, ignore rules and conflict policies
+- Bind mounts, with ignored directories kept from the image
+- Sync mode: seeding a volume before the container starts, then copying and removing changed files
+- Conflicts between host and container changes, under both policies
+"""
+
+import os
+import sys
+import json
+import time
+import pytest
+from pathlib import Path
+
+from conftest import *
+
+
+# Runs the `sh -c` scripts meant for a container against $FAKE_APP instead of /app and logs each call
+FAKE_DOCKER = """\
+import json, os, subprocess, sys
+args = sys.argv[1:]
+with open(os.environ["FAKE_DOCKER_LOG"], "a") as log:
+    log.write(json.dumps(args) + "\\n")
+if "sh" in args:
+    i = args.index("sh")
+    script = args[i + 2].replace("/app", os.environ["FAKE_APP"])
+    sys.exit(subprocess.run(["sh", "-c", script] + args[i + 3:]).returncode)
+"""
+
+
+@pytest.fixture
+def fake_docker(temp_dir, monkeypatch):
+    """A `docker` on PATH whose containers all share one directory; returns (app dir, call log)."""
+    bin_dir, app, log = temp_dir / "bin", temp_dir / "container-app", temp_dir / "docker.log"
+    bin_dir.mkdir()
+    app.mkdir()
+    docker = bin_dir / "docker"
+    docker.write_text(f"#!{sys.executable}\n" + FAKE_DOCKER)
+    docker.chmod(0o755)
+    monkeypatch.setenv("PATH", f"{bin_dir}{os.pathsep}{os.environ['PATH']}")
+    monkeypatch.setenv("FAKE_APP", str(app))
+    monkeypatch.setenv("FAKE_DOCKER_LOG", str(log))
+    return app, log
+
+
+def node_project(temp_dir: Path, sync: str) -> Path:
+    project = temp_dir / "web"
+    (project / "src").mkdir(parents=True)
+    (project / "package.json").write_text('{"name": "web"}\n')
+    (project / "src" / "index.js").write_text("console.log('v1')\n")
+    (project / "node_modules" / "left-pad").mkdir(parents=True)
+    (project / "node_modules" / "left-pad" / "index.js").write_text("// host copy\n")
+    (project / ".gitignore").write_text("dist/\n")
+    (project / "dist").mkdir()
+    (project / "dist" / "bundle.js").write_text("// built\n")
+    write_manifest(temp_dir, f"services:\n  web: {{path: web, backend: docker, ports: auto, sync: {sync}}}\n")
+    return project
+
+
+def touch_later(path: Path, text: str):
+    """Write a file with a modification time clearly after its previous one."""
+    path.write_text(text)
+    later = time.time() + 5
+    os.utime(path, (later, later))
+
+
+class TestSyncSettings:
+    """Tests for reading the sync settings."""
+
+    def test_defaults(self, omni_runner):
+        """Test the settings from the config's `docker.sync`."""
+        from omni_run import SyncSettings
+
+        base = SyncSettings.from_config("docker.sync", omni_runner.config["docker"]["sync"])
+        assert (base.mode, base.conflicts, base.interval) == ("copy", "host", 0.5)
+        assert base.volume_dirs() == ["node_modules", ".venv", "__pycache__"]
+
+    def test_service_overrides(self, temp_dir, omni_runner):
+        """Test a service's mode on its own and a full block over the config's settings."""
+        from omni_run import SyncSettings, load_manifest
+
+        base = SyncSettings.from_config("docker.sync", omni_runner.config["docker"]["sync"])
+        write_manifest(temp_dir, "services:\n  a: {command: x, sync: sync}\n"
+                                 "  b: {command: x, sync: {mode: bind, ignore: [vendor/, '*.log'], conflicts: container}}\n")
+        manifest = load_manifest(temp_dir / "omni-run.yaml")
+        a, b = (manifest.services[n].sync.over(base) for n in ("a", "b"))
+        assert (a.mode, a.ignore, a.conflicts) == ("sync", base.ignore, "host")
+        assert (b.mode, b.ignore, b.conflicts, b.volume_dirs()) == ("bind", ["vendor/", "*.log"], "container", ["vendor"])
+
+    def test_auto_mode(self, monkeypatch):
+        """Test that auto syncs on macOS and binds on Linux."""
+        import omni_run
+        from omni_run import SyncSettings
+
+        monkeypatch.setattr(omni_run.platform, "system", lambda: "Darwin")
+        assert SyncSettings(mode="auto").resolved_mode() == "sync"
+        monkeypatch.setattr(omni_run.platform, "system", lambda: "Linux")
+        assert SyncSettings(mode="auto").resolved_mode() == "bind"
+
+    def test_invalid(self, temp_dir):
+        """Test unknown modes and conflict policies and a bad interval."""
+        from omni_run import load_manifest, ManifestError
+
+        for block, message in [("rsync", "services.a.sync.mode: must be one of copy, bind, sync, auto"),
+                               ("{conflicts: newest}", "services.a.sync.conflicts: must be one of host, container"),
+                               ("{interval: often}", "services.a.sync.interval:")]:
+            write_manifest(temp_dir, f"services:\n  a: {{command: x, sync: {block}}}\n")
+            with pytest.raises(ManifestError, match=message):
+                load_manifest(temp_dir / "omni-run.yaml")
+
+
+@pytest.mark.skipif(sys.platform == "win32", reason="The stand-in docker runs POSIX shell scripts")
+class TestDockerSync:
+    """Tests for the bind and sync modes of the docker backend."""
+
+    def _prepare(self, temp_dir, omni_runner):
+        from omni_run import load_manifest, Orchestrator
+
+        orchestrator = Orchestrator(omni_runner, load_manifest(temp_dir / "omni-run.yaml"))
+        service = orchestrator.services["web"]
+        orchestrator.allocate_ports(service)
+        backend = orchestrator.backend_for(service)
+        argv = backend.prepare(orchestrator, service)[0]
+        if "web" in backend.syncs:
+            backend.syncs["web"].stop()  # The tests sync by hand
+        return orchestrator, service, backend, argv
+
+    def test_bind(self, temp_dir, omni_runner, fake_docker):
+        """Test that the service directory is mounted, with node_modules kept from the image."""
+        project = node_project(temp_dir, "bind")
+        orchestrator, service, backend, argv = self._prepare(temp_dir, omni_runner)
+        mounts = [argv[i + 1] for i, a in enumerate(argv) if a == "-v"]
+        assert mounts == [f"{project.resolve()}:/app", "/app/node_modules", "/app/.venv", "/app/__pycache__"]
+        assert argv.index("-v") < argv.index(argv[-1])
+
+    def _synced(self, temp_dir, omni_runner, fake_docker):
+        app, _ = fake_docker
+        project = node_project(temp_dir, "sync")
+        orchestrator, service, backend, _ = self._prepare(temp_dir, omni_runner)
+        sync = backend.syncs["web"]
+        return app, project, sync, sync.exec_argv(backend.container_name(orchestrator, service))
+
+    def test_seed_volume(self, temp_dir, omni_runner, fake_docker, capsys):
+        """Test that the volume is seeded with the files not ignored before the container starts."""
+        from omni_run import stack_id, ANSI_ESCAPE
+
+        app, log = fake_docker
+        node_project(temp_dir, "sync")
+        argv = self._prepare(temp_dir, omni_runner)[3]
+        volume = next(argv[i + 1] for i, a in enumerate(argv) if a == "-v").split(":")[0]
+        assert volume.startswith(f"omni-run-{stack_id(temp_dir)}-web-src-")
+        assert sorted(p.relative_to(app).as_posix() for p in app.rglob("*") if p.is_file()) == [
+            ".gitignore", "package.json", "src/index.js"]
+        calls = [json.loads(line) for line in log.read_text().splitlines()]
+        assert ["run", "--rm", "-i", "-v", f"{volume}:/app", "--entrypoint", ""] in [c[:7] for c in calls]
+        assert "synced 3 file(s) into volume" in ANSI_ESCAPE.sub("", capsys.readouterr().out)
+
+    def test_changed_files(self, temp_dir, omni_runner, fake_docker):
+        """Test that only changed files are copied, and removed ones removed, through `docker exec`."""
+        app, project, sync, exec_argv = self._synced(temp_dir, omni_runner, fake_docker)
+        assert sync.sync(exec_argv) == (0, 0)
+        touch_later(project / "src" / "index.js", "console.log('v2')\n")
+        (project / "src" / "new.js").write_text("export default 1\n")
+        (project / ".gitignore").unlink()
+        assert sync.sync(exec_argv) == (2, 1)
+        assert (app / "src" / "index.js").read_text() == "console.log('v2')\n"
+        assert (app / "src" / "new.js").exists() and not (app / ".gitignore").exists()
+        assert json.loads(fake_docker[1].read_text().splitlines()[-1])[:4] == exec_argv[1:] + ["sh"]
+
+    def test_conflict_host_wins(self, temp_dir, omni_runner, fake_docker, capsys):
+        """Test that the host's copy wins and the container's is saved."""
+        from omni_run import ANSI_ESCAPE
+
+        app, project, sync, exec_argv = self._synced(temp_dir, omni_runner, fake_docker)
+        touch_later(app / "package.json", '{"name": "web", "private": true}\n')  # npm rewrote it in the container
+        touch_later(project / "package.json", '{"name": "web", "version": "2.0.0"}\n')
+        capsys.readouterr()
+        assert sync.sync(exec_argv) == (1, 0)
+        assert "version" in (app / "package.json").read_text()
+        saved = temp_dir / ".omni-run" / "sync" / "web" / "conflicts" / "package.json"
+        assert "private" in saved.read_text()
+        out = ANSI_ESCAPE.sub("", capsys.readouterr().out)
+        assert "sync conflict: package.json changed in the container too; its copy is in .omni-run/sync/web" in out
+
+    def _container_kept(self, temp_dir, omni_runner, fake_docker):
+        app, project, sync, exec_argv = self._synced(temp_dir, omni_runner, fake_docker)
+        sync.conflicts = "container"
+        (app / "src" / "index.js").write_text("console.log('patched in the container')\n")
+        os.utime(app / "src" / "index.js", (time.time() + 10, time.time() + 10))
+        touch_later(project / "src" / "index.js", "console.log('v2')\n")
+        return app, project, sync, exec_argv
+
+    def test_conflict_container_kept(self, temp_dir, omni_runner, fake_docker, capsys):
+        """Test that the container's copy is kept under `conflicts: container`."""
+        from omni_run import ANSI_ESCAPE
+
+        app, _, sync, exec_argv = self._container_kept(temp_dir, omni_runner, fake_docker)
+        assert sync.sync(exec_argv) == (0, 0)
+        assert "patched" in (app / "src" / "index.js").read_text()
+        assert "src/index.js changed in the container too; keeping the container's copy" in ANSI_ESCAPE.sub(
+            "", capsys.readouterr().out)
+        assert sync.sync(exec_argv) == (0, 0)
+
+    def test_later_host_change(self, temp_dir, omni_runner, fake_docker):
+        """Test that the host's copy is synced again once it changes after a kept conflict."""
+        app, project, sync, exec_argv = self._container_kept(temp_dir, omni_runner, fake_docker)
+        assert sync.sync(exec_argv) == (0, 0)
+        os.utime(project / "src" / "index.js", (time.time() + 20, time.time() + 20))
+        assert sync.sync(exec_argv) == (1, 0) and "v2" in (app / "src" / "index.js").read_text()
+
+    def test_go_is_copied(self, temp_dir, omni_runner, fake_docker):
+        """Test that Go services, which are compiled into their image, refuse bind and sync modes."""
+        from omni_run import ManifestError
+
+        (temp_dir / "api").mkdir()
+        (temp_dir / "api" / "go.mod").write_text("module example.com/api\n")
+        write_manifest(temp_dir, "services:\n  web: {path: api, backend: docker, sync: bind}\n")
+        with pytest.raises(ManifestError, match="services.web.sync: Go services are compiled into their image"):
+            self._prepare(temp_dir, omni_runner)
@@ -0,0 +1,202 @@
+"""
+Tests for frontend dev servers in OmniRun.
+
+This module tests:
+- Detecting Vite, Next.js and Create React App projects and their dev scripts
+- Passing the allocated port to dev servers that don't read PORT
+- Parsing a service's `proxy:` prefixes, rewrites and the implicit http port
+- The proxy routes generated for frontends, and API calls reaching their backend through `up`
+"""
+
+import sys
+import json
+import time
+import shutil
+import pytest
+from pathlib import Path
+
+from conftest import *
+
+
+ECHO_SERVER = """\
+import json, os, sys
+from http.server import BaseHTTPRequestHandler, HTTPServer
+
+class Handler(BaseHTTPRequestHandler):
+    def do_GET(self):
+        body = json.dumps({"name": sys.argv[1], "path": self.path, "args": sys.argv[2:]}).encode()
+        self.send_response(200)
+        self.send_header("Content-Length", str(len(body)))
+        self.end_headers()
+        self.wfile.write(body)
+
+    def log_message(self, *args):
+        pass
+
+port = sys.argv[sys.argv.index("--port") + 1] if "--port" in sys.argv else os.environ["PORT"]
+HTTPServer(("127.0.0.1", int(port)), Handler).serve_forever()
+"""
+
+
+def write_package(path: Path, scripts, dev_dependencies=None, dependencies=None):
+    path.mkdir(parents=True, exist_ok=True)
+    (path / "package.json").write_text(json.dumps({"name": path.name, "scripts": scripts,
+                                                   "dependencies": dependencies or {},
+                                                   "devDependencies": dev_dependencies or {}}))
+
+
+class TestDevServerDetection:
+    """Tests for recognising frontend dev servers."""
+
+    def test_detection(self, temp_dir, omni_runner):
+        """Test the dev server, the script picked over `start` and the variables added."""
+        write_package(temp_dir / "vite", {"start": "vite preview", "dev": "vite"}, {"vite": "^5.0.0"})
+        write_package(temp_dir / "next", {"start": "next start", "dev": "next dev"}, dependencies={"next": "14.2.0"})
+        write_package(temp_dir / "cra", {"start": "react-scripts start"}, dependencies={"react-scripts": "5.0.1"})
+        write_package(temp_dir / "api", {"start": "node server.js", "dev": "nodemon"}, {"nodemon": "^3"})
+        (temp_dir / "cra" / "yarn.lock").write_text("")
+
+        plans = {name: omni_runner.detect_runtime(temp_dir / name) for name in ("vite", "next", "cra", "api")}
+        assert (plans["vite"].dev_server, plans["vite"].command) == ("vite", ["npm", "run", "dev"])
+        assert (plans["next"].dev_server, plans["next"].command) == ("next", ["npm", "run", "dev"])
+        assert (plans["cra"].dev_server, plans["cra"].command) == ("react-scripts", ["yarn", "run", "start"])
+        assert plans["cra"].env["BROWSER"] == "none" and plans["cra"].env["WDS_SOCKET_PORT"] == "0"
+        assert (plans["api"].dev_server, plans["api"].command) == (None, ["npm", "run", "start"])
+
+    def test_port_arguments(self, temp_dir, omni_runner):
+        """Test --port for Vite (after `--` for npm only) and nothing for servers reading PORT."""
+        from omni_run import load_manifest, Orchestrator
+
+        write_package(temp_dir / "web", {"dev": "vite"}, {"vite": "^5.0.0"})
+        write_package(temp_dir / "admin", {"dev": "vite"}, {"vite": "^5.0.0"})
+        (temp_dir / "admin" / "pnpm-lock.yaml").write_text("")
+        write_package(temp_dir / "site", {"dev": "next dev"}, {"next": "14.2.0"})
+        orchestrator = Orchestrator(omni_runner, load_manifest(write_manifest(temp_dir, """
+services:
+  web: {path: web, ports: {http: 5173}}
+  admin: {path: admin, ports: {http: 5174}}
+  site: {path: site, ports: {http: 3000}}
+  quiet: {path: web}
+""")))
+        launch = lambda name, port=None: orchestrator.resolve_launch(orchestrator.manifest.services[name],
+                                                                      {"http": port} if port else {})
+        assert launch("web", 5173)[0] == ["npm", "run", "dev", "--", "--port", "5173", "--strictPort"]
+        assert launch("admin", 5174)[0] == ["pnpm", "run", "dev", "--port", "5174", "--strictPort"]
+        argv, _, env = launch("site", 3000)
+        assert argv == ["npm", "run", "dev"] and env["PORT"] == "3000"
+        assert launch("quiet")[0] == ["npm", "run", "dev"]
+
+
+class TestServiceProxy:
+    """Tests for a frontend service's `proxy:` prefixes."""
+
+    def test_parse(self, temp_dir):
+        """Test the shorthand, the mapping form with a rewrite and the implicit http port."""
+        from omni_run import load_manifest
+
+        services = load_manifest(write_manifest(temp_dir, """
+services:
+  web:
+    command: npm run dev
+    proxy:
+      /api: api
+      /auth: {service: api, port: admin, rewrite: /v1/auth}
+  api: {command: "true", ports: {http: auto, admin: auto}}
+""")).services
+        web = services["web"]
+        assert [(r.path, r.service, r.port, r.rewrite) for r in web.proxy] == [
+            ("/api", "api", None, None), ("/auth", "api", "admin", "/v1/auth")]
+        assert web.ports["http"].strategy == "auto"
+        assert services["api"].proxy == []
+
+    def test_invalid(self, temp_dir):
+        """Test unknown backends, backends without ports, bad prefixes and rewrites."""
+        from omni_run import load_manifest, ManifestError
+
+        for proxy, message in [("{/api: billing}", "unknown service 'billing'"),
+                               ("{/api: job}", "'job' declares no ports"),
+                               ("{/api: 'api:grpc'}", "has no port 'grpc'"),
+                               ("{api: api}", "expected a path prefix such as /api"),
+                               ("{/api: {service: api, rewrite: v1}}", "rewrite: needs a path and must start with /")]:
+            write_manifest(temp_dir, f"services:\n  web:\n    command: 'true'\n    proxy: {proxy}\n"
+                                     "  api: {command: 'true', ports: auto}\n  job: {command: 'true'}\n")
+            with pytest.raises(ManifestError, match=message):
+                load_manifest(temp_dir / "omni-run.yaml")
+
+    def test_generated_routes(self, temp_dir):
+        """Test routes on the frontend's own hostname, and on any host for a single frontend."""
+        from omni_run import load_manifest, frontend_proxy_routes, ProxyRoute
+
+        def routes(content):
+            services = load_manifest(write_manifest(temp_dir, content)).services
+            return sorted(r.describe() for r in frontend_proxy_routes(services))
+
+        backend = "  api: {command: 'true', ports: auto}\n"
+        assert routes("services:\n  web: {command: 'true', proxy: {/api: api}}\n" + backend) == [
+            "*/ -> web", "*/api -> api", "web.localhost/ -> web", "web.localhost/api -> api"]
+        assert routes("services:\n  web: {command: 'true', proxy: {/api: api}}\n"
+                      "  admin: {command: 'true', proxy: {/api: api}}\n" + backend) == [
+            "admin.localhost/ -> admin", "admin.localhost/api -> api", "web.localhost/ -> web", "web.localhost/api -> api"]
+
+        route = ProxyRoute(service="api", path="/api", rewrite="/v1")
+        assert route.forwarded_path("/api/users?id=1") == "/v1/users?id=1"
+        assert route.forwarded_path("/api") == "/v1"
+        assert route.forwarded_path("/api?x=1") == "/v1?x=1"
+
+
+@pytest.fixture
+def frontend_stack(temp_dir, omni_runner):
+    """`up` running a Vite frontend proxying /api to a backend, once both are healthy; yields it and a JSON fetch."""
+    import threading
+    import urllib.request
+    from omni_run import load_manifest, Orchestrator, PortAllocator
+
+    proxy_port = PortAllocator().free_port()
+    (temp_dir / "echo.py").write_text(ECHO_SERVER)
+    write_package(temp_dir / "web", {"dev": f"{sys.executable} ../echo.py web"}, {"vite": "^5.0.0"})
+    manifest = load_manifest(write_manifest(temp_dir, f"""
+services:
+  web:
+    path: web
+    proxy:
+      /api: {{service: api, rewrite: /v1}}
+    health: {{type: tcp, port: http, interval: 100ms}}
+  api:
+    command: ["{sys.executable}", "echo.py", "api"]
+    ports: auto
+    health: {{type: tcp, port: http, interval: 100ms}}
+proxy:
+  address: 127.0.0.1:{proxy_port}
+"""))
+    omni_runner.config["install"] = {"auto": False}
+    orchestrator = Orchestrator(omni_runner, manifest)
+    runner = threading.Thread(target=orchestrator.up, daemon=True)
+    runner.start()
+    try:
+        deadline = time.time() + 20
+        while time.time() < deadline and not all(s.health and s.health.healthy for s in orchestrator.services.values()):
+            time.sleep(0.1)
+        assert all(s.health.healthy for s in orchestrator.services.values())
+        yield orchestrator, lambda path, host="localhost": json.loads(urllib.request.urlopen(urllib.request.Request(
+            f"http://127.0.0.1:{proxy_port}{path}", headers={"Host": host}), timeout=10).read())
+    finally:
+        orchestrator.request_shutdown()
+        runner.join(timeout=15)
+
+
+@pytest.mark.skipif(sys.platform == "win32", reason="Uses POSIX process groups")
+@pytest.mark.skipif(not shutil.which("npm"), reason="Needs npm to run the dev script")
+class TestFrontendThroughProxy:
+    """Tests for a frontend and its API behind the proxy during `up`."""
+
+    def test_page_served(self, frontend_stack):
+        """Test that the page comes from the dev server started on its allocated port."""
+        orchestrator, fetch = frontend_stack
+        page = fetch("/index.html")
+        assert page["name"] == "web" and page["args"][:2] == ["--port", str(orchestrator.services["web"].ports["http"])]
+
+    def test_api_calls_reach_backend(self, frontend_stack):
+        """Test that /api calls on the page's origin reach the backend with the prefix rewritten."""
+        orchestrator, fetch = frontend_stack
+        assert fetch("/api/users?id=1") == {"name": "api", "path": "/v1/users?id=1", "args": []}
+        assert fetch("/api/users", host="web.localhost")["path"] == "/v1/users"
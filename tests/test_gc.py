@@ -0,0 +1,198 @@
+"""
+Tests for log and failure bundle retention in OmniRun.
+
+This module tests:
+- Retention policies: age, file count and size limits, and files that must stay
+- The janitor's policies from the config, the manifest and services, and what a sweep removes
+- `omni-run gc` with --dry-run, a service filter, --max-age and JSON output
+"""
+
+import os
+import sys
+import json
+import time
+import pytest
+from pathlib import Path
+
+from conftest import *
+
+
+DAY = 86400
+
+
+def write_file(path: Path, size: int, age_days: float = 0) -> Path:
+    """A file of `size` bytes last modified `age_days` ago."""
+    path.parent.mkdir(parents=True, exist_ok=True)
+    path.write_bytes(b"x" * size)
+    mtime = time.time() - age_days * DAY
+    os.utime(path, (mtime, mtime))
+    return path
+
+
+def write_bundle(temp_dir: Path, name: str, service: str, age_days: float) -> Path:
+    directory = temp_dir / ".omni-run" / "failures" / name
+    write_file(directory / "output.log", 1000)
+    (directory / "failure.json").write_text(json.dumps({"service": service, "exit_code": 1}))
+    mtime = time.time() - age_days * DAY
+    os.utime(directory, (mtime, mtime))
+    return directory
+
+
+class TestRetentionPolicy:
+    """Tests for deciding which files a policy removes."""
+
+    FILES = [(Path(f"f{i}"), 100 * DAY - i * DAY, 100) for i in range(5)]  # f0 is the newest
+
+    def test_limits(self):
+        """Test no limits, and the age, file count and size limits each on their own."""
+        from omni_run import RetentionPolicy
+
+        now = 100 * DAY
+        assert RetentionPolicy().expired(self.FILES, now=now) == []
+        assert RetentionPolicy(max_age=2.5 * DAY).expired(self.FILES, now=now) == [Path("f3"), Path("f4")]
+        assert RetentionPolicy(max_files=2).expired(self.FILES, now=now) == [Path("f2"), Path("f3"), Path("f4")]
+        assert RetentionPolicy(max_bytes=350).expired(self.FILES, now=now) == [Path("f3"), Path("f4")]
+
+    def test_protected_files(self):
+        """Test that files to keep are neither removed nor counted against the limit."""
+        from omni_run import RetentionPolicy
+
+        assert RetentionPolicy(max_files=1).expired(self.FILES, keep={Path("f0"), Path("f2")}, now=100 * DAY) == [
+            Path("f1"), Path("f3"), Path("f4")]
+
+    def test_from_config(self):
+        """Test sizes in megabytes, and a service policy inheriting the limits it doesn't set."""
+        from omni_run import RetentionPolicy
+
+        base = RetentionPolicy.from_config("retention.logs", {"max_age": "14d", "max_size_mb": 1.5})
+        assert (base.max_age, base.max_bytes, base.max_files) == (14 * DAY, 1572864, None)
+        service = RetentionPolicy.from_config("x", {"max_files": 3, "max_age": None}, base)
+        assert (service.max_age, service.max_bytes, service.max_files) == (None, 1572864, 3)
+
+    def test_invalid(self):
+        """Test a count that isn't positive and an age that isn't a duration."""
+        from omni_run import RetentionPolicy, ManifestError
+
+        with pytest.raises(ManifestError, match="retention.logs.max_files: must be positive"):
+            RetentionPolicy.from_config("retention.logs", {"max_files": 0})
+        with pytest.raises(ManifestError, match="retention.logs.max_age:"):
+            RetentionPolicy.from_config("retention.logs", {"max_age": "soon"})
+
+
+class TestJanitor:
+    """Tests for the janitor that applies the policies."""
+
+    def test_policies(self, temp_dir, omni_runner):
+        """Test the defaults, manifest overrides, per-service log policies and failures.keep."""
+        from omni_run import load_manifest, Janitor
+
+        write_manifest(temp_dir, """
+failures: {keep: 5}
+retention:
+  interval: 1m
+  logs: {max_size_mb: 100}
+services:
+  api: {command: 'true'}
+  worker: {command: 'true', logs: {retention: {max_age: 2d}}}
+""")
+        janitor = Janitor.from_config(omni_runner.config, load_manifest(temp_dir / "omni-run.yaml"))
+        assert janitor.interval == 60 and janitor.log_dir == temp_dir / ".omni-run" / "logs"
+        assert (janitor.logs.max_age, janitor.logs.max_bytes) == (14 * DAY, 100 * 1024 * 1024)
+        assert (janitor.services["worker"].max_age, janitor.services["worker"].max_bytes) == (2 * DAY, 100 * 1024 * 1024)
+        assert "api" not in janitor.services
+        assert (janitor.failures.max_age, janitor.failures.max_files) == (30 * DAY, 5)
+        assert not janitor.due(time.time()) and janitor.due(time.time() + 61)
+
+    def _janitor(self, temp_dir):
+        from omni_run import Janitor, RetentionPolicy
+
+        logs = temp_dir / ".omni-run" / "logs"
+        write_file(logs / "api.log", 500, age_days=20)
+        write_file(logs / "api.log.1", 500, age_days=20)
+        write_file(logs / "api.log.1.idx", 50, age_days=20)
+        write_file(logs / "worker.log", 500, age_days=1)
+        write_file(logs / "notes.txt", 10, age_days=90)
+        write_bundle(temp_dir, "20240101-000000-api", "api", age_days=40)
+        write_bundle(temp_dir, "20240301-000000-api", "api", age_days=1)
+        return Janitor(logs, temp_dir / ".omni-run" / "failures", RetentionPolicy(max_age=14 * DAY),
+                       RetentionPolicy(max_age=30 * DAY))
+
+    def test_usage(self, temp_dir):
+        """Test the log and bundle usage per service, ignoring files that aren't service logs."""
+        usage = self._janitor(temp_dir).usage()
+        bundles = temp_dir / ".omni-run" / "failures"
+        assert usage["api"] == {"log_files": 2, "log_bytes": 1050, "failures": 2, "failure_bytes": 2000 + sum(
+            len((bundle / "failure.json").read_text()) for bundle in bundles.iterdir())}
+        assert sorted(usage) == ["api", "worker"]
+
+    def test_dry_run(self, temp_dir):
+        """Test that a dry run lists what a sweep would remove and leaves it."""
+        janitor = self._janitor(temp_dir)
+        rotated, old = janitor.log_dir / "api.log.1", temp_dir / ".omni-run" / "failures" / "20240101-000000-api"
+        assert [p for _, p, _ in janitor.sweep(dry_run=True)] == [rotated, old] and rotated.exists()
+
+    def test_sweep(self, temp_dir):
+        """Test removing old rotated logs with their indexes and old bundles, sparing the current log file."""
+        janitor = self._janitor(temp_dir)
+        rotated, old = janitor.log_dir / "api.log.1", temp_dir / ".omni-run" / "failures" / "20240101-000000-api"
+        assert janitor.sweep() == [("api", rotated, 550), ("api", old, 1000 + len('{"service": "api", "exit_code": 1}'))]
+        assert sorted(p.name for p in janitor.log_dir.iterdir()) == ["api.log", "notes.txt", "worker.log"]
+        assert not old.exists() and (temp_dir / ".omni-run" / "failures" / "20240301-000000-api").exists()
+
+    def test_current_log_file(self, temp_dir):
+        """Test that the current log file goes too when it needn't be kept."""
+        janitor = self._janitor(temp_dir)
+        janitor.sweep()
+        assert [p for _, p, _ in janitor.sweep(keep_current=False)] == [janitor.log_dir / "api.log"]
+
+
+class TestGcCommand:
+    """Tests for `omni-run gc`."""
+
+    def _logs(self, temp_dir, worker=True):
+        write_manifest(temp_dir, "services:\n  api: {command: 'true'}\n  worker: {command: 'true'}\n")
+        logs = temp_dir / ".omni-run" / "logs"
+        write_file(logs / "api.log", 2048, age_days=20)
+        if worker:
+            write_file(logs / "worker.log", 1024, age_days=3)
+            write_file(logs / "worker.log.1", 1024, age_days=4)
+        return logs
+
+    def test_dry_run(self, temp_dir, capsys):
+        """Test the usage table and what a dry run would remove, leaving it."""
+        from omni_run import run_subcommand, ANSI_ESCAPE
+
+        logs = self._logs(temp_dir)
+        assert run_subcommand(["gc", "--dry-run", "-C", str(temp_dir)]) == 0
+        out = ANSI_ESCAPE.sub("", capsys.readouterr().out)
+        assert "Would remove .omni-run/logs/api.log (2.0K)" in out
+        assert "api                  2.0K (1)           0B (0)             2.0K" in out
+        assert "Would remove 1 file(s), 2.0K" in out and (logs / "api.log").exists()
+
+    def test_one_service_max_age(self, temp_dir, capsys):
+        """Test collecting one service's files with --max-age."""
+        from omni_run import run_subcommand, ANSI_ESCAPE
+
+        logs = self._logs(temp_dir)
+        assert run_subcommand(["gc", "worker", "--max-age", "2d", "-C", str(temp_dir)]) == 0
+        out = ANSI_ESCAPE.sub("", capsys.readouterr().out)
+        assert "Removed 2 file(s), 2.0K" in out and "api " not in out
+        assert sorted(p.name for p in logs.iterdir()) == ["api.log"]
+
+    def test_json(self, temp_dir, capsys):
+        """Test the JSON document with what was removed and freed."""
+        from omni_run import run_subcommand
+
+        self._logs(temp_dir, worker=False)
+        assert run_subcommand(["gc", "-C", str(temp_dir), "--output", "json"]) == 0
+        document = json.loads(capsys.readouterr().out)
+        assert (document["kind"], document["freed"], document["usage"]) == ("gc", 2048, {})
+        assert [r["service"] for r in document["removed"]] == ["api"]
+
+    def test_unknown_service(self, temp_dir, capsys):
+        """Test gc for a service that isn't in the manifest."""
+        from omni_run import run_subcommand
+
+        self._logs(temp_dir)
+        assert run_subcommand(["gc", "nope", "-C", str(temp_dir)]) == 1
+        assert "Unknown service(s): nope" in capsys.readouterr().out
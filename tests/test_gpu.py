@@ -0,0 +1,161 @@
+"""
+Tests for GPU resources in OmniRun.
+
+This module tests:
+- Parsing `resources.gpu` and detecting GPUs with nvidia-smi, limited by CUDA_VISIBLE_DEVICES
+- Handing out GPUs without giving one device to two services, and keeping them across restarts
+- `up` passing CUDA_VISIBLE_DEVICES, services waiting for a GPU, and `--gpus` for the docker backend
+"""
+
+import os
+import sys
+import pytest
+from pathlib import Path
+
+from conftest import *
+
+
+def fake_nvidia_smi(temp_dir: Path, monkeypatch, count: int = 2):
+    """Put an nvidia-smi on PATH that lists `count` GPUs."""
+    bin_dir = temp_dir / "bin"
+    bin_dir.mkdir(exist_ok=True)
+    rows = "".join(f"{i}, GPU-{i}aaa-bbbb, NVIDIA A100, 40960\\n" for i in range(count))
+    script = bin_dir / "nvidia-smi"
+    script.write_text(f"#!/bin/sh\nprintf '{rows}'\n")
+    script.chmod(0o755)
+    monkeypatch.setenv("PATH", f"{bin_dir}{os.pathsep}{os.environ['PATH']}")
+    monkeypatch.delenv("CUDA_VISIBLE_DEVICES", raising=False)
+
+
+class TestGpuScheduler:
+    """Tests for detection and handing out devices."""
+
+    def test_detect_and_visible_devices(self, temp_dir, monkeypatch):
+        """Test parsing nvidia-smi, CUDA_VISIBLE_DEVICES by index and UUID, and no nvidia-smi."""
+        from omni_run import detect_gpus
+
+        fake_nvidia_smi(temp_dir, monkeypatch, 3)
+        devices = detect_gpus()
+        assert [(d.index, d.uuid, d.name, d.memory) for d in devices][0] == (
+            "0", "GPU-0aaa-bbbb", "NVIDIA A100", 40960 * 1024 * 1024)
+        assert len(devices) == 3
+        monkeypatch.setenv("CUDA_VISIBLE_DEVICES", "2,GPU-0aaa")
+        assert [d.index for d in detect_gpus()] == ["0", "2"]
+        monkeypatch.setenv("CUDA_VISIBLE_DEVICES", "")
+        assert detect_gpus() == []
+        assert detect_gpus("no-such-nvidia-smi") == []
+
+    def _scheduler(self, temp_dir):
+        from omni_run import load_manifest, GpuScheduler, GpuDevice
+
+        manifest = load_manifest(write_manifest(temp_dir, """
+services:
+  train: {command: 'true', resources: {gpu: 1}}
+  serve: {command: 'true', resources: {gpu: 2}}
+  big: {command: 'true', resources: {gpu: 3}}
+"""))
+        return manifest.services, GpuScheduler(lambda: [GpuDevice("0", "GPU-a", "A"), GpuDevice("1", "GPU-b", "B")])
+
+    def test_assign_free(self, temp_dir):
+        """Test that a service gets a free device, and keeps it across a restart."""
+        services, gpus = self._scheduler(temp_dir)
+        assert gpus.hold(services["train"]) is None and gpus.assign(services["train"]) == ["0"]
+        assert gpus.assign(services["train"]) == ["0"]  # A restart keeps its device
+
+    def test_wait_while_in_use(self, temp_dir):
+        """Test that a service is held while another has the devices it needs."""
+        from omni_run import ManifestError
+
+        services, gpus = self._scheduler(temp_dir)
+        gpus.assign(services["train"])
+        assert gpus.hold(services["serve"]) == "serve waits for 2 GPUs: 1 of 2 free, in use by train"
+        with pytest.raises(ManifestError, match="1 of 2 GPUs free, the rest in use by train"):
+            gpus.assign(services["serve"])
+
+    def test_release(self, temp_dir):
+        """Test that released devices go to the next service."""
+        services, gpus = self._scheduler(temp_dir)
+        gpus.assign(services["train"])
+        gpus.release("train")
+        assert gpus.assign(services["serve"]) == ["0", "1"] and gpus.free() == []
+
+    def test_never_enough(self, temp_dir):
+        """Test a service needing more devices than the machine has, and a machine without any."""
+        from omni_run import GpuScheduler, ManifestError
+
+        services, gpus = self._scheduler(temp_dir)
+        assert gpus.hold(services["big"]) is None
+        with pytest.raises(ManifestError, match="services.big.resources.gpu: needs 3 GPUs, but only 2"):
+            gpus.assign(services["big"])
+        with pytest.raises(ManifestError, match="no NVIDIA GPU found"):
+            GpuScheduler(lambda: []).assign(services["train"])
+
+    def test_invalid_count(self, temp_dir):
+        """Test that a negative GPU count is rejected."""
+        from omni_run import load_manifest, ManifestError
+
+        with pytest.raises(ManifestError, match="services.x.resources.gpu: must be 0 or more"):
+            load_manifest(write_manifest(temp_dir, "services:\n  x: {command: 'true', resources: {gpu: -1}}\n"))
+
+
+class TestGpuUp:
+    """Tests for GPUs during `up`."""
+
+    def _shared(self, temp_dir, omni_runner, monkeypatch):
+        from omni_run import load_manifest, Orchestrator
+
+        fake_nvidia_smi(temp_dir, monkeypatch, 1)
+        (temp_dir / "job.py").write_text("""
+import os, sys, time
+with open(sys.argv[1] + ".out", "w") as f:
+    f.write(f"{time.time()} {os.environ.get('CUDA_VISIBLE_DEVICES')} {os.environ.get('CUDA_DEVICE_ORDER')}")
+time.sleep(float(sys.argv[2]))
+with open(sys.argv[1] + ".out", "a") as f:
+    f.write(f" {time.time()}")
+""")
+        manifest = load_manifest(write_manifest(temp_dir, f"""
+services:
+  first: {{command: ['{sys.executable}', job.py, first, '0.5'], resources: {{gpu: 1}}}}
+  second: {{command: ['{sys.executable}', job.py, second, '0'], resources: {{gpu: 1}}}}
+  pinned: {{command: ['{sys.executable}', job.py, pinned, '0'], env: {{CUDA_VISIBLE_DEVICES: '7'}}}}
+"""))
+        orchestrator = Orchestrator(omni_runner, manifest)
+        assert orchestrator.up() == 0
+        return orchestrator, lambda name: (temp_dir / f"{name}.out").read_text().split()
+
+    def test_visible_devices(self, temp_dir, omni_runner, monkeypatch):
+        """Test CUDA_VISIBLE_DEVICES and the device order, and that every GPU is given back."""
+        orchestrator, recorded = self._shared(temp_dir, omni_runner, monkeypatch)
+        assert recorded("first")[1:3] == ["0", "PCI_BUS_ID"] and recorded("second")[1:3] == ["0", "PCI_BUS_ID"]
+        assert orchestrator.gpus.assigned == {}
+
+    def test_wait_for_gpu(self, temp_dir, omni_runner, monkeypatch):
+        """Test that a service waits for the GPU another service holds."""
+        _, recorded = self._shared(temp_dir, omni_runner, monkeypatch)
+        assert float(recorded("second")[0]) >= float(recorded("first")[3])  # The GPU was given back first
+
+    def test_env_overrides(self, temp_dir, omni_runner, monkeypatch):
+        """Test that a service setting CUDA_VISIBLE_DEVICES itself keeps its value."""
+        _, recorded = self._shared(temp_dir, omni_runner, monkeypatch)
+        assert recorded("pinned")[1:3] == ["7", "None"]
+
+    def test_docker_flag_and_unsupported_backend(self, temp_dir, omni_runner, monkeypatch):
+        """Test `--gpus "device=..."` for docker services, and the wasm backend refusing GPUs."""
+        from omni_run import load_manifest, Orchestrator, DockerBackend, ManifestError
+
+        fake_nvidia_smi(temp_dir, monkeypatch, 2)
+        (temp_dir / "requirements.txt").write_text("")
+        manifest = load_manifest(write_manifest(temp_dir, """
+services:
+  train: {command: 'python train.py', backend: docker, resources: {gpu: 2}}
+  module: {command: 'true', wasm: true, resources: {gpu: 1}}
+"""))
+        orchestrator = Orchestrator(omni_runner, manifest)
+        orchestrator.gpus.assign(manifest.services["train"])
+        backend = DockerBackend(docker=sys.executable)
+        backend.build = lambda orchestrator, service: "omni-run/train:test"
+        argv, _, _ = backend.prepare(orchestrator, orchestrator.services["train"])
+        assert argv[argv.index("--gpus") + 1] == '"device=0,1"'
+
+        with pytest.raises(ManifestError, match="services.module.resources.gpu needs the host or docker backend"):
+            orchestrator.start_service(orchestrator.services["module"])
@@ -0,0 +1,238 @@
+"""
+Tests for gRPC health probes in OmniRun.
+
+This module tests:
+- HPACK header decoding (RFC 7541 examples, Huffman strings, the dynamic table)
+- Parsing `type: grpc` health blocks, service names and TLS options
+- Probing a local HTTP/2 server: serving, not serving and unknown services
+- TLS probes against a certificate from the local CA, and readiness during `up`
+"""
+
+import sys
+import time
+import shutil
+import socket
+import threading
+import pytest
+from pathlib import Path
+
+from conftest import *
+
+
+class HealthServer:
+    """A minimal gRPC server speaking just enough HTTP/2 to answer Health/Check, optionally over TLS.
+
+    Responses use indexed and Huffman-coded headers, padding and CONTINUATION frames, like real servers.
+    """
+
+    def __init__(self, statuses, certificate=None):
+        self.statuses, self.requests = statuses, []
+        self.server = socket.create_server(("127.0.0.1", 0))
+        self.port = self.server.getsockname()[1]
+        self.context = None
+        if certificate:
+            import ssl
+            self.context = ssl.SSLContext(ssl.PROTOCOL_TLS_SERVER)
+            self.context.load_cert_chain(*[str(p) for p in certificate])
+            self.context.set_alpn_protocols(["h2"])
+        threading.Thread(target=self._serve, daemon=True).start()
+
+    def _serve(self):
+        while True:
+            try:
+                conn, _ = self.server.accept()
+            except OSError:
+                return
+            threading.Thread(target=self._handle, args=(conn,), daemon=True).start()
+
+    def _handle(self, conn):
+        from omni_run import HpackDecoder, hpack_encode, http2_frame, protobuf_varint
+
+        def read(size):
+            data = b""
+            while len(data) < size:
+                chunk = conn.recv(size - len(data))
+                if not chunk:
+                    raise ConnectionError
+                data += chunk
+            return data
+
+        try:
+            conn = self.context.wrap_socket(conn, server_side=True) if self.context else conn
+            read(24)
+            conn.sendall(http2_frame(4, 0, 0) + http2_frame(6, 0, 0, b"12345678"))
+            headers, body = {}, b""
+            while True:
+                head = read(9)
+                payload = read(int.from_bytes(head[:3], "big"))
+                if head[3] == 1:
+                    headers.update(HpackDecoder().decode(payload))
+                elif head[3] == 0:
+                    body += payload
+                    if head[4] & 1:
+                        break
+            self.requests.append(headers)
+            message, service = body[5:], ""
+            if message:
+                length, position = protobuf_varint(message, 1)
+                service = message[position:position + length].decode()
+
+            if service not in self.statuses:
+                trailers = b"\x88" + hpack_encode([("grpc-status", "5"), ("grpc-message", f"unknown%20service%20{service}")])
+                conn.sendall(http2_frame(1, 0x5, 1, trailers))
+                return
+            # :status 200 (indexed), then content-type with a Huffman-coded value added to the dynamic table,
+            # split into a CONTINUATION frame
+            response = b"\x88\x5f\x8b\x1d\x75\xd0\x62\x0d\x26\x3d\x4c\x4d\x65\x64"
+            conn.sendall(http2_frame(1, 0, 1, response[:4]) + http2_frame(9, 0x4, 1, response[4:]) +
+                         http2_frame(0, 0x8, 1, b"\x03" + b"\x00\x00\x00\x00\x02\x08" +
+                                     bytes([self.statuses[service]]) + b"pad") +
+                         http2_frame(1, 0x5, 1, hpack_encode([("grpc-status", "0")])))
+            time.sleep(0.1)
+        except (ConnectionError, OSError):
+            pass
+        finally:
+            conn.close()
+
+    def close(self):
+        self.server.close()
+
+
+class TestHpack:
+    """Tests for decoding HTTP/2 headers."""
+
+    def test_rfc_examples(self):
+        """Test the RFC 7541 C.4 requests, which share a dynamic table and use Huffman strings."""
+        from omni_run import HpackDecoder, hpack_huffman_decode, hpack_encode
+
+        decoder = HpackDecoder()
+        assert decoder.decode(bytes.fromhex("828684418cf1e3c2e5f23a6ba0ab90f4ff")) == [
+            (":method", "GET"), (":scheme", "http"), (":path", "/"), (":authority", "www.example.com")]
+        assert decoder.decode(bytes.fromhex("828684be5886a8eb10649cbf"))[-2:] == [
+            (":authority", "www.example.com"), ("cache-control", "no-cache")]
+        assert decoder.decode(bytes.fromhex("828785bf408825a849e95ba97d7f8925a849e95bb8e8b4bf"))[-1] == (
+            "custom-key", "custom-value")
+        assert hpack_huffman_decode(bytes.fromhex("9d29ad171863c78f0b97c8e9ae82ae43d3")) == b"https://www.example.com"
+        with pytest.raises(ValueError, match="padding"):
+            hpack_huffman_decode(b"\x00")
+
+        long = [("x-" + "n" * 200, "v" * 300)]
+        assert HpackDecoder().decode(hpack_encode(long)) == long
+
+
+class TestGrpcProbeConfig:
+    """Tests for `type: grpc` health blocks."""
+
+    def test_parse_probe(self):
+        """Test service names, named ports and TLS options."""
+        from omni_run import ProbeSpec
+
+        plain = ProbeSpec.from_config("api", {"type": "grpc", "port": "grpc"})
+        assert (plain.port_ref, plain.grpc_service, plain.tls) == ("grpc", "", False)
+        assert ProbeSpec.from_config("api", {"type": "grpc", "port": 50051, "tls": True}).tls_verify
+        secure = ProbeSpec.from_config("api", {"type": "grpc", "port": 50051, "service": "users.v1.Users",
+                                               "tls": {"ca_file": "certs/ca.pem", "server_name": "api.internal",
+                                                       "verify": False}})
+        assert (secure.grpc_service, secure.tls, secure.tls_verify) == ("users.v1.Users", True, False)
+        assert (secure.ca_file, secure.server_name) == ("certs/ca.pem", "api.internal")
+
+    def test_invalid_probe(self, temp_dir):
+        """Test a grpc probe without a port and grpc options on other probe types."""
+        from omni_run import load_manifest, ManifestError
+
+        for health, message in [("{type: grpc}", "grpc probe needs port"),
+                                ("{port: 8080, path: /, tls: true}", "health.tls: only applies to grpc probes"),
+                                ("{type: grpc, port: 1, tls: yes-please}", "health.tls"),
+                                ("{type: grpc2, port: 1}", "must be http, tcp, exec or grpc")]:
+            write_manifest(temp_dir, f"services:\n  api:\n    command: 'true'\n    health: {health}\n")
+            with pytest.raises(ManifestError, match=message):
+                load_manifest(temp_dir / "omni-run.yaml")
+
+
+class TestGrpcProbe:
+    """Tests for probing gRPC servers."""
+
+    def test_cleartext(self):
+        """Test serving, not serving and unknown services, and the request the server sees."""
+        from omni_run import ProbeSpec, run_probe
+
+        server = HealthServer({"": 1, "users.v1.Users": 1, "billing.v1.Billing": 2})
+        probe = lambda service="": run_probe(ProbeSpec(type="grpc", port=server.port, grpc_service=service))
+        try:
+            assert (probe().ok, probe().message) == (True, "gRPC SERVING")
+            assert probe("users.v1.Users").ok
+            assert (probe("billing.v1.Billing").ok, probe("billing.v1.Billing").message) == (False, "gRPC NOT_SERVING")
+            assert probe("audit.v1.Audit").message == "gRPC NOT_FOUND: unknown service audit.v1.Audit"
+        finally:
+            server.close()
+        request = server.requests[0]
+        assert request[":path"] == "/grpc.health.v1.Health/Check" and request[":scheme"] == "http"
+        assert request["content-type"] == "application/grpc" and request["te"] == "trailers"
+
+    def test_not_http2(self):
+        """Test the hint when the port doesn't speak HTTP/2."""
+        from omni_run import ProbeSpec, run_probe
+
+        listener = socket.create_server(("127.0.0.1", 0))
+        threading.Thread(target=lambda: listener.accept()[0].sendall(b"HTTP/1.1 400 Bad Request\r\n\r\n"),
+                         daemon=True).start()
+        try:
+            result = run_probe(ProbeSpec(type="grpc", port=listener.getsockname()[1]))
+        finally:
+            listener.close()
+        assert not result.ok and "did not answer with HTTP/2 (is it a gRPC server, or does it expect TLS?)" in result.message
+
+
+@pytest.mark.skipif(not shutil.which("openssl"), reason="Needs openssl to generate certificates")
+class TestGrpcProbeTls:
+    """Tests for gRPC probes over TLS."""
+
+    def _server(self, temp_dir):
+        from omni_run import LocalCA
+
+        ca = LocalCA(temp_dir / "ca").ensure()
+        return ca, HealthServer({"": 1}, ca.issue(temp_dir / "tls", "api", ["api.localhost", "localhost"], "test"))
+
+    def test_verification(self, temp_dir):
+        """Test trusting the CA through ca_file, hostname checks and verify: false."""
+        from omni_run import ProbeSpec, run_probe
+
+        ca, server = self._server(temp_dir)
+        probe = lambda **kwargs: run_probe(ProbeSpec(type="grpc", port=server.port, tls=True, **kwargs))
+        try:
+            assert "CERTIFICATE_VERIFY_FAILED" in probe().message
+            assert probe(ca_file=str(ca.cert)).ok
+            assert not probe(ca_file="ca/rootCA.pem").ok  # Relative to the service's directory, passed as cwd
+            assert run_probe(ProbeSpec(type="grpc", port=server.port, tls=True, ca_file="ca/rootCA.pem"), cwd=temp_dir).ok
+            assert "Hostname mismatch" in probe(ca_file=str(ca.cert), server_name="db.localhost").message
+            assert probe(tls_verify=False).ok
+            assert "expect TLS" in run_probe(ProbeSpec(type="grpc", port=server.port)).message
+        finally:
+            server.close()
+        assert server.requests[0][":scheme"] == "https"
+
+    @pytest.mark.skipif(sys.platform == "win32", reason="Uses POSIX process groups")
+    def test_up_trusts_local_ca(self, temp_dir, omni_runner, monkeypatch):
+        """Test that a service's TLS probe trusts the local CA without any ca_file."""
+        from omni_run import load_manifest, Orchestrator
+
+        monkeypatch.setenv("OMNI_RUN_CAROOT", str(temp_dir / "ca"))
+        _, server = self._server(temp_dir)
+        try:
+            manifest = load_manifest(write_manifest(temp_dir, f"""
+services:
+  api:
+    command: sleep 30
+    health: {{type: grpc, port: {server.port}, tls: true, interval: 100ms}}
+"""))
+            orchestrator = Orchestrator(omni_runner, manifest)
+            service = orchestrator.services["api"]
+            orchestrator.start_service(service)
+            deadline = time.time() + 10
+            while service.health.healthy is None and time.time() < deadline:
+                time.sleep(0.05)
+            assert service.health.healthy is True
+            assert service.health.probe.ca_file == str(temp_dir / "ca" / "rootCA.pem")
+            orchestrator.stop_service(service, timeout=5)
+        finally:
+            server.close()
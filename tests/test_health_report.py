@@ -0,0 +1,192 @@
+"""
+Tests for health-check history and `omni-run health report` in OmniRun.
+
+This module tests:
+- Recording every health check in the state store, and dropping old ones
+- Summaries: uptime, flaps, average and p95 probe latency, and the last failure
+- `health report` over a window, with --fail-under and --output json
+- `up` recording a service's checks
+"""
+
+import sys
+import json
+import time
+import pytest
+from pathlib import Path
+from datetime import datetime, timedelta
+
+from conftest import *
+
+
+def record(store, name, outcomes, start, step=timedelta(seconds=10)):
+    """Record checks from "+" (passed) and "-" (failed) characters, with the health state a
+    failure threshold of 2 gives; the latency of each check is its position in milliseconds."""
+    from omni_run import ProbeResult
+
+    healthy, failures = None, 0
+    for i, outcome in enumerate(outcomes):
+        failures = 0 if outcome == "+" else failures + 1
+        healthy = True if outcome == "+" else False if failures >= 2 else healthy
+        store.record_health(name, ProbeResult(outcome == "+", (i + 1) / 1000, "" if outcome == "+" else "HTTP 503"),
+                            healthy, at=start + i * step)
+
+
+@pytest.fixture
+def history(temp_dir):
+    """A store with an api checked in the last minutes and a db checked 8 days ago; yields (store, now)."""
+    from omni_run import StateStore, STATE_DB
+
+    store = StateStore(temp_dir / STATE_DB)
+    now = datetime.now()
+    try:
+        record(store, "api", "+" * 10 + "--" + "+" * 5 + "-+" + "--" + "+", now - timedelta(minutes=5))
+        record(store, "db", "++", now - timedelta(days=8))
+        yield store, now
+    finally:
+        store.close()
+
+
+@pytest.fixture
+def recorded_web(temp_dir, omni_runner):
+    """A web checked every 100ms by `up` until 5 checks are recorded; yields the checks of the last minute."""
+    from omni_run import load_manifest, Orchestrator, StateStore, STATE_DB
+
+    write_manifest(temp_dir, f"""
+services:
+  web:
+    command: ["{sys.executable}", "-c", "import os, socket, time; s = socket.create_server(('127.0.0.1', int(os.environ['PORT']))); time.sleep(60)"]
+    ports: auto
+    health: {{type: tcp, port: http, interval: 100ms}}
+""")
+    orchestrator = Orchestrator(omni_runner, load_manifest(temp_dir / "omni-run.yaml"))
+    orchestrator.store = StateStore(temp_dir / STATE_DB)
+    recent = lambda: orchestrator.store.health_checks("web", datetime.now() - timedelta(minutes=1))
+    try:
+        orchestrator.start_service(orchestrator.services["web"])
+        deadline = time.time() + 10
+        while time.time() < deadline and len(recent()) < 5:
+            time.sleep(0.1)
+    finally:
+        orchestrator.shutdown()
+    try:
+        yield recent()
+    finally:
+        orchestrator.store.close()
+
+
+class TestHealthHistory:
+    """Tests for the recorded checks and their summaries."""
+
+    def test_services(self, history):
+        """Test that only services checked within the window are listed."""
+        store, now = history
+        assert store.health_services(now - timedelta(hours=1)) == ["api"]
+
+    def test_summary(self, history):
+        """Test uptime, flaps on healthy -> unhealthy only, latencies and the last failure."""
+        from omni_run import health_summary
+
+        store, now = history
+        summary = health_summary(store.health_checks("api", now - timedelta(hours=1)))
+        assert (summary["checks"], summary["failed"], summary["uptime"], summary["flaps"]) == (22, 5, 77.273, 2)
+        assert summary["latency_avg"] == 0.0115 and summary["latency_p95"] == 0.021
+        assert summary["last_failure"]["message"] == "HTTP 503"
+
+    def test_window(self, history):
+        """Test a summary of only the checks since a later time, and of no checks."""
+        from omni_run import health_summary
+
+        store, now = history
+        later = health_summary(store.health_checks("api", now - timedelta(minutes=5) + timedelta(seconds=175)))
+        assert (later["checks"], later["uptime"]) == (4, 50.0)
+        assert health_summary([])["uptime"] is None
+
+    def test_retention(self, history):
+        """Test that recording a check drops the ones from more than a week ago."""
+        store, now = history
+        record(store, "db", "+", now)
+        assert len(store.health_checks("db", now - timedelta(days=30))) == 1
+
+
+class TestHealthReport:
+    """Tests for `omni-run health report`."""
+
+    def _recorded(self, temp_dir):
+        from omni_run import StateStore, STATE_DB
+
+        write_manifest(temp_dir, "services:\n  api: {command: ./api}\n  web: {command: ./web}\n")
+        (temp_dir / ".omni-run").mkdir(exist_ok=True)
+        store = StateStore(temp_dir / ".omni-run" / STATE_DB)
+        start = datetime.now() - timedelta(minutes=10)
+        record(store, "api", "+" * 99 + "-", start, step=timedelta(seconds=1))
+        record(store, "web", "+" * 9 + "--" + "+" * 9, start)
+        record(store, "web", "-" * 20, datetime.now() - timedelta(hours=3))
+        store.close()
+
+    def test_nothing_recorded(self, temp_dir, capsys):
+        """Test the report without any checks, which fails --fail-under."""
+        from omni_run import run_subcommand
+
+        write_manifest(temp_dir, "services:\n  api: {command: ./api}\n  web: {command: ./web}\n")
+        assert run_subcommand(["health", "report", "-C", str(temp_dir)]) == 0
+        assert "No health checks recorded in the last 24h" in capsys.readouterr().out
+        assert run_subcommand(["health", "-C", str(temp_dir), "--fail-under", "99"]) == 1
+
+    def test_table(self, temp_dir, capsys):
+        """Test the checks, uptime, flaps, latency and last failure of each service."""
+        from omni_run import run_subcommand, ANSI_ESCAPE
+
+        self._recorded(temp_dir)
+        assert run_subcommand(["health", "report", "-C", str(temp_dir), "--window", "1h"]) == 0
+        out = ANSI_ESCAPE.sub("", capsys.readouterr().out)
+        lines = {line.split()[0]: line for line in out.splitlines() if line.startswith(("api ", "web "))}
+        assert lines["api"].split()[1:4] == ["100", "99.00%", "0"] and lines["api"].split()[5] == "95ms"
+        assert lines["web"].split()[1:4] == ["20", "90.00%", "1"] and "HTTP 503" in lines["web"]
+
+    def test_fail_under(self, temp_dir, capsys):
+        """Test that --fail-under fails for services under it only, and for named services only."""
+        from omni_run import run_subcommand, ANSI_ESCAPE
+
+        self._recorded(temp_dir)
+        assert run_subcommand(["health", "report", "-C", str(temp_dir), "--window", "1h", "--fail-under", "99"]) == 1
+        out = ANSI_ESCAPE.sub("", capsys.readouterr().out)
+        assert "web: uptime 90.00% is under 99%" in out and "api: uptime" not in out
+        assert run_subcommand(["health", "report", "api", "-C", str(temp_dir), "--window", "1h",
+                               "--fail-under", "99"]) == 0
+
+    def test_json(self, temp_dir, capsys):
+        """Test the JSON document, with a named service without checks failing."""
+        from omni_run import run_subcommand
+
+        self._recorded(temp_dir)
+        assert run_subcommand(["health", "report", "api", "db", "-C", str(temp_dir), "--window", "1h",
+                               "--fail-under", "99", "--output", "json"]) == 1
+        document = json.loads(capsys.readouterr().out)
+        assert document["kind"] == "health" and document["failing"] == ["db"] and document["window"] == 3600
+        assert document["services"]["api"]["checks"] == 100 and document["services"]["db"]["checks"] == 0
+
+    def test_window(self, temp_dir, capsys):
+        """Test a longer --window, and an invalid one."""
+        from omni_run import run_subcommand
+
+        self._recorded(temp_dir)
+        assert run_subcommand(["health", "report", "web", "-C", str(temp_dir), "--window", "5h"]) == 0
+        assert "45.00%" in capsys.readouterr().out  # With the checks that failed 3 hours ago
+        assert run_subcommand(["health", "report", "-C", str(temp_dir), "--window", "soon"]) == 1
+        assert "--window: " in capsys.readouterr().out
+
+
+@pytest.mark.skipif(sys.platform == "win32", reason="Uses POSIX process groups")
+class TestHealthRecording:
+    """Tests for `up` recording health checks."""
+
+    def test_recorded(self, recorded_web):
+        """Test that every check of a running service ends up in the store with its state."""
+        assert len(recorded_web) >= 5 and recorded_web[-1]["healthy"] is True
+
+    def test_summarized(self, recorded_web):
+        """Test the summary of the recorded checks."""
+        from omni_run import health_summary
+
+        summary = health_summary(recorded_web)
+        assert summary["uptime"] > 0 and summary["latency_avg"] < 1
@@ -0,0 +1,355 @@
+"""
+Tests for hot-swapping rebuilt services (`hot_swap:`) in OmniRun.
+
+This module tests:
+- Parsing `hot_swap: true`, the default watch globs for Go services, and invalid combinations
+- Relaying connections to the current process, holding a replacement back, and giving it up
+- Swapping a new process in without refusing connections, and keeping the old one when the new one fails
+- Rebuilding and swapping a Go service
+"""
+
+import sys
+import time
+import shutil
+import socket
+import threading
+import pytest
+from pathlib import Path
+
+from conftest import *
+
+
+# Answers every request with the contents of message.txt as it was when the process started
+MESSAGE_SERVER = """\
+import os, sys
+from http.server import BaseHTTPRequestHandler, HTTPServer
+
+body = open("message.txt").read().encode()
+if body == b"crash":
+    sys.exit(3)
+
+class Handler(BaseHTTPRequestHandler):
+    def do_GET(self):
+        self.send_response(200)
+        self.send_header("Content-Length", str(len(body)))
+        self.end_headers()
+        self.wfile.write(body)
+
+    def log_message(self, *args):
+        pass
+
+HTTPServer(("127.0.0.1", int(os.environ["PORT"])), Handler).serve_forever()
+"""
+
+GO_SERVER = """\
+package main
+
+import (
+    "fmt"
+    "net/http"
+    "os"
+)
+
+func main() {
+    http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) { fmt.Fprint(w, "MESSAGE") })
+    http.ListenAndServe(":"+os.Getenv("PORT"), nil)
+}
+"""
+
+
+def fetch(port: int) -> str:
+    import http.client
+
+    conn = http.client.HTTPConnection("127.0.0.1", port, timeout=10)
+    try:
+        conn.request("GET", "/")
+        return conn.getresponse().read().decode()
+    finally:
+        conn.close()
+
+
+def wait_for(condition, timeout: float = 20):
+    deadline = time.time() + timeout
+    while time.time() < deadline and not condition():
+        time.sleep(0.05)
+    assert condition()
+
+
+def answers(port: int, body: str) -> bool:
+    try:
+        return fetch(port) == body
+    except OSError:
+        return False
+
+
+def serve(reply: bytes) -> socket.socket:
+    server = socket.create_server(("127.0.0.1", 0))
+
+    def accept():
+        while True:
+            try:
+                client, _ = server.accept()
+            except OSError:
+                return
+            client.sendall(reply)
+            client.close()
+    threading.Thread(target=accept, daemon=True).start()
+    return server
+
+
+def read(port: int) -> bytes:
+    with socket.create_connection(("127.0.0.1", port), timeout=5) as sock:
+        return sock.recv(100)
+
+
+@pytest.fixture
+def relay():
+    """A started relay on a free port; yields (swap, allocator, public port, serve(reply) giving a server's ports)."""
+    from omni_run import HotSwap, PortAllocator
+
+    allocator, servers = PortAllocator(), []
+    public = allocator.free_port()
+    swap = HotSwap({"http": public})
+    swap.start()
+
+    def serving(reply: bytes) -> dict:
+        servers.append(serve(reply))
+        return {"http": servers[-1].getsockname()[1]}
+
+    try:
+        yield swap, allocator, public, serving
+    finally:
+        swap.close(allocator)
+        for server in servers:
+            server.close()
+
+
+@pytest.fixture
+def swapping(temp_dir, omni_runner):
+    """A hot-swapped web answering v1 from message.txt; yields (orchestrator, web, public port)."""
+    from omni_run import load_manifest, Orchestrator
+
+    (temp_dir / "server.py").write_text(MESSAGE_SERVER)
+    (temp_dir / "message.txt").write_text("v1")
+    write_manifest(temp_dir, f"""
+services:
+  web:
+    command: ["{sys.executable}", "server.py"]
+    ports: auto
+    hot_swap: true
+""")
+    orchestrator = Orchestrator(omni_runner, load_manifest(temp_dir / "omni-run.yaml"))
+    web = orchestrator.services["web"]
+    try:
+        orchestrator.start_service(web)
+        wait_for(lambda: answers(web.ports["http"], "v1"))
+        yield orchestrator, web, web.ports["http"]
+    finally:
+        orchestrator.shutdown()
+        orchestrator.close_listeners()
+
+
+@pytest.fixture
+def go_api(temp_dir, omni_runner):
+    """A hot-swapped Go api answering v1; yields (orchestrator, api, main.go, public port)."""
+    from omni_run import load_manifest, Orchestrator
+
+    app = temp_dir / "api"
+    app.mkdir()
+    (app / "go.mod").write_text("module example.com/api\n\ngo 1.18\n")
+    (app / "main.go").write_text(GO_SERVER.replace("MESSAGE", "v1"))
+    write_manifest(temp_dir, "services:\n  api: {path: api, ports: auto, hot_swap: true, install: false}\n")
+    orchestrator = Orchestrator(omni_runner, load_manifest(temp_dir / "omni-run.yaml"))
+    api = orchestrator.services["api"]
+    try:
+        orchestrator.start_service(api)
+        wait_for(lambda: answers(api.ports["http"], "v1"), timeout=120)
+        yield orchestrator, api, app / "main.go", api.ports["http"]
+    finally:
+        orchestrator.shutdown()
+        orchestrator.close_listeners()
+
+
+class TestHotSwapSpec:
+    """Tests for parsing `hot_swap:`."""
+
+    def _services(self, temp_dir):
+        from omni_run import load_manifest
+
+        (temp_dir / "api").mkdir()
+        (temp_dir / "api" / "go.mod").write_text("module example.com/api\n")
+        write_manifest(temp_dir, """
+services:
+  api: {path: api, ports: auto, hot_swap: true}
+  web: {command: ./web, ports: auto, hot_swap: true, watch: '*.py'}
+  worker: {path: api, ports: auto}
+""")
+        return load_manifest(temp_dir / "omni-run.yaml").services
+
+    def test_go_watch(self, temp_dir):
+        """Test that a hot-swapped Go service watches its sources and module files."""
+        api = self._services(temp_dir)["api"]
+        assert api.hot_swap and api.watch == ["*.go", "go.mod", "go.sum"]
+
+    def test_explicit_watch(self, temp_dir):
+        """Test that explicit watch globs are kept."""
+        assert self._services(temp_dir)["web"].watch == ["*.py"]
+
+    def test_off(self, temp_dir):
+        """Test that a Go service without hot_swap watches nothing."""
+        worker = self._services(temp_dir)["worker"]
+        assert not worker.hot_swap and worker.watch == []
+
+    def test_invalid(self, temp_dir):
+        """Test the settings hot_swap can't be combined with."""
+        from omni_run import load_manifest, ManifestError
+
+        for block, message in [("{command: x, hot_swap: true}", "services.api.hot_swap: needs ports: to keep open"),
+                               ("{command: x, ports: auto, hot_swap: true, backend: docker}",
+                                r"services.api.hot_swap: needs the host backend \(backend is docker\)"),
+                               ("{command: x, ports: {http: {port: 8080, socket: true}}, hot_swap: true}",
+                                "services.api.ports.http.socket: hot_swap already keeps the port open")]:
+            write_manifest(temp_dir, f"services:\n  api: {block}\n")
+            with pytest.raises(ManifestError, match=message):
+                load_manifest(temp_dir / "omni-run.yaml")
+
+
+class TestHotSwapRelay:
+    """Tests for the relay in front of a service."""
+
+    def _serving_v1(self, relay):
+        swap, allocator, _, serving = relay
+        swap.renew(allocator)
+        swap.backend = swap.active = serving(b"v1")
+
+    def test_relay(self, relay):
+        """Test that renewing reserves a port of the process's own, and relaying to the active process."""
+        swap, allocator, public, serving = relay
+        first = swap.renew(allocator)
+        assert swap.active == first and first["http"] != public
+        swap.backend = swap.active = serving(b"v1")
+        assert read(public) == b"v1" and swap.listening()
+
+    def test_hold(self, relay):
+        """Test that a held replacement isn't relayed to."""
+        swap, allocator, public, _ = relay
+        self._serving_v1(relay)
+        swap.hold = True
+        second = swap.renew(allocator)
+        assert swap.active != second and not swap.listening()  # Nothing listens on the new port yet
+        assert read(public) == b"v1"
+
+    def test_discard(self, relay):
+        """Test that discarding a replacement releases its port."""
+        swap, allocator, _, _ = relay
+        self._serving_v1(relay)
+        swap.hold = True
+        second = swap.renew(allocator)
+        swap.discard(allocator)
+        assert swap.backend == swap.active and second["http"] not in allocator.reserved
+
+    def test_activate(self, relay):
+        """Test that activating a replacement relays to it."""
+        swap, allocator, public, serving = relay
+        self._serving_v1(relay)
+        swap.backend = serving(b"v2")
+        swap.activate(allocator)
+        assert read(public) == b"v2"
+
+    def test_close(self, relay):
+        """Test that closing the relay stops accepting connections."""
+        swap, allocator, public, _ = relay
+        self._serving_v1(relay)
+        swap.close(allocator)
+        with pytest.raises(OSError):
+            read(public)
+
+
+@pytest.mark.skipif(sys.platform == "win32", reason="Uses POSIX process groups")
+class TestHotSwapReload:
+    """Tests for swapping processes behind the service's ports."""
+
+    def test_relayed(self, swapping):
+        """Test that the process listens on a port of its own behind the service's."""
+        orchestrator, web, public = swapping
+        assert orchestrator.process_ports(web)["http"] != public
+
+    def test_swap(self, temp_dir, swapping, capsys):
+        """Test that requests keep being answered across a swap, and one in flight finishes on the old process."""
+        from omni_run import ANSI_ESCAPE
+
+        orchestrator, web, public = swapping
+        failures, stop = [], threading.Event()
+
+        def hammer():
+            while not stop.is_set():
+                try:
+                    fetch(public)
+                except OSError as e:
+                    failures.append(e)
+                time.sleep(0.01)
+
+        swap = orchestrator.swaps["web"]
+        in_flight = socket.create_connection(("127.0.0.1", public), timeout=10)
+        in_flight.sendall(b"GET / HTTP/1.0\r\n")  # The rest of the request comes after the swap
+        wait_for(lambda: any(swap._open.values()))
+        hammering = threading.Thread(target=hammer, daemon=True)
+        hammering.start()
+        (temp_dir / "message.txt").write_text("v2")
+        old_pid, old_ports = web.process.pid, dict(swap.active)
+        replaced = []
+        replacing = threading.Thread(target=lambda: replaced.append(orchestrator.replace_service(web)))
+        try:
+            replacing.start()
+            wait_for(lambda: swap.active != old_ports)
+            time.sleep(0.3)  # Enough for the old process to be stopped, were it not waiting
+            in_flight.sendall(b"\r\n")
+            assert in_flight.makefile("rb").read().endswith(b"\r\n\r\nv1")
+            replacing.join(timeout=30)
+        finally:
+            in_flight.close()
+            stop.set()
+            hammering.join(timeout=5)
+        assert replaced == [True]
+        assert fetch(public) == "v2" and web.process.pid != old_pid
+        assert failures == []
+        assert f"hot swap: starting a new process next to pid {old_pid}" in ANSI_ESCAPE.sub("", capsys.readouterr().out)
+
+    def test_failed_swap(self, temp_dir, swapping, capsys):
+        """Test that the old process keeps serving when the new one fails."""
+        from omni_run import ANSI_ESCAPE
+
+        orchestrator, web, public = swapping
+        (temp_dir / "message.txt").write_text("crash")
+        assert not orchestrator.replace_service(web)
+        assert fetch(public) == "v1"
+        out = ANSI_ESCAPE.sub("", capsys.readouterr().out)
+        assert f"reload failed: the new process exited with code 3; pid {web.process.pid} keeps serving" in out
+
+    def test_shutdown(self, swapping):
+        """Test that shutting down closes the service's ports."""
+        orchestrator, _, public = swapping
+        orchestrator.shutdown()
+        orchestrator.close_listeners()
+        assert orchestrator.swaps == {}
+        with pytest.raises(OSError):
+            fetch(public)
+
+    @pytest.mark.skipif(shutil.which("go") is None, reason="Needs a Go toolchain")
+    def test_go(self, go_api):
+        """Test that an edit to a Go service rebuilds it and swaps it in."""
+        orchestrator, api, main, public = go_api
+        main.write_text(GO_SERVER.replace("MESSAGE", "v2"))
+        assert orchestrator.replace_service(api)
+        assert fetch(public) == "v2"
+
+    @pytest.mark.skipif(shutil.which("go") is None, reason="Needs a Go toolchain")
+    def test_go_broken_edit(self, go_api, capsys):
+        """Test that a Go edit that doesn't build keeps the running process."""
+        from omni_run import ANSI_ESCAPE
+
+        orchestrator, api, main, public = go_api
+        main.write_text(GO_SERVER.replace("MESSAGE", "v3").replace("func main", "func main("))
+        assert not orchestrator.replace_service(api)
+        assert fetch(public) == "v1"
+        assert "reload failed: build failed" in ANSI_ESCAPE.sub("", capsys.readouterr().out)
@@ -0,0 +1,196 @@
+"""
+Tests for `omni-run import` in OmniRun.
+
+This module tests:
+- Procfile translation, including $PORT assignment
+- docker-compose translation: build and image services, ports, env, env_file,
+  depends_on conditions, healthchecks and restart policies
+- Writing, refusing to overwrite and printing the generated manifest
+"""
+
+import sys
+import pytest
+from pathlib import Path
+
+from conftest import *
+
+
+COMPOSE = """
+services:
+  db:
+    image: postgres:16
+    environment:
+      POSTGRES_PASSWORD: secret
+      POSTGRES_USER: ${DB_USER}
+    ports: ["5432:5432"]
+    healthcheck:
+      test: ["CMD-SHELL", "pg_isready -U postgres"]
+      interval: 5s
+      timeout: 1m30s
+      retries: 5
+    volumes: [data:/var/lib/postgresql/data]
+  api:
+    build: {context: ./api, dockerfile: Dockerfile}
+    command: python app.py
+    environment: [DEBUG=1, HOME]
+    env_file: api/.env.docker
+    ports: ["8080:80", "127.0.0.1:9090:9090/tcp"]
+    depends_on:
+      db: {condition: service_healthy}
+    restart: on-failure:3
+volumes: {data: {}}
+"""
+
+
+class TestProcfileImport:
+    """Tests for translating a Procfile."""
+
+    def test_processes_and_ports(self, temp_dir):
+        """Test that processes become services and $PORT users get foreman's ports."""
+        from omni_run import import_procfile
+
+        procfile = temp_dir / "Procfile"
+        procfile.write_text("# processes\nweb: bundle exec rails s -p $PORT\n"
+                            "worker: bundle exec sidekiq\nrelease: rake db:migrate\napi: node server.js --port=${PORT}\n")
+        data, notes = import_procfile(procfile)
+
+        assert data["services"] == {
+            "web": {"command": "bundle exec rails s -p $PORT", "ports": 5000},
+            "worker": {"command": "bundle exec sidekiq"},
+            "api": {"command": "node server.js --port=${PORT}", "ports": 5200},
+        }
+        assert any("release" in note for note in notes)
+
+    def test_invalid_procfile(self, temp_dir):
+        """Test that malformed and empty Procfiles are rejected."""
+        from omni_run import import_procfile, ManifestError
+
+        procfile = temp_dir / "Procfile"
+        procfile.write_text("web bundle exec rails s\n")
+        with pytest.raises(ManifestError, match=r"Procfile:1: expected `name: command`"):
+            import_procfile(procfile)
+        procfile.write_text("# nothing\n")
+        with pytest.raises(ManifestError, match="no processes defined"):
+            import_procfile(procfile)
+
+
+class TestComposeImport:
+    """Tests for translating a docker-compose file."""
+
+    def _import(self, temp_dir, content=COMPOSE):
+        from omni_run import import_compose
+
+        (temp_dir / "api").mkdir(exist_ok=True)
+        compose = temp_dir / "docker-compose.yml"
+        compose.write_text(content)
+        return import_compose(compose)
+
+    def test_image_service_becomes_docker_run(self, temp_dir):
+        """Test that an image-only service runs its image with the same ports, env and healthcheck."""
+        data, notes = self._import(temp_dir)
+        db = data["services"]["db"]
+        project = temp_dir.name
+
+        assert db["command"] == ["docker", "run", "--rm", "--name", f"{project}-db", "-p", "${PORT_HTTP}:5432",
+                                 "-e", "POSTGRES_PASSWORD", "-e", "POSTGRES_USER", "postgres:16"]
+        assert db["ports"] == 5432
+        assert db["env"] == {"POSTGRES_PASSWORD": "secret", "POSTGRES_USER": "${env.DB_USER}"}
+        assert db["health"] == {"type": "exec",
+                                "command": ["docker", "exec", f"{project}-db", "/bin/sh", "-c", "pg_isready -U postgres"],
+                                "interval": "5s", "timeout": "90s", "failure_threshold": 5}
+        assert "db: not imported: volumes" in notes
+
+    def test_build_service_runs_on_host(self, temp_dir):
+        """Test that a build service keeps its context, command, ports, env and dependencies."""
+        data, notes = self._import(temp_dir)
+        api = data["services"]["api"]
+
+        assert api == {
+            "path": "api",
+            "command": "python app.py",
+            "ports": [8080, 9090],
+            "env": {"DEBUG": "1"},
+            "env_file": [".env.docker"],
+            "depends_on": {"db": "service_healthy"},
+            "restart": {"policy": "on-failure", "max_restarts": 3},
+        }
+        assert any(note.startswith("api: runs on the host") for note in notes)
+
+    def test_generated_manifest_loads(self, temp_dir):
+        """Test that the translated data is a valid manifest."""
+        import yaml
+        from omni_run import load_manifest
+
+        data, _ = self._import(temp_dir)
+        (temp_dir / "api" / ".env.docker").write_text("TOKEN=abc\n")
+        (temp_dir / "omni-run.yaml").write_text(yaml.safe_dump(data))
+        manifest = load_manifest(temp_dir / "omni-run.yaml")
+
+        assert manifest.services["api"].conditions["db"].condition == "service_healthy"
+        assert manifest.services["api"].path == (temp_dir / "api").resolve()
+        assert list(manifest.services["api"].ports) == ["http", "port1"]
+        assert manifest.services["db"].health.failure_threshold == 5
+        assert manifest.services["api"].restart.max_restarts == 3
+
+    def test_awaited_service_becomes_init(self, temp_dir):
+        """Test that a service others wait to complete becomes an init service."""
+        data, notes = self._import(temp_dir, """
+services:
+  cache:
+    image: redis
+  job:
+    image: alpine
+    command: echo done
+    depends_on:
+      cache: {condition: service_completed_successfully}
+""")
+        assert data["services"]["job"]["depends_on"] == {"cache": "service_completed_successfully"}
+        assert data["services"]["job"]["command"][-3:] == ["alpine", "echo", "done"]
+        assert data["services"]["cache"]["type"] == "init"
+
+    def test_interpolation_noted(self, temp_dir):
+        """Test that compose interpolation in a value is kept and noted."""
+        data, notes = self._import(temp_dir, "services:\n  cache:\n    image: redis\n"
+                                             "    environment: {URL: \"${REDIS_URL:-redis://localhost}\"}\n")
+        assert any("compose interpolation in URL" in note for note in notes)
+
+    def test_unusable_services(self, temp_dir):
+        """Test that a service without build or image, and a port range, are errors."""
+        from omni_run import ManifestError
+
+        with pytest.raises(ManifestError, match="needs `build` or `image`"):
+            self._import(temp_dir, "services:\n  x: {command: run}\n")
+        with pytest.raises(ManifestError, match="ranges are not supported"):
+            self._import(temp_dir, "services:\n  x: {image: nginx, ports: ['8000-8010:80']}\n")
+
+class TestImportCommand:
+    """Tests for the `omni-run import` subcommand."""
+
+    def test_writes_manifest_and_refuses_overwrite(self, temp_dir, capsys):
+        """Test that the manifest is written next to the source and not overwritten without --force."""
+        from omni_run import run_subcommand, load_manifest
+
+        (temp_dir / "Procfile").write_text("web: python -m http.server $PORT\n")
+        assert run_subcommand(["import", "-C", str(temp_dir)]) == 0
+        assert "Wrote" in capsys.readouterr().out
+        text = (temp_dir / "omni-run.yaml").read_text()
+        assert text.startswith("# Generated by `omni-run import` from Procfile")
+        assert load_manifest(temp_dir / "omni-run.yaml").services["web"].ports["http"].port == 5000
+
+        assert run_subcommand(["import", "-C", str(temp_dir)]) == 1
+        assert "already exists (use --force to overwrite)" in capsys.readouterr().out
+        assert run_subcommand(["import", "-C", str(temp_dir), "--force"]) == 0
+
+    def test_stdout_and_missing_source(self, temp_dir, capsys):
+        """Test printing to stdout with notes as comments, and the no-source error."""
+        from omni_run import run_subcommand
+
+        assert run_subcommand(["import", "-C", str(temp_dir)]) == 1
+        assert "No Procfile or docker-compose file found" in capsys.readouterr().out
+
+        (temp_dir / "compose.yaml").write_text("services:\n  web: {image: nginx, ports: [8080:80], volumes: [./site:/usr/share]}\n")
+        assert run_subcommand(["import", str(temp_dir / "compose.yaml"), "-o", "-"]) == 0
+        out = capsys.readouterr().out
+        assert "#   - web: not imported: volumes" in out
+        assert "- ${PORT_HTTP}:80" in out
+        assert not (temp_dir / "omni-run.yaml").exists()
@@ -0,0 +1,267 @@
+"""
+Tests for manifest `include:` fragments in OmniRun.
+
+This module tests:
+- Local fragments merged beneath the manifest, nested includes, cycles and invalid fragments
+- HTTPS fragments: the cache, checksum pinning and falling back to a stale copy
+- Fragments from a git repository at a ref, and reloading when a local fragment changes
+"""
+
+import sys
+import time
+import shutil
+import hashlib
+import threading
+import subprocess
+import pytest
+from pathlib import Path
+
+from conftest import *
+
+
+REDIS = """
+sidecars:
+  cache: {kind: redis, mode: embedded}
+services:
+  worker:
+    command: ./worker
+    env: {QUEUE: jobs, LOG_LEVEL: info}
+"""
+
+
+def serve(directory: Path):
+    """Serve a directory over HTTP on a free loopback port; returns (server, base URL)."""
+    import functools
+    import http.server
+
+    handler = functools.partial(http.server.SimpleHTTPRequestHandler, directory=str(directory))
+    handler.log_message = lambda *args: None
+    server = http.server.ThreadingHTTPServer(("127.0.0.1", 0), handler)
+    threading.Thread(target=server.serve_forever, daemon=True).start()
+    return server, f"http://127.0.0.1:{server.server_address[1]}"
+
+
+@pytest.fixture
+def published(temp_dir, monkeypatch):
+    """Fragments served over HTTP and an empty cache; yields (directory, base URL, server)."""
+    import omni_run
+
+    monkeypatch.setattr(omni_run, "INCLUDES_DIR", temp_dir / "cache")
+    directory = temp_dir / "published"
+    directory.mkdir()
+    (directory / "base.yaml").write_text("startup_timeout: 1m\n")
+    (directory / "redis.yaml").write_text("include: base.yaml\n" + REDIS)
+    server, url = serve(directory)
+    try:
+        yield directory, url, server
+    finally:
+        server.shutdown()
+        server.server_close()
+
+
+@pytest.fixture
+def fragments(temp_dir, monkeypatch):
+    """A git repository of fragments, tagged v1 and changed since; yields (repository, v1 commit)."""
+    import omni_run
+
+    monkeypatch.setattr(omni_run, "INCLUDES_DIR", temp_dir / "cache")
+    repo = temp_dir / "fragments"
+    (repo / "stacks").mkdir(parents=True)
+    (repo / "stacks" / "redis.yaml").write_text(REDIS)
+    git = lambda *args: subprocess.run(["git", "-c", "user.name=t", "-c", "user.email=t@example.com", *args],
+                                       cwd=repo, check=True, capture_output=True, text=True).stdout.strip()
+    git("init", "-q")
+    git("add", ".")
+    git("commit", "-q", "-m", "redis")
+    git("tag", "v1")
+    commit = git("rev-parse", "HEAD")
+    (repo / "stacks" / "redis.yaml").write_text(REDIS.replace("jobs", "v2"))
+    git("commit", "-q", "-am", "v2")
+    yield repo, commit
+
+
+class TestLocalIncludes:
+    """Tests for fragments on disk."""
+
+    def _merged(self, temp_dir, overrides=()):
+        from omni_run import load_manifest
+
+        (temp_dir / "shared").mkdir()
+        (temp_dir / "shared" / "redis.yaml").write_text("include: base.yaml\n" + REDIS)
+        (temp_dir / "shared" / "base.yaml").write_text("version: 1\nservices:\n  worker: {stop_signal: SIGINT}\n"
+                                                      "startup_timeout: 30s\n")
+        (temp_dir / "team.yaml").write_text("services:\n  worker: {env: {LOG_LEVEL: warn}}\n")
+        write_manifest(temp_dir, """
+include: [shared/redis.yaml, {path: team.yaml}]
+services:
+  worker: {env: {QUEUE: priority}}
+  api: {command: ./api, depends_on: [worker]}
+""")
+        return load_manifest(temp_dir / "omni-run.yaml", overrides=list(overrides))
+
+    def test_precedence(self, temp_dir):
+        """Test that the manifest wins over fragments, later fragments over earlier ones, and nested includes."""
+        manifest = self._merged(temp_dir)
+        worker = manifest.services["worker"]
+        assert worker.command == "./worker" and (worker.env["QUEUE"], worker.env["LOG_LEVEL"]) == ("priority", "warn")
+        assert worker.stop_signal is not None and worker.path == temp_dir.resolve()
+        assert list(manifest.sidecars) == ["cache"] and manifest.raw["startup_timeout"] == "30s"
+
+    def test_included_files(self, temp_dir):
+        """Test that the includes are recorded in load order and dropped from the merged manifest."""
+        manifest = self._merged(temp_dir)
+        assert "include" not in manifest.raw and manifest.version == 2
+        assert manifest.includes == [str(temp_dir.resolve() / "shared" / p) for p in ("base.yaml", "redis.yaml")] + [
+            str(temp_dir.resolve() / "team.yaml")]
+
+    def test_overrides(self, temp_dir):
+        """Test that --set overrides apply over included values."""
+        from omni_run import ConfigOverride
+
+        override = ConfigOverride(("services", "worker", "env", "LOG_LEVEL"), "debug", "--set")
+        assert self._merged(temp_dir, [override]).services["worker"].env["LOG_LEVEL"] == "debug"
+
+    def test_errors(self, temp_dir):
+        """Test missing files, cycles, bad fragments and invalid entries."""
+        from omni_run import load_manifest, ManifestError
+
+        (temp_dir / "a.yaml").write_text("include: b.yaml\n")
+        (temp_dir / "b.yaml").write_text("include: a.yaml\n")
+        (temp_dir / "bad.yaml").write_text("services:\n  x: {comand: true}\n")
+        for entry, message in [
+            ("nope.yaml", "include: cannot read .*nope.yaml"),
+            ("a.yaml", "a.yaml includes itself"),
+            ("bad.yaml", r"bad.yaml:2:7: services.x: unknown key\(s\) comand"),
+            ("{path: a.yaml, url: 'https://example.com/x.yaml'}", "include: give one of path, url or git"),
+            ("'http://example.com/x.yaml'", "remote fragments must be fetched over https"),
+            ("{path: a.yaml, sha256: abc}", "include.sha256: expected 64 hex digits"),
+            ("{path: a.yaml, ref: main}", "ref and file only apply to git includes"),
+        ]:
+            write_manifest(temp_dir, f"include: {entry}\nservices:\n  api: {{command: 'true'}}\n")
+            with pytest.raises(ManifestError, match=message):
+                load_manifest(temp_dir / "omni-run.yaml")
+
+
+class TestRemoteIncludes:
+    """Tests for fragments fetched over HTTP(S)."""
+
+    def test_fetch(self, temp_dir, published):
+        """Test fetching a pinned fragment and its nested include into the cache."""
+        from omni_run import load_manifest
+
+        directory, url, _ = published
+        digest = hashlib.sha256((directory / "redis.yaml").read_bytes()).hexdigest()
+        write_manifest(temp_dir, f"include: {{url: '{url}/redis.yaml', sha256: {digest}}}\n")
+        manifest = load_manifest(temp_dir / "omni-run.yaml")
+        assert manifest.services["worker"].env["QUEUE"] == "jobs" and manifest.raw["startup_timeout"] == "1m"
+        assert manifest.includes == [f"{url}/base.yaml", f"{url}/redis.yaml"]
+        assert len(list((temp_dir / "cache").glob("*.yaml"))) == 2
+
+    def test_cached(self, temp_dir, published):
+        """Test that a cached fragment is used while it is fresh."""
+        from omni_run import load_manifest
+
+        directory, url, _ = published
+        write_manifest(temp_dir, f"include: '{url}/redis.yaml'\n")
+        load_manifest(temp_dir / "omni-run.yaml")
+        (directory / "redis.yaml").write_text(REDIS.replace("jobs", "evil"))
+        assert load_manifest(temp_dir / "omni-run.yaml").services["worker"].env["QUEUE"] == "jobs"
+
+    def test_pinned_checksum(self, temp_dir, published):
+        """Test that a fragment changed from its pinned checksum is rejected, and used when not pinned."""
+        from omni_run import load_manifest, ManifestError
+
+        directory, url, _ = published
+        digest = hashlib.sha256((directory / "redis.yaml").read_bytes()).hexdigest()
+        (directory / "redis.yaml").write_text(REDIS.replace("jobs", "evil"))
+        write_manifest(temp_dir, f"include: {{url: '{url}/redis.yaml', sha256: {digest}}}\n")
+        with pytest.raises(ManifestError, match=f"has sha256 [0-9a-f]+, but {digest} is pinned"):
+            load_manifest(temp_dir / "omni-run.yaml")
+        write_manifest(temp_dir, f"include: '{url}/redis.yaml'\n")
+        assert load_manifest(temp_dir / "omni-run.yaml").services["worker"].env["QUEUE"] == "evil"
+
+    def test_stale_copy_when_offline(self, temp_dir, published, monkeypatch, capsys):
+        """Test that an expired cached fragment is used, with a warning, when it can't be fetched."""
+        import omni_run
+        from omni_run import load_manifest
+
+        _, url, server = published
+        write_manifest(temp_dir, f"include: '{url}/redis.yaml'\n")
+        load_manifest(temp_dir / "omni-run.yaml")
+        server.shutdown()
+        monkeypatch.setattr(omni_run, "INCLUDE_TTL", 0.0)
+        capsys.readouterr()
+        assert load_manifest(temp_dir / "omni-run.yaml").services["worker"].env["QUEUE"] == "jobs"
+        assert "could not fetch" in capsys.readouterr().out
+
+    def test_offline_without_cache(self, temp_dir, published):
+        """Test that a fragment that can't be fetched and was never cached is an error."""
+        from omni_run import load_manifest, ManifestError
+
+        _, url, server = published
+        server.shutdown()
+        write_manifest(temp_dir, f"include: '{url}/other.yaml'\n")
+        with pytest.raises(ManifestError, match="include: could not fetch"):
+            load_manifest(temp_dir / "omni-run.yaml")
+
+
+@pytest.mark.skipif(shutil.which("git") is None, reason="Needs git")
+class TestGitIncludes:
+    """Tests for fragments from a git repository."""
+
+    def test_tag(self, temp_dir, fragments):
+        """Test a fragment from a tag."""
+        from omni_run import load_manifest
+
+        repo, _ = fragments
+        write_manifest(temp_dir, f"include: {{git: '{repo}', ref: v1, file: stacks/redis.yaml}}\n")
+        manifest = load_manifest(temp_dir / "omni-run.yaml")
+        assert manifest.services["worker"].env["QUEUE"] == "jobs"
+        assert manifest.includes == [f"{repo}@v1:stacks/redis.yaml"]
+
+    def test_pinned_commit(self, temp_dir, fragments):
+        """Test a fragment from a pinned commit, kept once the repository is gone."""
+        from omni_run import load_manifest
+
+        repo, commit = fragments
+        write_manifest(temp_dir, f"include: {{git: '{repo}', ref: {commit}, file: stacks/redis.yaml}}\n")
+        assert load_manifest(temp_dir / "omni-run.yaml").services["worker"].env["QUEUE"] == "jobs"
+        shutil.rmtree(repo)
+        assert load_manifest(temp_dir / "omni-run.yaml").services["worker"].env["QUEUE"] == "jobs"
+
+    def test_outside_repository(self, temp_dir, fragments):
+        """Test that a file outside the repository is rejected."""
+        from omni_run import load_manifest, ManifestError
+
+        repo, commit = fragments
+        write_manifest(temp_dir, f"include: {{git: '{repo}', ref: {commit}, file: ../../x.yaml}}\n")
+        with pytest.raises(ManifestError, match="include.file: ../../x.yaml is outside the repository"):
+            load_manifest(temp_dir / "omni-run.yaml")
+
+
+@pytest.mark.skipif(sys.platform == "win32", reason="Uses POSIX sleep processes as services")
+class TestIncludeReload:
+    """Tests for reloading a running stack when a fragment changes."""
+
+    def test_reload(self, temp_dir, omni_runner, capsys):
+        """Test that editing a local fragment restarts the service it changes."""
+        import omni_run
+        from omni_run import load_manifest, Orchestrator, ANSI_ESCAPE
+
+        (temp_dir / "worker.yaml").write_text(
+            f"services:\n  worker:\n    command: ['{sys.executable}', -c, 'import time; time.sleep(60)']\n")
+        write_manifest(temp_dir, "include: worker.yaml\n")
+        orchestrator = Orchestrator(omni_runner, load_manifest(temp_dir / "omni-run.yaml"))
+        runner = threading.Thread(target=orchestrator.up, kwargs={"reload": True})
+        runner.start()
+        try:
+            deadline = time.time() + 20
+            while time.time() < deadline and not orchestrator.services["worker"].is_ready():
+                time.sleep(0.1)
+            (temp_dir / "worker.yaml").write_text((temp_dir / "worker.yaml").read_text() + "    env: {QUEUE: jobs}\n")
+            while time.time() < deadline and orchestrator.services["worker"].spec.env.get("QUEUE") != "jobs":
+                time.sleep(0.1)
+        finally:
+            orchestrator.request_shutdown()
+            runner.join(timeout=20)
+        assert orchestrator.services["worker"].spec.env == {"QUEUE": "jobs"}
@@ -0,0 +1,194 @@
+"""
+Tests for `omni-run init` and service watch globs in OmniRun.
+
+This module tests:
+- Scaffolding the go-http, node-http and python-http templates, and --force
+- Guessing ports and health endpoints from the bundled examples' sources
+- Notes for hardcoded ports and missing health endpoints, and printing with `-o -`
+- Refusing to overwrite an existing manifest, and directories with nothing to run
+- Parsing `watch:` and restarting a service when a watched file changes during `up`
+"""
+
+import sys
+import time
+import shutil
+import threading
+import pytest
+import yaml
+from pathlib import Path
+
+from conftest import *
+
+
+EXAMPLES = Path(__file__).parent.parent / "examples"
+
+
+def run_init(temp_dir, *args):
+    from omni_run import run_subcommand
+    return run_subcommand(["init", "-C", str(temp_dir), *args])
+
+
+class TestTemplates:
+    """Tests for scaffolding starter apps."""
+
+    def test_templates(self, temp_dir):
+        """Test the files each template writes, with the name filled in."""
+        from omni_run import write_init_template, INIT_TEMPLATES
+
+        for template in INIT_TEMPLATES:
+            root = temp_dir / template
+            created = write_init_template(root, template, "hello")
+            assert created and all(path.parent == root and path.exists() for path in created)
+            assert not any("{name}" in path.read_text() for path in created)
+        assert "module example.com/hello" in (temp_dir / "go-http" / "go.mod").read_text()
+        assert '"name": "hello"' in (temp_dir / "node-http" / "package.json").read_text()
+
+    def test_force(self, temp_dir):
+        """Test that existing files are only overwritten with force."""
+        from omni_run import write_init_template, ManifestError
+
+        (temp_dir / "server.js").write_text("// mine\n")
+        with pytest.raises(ManifestError, match="server.js already exist"):
+            write_init_template(temp_dir, "node-http", "hello")
+        assert (temp_dir / "server.js").read_text() == "// mine\n"
+        write_init_template(temp_dir, "node-http", "hello", force=True)
+        assert "PORT" in (temp_dir / "server.js").read_text()
+
+    def test_init_from_template(self, temp_dir, capsys):
+        """Test that a template yields a manifest using PORT, a health check and watch globs."""
+        from omni_run import load_manifest
+
+        assert run_init(temp_dir, "--template", "python-http", "--name", "hello") == 0
+        out = capsys.readouterr().out
+        assert "from the python-http template" in out and "omni-run up" in out
+
+        text = (temp_dir / "omni-run.yaml").read_text()
+        assert text.startswith("# Generated by `omni-run init`")
+        service = load_manifest(temp_dir / "omni-run.yaml").services["hello"]
+        assert service.ports["http"].port == 5000
+        assert (service.health.port_ref, service.health.path) == ("http", "/health")
+        assert "*.py" in service.watch
+
+
+class TestDetection:
+    """Tests for guessing services from existing projects."""
+
+    def test_examples(self, temp_dir, capsys):
+        """Test the bundled examples, printed with `-o -`: the Node and Go apps read PORT, Flask hardcodes its own."""
+        shutil.copytree(EXAMPLES, temp_dir / "examples")
+        assert run_init(temp_dir / "examples", "-o", "-") == 0
+        out = capsys.readouterr().out
+        assert not (temp_dir / "examples" / "omni-run.yaml").exists()
+
+        services = yaml.safe_load(out)["services"]
+        assert services["go_app"]["path"] == "go_app" and services["go_app"]["command"].startswith("go run")
+        assert services["go_app"]["ports"] == {"http": 8080} and services["go_app"]["health"]["port"] == "http"
+        assert services["node_app"]["ports"] == {"http": 3000} and services["node_app"]["health"]["port"] == "http"
+        assert services["flask_app"]["health"]["port"] == 5000
+        assert "*.go" in services["go_app"]["watch"]
+        assert all(service["health"]["path"] == "/health" for service in services.values())
+        assert "flask_app: port 5000 looks hardcoded" in out and "go_app: port" not in out and "node_app: port" not in out
+
+    def test_guess_port(self, temp_dir):
+        """Test port patterns, health paths and projects without either."""
+        from omni_run import guess_listen_port
+
+        (temp_dir / "main.go").write_text('port := os.Getenv("PORT")\nif port == "" { port = "9090" }\n'
+                                          'http.HandleFunc("/healthz", health)\n')
+        assert guess_listen_port(temp_dir, ["*.go"]) == (9090, "/healthz", True)
+        (temp_dir / "main.go").write_text('log.Println("starting")\n')
+        assert guess_listen_port(temp_dir, ["*.go"]) == (None, None, False)
+
+    def test_notes(self, temp_dir, capsys):
+        """Test the notes for a project that serves nothing detectable."""
+        (temp_dir / "requirements.txt").write_text("")
+        (temp_dir / "main.py").write_text("import time\nwhile True:\n    time.sleep(1)\n")
+        assert run_init(temp_dir, "--name", "worker") == 0
+        text = (temp_dir / "omni-run.yaml").read_text()
+        assert "# Review before use:" in text and "worker: no listening port found" in text
+        assert "note:" in capsys.readouterr().out
+
+
+class TestInitErrors:
+    """Tests for refusing to run init."""
+
+    def test_existing_manifest(self, temp_dir, capsys):
+        """Test that an existing manifest is kept unless --force is given."""
+        write_manifest(temp_dir, "services:\n  api:\n    command: 'true'\n")
+        (temp_dir / "requirements.txt").write_text("")
+        (temp_dir / "main.py").write_text("print('hi')\n")
+        assert run_init(temp_dir) == 1
+        assert "already exists (use --force to overwrite)" in capsys.readouterr().out
+        assert "api" in (temp_dir / "omni-run.yaml").read_text()
+        assert run_init(temp_dir, "--force") == 0
+        assert "Generated by" in (temp_dir / "omni-run.yaml").read_text()
+
+    def test_nothing_to_run(self, temp_dir, capsys):
+        """Test the hint pointing at --template for an empty directory."""
+        assert run_init(temp_dir) == 1
+        assert "No runnable projects found" in capsys.readouterr().out
+
+
+class TestServiceWatch:
+    """Tests for `watch:` globs on services."""
+
+    def test_parse_watch(self, temp_dir):
+        """Test a single glob, a list and a rejected mapping."""
+        from omni_run import load_manifest, ManifestError
+
+        write_manifest(temp_dir, "services:\n  api:\n    command: 'true'\n    watch: '*.py'\n"
+                                 "  web:\n    command: 'true'\n    watch: ['*.js', 'src/**/*.ts']\n")
+        services = load_manifest(temp_dir / "omni-run.yaml").services
+        assert services["api"].watch == ["*.py"] and services["web"].watch == ["*.js", "src/**/*.ts"]
+        assert load_manifest(write_manifest(temp_dir, "services:\n  api:\n    command: 'true'\n")).services["api"].watch == []
+        write_manifest(temp_dir, "services:\n  api:\n    command: 'true'\n    watch: {glob: '*.py'}\n")
+        with pytest.raises(ManifestError, match="services.api.watch"):
+            load_manifest(temp_dir / "omni-run.yaml")
+
+    def _watching(self, temp_dir, omni_runner):
+        from omni_run import load_manifest, Orchestrator
+
+        (temp_dir / "app.py").write_text("print('v1')\n")
+        manifest = load_manifest(write_manifest(temp_dir, "services:\n  app:\n    command: sleep 30\n"
+                                                          "    watch: ['*.py']\n"))
+        omni_runner.config["watch"] = {"debounce_ms": 50}
+        orchestrator = Orchestrator(omni_runner, manifest)
+        runner = threading.Thread(target=orchestrator.up, daemon=True)
+        runner.start()
+        deadline = time.time() + 10
+        while orchestrator.services["app"].process is None and time.time() < deadline:
+            time.sleep(0.05)
+        return orchestrator, runner
+
+    def _shut_down(self, orchestrator, runner):
+        orchestrator.request_shutdown()
+        runner.join(timeout=15)
+        assert not runner.is_alive()
+
+    @pytest.mark.skipif(sys.platform == "win32", reason="Uses POSIX process groups")
+    def test_restart_on_change(self, temp_dir, omni_runner):
+        """Test that changing a watched file restarts the service."""
+        orchestrator, runner = self._watching(temp_dir, omni_runner)
+        service = orchestrator.services["app"]
+        try:
+            first = service.process.pid
+            (temp_dir / "app.py").write_text("print('v2')\n")
+            deadline = time.time() + 10
+            while (service.process is None or service.process.pid == first) and time.time() < deadline:
+                time.sleep(0.05)
+            assert service.process.pid != first
+        finally:
+            self._shut_down(orchestrator, runner)
+
+    @pytest.mark.skipif(sys.platform == "win32", reason="Uses POSIX process groups")
+    def test_other_files_ignored(self, temp_dir, omni_runner):
+        """Test that changing a file no glob matches leaves the service running."""
+        orchestrator, runner = self._watching(temp_dir, omni_runner)
+        service = orchestrator.services["app"]
+        try:
+            first = service.process.pid
+            (temp_dir / "notes.txt").write_text("ignored\n")
+            time.sleep(1.5)
+            assert service.process.pid == first
+        finally:
+            self._shut_down(orchestrator, runner)
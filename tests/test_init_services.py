@@ -0,0 +1,214 @@
+"""
+Tests for init services (`type: init`) in OmniRun.
+
+This module tests:
+- Parsing `type: init`, its retries, and the keys and conditions that don't go with it
+- Dependents waiting for an init service to complete, retries, and giving up
+- `omni-run run-init` in a running stack, starting the dependents that gave up, and on its own
+"""
+
+import sys
+import json
+import time
+import threading
+import pytest
+from pathlib import Path
+
+from conftest import *
+
+
+# Fails while a file named `broken` exists; counts its attempts in `attempts`
+MIGRATE = ("import os, sys; n = int(open('attempts').read()) + 1 if os.path.exists('attempts') else 1; "
+           "open('attempts', 'w').write(str(n)); print('migration attempt', n); "
+           "sys.exit(1 if os.path.exists('broken') or n < int(os.environ.get('SUCCEED_AT', '1')) else 0)")
+
+
+class TestInitSpec:
+    """Tests for reading init services from the manifest."""
+
+    def _manifest(self, temp_dir):
+        from omni_run import load_manifest
+
+        write_manifest(temp_dir, """
+services:
+  migrate: {type: init, command: 'true', retries: 2, retry_backoff: 3s}
+  seed: {type: init, command: 'true', depends_on: [migrate]}
+  api: {command: 'true', depends_on: {migrate: null, seed: service_started}}
+""")
+        return load_manifest(temp_dir / "omni-run.yaml")
+
+    def test_parse(self, temp_dir):
+        """Test the init flag and the retry policy, with init services not retried by default."""
+        services = self._manifest(temp_dir).services
+        migrate, seed, api = (services[n] for n in ("migrate", "seed", "api"))
+        assert migrate.init and not api.init
+        assert (migrate.restart.policy, migrate.restart.max_restarts, migrate.restart.backoff) == ("on-failure", 2, 3.0)
+        assert migrate.restart.delay(2) == 6.0
+        assert seed.restart.policy == "never"
+
+    def test_dependent_conditions(self, temp_dir):
+        """Test that dependents wait for an init service to complete unless they say otherwise."""
+        services = self._manifest(temp_dir).services
+        assert services["seed"].conditions["migrate"].condition == "service_completed_successfully"
+        assert services["api"].conditions["migrate"].condition == "service_completed_successfully"
+        assert services["api"].conditions["seed"].condition == "service_started"
+
+    def test_invalid(self, temp_dir):
+        """Test unknown types, keys init services refuse, bad retries, and conditions needing an init service."""
+        from omni_run import load_manifest, ManifestError
+
+        for block, message in [
+            ("{type: job, command: 'true'}", "services.x.type: must be one of service, init"),
+            ("{type: init, command: 'true', restart: always}", "retry them with retries: and retry_backoff:"),
+            ("{type: init, command: 'true', health: {port: 80}}", "init services are done when they exit"),
+            ("{type: init, command: 'true', retries: -1}", "services.x.retries: expected a number of retries"),
+            ("{command: 'true', retries: 2}", "services.x.retries: only applies to `type: init` services"),
+            ("{command: 'true', depends_on: {y: service_completed_successfully}}",
+             "service_completed_successfully needs 'y' to be `type: init`"),
+        ]:
+            write_manifest(temp_dir, f"services:\n  x: {block}\n  y: {{command: 'true'}}\n")
+            with pytest.raises(ManifestError, match=message):
+                load_manifest(temp_dir / "omni-run.yaml")
+
+
+class TestInitRuns:
+    """Tests for running init services during `up`."""
+
+    def test_retries_then_dependents(self, temp_dir, omni_runner, capsys):
+        """Test that a failing attempt is retried and the dependent starts only once the service succeeds."""
+        from omni_run import load_manifest, Orchestrator, ServiceState, ANSI_ESCAPE
+
+        write_manifest(temp_dir, f"""
+services:
+  migrate:
+    type: init
+    command: ["{sys.executable}", "-c", "{MIGRATE}"]
+    env: {{SUCCEED_AT: '2'}}
+    retries: 2
+    retry_backoff: 0.1
+  api:
+    command: ["{sys.executable}", "-c", "print('api sees', open('attempts').read())"]
+    depends_on: [migrate]
+""")
+        orchestrator = Orchestrator(omni_runner, load_manifest(temp_dir / "omni-run.yaml"))
+        assert orchestrator.up(abort_on_exit=True) == 0
+        out = ANSI_ESCAPE.sub("", capsys.readouterr().out)
+        assert "migrate | retrying in 0.1s (attempt 1/2)" in out
+        assert "api     | api sees 2" in out
+        assert orchestrator.services["migrate"].state == ServiceState.EXITED
+
+    def test_gives_up(self, temp_dir, omni_runner, capsys):
+        """Test that dependents are not started once the retries are used up."""
+        from omni_run import load_manifest, Orchestrator, ServiceState, ANSI_ESCAPE
+
+        (temp_dir / "broken").write_text("")
+        write_manifest(temp_dir, f"""
+services:
+  migrate: {{type: init, command: ["{sys.executable}", "-c", "{MIGRATE}"], retries: 1, retry_backoff: 0.1}}
+  api: {{command: ["{sys.executable}", "-c", "print('api ran')"], depends_on: [migrate]}}
+""")
+        orchestrator = Orchestrator(omni_runner, load_manifest(temp_dir / "omni-run.yaml"))
+        assert orchestrator.up() == 1
+        out = ANSI_ESCAPE.sub("", capsys.readouterr().out)
+        assert (temp_dir / "attempts").read_text() == "2"
+        assert orchestrator.services["migrate"].reason == "gave up after 1 retries"
+        assert "api ran" not in out and "not started: api waits for migrate to be service_completed_successfully" in out
+        assert orchestrator.services["api"].state == ServiceState.FAILED
+
+
+@pytest.fixture
+def failed_init(temp_dir, omni_runner, capsys):
+    """A running stack whose init service failed, so its dependent gave up; yields a lookup of a service's state."""
+    from omni_run import load_manifest, Orchestrator, read_supervisor_state
+
+    (temp_dir / "broken").write_text("")
+    write_manifest(temp_dir, f"""
+services:
+  db: {{command: ["{sys.executable}", "-c", "import time; time.sleep(60)"]}}
+  migrate: {{type: init, command: ["{sys.executable}", "-c", "{MIGRATE}"], depends_on: {{db: service_started}}}}
+  api:
+    command: ["{sys.executable}", "-c", "import time; print('api up', flush=True); time.sleep(60)"]
+    depends_on: [migrate]
+""")
+    state_dir = temp_dir / ".omni-run"
+    orchestrator = Orchestrator(omni_runner, load_manifest(temp_dir / "omni-run.yaml"), state_dir=state_dir)
+    runner = threading.Thread(target=orchestrator.up)
+    runner.start()
+
+    def state(name):
+        return (read_supervisor_state(state_dir).get("services", {}).get(name) or {}).get("state")
+
+    try:
+        deadline = time.time() + 20
+        while time.time() < deadline and state("api") != "failed":
+            time.sleep(0.1)
+        assert state("migrate") == "failed"
+        capsys.readouterr()
+        yield state
+    finally:
+        orchestrator.request_shutdown()
+        runner.join(timeout=20)
+
+
+@pytest.mark.skipif(sys.platform == "win32", reason="Uses Unix domain sockets and POSIX sleep processes")
+class TestRunInit:
+    """Tests for `omni-run run-init`."""
+
+    def test_rerun_fails_again(self, temp_dir, failed_init, capsys):
+        """Test re-running an init service that fails again under the supervisor."""
+        from omni_run import run_subcommand, ANSI_ESCAPE
+
+        assert run_subcommand(["run-init", "migrate", "-C", str(temp_dir)]) == 1
+        out = ANSI_ESCAPE.sub("", capsys.readouterr().out)
+        assert "migration attempt 2" in out and "migrate failed: exited with code 1" in out
+        assert failed_init("api") == "failed"
+
+    def test_rerun_starts_dependents(self, temp_dir, failed_init, capsys):
+        """Test that once the init service completes, the dependent that gave up is started."""
+        from omni_run import run_subcommand, ANSI_ESCAPE
+
+        (temp_dir / "broken").unlink()
+        assert run_subcommand(["run-init", "migrate", "-C", str(temp_dir)]) == 0
+        out = ANSI_ESCAPE.sub("", capsys.readouterr().out)
+        assert "migration attempt 2" in out and "migrate completed" in out
+        deadline = time.time() + 20
+        while time.time() < deadline and failed_init("api") != "running":
+            time.sleep(0.1)
+        assert failed_init("api") == "running"
+
+    def test_not_an_init_service(self, temp_dir, failed_init, capsys):
+        """Test run-init for a service that isn't an init service."""
+        from omni_run import run_subcommand
+
+        assert run_subcommand(["run-init", "api", "-C", str(temp_dir)]) == 1
+        assert "'api' is not an init service (init services: migrate)" in capsys.readouterr().out
+
+    def test_audited(self, temp_dir, failed_init, capsys):
+        """Test that each run-init is recorded in the audit log, whatever its outcome."""
+        from omni_run import run_subcommand
+
+        assert run_subcommand(["run-init", "migrate", "-C", str(temp_dir)]) == 1
+        (temp_dir / "broken").unlink()
+        assert run_subcommand(["run-init", "migrate", "-C", str(temp_dir)]) == 0
+        audit = [json.loads(line) for line in (temp_dir / ".omni-run" / "audit.jsonl").read_text().splitlines()]
+        assert [e["service"] for e in audit if e["action"] == "run-init"] == ["migrate", "migrate"]
+
+    def test_without_supervisor(self, temp_dir, capsys):
+        """Test that run-init starts the dependencies, runs the service, stops them again and returns its code."""
+        from omni_run import run_subcommand, ANSI_ESCAPE
+
+        write_manifest(temp_dir, f"""
+services:
+  db: {{command: ["{sys.executable}", "-c", "import time; time.sleep(60)"]}}
+  migrate: {{type: init, command: ["{sys.executable}", "-c", "{MIGRATE}"], depends_on: {{db: service_started}}}}
+  api: {{command: ["{sys.executable}", "-c", "print('api ran')"], depends_on: [migrate]}}
+""")
+        started = time.time()
+        assert run_subcommand(["run-init", "migrate", "-C", str(temp_dir)]) == 0
+        out = ANSI_ESCAPE.sub("", capsys.readouterr().out)
+        assert time.time() - started < 30
+        assert "No services running; starting migrate with its dependencies" in out
+        assert "migration attempt 1" in out and "api ran" not in out
+
+        (temp_dir / "broken").write_text("")
+        assert run_subcommand(["run-init", "migrate", "-C", str(temp_dir)]) == 1
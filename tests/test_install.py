@@ -0,0 +1,175 @@
+"""
+Tests for the dependency install phase in OmniRun.
+
+This module tests:
+- Install command detection from lockfiles
+- Fingerprint caching (skip when nothing changed)
+- Per-service install settings and install failures
+- The `install` command
+"""
+
+import sys
+import pytest
+from pathlib import Path
+
+from conftest import *
+
+
+class TestInstallDetection:
+    """Tests for choosing install commands."""
+
+    def test_node_lockfiles(self, temp_dir):
+        """Test that the lockfile picks the package manager."""
+        from omni_run import detect_install_steps
+
+        (temp_dir / "package.json").write_text("{}")
+        assert detect_install_steps(temp_dir)[0].command == ["npm", "install"]
+
+        (temp_dir / "package-lock.json").write_text("{}")
+        step = detect_install_steps(temp_dir)[0]
+        assert step.command == ["npm", "ci"]
+        assert step.output == temp_dir / "node_modules"
+
+    def test_python_go_rust(self, temp_dir):
+        """Test requirements.txt, go.mod and Cargo.toml detection."""
+        from omni_run import detect_install_steps
+
+        (temp_dir / "requirements.txt").write_text("requests\n")
+        (temp_dir / "go.mod").write_text("module x\n")
+        (temp_dir / "Cargo.toml").write_text("[package]\nname = 'x'\n")
+
+        steps = {s.runtime: s for s in detect_install_steps(temp_dir)}
+        assert steps["python"].command[-4:] == ["pip", "install", "-r", "requirements.txt"]
+        assert steps["go"].command == ["go", "mod", "download"]
+        assert steps["rust"].command == ["cargo", "fetch"]
+
+    def test_php_ruby(self, temp_dir):
+        """Test composer.json and Gemfile detection."""
+        from omni_run import detect_install_steps
+
+        (temp_dir / "composer.json").write_text("{}")
+        (temp_dir / "Gemfile").write_text("source 'https://rubygems.org'\n")
+
+        steps = {s.runtime: s for s in detect_install_steps(temp_dir)}
+        assert (steps["php"].command, steps["php"].output) == (["composer", "install"], temp_dir / "vendor")
+        assert steps["ruby"].command == ["bundle", "install"]
+
+    def test_project_venv_python(self, temp_dir):
+        """Test that a project virtualenv's interpreter is used for pip."""
+        from omni_run import detect_install_steps
+
+        (temp_dir / "requirements.txt").write_text("")
+        venv_python = temp_dir / ".venv" / "bin" / "python"
+        venv_python.parent.mkdir(parents=True)
+        venv_python.touch()
+
+        if sys.platform != "win32":
+            assert detect_install_steps(temp_dir)[0].command[0] == str(venv_python)
+
+
+class TestInstallCache:
+    """Tests for lockfile-hash caching."""
+
+    def _step(self, temp_dir, marker):
+        from omni_run import InstallStep
+        command = [sys.executable, "-c", f"open({str(marker)!r}, 'a').write('x')"]
+        return InstallStep("python", command, temp_dir, [temp_dir / "requirements.txt"])
+
+    def test_skips_when_unchanged(self, temp_dir):
+        """Test that a second install with the same lockfile is skipped."""
+        from omni_run import InstallCache, install_dependencies
+
+        (temp_dir / "requirements.txt").write_text("flask\n")
+        marker = temp_dir / "runs"
+        cache = InstallCache(temp_dir / ".omni-run" / "install-cache.json")
+        lines = []
+
+        assert install_dependencies([self._step(temp_dir, marker)], cache, lines.append)
+        assert install_dependencies([self._step(temp_dir, marker)], cache, lines.append)
+        assert marker.read_text() == "x"
+        assert any("up to date" in l for l in lines)
+
+        (temp_dir / "requirements.txt").write_text("flask\nrequests\n")
+        assert install_dependencies([self._step(temp_dir, marker)], cache, lines.append)
+        assert marker.read_text() == "xx"
+
+    def test_cache_persists_and_force(self, temp_dir):
+        """Test that the cache survives reloads and --force reinstalls."""
+        from omni_run import InstallCache, install_dependencies
+
+        (temp_dir / "requirements.txt").write_text("flask\n")
+        marker = temp_dir / "runs"
+        path = temp_dir / ".omni-run" / "install-cache.json"
+
+        install_dependencies([self._step(temp_dir, marker)], InstallCache(path), lambda l: None)
+        install_dependencies([self._step(temp_dir, marker)], InstallCache(path), lambda l: None)
+        assert marker.read_text() == "x"
+        install_dependencies([self._step(temp_dir, marker)], InstallCache(path), lambda l: None, force=True)
+        assert marker.read_text() == "xx"
+
+    def test_missing_output_dir_reinstalls(self, temp_dir):
+        """Test that deleting node_modules invalidates the cached install."""
+        from omni_run import InstallCache, InstallStep
+
+        (temp_dir / "package.json").write_text("{}")
+        step = InstallStep("node", ["npm", "install"], temp_dir, [temp_dir / "package.json"], temp_dir / "node_modules")
+        cache = InstallCache(temp_dir / "cache.json")
+        (temp_dir / "node_modules").mkdir()
+        cache.record(step)
+        assert cache.is_current(step)
+
+        (temp_dir / "node_modules").rmdir()
+        assert not cache.is_current(step)
+
+
+class TestServiceInstall:
+    """Tests for installs wired into `up`."""
+
+    def test_failed_install_blocks_service(self, temp_dir, omni_runner, capsys):
+        """Test that a failing install fails the service and its dependents."""
+        from omni_run import load_manifest, Orchestrator, ServiceState
+
+        (temp_dir / "omni-run.yaml").write_text(f"""
+services:
+  api:
+    command: ["{sys.executable}", "-c", "print('should not run')"]
+    install: "exit 4"
+  web:
+    command: ["{sys.executable}", "-c", "print('nor this')"]
+    depends_on: [api]
+""")
+        orchestrator = Orchestrator(omni_runner, load_manifest(temp_dir / "omni-run.yaml"), install=True)
+
+        assert orchestrator.up() == 1
+        assert orchestrator.services["api"].reason == "dependency install failed"
+        assert orchestrator.services["web"].state == ServiceState.FAILED
+        out = capsys.readouterr().out
+        assert "exited with code 4" in out
+        assert "should not run" not in out
+
+    def test_install_disabled(self, temp_dir, omni_runner):
+        """Test that install: false skips detected installs."""
+        from omni_run import load_manifest, Orchestrator
+
+        (temp_dir / "package.json").write_text("{}")
+        (temp_dir / "omni-run.yaml").write_text("services:\n  web:\n    command: 'true'\n    install: false\n")
+        orchestrator = Orchestrator(omni_runner, load_manifest(temp_dir / "omni-run.yaml"))
+
+        assert orchestrator.install_steps(orchestrator.manifest.services["web"]) == []
+
+    def test_install_command(self, temp_dir, capsys):
+        """Test `omni-run install` for manifest services."""
+        from omni_run import run_subcommand
+
+        (temp_dir / "omni-run.yaml").write_text(f"""
+services:
+  api:
+    command: 'true'
+    install: ["{sys.executable}", "-c", "print('installing deps')"]
+""")
+        args = ["install", "-C", str(temp_dir)]
+
+        assert run_subcommand(args) == 0
+        assert "installing deps" in capsys.readouterr().out
+        assert run_subcommand(args) == 0
+        assert "up to date" in capsys.readouterr().out
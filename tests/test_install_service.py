@@ -0,0 +1,226 @@
+"""
+Tests for `omni-run install-service` and `uninstall-service` in OmniRun.
+
+This module tests:
+- The systemd unit and the launchd property list: the supervisor's command line, environment and output, and a
+  launchd job installed with --no-start
+- Installing a user unit: where it goes, systemctl calls, --force, --no-start and a running stack
+- Removing it again with `uninstall-service`
+- The supervisor's journal output: plain lines with a syslog priority
+"""
+
+import os
+import sys
+import json
+import plistlib
+import pytest
+from pathlib import Path
+
+from conftest import *
+
+
+# Logs each call; `loginctl show-user` answers that lingering is off
+FAKE_SERVICE_MANAGER = """\
+import json, os, sys
+with open(os.environ["FAKE_SERVICE_LOG"], "a") as log:
+    log.write(json.dumps([os.path.basename(sys.argv[0])] + sys.argv[1:]) + "\\n")
+if sys.argv[1:2] == ["show-user"]:
+    print("Linger=no")
+"""
+
+
+@pytest.fixture
+def fake_systemd(temp_dir, monkeypatch):
+    """`systemctl` and `loginctl` on PATH, and a home of its own; returns a function giving the calls made so far."""
+    bin_dir, log = temp_dir / "bin", temp_dir / "service.log"
+    bin_dir.mkdir()
+    for name in ("systemctl", "loginctl"):
+        (bin_dir / name).write_text(f"#!{sys.executable}\n" + FAKE_SERVICE_MANAGER)
+        (bin_dir / name).chmod(0o755)
+    monkeypatch.setenv("PATH", f"{bin_dir}{os.pathsep}{os.environ['PATH']}")
+    monkeypatch.setenv("FAKE_SERVICE_LOG", str(log))
+    monkeypatch.setenv("XDG_CONFIG_HOME", str(temp_dir / "config"))
+    monkeypatch.setenv("OMNI_RUN_USER", "alice")
+    monkeypatch.delenv("OMNI_RUN_HOME", raising=False)
+    return lambda: [json.loads(line) for line in log.read_text().splitlines()] if log.exists() else []
+
+
+@pytest.mark.skipif(sys.platform == "win32", reason="systemd and launchd are POSIX-only")
+class TestServiceFiles:
+    """Tests for the unit and property list install-service writes."""
+
+    def test_systemd_unit(self, temp_dir, fake_systemd, capsys):
+        """Test the unit's command line, working directory, environment, journal output and target."""
+        from omni_run import run_subcommand, stack_id, systemd_quote
+
+        write_manifest(temp_dir, "services:\n  api: {command: ./api}\n  web: {command: ./web}\n")
+        (temp_dir / "my config.yaml").write_text("logs: {level: info}\n")
+        assert run_subcommand(["install-service", "web", "-C", str(temp_dir), "--manager", "systemd", "--print",
+                               "--config", str(temp_dir / "my config.yaml"), "--skip-install"]) == 0
+        unit = capsys.readouterr().out
+        lines = unit.splitlines()
+        assert lines[0].startswith("# Generated by `omni-run install-service`")
+        start = next(line for line in lines if line.startswith("ExecStart="))
+        assert start.startswith(f"ExecStart={sys.executable} ") and " up --supervised -C " in start
+        assert f'--config "{temp_dir / "my config.yaml"}"' in start
+        assert start.endswith(" --skip-install web --journal")
+        assert f"WorkingDirectory={temp_dir}" in lines and f"SyslogIdentifier=omni-run-{stack_id(temp_dir)}" in lines
+        assert f"Environment={systemd_quote('PATH=' + os.environ['PATH'])}" in lines
+        assert {"StandardOutput=journal", "KillMode=mixed", "Restart=on-failure", "WantedBy=default.target"} <= set(lines)
+        assert "User=" not in unit and fake_systemd() == []
+        assert not (temp_dir / "config").exists()
+
+    def test_systemd_unit_escaping(self, temp_dir, fake_systemd, monkeypatch, capsys):
+        """Test that `$` is doubled only on ExecStart= and that a root with a space is written as is."""
+        from omni_run import run_subcommand
+
+        root = temp_dir / "my stack"
+        root.mkdir()
+        write_manifest(root, "services:\n  api: {command: ./api}\n")
+        monkeypatch.setenv("PATH", f"/opt/$tools/bin{os.pathsep}{os.environ['PATH']}")
+        assert run_subcommand(["install-service", "-C", str(root), "--manager", "systemd", "--print",
+                               "--set", "services.api.env.GREETING=$HOME"]) == 0
+        lines = capsys.readouterr().out.splitlines()
+        assert f"WorkingDirectory={root}" in lines
+        assert f"Environment=PATH=/opt/$tools/bin{os.pathsep}" in "\n".join(lines)
+        start = next(line for line in lines if line.startswith("ExecStart="))
+        assert f'-C "{root}"' in start and '--set "services.api.env.GREETING=$$HOME"' in start
+
+    def test_launchd_plist(self, temp_dir, monkeypatch, capsys):
+        """Test the job's label, arguments, environment and log."""
+        from omni_run import run_subcommand, stack_id
+
+        monkeypatch.delenv("OMNI_RUN_HOME", raising=False)
+        monkeypatch.setenv("OMNI_RUN_PROFILE", "staging")
+        write_manifest(temp_dir, "services:\n  api: {command: ./api}\n")
+        assert run_subcommand(["install-service", "-C", str(temp_dir), "--manager", "launchd", "--print"]) == 0
+        job = plistlib.loads(capsys.readouterr().out.encode())
+        assert job["Label"] == f"dev.omni-run.{stack_id(temp_dir)}"
+        assert job["ProgramArguments"][2:5] == ["up", "--supervised", "-C"] and "--journal" not in job["ProgramArguments"]
+        assert job["EnvironmentVariables"]["OMNI_RUN_PROFILE"] == "staging"
+        assert job["StandardOutPath"] == str(temp_dir / ".omni-run" / "supervisor.log")
+        assert (job["RunAtLoad"], job["KeepAlive"], job["WorkingDirectory"]) == (True, {"SuccessfulExit": False},
+                                                                                  str(temp_dir))
+
+    def test_launchd_no_start(self, temp_dir, monkeypatch, capsys):
+        """Test that a job installed with --no-start is written but not loaded, with the command that loads it."""
+        from omni_run import run_subcommand, ANSI_ESCAPE
+
+        monkeypatch.setenv("HOME", str(temp_dir / "home"))
+        write_manifest(temp_dir, "services:\n  api: {command: ./api}\n")
+        assert run_subcommand(["install-service", "-C", str(temp_dir), "--manager", "launchd", "--name", "dev.shop",
+                               "--no-start"]) == 0
+        job = temp_dir / "home" / "Library" / "LaunchAgents" / "dev.shop.plist"
+        out = ANSI_ESCAPE.sub("", capsys.readouterr().out)
+        assert f"Installed dev.shop; load it with `launchctl bootstrap gui/{os.getuid()} {job}`" in out
+        assert "Loaded" not in out and plistlib.loads(job.read_bytes())["Label"] == "dev.shop"
+
+    def test_invalid_name(self, temp_dir, capsys):
+        """Test a --name the service manager can't use."""
+        from omni_run import run_subcommand
+
+        write_manifest(temp_dir, "services:\n  api: {command: ./api}\n")
+        assert run_subcommand(["install-service", "-C", str(temp_dir), "--manager", "systemd", "--print",
+                               "--name", "my stack"]) == 1
+        assert "--name 'my stack': use letters, digits" in capsys.readouterr().out
+
+    def test_system_without_root(self, temp_dir, monkeypatch, capsys):
+        """Test --system without root."""
+        from omni_run import run_subcommand
+
+        write_manifest(temp_dir, "services:\n  api: {command: ./api}\n")
+        monkeypatch.setattr(os, "geteuid", lambda: 1000)
+        assert run_subcommand(["install-service", "-C", str(temp_dir), "--manager", "systemd", "--system"]) == 1
+        assert "--system installs for the whole machine and needs root" in capsys.readouterr().out
+
+
+@pytest.mark.skipif(sys.platform == "win32", reason="systemd is POSIX-only")
+class TestInstall:
+    """Tests for installing and removing a systemd user unit."""
+
+    def _installed(self, temp_dir, capsys):
+        from omni_run import run_subcommand, ANSI_ESCAPE
+
+        write_manifest(temp_dir, "services:\n  api: {command: ./api}\n")
+        assert run_subcommand(["install-service", "-C", str(temp_dir), "--manager", "systemd", "--name", "shop"]) == 0
+        return temp_dir / "config" / "systemd" / "user" / "shop.service", ANSI_ESCAPE.sub("", capsys.readouterr().out)
+
+    def test_install(self, temp_dir, fake_systemd, capsys):
+        """Test writing the unit, enabling and starting it, and the journal and linger hints."""
+        unit, out = self._installed(temp_dir, capsys)
+        assert f"Wrote {unit}" in out and "Enabled shop.service and started it" in out
+        assert "`journalctl --user -u shop -f`" in out and "run `loginctl enable-linger alice`" in out
+        assert "SyslogIdentifier=shop" in unit.read_text() and (temp_dir / ".omni-run" / ".gitignore").exists()
+
+    def test_service_manager_calls(self, temp_dir, fake_systemd, capsys):
+        """Test reloading systemd, enabling the unit and asking whether the user lingers."""
+        self._installed(temp_dir, capsys)
+        assert fake_systemd() == [["systemctl", "--user", "daemon-reload"],
+                                  ["systemctl", "--user", "enable", "--now", "shop.service"],
+                                  ["loginctl", "show-user", "alice", "-p", "Linger"]]
+
+    def test_already_installed(self, temp_dir, fake_systemd, capsys):
+        """Test that an installed unit is kept without --force."""
+        from omni_run import run_subcommand
+
+        unit, _ = self._installed(temp_dir, capsys)
+        assert run_subcommand(["install-service", "-C", str(temp_dir), "--manager", "systemd", "--name", "shop"]) == 1
+        assert f"{unit} already exists (use --force" in capsys.readouterr().out
+
+    def test_force_no_start(self, temp_dir, fake_systemd, capsys):
+        """Test replacing the unit with --force, and enabling it without starting it with --no-start."""
+        from omni_run import run_subcommand, ANSI_ESCAPE
+
+        self._installed(temp_dir, capsys)
+        assert run_subcommand(["install-service", "-C", str(temp_dir), "--manager", "systemd", "--name", "shop",
+                               "--force", "--no-start"]) == 0
+        assert "Enabled shop.service\n" in ANSI_ESCAPE.sub("", capsys.readouterr().out)
+        assert fake_systemd()[-2] == ["systemctl", "--user", "enable", "shop.service"]
+
+    def test_uninstall(self, temp_dir, fake_systemd, capsys):
+        """Test stopping, disabling and removing the unit."""
+        from omni_run import run_subcommand
+
+        unit, _ = self._installed(temp_dir, capsys)
+        before = len(fake_systemd())
+        assert run_subcommand(["uninstall-service", "-C", str(temp_dir), "--manager", "systemd", "--name", "shop"]) == 0
+        assert f"Stopped and removed shop ({unit})" in capsys.readouterr().out
+        assert not unit.exists()
+        assert fake_systemd()[before:] == [["systemctl", "--user", "disable", "--now", "shop.service"],
+                                           ["systemctl", "--user", "daemon-reload"]]
+
+    def test_uninstall_nothing(self, temp_dir, fake_systemd, capsys):
+        """Test uninstalling when no unit is installed."""
+        from omni_run import run_subcommand
+
+        write_manifest(temp_dir, "services:\n  api: {command: ./api}\n")
+        assert run_subcommand(["uninstall-service", "-C", str(temp_dir), "--manager", "systemd", "--name", "shop"]) == 0
+        assert "No service installed at" in capsys.readouterr().out
+
+    def test_running(self, temp_dir, fake_systemd, monkeypatch, capsys):
+        """Test that a stack already running under `start --detach` isn't started a second time."""
+        import omni_run
+        from omni_run import run_subcommand
+
+        monkeypatch.setattr(omni_run, "read_supervisor_pid", lambda state_dir: 4242)
+        write_manifest(temp_dir, "services:\n  api: {command: ./api}\n")
+        assert run_subcommand(["install-service", "-C", str(temp_dir), "--manager", "systemd"]) == 1
+        assert "already running under supervisor pid 4242" in capsys.readouterr().out
+        assert fake_systemd() == [] and not (temp_dir / "config").exists()
+
+
+class TestJournalOutput:
+    """Tests for the supervisor's output under systemd."""
+
+    def test_emit(self, capsys):
+        """Test plain lines led by the syslog priority of their level, and notices for status lines."""
+        from omni_run import JournalLogPipeline, Colors
+
+        logs = JournalLogPipeline()
+        logs.register("api", Colors.OKBLUE)
+        logs.write("api", "listening on :8080")
+        logs.write("api", "ERROR connection refused", "stderr")
+        logs.status("api", "restarting")
+        assert capsys.readouterr().out.splitlines() == ["<6>api | listening on :8080",
+                                                        "<3>api | ERROR connection refused",
+                                                        "<5>api | restarting"]
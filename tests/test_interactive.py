@@ -0,0 +1,183 @@
+"""
+Tests for running interactive programs in OmniRun.
+
+This module tests:
+- Running on a PTY: a controlling terminal, input, window size and resizes
+- Forwarding signals, Ctrl+C as a keystroke, and suspending on Ctrl+Z
+- Restoring the terminal's modes and passing exit codes through
+- Sharing stdio without a PTY, and the `tty` setting choosing how programs run
+"""
+
+import os
+import sys
+import time
+import signal
+import subprocess
+import pytest
+from pathlib import Path
+
+from conftest import *
+
+
+pytestmark = pytest.mark.skipif(sys.platform == "win32", reason="PTYs are POSIX only")
+
+ROOT = Path(__file__).parent.parent
+
+
+class Terminal:
+    """A PTY standing in for the user's terminal, with run_interactive running on it."""
+
+    def __init__(self, program, rows=30, columns=100, argv=None, **kwargs):
+        import fcntl, pty, struct, termios
+
+        self.master, self.slave = pty.openpty()
+        self.resize(rows, columns)
+        self.modes = termios.tcgetattr(self.slave)
+        argv = argv or [sys.executable, "-c", program]
+        script = (f"import sys; sys.path.insert(0, {str(ROOT)!r}); from omni_run import run_interactive; "
+                  f"sys.exit(run_interactive({argv!r}, **{kwargs!r}))")
+        self.launcher = subprocess.Popen([sys.executable, "-c", script], stdin=self.slave, stdout=self.slave,
+                                         stderr=self.slave, start_new_session=True,
+                                         preexec_fn=lambda: fcntl.ioctl(0, termios.TIOCSCTTY, 0))
+        self.output = b""
+
+    def resize(self, rows, columns):
+        import fcntl, struct, termios
+        fcntl.ioctl(self.master, termios.TIOCSWINSZ, struct.pack("HHHH", rows, columns, 0, 0))
+
+    def type(self, data: bytes):
+        os.write(self.master, data)
+
+    def expect(self, text: bytes, timeout=10):
+        import select
+
+        deadline = time.time() + timeout
+        while text not in self.output and time.time() < deadline:
+            if select.select([self.master], [], [], 0.05)[0]:
+                try:
+                    self.output += os.read(self.master, 4096)
+                except OSError:
+                    break
+        assert text in self.output, self.output
+
+    def close(self):
+        if self.launcher.poll() is None:
+            self.launcher.kill()
+        self.launcher.wait(5)
+        os.close(self.master)
+        os.close(self.slave)
+
+
+REPL = """
+import os, signal, sys
+signal.signal(signal.SIGINT, lambda *a: print("got INT", flush=True))
+signal.signal(signal.SIGTERM, lambda *a: (print("got TERM", flush=True), sys.exit(3)))
+signal.signal(signal.SIGWINCH, lambda *a: print("size", *os.get_terminal_size(), flush=True))
+print("tty", sys.stdin.isatty(), "size", *os.get_terminal_size(), flush=True)
+for line in sys.stdin:
+    print("echo", line.strip(), flush=True)
+    if line.strip() == "quit":
+        sys.exit(5)
+"""
+
+
+class TestPty:
+    """Tests for programs on a PTY of their own."""
+
+    def test_terminal(self):
+        """Test the child's terminal, typed input, resizes and the exit code."""
+        import termios
+
+        terminal = Terminal(REPL)
+        try:
+            terminal.expect(b"tty True size 100 30")
+            terminal.type(b"hello\r")
+            terminal.expect(b"echo hello")
+            terminal.resize(40, 120)
+            terminal.expect(b"size 120 40")
+            terminal.type(b"quit\r")
+            assert terminal.launcher.wait(10) == 5
+            assert termios.tcgetattr(terminal.slave) == terminal.modes
+        finally:
+            terminal.close()
+
+    def test_signals(self):
+        """Test Ctrl+C reaching only the child and SIGTERM to omni-run being forwarded."""
+        terminal = Terminal(REPL)
+        try:
+            terminal.expect(b"tty True")
+            terminal.type(b"\x03")
+            terminal.expect(b"got INT")
+            assert terminal.launcher.poll() is None
+            terminal.launcher.send_signal(signal.SIGTERM)
+            terminal.expect(b"got TERM")
+            assert terminal.launcher.wait(10) == 3
+        finally:
+            terminal.close()
+
+    def test_suspend(self):
+        """Test that Ctrl+Z stops omni-run along with the child, and that both resume."""
+        terminal = Terminal(REPL)
+        try:
+            terminal.expect(b"tty True")
+            terminal.type(b"\x1a")
+            _, status = os.waitpid(terminal.launcher.pid, os.WUNTRACED)
+            assert os.WIFSTOPPED(status)
+            os.kill(terminal.launcher.pid, signal.SIGCONT)
+            time.sleep(0.3)
+            terminal.type(b"again\r")
+            terminal.expect(b"echo again")
+        finally:
+            terminal.close()
+
+    def test_restores_raw_mode(self):
+        """Test that the terminal gets its modes back from a child that left it in raw mode."""
+        import termios
+
+        terminal = Terminal("import sys, tty; tty.setraw(0); print('raw', flush=True)")
+        try:
+            terminal.expect(b"raw")
+            assert terminal.launcher.wait(10) == 0
+            assert termios.tcgetattr(terminal.slave) == terminal.modes
+        finally:
+            terminal.close()
+
+    def test_missing_program(self):
+        """Test the error and exit code 127 when the program can't be started."""
+        terminal = Terminal(None, argv=["/nonexistent/program"])
+        try:
+            terminal.expect(b"/nonexistent/program: No such file or directory")
+            assert terminal.launcher.wait(10) == 127
+        finally:
+            terminal.close()
+
+
+class TestWithoutPty:
+    """Tests for sharing omni-run's stdio."""
+
+    def test_stdio(self, temp_dir):
+        """Test that output isn't captured and Ctrl+C is left to the child."""
+        script = (f"import sys; sys.path.insert(0, {str(ROOT)!r}); from omni_run import run_interactive; "
+                  "sys.exit(run_interactive(['sh', '-c', 'trap \"echo trapped; exit 4\" INT; echo ready; "
+                  "kill -INT 0; sleep 5'], use_pty=False))")
+        result = subprocess.run([sys.executable, "-c", script], capture_output=True, text=True, timeout=20,
+                                start_new_session=True)
+        assert result.stdout.split() == ["ready", "trapped"]
+        assert result.returncode == 4
+
+    def test_tty_setting(self, temp_dir, omni_runner, monkeypatch):
+        """Test that `tty: always` runs programs attached and `never` captures their output."""
+        import omni_run
+
+        (temp_dir / "main.py").write_text("print('hi')\n")
+        omni_runner.scan_for_executables(max_depth=1)
+        calls = []
+        monkeypatch.setattr(omni_run, "run_interactive", lambda *args, **kwargs: calls.append(kwargs) or 0)
+
+        omni_runner.config["tty"] = "always"
+        result = omni_runner.execute_program_synchronously(omni_runner.discovered_programs[0])
+        assert result.return_code == 0 and result.stdout == "" and calls == [{"use_pty": True}]
+
+        omni_runner.config["tty"] = "never"
+        result = omni_runner.execute_program_synchronously(omni_runner.discovered_programs[0])
+        assert "hi" in result.stdout and len(calls) == 1
@@ -0,0 +1,252 @@
+"""
+Tests for per-service working directories, namespace isolation and users in OmniRun.
+
+This module tests:
+- `workdir:` as the process working directory
+- Parsing `isolate:` and `read_only_root:`, and the unshare(1) wrapper they produce
+- Running isolated services: read-only root, private network and pid namespaces, signal forwarding
+- `user:` and `group:`: looking up ids, refusing switches without privileges, and running as another user
+"""
+
+import os
+import sys
+import shutil
+import subprocess
+import pytest
+from pathlib import Path
+
+from conftest import *
+
+
+def namespaces_available() -> bool:
+    if not sys.platform.startswith("linux") or not shutil.which("unshare"):
+        return False
+    flags = [] if os.geteuid() == 0 else ["--map-root-user"]
+    result = subprocess.run(["unshare", "--fork", "--pid", "--mount-proc", "--net", *flags, "true"],
+                            capture_output=True)
+    return result.returncode == 0
+
+
+class TestIsolationConfig:
+    """Tests for the `workdir`, `isolate` and `read_only_root` keys."""
+
+    def test_workdir(self, temp_dir, omni_runner, capsys):
+        """Test that the process runs in workdir, relative to the service path."""
+        from omni_run import load_manifest, Orchestrator, ManifestError
+
+        (temp_dir / "app" / "data").mkdir(parents=True)
+        manifest = load_manifest(write_manifest(temp_dir, f"""
+services:
+  app:
+    path: app
+    workdir: data
+    command: ["{sys.executable}", "-c", "import os; print('cwd', os.getcwd())"]
+"""))
+        assert manifest.services["app"].workdir == (temp_dir / "app" / "data").resolve()
+        assert Orchestrator(omni_runner, manifest).up() == 0
+        assert f"cwd {(temp_dir / 'app' / 'data').resolve()}" in capsys.readouterr().out
+
+        write_manifest(temp_dir, "services:\n  app: {command: 'true', workdir: missing}\n")
+        with pytest.raises(ManifestError, match="workdir: .*missing is not a directory"):
+            load_manifest(temp_dir / "omni-run.yaml")
+
+    def test_parse_and_validate(self, temp_dir):
+        """Test namespaces, the read-only root's writable paths, and invalid combinations."""
+        import tempfile
+        from omni_run import load_manifest, ManifestError
+
+        manifest = load_manifest(write_manifest(temp_dir, """
+services:
+  api: {command: 'true', isolate: [pid, mount], read_only_root: true}
+  worker: {command: 'true', isolate: net, ports: {http: {port: auto, socket: true}}}
+  plain: {command: 'true'}
+"""))
+        api = manifest.services["api"].isolation
+        assert (api.namespaces, api.read_only_root) == (["pid", "mount"], True)
+        assert api.writable[0] == temp_dir.resolve() and Path(tempfile.gettempdir()) in api.writable
+        assert api.describe() == "pid namespace, mount namespace, read-only root"
+        assert manifest.services["worker"].isolation.namespaces == ["net"]
+        assert manifest.services["plain"].isolation is None
+
+        for block, message in [("{command: x, isolate: [user]}", "unknown namespace 'user' \\(supported: net, pid, mount\\)"),
+                               ("{command: x, isolate: [net], ports: 8080}", "port\\(s\\) http would be unreachable"),
+                               ("{command: x, read_only_root: yes please}", "expected true or false")]:
+            write_manifest(temp_dir, f"services:\n  api: {block}\n")
+            with pytest.raises(ManifestError, match=message):
+                load_manifest(temp_dir / "omni-run.yaml")
+
+    @pytest.mark.skipif(not sys.platform.startswith("linux"), reason="Namespaces are Linux only")
+    def test_unshare_wrapper(self, temp_dir, monkeypatch):
+        """Test the unshare flags and the setup script run before the service."""
+        import omni_run
+        from omni_run import Isolation
+
+        monkeypatch.setattr(omni_run.shutil, "which", lambda name: "/usr/bin/" + name)
+        monkeypatch.setattr(omni_run.os, "geteuid", lambda: 1000)
+        argv = Isolation(["net", "pid"], read_only_root=True, writable=[temp_dir]).wrap("services.api", ["./api", "-v"])
+
+        assert argv[:argv.index("--")] == ["unshare", "--fork", "--map-root-user", "--net", "--pid", "--mount-proc", "--mount"]
+        script = argv[argv.index("--") + 3]
+        assert "ip link set lo up" in script
+        assert f"mount --bind {temp_dir} {temp_dir}" in script
+        assert script.index("mount --bind") < script.index("remount,bind,ro /")
+        assert 'trap "kill -$sig $child' in script
+        assert argv[-3:] == ["omni-run", "./api", "-v"]
+
+        monkeypatch.setattr(omni_run.shutil, "which", lambda name: None)
+        with pytest.raises(omni_run.ManifestError, match="need Linux with unshare"):
+            Isolation(["pid"]).wrap("services.api", ["./api"])
+
+
+@pytest.mark.skipif(not namespaces_available(), reason="Needs unshare with pid and network namespaces")
+class TestIsolatedServices:
+    """Tests for running services in their own namespaces."""
+
+    def _probe(self, temp_dir, omni_runner, capsys):
+        from omni_run import load_manifest, Orchestrator
+
+        (temp_dir / "probe.py").write_text("""
+import os, socket
+print("pid", os.getpid())
+for target in ("/omni-run-isolation-probe", "written"):
+    try:
+        open(target, "w").close()
+        print("wrote", target)
+    except OSError:
+        print("denied", target)
+try:
+    socket.create_connection(("192.0.2.1", 80), timeout=1)
+except OSError as e:
+    print("network", e.errno)
+""")
+        manifest = load_manifest(write_manifest(temp_dir, f"""
+services:
+  box:
+    command: ["{sys.executable}", probe.py]
+    isolate: [net, pid]
+    read_only_root: true
+"""))
+        assert Orchestrator(omni_runner, manifest).up() == 0
+        return capsys.readouterr().out
+
+    def test_own_pids(self, temp_dir, omni_runner, capsys):
+        """Test that an isolated service is among the first pids of its own namespace."""
+        out = self._probe(temp_dir, omni_runner, capsys)
+        assert int(out.split("pid ")[1].split()[0]) < 10
+
+    def test_read_only_root(self, temp_dir, omni_runner, capsys):
+        """Test that an isolated service can't write outside its directory but can inside it."""
+        out = self._probe(temp_dir, omni_runner, capsys)
+        assert "denied /omni-run-isolation-probe" in out
+        assert "wrote written" in out and (temp_dir / "written").exists()
+        assert not Path("/omni-run-isolation-probe").exists()
+
+    def test_no_network(self, temp_dir, omni_runner, capsys):
+        """Test that an isolated service has only a loopback interface."""
+        out = self._probe(temp_dir, omni_runner, capsys)
+        assert "network 101" in out  # ENETUNREACH
+
+    def test_stop_signal_reaches_service(self, temp_dir, omni_runner, capsys):
+        """Test that stopping a pid-isolated service delivers its stop signal rather than a kill."""
+        import time
+        from omni_run import load_manifest, Orchestrator
+
+        manifest = load_manifest(write_manifest(temp_dir, f"""
+services:
+  box:
+    command: ["{sys.executable}", "-c", "import signal, sys, time; signal.signal(signal.SIGTERM, lambda *a: (print('graceful', flush=True), sys.exit(0))); print('up', flush=True); time.sleep(60)"]
+    isolate: pid
+    stop_timeout: 20s
+"""))
+        orchestrator = Orchestrator(omni_runner, manifest)
+        box = orchestrator.services["box"]
+        orchestrator.start_service(box)
+        deadline = time.time() + 10
+        while "up" not in "".join(line for _, _, line in box.output) and time.time() < deadline:
+            time.sleep(0.05)
+        start = time.time()
+        assert orchestrator.stop_service(box) is False
+        assert time.time() - start < 10
+        time.sleep(0.2)
+        assert "graceful" in capsys.readouterr().out
+
+
+class TestRunAs:
+    """Tests for the `user` and `group` keys."""
+
+    def test_parse(self, temp_dir):
+        """Test names and ids, and settings that are rejected."""
+        from omni_run import load_manifest, ManifestError, RunAs
+
+        manifest = load_manifest(write_manifest(temp_dir, "services:\n  api: {command: 'true', user: 1234, group: 99}\n"))
+        assert manifest.services["api"].run_as == RunAs("1234", "99")
+        assert manifest.services["api"].run_as.describe() == "user 1234, group 99"
+        for block, message in [("{command: x, user: ''}", "user: expected a name or a numeric id"),
+                               ("{command: x, user: nobody, isolate: pid}", "can't be combined with isolate")]:
+            write_manifest(temp_dir, f"services:\n  api: {block}\n")
+            with pytest.raises(ManifestError, match=message):
+                load_manifest(temp_dir / "omni-run.yaml")
+
+    @pytest.mark.skipif(sys.platform == "win32", reason="Users and groups come from the POSIX databases")
+    def test_unknown_users_and_groups(self):
+        """Test unknown names and a uid without a passwd entry or a group."""
+        from omni_run import ManifestError, RunAs
+
+        with pytest.raises(ManifestError, match="no such user 'omni-run-nobody-here'"):
+            RunAs("omni-run-nobody-here").resolve("services.api")
+        with pytest.raises(ManifestError, match="uid 4242424 has no passwd entry; set group"):
+            RunAs("4242424").resolve("services.api")
+        with pytest.raises(ManifestError, match="no such group 'omni-run-nogroup-here'"):
+            RunAs(group="omni-run-nogroup-here").resolve("services.api")
+
+    @pytest.mark.skipif(sys.platform == "win32", reason="Users and groups come from the POSIX databases")
+    def test_privilege_check(self, monkeypatch):
+        """Test that another user needs root, and omni-run's own user doesn't."""
+        import omni_run
+        from omni_run import ManifestError, RunAs
+
+        monkeypatch.setattr(omni_run.os, "geteuid", lambda: 1000)
+        monkeypatch.setattr(omni_run.os, "getgid", lambda: 1000)
+        monkeypatch.setattr(omni_run.os, "getegid", lambda: 1000)
+        with pytest.raises(ManifestError, match=r"services.api: running as user 4242424, group 7 needs root "
+                                                r"privileges \(omni-run runs as uid 1000\)"):
+            RunAs("4242424", "7").resolve("services.api")
+        credentials = RunAs("1000", "1000").resolve("services.api")
+        assert (credentials.uid, credentials.gid, credentials.groups) == (1000, 1000, None)
+
+    @pytest.mark.skipif(sys.platform == "win32" or os.geteuid() != 0, reason="Switching users needs root")
+    def test_service_runs_as_user(self, temp_dir, omni_runner, capsys):
+        """Test that only the service switches (hooks keep the launcher's user), with the user's HOME."""
+        import pwd
+        from omni_run import load_manifest, Orchestrator
+
+        nobody = pwd.getpwnam("nobody")
+        temp_dir.chmod(0o755)
+        manifest = load_manifest(write_manifest(temp_dir, """
+services:
+  app:
+    command: ["/bin/sh", "-c", "echo ids $(id -u) $(id -g) home $HOME"]
+    user: nobody
+    hooks: {pre_start: "echo hook $(id -u)"}
+"""))
+        assert Orchestrator(omni_runner, manifest).up() == 0
+        out = capsys.readouterr().out
+        assert f"ids {nobody.pw_uid} {nobody.pw_gid} home {nobody.pw_dir}" in out
+        assert "hook 0" in out
+
+    @pytest.mark.skipif(sys.platform == "win32" or os.geteuid() != 0, reason="Switching users needs root")
+    def test_limited_service_runs_as_user(self, temp_dir, omni_runner, capsys):
+        """Test that the limits shim drops to the user after applying the limits."""
+        import pwd
+        from omni_run import load_manifest, Orchestrator
+
+        temp_dir.chmod(0o755)
+        manifest = load_manifest(write_manifest(temp_dir, """
+services:
+  app:
+    command: ["/bin/sh", "-c", "echo uid $(id -u) nofile $(ulimit -n)"]
+    user: nobody
+    limits: {open_files: 64}
+"""))
+        assert Orchestrator(omni_runner, manifest).up() == 0
+        assert f"uid {pwd.getpwnam('nobody').pw_uid} nofile 64" in capsys.readouterr().out
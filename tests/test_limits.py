@@ -0,0 +1,245 @@
+"""
+Tests for per-service resource limits in OmniRun.
+
+This module tests:
+- Parsing `limits:` (cpu, memory, open_files, on_exceed) and byte sizes
+- cgroup v2 groups, limit files and usage accounting
+- rlimit and usage-sampling fallbacks when cgroups are unavailable
+- Usage and limits reported by `omni-run status`
+"""
+
+import sys
+import time
+import pytest
+from pathlib import Path
+
+from conftest import *
+
+
+def fake_cgroup(temp_dir: Path, controllers: str = "cpuset cpu io memory pids") -> Path:
+    parent = temp_dir / "cgroup"
+    parent.mkdir()
+    (parent / "cgroup.controllers").write_text(controllers + "\n")
+    (parent / "cgroup.subtree_control").write_text("\n")
+    return parent
+
+
+class TestLimitConfig:
+    """Tests for the `limits:` block."""
+
+    def test_parse_size(self):
+        """Test plain byte counts and binary suffixes."""
+        from omni_run import parse_size
+
+        assert parse_size(1024) == 1024
+        assert parse_size("512") == 512
+        assert parse_size("64K") == 64 * 1024
+        assert parse_size("512M") == 512 * 1024 ** 2
+        assert parse_size("256Mi") == 256 * 1024 ** 2
+        assert parse_size("1.5G") == int(1.5 * 1024 ** 3)
+        with pytest.raises(ValueError):
+            parse_size("lots")
+
+    def test_limits_from_manifest(self, temp_dir):
+        """Test that limits are parsed, including millicores, and that on_exceed defaults to kill."""
+        from omni_run import load_manifest
+
+        manifest = load_manifest(write_manifest(temp_dir, """
+services:
+  api:
+    command: "true"
+    limits:
+      cpu: 500m
+      memory: 256M
+      open_files: 512
+      on_exceed: warn
+  worker:
+    command: "true"
+    limits: {cpu: 2}
+  free:
+    command: "true"
+"""))
+        api = manifest.services["api"].limits
+        assert (api.cpu, api.memory, api.open_files, api.on_exceed) == (0.5, 256 * 1024 ** 2, 512, "warn")
+        assert manifest.services["worker"].limits.on_exceed == "kill"
+        assert manifest.services["free"].limits is None
+
+    def test_invalid_limits(self, temp_dir):
+        """Test that bad sizes, non-positive cpu, unknown on_exceed values and unknown keys are rejected."""
+        from omni_run import load_manifest, ManifestError
+
+        for block, message in [("{memory: huge}", "Invalid size"), ("{cpu: 0}", "limits.cpu: must be positive"),
+                               ("{on_exceed: ignore}", "on_exceed: must be one of kill, warn"),
+                               ("{disk: 1G}", "unknown key")]:
+            write_manifest(temp_dir, f"services:\n  api:\n    command: 'true'\n    limits: {block}\n")
+            with pytest.raises(ManifestError, match=message):
+                load_manifest(temp_dir / "omni-run.yaml")
+
+
+class TestCgroupLimiter:
+    """Tests for cgroup v2 enforcement against a fake cgroup tree."""
+
+    def test_group_writes_limits(self, temp_dir):
+        """Test that the service group gets cpu.max and memory.max, or memory.high when only warning."""
+        from omni_run import CgroupLimiter, ResourceLimits
+
+        limiter = CgroupLimiter(fake_cgroup(temp_dir))
+        group = limiter.group("api", ResourceLimits(cpu=1.5, memory=1024 ** 3))
+        assert group == limiter.base / "api"
+        assert (limiter.parent / "cgroup.subtree_control").read_text() == "+cpu +memory"
+        assert (limiter.base / "cgroup.subtree_control").read_text() == "+cpu +memory"
+        assert (group / "cpu.max").read_text() == "150000 100000"
+        assert (group / "memory.max").read_text() == str(1024 ** 3)
+
+        soft = limiter.group("web", ResourceLimits(memory=1024, on_exceed="warn"))
+        assert (soft / "memory.high").read_text() == "1024"
+        assert not (soft / "memory.max").exists()
+
+    def test_unusable_without_controllers(self, temp_dir):
+        """Test that a cgroup without the cpu/memory controllers is not used."""
+        from omni_run import CgroupLimiter, ResourceLimits
+
+        limiter = CgroupLimiter(fake_cgroup(temp_dir, controllers="pids"))
+        assert limiter.group("api", ResourceLimits(cpu=1)) is None
+        assert not limiter.base.exists()
+
+    def test_usage_and_oom_kills(self, temp_dir):
+        """Test reading cpu.stat, memory.current and memory.events."""
+        from omni_run import CgroupLimiter, ResourceLimits, cgroup2_mount, own_cgroup
+
+        group = CgroupLimiter(fake_cgroup(temp_dir)).group("api", ResourceLimits(memory=4096))
+        (group / "cpu.stat").write_text("usage_usec 2500000\nuser_usec 2000000\nsystem_usec 500000\n")
+        (group / "memory.current").write_text("123456\n")
+        (group / "memory.events").write_text("low 0\nhigh 0\nmax 3\noom 1\noom_kill 1\n")
+        assert CgroupLimiter.usage(group) == (2.5, 123456)
+        assert CgroupLimiter.oom_kills(group) == 1
+        assert CgroupLimiter.oom_kills(temp_dir) == 0
+
+        (temp_dir / "mounts").write_text("proc /proc proc rw 0 0\ncgroup2 /sys/fs/cgroup/unified cgroup2 rw 0 0\n")
+        (temp_dir / "cgroup").joinpath("self").write_text("12:pids:/user.slice\n0::/user.slice/session-1.scope\n")
+        assert cgroup2_mount(str(temp_dir / "mounts")) == Path("/sys/fs/cgroup/unified")
+        assert own_cgroup(str(temp_dir / "cgroup" / "self")) == "/user.slice/session-1.scope"
+
+    @pytest.mark.skipif(sys.platform == "win32", reason="cgroups are Linux-only")
+    def test_service_joins_group_before_exec(self, temp_dir, omni_runner, monkeypatch, capsys):
+        """Test that omni-run attaches the service to its group before the service's own code runs."""
+        import omni_run
+        from omni_run import load_manifest, Orchestrator, CgroupLimiter
+
+        limiter = CgroupLimiter(fake_cgroup(temp_dir))
+        monkeypatch.setattr(omni_run.CgroupLimiter, "detect", classmethod(lambda cls: limiter))
+        orchestrator = Orchestrator(omni_runner, load_manifest(write_manifest(temp_dir, f"""
+services:
+  api:
+    command: ["{sys.executable}", "-c", "import os; print('procs', open('{limiter.base}/api/cgroup.procs').read(), os.getpid())"]
+    limits: {{cpu: 1}}
+""")))
+        assert orchestrator.up() == 0
+        pid = orchestrator.services["api"].process.pid
+        assert f"procs {pid} {pid}" in capsys.readouterr().out
+
+
+@pytest.mark.skipif(sys.platform == "win32", reason="Uses rlimits and POSIX process groups")
+class TestLimitEnforcement:
+    """Tests for enforcing limits on running services without cgroups."""
+
+    def _orchestrator(self, temp_dir, omni_runner, monkeypatch, content):
+        import omni_run
+        from omni_run import load_manifest, Orchestrator
+
+        monkeypatch.setattr(omni_run.CgroupLimiter, "detect", classmethod(lambda cls: None))
+        monkeypatch.setattr(omni_run, "USAGE_CHECK_INTERVAL", 0.2)
+        return Orchestrator(omni_runner, load_manifest(write_manifest(temp_dir, content)))
+
+    def test_open_files_rlimit(self, temp_dir, omni_runner, monkeypatch, capsys):
+        """Test that open_files becomes the child's RLIMIT_NOFILE."""
+        orchestrator = self._orchestrator(temp_dir, omni_runner, monkeypatch, f"""
+services:
+  api:
+    command: ["{sys.executable}", "-c", "import resource; print('nofile', *resource.getrlimit(resource.RLIMIT_NOFILE))"]
+    limits: {{open_files: 64}}
+""")
+        assert orchestrator.up() == 0
+        assert "nofile 64 64" in capsys.readouterr().out
+
+    def test_memory_breach_kills(self, temp_dir, omni_runner, monkeypatch, capsys):
+        """Test that a service over its memory limit is killed and the reason recorded."""
+        from omni_run import ServiceState
+
+        orchestrator = self._orchestrator(temp_dir, omni_runner, monkeypatch, f"""
+services:
+  hog:
+    command: ["{sys.executable}", "-c", "import time; data = b'x' * (64 * 1024 * 1024); time.sleep(30)"]
+    limits: {{memory: 16M}}
+""")
+        start = time.time()
+        assert orchestrator.up() == 1
+        out = capsys.readouterr().out
+
+        hog = orchestrator.services["hog"]
+        assert time.time() - start < 15
+        assert hog.state == ServiceState.FAILED
+        assert hog.reason.startswith("limit exceeded: memory")
+        assert "exceeds limit 16.0M; killing" in out
+        assert "cgroups v2 unavailable" in out
+
+    def test_warn_only(self, temp_dir, omni_runner, monkeypatch, capsys):
+        """Test that on_exceed: warn reports the breach once and lets the service finish."""
+        from omni_run import ServiceState
+
+        orchestrator = self._orchestrator(temp_dir, omni_runner, monkeypatch, f"""
+services:
+  hog:
+    command: ["{sys.executable}", "-c", "import time; data = b'x' * (64 * 1024 * 1024); time.sleep(1.5)"]
+    limits: {{memory: 16M, on_exceed: warn}}
+""")
+        assert orchestrator.up() == 0
+        out = capsys.readouterr().out
+
+        assert orchestrator.services["hog"].state == ServiceState.EXITED
+        assert out.count("limit exceeded: memory") == 1
+        assert "killing" not in out
+
+    def _limited_api(self, temp_dir, omni_runner, monkeypatch):
+        return self._orchestrator(temp_dir, omni_runner, monkeypatch, f"""
+services:
+  api:
+    command: ["{sys.executable}", "-c", "import time; time.sleep(30)"]
+    limits: {{cpu: 0.5, memory: 1G, open_files: 256}}
+""")
+
+    def test_snapshot_reports_usage(self, temp_dir, omni_runner, monkeypatch):
+        """Test that sampled usage and the limits appear in the supervisor snapshot."""
+        orchestrator = self._limited_api(temp_dir, omni_runner, monkeypatch)
+        api = orchestrator.services["api"]
+        orchestrator.start_service(api)
+        try:
+            orchestrator.check_limits(api)
+            time.sleep(0.2)
+            orchestrator.check_limits(api)
+            info = orchestrator.snapshot()["services"]["api"]
+        finally:
+            orchestrator.shutdown()
+
+        assert info["limits"] == {"cpu": 0.5, "memory": 1024 ** 3, "open_files": 256, "on_exceed": "kill"}
+        assert info["usage"]["memory"] > 0
+        assert info["usage"]["cpu"] is not None
+        assert 3 <= info["usage"]["open_files"] <= 256
+
+    def test_status_reports_usage(self, temp_dir, omni_runner, monkeypatch, capsys):
+        """Test that `omni-run status` shows recorded usage against the limits."""
+        import os
+        from omni_run import run_subcommand, write_supervisor_state, SUPERVISOR_PIDFILE
+
+        snapshot = self._limited_api(temp_dir, omni_runner, monkeypatch).snapshot()
+        snapshot["services"]["api"].update(state="running", usage={"cpu": 12.5, "memory": 50 * 1024 ** 2, "open_files": 9})
+        (temp_dir / ".omni-run").mkdir(exist_ok=True)
+        write_supervisor_state(temp_dir / ".omni-run", snapshot)
+        (temp_dir / ".omni-run" / SUPERVISOR_PIDFILE).write_text(str(os.getpid()))
+        capsys.readouterr()
+
+        assert run_subcommand(["status", "-C", str(temp_dir)]) == 0
+        out = capsys.readouterr().out
+        assert "CPU" in out and "MEM" in out
+        assert "12.5%" in out and "50.0M" in out
+        assert "cpu 12%/50%, memory 50.0M/1.0G, open files 9/256 (on exceed: kill)" in out
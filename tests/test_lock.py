@@ -0,0 +1,143 @@
+"""
+Tests for omni-run.lock and --frozen in OmniRun.
+
+This module tests:
+- Lock entries: detected launches, runtime versions and dependency hashes, with machine-independent paths
+- Describing how the current project diverges from the lock
+- `omni-run lock` and `lock --check`, and `up --frozen` refusing to start a diverged project
+"""
+
+import json
+from pathlib import Path
+
+from conftest import *
+
+
+def write_project(temp_dir: Path):
+    write_manifest(temp_dir, "services:\n  web:\n    path: web\n  worker:\n    command: python3 worker.py\n"
+                             "sidecars:\n  db: postgres:16\n")
+    web = temp_dir / "web"
+    web.mkdir()
+    (web / "package.json").write_text(json.dumps({"scripts": {"start": "node server.js"}}))
+    (web / "package-lock.json").write_text("{}")
+    (web / ".nvmrc").write_text("20\n")
+    (temp_dir / "requirements.txt").write_text("requests==2.31.0\n")
+
+
+def fake_versions(monkeypatch, versions):
+    """Make the toolchain probes report fixed versions instead of running the host's programs."""
+    from omni_run import ToolchainResolver
+    monkeypatch.setattr(ToolchainResolver, "path_version", lambda self, runtime, directory: versions.get(runtime))
+
+
+class TestLockEntries:
+    """Tests for what a service records."""
+
+    def test_entries(self, temp_dir, omni_runner, monkeypatch):
+        """Test the detected launch, pinned and PATH versions, relative dependency paths and skipped sidecars."""
+        import hashlib
+        from omni_run import load_manifest, Orchestrator, lock_entries
+
+        write_project(temp_dir)
+        fake_versions(monkeypatch, {"node": "20.11.1", "python": "3.12.2"})
+        orchestrator = Orchestrator(omni_runner, load_manifest(temp_dir / "omni-run.yaml"))
+        entries = lock_entries(orchestrator, list(orchestrator.manifest.services))
+
+        assert set(entries) == {"web", "worker"}
+        assert entries["web"]["runtime"] == "node"
+        assert entries["web"]["detected"] == {"command": ["npm", "run", "start"], "cwd": "web"}
+        assert entries["web"]["toolchains"] == {"node": {"version": "20.11.1", "pin": "20", "source": "web/.nvmrc"}}
+        assert entries["web"]["dependencies"] == {
+            "web/package.json": "sha256:" + hashlib.sha256((temp_dir / "web" / "package.json").read_bytes()).hexdigest(),
+            "web/package-lock.json": "sha256:" + hashlib.sha256(b"{}").hexdigest()}
+        assert "detected" not in entries["worker"]
+        assert entries["worker"]["toolchains"] == {"python": {"version": "3.12.2"}}
+        assert list(entries["worker"]["dependencies"]) == ["requirements.txt"]
+
+    def test_differences(self):
+        """Test messages for runtimes, launches, versions and dependency files, and unlocked services."""
+        from omni_run import lock_differences
+
+        locked = {"web": {"runtime": "node", "detected": {"command": ["npm", "run", "start"], "cwd": "web"},
+                          "toolchains": {"node": {"version": "20.11.1"}},
+                          "dependencies": {"web/package.json": "sha256:a", "web/yarn.lock": "sha256:b"}}}
+        current = {"web": {"runtime": "node", "detected": {"command": ["npm", "run", "dev"], "cwd": "web"},
+                           "toolchains": {"node": {"version": "20.12.0"}, "python": {"version": "3.12.2"}},
+                           "dependencies": {"web/package.json": "sha256:c", "web/package-lock.json": "sha256:d"}},
+                   "api": {}}
+        assert lock_differences(locked, current) == [
+            "web: detected launch is `npm run dev` in web, locked `npm run start` in web",
+            "web: node is 20.12.0, locked 20.11.1",
+            "web: python is 3.12.2, locked none",
+            "web: web/package-lock.json is not in omni-run.lock",
+            "web: web/package.json changed since it was locked",
+            "web: web/yarn.lock is locked but missing",
+            "api: not in omni-run.lock"]
+        assert lock_differences(current, current) == []
+
+
+class TestLockCommand:
+    """Tests for `omni-run lock` and `--frozen`."""
+
+    def _locked(self, temp_dir, capsys, monkeypatch):
+        from omni_run import run_subcommand
+
+        write_project(temp_dir)
+        fake_versions(monkeypatch, {"node": "20.11.1", "python": "3.12.2"})
+        assert run_subcommand(["lock", "-C", str(temp_dir)]) == 0
+        return capsys.readouterr().out
+
+    def _changed(self, temp_dir, capsys, monkeypatch):
+        self._locked(temp_dir, capsys, monkeypatch)
+        (temp_dir / "web" / "package-lock.json").write_text('{"lockfileVersion": 3}')
+        fake_versions(monkeypatch, {"node": "20.11.1", "python": "3.11.9"})
+
+    def test_frozen_without_lock(self, temp_dir, capsys, monkeypatch):
+        """Test that --frozen refuses to start without a lock file."""
+        from omni_run import run_subcommand
+
+        write_project(temp_dir)
+        fake_versions(monkeypatch, {"node": "20.11.1", "python": "3.12.2"})
+        assert run_subcommand(["up", "--frozen", "-C", str(temp_dir)]) == 1
+        assert "--frozen: no omni-run.lock next to the manifest" in capsys.readouterr().out
+
+    def test_lock_and_check(self, temp_dir, capsys, monkeypatch):
+        """Test writing the lock for every service, and a clean check right after."""
+        from omni_run import run_subcommand, ANSI_ESCAPE
+
+        assert "Wrote omni-run.lock (2 service(s))" in ANSI_ESCAPE.sub("", self._locked(temp_dir, capsys, monkeypatch))
+        data = json.loads((temp_dir / "omni-run.lock").read_text())
+        assert data["version"] == 1 and sorted(data["services"]) == ["web", "worker"]
+        assert run_subcommand(["lock", "--check", "-C", str(temp_dir)]) == 0
+        assert "omni-run.lock is up to date" in capsys.readouterr().out
+
+    def test_check_after_change(self, temp_dir, capsys, monkeypatch):
+        """Test that a check reports a changed lockfile and a different toolchain version."""
+        from omni_run import run_subcommand, ANSI_ESCAPE
+
+        self._changed(temp_dir, capsys, monkeypatch)
+        assert run_subcommand(["lock", "--check", "-C", str(temp_dir)]) == 1
+        out = ANSI_ESCAPE.sub("", capsys.readouterr().out)
+        assert "web: web/package-lock.json changed since it was locked" in out
+        assert "worker: python is 3.11.9, locked 3.12.2" in out
+
+    def test_frozen_after_change(self, temp_dir, capsys, monkeypatch):
+        """Test that --frozen refuses to start a diverged service, checking only the services being started."""
+        from omni_run import run_subcommand
+
+        self._changed(temp_dir, capsys, monkeypatch)
+        assert run_subcommand(["up", "web", "--frozen", "--skip-install", "-C", str(temp_dir)]) == 1
+        out = capsys.readouterr().out
+        assert "--frozen: the project diverges from omni-run.lock:\n  web: web/package-lock.json changed" in out
+        assert "worker" not in out
+
+    def test_relock_one_service(self, temp_dir, capsys, monkeypatch):
+        """Test relocking a named service, which leaves the others' entries, and an unknown name."""
+        from omni_run import run_subcommand
+
+        self._changed(temp_dir, capsys, monkeypatch)
+        assert run_subcommand(["lock", "web", "-C", str(temp_dir)]) == 0
+        assert "web: web/package-lock.json changed since it was locked" in capsys.readouterr().out
+        data = json.loads((temp_dir / "omni-run.lock").read_text())
+        assert data["services"]["worker"]["toolchains"]["python"]["version"] == "3.12.2"
+        assert run_subcommand(["lock", "nope", "-C", str(temp_dir)]) == 1
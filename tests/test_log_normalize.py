@@ -0,0 +1,121 @@
+"""
+Tests for normalized (unified JSON) service logs in OmniRun.
+
+This module tests:
+- logfmt parsing and level names from other loggers
+- Unified fields for plain text, JSON and logfmt lines
+- Normalized log files and sinks during `up`, per service, and searching them with `omni-run logs`
+"""
+
+import sys
+import json
+import pytest
+from pathlib import Path
+
+from conftest import *
+
+
+class TestStructuredLines:
+    """Tests for reading structured lines."""
+
+    def test_logfmt_and_levels(self):
+        """Test logfmt pairs and quoting, lines that aren't logfmt, and level names and numbers."""
+        from omni_run import parse_logfmt, unified_level
+
+        assert parse_logfmt('level=info msg="listening on :8080" port=8080 tag=') == {
+            "level": "info", "msg": "listening on :8080", "port": "8080", "tag": ""}
+        assert parse_logfmt('msg="say \\"hi\\"" at=x') == {"msg": 'say "hi"', "at": "x"}
+        for line in ("GET /users 200", "a=b and more", "only=one", ""):
+            assert parse_logfmt(line) is None
+
+        assert [unified_level(v) for v in ("WARNING", "Err", "trace", "critical", "30", 40, 50, 60, 5)] == [
+            "warn", "error", "debug", "fatal", "info", "warn", "error", "fatal", "debug"]
+        assert unified_level("verbose") is None and unified_level(True) is None
+
+    def test_normalized_payloads(self):
+        """Test the unified fields of text, JSON (pino-style) and logfmt lines, and stderr errors."""
+        from omni_run import parse_log_line, normalized_payload, normalize_record
+
+        payload = normalized_payload(parse_log_line("api", "\x1b[32mplain hello\x1b[0m"))
+        assert set(payload) == {"timestamp", "service", "stream", "level", "message"}
+        assert (payload["service"], payload["stream"], payload["level"], payload["message"]) == (
+            "api", "stdout", "info", "plain hello")
+
+        payload = normalized_payload(parse_log_line(
+            "web", '{"level":50,"time":1714557600000,"msg":"boom","req":{"id":7}}'))
+        assert payload["level"] == "error" and payload["message"] == "boom"
+        assert payload["timestamp"].startswith("2024-05-0") and payload["fields"] == {"req": {"id": 7}}
+
+        payload = normalized_payload(parse_log_line("worker", 'lvl=warning msg="slow job" ms=120', "stderr"))
+        assert (payload["level"], payload["message"], payload["fields"]) == ("warn", "slow job", {"ms": "120"})
+
+        assert normalized_payload(parse_log_line("api", "ValueError: bad input", "stderr"))["level"] == "error"
+        assert normalized_payload(parse_log_line("api", "ValueError: bad input"))["level"] == "info"
+        assert normalized_payload(parse_log_line("api", "2024 ERROR disk full"))["level"] == "error"
+        record = normalize_record(parse_log_line("api", "GET / 200"))
+        assert record.normalized and json.loads(record.line) == record.fields
+
+
+@pytest.fixture
+def normalized_up(temp_dir, omni_runner, capsys):
+    """A finished `up` of logfmt, JSON and opted-out services with a JSON file sink; yields the log directory."""
+    from omni_run import load_manifest, Orchestrator, LogPipeline
+
+    (temp_dir / "go.py").write_text("""print('level=error msg="db down" user=42')\n""")
+    (temp_dir / "node.py").write_text("import json\nprint(json.dumps({'level': 30, 'msg': 'hi', 'user': '42'}))\n")
+    write_manifest(temp_dir, f"""
+logs:
+  normalize: true
+  sinks:
+    - {{type: file, path: all.jsonl, format: json}}
+services:
+  go: {{command: ["{sys.executable}", go.py]}}
+  node: {{command: ["{sys.executable}", node.py]}}
+  legacy:
+    command: ["{sys.executable}", "-c", "print('plain text')"]
+    logs: {{normalize: false}}
+""")
+    logs = LogPipeline.from_config(omni_runner.config, temp_dir, console=False)
+    assert Orchestrator(omni_runner, load_manifest(temp_dir / "omni-run.yaml"), logs=logs).up() == 0
+    logs.close()
+    capsys.readouterr()
+    yield temp_dir / ".omni-run" / "logs"
+
+
+class TestNormalizedUp:
+    """Tests for normalized logs during `up`."""
+
+    def test_normalized_file(self, normalized_up):
+        """Test that a service's log file holds its lines, and omni-run's own, as JSON entries."""
+        go = [json.loads(line) for line in (normalized_up / "go.log").read_text().splitlines()]
+        assert {"service": "go", "stream": "stdout", "level": "error", "message": "db down",
+                "fields": {"user": "42"}}.items() <= next(e for e in go if e["stream"] == "stdout").items()
+        assert any(e["stream"] == "omni" and e["message"].startswith("starting:") for e in go)
+
+    def test_opted_out(self, normalized_up):
+        """Test that a service with `normalize: false` keeps the plain log format."""
+        assert "[stdout] plain text" in (normalized_up / "legacy.log").read_text()
+
+    def test_sink(self, temp_dir, normalized_up):
+        """Test that sinks get normalized entries, and plain messages for a service that opted out."""
+        shipped = [json.loads(line) for line in (temp_dir / "all.jsonl").read_text().splitlines()]
+        node = next(e for e in shipped if e["service"] == "node" and e["stream"] == "stdout")
+        assert (node["level"], node["message"], node["fields"]) == ("info", "hi", {"user": "42"})
+        legacy = next(e for e in shipped if e["service"] == "legacy" and e["stream"] == "stdout")
+        assert legacy["message"] == "plain text" and "fields" not in legacy
+
+    def test_where_across_formats(self, temp_dir, normalized_up, capsys):
+        """Test that `logs --where` matches a field in logfmt and JSON lines alike."""
+        from omni_run import run_subcommand, ANSI_ESCAPE
+
+        run_subcommand(["logs", "-C", str(temp_dir), "--where", "fields.user=42"])
+        out = ANSI_ESCAPE.sub("", capsys.readouterr().out)
+        assert sorted(line.split(" | ")[0].strip() for line in out.splitlines() if " | " in line) == ["go", "node"]
+
+    def test_level(self, temp_dir, normalized_up, capsys):
+        """Test that `logs --level` uses the normalized levels."""
+        from omni_run import run_subcommand, ANSI_ESCAPE
+
+        run_subcommand(["logs", "-C", str(temp_dir), "--level", "error"])
+        out = ANSI_ESCAPE.sub("", capsys.readouterr().out)
+        assert "db down" in out and '"hi"' not in out
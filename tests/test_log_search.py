@@ -0,0 +1,210 @@
+"""
+Tests for searching service log files in OmniRun.
+
+This module tests:
+- Time checkpoints in the <service>.log.idx index and how they follow rotation
+- Parsing --since/--until times and --where field conditions
+- Reading file lines back into times and records, and seeking with the index
+- `omni-run logs --grep/--since/--until/--level/--where` across services and rotated files
+"""
+
+import json
+import pytest
+from datetime import datetime
+from pathlib import Path
+
+from conftest import *
+
+
+def stamp(hour, minute, second=0):
+    return datetime(2024, 5, 1, hour, minute, second).timestamp()
+
+
+def text_line(hour, minute, text, stream="stdout"):
+    return f"{datetime(2024, 5, 1, hour, minute).isoformat(timespec='milliseconds')} [{stream}] {text}\n"
+
+
+class TestLogIndex:
+    """Tests for the checkpoints written next to log files."""
+
+    def _indexed(self, temp_dir, monkeypatch):
+        import omni_run
+        from omni_run import RotatingLogFile
+
+        monkeypatch.setattr(omni_run, "LOG_INDEX_INTERVAL", 100)
+        log = RotatingLogFile(temp_dir / "api.log", max_bytes=400, backups=1, index=True)
+        for i in range(8):
+            log.write(f"line {i} " + "." * 40, stamp(12, i))
+        return log
+
+    def test_checkpoints(self, temp_dir, monkeypatch):
+        """Test a checkpoint at the first write and every interval, pointing at its line."""
+        from omni_run import read_log_index
+
+        self._indexed(temp_dir, monkeypatch).close()
+        content = (temp_dir / "api.log").read_bytes()
+        checkpoints = read_log_index(temp_dir / "api.log")
+        assert [s for _, s in checkpoints] == [stamp(12, 0), stamp(12, 3), stamp(12, 6)]
+        assert all(content[offset:].startswith(f"line {i}".encode()) for (offset, _), i in zip(checkpoints, [0, 3, 6]))
+
+    def test_rotation_carries_index(self, temp_dir, monkeypatch):
+        """Test that a rotated file keeps its index and the new file starts one of its own."""
+        from omni_run import read_log_index
+
+        log = self._indexed(temp_dir, monkeypatch)
+        checkpoints = read_log_index(temp_dir / "api.log")
+        log.write("line 8 " + "." * 40, stamp(12, 8))
+        log.close()
+        assert read_log_index(temp_dir / "api.log.1") == checkpoints
+        assert read_log_index(temp_dir / "api.log") == [(0, stamp(12, 8))]
+
+    def test_no_index_by_default(self, temp_dir):
+        """Test that a file opened without index=True gets no index."""
+        from omni_run import RotatingLogFile
+
+        plain = RotatingLogFile(temp_dir / "sink.log")
+        plain.write("no index")
+        plain.close()
+        assert not (temp_dir / "sink.log.idx").exists()
+
+    def test_pipeline_indexes_service_files(self, temp_dir):
+        """Test that the files `up` writes get an index stamped with the record times."""
+        from omni_run import LogPipeline, read_log_index
+
+        logs = LogPipeline(log_dir=temp_dir / "logs")
+        logs.register("api")
+        record = logs.write("api", "hello")
+        logs.close()
+        assert read_log_index(temp_dir / "logs" / "api.log") == [(0, round(record.timestamp.timestamp(), 3))]
+
+
+class TestLogQuery:
+    """Tests for times, field conditions and reading lines back."""
+
+    def test_parse_log_time(self):
+        """Test durations ago, times today and ISO date/times."""
+        from omni_run import parse_log_time
+
+        now = datetime(2024, 5, 1, 12, 0)
+        assert parse_log_time("15m", now) == stamp(11, 45)
+        assert parse_log_time("09:30", now) == stamp(9, 30)
+        assert parse_log_time("09:30:15", now) == stamp(9, 30, 15)
+        assert parse_log_time("2024-05-01T08:00", now) == stamp(8, 0)
+        assert parse_log_time("2024-05-01T08:00:00Z", now) == datetime.fromisoformat("2024-05-01T08:00:00+00:00").timestamp()
+        with pytest.raises(ValueError, match="expected a duration like 15m"):
+            parse_log_time("yesterday", now)
+
+    def test_field_filters(self):
+        """Test equality, numeric comparisons, regexes and nested paths, and the syntax errors."""
+        from omni_run import LogFieldFilter
+
+        fields = {"status": 500, "path": "/api/users", "ok": False, "http": {"method": "GET"}, "size": "12"}
+        checks = {"status=500": True, "status!=500": False, "status>=500": True, "status<500": False,
+                  "size>10": True, "ok=false": True, "path~^/api/": True, "path~^/web": False,
+                  "http.method=GET": True, "http.method.name=GET": False, "missing!=1": False, "path>1": False}
+        assert {text: LogFieldFilter.parse(text).matches(fields) for text in checks} == checks
+
+        for text, message in [("status", "expected FIELD=VALUE"), ("a..b=1", "invalid field path"),
+                              ("path~(", "invalid regex"), ("status>high", "> needs a number")]:
+            with pytest.raises(ValueError, match=message):
+                LogFieldFilter.parse(text)
+
+    def test_read_log_entry(self):
+        """Test text lines, JSON lines with and without a time of their own, and status lines."""
+        from omni_run import read_log_entry
+
+        when, record = read_log_entry("api", text_line(9, 15, "ERROR db down", "stderr").rstrip("\n"))
+        assert (when, record.stream, record.line, record.level) == (stamp(9, 15), "stderr", "ERROR db down", "error")
+        when, record = read_log_entry("api", '{"msg": "hi", "ts": %d}' % (stamp(9, 16) * 1000), None)
+        assert (when, record.fields["msg"]) == (stamp(9, 16), "hi")
+        assert read_log_entry("api", '{"msg": "no time"}', stamp(9, 17))[0] == stamp(9, 17)
+        assert read_log_entry("api", '{"time": "2024-05-01T09:18:00", "level": "warn"}')[1].level == "warn"
+
+    def test_since_seeks_with_index(self, temp_dir):
+        """Test that a --since search starts at the last checkpoint before the range."""
+        from omni_run import LogQuery, search_service_logs
+
+        head = text_line(9, 0, "before the checkpoint")
+        (temp_dir / "api.log").write_text(head + text_line(10, 0, "at the checkpoint") + text_line(11, 0, "after"))
+        # The index says everything before the second line is older than 08:20, which it isn't:
+        # the first line only shows when the file is read from the top
+        (temp_dir / "api.log.idx").write_text(f"0 {stamp(8, 0):.3f}\n{len(head)} {stamp(8, 20):.3f}\n")
+        found = [line for _, line in search_service_logs(temp_dir, "api", LogQuery(since=stamp(8, 30)))]
+        assert [line.split("] ")[1] for line in found] == ["at the checkpoint", "after"]
+
+        (temp_dir / "api.log.idx").unlink()
+        found = [line for _, line in search_service_logs(temp_dir, "api", LogQuery(since=stamp(8, 30)))]
+        assert len(found) == 3
+
+
+class TestLogsCommand:
+    """Tests for `omni-run logs` with filters."""
+
+    def setup_logs(self, temp_dir):
+        write_manifest(temp_dir, "services:\n  api: {command: 'true'}\n  web: {command: 'true'}\n")
+        logs = temp_dir / ".omni-run" / "logs"
+        logs.mkdir(parents=True)
+        (logs / "api.log.1").write_text(text_line(9, 0, "INFO booting") + text_line(9, 5, "WARN slow query"))
+        (logs / "api.log").write_text(
+            json.dumps({"time": "2024-05-01T10:00:00", "level": "info", "status": 200, "path": "/api/users"}) + "\n" +
+            json.dumps({"time": "2024-05-01T10:10:00", "level": "error", "status": 500, "path": "/api/orders"}) + "\n" +
+            text_line(10, 20, "Connection refused", "stderr") + text_line(10, 21, "restarting", "omni"))
+        (logs / "web.log").write_text(text_line(9, 2, "compiled") + text_line(10, 15, "ERROR proxy timeout"))
+
+    def run_logs(self, temp_dir, capsys, *args):
+        from omni_run import run_subcommand, ANSI_ESCAPE
+        code = run_subcommand(["logs", "-C", str(temp_dir), *args])
+        out = ANSI_ESCAPE.sub("", capsys.readouterr().out)
+        return code, [line.split(" | ", 1) for line in out.splitlines() if " | " in line], out
+
+    def test_since(self, temp_dir, capsys):
+        """Test --since over rotated files, with services interleaved in time order."""
+        self.setup_logs(temp_dir)
+        code, lines, _ = self.run_logs(temp_dir, capsys, "--since", "2024-05-01T09:01")
+        assert code == 0
+        assert [(name.strip(), line.split()[-1]) for name, line in lines] == [
+            ("web", "compiled"), ("api", "query"), ("api", '"/api/users"}'), ("api", '"/api/orders"}'),
+            ("web", "timeout"), ("api", "refused"), ("api", "restarting")]
+
+    def test_until(self, temp_dir, capsys):
+        """Test a window closed by --until, and a bare time meaning today."""
+        self.setup_logs(temp_dir)
+        _, lines, _ = self.run_logs(temp_dir, capsys, "--since", "09:00", "--until", "2024-05-01T09:03")
+        assert lines == []
+        _, lines, _ = self.run_logs(temp_dir, capsys, "--since", "2024-05-01T09:00", "--until", "2024-05-01T09:03")
+        assert [line.split()[-1] for _, line in lines] == ["booting", "compiled"]
+
+    def test_grep(self, temp_dir, capsys):
+        """Test a case-insensitive --grep pattern."""
+        self.setup_logs(temp_dir)
+        _, lines, _ = self.run_logs(temp_dir, capsys, "--grep", "REFUSED|timeout", "-i")
+        assert [name.strip() for name, _ in lines] == ["web", "api"]
+
+    def test_level(self, temp_dir, capsys):
+        """Test --level on its own and with -n keeping the last matches."""
+        self.setup_logs(temp_dir)
+        _, lines, _ = self.run_logs(temp_dir, capsys, "--level", "warn")
+        assert [line.split()[-1] for _, line in lines] == ["query", '"/api/orders"}', "timeout"]
+        _, lines, _ = self.run_logs(temp_dir, capsys, "--level", "info", "-n", "2")
+        assert [line.split()[-1] for _, line in lines] == ["refused", "restarting"]
+
+    def test_where(self, temp_dir, capsys):
+        """Test that several --where conditions on one service must all hold."""
+        self.setup_logs(temp_dir)
+        _, lines, _ = self.run_logs(temp_dir, capsys, "api", "--where", "status>=500", "--where", "path~orders")
+        assert len(lines) == 1 and '"status": 500' in lines[0][1]
+
+    def test_plain_tail_unchanged(self, temp_dir, capsys):
+        """Test that without filters each service's current file is tailed in turn."""
+        self.setup_logs(temp_dir)
+        _, lines, _ = self.run_logs(temp_dir, capsys, "-n", "1")
+        assert [(name.strip(), line.split()[-1]) for name, line in lines] == [("api", "restarting"), ("web", "timeout")]
+
+    def test_usage_errors(self, temp_dir, capsys):
+        """Test invalid times, regexes and conditions, and --until with --follow."""
+        self.setup_logs(temp_dir)
+        for args, message in [(["--since", "soon"], "expected a duration"), (["--grep", "("], "--grep: invalid regex"),
+                              (["--where", "status"], "--where status: expected FIELD=VALUE"),
+                              (["--until", "1h", "-F"], "--until cannot be combined with --follow")]:
+            code, _, out = self.run_logs(temp_dir, capsys, *args)
+            assert code == 2 and message in out
@@ -0,0 +1,225 @@
+"""
+Tests for external log sinks in OmniRun.
+
+This module tests:
+- Sink configuration and validation
+- file, syslog, journald, Loki and HTTP delivery
+- Batching, retries and overflow (backpressure) handling
+- Global and per-service sinks during `up`
+"""
+
+import sys
+import json
+import time
+import socket
+import pytest
+import threading
+from pathlib import Path
+
+from conftest import *
+
+
+def record(service="api", line="hello", stream="stdout", level="info"):
+    from omni_run import ServiceLogRecord
+    return ServiceLogRecord(service=service, stream=stream, line=line, level=level)
+
+
+class CaptureServer:
+    """A local HTTP server that records POST bodies, optionally failing every request."""
+
+    def __init__(self, status=204):
+        from http.server import BaseHTTPRequestHandler, HTTPServer
+        bodies, headers = self.bodies, self.headers = [], []
+
+        class Handler(BaseHTTPRequestHandler):
+            def do_POST(self):
+                bodies.append(self.rfile.read(int(self.headers["Content-Length"])).decode())
+                headers.append({k.lower(): v for k, v in self.headers.items()})
+                self.send_response(status)
+                self.end_headers()
+
+            def log_message(self, *args):
+                pass
+
+        self.server = HTTPServer(("127.0.0.1", 0), Handler)
+        self.url = f"http://127.0.0.1:{self.server.server_port}"
+        threading.Thread(target=self.server.serve_forever, daemon=True).start()
+
+    def close(self):
+        self.server.shutdown()
+        self.server.server_close()
+
+
+class TestSinkConfig:
+    """Tests for building sinks from configuration."""
+
+    def test_invalid_sinks(self, temp_dir):
+        """Test unknown types, missing options and bad overflow policies."""
+        from omni_run import create_log_sinks, ManifestError
+
+        with pytest.raises(ManifestError, match=r"logs.sinks\[0\].type: must be one of file, syslog"):
+            create_log_sinks("logs.sinks", [{"type": "kafka"}])
+        with pytest.raises(ManifestError, match=r"logs.sinks\[0\]: loki log sink needs a url"):
+            create_log_sinks("logs.sinks", [{"type": "loki"}])
+        with pytest.raises(ManifestError, match="overflow: must be drop or block"):
+            create_log_sinks("logs.sinks", [{"type": "http", "url": "http://x", "overflow": "spill"}])
+
+    def test_service_and_level_filters(self, temp_dir):
+        """Test that sinks only accept their services and levels (status lines always pass)."""
+        from omni_run import create_log_sinks
+
+        sink, = create_log_sinks("s", {"type": "file", "path": "all.log", "level": "warn"}, temp_dir, ["api"])
+        assert sink.accepts(record(level="error"))
+        assert not sink.accepts(record(level="info"))
+        assert sink.accepts(record(stream="omni"))
+        assert not sink.accepts(record(service="web", level="error"))
+        sink.close()
+
+
+class TestSinkDelivery:
+    """Tests for shipping records to each sink type."""
+
+    def test_file_sink_json(self, temp_dir):
+        """Test JSON-line output of the file sink."""
+        from omni_run import FileLogSink
+
+        sink = FileLogSink({"path": "out/all.jsonl", "format": "json", "flush_interval": "50ms"}, root=temp_dir)
+        sink.start()
+        sink.submit(record(line="\x1b[32mready\x1b[0m"))
+        sink.close()
+        entry = json.loads((temp_dir / "out" / "all.jsonl").read_text())
+        assert (entry["service"], entry["message"], entry["level"]) == ("api", "ready", "info")
+
+    def test_syslog_udp(self):
+        """Test RFC 3164 messages over UDP with facility and severity."""
+        from omni_run import SyslogLogSink
+
+        receiver = socket.socket(socket.AF_INET, socket.SOCK_DGRAM)
+        receiver.bind(("127.0.0.1", 0))
+        receiver.settimeout(5)
+        try:
+            sink = SyslogLogSink({"address": f"127.0.0.1:{receiver.getsockname()[1]}", "facility": "local0"})
+            sink.send([record(line="disk almost full", level="warn")])
+            message = receiver.recv(4096).decode()
+            sink.close()
+        finally:
+            receiver.close()
+        assert message.startswith("<132>")  # local0 (16) * 8 + warning (4)
+        assert message.endswith(" api: disk almost full")
+
+    @pytest.mark.skipif(sys.platform == "win32", reason="Uses Unix datagram sockets")
+    def test_journald_native_protocol(self, temp_dir):
+        """Test journal field encoding, including multi-line messages."""
+        from omni_run import JournaldLogSink
+
+        path = str(temp_dir / "journal.sock")
+        receiver = socket.socket(socket.AF_UNIX, socket.SOCK_DGRAM)
+        receiver.bind(path)
+        receiver.settimeout(5)
+        try:
+            sink = JournaldLogSink({"socket": path})
+            sink.send([record(line="boom", level="error"), record(line="line one\nline two")])
+            first, second = receiver.recv(4096), receiver.recv(4096)
+            sink.close()
+        finally:
+            receiver.close()
+        assert b"MESSAGE=boom\n" in first
+        assert b"PRIORITY=3\n" in first
+        assert b"SYSLOG_IDENTIFIER=api\n" in first
+        assert b"MESSAGE\n" + (17).to_bytes(8, "little") + b"line one\nline two\n" in second
+
+    def test_loki_push_batches(self):
+        """Test that Loki receives batched streams labelled by service and level."""
+        from omni_run import LokiLogSink
+
+        server = CaptureServer()
+        try:
+            sink = LokiLogSink({"url": server.url, "labels": {"env": "dev"}, "tenant": "team-a",
+                                "batch_size": 2, "flush_interval": "50ms"})
+            sink.start()
+            for i in range(5):
+                sink.submit(record(line=f"line {i}", level="error" if i == 4 else "info"))
+            sink.close()
+        finally:
+            server.close()
+
+        assert len(server.bodies) == 3
+        streams = [s for body in server.bodies for s in json.loads(body)["streams"]]
+        assert streams[0]["stream"] == {"env": "dev", "service": "api", "level": "info"}
+        assert [v[1] for s in streams for v in s["values"]] == [f"line {i}" for i in range(5)]
+        assert server.headers[0]["x-scope-orgid"] == "team-a"
+
+    def test_http_retries_then_drops(self):
+        """Test that a failing endpoint is retried, then the batch is dropped and reported."""
+        from omni_run import HttpLogSink
+
+        server = CaptureServer(status=500)
+        try:
+            sink = HttpLogSink({"url": server.url, "format": "ndjson", "retries": 2, "flush_interval": "50ms"})
+            sink.start()
+            sink.submit(record())
+            deadline = time.time() + 10
+            while not sink.failed_batches and time.time() < deadline:
+                time.sleep(0.05)
+            sink.close()
+        finally:
+            server.close()
+
+        assert len(server.bodies) == 3
+        assert json.loads(server.bodies[0].splitlines()[0])["message"] == "hello"
+        assert sink.summary() == f"log sink http: 1 record dropped, 1 failed batch (last error: HTTP 500 from {server.url})"
+
+    def test_overflow_drops_when_full(self):
+        """Test that a full buffer drops records instead of blocking the writer."""
+        from omni_run import LogSink
+
+        release = threading.Event()
+
+        class SlowSink(LogSink):
+            type = "slow"
+
+            def send(self, batch):
+                release.wait(5)
+
+        sink = SlowSink({"buffer": 2, "batch_size": 1, "flush_interval": "10ms"})
+        sink.start()
+        started = time.time()
+        for i in range(10):
+            sink.submit(record(line=str(i)))
+        assert time.time() - started < 1
+        assert sink.dropped >= 7
+        release.set()
+        sink.close()
+
+
+class TestPipelineSinks:
+    """Tests for sinks wired into service output."""
+
+    def test_manifest_sinks(self, temp_dir, omni_runner):
+        """Test global and per-service sinks declared in the manifest."""
+        from omni_run import load_manifest, Orchestrator, LogPipeline
+
+        (temp_dir / "omni-run.yaml").write_text(f"""
+logs:
+  sinks:
+    - {{type: file, path: all.log}}
+services:
+  api:
+    command: ["{sys.executable}", "-c", "print('from api')"]
+    logs:
+      sinks:
+        - {{type: file, path: api.jsonl, format: json}}
+  web:
+    command: ["{sys.executable}", "-c", "print('from web')"]
+""")
+        logs = LogPipeline(console=False)
+        assert Orchestrator(omni_runner, load_manifest(temp_dir / "omni-run.yaml"), logs=logs).up() == 0
+        logs.close()
+
+        everything = (temp_dir / "all.log").read_text()
+        assert "api [stdout] from api" in everything
+        assert "web [stdout] from web" in everything
+        assert "api [omni] starting:" in everything
+        api_only = [json.loads(line) for line in (temp_dir / "api.jsonl").read_text().splitlines()]
+        assert {entry["service"] for entry in api_only} == {"api"}
+        assert "from api" in [entry["message"] for entry in api_only]
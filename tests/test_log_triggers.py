@@ -0,0 +1,103 @@
+"""
+Tests for log-triggered actions in OmniRun.
+
+This module tests:
+- Parsing `log_triggers:` rules and their errors
+- A ready trigger holding a service in starting until its output matches, and gating dependents
+- Hook triggers running with the matched line, and restart triggers restarting once per process
+"""
+
+import sys
+import pytest
+from pathlib import Path
+
+from conftest import *
+
+
+class TestParseTriggers:
+    """Tests for reading `log_triggers:`."""
+
+    def test_parse(self, temp_dir):
+        """Test the single-rule and list forms, the hook action implied by a command, and streams."""
+        from omni_run import load_manifest
+
+        manifest = load_manifest(write_manifest(temp_dir, """
+services:
+  api:
+    command: ./api
+    log_triggers:
+      - {match: "Listening on :\\\\d+", action: ready}
+      - {match: OutOfMemoryError, action: restart, stream: stderr}
+      - {match: "slow query", command: ./alert.sh, timeout: 5s, cooldown: 1m}
+  worker:
+    command: ./worker
+    log_triggers: {match: started, action: ready}
+"""))
+        triggers = manifest.services["api"].log_triggers
+        assert [(t.action, t.stream) for t in triggers] == [("ready", None), ("restart", "stderr"), ("hook", None)]
+        assert triggers[0].pattern.search("Listening on :8080")
+        assert (triggers[2].hook.command, triggers[2].hook.timeout, triggers[2].cooldown) == ("./alert.sh", 5, 60)
+        assert triggers[0].describe() == "output matched /Listening on :\\d+/"
+        assert manifest.services["worker"].log_triggers[0].action == "ready"
+
+    def test_errors(self, temp_dir):
+        """Test missing patterns, unknown actions, commands on the wrong action, regexes, streams and health."""
+        from omni_run import load_manifest, ManifestError
+
+        for rule, message in [("{action: ready}", r"log_triggers\[0\]: expected a mapping with `match`"),
+                              ("{match: x, action: page}", r"log_triggers\[0\].action: must be one of ready, restart, hook"),
+                              ("{match: x}", r"log_triggers\[0\].action: must be one of"),
+                              ("{match: x, action: hook}", r"a hook trigger needs a command"),
+                              ("{match: x, action: restart, command: y}", r"command only applies to hook triggers, not restart"),
+                              ("{match: '(', action: ready}", r"log_triggers\[0\].match: invalid regex"),
+                              ("{match: x, action: ready, stream: both}", r"stream: must be stdout or stderr")]:
+            with pytest.raises(ManifestError, match=message):
+                load_manifest(write_manifest(temp_dir, f"services:\n  api:\n    command: x\n    log_triggers: [{rule}]\n"))
+        with pytest.raises(ManifestError, match="a ready trigger takes the place of a health probe"):
+            load_manifest(write_manifest(temp_dir, "services:\n  api:\n    command: x\n    health: {port: 80}\n"
+                                                   "    log_triggers: {match: up, action: ready}\n"))
+
+
+@pytest.mark.skipif(sys.platform == "win32", reason="POSIX shell commands")
+class TestTriggerActions:
+    """Tests for what matching lines set off during `up`."""
+
+    def test_ready_gates_dependents(self, temp_dir, omni_runner, capsys):
+        """Test that a dependent waits for the line a ready trigger matches."""
+        from omni_run import load_manifest, Orchestrator
+
+        manifest = load_manifest(write_manifest(temp_dir, f"""
+services:
+  db:
+    command: ["{sys.executable}", "-uc", "import time, pathlib; print('booting'); time.sleep(0.5); pathlib.Path('ready').touch(); print('Listening on 5432'); time.sleep(1)"]
+    log_triggers: {{match: "^Listening on", action: ready}}
+  app:
+    command: ["{sys.executable}", "-c", "import pathlib; print('db ready:', pathlib.Path('ready').exists())"]
+    depends_on: [db]
+"""))
+        orchestrator = Orchestrator(omni_runner, manifest)
+        assert orchestrator.up() == 0
+        out = capsys.readouterr().out
+        assert "db ready: True" in out
+        assert "ready: output matched /^Listening on/" in out
+
+    def test_hook_and_restart(self, temp_dir, omni_runner, capsys):
+        """Test a hook getting the matched line and a restart that happens once per process."""
+        from omni_run import load_manifest, Orchestrator
+
+        manifest = load_manifest(write_manifest(temp_dir, """
+services:
+  api:
+    command: >-
+      if [ -e restarted ]; then echo 'disk 91% full'; sleep 0.5;
+      else touch restarted; echo 'FATAL deadlock' >&2; echo 'FATAL again' >&2; sleep 30; fi
+    log_triggers:
+      - {match: FATAL, action: restart, stream: stderr}
+      - {match: 'disk \\d+% full', command: 'echo "$OMNI_RUN_LOG_STREAM $OMNI_RUN_LOG_LINE" > alert.txt'}
+"""))
+        orchestrator = Orchestrator(omni_runner, manifest)
+        assert orchestrator.up() == 0
+        out = capsys.readouterr().out
+        assert out.count("restarting: output matched /FATAL/") == 1
+        assert orchestrator.services["api"].restarts == 1
+        assert (temp_dir / "alert.txt").read_text() == "stdout disk 91% full\n"
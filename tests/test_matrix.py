@@ -0,0 +1,233 @@
+"""
+Tests for `omni-run matrix` in OmniRun.
+
+This module tests:
+- Parsing `matrix:` axes (runtimes, manifest fields, variables), exclusions and their errors
+- Combinations in axis order, --axis on the command line and --dry-run
+- Sidecars kept apart per combination, and runtime axes replacing pinned versions
+- Running a command against concurrent stacks and the aggregated result table
+"""
+
+import sys
+import shutil
+import pytest
+from pathlib import Path
+
+from conftest import *
+
+
+SERVER = """\
+import os
+from http.server import BaseHTTPRequestHandler, HTTPServer
+
+class Handler(BaseHTTPRequestHandler):
+    def do_GET(self):
+        body = (os.environ["MODE"] + " " + os.environ.get("FLAVOR", "")).encode()
+        self.send_response(200)
+        self.send_header("Content-Length", str(len(body)))
+        self.end_headers()
+        self.wfile.write(body)
+
+    def log_message(self, *args):
+        pass
+
+HTTPServer(("127.0.0.1", int(os.environ["PORT"])), Handler).serve_forever()
+"""
+
+# Fails for the mode the service was started in, unless the variable says otherwise
+CHECK = """\
+import os, sys, urllib.request
+body = urllib.request.urlopen(sys.argv[1], timeout=10).read().decode()
+print("got", body, "for", os.environ["OMNI_RUN_MATRIX"])
+sys.exit(1 if body.startswith("slow") and os.environ["FLAVOR"] == "strict" else 0)
+"""
+
+
+def run_matrix(temp_dir, *args):
+    from omni_run import run_subcommand
+    return run_subcommand(["matrix", "-C", str(temp_dir), *args])
+
+
+class TestMatrixSpec:
+    """Tests for parsing the `matrix:` block."""
+
+    def _matrix(self, temp_dir):
+        from omni_run import load_manifest
+
+        return load_manifest(write_manifest(temp_dir, """
+services:
+  api: {command: "true"}
+matrix:
+  command: go test ./...
+  axes:
+    sidecars.db.image: [postgres:14, postgres:15]
+    go: ["1.21", "1.22"]
+    FEATURES: beta
+  exclude:
+    - {sidecars.db.image: postgres:14, go: "1.22"}
+  concurrency: 2
+  timeout: 5m
+""")).matrix
+
+    def test_axes(self, temp_dir):
+        """Test that axes are manifest fields, runtimes or variables, and a single value is a list of one."""
+        assert [(a.name, a.kind, a.values) for a in self._matrix(temp_dir).axes] == [
+            ("sidecars.db.image", "field", ["postgres:14", "postgres:15"]),
+            ("go", "runtime", ["1.21", "1.22"]), ("FEATURES", "env", ["beta"])]
+
+    def test_combinations(self, temp_dir):
+        """Test the combinations left after exclusions, in axis order."""
+        assert [list(c.values()) for c in self._matrix(temp_dir).combinations()] == [
+            ["postgres:14", "1.21", "beta"], ["postgres:15", "1.21", "beta"], ["postgres:15", "1.22", "beta"]]
+
+    def test_settings(self, temp_dir):
+        """Test the command, its directory, concurrency and timeout, and no matrix without the block."""
+        from omni_run import load_manifest
+
+        matrix = self._matrix(temp_dir)
+        assert (matrix.command, matrix.path, matrix.concurrency, matrix.timeout) == (
+            "go test ./...", temp_dir.resolve(), 2, 300.0)
+        assert load_manifest(write_manifest(temp_dir, "services:\n  api: {command: 'true'}\n")).matrix is None
+
+    def test_invalid(self, temp_dir):
+        """Test bad axis names, empty axes and exclusions naming unknown axes."""
+        from omni_run import load_manifest, ManifestError
+
+        for block, message in [("{axes: {'my-var': [a]}}", "expected node, python, go, a manifest path"),
+                               ("{axes: {SIZE: []}}", "matrix.axes.SIZE: needs at least one value"),
+                               ("{axes: {'services..env': [a]}}", "matrix.axes.services..env: invalid path"),
+                               ("{axes: {SIZE: [a]}, exclude: [{COLOR: red}]}", "unknown axis 'COLOR'"),
+                               ("{axes: {SIZE: [a]}, timeout: soon}", "matrix.timeout")]:
+            write_manifest(temp_dir, f"services:\n  api: {{command: 'true'}}\nmatrix: {block}\n")
+            with pytest.raises(ManifestError, match=message):
+                load_manifest(temp_dir / "omni-run.yaml")
+
+    def test_command_line_axes(self, temp_dir, capsys):
+        """Test that --axis adds and replaces axes, and --dry-run lists the combinations."""
+        write_manifest(temp_dir, "services:\n  api: {command: 'true'}\n"
+                                 "matrix:\n  command: 'true'\n  axes:\n    SIZE: [s, m]\n")
+        assert run_matrix(temp_dir, "-n", "--axis", "SIZE=l", "--axis", "node=18,20") == 0
+        assert capsys.readouterr().out.split("\n")[:2] == ["  1  SIZE=l node=18", "  2  SIZE=l node=20"]
+
+        assert run_matrix(temp_dir, "-n", "--axis", "SIZE") == 1
+        assert "expected NAME=VALUE[,VALUE...]" in capsys.readouterr().out
+        write_manifest(temp_dir, "services:\n  api: {command: 'true'}\n")
+        assert run_matrix(temp_dir, "-n", "--", "true") == 1
+        assert "needs at least one axis" in capsys.readouterr().out
+
+
+class TestIsolation:
+    """Tests for what keeps the combinations' stacks apart."""
+
+    def test_sidecar_instances(self, temp_dir):
+        """Test container names and embedded data directories per instance."""
+        from omni_run import load_manifest, stack_id
+
+        write_manifest(temp_dir, "services:\n  api: {command: 'true'}\n"
+                                 "sidecars:\n  db: postgres:16\n  cache: {image: redis:7, mode: embedded}\n")
+        default = load_manifest(temp_dir / "omni-run.yaml").services
+        services = load_manifest(temp_dir / "omni-run.yaml", instance="matrix-2").services
+        project = stack_id(temp_dir)
+        assert f"omni-run-{project}-db" in default["db"].command
+        assert f"omni-run-{project}-db-matrix-2" in services["db"].command
+        assert services["db"].hooks["post_stop"][0].command == ["docker", "rm", "-f", f"omni-run-{project}-db-matrix-2"]
+        assert not any("matrix" in str(a) for a in default["cache"].command)
+
+        postgres = load_manifest(write_manifest(temp_dir, "services:\n  api: {command: 'true'}\n"
+                                                          "sidecars:\n  db: {kind: postgres, mode: embedded}\n"),
+                                 instance="matrix-2").services["db"]
+        assert str(temp_dir / ".omni-run" / "sidecars" / "db-matrix-2") in postgres.command
+
+    @pytest.mark.skipif(not shutil.which("node"), reason="Needs node on PATH")
+    def test_runtime_pin(self, temp_dir, omni_runner):
+        """Test that a runtime axis replaces the directory's pin for the runtime a service launches."""
+        from omni_run import load_manifest, Orchestrator, ToolchainPin, ToolchainError
+
+        (temp_dir / ".nvmrc").write_text("1\n")
+        manifest = load_manifest(write_manifest(temp_dir, "services:\n  web: {command: node server.js}\n"))
+        orchestrator = Orchestrator(omni_runner, manifest)
+        orchestrator.toolchains.enabled = True
+        with pytest.raises(ToolchainError, match=r"\.nvmrc: requires node 1,"):
+            orchestrator.toolchain_env(manifest.services["web"])
+
+        import copy
+        orchestrator.toolchains = copy.copy(omni_runner.toolchains)
+        orchestrator.toolchains.pins = {"node": ToolchainPin("node", "99", manifest.path)}
+        with pytest.raises(ToolchainError, match=r"omni-run\.yaml: requires node 99,"):
+            orchestrator.toolchain_env(manifest.services["web"])
+        assert omni_runner.toolchains.pins == {}
+
+
+@pytest.mark.skipif(sys.platform == "win32", reason="Uses POSIX process groups")
+class TestMatrixRun:
+    """Tests for running the command against each combination's stack."""
+
+    def _run(self, temp_dir, capsys):
+        from omni_run import ANSI_ESCAPE
+
+        (temp_dir / "server.py").write_text(SERVER)
+        (temp_dir / "check.py").write_text(CHECK)
+        write_manifest(temp_dir, f"""
+services:
+  api:
+    command: ["{sys.executable}", "server.py"]
+    ports: auto
+    health: {{type: tcp, port: http, interval: 100ms}}
+matrix:
+  command: ["{sys.executable}", "check.py", "http://127.0.0.1:${{service.api.port}}/"]
+  axes:
+    services.api.env.MODE: [fast, slow]
+    FLAVOR: [lax, strict]
+  exclude:
+    - {{services.api.env.MODE: fast, FLAVOR: lax}}
+  timeout: 30s
+""")
+        assert run_matrix(temp_dir, "--skip-install", "-j", "3") == 1
+        return ANSI_ESCAPE.sub("", capsys.readouterr().out)
+
+    def test_run(self, temp_dir, capsys):
+        """Test that the combinations run concurrently and the table gives each one's result."""
+        out = self._run(temp_dir, capsys)
+        assert "Running 3 combination(s), 3 at a time" in out
+        table = out[out.index("RESULT"):].split("\n")
+        assert table[1].split()[:4] == ["1", "fast", "strict", "passed"]
+        assert table[2].split()[:4] == ["2", "slow", "lax", "passed"]
+        assert table[3].split()[:4] == ["3", "slow", "strict", "failed"]
+        assert "2 passed, 1 failed in" in out
+
+    def test_command_sees_combination(self, temp_dir, capsys):
+        """Test that the service and the command see the combination's variables, shown for a failure."""
+        out = self._run(temp_dir, capsys)
+        assert "#3 services.api.env.MODE=slow FLAVOR=strict: exited with code 1" in out
+        assert "got slow strict for services.api.env.MODE=slow FLAVOR=strict" in out
+
+    def test_logs_per_combination(self, temp_dir, capsys):
+        """Test that the command's and the services' output is kept per combination."""
+        self._run(temp_dir, capsys)
+        log = temp_dir / ".omni-run" / "matrix" / "1" / "command.log"
+        assert "got fast strict" in log.read_text()
+        assert (temp_dir / ".omni-run" / "matrix" / "1" / "api.log").exists()
+
+    def test_stack_errors(self, temp_dir, capsys):
+        """Test a combination whose service fails to start, and a timeout waiting on health."""
+        from omni_run import ANSI_ESCAPE
+
+        write_manifest(temp_dir, f"""
+services:
+  api:
+    command: ["{sys.executable}", "-c", "import os, sys, time; print('bad mode') or sys.exit(3) if os.environ['MODE'] == 'broken' else time.sleep(30)"]
+    health: {{type: tcp, port: 1, interval: 100ms}}
+    restart: never
+matrix:
+  command: "true"
+  axes:
+    services.api.env.MODE: [broken, slow]
+  timeout: 2s
+""")
+        assert run_matrix(temp_dir, "--skip-install") == 1
+        out = ANSI_ESCAPE.sub("", capsys.readouterr().out)
+        table = out[out.index("RESULT"):].split("\n")
+        assert table[1].split()[:3] == ["1", "broken", "error"]
+        assert "#1 services.api.env.MODE=broken: api failed: exited with code 3\n  bad mode" in out
+        assert table[2].split()[:3] == ["2", "slow", "error"] and "timed out after 2s waiting for api" in table[2]
+        assert "2 error in" in out
@@ -0,0 +1,235 @@
+"""
+Tests for announcing services over mDNS in OmniRun.
+
+This module tests:
+- Per-service `mdns:` settings and the `mdns:` block
+- Encoding names and responses, and reading queries with compressed names
+- Answering queries for service types, instances and the host
+- Announcing ready services, reporting ones only reachable on localhost, and goodbyes when they stop
+"""
+
+import sys
+import time
+import socket
+import struct
+import pytest
+from pathlib import Path
+
+from conftest import *
+
+
+def query(*questions, ident=0) -> bytes:
+    """An mDNS query packet; the second and later names point back at the first one's `_tcp.local`."""
+    packet = struct.pack("!HHHHHH", ident, 0, len(questions), 0, 0, 0)
+    first_suffix = None
+    for name, qtype, unicast in questions:
+        labels = name.split(".")
+        if first_suffix is None:
+            first_suffix = len(packet) + sum(len(l) + 1 for l in labels[:-2])
+            encoded = b"".join(bytes([len(l)]) + l.encode() for l in labels) + b"\0"
+        else:
+            encoded = b"".join(bytes([len(l)]) + l.encode() for l in labels[:-2]) + struct.pack("!H", 0xC000 | first_suffix)
+        packet += encoded + struct.pack("!HH", qtype, 0x8001 if unicast else 1)
+    return packet
+
+
+def answer_names(packet: bytes):
+    """The (name, type, ttl) of each answer in a response packet."""
+    from omni_run import decode_dns_name
+
+    count, offset, answers = struct.unpack("!H", packet[6:8])[0], 12, []
+    for _ in range(count):
+        name, offset = decode_dns_name(packet, offset)
+        rtype, _, ttl, length = struct.unpack("!HHIH", packet[offset:offset + 10])
+        answers.append((name, rtype, ttl))
+        offset += 10 + length
+    return answers
+
+
+@pytest.fixture
+def announcing(temp_dir, omni_runner):
+    """A ready service that listens and one that doesn't; yields (orchestrator, announcer, answers sent)."""
+    from omni_run import load_manifest, Orchestrator, MdnsAnnouncer
+
+    write_manifest(temp_dir, f"""
+services:
+  web:
+    command: ["{sys.executable}", "-c", "import os, socket, time; s = socket.create_server(('127.0.0.1', int(os.environ['PORT']))); time.sleep(60)"]
+    ports: auto
+    health: {{type: tcp, port: http, interval: 100ms}}
+  worker:
+    command: ["{sys.executable}", "-c", "import time; time.sleep(60)"]
+    ports: auto
+""")
+    orchestrator = Orchestrator(omni_runner, load_manifest(temp_dir / "omni-run.yaml"))
+    announcer = MdnsAnnouncer(orchestrator, "127.0.0.1")
+    sent = []
+    announcer._send = lambda packet, destination=None: sent.append(answer_names(packet))
+    try:
+        for service in orchestrator.services.values():
+            orchestrator.start_service(service)
+        deadline = time.time() + 10
+        while time.time() < deadline and not all(s.is_ready() for s in orchestrator.services.values()):
+            time.sleep(0.05)
+        yield orchestrator, announcer, sent
+    finally:
+        orchestrator.shutdown()
+
+
+class TestMdnsSpec:
+    """Tests for reading the mDNS settings."""
+
+    def _announcer(self, temp_dir, omni_runner):
+        from omni_run import load_manifest, Orchestrator, MdnsAnnouncer
+
+        write_manifest(temp_dir, """
+mdns: {enabled: true, address: 192.168.1.20, name: '{service} on {host}'}
+services:
+  web: {command: ./web, ports: auto}
+  api: {command: ./api, ports: {http: auto, grpc: auto}, mdns: {type: _grpc._tcp, port: grpc, txt: {v: 2}}}
+  db: {command: ./db, ports: auto, mdns: false}
+""")
+        return MdnsAnnouncer.from_config(Orchestrator(omni_runner, load_manifest(temp_dir / "omni-run.yaml")))
+
+    def test_service_settings(self, temp_dir, omni_runner):
+        """Test the default, a service type with a port and TXT record, and opting out."""
+        services = self._announcer(temp_dir, omni_runner).orchestrator.manifest.services
+        assert services["web"].mdns is None and services["db"].mdns.enabled is False
+        api = services["api"].mdns
+        assert (api.type, api.port, api.txt) == ("_grpc._tcp", "grpc", {"v": "2"})
+
+    def test_block(self, temp_dir, omni_runner):
+        """Test the announcer's address and record lifetime."""
+        announcer = self._announcer(temp_dir, omni_runner)
+        assert (announcer.address, announcer.ttl) == ("192.168.1.20", 120)
+
+    def test_adverts(self, temp_dir, omni_runner):
+        """Test the instance names, types, ports and TXT records announced, and nothing for an opted-out service."""
+        announcer = self._announcer(temp_dir, omni_runner)
+        services = announcer.orchestrator.services
+        services["web"].ports, services["api"].ports, services["db"].ports = {"http": 8080}, {"http": 81, "grpc": 82}, {"db": 5432}
+        web, api = announcer.advert(services["web"]), announcer.advert(services["api"])
+        assert web.instance_name == f"web on {announcer.host[:-6]}._http._tcp.local" and web.txt == {"path": "/"}
+        assert (api.type_name, api.port, api.txt) == ("_grpc._tcp.local", 82, {"v": "2"})
+        assert announcer.advert(services["db"]) is None
+
+    def test_off_by_default(self, temp_dir, omni_runner):
+        """Test that there's no announcer without an enabled `mdns:` block."""
+        from omni_run import load_manifest, Orchestrator, MdnsAnnouncer
+
+        write_manifest(temp_dir, "services:\n  web: {command: ./web, ports: auto}\n")
+        assert MdnsAnnouncer.from_config(Orchestrator(omni_runner, load_manifest(temp_dir / "omni-run.yaml"))) is None
+
+    def test_invalid(self, temp_dir):
+        """Test a type that isn't a DNS-SD service type and an unknown port."""
+        from omni_run import load_manifest, ManifestError
+
+        for block, message in [("http", "services.web.mdns.type: expected a DNS-SD service type"),
+                               ("{port: grpc}", "services.web.mdns.port: unknown port 'grpc'")]:
+            write_manifest(temp_dir, f"services:\n  web: {{command: ./web, ports: auto, mdns: {block}}}\n")
+            with pytest.raises(ManifestError, match=message):
+                load_manifest(temp_dir / "omni-run.yaml")
+
+
+class TestMdnsPackets:
+    """Tests for the DNS wire format and answering queries."""
+
+    def test_questions(self):
+        """Test reading questions with compressed names and the unicast-response bit."""
+        from omni_run import mdns_questions, DNS_PTR, DNS_SRV
+
+        ident, questions = mdns_questions(query(("_http._tcp.local", DNS_PTR, False), ("web._tcp.local", DNS_SRV, True),
+                                                ident=7))
+        assert (ident, questions) == (7, [("_http._tcp.local", DNS_PTR, False), ("web._tcp.local", DNS_SRV, True)])
+
+    def test_no_questions_and_truncated(self):
+        """Test that a response has no questions and that a truncated packet is rejected."""
+        from omni_run import mdns_questions, mdns_response, DNS_PTR
+
+        assert mdns_questions(mdns_response([], 120)) == (0, [])
+        with pytest.raises(ValueError):
+            mdns_questions(query(("_http._tcp.local", DNS_PTR, False))[:20])
+
+    def _announcer(self, temp_dir, omni_runner):
+        from omni_run import load_manifest, Orchestrator, MdnsAnnouncer, MdnsAdvert
+
+        write_manifest(temp_dir, "services:\n  web: {command: ./web}\n")
+        announcer = MdnsAnnouncer(Orchestrator(omni_runner, load_manifest(temp_dir / "omni-run.yaml")), "10.0.0.5")
+        announcer.announced["web"] = MdnsAdvert("web", "web", "_http._tcp", 8080, {"path": "/"})
+        return announcer
+
+    def test_browse(self, temp_dir, omni_runner):
+        """Test that browsing a service type answers with every record for its instances."""
+        from omni_run import DNS_PTR, DNS_SRV, DNS_TXT, DNS_A
+
+        announcer = self._announcer(temp_dir, omni_runner)
+        browse = [(r.name, r.type) for r in announcer.answer([("_http._tcp.local", DNS_PTR, False)])]
+        assert browse == [("_http._tcp.local", DNS_PTR), ("web._http._tcp.local", DNS_SRV),
+                          ("web._http._tcp.local", DNS_TXT), (announcer.host, DNS_A)]
+
+    def test_other_questions(self, temp_dir, omni_runner):
+        """Test the host's address in any case, an unknown type and service type enumeration."""
+        from omni_run import DNS_PTR, DNS_A
+
+        announcer = self._announcer(temp_dir, omni_runner)
+        assert [r.type for r in announcer.answer([(announcer.host.lower(), DNS_A, False)])] == [DNS_A]
+        assert announcer.answer([("_ssh._tcp.local", DNS_PTR, False)]) == []
+        assert [r.type for r in announcer.answer([("_services._dns-sd._udp.local", DNS_PTR, False)])] == [DNS_PTR]
+
+    def test_response(self, temp_dir, omni_runner):
+        """Test the response's flags, record lifetimes, address and TXT record."""
+        from omni_run import mdns_response, DNS_SRV
+
+        announcer = self._announcer(temp_dir, omni_runner)
+        packet = mdns_response(announcer.records(announcer.announced["web"]), 120)
+        assert struct.unpack("!HH", packet[:4]) == (0, 0x8400)
+        assert answer_names(packet)[1] == ("web._http._tcp.local", DNS_SRV, 120)
+        assert socket.inet_aton("10.0.0.5") in packet and b"\x06path=/" in packet
+
+
+@pytest.mark.skipif(sys.platform == "win32", reason="Uses POSIX process groups")
+class TestMdnsAnnouncer:
+    """Tests for announcing and withdrawing running services."""
+
+    def test_announce(self, announcing):
+        """Test that a ready service that accepts connections is announced once."""
+        from omni_run import DNS_SRV
+
+        _, announcer, sent = announcing
+        now = time.time()
+        announcer.poll(now)
+        announcer.poll(now + 0.5)
+        assert list(announcer.announced) == ["web"] and len(sent) == 1
+        assert ("web._http._tcp.local", DNS_SRV, 120) in sent[0]
+
+    def test_announced_again(self, announcing):
+        """Test that the announcement is repeated after a while."""
+        _, announcer, sent = announcing
+        now = time.time()
+        for later in (0, 0.5, 6, 7):
+            announcer.poll(now + later)
+        assert len(sent) == 2 and sent[1] == sent[0]
+
+    def test_messages(self, announcing, capsys):
+        """Test the announcement message and that an unreachable service is reported once."""
+        from omni_run import ANSI_ESCAPE
+
+        _, announcer, _ = announcing
+        now = time.time()
+        for later in (0, 0.5, 6, 7):
+            announcer.poll(now + later)
+        out = ANSI_ESCAPE.sub("", capsys.readouterr().out)
+        assert "announced as web._http._tcp.local" in out
+        assert out.count("not announced over mDNS: nothing accepts connections on 127.0.0.1:") == 1
+
+    def test_goodbye(self, announcing):
+        """Test that a stopped service is withdrawn with records that expire at once."""
+        orchestrator, announcer, sent = announcing
+        now = time.time()
+        for later in (0, 0.5, 6, 7):
+            announcer.poll(now + later)
+        orchestrator.stop_service(orchestrator.services["web"])
+        announcer.poll(now + 8)
+        assert announcer.announced == {}
+        assert [(name, ttl) for name, _, ttl in sent[-1]] == [("_http._tcp.local", 0), ("web._http._tcp.local", 0),
+                                                              ("web._http._tcp.local", 0)]
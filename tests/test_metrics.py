@@ -0,0 +1,178 @@
+"""
+Tests for the Prometheus metrics endpoint in OmniRun.
+
+This module tests:
+- Bind address parsing and the `metrics:` config block
+- Text exposition of per-service state, restarts, exit codes and health latency
+- Process CPU/RSS sampling
+- Serving /metrics over HTTP
+"""
+
+import os
+import sys
+import time
+import urllib.error
+import urllib.request
+import pytest
+from pathlib import Path
+
+from conftest import *
+
+
+def make_orchestrator(omni_runner, temp_dir, manifest_text):
+    from omni_run import Orchestrator, load_manifest
+
+    (temp_dir / "omni-run.yaml").write_text(manifest_text)
+    return Orchestrator(omni_runner, load_manifest(temp_dir / "omni-run.yaml"))
+
+
+class TestMetricsConfig:
+    """Tests for metrics configuration."""
+
+    def test_parse_bind_address(self):
+        """Test host:port, :port and bare port forms."""
+        from omni_run import parse_bind_address
+
+        assert parse_bind_address("0.0.0.0:9000") == ("0.0.0.0", 9000)
+        assert parse_bind_address(":9000") == ("0.0.0.0", 9000)
+        assert parse_bind_address(9000) == ("127.0.0.1", 9000)
+        assert parse_bind_address("9000") == ("127.0.0.1", 9000)
+        assert parse_bind_address(None) == ("127.0.0.1", 9464)
+        with pytest.raises(ValueError):
+            parse_bind_address("localhost:http")
+
+    def test_disabled_by_default(self, omni_runner, temp_dir):
+        """Test that no server is created unless metrics are enabled."""
+        from omni_run import MetricsServer
+
+        orch = make_orchestrator(omni_runner, temp_dir, "services:\n  a:\n    command: 'true'\n")
+        assert MetricsServer.from_config(orch) is None
+
+    def test_manifest_block_enables(self, omni_runner, temp_dir):
+        """Test that the manifest metrics block overrides the launcher config."""
+        from omni_run import MetricsServer
+
+        orch = make_orchestrator(omni_runner, temp_dir, (
+            "metrics:\n  enabled: true\n  address: 127.0.0.1:0\n  path: /prom\n"
+            "services:\n  a:\n    command: 'true'\n"
+        ))
+        server = MetricsServer.from_config(orch)
+        assert (server.host, server.port, server.path) == ("127.0.0.1", 0, "/prom")
+
+    def test_invalid_address(self, omni_runner, temp_dir):
+        """Test that a malformed address is a manifest error."""
+        from omni_run import ManifestError, MetricsServer
+
+        orch = make_orchestrator(omni_runner, temp_dir, (
+            "metrics:\n  enabled: true\n  address: nowhere\n"
+            "services:\n  a:\n    command: 'true'\n"
+        ))
+        with pytest.raises(ManifestError, match="metrics.address"):
+            MetricsServer.from_config(orch)
+
+
+class TestMetricsRendering:
+    """Tests for the exposition format."""
+
+    def _render(self, omni_runner, temp_dir):
+        from omni_run import MetricsServer, ProbeResult, ServiceState
+
+        orch = make_orchestrator(omni_runner, temp_dir, (
+            "services:\n  api:\n    command: 'true'\n  worker:\n    command: 'true'\n"
+        ))
+        api = orch.services["api"]
+        api.state = ServiceState.FAILED
+        api.exit_code = 3
+        api.restarts = 2
+
+        class FakeMonitor:
+            last_result = ProbeResult(True, 0.25)
+
+        orch.services["worker"].health = FakeMonitor()
+        return MetricsServer(orch).render()
+
+    def test_restarts_and_exit_code(self, omni_runner, temp_dir):
+        """Test the restart counter and the last exit code."""
+        text = self._render(omni_runner, temp_dir)
+        assert "# TYPE omni_run_service_restarts_total counter" in text
+        assert 'omni_run_service_restarts_total{service="api"} 2' in text
+        assert 'omni_run_service_last_exit_code{service="api"} 3' in text
+
+    def test_state(self, omni_runner, temp_dir):
+        """Test one sample per state, set for the current one, and up for a service that isn't running."""
+        text = self._render(omni_runner, temp_dir)
+        assert 'omni_run_service_state{service="api",state="failed"} 1' in text
+        assert 'omni_run_service_state{service="api",state="running"} 0' in text
+        assert 'omni_run_service_up{service="worker"} 0' in text
+        assert text.count("# HELP omni_run_service_up ") == 1
+
+    def test_health_check(self, omni_runner, temp_dir):
+        """Test the latency and outcome of the last health check."""
+        text = self._render(omni_runner, temp_dir)
+        assert 'omni_run_health_check_latency_seconds{service="worker"} 0.25' in text
+        assert 'omni_run_health_check_success{service="worker"} 1' in text
+
+    @pytest.mark.skipif(sys.platform == "win32", reason="POSIX sleep command")
+    def test_running_service_usage(self, omni_runner, temp_dir):
+        """Test uptime, CPU and RSS for a running service."""
+        from omni_run import MetricsServer, read_process_usage
+
+        orch = make_orchestrator(omni_runner, temp_dir, "services:\n  sleeper:\n    command: sleep 5\n")
+        service = orch.services["sleeper"]
+        orch.start_service(service)
+        try:
+            usage = read_process_usage(service.process.pid)
+            assert usage is not None and usage[1] > 0
+            text = MetricsServer(orch).render()
+            assert 'omni_run_service_up{service="sleeper"} 1' in text
+            assert 'omni_run_service_uptime_seconds{service="sleeper"}' in text
+            assert 'omni_run_service_resident_memory_bytes{service="sleeper"}' in text
+        finally:
+            orch.stop_service(service, timeout=2)
+
+    def test_usage_of_missing_process(self):
+        """Test that vanished processes report no usage."""
+        from omni_run import read_process_usage
+
+        assert read_process_usage(2 ** 22 + 12345) is None
+
+
+class TestMetricsServer:
+    """Tests for serving metrics over HTTP."""
+
+    def test_serves_metrics_path(self, omni_runner, temp_dir):
+        """Test that /metrics responds and other paths 404."""
+        from omni_run import MetricsServer
+
+        orch = make_orchestrator(omni_runner, temp_dir, "services:\n  a:\n    command: 'true'\n")
+        server = MetricsServer(orch, port=0)
+        server.start()
+        try:
+            with urllib.request.urlopen(server.url, timeout=5) as response:
+                assert response.status == 200
+                assert "text/plain" in response.headers["Content-Type"]
+                assert "omni_run_uptime_seconds" in response.read().decode()
+            with pytest.raises(urllib.error.HTTPError):
+                urllib.request.urlopen(f"http://127.0.0.1:{server.port}/other", timeout=5)
+        finally:
+            server.stop()
+
+    def test_port_in_use(self, omni_runner, temp_dir):
+        """Test that a metrics port that can't be bound fails `up` without leaving a supervisor pidfile."""
+        import socket
+        from omni_run import Orchestrator, ManifestError, SUPERVISOR_PIDFILE, load_manifest
+
+        busy = socket.socket()
+        busy.bind(("127.0.0.1", 0))
+        busy.listen(1)
+        try:
+            (temp_dir / "omni-run.yaml").write_text(
+                f"metrics:\n  enabled: true\n  address: 127.0.0.1:{busy.getsockname()[1]}\n"
+                "services:\n  a:\n    command: 'true'\n")
+            state_dir = temp_dir / ".omni-run"
+            orch = Orchestrator(omni_runner, load_manifest(temp_dir / "omni-run.yaml"), state_dir=state_dir)
+            with pytest.raises(ManifestError, match="metrics.address: cannot listen on 127.0.0.1:"):
+                orch.up()
+            assert not (state_dir / SUPERVISOR_PIDFILE).exists()
+        finally:
+            busy.close()
@@ -0,0 +1,186 @@
+"""
+Tests for OpenAPI mock services (`type: mock`) in OmniRun.
+
+This module tests:
+- Matching requests to operations, with server base paths and literal paths before templated ones
+- Response bodies from examples, named examples, schemas and $refs, Prefer headers, and Swagger 2
+- `type: mock` services in the manifest, and a frontend calling a mock in a running stack
+"""
+
+import sys
+import json
+import pytest
+from pathlib import Path
+
+from conftest import *
+
+
+PETSTORE = """
+openapi: 3.0.3
+info: {title: Petstore, version: 1.2.0}
+servers: [{url: 'https://api.example.com/v1'}]
+paths:
+  /pets:
+    get:
+      operationId: listPets
+      responses:
+        '200':
+          content:
+            application/json:
+              schema: {type: array, items: {$ref: '#/components/schemas/Pet'}}
+    post:
+      responses:
+        '201':
+          content:
+            application/json:
+              examples:
+                cat: {value: {id: 1, name: Tom}}
+                dog: {$ref: '#/components/examples/Dog'}
+  /pets/{petId}:
+    get:
+      operationId: getPet
+      responses:
+        200:
+          content:
+            application/json: {schema: {$ref: '#/components/schemas/Pet'}}
+        '404':
+          content:
+            application/problem+json: {example: {title: not found}}
+    delete:
+      responses: {'204': {description: deleted}}
+  /pets/mine:
+    get:
+      responses: {'200': {content: {text/plain: {example: all of them}}}}
+components:
+  schemas:
+    Pet:
+      type: object
+      properties:
+        id: {type: integer, minimum: 1}
+        name: {type: string, example: Rex}
+        born: {type: string, format: date}
+        kind: {type: string, enum: [dog, cat]}
+        owner: {allOf: [{properties: {email: {type: string, format: email}}}, {properties: {vip: {type: boolean}}}]}
+        tags: {type: [array, 'null'], items: {type: string}}
+  examples:
+    Dog: {value: {id: 2, name: Rex}}
+"""
+
+
+class TestOpenApiMock:
+    """Tests for answering requests from an OpenAPI document."""
+
+    def test_match(self, temp_dir):
+        """Test paths with and without the server's base path, literal paths first, and other methods."""
+        from omni_run import OpenApiMock
+
+        (temp_dir / "openapi.yaml").write_text(PETSTORE)
+        mock = OpenApiMock.load(temp_dir / "openapi.yaml")
+        assert mock.match("GET", "/v1/pets/7")[0].name == "getPet"
+        assert mock.match("GET", "/pets/7?fields=name")[0].name == "getPet"
+        assert mock.match("GET", "/pets/mine/")[0].template == "/pets/mine"
+        assert mock.match("PUT", "/pets/7") == (None, ["GET", "DELETE"])
+        assert mock.match("GET", "/owners") == (None, [])
+
+    def test_responses(self, temp_dir):
+        """Test bodies built from schemas, examples picked with Prefer, other statuses and empty responses."""
+        from omni_run import OpenApiMock
+
+        (temp_dir / "openapi.yaml").write_text(PETSTORE)
+        mock = OpenApiMock.load(temp_dir / "openapi.yaml")
+        pet = {"id": 1, "name": "Rex", "born": "2024-01-01", "kind": "dog",
+               "owner": {"email": "user@example.com", "vip": True}, "tags": ["string"]}
+        status, content_type, body = mock.respond(mock.match("GET", "/pets")[0])
+        assert (status, content_type, json.loads(body)) == (200, "application/json", [pet])
+
+        create = mock.match("POST", "/pets")[0]
+        assert (mock.respond(create)[0], json.loads(mock.respond(create)[2])) == (201, {"id": 1, "name": "Tom"})
+        assert json.loads(mock.respond(create, "example=dog")[2]) == {"id": 2, "name": "Rex"}
+
+        get = mock.match("GET", "/pets/1")[0]
+        assert mock.respond(get, "code=404") == (404, "application/problem+json", b'{\n  "title": "not found"\n}')
+        assert mock.respond(get, "code=500")[0] == 200
+        assert mock.respond(mock.match("DELETE", "/pets/1")[0]) == (204, None, None)
+        assert mock.respond(mock.match("GET", "/pets/mine")[0]) == (200, "text/plain", b"all of them")
+
+    def test_swagger2_and_bad_documents(self, temp_dir):
+        """Test Swagger 2 examples and definitions, and files that aren't OpenAPI documents."""
+        from omni_run import OpenApiMock, ManifestError
+
+        mock = OpenApiMock({"swagger": "2.0", "basePath": "/api", "definitions": {"User": {
+            "type": "object", "properties": {"id": {"type": "string", "format": "uuid"}}}}, "paths": {
+            "/users": {"get": {"responses": {"200": {"schema": {"$ref": "#/definitions/User"}}}}},
+            "/health": {"get": {"produces": ["text/plain"], "responses": {"200": {"examples": {"text/plain": "ok"}}}}}}})
+        assert json.loads(mock.respond(mock.match("GET", "/api/users")[0])[2]) == {
+            "id": "00000000-0000-4000-8000-000000000000"}
+        assert mock.respond(mock.match("GET", "/health")[0]) == (200, "text/plain", b"ok")
+
+        for content, message in [("paths: {}\n", "not an OpenAPI document"), ("openapi: 3.0.0\n", "declares no paths"),
+                                 ("openapi: [\n", "invalid YAML or JSON")]:
+            (temp_dir / "spec.yaml").write_text(content)
+            with pytest.raises(ManifestError, match=message):
+                OpenApiMock.load(temp_dir / "spec.yaml")
+
+
+class TestMockService:
+    """Tests for `type: mock` services."""
+
+    def test_manifest(self, temp_dir):
+        """Test the generated command and port, and the keys a mock service needs or refuses."""
+        from omni_run import load_manifest, self_command, ManifestError
+
+        (temp_dir / "specs").mkdir()
+        (temp_dir / "specs" / "pets.yaml").write_text(PETSTORE)
+        write_manifest(temp_dir, "services:\n  pets: {type: mock, openapi: specs/pets.yaml}\n")
+        spec = load_manifest(temp_dir / "omni-run.yaml").services["pets"]
+        assert spec.command == self_command() + ["mock", str((temp_dir / "specs" / "pets.yaml").resolve())]
+        assert list(spec.ports) == ["http"] and spec.install is False
+
+        for block, message in [("{type: mock}", "a mock service needs `openapi:`"),
+                               ("{type: mock, openapi: nope.yaml}", "services.pets.openapi: .*nope.yaml not found"),
+                               ("{type: mock, openapi: specs/pets.yaml, command: serve}",
+                                "services.pets.command: a mock service is served from its OpenAPI document"),
+                               ("{command: serve, openapi: specs/pets.yaml}", "only applies to `type: mock` services")]:
+            write_manifest(temp_dir, f"services:\n  pets: {block}\n")
+            with pytest.raises(ManifestError, match=message):
+                load_manifest(temp_dir / "omni-run.yaml")
+
+    def _up(self, temp_dir, omni_runner, capsys):
+        from omni_run import load_manifest, Orchestrator, ANSI_ESCAPE
+
+        (temp_dir / "openapi.yaml").write_text(PETSTORE)
+        (temp_dir / "web.py").write_text("""
+import json, os, sys, time, urllib.request
+url = sys.argv[1] + "/v1/pets/3"
+for _ in range(100):
+    try:
+        request = urllib.request.Request(url, headers={"Origin": "http://localhost:3000"})
+        with urllib.request.urlopen(request) as response:
+            print("web got", json.load(response)["name"], response.headers["Access-Control-Allow-Origin"])
+            break
+    except OSError:
+        time.sleep(0.1)
+""")
+        write_manifest(temp_dir, f"""
+services:
+  pets: {{type: mock, openapi: openapi.yaml}}
+  web:
+    command: ["{sys.executable}", web.py, "http://127.0.0.1:${{service.pets.port}}"]
+    depends_on: {{pets: port_open}}
+""")
+        orchestrator = Orchestrator(omni_runner, load_manifest(temp_dir / "omni-run.yaml"))
+        assert orchestrator.up(abort_on_exit=True) == 0
+        return ANSI_ESCAPE.sub("", capsys.readouterr().out)
+
+    def test_mock_announced(self, temp_dir, omni_runner, capsys):
+        """Test the line saying what the mock serves and where."""
+        out = self._up(temp_dir, omni_runner, capsys)
+        assert "pets | Mocking Petstore 1.2.0 (5 operations from openapi.yaml) on http://127.0.0.1:" in out
+
+    def test_frontend_calls_mock(self, temp_dir, omni_runner, capsys):
+        """Test a service fetching from a mock in the same stack, with CORS headers."""
+        assert "web  | web got Rex http://localhost:3000" in self._up(temp_dir, omni_runner, capsys)
+
+    def test_request_log(self, temp_dir, omni_runner, capsys):
+        """Test that the mock logs each request with its status and operation."""
+        assert "pets | GET /v1/pets/3 200 (getPet)" in self._up(temp_dir, omni_runner, capsys)
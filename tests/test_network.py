@@ -0,0 +1,219 @@
+"""
+Tests for per-stack network namespaces in OmniRun.
+
+This module tests:
+- Stable virtual IPs for a stack's services, and the embedded DNS server's answers
+- The `network:` settings and what can't be combined with them
+- Running a stack in its own namespace: declared ports, names, templates and published host ports
+- Relaying services outside the namespace in at their addresses and on its loopback
+"""
+
+import os
+import sys
+import shutil
+import socket
+import struct
+import subprocess
+import threading
+import urllib.request
+import pytest
+from pathlib import Path
+
+from conftest import *
+
+
+def network_namespaces_available() -> bool:
+    if not sys.platform.startswith("linux") or not all(shutil.which(t) for t in ("unshare", "nsenter", "ip")):
+        return False
+    flags = [] if os.geteuid() == 0 else ["--user", "--map-root-user"]
+    result = subprocess.run(["unshare", "--net", "--mount", "--fork", *flags, "ip", "link", "set", "lo", "up"],
+                            capture_output=True)
+    return result.returncode == 0
+
+
+def query(name: str, qtype: int = 1) -> bytes:
+    labels = b"".join(bytes([len(part)]) + part.encode() for part in name.split("."))
+    return struct.pack("!HHHHHH", 0x1234, 0x0100, 1, 0, 0, 0) + labels + b"\x00" + struct.pack("!HH", qtype, 1)
+
+
+class TestAddressesAndDns:
+    """Tests for virtual IPs and DNS answers."""
+
+    def test_stack_addresses(self):
+        """Test addresses that stay put, skip the DNS address, and a subnet that's too small."""
+        from omni_run import stack_addresses
+
+        addresses = stack_addresses(["web", "api", "db"], "10.89.0.0/24")
+        assert addresses == stack_addresses(["db", "api", "web"], "10.89.0.0/24")
+        assert len(set(addresses.values())) == 3
+        assert all(a.startswith("10.89.0.") and a not in ("10.89.0.0", "10.89.0.1", "10.89.0.255")
+                   for a in addresses.values())
+        assert stack_addresses(["api"], "10.89.0.0/24")["api"] == addresses["api"]
+        small = stack_addresses(["a", "b", "c", "d", "e"], "10.1.2.0/29")  # Every address is taken
+        assert sorted(small.values()) == [f"10.1.2.{i}" for i in range(2, 7)]
+
+        with pytest.raises(ValueError, match="has room for 1 service address"):
+            stack_addresses(["a", "b"], "10.1.2.0/30")
+        with pytest.raises(ValueError, match="not an IPv4 subnet"):
+            stack_addresses(["a"], "fd00::/64")
+
+    def test_dns_response(self):
+        """Test an A record, case-insensitive names, an empty AAAA answer, NXDOMAIN and junk."""
+        from omni_run import dns_response
+
+        records = {"api": "10.89.0.7", "api.omni": "10.89.0.7"}
+        response = dns_response(query("API.omni"), records)
+        ident, flags, questions, answers = struct.unpack("!HHHH", response[:8])
+        assert (ident, flags & 0x8000, flags & 0x000F, questions, answers) == (0x1234, 0x8000, 0, 1, 1)
+        assert flags & 0x0100  # Recursion desired is echoed
+        assert response[-4:] == socket.inet_aton("10.89.0.7")
+
+        _, flags, _, answers = struct.unpack("!HHHH", dns_response(query("api", qtype=28), records)[:8])
+        assert (flags & 0x000F, answers) == (0, 0)
+        response = dns_response(query("example.com"), records)
+        assert struct.unpack("!HH", response[:4])[1] & 0x000F == 3
+        assert dns_response(b"\x00\x01", records) is None
+        assert dns_response(response, records) is None  # A response, not a query
+
+
+class TestNetworkSettings:
+    """Tests for the `network:` block."""
+
+    def test_settings(self, temp_dir, omni_runner):
+        """Test members, addresses for services and sidecars, the DNS address and the domain."""
+        from omni_run import load_manifest, Orchestrator, StackNetwork
+
+        manifest = load_manifest(write_manifest(temp_dir, """
+network: {namespace: true, subnet: 10.50.0.0/24, domain: Dev.Local}
+services:
+  api: {command: 'true'}
+sidecars:
+  db: postgres:16
+"""))
+        network = StackNetwork.from_config(Orchestrator(omni_runner, manifest))
+        assert network.members == {"api"} and set(network.addresses) == {"api", "db"}
+        assert network.gateway == "10.50.0.1" and network.domain == "dev.local"
+
+    def test_off(self, temp_dir, omni_runner):
+        """Test that no network is set up when the block is false, off or missing."""
+        from omni_run import load_manifest, Orchestrator, StackNetwork
+
+        for block in ("network: false\n", "network: {namespace: false}\n", ""):
+            manifest = load_manifest(write_manifest(temp_dir, block + "services:\n  api: {command: 'true'}\n"))
+            assert StackNetwork.from_config(Orchestrator(omni_runner, manifest)) is None
+
+    def test_invalid(self, temp_dir, omni_runner):
+        """Test a bad subnet or domain, and port and isolation settings that need the host's network."""
+        from omni_run import load_manifest, Orchestrator, StackNetwork, ManifestError
+
+        for block, message in [
+                ("network: {namespace: true, subnet: nope}\nservices:\n  api: {command: x}\n", "network.subnet: "),
+                ("network: {namespace: true, domain: 'a b'}\nservices:\n  api: {command: x}\n", "not a DNS domain"),
+                ("network: true\nservices:\n  api: {command: x, isolate: net, ports: {http: {port: auto, socket: true}}}\n",
+                 "services.api.isolate: net can't be combined with network.namespace"),
+                ("network: true\nservices:\n  api: {command: x, ports: {http: {port: auto, socket: true}}}\n",
+                 "services.api.ports.http: socket: true can't be combined")]:
+            manifest = load_manifest(write_manifest(temp_dir, block))
+            with pytest.raises(ManifestError, match=message):
+                StackNetwork.from_config(Orchestrator(omni_runner, manifest))
+
+
+@pytest.fixture
+def namespaced_up(temp_dir, omni_runner, capsys):
+    """A finished `up` in a namespace while api's port is taken on the host; yields the run, its output, and ports."""
+    from omni_run import load_manifest, Orchestrator
+
+    busy = socket.socket()
+    busy.bind(("127.0.0.1", 0))
+    busy.listen(1)
+    port = busy.getsockname()[1]
+    (temp_dir / "client.py").write_text(f"""
+import os, socket, urllib.request
+print("resolved", socket.gethostbyname("api"), socket.gethostbyname("api.omni"))
+print("fetched", urllib.request.urlopen("http://api:{port}/").status, "via", os.environ["API"])
+""")
+    manifest = load_manifest(write_manifest(temp_dir, f"""
+network: true
+services:
+  api:
+    command: ["{sys.executable}", "-m", "http.server", "{port}", "--bind", "0.0.0.0"]
+    ports: {{http: {port}}}
+    health: {{type: tcp, port: http, interval: 100ms}}
+  client:
+    command: ["{sys.executable}", client.py]
+    env: {{API: "${{service.api.host}}:${{service.api.port}}"}}
+    depends_on: {{api: service_healthy}}
+"""))
+    orchestrator = Orchestrator(omni_runner, manifest)
+    host = {}
+
+    def fetch_and_stop():
+        published = orchestrator.host_ports(orchestrator.services["api"])["http"]
+        host["port"] = published
+        host["status"] = urllib.request.urlopen(f"http://127.0.0.1:{published}/", timeout=5).status
+        orchestrator.request_shutdown()
+
+    timer = threading.Timer(3, fetch_and_stop)
+    timer.start()
+    try:
+        orchestrator.up()
+    finally:
+        timer.cancel()
+        busy.close()
+    yield orchestrator, capsys.readouterr().out, port, host
+
+
+@pytest.mark.skipif(not network_namespaces_available(), reason="Needs unshare, nsenter and ip with network namespaces")
+class TestStackNetwork:
+    """Tests for running a stack in its own network namespace."""
+
+    def test_addresses_listed(self, namespaced_up):
+        """Test that the namespace and each service's address are printed, and the namespace is gone afterwards."""
+        orchestrator, out, _, _ = namespaced_up
+        assert "Network namespace: " in out and all(name in out for name in ("api 10.89.0.", "client 10.89.0."))
+        assert orchestrator.network is None
+
+    def test_found_by_name(self, namespaced_up):
+        """Test that services resolve each other by name, with and without the domain, and through templates."""
+        _, out, port, _ = namespaced_up
+        address = out.split("resolved ")[1].split()[0]
+        assert f"resolved {address} {address}" in out
+        assert f"fetched 200 via {address}:{port}" in out
+
+    def test_declared_port_published(self, namespaced_up):
+        """Test that a service keeps its declared port while the host's is taken, and is published elsewhere."""
+        orchestrator, out, port, host = namespaced_up
+        assert orchestrator.services["api"].ports == {"http": port}
+        assert host["port"] != port and host["status"] == 200
+        assert f"ports: http={port} (host {host['port']})" in out
+
+    def test_relays_into_namespace(self, temp_dir):
+        """Test that a service outside is reached at its address and on the namespace's loopback."""
+        from omni_run import StackNetwork, PortAllocator
+
+        server = socket.socket()
+        server.bind(("127.0.0.1", 0))
+        server.listen(4)
+        port = server.getsockname()[1]
+
+        def answer():
+            for _ in range(2):
+                conn, _ = server.accept()
+                conn.sendall(b"hello from the host\n")
+                conn.close()
+
+        threading.Thread(target=answer, daemon=True).start()
+        network = StackNetwork({"app": "10.89.0.5", "db": "10.89.0.9"}, "10.89.0.1", "omni", {"app"})
+        network.start()
+        try:
+            assert network.attach("db", {"db": port}, PortAllocator()) == []
+            check = ("import socket, sys\n"
+                     "for host in sys.argv[1:]:\n"
+                     "    print(host, socket.create_connection((host, %d), timeout=5).recv(100).decode().strip())" % port)
+            result = subprocess.run(network.wrap([sys.executable, "-c", check, "db", "127.0.0.1"], temp_dir),
+                                    capture_output=True, text=True, timeout=30)
+            assert result.stdout.splitlines() == ["db hello from the host", "127.0.0.1 hello from the host"], result.stderr
+        finally:
+            network.stop()
+            server.close()
+        assert network.pid is None
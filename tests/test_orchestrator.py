@@ -0,0 +1,1167 @@
+"""
+Tests for multi-service orchestration in OmniRun.
+
+This module tests:
+- Manifest loading and normalization
+- Dependency ordering and cycle detection
+- Service lifecycle and coordinated shutdown
+- Health probes and readiness gating
+- depends_on conditions and startup timeouts
+- Port allocation and injection
+- Graceful shutdown and signal escalation
+- Windows process trees (Ctrl+Break, Job Objects, PATHEXT)
+- Restart policies, backoff and crash-loop detection
+- Runtime start/stop/restart requests
+- Lifecycle hooks
+- Log capture, filtering and per-service log files
+"""
+
+import re
+import sys
+import time
+import pytest
+from pathlib import Path
+
+from conftest import *
+
+
+def wait_for(predicate, timeout: float = 5):
+    deadline = time.time() + timeout
+    while not predicate() and time.time() < deadline:
+        time.sleep(0.05)
+    assert predicate()
+
+
+class TestManifestLoading:
+    """Tests for parsing omni-run.yaml."""
+
+    def test_load_services(self, temp_dir):
+        """Test that services, env and dependencies are normalized."""
+        from omni_run import load_manifest
+
+        (temp_dir / "api").mkdir()
+        manifest = load_manifest(write_manifest(temp_dir, """
+version: 1
+services:
+  api:
+    path: api
+    command: go run .
+    env:
+      DEBUG: true
+    depends_on: db
+  db:
+    command: ["postgres", "-D", "data"]
+"""))
+
+        api = manifest.services["api"]
+        assert api.path == (temp_dir / "api").resolve()
+        assert api.env == {"DEBUG": "True"}
+        assert api.depends_on == ["db"]
+        assert manifest.services["db"].argv() == ["postgres", "-D", "data"]
+
+    def test_string_command_runs_through_shell(self, temp_dir):
+        """Test that string commands are wrapped in a shell."""
+        from omni_run import load_manifest
+
+        manifest = load_manifest(write_manifest(temp_dir, "services:\n  web:\n    command: npm start && echo done\n"))
+
+        assert manifest.services["web"].argv()[-1] == "npm start && echo done"
+
+    def test_find_manifest(self, temp_dir):
+        """Test manifest discovery in a project directory."""
+        from omni_run import find_manifest
+
+        assert find_manifest(temp_dir) is None
+        path = write_manifest(temp_dir, "services: {}\n")
+        assert find_manifest(temp_dir) == path
+
+    def test_invalid_yaml_raises(self, temp_dir):
+        """Test that malformed manifests raise ManifestError."""
+        from omni_run import load_manifest, ManifestError
+
+        with pytest.raises(ManifestError):
+            load_manifest(write_manifest(temp_dir, "services: [unclosed\n"))
+
+
+class TestStartOrder:
+    """Tests for dependency ordering."""
+
+    def _services(self, deps):
+        from omni_run import ServiceSpec
+        return {name: ServiceSpec(name=name, path=Path("."), command="true", depends_on=d) for name, d in deps.items()}
+
+    def test_dependencies_start_first(self):
+        """Test that dependencies come before dependents."""
+        from omni_run import resolve_start_order
+
+        order = resolve_start_order(self._services({"web": ["api"], "api": ["db"], "db": []}))
+
+        assert order == ["db", "api", "web"]
+
+    def test_selected_service_pulls_dependencies(self):
+        """Test that selecting a service includes what it depends on."""
+        from omni_run import resolve_start_order
+
+        services = self._services({"web": ["api"], "api": [], "worker": []})
+
+        assert resolve_start_order(services, ["web"]) == ["api", "web"]
+
+    def test_cycle_detection(self):
+        """Test that dependency cycles are reported."""
+        from omni_run import resolve_start_order, ManifestError
+
+        with pytest.raises(ManifestError, match="a -> b -> a"):
+            resolve_start_order(self._services({"a": ["b"], "b": ["a"]}))
+
+    def test_unknown_dependency(self):
+        """Test that references to undeclared services are reported."""
+        from omni_run import resolve_start_order, ManifestError
+
+        with pytest.raises(ManifestError, match="unknown service 'cache'"):
+            resolve_start_order(self._services({"api": ["cache"]}))
+
+
+class TestOrchestratorLifecycle:
+    """Tests for running services under the orchestrator."""
+
+    def test_up_runs_services_and_reports_failure(self, temp_dir, omni_runner, capsys):
+        """Test that output is prefixed and a failing service fails the run."""
+        from omni_run import load_manifest, Orchestrator, ServiceState
+
+        manifest = load_manifest(write_manifest(temp_dir, f"""
+services:
+  ok:
+    command: ["{sys.executable}", "-c", "print('hello from ok')"]
+  bad:
+    command: ["{sys.executable}", "-c", "import sys; sys.exit(3)"]
+    depends_on: [ok]
+"""))
+        orchestrator = Orchestrator(omni_runner, manifest)
+
+        code = orchestrator.up()
+        out = capsys.readouterr().out
+
+        assert code == 1
+        assert re.search(r"ok\s+\|\S* hello from ok", out)
+        assert orchestrator.services["ok"].state == ServiceState.EXITED
+        assert orchestrator.services["bad"].exit_code == 3
+
+    def test_service_env_is_injected(self, temp_dir, omni_runner, capsys):
+        """Test that manifest env reaches the child process."""
+        from omni_run import load_manifest, Orchestrator
+
+        manifest = load_manifest(write_manifest(temp_dir, f"""
+services:
+  env:
+    command: ["{sys.executable}", "-c", "import os; print(os.environ['GREETING'])"]
+    env:
+      GREETING: hi-there
+"""))
+
+        assert Orchestrator(omni_runner, manifest).up() == 0
+        assert "hi-there" in capsys.readouterr().out
+
+    def test_shutdown_stops_running_services(self, temp_dir, omni_runner):
+        """Test that shutdown terminates long-running services."""
+        from omni_run import load_manifest, Orchestrator, ServiceState
+
+        manifest = load_manifest(write_manifest(temp_dir, f"""
+services:
+  sleeper:
+    command: ["{sys.executable}", "-c", "import time; time.sleep(60)"]
+"""))
+        orchestrator = Orchestrator(omni_runner, manifest)
+        service = orchestrator.services["sleeper"]
+
+        orchestrator.start_service(service)
+        assert service.is_alive()
+        orchestrator.shutdown(["sleeper"])
+
+        assert not service.is_alive()
+        assert service.state == ServiceState.STOPPED
+
+
+class TestHealthProbes:
+    """Tests for service health checks and readiness gating."""
+
+    def test_parse_duration(self):
+        """Test duration strings and numbers."""
+        from omni_run import parse_duration
+
+        assert parse_duration("500ms") == pytest.approx(0.5)
+        assert parse_duration("2s") == 2
+        assert parse_duration("1m") == 60
+        assert parse_duration(3) == 3
+        assert parse_duration(None, 1.5) == 1.5
+        with pytest.raises(ValueError):
+            parse_duration("soon")
+
+    def test_probe_from_config(self):
+        """Test probe type inference and URL construction."""
+        from omni_run import ProbeSpec
+
+        http = ProbeSpec.from_config("api", {"port": 8080, "path": "/ready", "type": "http", "interval": "250ms"})
+        assert http.url == "http://127.0.0.1:8080/ready"
+        assert http.interval == pytest.approx(0.25)
+        assert ProbeSpec.from_config("db", {"port": 5432}).type == "tcp"
+        assert ProbeSpec.from_config("job", {"command": "true"}).type == "exec"
+        assert ProbeSpec.from_config("web", "http://localhost:3000/").type == "http"
+
+    def test_invalid_probe_raises(self, temp_dir):
+        """Test that incomplete health blocks are rejected at load time."""
+        from omni_run import load_manifest, ManifestError
+
+        with pytest.raises(ManifestError, match="services.api.health: tcp probe needs port"):
+            load_manifest(write_manifest(temp_dir, "services:\n  api:\n    command: 'true'\n    health:\n      type: tcp\n"))
+
+    def test_tcp_probe(self):
+        """Test TCP probes against a listening and a closed port."""
+        import socket
+        from omni_run import ProbeSpec, run_probe
+
+        server = socket.socket()
+        server.bind(("127.0.0.1", 0))
+        server.listen(1)
+        port = server.getsockname()[1]
+        try:
+            assert run_probe(ProbeSpec(type="tcp", port=port)).ok
+        finally:
+            server.close()
+        assert not run_probe(ProbeSpec(type="tcp", port=port, timeout=0.5)).ok
+
+    def test_exec_probe_and_thresholds(self):
+        """Test that transitions only happen after the configured thresholds."""
+        from omni_run import ProbeSpec, HealthMonitor
+
+        changes = []
+        monitor = HealthMonitor(ProbeSpec(type="exec", command="exit 1", failure_threshold=2),
+                                on_change=lambda healthy, result: changes.append(healthy))
+        monitor.check_once()
+        assert changes == []
+        monitor.check_once()
+        assert changes == [False]
+
+        monitor.probe = ProbeSpec(type="exec", command="true", success_threshold=2)
+        monitor.check_once()
+        monitor.check_once()
+        assert changes == [False, True]
+
+    def test_dependent_waits_for_healthy(self, temp_dir, omni_runner, capsys):
+        """Test that a dependent starts only after its dependency's probe passes."""
+        from omni_run import load_manifest, Orchestrator
+
+        ready = temp_dir / "ready"
+        manifest = load_manifest(write_manifest(temp_dir, f"""
+services:
+  db:
+    command: ["{sys.executable}", "-c", "import time, pathlib; time.sleep(0.5); pathlib.Path('ready').touch(); time.sleep(1)"]
+    health:
+      command: ["{sys.executable}", "-c", "import pathlib, sys; sys.exit(0 if pathlib.Path('ready').exists() else 1)"]
+      interval: 100ms
+  app:
+    command: ["{sys.executable}", "-c", "import pathlib; print('db ready:', pathlib.Path('ready').exists())"]
+    depends_on: [db]
+"""))
+
+        assert Orchestrator(omni_runner, manifest).up() == 0
+        out = capsys.readouterr().out
+        assert "db ready: True" in out
+        assert "healthy" in out
+
+    def test_unhealthy_dependency_fails_dependents(self, temp_dir, omni_runner, capsys):
+        """Test that dependents are not started when a dependency never becomes healthy."""
+        from omni_run import load_manifest, Orchestrator, ServiceState
+
+        manifest = load_manifest(write_manifest(temp_dir, f"""
+services:
+  db:
+    command: ["{sys.executable}", "-c", "import time; time.sleep(1)"]
+    health:
+      command: "exit 1"
+      interval: 50ms
+      failure_threshold: 2
+  app:
+    command: ["{sys.executable}", "-c", "print('should not run')"]
+    depends_on: [db]
+"""))
+        orchestrator = Orchestrator(omni_runner, manifest)
+
+        assert orchestrator.up() == 1
+        assert orchestrator.services["app"].state == ServiceState.FAILED
+        assert orchestrator.services["app"].process is None
+        assert "should not run" not in capsys.readouterr().out
+
+
+class TestDependencyConditions:
+    """Tests for depends_on conditions and startup timeouts."""
+
+    def test_parse_conditions(self, temp_dir):
+        """Test the list, list-of-mappings and mapping forms of depends_on."""
+        from omni_run import load_manifest
+
+        manifest = load_manifest(write_manifest(temp_dir, """
+services:
+  db:
+    command: 'true'
+    ports: {pg: 5432}
+    health: {port: pg}
+  cache:
+    command: 'true'
+  api:
+    command: 'true'
+    depends_on:
+      - cache
+      - db: service_healthy
+  web:
+    command: 'true'
+    depends_on:
+      api: service_started
+      db: {condition: port_open, port: pg, timeout: 30s}
+"""))
+        api, web = manifest.services["api"], manifest.services["web"]
+        assert api.depends_on == ["cache", "db"]
+        assert api.conditions["cache"].condition is None
+        assert api.conditions["db"].condition == "service_healthy"
+        assert web.conditions["db"].describe() == "port_open (pg)"
+        assert web.conditions["db"].timeout == 30
+
+    def test_invalid_conditions(self, temp_dir):
+        """Test that impossible conditions are rejected when the manifest loads."""
+        from omni_run import load_manifest, ManifestError
+
+        base = "services:\n  db:\n    command: 'true'\n  api:\n    command: 'true'\n    depends_on:\n      db: "
+        with pytest.raises(ManifestError, match="condition: must be one of"):
+            load_manifest(write_manifest(temp_dir, base + "service_happy\n"))
+        with pytest.raises(ManifestError, match="service_healthy needs a health check on 'db'"):
+            load_manifest(write_manifest(temp_dir, base + "service_healthy\n"))
+        with pytest.raises(ManifestError, match="port_open needs a port"):
+            load_manifest(write_manifest(temp_dir, base + "port_open\n"))
+
+    def test_service_started_does_not_wait_for_health(self, temp_dir, omni_runner, capsys):
+        """Test that service_started only waits for the dependency's process."""
+        from omni_run import load_manifest, Orchestrator
+
+        manifest = load_manifest(write_manifest(temp_dir, f"""
+services:
+  db:
+    command: ["{sys.executable}", "-c", "import time; time.sleep(1)"]
+    health:
+      command: "exit 1"
+      interval: 1s
+  app:
+    command: ["{sys.executable}", "-c", "print('app started')"]
+    depends_on:
+      db: service_started
+"""))
+        orchestrator = Orchestrator(omni_runner, manifest)
+        orchestrator.up(["app"])
+        assert "app started" in capsys.readouterr().out
+
+    def test_port_open(self, temp_dir, omni_runner, capsys):
+        """Test that port_open waits until the dependency accepts connections."""
+        from omni_run import load_manifest, Orchestrator
+
+        server = ("import os, socket, time; time.sleep(0.4); s = socket.socket(); "
+                  "s.bind(('127.0.0.1', int(os.environ['PORT']))); s.listen(1); time.sleep(1.5)")
+        client = ("import os, socket; socket.create_connection(('127.0.0.1', int(os.environ['DB_PORT']))); "
+                  "print('connected')")
+        manifest = load_manifest(write_manifest(temp_dir, f"""
+services:
+  db:
+    command: ["{sys.executable}", "-c", "{server}"]
+    ports:
+      tcp: auto
+  app:
+    command: ["{sys.executable}", "-c", "{client}"]
+    env:
+      DB_PORT: ${{service.db.port}}
+    depends_on:
+      db: port_open
+"""))
+        orchestrator = Orchestrator(omni_runner, manifest)
+
+        assert orchestrator.up() == 0
+        assert "connected" in capsys.readouterr().out
+
+    def test_startup_timeout_report(self, temp_dir, omni_runner, capsys):
+        """Test that the overall startup timeout fails the run with a dependency report."""
+        from omni_run import load_manifest, Orchestrator, ServiceState
+
+        manifest = load_manifest(write_manifest(temp_dir, f"""
+startup_timeout: 600ms
+services:
+  db:
+    command: ["{sys.executable}", "-c", "import time; time.sleep(5)"]
+    health:
+      command: "exit 1"
+      interval: 100ms
+      failure_threshold: 100
+  api:
+    command: 'true'
+    depends_on:
+      db: service_healthy
+  web:
+    command: 'true'
+    depends_on: [api]
+"""))
+        orchestrator = Orchestrator(omni_runner, manifest)
+
+        started = time.time()
+        assert orchestrator.up() == 1
+        assert time.time() - started < 4
+        out = capsys.readouterr().out
+        assert "Startup timed out after 0.6s" in out
+        assert "api waits for db to be service_healthy: db is starting (last probe: exit code 1)" in out
+        assert "web waits for api to be ready: api is pending" in out
+        assert orchestrator.services["web"].state == ServiceState.FAILED
+
+    def test_dependency_timeout(self, temp_dir, omni_runner, capsys):
+        """Test that a per-dependency timeout fails only the waiting service."""
+        from omni_run import load_manifest, Orchestrator, ServiceState
+
+        manifest = load_manifest(write_manifest(temp_dir, f"""
+services:
+  db:
+    command: ["{sys.executable}", "-c", "import time; time.sleep(1)"]
+    health:
+      command: "exit 1"
+      interval: 100ms
+      failure_threshold: 100
+  app:
+    command: ["{sys.executable}", "-c", "print('should not run')"]
+    depends_on:
+      db: {{condition: service_healthy, timeout: 300ms}}
+"""))
+        orchestrator = Orchestrator(omni_runner, manifest)
+
+        assert orchestrator.up() == 1
+        out = capsys.readouterr().out
+        assert "not started: app waits for db to be service_healthy" in out
+        assert "gave up after 0.3s" in out
+        assert "should not run" not in out
+        assert orchestrator.services["app"].reason == "dependency 'db' is not service_healthy"
+        assert orchestrator.services["db"].state != ServiceState.FAILED
+
+
+class TestLogPipeline:
+    """Tests for service log parsing, filtering and files."""
+
+    def test_parse_json_line(self):
+        """Test that JSON lines are recognized and keep their level."""
+        from omni_run import parse_log_line
+
+        record = parse_log_line("api", '{"level": "ERROR", "msg": "boom"}')
+
+        assert record.level == "error"
+        assert record.fields == {"level": "ERROR", "msg": "boom"}
+
+    def test_parse_text_levels(self):
+        """Test textual level markers and the info default."""
+        from omni_run import parse_log_line
+
+        assert parse_log_line("api", "2024-01-01 WARN disk almost full").level == "warn"
+        assert parse_log_line("api", "[debug] cache miss").level == "debug"
+        assert parse_log_line("api", "listening on :8080").level == "info"
+        assert parse_log_line("api", "{not json}").fields is None
+
+    def test_level_filter_and_quiet(self, capsys):
+        """Test that --log-level and --quiet filter console output."""
+        from omni_run import LogPipeline
+
+        logs = LogPipeline(level="warn")
+        logs.register("api")
+        logs.write("api", "INFO started")
+        logs.write("api", "ERROR failed to bind")
+        out = capsys.readouterr().out
+        assert "started" not in out
+        assert "failed to bind" in out
+
+        quiet = LogPipeline(quiet=True)
+        quiet.register("api")
+        quiet.write("api", "ERROR hidden")
+        quiet.status("api", "stopped")
+        out = capsys.readouterr().out
+        assert "hidden" not in out
+        assert "stopped" in out
+
+    def test_log_files_keep_json_raw(self, temp_dir, capsys):
+        """Test that per-service files get timestamps for text and raw JSON lines."""
+        from omni_run import LogPipeline
+
+        logs = LogPipeline(log_dir=temp_dir / "logs")
+        logs.register("api")
+        logs.write("api", "plain line", "stderr")
+        logs.write("api", '{"msg": "structured"}')
+        logs.close()
+
+        lines = (temp_dir / "logs" / "api.log").read_text().splitlines()
+        assert lines[0].endswith("[stderr] plain line")
+        assert lines[1] == '{"msg": "structured"}'
+
+    def test_rotation(self, temp_dir):
+        """Test that log files rotate once they exceed the size limit."""
+        from omni_run import RotatingLogFile
+
+        log = RotatingLogFile(temp_dir / "svc.log", max_bytes=50, backups=2)
+        for i in range(10):
+            log.write(f"line number {i:02d} ........")
+        log.close()
+
+        assert (temp_dir / "svc.log.1").exists()
+        assert (temp_dir / "svc.log.2").exists()
+        assert not (temp_dir / "svc.log.3").exists()
+        assert "line number 09" in (temp_dir / "svc.log").read_text()
+
+    def test_up_writes_service_logs(self, temp_dir, omni_runner, capsys):
+        """Test that orchestrated services are captured into their log files."""
+        from omni_run import load_manifest, Orchestrator, LogPipeline
+
+        manifest = load_manifest(write_manifest(temp_dir, f"""
+services:
+  web:
+    command: ["{sys.executable}", "-c", "import sys; print('to stdout'); print('to stderr', file=sys.stderr)"]
+"""))
+        logs = LogPipeline.from_config({}, manifest.root)
+
+        assert Orchestrator(omni_runner, manifest, logs).up() == 0
+        logs.close()
+        content = (temp_dir / ".omni-run" / "logs" / "web.log").read_text()
+        assert "[stdout] to stdout" in content
+        assert "[stderr] to stderr" in content
+        assert "[omni] exited with code 0" in content
+
+
+class TestPortAllocation:
+    """Tests for the `ports:` section and free-port allocation."""
+
+    def _busy_socket(self):
+        import socket
+        sock = socket.socket()
+        sock.bind(("127.0.0.1", 0))
+        sock.listen(1)
+        return sock
+
+    def test_port_spec_forms(self):
+        """Test auto, fixed and range short forms."""
+        from omni_run import PortSpec
+
+        assert PortSpec.from_config("api", "http", "auto").strategy == "auto"
+        fixed = PortSpec.from_config("api", "admin", 9090)
+        assert (fixed.strategy, fixed.port, fixed.env_name) == ("fixed", 9090, "PORT_ADMIN")
+        span = PortSpec.from_config("api", "debug", "5000-5010")
+        assert (span.start, span.end) == (5000, 5010)
+        assert not PortSpec.from_config("api", "db", {"port": 5432, "fallback": "fail"}).fallback
+
+    def test_invalid_port_spec(self):
+        """Test that malformed port values are manifest errors."""
+        from omni_run import PortSpec, ManifestError
+
+        with pytest.raises(ManifestError, match="services.api.ports.http"):
+            PortSpec.from_config("api", "http", "lots")
+        with pytest.raises(ManifestError, match="out of range"):
+            PortSpec.from_config("api", "http", 70000)
+
+    def test_busy_fixed_port_falls_back(self):
+        """Test that a busy fixed port is replaced by a free one unless fallback is disabled."""
+        from omni_run import PortAllocator, PortSpec, ManifestError
+
+        sock = self._busy_socket()
+        busy = sock.getsockname()[1]
+        try:
+            allocator = PortAllocator()
+            port = allocator.allocate("api", PortSpec(name="http", strategy="fixed", port=busy))
+            assert port != busy
+            with pytest.raises(ManifestError, match="already in use"):
+                allocator.allocate("api", PortSpec(name="http", strategy="fixed", port=busy, fallback=False))
+        finally:
+            sock.close()
+
+    def test_range_skips_busy_and_reserved(self):
+        """Test that range allocation skips busy ports and ports already handed out."""
+        from omni_run import PortAllocator, PortSpec
+
+        sock = self._busy_socket()
+        busy = sock.getsockname()[1]
+        try:
+            allocator = PortAllocator()
+            allocator.reserved.add(busy + 1)
+            spec = PortSpec(name="http", strategy="range", start=busy, end=busy + 5)
+            assert allocator.allocate("api", spec) >= busy + 2
+        finally:
+            sock.close()
+
+    def test_ports_injected_into_env_and_args(self, temp_dir, omni_runner, capsys):
+        """Test PORT / PORT_<NAME> injection, argument substitution and the recorded mapping."""
+        import json
+        from omni_run import load_manifest, Orchestrator
+
+        manifest = load_manifest(write_manifest(temp_dir, f"""
+services:
+  api:
+    command: ["{sys.executable}", "-c", "import os, sys; print('env', os.environ['PORT'], os.environ['PORT_ADMIN'], 'arg', sys.argv[1])", "${{PORT_ADMIN}}"]
+    ports:
+      http: auto
+      admin: auto
+"""))
+        orchestrator = Orchestrator(omni_runner, manifest)
+
+        assert orchestrator.up() == 0
+        ports = orchestrator.services["api"].ports
+        out = capsys.readouterr().out
+        assert f"env {ports['http']} {ports['admin']} arg {ports['admin']}" in out
+        recorded = json.loads((temp_dir / ".omni-run" / "ports.json").read_text())
+        assert recorded == {"api": ports}
+
+    def test_health_probe_uses_named_port(self, temp_dir):
+        """Test that a health probe can reference a named port."""
+        from omni_run import load_manifest, ManifestError
+
+        manifest = load_manifest(write_manifest(temp_dir, """
+services:
+  api:
+    command: "true"
+    ports:
+      http: auto
+    health:
+      type: http
+      port: http
+      path: /ready
+"""))
+        probe = manifest.services["api"].health.resolve({"http": 4321})
+        assert probe.url == "http://127.0.0.1:4321/ready"
+
+        with pytest.raises(ManifestError, match="unknown port 'web'"):
+            load_manifest(write_manifest(temp_dir, "services:\n  api:\n    command: 'true'\n    health:\n      port: web\n"))
+
+
+@pytest.mark.skipif(sys.platform == "win32", reason="Uses POSIX signals and process groups")
+class TestGracefulShutdown:
+    """Tests for stop signals, grace periods and process-group cleanup."""
+
+    def test_parse_signal(self):
+        """Test signal names and numbers."""
+        import signal
+        from omni_run import parse_signal
+
+        assert parse_signal("SIGINT") == signal.SIGINT
+        assert parse_signal("quit") == signal.SIGQUIT
+        assert parse_signal(9) == 9
+        assert parse_signal(None) == signal.SIGTERM
+        with pytest.raises(ValueError):
+            parse_signal("SIGNOPE")
+
+    def test_manifest_stop_settings(self, temp_dir):
+        """Test that stop.signal and stop.timeout (stop_signal and stop_timeout in version 1) are parsed and validated."""
+        import signal
+        from omni_run import load_manifest, ManifestError
+
+        manifest = load_manifest(write_manifest(temp_dir, "services:\n  api:\n    command: 'true'\n    stop: {signal: SIGINT, timeout: 500ms}\n"))
+        assert manifest.services["api"].stop_signal == signal.SIGINT
+        assert manifest.services["api"].stop_timeout == pytest.approx(0.5)
+        manifest = load_manifest(write_manifest(temp_dir, "services:\n  api:\n    command: 'true'\n    stop_signal: SIGINT\n    stop_timeout: 500ms\n"))
+        assert (manifest.services["api"].stop_signal, manifest.version) == (signal.SIGINT, 1)
+
+        with pytest.raises(ManifestError, match="services.api.stop.signal"):
+            load_manifest(write_manifest(temp_dir, "services:\n  api:\n    command: 'true'\n    stop_signal: BOGUS\n"))
+
+    def test_custom_stop_signal(self, temp_dir, omni_runner, capsys):
+        """Test that a service receives its configured stop signal."""
+        from omni_run import load_manifest, Orchestrator
+
+        marker = temp_dir / "got-int"
+        manifest = load_manifest(write_manifest(temp_dir, f"""
+services:
+  api:
+    command: ["{sys.executable}", "-c", "import signal, sys, time, pathlib\\ndef h(*a):\\n  pathlib.Path('got-int').touch(); sys.exit(0)\\nsignal.signal(signal.SIGINT, h)\\nprint('ready', flush=True)\\ntime.sleep(30)"]
+    stop_signal: SIGINT
+"""))
+        orchestrator = Orchestrator(omni_runner, manifest)
+        service = orchestrator.services["api"]
+        orchestrator.start_service(service)
+        time.sleep(0.5)
+
+        orchestrator.shutdown(["api"])
+
+        assert marker.exists()
+        assert service.exit_code == 0
+
+    def test_escalates_to_sigkill(self, temp_dir, omni_runner, capsys):
+        """Test that a service ignoring its stop signal is killed after stop_timeout."""
+        from omni_run import load_manifest, Orchestrator
+
+        manifest = load_manifest(write_manifest(temp_dir, f"""
+services:
+  stubborn:
+    command: ["{sys.executable}", "-c", "import signal, time\\nsignal.signal(signal.SIGTERM, signal.SIG_IGN)\\nprint('ready', flush=True)\\ntime.sleep(30)"]
+    stop_timeout: 0.5
+"""))
+        orchestrator = Orchestrator(omni_runner, manifest)
+        service = orchestrator.services["stubborn"]
+        orchestrator.start_service(service)
+        time.sleep(0.5)
+
+        started = time.time()
+        orchestrator.shutdown(["stubborn"])
+
+        assert time.time() - started < 5
+        assert service.exit_code == -9
+        assert "killed after 0.5s grace period" in capsys.readouterr().out
+
+    def test_grandchildren_are_stopped(self, temp_dir):
+        """Test that the whole process group is signalled, not just the leader."""
+        import subprocess
+        from omni_run import ShutdownManager, pid_alive
+
+        pidfile = temp_dir / "grandchild.pid"
+        script = (
+            "import subprocess, sys, time\n"
+            f"child = subprocess.Popen([sys.executable, '-c', 'import time; time.sleep(60)'])\n"
+            f"open({str(pidfile)!r}, 'w').write(str(child.pid))\n"
+            "time.sleep(60)\n"
+        )
+        proc = subprocess.Popen([sys.executable, "-c", script], start_new_session=True)
+        deadline = time.time() + 5
+        while not (pidfile.exists() and pidfile.read_text()) and time.time() < deadline:
+            time.sleep(0.05)
+        grandchild = int(pidfile.read_text())
+
+        ShutdownManager(timeout=2).stop(proc)
+
+        deadline = time.time() + 2
+        while pid_alive(grandchild) and time.time() < deadline:
+            time.sleep(0.05)
+        assert not pid_alive(grandchild)
+
+
+class TestWindowsProcessTrees:
+    """Tests for Windows process-tree handling, exercised by faking the platform."""
+
+    class FakeProcess:
+        def __init__(self, exits_on_break=True, console=True):
+            self.pid = 4242
+            self.returncode = None
+            self.exits_on_break = exits_on_break
+            self.console = console
+            self.sent = []
+            self.job = self.FakeJob(self)
+
+        class FakeJob:
+            def __init__(self, proc):
+                self.proc = proc
+                self.terminated = self.closed = False
+
+            def active_processes(self):
+                return 0 if self.proc.returncode is not None else 2
+
+            def terminate(self, exit_code=1):
+                self.terminated = True
+                self.proc.returncode = exit_code
+
+            def close(self):
+                self.closed = True
+
+        def send_signal(self, sig):
+            if not self.console:
+                raise OSError("no console")
+            self.sent.append(sig)
+            if self.exits_on_break:
+                self.returncode = 0xC000013A
+
+        def poll(self):
+            return self.returncode
+
+        def wait(self, timeout=None):
+            if self.returncode is None and timeout is not None:
+                import subprocess
+                raise subprocess.TimeoutExpired("fake", timeout)
+            return self.returncode
+
+        def kill(self):
+            self.returncode = 1
+
+    def fake_windows(self, monkeypatch):
+        import signal
+        import omni_run
+        monkeypatch.setattr(omni_run.platform, "system", lambda: "Windows")
+        monkeypatch.setattr(signal, "CTRL_BREAK_EVENT", 1, raising=False)
+
+    def test_resolves_batch_files_and_extensions(self, monkeypatch):
+        """Test PATHEXT resolution and that .cmd/.bat scripts run through cmd /c."""
+        self.fake_windows(monkeypatch)
+        import omni_run
+        from omni_run import resolve_executable
+
+        found = {"npm": r"C:\node\npm.CMD", "go": r"C:\go\bin\go.exe"}
+        seen_paths = []
+
+        def which(name, path=None):
+            seen_paths.append(path)
+            return found.get(name)
+
+        monkeypatch.setattr(omni_run.shutil, "which", which)
+        assert resolve_executable(["npm", "ci"], env={"Path": r"C:\node"}) == ["cmd", "/c", r"C:\node\npm.CMD", "ci"]
+        assert resolve_executable(["go", "run", "."])[0] == r"C:\go\bin\go.exe"
+        assert resolve_executable(["missing", "x"]) == ["missing", "x"]
+        assert seen_paths[0] == r"C:\node"
+
+    def test_unchanged_on_posix(self):
+        """Test that argv is passed through untouched off Windows."""
+        from omni_run import resolve_executable
+
+        if sys.platform != "win32":
+            assert resolve_executable(["npm.cmd", "ci"]) == ["npm.cmd", "ci"]
+
+    def test_environment_names_are_case_insensitive(self, monkeypatch):
+        """Test that `PATH` overrides an inherited `Path` instead of duplicating it."""
+        self.fake_windows(monkeypatch)
+        from omni_run import EnvironmentResolver
+
+        resolver = EnvironmentResolver({"Path": r"C:\Windows"})
+        resolver.add("manifest", {"PATH": r"C:\tools;${path}"})
+        assert resolver.env == {"Path": r"C:\tools;C:\Windows"}
+
+    def test_ctrl_break_exit_counts_as_stopped(self):
+        """Test that STATUS_CONTROL_C_EXIT is treated as a deliberate stop."""
+        from omni_run import stopped_by_signal
+
+        assert stopped_by_signal(0xC000013A)
+        assert stopped_by_signal(-1073741510)
+        assert not stopped_by_signal(1)
+
+    def test_graceful_stop_sends_ctrl_break(self, monkeypatch):
+        """Test that SIGTERM/SIGINT become CTRL_BREAK_EVENT and a clean exit needs no kill."""
+        self.fake_windows(monkeypatch)
+        import signal
+        from omni_run import ShutdownManager
+
+        proc = self.FakeProcess()
+        assert ShutdownManager(timeout=1).stop(proc) is False
+        assert proc.sent == [signal.CTRL_BREAK_EVENT]
+        assert proc.job.closed and not proc.job.terminated
+
+    def test_escalates_to_job_termination(self, monkeypatch):
+        """Test that a tree still alive after the grace period is killed through its job."""
+        self.fake_windows(monkeypatch)
+        from omni_run import ShutdownManager
+
+        stubborn = self.FakeProcess(exits_on_break=False)
+        assert ShutdownManager(timeout=0.2).stop(stubborn) is True
+        assert stubborn.job.terminated and stubborn.job.closed
+
+        detached = self.FakeProcess(console=False)
+        started = time.time()
+        assert ShutdownManager(timeout=10).stop(detached) is True
+        assert time.time() - started < 2
+        assert detached.job.terminated
+
+    def test_supervisor_honors_stop_request(self, temp_dir, omni_runner, capsys):
+        """Test the stop-request file `omni-run stop` uses for a detached Windows supervisor."""
+        import threading
+        from omni_run import load_manifest, Orchestrator, SUPERVISOR_STOP, WORKSPACE_DIR
+
+        manifest = load_manifest(write_manifest(temp_dir, "services:\n  api:\n    command: sleep 30\n"))
+        state_dir = temp_dir / WORKSPACE_DIR
+        orchestrator = Orchestrator(omni_runner, manifest, state_dir=state_dir)
+        threading.Timer(0.5, (state_dir / SUPERVISOR_STOP).touch).start()
+
+        started = time.time()
+        orchestrator.up()
+        assert time.time() - started < 5
+        assert not (state_dir / SUPERVISOR_STOP).exists()
+        assert not orchestrator.services["api"].is_alive()
+
+
+class TestRestartPolicies:
+    """Tests for restart policies, backoff and the crash-loop breaker."""
+
+    def test_policy_from_config(self):
+        """Test policy names, mappings and validation."""
+        from omni_run import ManifestError, RestartPolicy
+
+        assert RestartPolicy.from_config("r", None).policy == "never"
+        assert RestartPolicy.from_config("r", False).policy == "never"
+        assert RestartPolicy.from_config("r", "always").policy == "always"
+        policy = RestartPolicy.from_config("r", {"policy": "on-failure", "max_restarts": 2, "backoff": "250ms"})
+        assert (policy.max_restarts, policy.backoff) == (2, pytest.approx(0.25))
+        with pytest.raises(ManifestError, match="r.policy"):
+            RestartPolicy.from_config("r", "sometimes")
+
+    def test_should_restart(self):
+        """Test each policy against clean exits, failures and deliberate stops."""
+        from omni_run import RestartPolicy
+
+        def decide(policy, code, stopped=False):
+            return RestartPolicy(policy=policy).should_restart(code, stopped)
+
+        assert not decide("never", 1)
+        assert decide("on-failure", 1) and not decide("on-failure", 0)
+        assert not decide("on-failure", -15) and not decide("on-failure", 143)
+        assert decide("unless-stopped", 0) and not decide("unless-stopped", 0, stopped=True)
+        assert decide("always", -15) and decide("always", 0, stopped=True)
+
+    def test_backoff_and_breaker(self):
+        """Test exponential delays, the cap, jitter bounds and max_restarts."""
+        from omni_run import RestartPolicy
+
+        policy = RestartPolicy(policy="always", backoff=1, max_backoff=5, multiplier=2, jitter=0.5, max_restarts=3)
+        assert [policy.delay(n, rng=lambda: 0.5) for n in (1, 2, 3, 4)] == [1, 2, 4, 5]
+        assert policy.delay(2, rng=lambda: 0.0) == 1.0
+        assert policy.delay(2, rng=lambda: 1.0) == 3.0
+        assert not policy.exhausted(3) and policy.exhausted(4)
+        assert not RestartPolicy(max_restarts=0).exhausted(1000)
+
+    def test_crash_loop_marks_failed(self, temp_dir, omni_runner, capsys):
+        """Test that a crashing service is restarted with backoff and then given up on."""
+        from omni_run import load_manifest, Orchestrator, ServiceState
+
+        manifest = load_manifest(write_manifest(temp_dir, """
+services:
+  crasher:
+    command: exit 2
+    restart:
+      policy: on-failure
+      max_restarts: 2
+      backoff: 50ms
+      jitter: 0
+"""))
+        orchestrator = Orchestrator(omni_runner, manifest)
+        assert orchestrator.up() == 1
+
+        service = orchestrator.services["crasher"]
+        out = capsys.readouterr().out
+        assert service.state == ServiceState.FAILED
+        assert service.restarts == 2
+        assert "crash loop: gave up after 2 restarts" in service.reason
+        assert "restarting in 0.1s (attempt 2/2)" in out
+        assert [entry["exit_code"] for entry in service.restart_history] == [2, 2]
+        assert orchestrator.snapshot()["services"]["crasher"]["restarts"] == 2
+
+    def test_on_failure_stops_after_success(self, temp_dir, omni_runner, capsys):
+        """Test that on-failure restarts until the service exits cleanly."""
+        from omni_run import load_manifest, Orchestrator, ServiceState
+
+        counter = temp_dir / "runs"
+        manifest = load_manifest(write_manifest(temp_dir, f"""
+services:
+  flaky:
+    command: ["{sys.executable}", "-c", "import pathlib, sys\\np = pathlib.Path('runs')\\nn = int(p.read_text()) + 1 if p.exists() else 1\\np.write_text(str(n))\\nsys.exit(0 if n >= 3 else 1)"]
+    restart: {{policy: on-failure, backoff: 10ms, jitter: 0}}
+"""))
+        orchestrator = Orchestrator(omni_runner, manifest)
+        assert orchestrator.up() == 0
+
+        assert counter.read_text() == "3"
+        assert orchestrator.services["flaky"].state == ServiceState.EXITED
+        assert orchestrator.services["flaky"].restarts == 2
+
+
+@pytest.mark.skipif(sys.platform == "win32", reason="POSIX sleep command")
+class TestServiceCommands:
+    """Tests for start/stop/restart requests handled by a running orchestrator."""
+
+    def _running(self, temp_dir, omni_runner):
+        import threading
+        from omni_run import load_manifest, Orchestrator
+
+        manifest = load_manifest(write_manifest(temp_dir, "services:\n  sleeper:\n    command: sleep 30\n"))
+        orchestrator = Orchestrator(omni_runner, manifest)
+        runner = threading.Thread(target=orchestrator.up, kwargs={"persistent": True})
+        runner.start()
+        wait_for(orchestrator.services["sleeper"].is_alive)
+        return orchestrator, runner
+
+    def _shut_down(self, orchestrator, runner):
+        orchestrator.request_shutdown()
+        runner.join(timeout=10)
+
+    def test_stop_keeps_up_running(self, temp_dir, omni_runner):
+        """Test that stopping a service leaves `up` running."""
+        from omni_run import ServiceState
+
+        orchestrator, runner = self._running(temp_dir, omni_runner)
+        service = orchestrator.services["sleeper"]
+        try:
+            orchestrator.request("stop", "sleeper")
+            wait_for(lambda: service.state == ServiceState.STOPPED)
+            assert runner.is_alive()
+        finally:
+            self._shut_down(orchestrator, runner)
+
+    def test_start_after_stop(self, temp_dir, omni_runner):
+        """Test that a stopped service is started again as a new process."""
+        orchestrator, runner = self._running(temp_dir, omni_runner)
+        service = orchestrator.services["sleeper"]
+        first_pid = service.process.pid
+        try:
+            orchestrator.request("stop", "sleeper")
+            wait_for(lambda: not service.is_alive())
+            orchestrator.request("start", "sleeper")
+            wait_for(lambda: service.is_alive() and service.process.pid != first_pid)
+        finally:
+            self._shut_down(orchestrator, runner)
+
+    def test_restart(self, temp_dir, omni_runner):
+        """Test that a restart replaces the process and counts as one."""
+        orchestrator, runner = self._running(temp_dir, omni_runner)
+        service = orchestrator.services["sleeper"]
+        first_pid = service.process.pid
+        try:
+            orchestrator.request("restart", "sleeper")
+            wait_for(lambda: service.is_alive() and service.process.pid != first_pid)
+            assert service.restarts == 1
+        finally:
+            self._shut_down(orchestrator, runner)
+
+    def test_shutdown_request(self, temp_dir, omni_runner):
+        """Test that a shutdown request ends `up` and its services."""
+        orchestrator, runner = self._running(temp_dir, omni_runner)
+        self._shut_down(orchestrator, runner)
+        assert not runner.is_alive()
+        assert not orchestrator.services["sleeper"].is_alive()
+
+    def test_unknown_requests(self, temp_dir, omni_runner):
+        """Test that unknown services and actions are rejected."""
+        from omni_run import load_manifest, ManifestError, Orchestrator
+
+        orchestrator = Orchestrator(omni_runner, load_manifest(write_manifest(temp_dir, "services:\n  a:\n    command: 'true'\n")))
+        with pytest.raises(ManifestError, match="Unknown service"):
+            orchestrator.request("stop", "nope")
+        with pytest.raises(ValueError):
+            orchestrator.request("explode", "a")
+
+
+@pytest.mark.skipif(sys.platform == "win32", reason="POSIX shell hooks")
+class TestLifecycleHooks:
+    """Tests for pre/post start and stop hooks."""
+
+    def test_parse_hooks(self, temp_dir):
+        """Test a single command, a list and the mapping form with a timeout."""
+        from omni_run import load_manifest
+
+        manifest = load_manifest(write_manifest(temp_dir, """
+services:
+  api:
+    command: 'true'
+    hooks:
+      pre_start: ./migrate.sh
+      post_start:
+        - echo one
+        - ["echo", "two"]
+        - {command: echo three, timeout: 5s}
+"""))
+        hooks = manifest.services["api"].hooks
+        assert [h.command for h in hooks["pre_start"]] == ["./migrate.sh"]
+        assert [h.describe() for h in hooks["post_start"]] == ["echo one", "echo two", "echo three"]
+        assert hooks["post_start"][2].timeout == 5
+
+    def test_invalid_hooks(self, temp_dir):
+        """Test that an unknown phase and a hook without a command are rejected."""
+        from omni_run import load_manifest, ManifestError
+
+        with pytest.raises(ManifestError, match=r"services.api.hooks: unknown key\(s\) before_start \(did you mean pre_start\?\)"):
+            load_manifest(write_manifest(temp_dir, "services:\n  api:\n    command: 'true'\n    hooks:\n      before_start: x\n"))
+        with pytest.raises(ManifestError, match=r"hooks.pre_stop\[0\]: hook needs a command"):
+            load_manifest(write_manifest(temp_dir, "services:\n  api:\n    command: 'true'\n    hooks:\n      pre_stop: [{timeout: 1}]\n"))
+
+    def test_hooks_run_in_order_with_env(self, temp_dir, omni_runner, capsys):
+        """Test that every phase runs with the service's resolved environment."""
+        from omni_run import load_manifest, Orchestrator
+
+        manifest = load_manifest(write_manifest(temp_dir, """
+services:
+  api:
+    command: sleep 0.5
+    env:
+      GREETING: hi
+    ports:
+      http: auto
+    hooks:
+      pre_start: echo "pre_start $OMNI_RUN_SERVICE $GREETING $PORT_HTTP" >> hooks.log
+      post_start: echo "post_start $OMNI_RUN_PID" >> hooks.log
+      post_stop: echo "post_stop $OMNI_RUN_HOOK" >> hooks.log
+"""))
+        orchestrator = Orchestrator(omni_runner, manifest)
+        assert orchestrator.up() == 0
+
+        lines = (temp_dir / "hooks.log").read_text().splitlines()
+        port = orchestrator.services["api"].ports["http"]
+        assert lines[0] == f"pre_start api hi {port}"
+        assert lines[1].startswith("post_start ") and lines[1].split()[1].isdigit()
+        assert lines[2] == "post_stop post_stop"
+
+    def test_pre_stop_runs_before_signal(self, temp_dir, omni_runner, capsys):
+        """Test that pre_stop sees the live process and its output is captured."""
+        from omni_run import load_manifest, Orchestrator
+
+        manifest = load_manifest(write_manifest(temp_dir, """
+services:
+  api:
+    command: sleep 30
+    hooks:
+      pre_stop: kill -0 $OMNI_RUN_PID && echo draining
+"""))
+        orchestrator = Orchestrator(omni_runner, manifest)
+        service = orchestrator.services["api"]
+        orchestrator.start_service(service)
+        orchestrator.shutdown(["api"])
+
+        out = capsys.readouterr().out
+        assert "pre_stop: kill -0" in out
+        assert "draining" in out
+        assert "hook failed" not in out
+
+    def test_failed_pre_start_aborts_launch(self, temp_dir, omni_runner, capsys):
+        """Test that a failing pre_start keeps the service and its dependents from starting."""
+        from omni_run import load_manifest, Orchestrator, ServiceState
+
+        manifest = load_manifest(write_manifest(temp_dir, """
+services:
+  db:
+    command: touch started
+    hooks:
+      pre_start: exit 3
+  api:
+    command: 'true'
+    depends_on: [db]
+"""))
+        orchestrator = Orchestrator(omni_runner, manifest)
+        assert orchestrator.up() == 1
+
+        out = capsys.readouterr().out
+        assert "pre_start hook failed: exit 3 exited with code 3" in out
+        assert orchestrator.services["db"].reason == "pre_start hook failed"
+        assert orchestrator.services["db"].process is None
+        assert not (temp_dir / "started").exists()
+        assert orchestrator.services["api"].state == ServiceState.FAILED
+
+    def test_failed_pre_start_releases_ports(self, temp_dir, omni_runner, capsys):
+        """Test that the ports allocated for a service whose pre_start fails are given back."""
+        from omni_run import load_manifest, Orchestrator
+
+        manifest = load_manifest(write_manifest(temp_dir, """
+services:
+  api:
+    command: 'true'
+    ports: {http: auto, grpc: {port: auto, socket: true}}
+    hooks:
+      pre_start: exit 1
+"""))
+        orchestrator = Orchestrator(omni_runner, manifest)
+        service = orchestrator.services["api"]
+        orchestrator.start_service(service)
+        assert service.reason == "pre_start hook failed"
+        assert service.ports == {} and orchestrator.ports.reserved == set() and "api" not in orchestrator.listeners
+
+    def test_hook_timeout(self, temp_dir, omni_runner, capsys):
+        """Test that a hook exceeding its timeout counts as failed."""
+        from omni_run import load_manifest, Orchestrator
+
+        manifest = load_manifest(write_manifest(temp_dir, """
+services:
+  api:
+    command: 'true'
+    hooks:
+      pre_start: [{command: sleep 5, timeout: 200ms}]
+"""))
+        assert Orchestrator(omni_runner, manifest).up() == 1
+        assert "timed out after 0.2s" in capsys.readouterr().out
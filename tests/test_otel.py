@@ -0,0 +1,198 @@
+"""
+Tests for OpenTelemetry support in OmniRun.
+
+This module tests:
+- The `otel` settings, and OTEL_* variables injected into services but not sidecars
+- The bundled collector sidecar and the endpoint services are pointed at
+- Spans for the launcher's start, health and stop operations, exported over OTLP/HTTP
+- TRACEPARENT linking a starting service to the launcher's trace, and failed exports
+"""
+
+import sys
+import json
+import threading
+import pytest
+from pathlib import Path
+
+from conftest import *
+
+
+class CaptureServer:
+    """A local OTLP/HTTP endpoint that records the JSON bodies posted to it."""
+
+    def __init__(self):
+        from http.server import BaseHTTPRequestHandler, HTTPServer
+        requests = self.requests = []
+
+        class Handler(BaseHTTPRequestHandler):
+            def do_POST(self):
+                requests.append((self.path, json.loads(self.rfile.read(int(self.headers["Content-Length"])))))
+                self.send_response(200)
+                self.end_headers()
+
+            def log_message(self, *args):
+                pass
+
+        self.server = HTTPServer(("127.0.0.1", 0), Handler)
+        self.url = f"http://127.0.0.1:{self.server.server_port}"
+        threading.Thread(target=self.server.serve_forever, daemon=True).start()
+
+    def spans(self):
+        return [span for _, body in self.requests for resource in body["resourceSpans"]
+                for scope in resource["scopeSpans"] for span in scope["spans"]]
+
+    def close(self):
+        self.server.shutdown()
+        self.server.server_close()
+
+
+def attributes(span):
+    return {a["key"]: next(iter(a["value"].values())) for a in span["attributes"]}
+
+
+class TestOtelEnvironment:
+    """Tests for the variables services get."""
+
+    def test_injected_variables(self, temp_dir, omni_runner):
+        """Test the service name, endpoint, protocol and resource attributes, and that sidecars get none."""
+        from omni_run import load_manifest, Orchestrator
+
+        manifest = load_manifest(write_manifest(temp_dir, """
+otel:
+  endpoint: http://collector.internal:4318
+  attributes: {team: payments, owner: a b}
+services:
+  api: {command: 'true', env: {OTEL_SERVICE_NAME: billing-api}}
+  worker: {command: 'true'}
+sidecars:
+  db: postgres:16
+"""))
+        orchestrator = Orchestrator(omni_runner, manifest)
+        env = orchestrator.otel_env(manifest.services["worker"])
+        assert env == {"OTEL_SERVICE_NAME": "worker", "OTEL_EXPORTER_OTLP_ENDPOINT": "http://collector.internal:4318",
+                       "OTEL_EXPORTER_OTLP_PROTOCOL": "http/protobuf",
+                       "OTEL_RESOURCE_ATTRIBUTES": f"service.namespace={temp_dir.name},deployment.environment=development,"
+                                                   "team=payments,owner=a%20b"}
+        assert orchestrator.resolve_env(manifest.services["api"]).env["OTEL_SERVICE_NAME"] == "billing-api"
+        assert orchestrator.otel_env(manifest.services["db"]) == {}
+
+    def test_disabled(self, temp_dir, omni_runner):
+        """Test that services get no variables when otel is off or not configured."""
+        from omni_run import load_manifest, Orchestrator
+
+        for block in ("otel: false\n", "otel: {enabled: false}\n", ""):
+            manifest = load_manifest(write_manifest(temp_dir, block + "services:\n  api: {command: 'true'}\n"))
+            assert Orchestrator(omni_runner, manifest).otel_env(manifest.services["api"]) == {}
+
+    def test_default_endpoint(self, temp_dir, omni_runner):
+        """Test that `otel: true` points services at a collector on localhost."""
+        from omni_run import load_manifest, Orchestrator
+
+        manifest = load_manifest(write_manifest(temp_dir, "otel: true\nservices:\n  api: {command: 'true'}\n"))
+        env = Orchestrator(omni_runner, manifest).otel_env(manifest.services["api"])
+        assert env["OTEL_EXPORTER_OTLP_ENDPOINT"] == "http://localhost:4318"
+
+    def test_bundled_collector(self, temp_dir, omni_runner):
+        """Test the collector sidecar, its published ports, and services pointed at it."""
+        from omni_run import load_manifest, Orchestrator, OTEL_COLLECTOR
+
+        manifest = load_manifest(write_manifest(temp_dir, "otel: {collector: true}\nservices:\n  api: {command: 'true'}\n"))
+        collector = manifest.services[OTEL_COLLECTOR]
+        assert collector.sidecar == "jaeger" and list(collector.ports) == ["jaeger", "ui"]
+        assert collector.command[-1] == "jaegertracing/all-in-one:1.57"
+        assert "127.0.0.1:${PORT}:4318" in collector.command and "127.0.0.1:${PORT_UI}:16686" in collector.command
+        assert collector.health.type == "tcp" and collector.env == {"COLLECTOR_OTLP_ENABLED": "true"}
+        api = manifest.services["api"]
+        assert OTEL_COLLECTOR in api.depends_on
+        assert api.env["OTEL_EXPORTER_OTLP_ENDPOINT"] == f"http://${{service.{OTEL_COLLECTOR}.host}}:${{service.{OTEL_COLLECTOR}.port}}"
+
+        orchestrator = Orchestrator(omni_runner, manifest)
+        orchestrator.services[OTEL_COLLECTOR].ports = {"jaeger": 41318, "ui": 41686}
+        assert orchestrator.otel_endpoint() == "http://127.0.0.1:41318"
+        assert orchestrator.resolve_env(api).env["OTEL_EXPORTER_OTLP_ENDPOINT"] == "http://127.0.0.1:41318"
+
+        manifest = load_manifest(write_manifest(temp_dir, "otel: {collector: 'jaegertracing/all-in-one:1.60'}\n"
+                                                          "services:\n  api: {command: 'true'}\n"))
+        assert manifest.services[OTEL_COLLECTOR].command[-1] == "jaegertracing/all-in-one:1.60"
+
+
+@pytest.fixture
+def traced_up(temp_dir, omni_runner, capsys):
+    """A finished `up` exporting to a capture server; yields the server's spans by name, its requests and the output."""
+    from omni_run import load_manifest, Orchestrator
+
+    server = CaptureServer()
+    try:
+        manifest = load_manifest(write_manifest(temp_dir, f"""
+otel: {{endpoint: "{server.url}", headers: {{x-api-key: k}}}}
+services:
+  api:
+    command: ["{sys.executable}", "-c", "import os, time; print('tp', os.environ['TRACEPARENT']); time.sleep(30)"]
+    health: {{command: 'true', interval: 100ms}}
+  once:
+    command: ["{sys.executable}", "-c", "raise SystemExit(3)"]
+"""))
+        orchestrator = Orchestrator(omni_runner, manifest)
+        threading.Timer(1.5, orchestrator.request_shutdown).start()
+        orchestrator.up()
+        assert orchestrator.tracer is None
+    finally:
+        server.close()
+    yield {span["name"]: span for span in server.spans()}, server.requests, capsys.readouterr().out
+
+
+class TestLauncherSpans:
+    """Tests for the spans the launcher exports."""
+
+    def test_exported_resource(self, temp_dir, traced_up):
+        """Test that spans are posted to /v1/traces under the launcher's resource."""
+        _, requests, _ = traced_up
+        assert {path for path, _ in requests} == {"/v1/traces"}
+        resource = attributes(requests[-1][1]["resourceSpans"][0]["resource"])
+        assert resource["service.name"] == "omni-run" and resource["service.namespace"] == temp_dir.name
+
+    def test_spans_under_run(self, traced_up):
+        """Test that start, health and stop spans share the trace of the run's root span."""
+        spans, _, _ = traced_up
+        assert {"omni-run up", "start api", "health api", "stop api", "start once"} <= set(spans)
+        root = spans["omni-run up"]
+        assert "parentSpanId" not in root and len(root["traceId"]) == 32
+        for name in ("start api", "health api", "stop api", "start once"):
+            assert spans[name]["parentSpanId"] == root["spanId"] and spans[name]["traceId"] == root["traceId"]
+
+    def test_start_and_health_spans(self, traced_up):
+        """Test the start span's tags and status, and that the health span follows it."""
+        spans, _, _ = traced_up
+        start = spans["start api"]
+        assert attributes(start)["omni_run.service"] == "api" and attributes(start)["omni_run.operation"] == "start"
+        assert start["status"] == {"code": 1} and spans["health api"]["status"] == {"code": 1}
+        assert int(start["endTimeUnixNano"]) <= int(spans["health api"]["startTimeUnixNano"])
+
+    def test_traceparent(self, traced_up):
+        """Test that a starting service's TRACEPARENT names its start span."""
+        spans, _, out = traced_up
+        assert f"tp 00-{spans['omni-run up']['traceId']}-{spans['start api']['spanId']}-01" in out
+
+    def test_service_without_health_check(self, traced_up):
+        """Test that a service without a health check gets only a start span."""
+        spans, _, _ = traced_up
+        assert "health once" not in spans and spans["start once"]["status"] == {"code": 1}
+
+    def test_events_and_failed_export(self):
+        """Test spans closed with an error by events, and the summary when the collector is unreachable."""
+        from omni_run import OtelTracer, LifecycleEvent
+
+        tracer = OtelTracer(lambda: "http://127.0.0.1:9", "shop", {"api"}, timeout=0.5)
+        tracer.begin("api", "start")
+        assert tracer.traceparent("api").startswith(f"00-{tracer.trace_id}-")
+        tracer(LifecycleEvent("started", "api", pid=42))
+        assert tracer.traceparent("api") is None
+        tracer(LifecycleEvent("crashed", "api", "exited with code 139", exit_code=139))
+        tracer.begin("worker", "start")
+        tracer.close()
+
+        spans = {span.name: span for span in tracer._finished}
+        assert spans["start api"].attributes["process.pid"] == 42
+        assert spans["health api"].error == "exited with code 139"
+        assert spans["start worker"].error == "not finished when the run ended"
+        assert tracer.summary().startswith("otel: 4 span(s) not exported to http://127.0.0.1:9 (last error: ")
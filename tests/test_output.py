@@ -0,0 +1,149 @@
+"""
+Tests for `--output json` in OmniRun.
+
+This module tests:
+- The versioned document envelope and errors reported as JSON
+- JSON from `status`, `detect`, `ports` and `env`
+- Text output of the `detect` and `ports` subcommands
+- Rejecting --output json for commands without machine-readable output
+"""
+
+import os
+import json
+import pytest
+from pathlib import Path
+
+from conftest import *
+
+
+MANIFEST = """
+services:
+  api:
+    command: "true"
+    ports: {http: auto, admin: 9001, grpc: 7000-7010}
+  worker:
+    command: "true"
+"""
+
+
+def run_json(capsys, argv):
+    from omni_run import run_subcommand
+
+    capsys.readouterr()
+    code = run_subcommand(argv + ["--output", "json"])
+    return code, json.loads(capsys.readouterr().out)
+
+
+class TestJsonOutput:
+    """Tests for the JSON documents of each supported command."""
+
+    def _supervised(self, temp_dir, state):
+        from omni_run import write_supervisor_state, SUPERVISOR_PIDFILE
+
+        state_dir = temp_dir / ".omni-run"
+        state_dir.mkdir()
+        write_supervisor_state(state_dir, state)
+        (state_dir / SUPERVISOR_PIDFILE).write_text(str(os.getpid()))
+
+    def _go_service(self, temp_dir):
+        (temp_dir / "svc").mkdir()
+        (temp_dir / "svc" / "go.mod").write_text("module example.com/svc\n\ngo 1.21\n")
+        (temp_dir / "svc" / "main.go").write_text("package main\n\nfunc main() {}\n")
+
+    def test_status_without_supervisor(self, temp_dir, capsys):
+        """Test the document and exit code 3 when no supervisor is running."""
+        from omni_run import OUTPUT_SCHEMA_VERSION
+
+        code, doc = run_json(capsys, ["status", "-C", str(temp_dir)])
+        assert code == 3
+        assert doc == {"schema_version": OUTPUT_SCHEMA_VERSION, "kind": "status",
+                       "supervisor": {"running": False, "pid": None}, "manifest": None, "services": {},
+                       "schedules": {}, "history": {}}
+
+    def test_status(self, temp_dir, capsys):
+        """Test the supervisor and per-service fields of a running stack."""
+        self._supervised(temp_dir, {"manifest": str(temp_dir / "omni-run.yaml"), "services": {
+            "api": {"state": "healthy", "pid": 4242, "exit_code": None, "ports": {"http": 8080},
+                    "started_at": "2026-01-01T10:00:00", "restarts": 1, "restart_history": [{"exit_code": 1}],
+                    "usage": {"cpu": 3.5, "memory": 1024}}}})
+        code, doc = run_json(capsys, ["status", "-C", str(temp_dir)])
+        assert code == 0
+        assert doc["supervisor"] == {"running": True, "pid": os.getpid()}
+        assert doc["services"]["api"] == {"state": "healthy", "pid": 4242, "exit_code": None, "ports": {"http": 8080},
+                                          "started_at": "2026-01-01T10:00:00", "stopped_at": None, "reason": None,
+                                          "restarts": 1, "usage": {"cpu": 3.5, "memory": 1024}, "limits": None,
+                                          "gpus": None, "sidecar": None}
+
+    def test_detect(self, temp_dir, capsys):
+        """Test the detected launch plan."""
+        self._go_service(temp_dir)
+        code, doc = run_json(capsys, ["detect", "-C", str(temp_dir), "svc"])
+        assert code == 0
+        assert doc["kind"] == "detect"
+        assert doc["plan"]["runtime"] == "go"
+        assert doc["plan"]["command"] == ["go", "run", "."]
+        assert doc["plan"]["cwd"] == str((temp_dir / "svc").resolve())
+
+    def test_detect_text(self, temp_dir, capsys):
+        """Test the plan printed without --output json."""
+        from omni_run import run_subcommand
+
+        self._go_service(temp_dir)
+        assert run_subcommand(["detect", "-C", str(temp_dir), "svc"]) == 0
+        out = capsys.readouterr().out
+        assert "go" in out and "run:     go run ." in out
+
+    def test_detect_nothing(self, temp_dir, capsys):
+        """Test a null plan with exit code 1 for a directory with nothing to run."""
+        (temp_dir / "empty").mkdir()
+        code, doc = run_json(capsys, ["detect", "-C", str(temp_dir), "empty"])
+        assert (code, doc["plan"]) == (1, None)
+
+    def test_ports(self, temp_dir, capsys):
+        """Test each port's declared strategy and variable before a stack runs."""
+        (temp_dir / "omni-run.yaml").write_text(MANIFEST)
+        code, doc = run_json(capsys, ["ports", "-C", str(temp_dir)])
+        assert code == 0 and doc["running"] is False
+        assert [(p["name"], p["strategy"], p["declared"], p["env"], p["port"]) for p in doc["ports"]] == [
+            ("http", "auto", "auto", "PORT_HTTP", None),
+            ("admin", "fixed", "9001", "PORT_ADMIN", None),
+            ("grpc", "range", "7000-7010", "PORT_GRPC", None)]
+
+    def test_ports_of_running_stack(self, temp_dir, capsys):
+        """Test the ports recorded by a running stack, as JSON and as text."""
+        from omni_run import run_subcommand
+
+        (temp_dir / "omni-run.yaml").write_text(MANIFEST)
+        self._supervised(temp_dir, {"services": {"api": {"state": "running", "ports": {"http": 51234}}}})
+        code, doc = run_json(capsys, ["ports", "-C", str(temp_dir)])
+        assert doc["running"] is True
+        assert doc["ports"][0]["port"] == 51234
+
+        assert run_subcommand(["ports", "-C", str(temp_dir)]) == 0
+        out = capsys.readouterr().out
+        assert "PORT_ADMIN" in out and "51234" in out
+
+    def test_env(self, temp_dir, capsys):
+        """Test layers and variables with their sources, masking secrets."""
+        (temp_dir / ".env").write_text("GREETING=hello\n")
+        (temp_dir / ".env.local").write_text("GREETING=hi\nDEBUG=1\n")
+        code, doc = run_json(capsys, ["env", "-C", str(temp_dir)])
+        assert code == 0
+        assert doc["layers"] == [str(temp_dir / ".env"), str(temp_dir / ".env.local")]
+        assert doc["variables"]["GREETING"] == {"value": "hi", "source": ".env.local", "secret": False}
+        assert doc["variables"]["DEBUG"]["value"] == "1"
+        assert "PATH" not in doc["variables"]
+
+    def test_errors_and_unsupported_commands(self, temp_dir, capsys):
+        """Test that failures are JSON documents and other commands refuse --output json."""
+        from omni_run import run_subcommand, hoist_subcommand
+
+        (temp_dir / "omni-run.yaml").write_text(MANIFEST)
+        code, doc = run_json(capsys, ["env", "-C", str(temp_dir), "missing"])
+        assert code == 1
+        assert doc["kind"] == "error" and doc["error"] == "Unknown service 'missing'"
+
+        argv = hoist_subcommand(["--output", "json", "up", "-C", str(temp_dir)], {"up"})
+        assert argv == ["up", "--output", "json", "-C", str(temp_dir)]
+        assert run_subcommand(argv) == 2
+        assert "--output json is not supported by `up`" in capsys.readouterr().out
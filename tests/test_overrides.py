@@ -0,0 +1,138 @@
+"""
+Tests for overriding manifest fields in OmniRun.
+
+This module tests:
+- Parsing config paths and `--set PATH=VALUE` arguments
+- Reading OMNI_RUN_* variables as overrides
+- Setting values with type coercion, list indexes and new keys
+- Precedence over profiles and schema errors for bad overrides
+- `--set` and OMNI_RUN_* variables from the command line
+"""
+
+import pytest
+from pathlib import Path
+
+from conftest import *
+
+
+MANIFEST = """
+services:
+  api-gateway:
+    command: go run .
+    env:
+      LOG_LEVEL: debug
+    stop_timeout: 5s
+  worker:
+    command: [./worker, --queue, default]
+profiles:
+  prod:
+    services:
+      api-gateway:
+        env:
+          LOG_LEVEL: warn
+"""
+
+
+class TestOverrideParsing:
+    """Tests for reading overrides from arguments and variables."""
+
+    def test_config_paths(self):
+        """Test dotted keys, list indexes and quoted keys containing dots."""
+        from omni_run import parse_config_path
+
+        assert parse_config_path("services.api.env.DEBUG") == ["services", "api", "env", "DEBUG"]
+        assert parse_config_path("services.worker.command[2]") == ["services", "worker", "command", 2]
+        assert parse_config_path('proxy.routes["api.localhost"].port') == ["proxy", "routes", "api.localhost", "port"]
+        for text in ["", "services..api", "services.api["]:
+            with pytest.raises(ValueError):
+                parse_config_path(text)
+
+    def test_set_arguments(self):
+        """Test splitting on the first `=` and errors for arguments without one."""
+        from omni_run import parse_set_override, ManifestError
+
+        override = parse_set_override("services.api.env.URL=postgres://db?sslmode=off")
+        assert override.path == ["services", "api", "env", "URL"]
+        assert override.value == "postgres://db?sslmode=off" and override.source == "--set services.api.env.URL"
+        assert parse_set_override("services.api.env.EMPTY=").value == ""
+        for text in ["services.api.env.DEBUG", "=true", "services..api=1"]:
+            with pytest.raises(ManifestError, match=f"--set {text}"):
+                parse_set_override(text)
+
+    def test_environment_variables(self):
+        """Test that only variables naming a top-level manifest key become overrides."""
+        from omni_run import env_overrides
+
+        overrides = env_overrides({"OMNI_RUN_SERVICES__API_GATEWAY__ENV__DEBUG": "yes",
+                                   "OMNI_RUN_STARTUP_TIMEOUT": "2m", "OMNI_RUN_PROFILE": "prod",
+                                   "OMNI_RUN_TASK": "build", "OMNI_RUN_SERVICES____ENV": "x", "PATH": "/bin"})
+        assert [(o.path, o.value, o.loose) for o in overrides] == [
+            (["SERVICES", "API_GATEWAY", "ENV", "DEBUG"], "yes", True), (["STARTUP_TIMEOUT"], "2m", True)]
+
+
+class TestApplyingOverrides:
+    """Tests for setting overridden values in a manifest."""
+
+    def _load(self, temp_dir, *sets, environ=None, profile=None, content=MANIFEST):
+        from omni_run import load_manifest, parse_set_override, env_overrides
+
+        overrides = env_overrides(environ or {}) + [parse_set_override(s) for s in sets]
+        return load_manifest(write_manifest(temp_dir, content), profile, overrides)
+
+    def test_coercion(self, temp_dir):
+        """Test YAML values for typed fields, env values kept verbatim and strings where the schema wants one."""
+        manifest = self._load(temp_dir, "services.api-gateway.stop_timeout=30", "services.api-gateway.env.DEBUG=true",
+                              "services.api-gateway.env.GO_VERSION=1.10", "services.api-gateway.command=true",
+                              "services.worker.restart.max_restarts=3")
+        api, worker = manifest.services["api-gateway"], manifest.services["worker"]
+        assert api.stop_timeout == 30
+        assert api.env["DEBUG"] == "true" and api.env["GO_VERSION"] == "1.10" and api.env["LOG_LEVEL"] == "debug"
+        assert api.command == "true"
+        assert worker.restart.max_restarts == 3
+
+    def test_lists_and_new_keys(self, temp_dir):
+        """Test replacing and appending list items, and creating mappings along the path."""
+        manifest = self._load(temp_dir, "services.worker.command[2]=emails", "services.worker.command[3]=--verbose",
+                              "services.worker.env.QUEUE=emails")
+        worker = manifest.services["worker"]
+        assert worker.command == ["./worker", "--queue", "emails", "--verbose"]
+        assert worker.env == {"QUEUE": "emails"}
+
+    def test_precedence(self, temp_dir):
+        """Test that variables win over the profile and --set wins over variables."""
+        environ = {"OMNI_RUN_SERVICES__API_GATEWAY__ENV__LOG_LEVEL": "info",
+                   "OMNI_RUN_SERVICES__API_GATEWAY__ENV__REGION": "eu"}
+        manifest = self._load(temp_dir, environ=environ, profile="prod")
+        assert manifest.services["api-gateway"].env["LOG_LEVEL"] == "info"
+        manifest = self._load(temp_dir, "services.api-gateway.env.LOG_LEVEL=trace", environ=environ, profile="prod")
+        env = manifest.services["api-gateway"].env
+        assert env["LOG_LEVEL"] == "trace" and env["REGION"] == "eu"
+
+    def test_invalid_overrides(self, temp_dir):
+        """Test schema errors for the overridden manifest and paths through scalars or past a list's end."""
+        from omni_run import ManifestError
+
+        for args, message in [(["services.api-gateway.stop_timeout=soon"], "services.api-gateway.stop.timeout"),
+                              (["services.api-gateway.command.args=x"], "command is string .go run .., not a mapping"),
+                              (["services.worker.command[7]=x"], "has 3 item"),
+                              (["services.api-gateway.colour=red"], "with overrides")]:
+            with pytest.raises(ManifestError, match=message):
+                self._load(temp_dir, *args)
+
+
+class TestOverridesFromCommandLine:
+    """Tests for --set and OMNI_RUN_* variables reaching subcommands."""
+
+    def test_set_and_environment(self, temp_dir, capsys, monkeypatch):
+        """Test `env --resolve` with --set, a variable and a malformed --set."""
+        from omni_run import run_subcommand
+
+        write_manifest(temp_dir, MANIFEST)
+        monkeypatch.setenv("OMNI_RUN_SERVICES__API_GATEWAY__ENV__REGION", "eu")
+        assert run_subcommand(["env", "api-gateway", "--resolve", "-C", str(temp_dir),
+                               "--set", "services.api-gateway.env.LOG_LEVEL=trace"]) == 0
+        out = capsys.readouterr().out
+        assert "LOG_LEVEL=trace" in out and "REGION=eu" in out
+
+        assert run_subcommand(["env", "api-gateway", "--resolve", "-C", str(temp_dir), "--set", "LOG_LEVEL"]) == 2
+        assert "expected PATH=VALUE" in capsys.readouterr().out
@@ -0,0 +1,238 @@
+"""
+Tests for `omni-run build` and packages in OmniRun.
+
+This module tests:
+- Cross-compiling Go (GOOS/GOARCH) and Rust (--target) builds for another platform
+- The trimmed manifest a package runs, and the notes about what was left out
+- `build --package` tarballs and `run-package` unpacking and running one, or refusing another platform's
+- `--format oci` image layouts
+"""
+
+import os
+import sys
+import json
+import tarfile
+import hashlib
+import pytest
+from pathlib import Path
+
+from conftest import *
+
+
+FAKE_GO = """#!/bin/sh
+if [ "$1" = version ]; then echo "go version go1.22.0 fake"; exit 0; fi
+printf '#!/bin/sh\\necho "api built for %s/%s cgo=%s port $PORT"\\n' "${GOOS:-host}" "${GOARCH:-host}" "${CGO_ENABLED:-unset}" > "$3"
+chmod +x "$3"
+"""
+
+MANIFEST = """
+services:
+  api:
+    path: api
+    ports: 8080
+    env: {MODE: prod, DB: "${service.db.url}"}
+    env_file: api.env
+    depends_on: [db, web]
+    restart: never
+  web:
+    command: python3 -m http.server
+sidecars:
+  db: postgres:16
+tasks:
+  migrate: ./migrate.sh
+"""
+
+
+def go_project(temp_dir: Path, monkeypatch):
+    """An api/ Go project built by a fake `go` that records the platform it was built for."""
+    api = temp_dir / "api"
+    api.mkdir()
+    (api / "go.mod").write_text("module api\n\ngo 1.22\n")
+    (api / "main.go").write_text("package main\n")
+    (api / "api.env").write_text("X=1\n")
+    bin_dir = temp_dir / "bin"
+    bin_dir.mkdir()
+    (bin_dir / "go").write_text(FAKE_GO)
+    (bin_dir / "go").chmod(0o755)
+    monkeypatch.setenv("PATH", f"{bin_dir}{os.pathsep}{os.environ['PATH']}")
+    (temp_dir / "config.yaml").write_text(f"build_cache:\n  dir: {temp_dir / 'cache'}\n")
+
+
+class TestCrossRecipes:
+    """Tests for builds targeting another platform."""
+
+    def test_go_and_rust(self, temp_dir):
+        """Test GOOS/GOARCH and cgo for Go, --target and the produced path for Rust, and unknown targets."""
+        from omni_run import BuildRecipe, BuildError, cross_recipe, host_platform
+
+        go = BuildRecipe("go", temp_dir, ["go", "build", "-o", os.path.join("{out}", "api"), "."], ["{out}"], "api")
+        assert cross_recipe(go, host_platform(), {"PATH": "/bin"}) == (go, {"PATH": "/bin"})
+        recipe, env = cross_recipe(go, "windows/arm64", {"PATH": "/bin"})
+        assert recipe.build == ["go", "build", "-o", os.path.join("{out}", "api.exe"), "."] and recipe.output == "api.exe"
+        assert env == {"PATH": "/bin", "GOOS": "windows", "GOARCH": "arm64", "CGO_ENABLED": "0"}
+        assert cross_recipe(go, "linux/riscv64", {"CGO_ENABLED": "1"})[1]["CGO_ENABLED"] == "1"
+
+        target = temp_dir / "target"
+        rust = BuildRecipe("rust", temp_dir, ["cargo", "build", "--release"], ["{out}"], "app", produced=target / "release" / "app")
+        other = "darwin/arm64" if host_platform() != "darwin/arm64" else "linux/arm64"
+        recipe, _ = cross_recipe(rust, other, {})
+        triple = recipe.build[-1]
+        assert recipe.build == ["cargo", "build", "--release", "--target", triple] and triple.startswith("aarch64-")
+        assert recipe.produced == target / triple / "release" / "app"
+        with pytest.raises(BuildError, match="no Rust target known for plan9/386"):
+            cross_recipe(rust, "plan9/386", {})
+
+
+class TestPackageManifest:
+    """Tests for the manifest written into a package."""
+
+    def test_trimmed_manifest(self, temp_dir):
+        """Test artifact commands, kept and dropped keys, sidecars, dependencies and notes."""
+        from omni_run import load_manifest, package_manifest, BuildRecipe, MANIFEST_VERSION
+
+        (temp_dir / "api").mkdir()
+        (temp_dir / "api" / "api.env").write_text("X=1\n")
+        manifest = load_manifest(write_manifest(temp_dir, MANIFEST))
+        built = {"api": (BuildRecipe("go", temp_dir / "api", [], ["{out}", "--verbose"], "api"), temp_dir / "x")}
+        data, notes = package_manifest(manifest, built, ["db", "web", "api"])
+
+        assert list(data) == ["version", "services", "sidecars"] and data["version"] == MANIFEST_VERSION
+        assert data["services"] == {"api": {"path": "artifacts/api", "command": ["./api", "--verbose"], "ports": 8080,
+                                            "env": {"MODE": "prod", "DB": "${service.db.url}"},
+                                            "depends_on": ["db"], "restart": "never"}}
+        assert data["sidecars"] == {"db": "postgres:16"}
+        assert notes == ["tasks: not packaged (needs the source tree)",
+                         "services.api.env_file: not packaged (names files in the source tree)",
+                         "services.api: depends_on web dropped (not packaged)"]
+
+
+@pytest.mark.skipif(sys.platform == "win32", reason="The fake compiler is a shell script")
+class TestBuildCommand:
+    """Tests for `omni-run build` and `omni-run run-package`."""
+
+    def _stack(self, temp_dir, monkeypatch):
+        go_project(temp_dir, monkeypatch)
+        write_manifest(temp_dir, MANIFEST.replace("[db, web]", "[web]").replace("${service.db.url}", "x")
+                       .replace("sidecars:\n  db: postgres:16\n", ""))
+        return ["-C", str(temp_dir), "--config", str(temp_dir / "config.yaml")]
+
+    def test_build(self, temp_dir, capsys, monkeypatch):
+        """Test building services for this machine without packaging them."""
+        from omni_run import run_subcommand, ANSI_ESCAPE, host_platform
+
+        assert run_subcommand(["build"] + self._stack(temp_dir, monkeypatch)) == 0
+        out = ANSI_ESCAPE.sub("", capsys.readouterr().out)
+        assert f"api: built api for {host_platform()}" in out
+        assert "web: no build step (it sets command:)" in out and "Wrote" not in out
+
+    def test_package(self, temp_dir, capsys, monkeypatch):
+        """Test the package's files and metadata, reusing the cached build."""
+        from omni_run import run_subcommand, ANSI_ESCAPE, host_platform, PACKAGE_FILE
+
+        root = self._stack(temp_dir, monkeypatch)
+        assert run_subcommand(["build"] + root) == 0
+        capsys.readouterr()
+        assert run_subcommand(["build", "--package", str(temp_dir / "stack.tar.gz")] + root) == 0
+        out = ANSI_ESCAPE.sub("", capsys.readouterr().out)
+        assert "build cache hit" in out and f"Wrote {temp_dir / 'stack.tar.gz'}" in out
+        assert "  - web: no build step (it sets command:); not packaged\n" in out
+        with tarfile.open(temp_dir / "stack.tar.gz") as archive:
+            assert sorted(archive.getnames()) == ["artifacts/api/api", PACKAGE_FILE, "omni-run.yaml"]
+            metadata = json.load(archive.extractfile(PACKAGE_FILE))
+        assert metadata["platform"] == host_platform()
+        assert metadata["services"] == {"api": {"runtime": "go", "artifact": "artifacts/api/api"}}
+
+    def test_run_package(self, temp_dir, capsys, monkeypatch):
+        """Test unpacking and running a package, and running the unpacked directory again."""
+        from omni_run import run_subcommand
+
+        assert run_subcommand(["build", "--package", str(temp_dir / "stack.tar.gz")] + self._stack(temp_dir, monkeypatch)) == 0
+        capsys.readouterr()
+        server = temp_dir / "server"
+        server.mkdir()
+        assert run_subcommand(["run-package", str(temp_dir / "stack.tar.gz"), "-C", str(server)]) == 0
+        assert "api built for host/host cgo=unset port 8080" in capsys.readouterr().out
+        unpacked = server / ".omni-run" / "packages" / "stack"
+        assert (unpacked / "artifacts" / "api" / "api").exists() and (unpacked / ".omni-run").is_dir()
+        assert run_subcommand(["run-package", str(unpacked), "-C", str(server)]) == 0
+
+    def test_other_platform(self, temp_dir, capsys, monkeypatch):
+        """Test cross-building a package for another platform, which this machine refuses to run."""
+        from omni_run import run_subcommand, host_platform
+
+        other = "linux/arm64" if host_platform() != "linux/arm64" else "linux/amd64"
+        assert run_subcommand(["build", "--package", "--platform", other] + self._stack(temp_dir, monkeypatch)) == 0
+        package = temp_dir / f"{temp_dir.name}-{other.replace('/', '-')}.tar.gz"
+        with tarfile.open(package) as archive:
+            assert f"built for {other} cgo=0" in archive.extractfile("artifacts/api/api").read().decode()
+        capsys.readouterr()
+        assert run_subcommand(["run-package", str(package), "-C", str(temp_dir)]) == 1
+        assert f"was built for {other}; this machine is {host_platform()}" in capsys.readouterr().out
+
+    def test_invalid_arguments(self, temp_dir, capsys, monkeypatch):
+        """Test running a directory that isn't a package, and a platform without an architecture."""
+        from omni_run import run_subcommand
+
+        root = self._stack(temp_dir, monkeypatch)
+        assert run_subcommand(["run-package", str(temp_dir / "api"), "-C", str(temp_dir)]) == 1
+        assert "api: not an omni-run package" in capsys.readouterr().out
+        assert run_subcommand(["build", "--platform", "linux"] + root) == 2
+
+    def test_run_package_options(self):
+        """Test that run-package takes the options of `up`, with the same defaults."""
+        from omni_run import build_subcommand_parser
+
+        parser, _ = build_subcommand_parser()
+        up = vars(parser.parse_args(["up", "api", "--startup-budget", "30s", "--tag", "core"]))
+        run = vars(parser.parse_args(["run-package", "stack.tar.gz", "api", "--startup-budget", "30s", "--tag", "core"]))
+        assert (run.pop("package"), run.pop("dir"), run.pop("func").__name__) == ("stack.tar.gz", None, "cmd_run_package")
+        assert dict(run, command="up", func=up["func"]) == up
+
+    def _image(self, temp_dir, monkeypatch, capsys):
+        from omni_run import run_subcommand, host_platform
+
+        go_project(temp_dir, monkeypatch)
+        write_manifest(temp_dir, "services:\n  api:\n    path: api\n    ports: 8080\n    env: {MODE: prod}\n"
+                                 "  worker:\n    path: api\n")
+        root = ["-C", str(temp_dir), "--config", str(temp_dir / "config.yaml")]
+        assert run_subcommand(["build", "api", "--package", "--format", "oci"] + root) == 0
+        capsys.readouterr()
+        return tarfile.open(temp_dir / f"{temp_dir.name}-api-{host_platform().replace('/', '-')}.oci.tar")
+
+    def test_oci_several_services(self, temp_dir, capsys, monkeypatch):
+        """Test that an image is refused when more than one service is built."""
+        from omni_run import run_subcommand
+
+        go_project(temp_dir, monkeypatch)
+        write_manifest(temp_dir, "services:\n  api: {path: api}\n  worker: {path: api}\n")
+        assert run_subcommand(["build", "--package", "--format", "oci", "-C", str(temp_dir),
+                               "--config", str(temp_dir / "config.yaml")]) == 1
+        assert "--format oci packages one service (2 built: api, worker)" in capsys.readouterr().out
+
+    def test_oci_layout(self, temp_dir, capsys, monkeypatch):
+        """Test the image layout, its index entry and the manifest's digest."""
+        with self._image(temp_dir, monkeypatch, capsys) as archive:
+            assert json.load(archive.extractfile("oci-layout")) == {"imageLayoutVersion": "1.0.0"}
+            entry = json.load(archive.extractfile("index.json"))["manifests"][0]
+            manifest_bytes = archive.extractfile(f"blobs/sha256/{entry['digest'].split(':')[1]}").read()
+        assert entry["annotations"]["org.opencontainers.image.ref.name"] == f"{temp_dir.name}-api:latest"
+        assert "sha256:" + hashlib.sha256(manifest_bytes).hexdigest() == entry["digest"]
+
+    def test_oci_config(self, temp_dir, capsys, monkeypatch):
+        """Test the image config's platform, entrypoint, env and ports, and its one layer."""
+        import gzip
+        import io
+        from omni_run import host_platform
+
+        with self._image(temp_dir, monkeypatch, capsys) as archive:
+            blob = lambda digest: archive.extractfile(f"blobs/sha256/{digest.split(':')[1]}").read()
+            manifest = json.loads(blob(json.load(archive.extractfile("index.json"))["manifests"][0]["digest"]))
+            config = json.loads(blob(manifest["config"]["digest"]))
+            layer = blob(manifest["layers"][0]["digest"])
+        assert (config["os"], config["architecture"]) == tuple(host_platform().split("/"))
+        assert config["config"]["Entrypoint"] == ["/app/api"]
+        assert config["config"]["Env"] == ["PORT=8080", "PORT_HTTP=8080", "MODE=prod"]
+        assert config["config"]["ExposedPorts"] == {"8080/tcp": {}}
+        with tarfile.open(fileobj=io.BytesIO(gzip.decompress(layer))) as files:
+            assert files.getnames() == ["app/api"]
+        assert config["rootfs"]["diff_ids"] == ["sha256:" + hashlib.sha256(gzip.decompress(layer)).hexdigest()]
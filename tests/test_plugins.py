@@ -0,0 +1,185 @@
+"""
+Tests for runtime detector plugins in OmniRun.
+
+This module tests:
+- Built-in detector registration and ordering
+- Python plugins registering Detector/Runner classes
+- External plugins speaking JSON over stdin/stdout
+- The `plugins list` command
+"""
+
+import os
+import sys
+import pytest
+from pathlib import Path
+
+from conftest import *
+
+
+PYTHON_PLUGIN = '''
+"""Detects projects marked with a .acme file."""
+from omni_run import Detector, Runner, LaunchPlan
+
+PLUGIN_NAME = "acme"
+PLUGIN_VERSION = "1.2"
+
+
+class AcmeDetector(Detector):
+    name = "acme"
+
+    def detect(self, launcher, path):
+        if (path / ".acme").exists():
+            return LaunchPlan(runtime="acme", command=["acme", "serve"], cwd=path)
+        return None
+
+
+class AcmeRunner(Runner):
+    name = "acme"
+    runtimes = ["acme"]
+
+    def prepare(self, launcher, plan):
+        plan.env["ACME_MODE"] = "dev"
+        return plan
+
+
+def register(registry):
+    registry.add_detector(AcmeDetector())
+    registry.add_runner(AcmeRunner())
+'''
+
+EXTERNAL_PLUGIN = '''#!{python}
+import json, os, sys
+
+request = json.load(sys.stdin)
+if request["action"] == "describe":
+    print(json.dumps({{"name": "zig", "version": "0.1", "runtimes": ["zig"], "capabilities": ["detect"]}}))
+elif request["action"] == "detect":
+    if os.path.exists(os.path.join(request["path"], "build.zig")):
+        print(json.dumps({{"plan": {{"runtime": "zig", "command": ["zig", "build", "run"]}}}}))
+    else:
+        print(json.dumps({{"plan": None}}))
+'''
+
+
+def make_launcher(temp_dir: Path, plugin_dir: Path):
+    from omni_run import OmniRun
+    launcher = OmniRun(str(temp_dir))
+    launcher.config['plugins'] = {'enabled': True, 'dirs': [str(plugin_dir)]}
+    return launcher
+
+
+class TestBuiltinDetectors:
+    """Tests for the default registry."""
+
+    def test_default_registry_order(self):
+        """Test that Cargo is tried before Go modules."""
+        from omni_run import PluginRegistry
+
+        names = [d.name for d in PluginRegistry.default().detectors()]
+
+        assert names == ["cargo", "go", "node", "python", "java", "dotnet", "php", "ruby", "static"]
+
+    def test_builtin_go_detection_through_registry(self, temp_dir):
+        """Test that runtime detection still finds Go modules."""
+        from omni_run import OmniRun
+
+        (temp_dir / "go.mod").write_text("module example.com/app\n")
+        plan = OmniRun(str(temp_dir)).detect_runtime(temp_dir)
+
+        assert plan.runtime == "go"
+
+
+class TestPythonPlugins:
+    """Tests for plugins written as Python modules."""
+
+    def test_detector_and_runner(self, temp_dir):
+        """Test that a Python plugin detects its runtime and prepares the plan."""
+        plugin_dir = temp_dir / "plugins"
+        plugin_dir.mkdir()
+        (plugin_dir / "acme.py").write_text(PYTHON_PLUGIN)
+        (temp_dir / ".acme").touch()
+
+        plan = make_launcher(temp_dir, plugin_dir).detect_runtime(temp_dir)
+
+        assert plan.runtime == "acme"
+        assert plan.command == ["acme", "serve"]
+        assert plan.env["ACME_MODE"] == "dev"
+
+    def test_plugin_metadata(self, temp_dir):
+        """Test that plugin name, version and description are recorded."""
+        plugin_dir = temp_dir / "plugins"
+        plugin_dir.mkdir()
+        (plugin_dir / "acme.py").write_text(PYTHON_PLUGIN)
+
+        info = make_launcher(temp_dir, plugin_dir).plugins.plugins[-1]
+
+        assert (info.name, info.kind, info.version) == ("acme", "python", "1.2")
+        assert info.provides == ["detect", "prepare"]
+        assert info.description == "Detects projects marked with a .acme file."
+
+    def test_broken_plugin_is_reported(self, temp_dir):
+        """Test that a plugin without register() is reported, not fatal."""
+        plugin_dir = temp_dir / "plugins"
+        plugin_dir.mkdir()
+        (plugin_dir / "broken.py").write_text("x = 1\n")
+
+        registry = make_launcher(temp_dir, plugin_dir).plugins
+
+        assert any("missing register" in e for e in registry.errors)
+        assert [d.name for d in registry.detectors()] == ["cargo", "go", "node", "python", "java", "dotnet", "php", "ruby", "static"]
+
+
+@pytest.mark.skipif(sys.platform == "win32", reason="Executable plugins use a shebang")
+class TestExternalPlugins:
+    """Tests for executable plugins using the JSON protocol."""
+
+    def _install(self, plugin_dir: Path) -> Path:
+        plugin_dir.mkdir()
+        path = plugin_dir / "omni-run-zig"
+        path.write_text(EXTERNAL_PLUGIN.format(python=sys.executable))
+        path.chmod(0o755)
+        return path
+
+    def test_external_detect(self, temp_dir):
+        """Test that an external plugin's plan is used."""
+        self._install(temp_dir / "plugins")
+        (temp_dir / "build.zig").touch()
+
+        plan = make_launcher(temp_dir, temp_dir / "plugins").detect_runtime(temp_dir)
+
+        assert plan.runtime == "zig"
+        assert plan.command == ["zig", "build", "run"]
+        assert plan.cwd == temp_dir.resolve()
+
+    def test_external_no_match(self, temp_dir):
+        """Test that a plugin returning no plan falls through to nothing."""
+        self._install(temp_dir / "plugins")
+
+        assert make_launcher(temp_dir, temp_dir / "plugins").detect_runtime(temp_dir) is None
+
+    def test_invalid_response(self, temp_dir):
+        """Test that malformed plugin output raises PluginError."""
+        from omni_run import ExternalPlugin, PluginError
+
+        path = temp_dir / "bad-plugin"
+        path.write_text(f"#!{sys.executable}\nprint('not json')\n")
+        path.chmod(0o755)
+
+        with pytest.raises(PluginError, match="invalid JSON"):
+            ExternalPlugin(path)
+
+    def test_plugins_list_command(self, temp_dir, capsys):
+        """Test that `plugins list` shows built-in and external plugins."""
+        from omni_run import cmd_plugins
+
+        self._install(temp_dir / "plugins")
+        launcher = make_launcher(temp_dir, temp_dir / "plugins")
+
+        class Args:
+            verbose = False
+
+        assert cmd_plugins(launcher, Args()) == 0
+        out = capsys.readouterr().out
+        assert "cargo" in out
+        assert "zig" in out
+        assert "external" in out
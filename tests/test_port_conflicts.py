@@ -0,0 +1,232 @@
+"""
+Tests for port-conflict strategies (`conflict:` and `port_conflict:`) in OmniRun.
+
+This module tests:
+- Parsing the strategies per port and per service, the older `fallback:`, and invalid combinations
+- auto, increment, fail and reuseport when a fixed port is taken, and the owner named in the error
+- kill: stopping the process that has the port once confirmed, and not without an answer
+- `omni-run ports` listing fixed ports that are taken
+"""
+
+import os
+import sys
+import json
+import socket
+import subprocess
+import time
+import pytest
+from pathlib import Path
+
+from conftest import *
+
+
+def listen(reuse_port: bool = False) -> socket.socket:
+    sock = socket.socket(socket.AF_INET, socket.SOCK_STREAM)
+    if reuse_port:
+        sock.setsockopt(socket.SOL_SOCKET, socket.SO_REUSEPORT, 1)
+    sock.bind(("127.0.0.1", 0))
+    sock.listen(1)
+    return sock
+
+
+@pytest.fixture
+def port_owner():
+    """Another process listening on a free port; yields (process, port)."""
+    from omni_run import PortAllocator
+
+    port = PortAllocator().free_port()
+    server = f"import socket, time; s = socket.create_server(('127.0.0.1', {port})); print('up', flush=True); " \
+             f"time.sleep(60)"
+    owner = subprocess.Popen([sys.executable, "-c", server], stdout=subprocess.PIPE)
+    try:
+        assert owner.stdout.readline() == b"up\n"
+        yield owner, port
+    finally:
+        owner.kill()
+        owner.wait()
+
+
+class TestConflictSpec:
+    """Tests for parsing conflict strategies."""
+
+    def test_parse(self, temp_dir):
+        """Test a service's default, a port's own strategy, fallback: and ports it doesn't apply to."""
+        from omni_run import load_manifest
+
+        write_manifest(temp_dir, """
+services:
+  api:
+    port_conflict: increment
+    ports:
+      http: 8080
+      db: {port: 5432, conflict: kill}
+      admin: auto
+  web:
+    ports:
+      http: {port: 3000, socket: true, conflict: reuseport}
+      old: {port: 3001, fallback: false}
+""")
+        services = load_manifest(temp_dir / "omni-run.yaml").services
+        api, web = services["api"].ports, services["web"].ports
+        assert (api["http"].conflict, api["db"].conflict, api["admin"].conflict) == ("increment", "kill", "auto")
+        assert web["http"].conflict == "reuseport" and (web["old"].conflict, web["old"].fallback) == ("fail", False)
+        assert api["http"].fallback
+
+    def test_errors(self, temp_dir):
+        """Test unknown strategies, a strategy on a port that isn't fixed, and reuseport without socket: true."""
+        from omni_run import load_manifest, ManifestError
+
+        for block, message in [("{port_conflict: wait, ports: {http: 8080}}",
+                                "services.api.port_conflict: expected one of auto, increment, fail, kill, reuseport"),
+                               ("{ports: {http: {port: 8080, conflict: steal}}}",
+                                "services.api.ports.http.conflict: expected one of"),
+                               ("{ports: {http: {port: auto, conflict: kill}}}",
+                                "services.api.ports.http.conflict: only applies to a fixed port"),
+                               ("{port_conflict: reuseport, ports: {http: 8080}}",
+                                "services.api.ports.http.conflict: reuseport needs socket: true")]:
+            write_manifest(temp_dir, f"services:\n  api: {block}\n")
+            with pytest.raises(ManifestError, match=message):
+                load_manifest(temp_dir / "omni-run.yaml")
+
+
+class TestConflictAllocation:
+    """Tests for what a taken fixed port gets."""
+
+    def test_auto(self, busy_port):
+        """Test that a taken fixed port gets a free one by default."""
+        from omni_run import PortAllocator, PortSpec
+
+        assert PortAllocator().allocate("api", PortSpec(name="http", strategy="fixed", port=busy_port)) != busy_port
+
+    def _incremented(self, allocator, busy_port):
+        from omni_run import PortSpec
+
+        allocator.reserved.add(busy_port + 1)
+        return allocator.allocate("api", PortSpec(name="http", strategy="fixed", port=busy_port, conflict="increment"))
+
+    def test_increment(self, busy_port):
+        """Test counting up past taken and reserved ports."""
+        from omni_run import PortAllocator
+
+        assert busy_port + 1 < self._incremented(PortAllocator(), busy_port) <= busy_port + 100
+
+    def test_fail(self, busy_port):
+        """Test that fail raises, naming the owner where it can be found."""
+        from omni_run import PortAllocator, PortSpec, PortConflict
+
+        with pytest.raises(PortConflict) as failed:
+            PortAllocator().allocate("api", PortSpec(name="http", strategy="fixed", port=busy_port, conflict="fail"))
+        assert failed.value.port == busy_port
+        if sys.platform.startswith("linux"):
+            assert failed.value.owner[0] == os.getpid()
+            assert f"port {busy_port} is already in use by pid {os.getpid()} (" in str(failed.value)
+
+    def test_taken_by_stack(self, busy_port):
+        """Test that a port given to another service of the stack is named as such."""
+        from omni_run import PortAllocator, PortSpec, PortConflict
+
+        allocator = PortAllocator()
+        incremented = self._incremented(allocator, busy_port)
+        with pytest.raises(PortConflict, match="by another service of this stack"):
+            allocator.allocate("web", PortSpec(name="http", strategy="fixed", port=incremented, conflict="fail"))
+
+    @pytest.mark.skipif(not hasattr(socket, "SO_REUSEPORT") or sys.platform == "win32", reason="Needs SO_REUSEPORT")
+    def test_reuseport(self):
+        """Test sharing a port whose listener set SO_REUSEPORT, and refusing one that didn't."""
+        from omni_run import PortAllocator, PortSpec, PortConflict, bind_listener
+
+        shared, plain = listen(reuse_port=True), listen()
+        try:
+            allocator = PortAllocator()
+            port = shared.getsockname()[1]
+            assert allocator.allocate("web", PortSpec(name="http", strategy="fixed", port=port, socket=True,
+                                                      conflict="reuseport")) == port
+            bind_listener(port, reuse_port=True).close()
+            with pytest.raises(PortConflict, match="which doesn't share it"):
+                allocator.allocate("web", PortSpec(name="http", strategy="fixed", port=plain.getsockname()[1],
+                                                   socket=True, conflict="reuseport"))
+        finally:
+            shared.close()
+            plain.close()
+
+
+@pytest.mark.skipif(not sys.platform.startswith("linux"), reason="Finds the owner in /proc")
+class TestConflictKill:
+    """Tests for `conflict: kill`."""
+
+    def _api(self, temp_dir, omni_runner, port):
+        from omni_run import load_manifest, Orchestrator
+
+        write_manifest(temp_dir, f"services:\n  api:\n    command: ./api\n"
+                                 f"    ports: {{http: {{port: {port}, conflict: kill}}}}\n")
+        orchestrator = Orchestrator(omni_runner, load_manifest(temp_dir / "omni-run.yaml"))
+        return orchestrator, orchestrator.services["api"]
+
+    def test_no_terminal(self, temp_dir, omni_runner, port_owner, monkeypatch):
+        """Test that the owner is left running when nobody can be asked."""
+        import omni_run
+        from omni_run import ManifestError
+
+        owner, port = port_owner
+        orchestrator, api = self._api(temp_dir, omni_runner, port)
+        monkeypatch.setattr(omni_run, "ask_yes_no", lambda question: None)
+        with pytest.raises(ManifestError, match=f"port {port} is already in use by pid {owner.pid} .*; "
+                                                f"not stopped without a terminal to confirm on"):
+            orchestrator.allocate_ports(api)
+        assert owner.poll() is None
+
+    def test_declined(self, temp_dir, omni_runner, port_owner, monkeypatch):
+        """Test the question naming the owner, and leaving it running when declined."""
+        import omni_run
+        from omni_run import ManifestError
+
+        owner, port = port_owner
+        orchestrator, api = self._api(temp_dir, omni_runner, port)
+        questions = []
+        monkeypatch.setattr(omni_run, "ask_yes_no", lambda question: questions.append(question) or False)
+        with pytest.raises(ManifestError, match=f"port {port} is already in use by pid {owner.pid} .*; left running"):
+            orchestrator.allocate_ports(api)
+        assert owner.poll() is None
+        assert questions[0].startswith(f"api: port {port} is in use by pid {owner.pid} ({sys.executable} -c ")
+
+    def test_confirmed(self, temp_dir, omni_runner, port_owner, monkeypatch, capsys):
+        """Test stopping the owner once confirmed and taking its port."""
+        import omni_run
+        from omni_run import ANSI_ESCAPE
+
+        owner, port = port_owner
+        orchestrator, api = self._api(temp_dir, omni_runner, port)
+        monkeypatch.setattr(omni_run, "ask_yes_no", lambda question: True)
+        assert orchestrator.allocate_ports(api)["http"] == port
+        assert owner.wait(timeout=10) != 0
+        assert f"stopped pid {owner.pid}, which had port {port}" in ANSI_ESCAPE.sub("", capsys.readouterr().out)
+
+
+class TestPortsCommand:
+    """Tests for taken ports in `omni-run ports`."""
+
+    def _stack(self, temp_dir, busy_port):
+        write_manifest(temp_dir, f"services:\n  api:\n    command: ./api\n    port_conflict: increment\n"
+                                 f"    ports: {{http: {busy_port}, admin: auto}}\n")
+
+    def test_busy(self, temp_dir, busy_port, capsys):
+        """Test the note for a taken fixed port, and none for an auto one."""
+        from omni_run import run_subcommand, ANSI_ESCAPE
+
+        self._stack(temp_dir, busy_port)
+        assert run_subcommand(["ports", "-C", str(temp_dir)]) == 0
+        out = ANSI_ESCAPE.sub("", capsys.readouterr().out)
+        assert f"api.http: {busy_port} is in use" in out and "(conflict: increment)" in out and "api.admin" not in out
+
+    def test_json(self, temp_dir, busy_port, capsys):
+        """Test the conflict, busy and owner fields."""
+        from omni_run import run_subcommand
+
+        self._stack(temp_dir, busy_port)
+        assert run_subcommand(["ports", "-C", str(temp_dir), "--output", "json"]) == 0
+        entries = {e["name"]: e for e in json.loads(capsys.readouterr().out)["ports"]}
+        assert (entries["http"]["conflict"], entries["http"]["busy"]) == ("increment", True)
+        admin = entries["admin"]
+        assert (admin["conflict"], admin["busy"], admin["owner"]) == (None, False, None)
+        if sys.platform.startswith("linux"):
+            assert entries["http"]["owner"].startswith(f"pid {os.getpid()} (")
@@ -0,0 +1,164 @@
+"""
+Tests for manifest profiles in OmniRun.
+
+This module tests:
+- Profile overlays on services (command, env, health, build flags)
+- Profile inheritance via extends
+- Profile selection from the command line
+"""
+
+import pytest
+from pathlib import Path
+
+from conftest import *
+
+
+MANIFEST = """
+services:
+  api:
+    command: go run .
+    env:
+      LOG_LEVEL: debug
+  worker:
+    command: ./worker
+profiles:
+  base:
+    env:
+      APP_ENV: shared
+  dev:
+    extends: base
+  prod:
+    extends: base
+    env:
+      APP_ENV: production
+    services:
+      api:
+        command: ./bin/api
+        env:
+          LOG_LEVEL: warn
+        health:
+          port: 8080
+  canary:
+    extends: prod
+    services:
+      api:
+        env:
+          CANARY: "1"
+"""
+
+
+class TestProfileResolution:
+    """Tests for flattening profiles."""
+
+    def test_deep_merge(self):
+        """Test that mappings merge and scalars/lists replace."""
+        from omni_run import deep_merge
+
+        merged = deep_merge({"a": {"x": 1, "y": [1]}, "b": 1}, {"a": {"y": [2]}, "c": 3})
+
+        assert merged == {"a": {"x": 1, "y": [2]}, "b": 1, "c": 3}
+
+    def test_inheritance_chain(self):
+        """Test that later profiles in an extends chain win."""
+        import yaml
+        from omni_run import resolve_profile
+
+        profiles = yaml.safe_load(MANIFEST)["profiles"]
+        overlay = resolve_profile(profiles, "canary")
+
+        assert overlay["env"] == {"APP_ENV": "production"}
+        assert overlay["services"]["api"]["command"] == "./bin/api"
+        assert overlay["services"]["api"]["env"] == {"LOG_LEVEL": "warn", "CANARY": "1"}
+
+    def test_cycle_and_unknown(self):
+        """Test that extends cycles and unknown profiles are errors."""
+        from omni_run import resolve_profile, ManifestError
+
+        with pytest.raises(ManifestError, match="Profile cycle: a -> b -> a"):
+            resolve_profile({"a": {"extends": "b"}, "b": {"extends": "a"}}, "a")
+        with pytest.raises(ManifestError, match="profiles.a.extends: unknown profile 'zzz'"):
+            resolve_profile({"a": {"extends": "zzz"}}, "a")
+
+
+class TestProfileLoading:
+    """Tests for applying profiles while loading the manifest."""
+
+    def test_no_profile_keeps_base(self, temp_dir):
+        """Test that services are unchanged without a profile."""
+        from omni_run import load_manifest
+
+        manifest = load_manifest(write_manifest(temp_dir, MANIFEST))
+
+        assert manifest.services["api"].command == "go run ."
+        assert manifest.profile is None
+
+    def test_prod_overrides(self, temp_dir):
+        """Test command, env and health overrides from a profile."""
+        from omni_run import load_manifest
+
+        manifest = load_manifest(write_manifest(temp_dir, MANIFEST), "prod")
+        api = manifest.services["api"]
+
+        assert manifest.profile == "prod"
+        assert api.command == "./bin/api"
+        assert api.env == {"LOG_LEVEL": "warn", "APP_ENV": "production"}
+        assert api.health.port == 8080
+        assert manifest.services["worker"].env == {"APP_ENV": "production"}
+
+    def test_unknown_profile(self, temp_dir):
+        """Test that selecting an undefined profile is reported."""
+        from omni_run import load_manifest, ManifestError
+
+        with pytest.raises(ManifestError, match="unknown profile 'staging'"):
+            load_manifest(write_manifest(temp_dir, MANIFEST), "staging")
+
+    def test_profile_without_profiles_section(self, temp_dir):
+        """Test that a profile is allowed when the manifest declares none (it still selects .env layers)."""
+        from omni_run import load_manifest
+
+        manifest = load_manifest(write_manifest(temp_dir, "services:\n  api:\n    command: 'true'\n"), "dev")
+
+        assert manifest.profile is None
+
+    def test_build_flags(self, temp_dir, omni_runner):
+        """Test that build flags are inserted into detected go/cargo launches."""
+        from omni_run import load_manifest, Orchestrator, apply_build_flags
+
+        assert apply_build_flags(["cargo", "run", "--bin", "x"], ["--release"]) == ["cargo", "run", "--release", "--bin", "x"]
+        assert apply_build_flags(["./bin/api"], ["-race"]) == ["./bin/api"]
+
+        (temp_dir / "go.mod").write_text("module example.com/app\n")
+        manifest = load_manifest(write_manifest(temp_dir, """
+services:
+  api: {}
+profiles:
+  race:
+    services:
+      api:
+        build_flags: ["-race"]
+"""), "race")
+        argv, _, _ = Orchestrator(omni_runner, manifest).resolve_launch(manifest.services["api"])
+
+        assert argv == ["go", "run", "-race", "."]
+
+
+class TestProfileSelection:
+    """Tests for choosing a profile from the command line."""
+
+    def test_global_option_before_subcommand(self):
+        """Test that `omni-run --profile prod up` is routed to the subcommand parser."""
+        from omni_run import hoist_subcommand
+
+        assert hoist_subcommand(["--profile", "prod", "up", "api"], {"up"}) == ["up", "--profile", "prod", "api"]
+        assert hoist_subcommand(["--profile", "."], {"up"}) is None
+
+    def test_env_resolve_uses_profile(self, temp_dir, capsys):
+        """Test that the selected profile reaches service environment resolution."""
+        from omni_run import run_subcommand
+
+        write_manifest(temp_dir, MANIFEST)
+
+        assert run_subcommand(["env", "api", "--resolve", "--profile", "prod", "-C", str(temp_dir)]) == 0
+        out = capsys.readouterr().out
+        assert "APP_ENV=production" in out
+        assert "LOG_LEVEL=warn" in out
@@ -0,0 +1,349 @@
+"""
+Tests for the reverse proxy front door in OmniRun.
+
+This module tests:
+- Parsing `proxy.routes` in list and mapping form, and route matching
+- Forwarding by hostname and path prefix, with X-Forwarded headers and prefix stripping
+- Errors for unknown routes and stopped services
+- Tunnelling Upgrade requests
+- Shaping routes with latency, bandwidth caps and injected errors
+- Self-signed TLS certificates
+"""
+
+import sys
+import time
+import json
+import shutil
+import socket
+import threading
+import pytest
+from pathlib import Path
+
+from conftest import *
+
+
+ECHO_SERVER = """\
+import json, os, sys
+from http.server import BaseHTTPRequestHandler, HTTPServer
+
+class Handler(BaseHTTPRequestHandler):
+    def _reply(self):
+        length = int(self.headers.get("Content-Length") or 0)
+        body = json.dumps({"name": sys.argv[1], "method": self.command, "path": self.path,
+                           "headers": dict(self.headers), "body": self.rfile.read(length).decode()}).encode()
+        self.send_response(200)
+        self.send_header("Content-Type", "application/json")
+        self.send_header("Content-Length", str(len(body)))
+        self.end_headers()
+        self.wfile.write(body)
+
+    do_GET = do_POST = _reply
+
+    def log_message(self, *args):
+        pass
+
+HTTPServer(("127.0.0.1", int(os.environ["PORT"])), Handler).serve_forever()
+"""
+
+
+def request(port, path, host, method="GET", body=None, tls=False):
+    import http.client
+    import ssl
+
+    if tls:
+        conn = http.client.HTTPSConnection("127.0.0.1", port, timeout=10, context=ssl._create_unverified_context())
+    else:
+        conn = http.client.HTTPConnection("127.0.0.1", port, timeout=10)
+    conn.request(method, path, body=body, headers={"Host": host})
+    response = conn.getresponse()
+    data = response.read()
+    conn.close()
+    return response.status, data
+
+
+class TestProxyRoutes:
+    """Tests for parsing and matching `proxy.routes`."""
+
+    def _services(self, temp_dir):
+        from omni_run import load_manifest
+
+        return load_manifest(write_manifest(temp_dir, """
+services:
+  api: {command: "true", ports: {http: auto, admin: auto}}
+  web: {command: "true", ports: auto}
+  job: {command: "true"}
+""")).services
+
+    def test_list_and_mapping_forms(self, temp_dir):
+        """Test both route forms, and that host routes and longer prefixes are tried first."""
+        from omni_run import parse_proxy_routes
+
+        services = self._services(temp_dir)
+        routes = parse_proxy_routes({"/": "web", "/api/v2": "api:admin", "API.localhost": "api"}, services)
+        assert [r.describe() for r in routes] == ["api.localhost -> api", "*/api/v2 -> api:admin", "*/ -> web"]
+
+        routes = parse_proxy_routes([{"path": "/frontend/", "service": "web", "strip_prefix": True}], services)
+        assert (routes[0].path, routes[0].strip_prefix) == ("/frontend", True)
+
+    def test_invalid_routes(self, temp_dir):
+        """Test errors for unknown services and ports, services without ports and incomplete routes."""
+        from omni_run import parse_proxy_routes, ManifestError
+
+        services = self._services(temp_dir)
+        for block, message in [({"/x": "db"}, "unknown service 'db'"), ({"/x": "job"}, "'job' declares no ports"),
+                               ({"/x": "api:grpc"}, "'api' has no port 'grpc'"),
+                               ([{"service": "api"}], "route needs a host or path"),
+                               ([{"path": "x", "service": "api"}], "path: must start with /"),
+                               ([{"host": "a", "service": "api", "tls": True}], r"unknown key\(s\) tls")]:
+            with pytest.raises(ManifestError, match=message):
+                parse_proxy_routes(block, services)
+
+    def test_matching_and_prefix_stripping(self):
+        """Test host patterns, prefix boundaries and the forwarded path."""
+        from omni_run import ProxyRoute
+
+        route = ProxyRoute(service="web", host="*.app.localhost", path="/frontend", strip_prefix=True)
+        assert route.matches("a.app.localhost", "/frontend/main.js")
+        assert route.matches("a.app.localhost", "/frontend?x=1")
+        assert not route.matches("a.app.localhost", "/frontend-old")
+        assert not route.matches("app.localhost", "/frontend")
+        assert route.forwarded_path("/frontend/main.js") == "/main.js"
+        assert route.forwarded_path("/frontend?x=1") == "/?x=1"
+        assert ProxyRoute(service="web", path="/frontend").forwarded_path("/frontend/a") == "/frontend/a"
+
+
+    def test_bandwidth_units(self):
+        """Test bandwidth in bytes, binary suffixes, per-second suffixes and bits."""
+        from omni_run import parse_bandwidth
+
+        assert [parse_bandwidth(v) for v in (65536, "512K", "1.5MB/s", "256kbit", "10mbps")] == [
+            65536, 512 * 1024, 1.5 * 1024 ** 2, 32000, 1250000]
+
+    def test_route_shapes(self, temp_dir, omni_runner):
+        """Test `shape:` on a route, and proxy.shape for routes without one."""
+        from omni_run import load_manifest, Orchestrator, ReverseProxy, TrafficShape
+
+        manifest = load_manifest(write_manifest(temp_dir, """
+services:
+  api: {command: "true", ports: auto}
+  web: {command: "true", ports: auto}
+proxy:
+  shape: {latency: 1s}
+  routes:
+    - {host: api.localhost, service: api, shape: {latency: 200ms, jitter: 50ms, bandwidth: 64K, error_rate: 0.05}}
+    - {path: /, service: web}
+"""))
+        api, web = ReverseProxy.from_config(Orchestrator(omni_runner, manifest)).routes
+        assert api.shape == TrafficShape(0.2, 0.05, 65536.0, 0.05, 503)
+        assert web.shape == TrafficShape(latency=1.0)
+
+    def test_shape_effects(self):
+        """Test a shape's description, its delay with jitter, and failing requests."""
+        from omni_run import TrafficShape
+
+        shape = TrafficShape(0.2, 0.05, 65536.0, 0.05, 503)
+        assert shape.describe() == "0.2s (+ up to 0.05s) latency, 64.0K/s, 5% 503 errors"
+        assert 0.2 <= shape.delay() <= 0.25
+        assert TrafficShape(error_rate=1.0).fails() and not TrafficShape().fails()
+
+    def test_invalid_shapes(self):
+        """Test bad durations, bandwidths, error rates and statuses, and unknown keys."""
+        import yaml
+        from omni_run import TrafficShape, ManifestError
+
+        for shape, message in [("{latency: soon}", "routes\\[0\\].shape: Invalid duration"),
+                               ("{bandwidth: fast}", "Invalid bandwidth: 'fast'"),
+                               ("{bandwidth: 0}", "shape.bandwidth: must be positive"),
+                               ("{error_rate: 5}", "shape.error_rate: must be a number from 0 to 1"),
+                               ("{error_status: 200}", "must be an HTTP error status"),
+                               ("{loss: 0.1}", "shape: unknown key\\(s\\) loss")]:
+            with pytest.raises(ManifestError, match=message):
+                TrafficShape.from_config("proxy.routes[0].shape", yaml.safe_load(shape))
+
+
+def upgrade_upstream():
+    upstream = socket.socket()
+    upstream.bind(("127.0.0.1", 0))
+    upstream.listen()
+    seen = {}
+
+    def serve():
+        conn, _ = upstream.accept()
+        handshake = b""
+        while b"\r\n\r\n" not in handshake:
+            handshake += conn.recv(4096)
+        seen["handshake"] = handshake.decode()
+        conn.sendall(b"HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n")
+        conn.sendall(b"echo:" + conn.recv(4096))
+        conn.close()
+
+    threading.Thread(target=serve, daemon=True).start()
+    return upstream, seen
+
+
+@pytest.mark.skipif(sys.platform == "win32", reason="Uses POSIX process groups")
+class TestReverseProxy:
+    """Tests for forwarding requests to running services."""
+
+    def _start(self, temp_dir, omni_runner, proxy_block):
+        from omni_run import load_manifest, Orchestrator, ReverseProxy
+
+        (temp_dir / "echo.py").write_text(ECHO_SERVER)
+        orchestrator = Orchestrator(omni_runner, load_manifest(write_manifest(temp_dir, f"""
+services:
+  api:
+    command: ["{sys.executable}", "echo.py", "api"]
+    ports: auto
+    health: {{type: tcp, port: http, interval: 100ms}}
+  web:
+    command: ["{sys.executable}", "echo.py", "web"]
+    ports: auto
+    health: {{type: tcp, port: http, interval: 100ms}}
+proxy:
+  address: 127.0.0.1:0
+{proxy_block}
+""")))
+        for service in orchestrator.services.values():
+            orchestrator.start_service(service)
+        deadline = time.time() + 10
+        while time.time() < deadline and not all(s.health.healthy for s in orchestrator.services.values()):
+            time.sleep(0.05)
+        proxy = ReverseProxy.from_config(orchestrator)
+        proxy.start()
+        return orchestrator, proxy
+
+    def _routed(self, temp_dir, omni_runner):
+        return self._start(temp_dir, omni_runner, """  routes:
+    - {host: api.localhost, service: api}
+    - {path: /frontend, service: web, strip_prefix: true}
+""")
+
+    def test_routes_by_host(self, temp_dir, omni_runner):
+        """Test that a request reaches the service for its host with forwarded headers."""
+        orchestrator, proxy = self._routed(temp_dir, omni_runner)
+        try:
+            status, body = request(proxy.port, "/users?id=1", "api.localhost:9999", method="POST", body=b"hello")
+            data = json.loads(body)
+            assert status == 200
+            assert (data["name"], data["method"], data["path"], data["body"]) == ("api", "POST", "/users?id=1", "hello")
+            assert data["headers"]["Host"] == "api.localhost:9999"
+            assert data["headers"]["X-Forwarded-Host"] == "api.localhost:9999"
+            assert data["headers"]["X-Forwarded-Proto"] == "http"
+            assert data["headers"]["X-Forwarded-For"] == "127.0.0.1"
+        finally:
+            proxy.stop()
+            orchestrator.shutdown()
+
+    def test_routes_by_path(self, temp_dir, omni_runner):
+        """Test that a path route strips its prefix and forwards it in X-Forwarded-Prefix."""
+        orchestrator, proxy = self._routed(temp_dir, omni_runner)
+        try:
+            data = json.loads(request(proxy.port, "/frontend/app.js", "localhost")[1])
+            assert (data["name"], data["path"]) == ("web", "/app.js")
+            assert data["headers"]["X-Forwarded-Prefix"] == "/frontend"
+        finally:
+            proxy.stop()
+            orchestrator.shutdown()
+
+    def test_unrouted_and_stopped(self, temp_dir, omni_runner):
+        """Test a 404 for a request no route matches and a 502 for a route to a stopped service."""
+        orchestrator, proxy = self._routed(temp_dir, omni_runner)
+        try:
+            status, body = request(proxy.port, "/other", "localhost")
+            assert status == 404 and b"No route for localhost/other" in body
+
+            orchestrator.stop_service(orchestrator.services["api"])
+            status, body = request(proxy.port, "/", "api.localhost")
+            assert status == 502 and b"Service 'api' is not running (stopped)" in body
+        finally:
+            proxy.stop()
+            orchestrator.shutdown()
+
+    def test_shaped_routes(self, temp_dir, omni_runner):
+        """Test added latency, a response held to the bandwidth cap, and injected errors."""
+        orchestrator, proxy = self._start(temp_dir, omni_runner, """  routes:
+    - {host: api.localhost, service: api, shape: {latency: 300ms, bandwidth: 40K}}
+    - {host: web.localhost, service: web, shape: {error_rate: 1, error_status: 504}}
+""")
+        try:
+            started = time.time()
+            assert request(proxy.port, "/", "api.localhost")[0] == 200
+            assert 0.3 <= time.time() - started < 1.5
+            started = time.time()
+            status, body = request(proxy.port, "/", "api.localhost", method="POST", body=b"x" * 20000)
+            assert status == 200 and json.loads(body)["body"] == "x" * 20000
+            assert time.time() - started >= 0.3 + 20000 / 40960 * 0.9
+
+            status, body = request(proxy.port, "/", "web.localhost", method="POST", body=b"ignored")
+            assert status == 504 and b"Error injected by the proxy's shape for web.localhost -> web" in body
+        finally:
+            proxy.stop()
+            orchestrator.shutdown()
+
+    def _upgrade(self, temp_dir, omni_runner):
+        from omni_run import ReverseProxy, ProxyRoute, Orchestrator, load_manifest
+
+        upstream, seen = upgrade_upstream()
+        orchestrator = Orchestrator(omni_runner, load_manifest(write_manifest(temp_dir, "services:\n  ws: {command: 'true', ports: auto}\n")))
+        ws = orchestrator.services["ws"]
+        ws.ports = {"http": upstream.getsockname()[1]}
+        ws.is_alive = lambda: True
+        proxy = ReverseProxy(orchestrator, [ProxyRoute(service="ws", path="/socket")], port=0)
+        proxy.start()
+        try:
+            client = socket.create_connection(("127.0.0.1", proxy.port), timeout=10)
+            client.sendall(b"GET /socket HTTP/1.1\r\nHost: localhost\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n")
+            response = b""
+            while b"\r\n\r\n" not in response:
+                response += client.recv(4096)
+            client.sendall(b"ping")
+            rest = response.split(b"\r\n\r\n", 1)[1]
+            while b"echo:ping" not in rest:
+                chunk = client.recv(4096)
+                if not chunk:
+                    break
+                rest += chunk
+            client.close()
+            return response, rest, seen["handshake"]
+        finally:
+            proxy.stop()
+            upstream.close()
+
+    def test_upgrade_is_tunnelled(self, temp_dir, omni_runner):
+        """Test that an Upgrade request is answered by the service and then piped both ways."""
+        response, rest, handshake = self._upgrade(temp_dir, omni_runner)
+        assert response.startswith(b"HTTP/1.1 101")
+        assert b"echo:ping" in rest
+
+    def test_upgrade_handshake_forwarded(self, temp_dir, omni_runner):
+        """Test that the service sees the Upgrade header and the forwarded headers."""
+        response, rest, handshake = self._upgrade(temp_dir, omni_runner)
+        assert "Upgrade: websocket" in handshake
+        assert "X-Forwarded-Proto: http" in handshake
+
+    @pytest.mark.skipif(not shutil.which("openssl"), reason="Needs openssl to generate a certificate")
+    def test_self_signed_tls(self, temp_dir, omni_runner):
+        """Test that tls: self-signed serves HTTPS with a certificate generated for the route hosts."""
+        from omni_run import self_signed_certificate
+
+        orchestrator, proxy = self._start(temp_dir, omni_runner, """  tls: self-signed
+  routes:
+    api.localhost: api
+""")
+        try:
+            status, body = request(proxy.port, "/", "api.localhost", tls=True)
+            assert status == 200
+            assert json.loads(body)["headers"]["X-Forwarded-Proto"] == "https"
+            assert proxy.url.startswith("https://")
+        finally:
+            proxy.stop()
+            orchestrator.shutdown()
+
+        directory = temp_dir / ".omni-run" / "proxy"
+        assert (directory / "proxy-cert.hosts").read_text().split() == ["api.localhost", "localhost"]
+        cert = directory / "proxy-cert.pem"
+        mtime = cert.stat().st_mtime_ns
+        self_signed_certificate(directory, ["api.localhost"])
+        assert cert.stat().st_mtime_ns == mtime
+        self_signed_certificate(directory, ["api.localhost", "web.localhost"])
+        assert "web.localhost" in (directory / "proxy-cert.hosts").read_text()
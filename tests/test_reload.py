@@ -0,0 +1,136 @@
+"""
+Tests for reloading the manifest while `up` runs in OmniRun.
+
+This module tests:
+- Added services starting, removed ones stopping and changed ones restarting, while the rest keep running
+- A manifest that doesn't load leaving the stack as it was
+- Blocks that are only read when `up` starts, and `--no-reload`
+"""
+
+import sys
+import time
+import threading
+import pytest
+from pathlib import Path
+
+from conftest import *
+
+
+def service(name: str, value: str = "1", extra: str = "") -> str:
+    """A manifest entry for a service that records its pid and $VALUE, then waits."""
+    return (f"  {name}:\n    command: ['{sys.executable}', '-c', \"import os, time; open('{name}.out', 'a')"
+            f".write(f'{{os.getpid()}} {{os.environ[\\\"VALUE\\\"]}}\\\\n'); time.sleep(60)\"]\n"
+            f"    env: {{VALUE: '{value}'}}\n" + extra)
+
+
+def runs(temp_dir: Path, name: str):
+    path = temp_dir / f"{name}.out"
+    return [line.split() for line in path.read_text().splitlines()] if path.exists() else []
+
+
+def wait_for(condition, timeout=10.0):
+    deadline = time.time() + timeout
+    while time.time() < deadline:
+        if condition():
+            return True
+        time.sleep(0.1)
+    return False
+
+
+@pytest.fixture
+def reloading(temp_dir, omni_runner, capsys):
+    """api, worker and db running under `up` with reloading; yields the orchestrator and a reader of the output."""
+    from omni_run import load_manifest, Orchestrator, ANSI_ESCAPE
+
+    write_manifest(temp_dir, "services:\n" + service("api") + service("worker") + service("db"))
+    orchestrator = Orchestrator(omni_runner, load_manifest(temp_dir / "omni-run.yaml"))
+    outcome, seen = {}, []
+    runner = threading.Thread(target=lambda: outcome.setdefault("code", orchestrator.up(reload=True)))
+    runner.start()
+
+    def output():
+        seen.append(ANSI_ESCAPE.sub("", capsys.readouterr().out))
+        return "".join(seen)
+
+    try:
+        assert wait_for(lambda: all(runs(temp_dir, n) for n in ("api", "worker", "db")))
+        yield orchestrator, output
+    finally:
+        orchestrator.request_shutdown()
+        runner.join(timeout=20)
+    assert outcome["code"] == 0
+
+
+class TestReload:
+    """Tests for applying manifest changes to a running stack."""
+
+    def _changed(self, temp_dir):
+        time.sleep(0.1)  # A new mtime, even on coarse-grained filesystems
+        write_manifest(temp_dir, "services:\n" + service("api", "2") + service("db") +
+                       service("web", extra="    depends_on: [api]\n") + "metrics: {enabled: true}\n")
+        assert wait_for(lambda: runs(temp_dir, "web") and len(runs(temp_dir, "api")) == 2)
+
+    def test_changed_restarts(self, temp_dir, reloading):
+        """Test that a service whose settings changed restarts with them."""
+        _, output = reloading
+        self._changed(temp_dir)
+        assert [value for _, value in runs(temp_dir, "api")] == ["1", "2"]
+        assert wait_for(lambda: "api    | its settings changed; restarting" in output())
+
+    def test_removed_stops(self, temp_dir, reloading):
+        """Test that a service removed from the manifest is stopped and forgotten."""
+        orchestrator, output = reloading
+        self._changed(temp_dir)
+        assert "worker" not in orchestrator.services and len(runs(temp_dir, "worker")) == 1
+        assert wait_for(lambda: "worker | removed from the manifest; stopping" in output())
+
+    def test_added_starts(self, temp_dir, reloading):
+        """Test that a service added to the manifest starts."""
+        from omni_run import ServiceState
+
+        orchestrator, output = reloading
+        self._changed(temp_dir)
+        assert orchestrator.services["web"].state == ServiceState.RUNNING
+        assert wait_for(lambda: "web    | added to the manifest" in output())
+
+    def test_unchanged_keeps_process(self, temp_dir, reloading):
+        """Test that an unchanged service keeps its process, and the summary of what was applied."""
+        orchestrator, output = reloading
+        db_pid = orchestrator.services["db"].process.pid
+        self._changed(temp_dir)
+        assert orchestrator.services["db"].process.pid == db_pid and len(runs(temp_dir, "db")) == 1
+        assert wait_for(lambda: "omni-run.yaml reloaded: 1 added, 1 removed, 1 restarted" in output())
+
+    def test_next_up_blocks(self, temp_dir, reloading):
+        """Test that a change to a block only read at startup is reported, not applied."""
+        _, output = reloading
+        self._changed(temp_dir)
+        assert wait_for(lambda: "Changes to metrics take effect on the next `up`" in output())
+
+    def test_invalid_manifest_ignored(self, temp_dir, reloading):
+        """Test that a manifest that doesn't load leaves the stack as it was."""
+        orchestrator, output = reloading
+        time.sleep(0.1)  # A new mtime, even on coarse-grained filesystems
+        write_manifest(temp_dir, "services:\n" + service("api", "3", "    depends_on: [nope]\n"))
+        assert wait_for(lambda: "omni-run.yaml changed, but is not applied: services.api.depends_on: unknown service "
+                                "'nope'" in output())
+        time.sleep(0.5)
+        assert len(runs(temp_dir, "api")) == 1 and "worker" in orchestrator.services
+
+    def test_no_reload(self, temp_dir, capsys):
+        """Test that `up --no-reload` runs the manifest it started with."""
+        from omni_run import run_subcommand
+
+        write_manifest(temp_dir, f"""
+services:
+  job: {{command: ["{sys.executable}", "-c", "import time; time.sleep(2)"]}}
+""")
+
+        def rewrite():
+            time.sleep(0.5)
+            write_manifest(temp_dir, f"services:\n  other: {{command: ['{sys.executable}', '-c', 'pass']}}\n")
+
+        threading.Thread(target=rewrite).start()
+        assert run_subcommand(["up", "--no-reload", "-C", str(temp_dir)]) == 0
+        out = capsys.readouterr().out
+        assert "reloaded" not in out and "other" not in out
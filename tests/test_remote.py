@@ -0,0 +1,184 @@
+"""
+Tests for running services over SSH in OmniRun.
+
+This module tests:
+- Parsing ssh:// targets and selecting the ssh backend with --target
+- The rsync invocation (ignore files, workspace state, remote directory creation)
+- The remote command: working directory, environment and forwarded ports
+- Running a stack end to end against stand-in ssh and rsync commands
+"""
+
+import sys
+import json
+import pytest
+from pathlib import Path
+
+from conftest import *
+
+
+FAKE_SSH = """
+import json, os, sys
+args = sys.argv[1:]
+with open(os.environ["FAKE_LOG"], "a") as f:
+    f.write(json.dumps(["ssh"] + args) + "\\n")
+i = 0
+while args[i].startswith("-"):
+    i += 2 if args[i] in ("-p", "-o", "-L") else 1
+os.execv("/bin/sh", ["/bin/sh", "-c", " ".join(args[i + 1:])])
+"""
+
+FAKE_RSYNC = """
+import json, os, shutil, sys
+args = sys.argv[1:]
+with open(os.environ["FAKE_LOG"], "a") as f:
+    f.write(json.dumps(["rsync"] + args) + "\\n")
+source, destination = args[-2], args[-1].split(":", 1)[1]
+shutil.copytree(source, destination, dirs_exist_ok=True, ignore=shutil.ignore_patterns(".omni-run"))
+"""
+
+
+def install_fakes(temp_dir: Path, monkeypatch) -> Path:
+    import os
+
+    bin_dir = temp_dir / "bin"
+    bin_dir.mkdir()
+    for name, source in (("ssh", FAKE_SSH), ("rsync", FAKE_RSYNC)):
+        script = bin_dir / name
+        script.write_text(f"#!{sys.executable}\n{source}")
+        script.chmod(0o755)
+    log = temp_dir / "calls.jsonl"
+    monkeypatch.setenv("PATH", f"{bin_dir}{os.pathsep}{os.environ.get('PATH', '')}")
+    monkeypatch.setenv("FAKE_LOG", str(log))
+    return log
+
+
+class TestSshTarget:
+    """Tests for ssh:// target URLs."""
+
+    def test_parse(self):
+        """Test user, port and path, and rejecting other schemes."""
+        from omni_run import SshTarget, ManifestError
+
+        target = SshTarget.parse("ssh://dev@build-box:2222/srv/work/")
+        assert (target.user, target.host, target.port, target.path) == ("dev", "build-box", 2222, "/srv/work")
+        assert target.destination == "dev@build-box"
+        assert SshTarget.parse("ssh://box").destination == "box"
+        assert SshTarget.parse("ssh://box").path is None
+
+        for url in ("box", "http://box", "ssh://", "ssh://box:port"):
+            with pytest.raises(ManifestError, match="expected ssh://"):
+                SshTarget.parse(url)
+
+    def test_target_selects_backend(self, temp_dir, omni_runner):
+        """Test that --target picks the ssh backend and that it needs a target."""
+        import argparse
+        from omni_run import run_backend, create_backend, SshBackend, ManifestError
+
+        args = argparse.Namespace(backend=None, target="ssh://dev@box")
+        assert run_backend(omni_runner, args) == "ssh"
+        backend = create_backend("ssh", omni_runner.config)
+        assert isinstance(backend, SshBackend)
+        assert backend.target.destination == "dev@box"
+        assert run_backend(omni_runner, argparse.Namespace(backend="docker", target=None)) == "docker"
+
+        with pytest.raises(ManifestError, match="ssh backend needs a target"):
+            create_backend("ssh", {"remote": {}})
+
+
+class TestSshBackend:
+    """Tests for the commands the ssh backend runs."""
+
+    def _orchestrator(self, temp_dir, omni_runner, target="ssh://dev@box:2200"):
+        from omni_run import load_manifest, Orchestrator
+
+        (temp_dir / "api").mkdir(exist_ok=True)
+        (temp_dir / "omni-run.yaml").write_text("""
+services:
+  api:
+    path: api
+    command: ./server --port ${PORT_HTTP}
+    ports: {http: auto}
+    env: {MODE: "remote dev"}
+""")
+        omni_runner.config["remote"] = dict(omni_runner.config["remote"], target=target, exclude=["*.log"])
+        return Orchestrator(omni_runner, load_manifest(temp_dir / "omni-run.yaml"), backend="ssh")
+
+    def test_sync_command(self, temp_dir, omni_runner):
+        """Test that rsync respects .gitignore, skips workspace state and creates the remote directory."""
+        from omni_run import stack_id
+
+        orchestrator = self._orchestrator(temp_dir, omni_runner)
+        backend = orchestrator.backend_for(orchestrator.services["api"])
+        root = f".omni-run/remote/{stack_id(temp_dir)}"
+        assert backend.remote_root(orchestrator) == root
+
+        argv = backend.sync_argv(orchestrator)
+        assert argv[:3] == ["rsync", "-az", "--delete"]
+        assert argv[argv.index("-e") + 1].startswith("ssh -p 2200 -o BatchMode=yes")
+        assert f"--rsync-path=mkdir -p {root} && rsync" in argv
+        assert "--filter=:- .gitignore" in argv
+        assert argv[argv.index("/.omni-run/") - 1] == "--exclude"
+        assert "*.log" in argv
+        assert argv[-2:] == [f"{temp_dir}/", f"dev@box:{root}/"]
+
+    def test_remote_command(self, temp_dir, omni_runner, monkeypatch):
+        """Test the ssh session: forwarded ports, remote cwd and environment."""
+        import omni_run
+
+        monkeypatch.setattr(omni_run.shutil, "which", lambda name, *a, **k: f"/usr/bin/{name}")
+        orchestrator = self._orchestrator(temp_dir, omni_runner, target="ssh://dev@box/srv/app")
+        api = orchestrator.services["api"]
+        api.ports = {"http": 45123}
+        backend = orchestrator.backend_for(api)
+        backend._synced = True
+        argv, cwd, _ = backend.prepare(orchestrator, api)
+
+        assert argv[argv.index("-L") + 1] == "45123:localhost:45123"
+        assert "-tt" in argv and "ExitOnForwardFailure=yes" in argv
+        assert argv[-2] == "dev@box"
+        script = argv[-1]
+        assert "cd /srv/app/api && exec env " in script
+        assert "'MODE=remote dev'" in script and "PORT_HTTP=45123" in script
+        assert script.endswith("/bin/sh -c './server --port 45123'")
+        assert "PATH=" not in script
+        assert cwd == (temp_dir / "api").resolve()
+
+
+@pytest.mark.skipif(sys.platform == "win32", reason="Uses POSIX shell scripts as ssh and rsync")
+class TestRemoteRun:
+    """Tests for `omni-run up --target` against stand-in ssh and rsync."""
+
+    def _up(self, temp_dir, capsys, monkeypatch):
+        from omni_run import run_subcommand
+
+        log = install_fakes(temp_dir, monkeypatch)
+        project = temp_dir / "project"
+        (project / "web").mkdir(parents=True)
+        (project / "omni-run.yaml").write_text("""
+services:
+  api:
+    command: echo "api in $(pwd) on $PORT"
+    ports: {http: auto}
+  web:
+    path: web
+    command: echo "web in $(pwd)"
+""")
+        remote = temp_dir / "remote"
+        assert run_subcommand(["up", "-C", str(project), "--target", f"ssh://dev@box{remote}", "--skip-install"]) == 0
+        return remote, capsys.readouterr().out, [json.loads(line) for line in log.read_text().splitlines()]
+
+    def test_up_on_target(self, temp_dir, capsys, monkeypatch):
+        """Test that services run in the synced copy with their output streamed back."""
+        remote, out, calls = self._up(temp_dir, capsys, monkeypatch)
+        assert f"syncing project to dev@box:{remote}" in out
+        assert f"api in {remote} on " in out
+        assert f"web in {remote}/web" in out
+        assert (remote / "omni-run.yaml").exists()
+
+    def test_synced_once(self, temp_dir, capsys, monkeypatch):
+        """Test one rsync for the project and an ssh session per service, forwarding the one with a port."""
+        remote, out, calls = self._up(temp_dir, capsys, monkeypatch)
+        assert [c[0] for c in calls].count("rsync") == 1
+        ssh_calls = [c for c in calls if c[0] == "ssh"]
+        assert len(ssh_calls) == 2
+        assert any("-L" in c for c in ssh_calls)
@@ -0,0 +1,177 @@
+"""
+Tests for replicated services (`replicas:`) in OmniRun.
+
+This module tests:
+- Expanding a service into numbered instances, ${replica.*} references, ports and injected variables
+- Dependents waiting on every instance, selecting instances by the service's name, and invalid replicas
+- The proxy spreading requests over the running instances in turn
+"""
+
+import sys
+import json
+import time
+import pytest
+from pathlib import Path
+
+from conftest import *
+
+
+WHOAMI_SERVER = """\
+import os
+from http.server import BaseHTTPRequestHandler, HTTPServer
+
+class Handler(BaseHTTPRequestHandler):
+    def do_GET(self):
+        body = os.environ["WORKER_NAME"].encode()
+        self.send_response(200)
+        self.send_header("Content-Length", str(len(body)))
+        self.end_headers()
+        self.wfile.write(body)
+
+    def log_message(self, *args):
+        pass
+
+HTTPServer(("127.0.0.1", int(os.environ["PORT"])), Handler).serve_forever()
+"""
+
+
+@pytest.fixture
+def balanced(temp_dir, omni_runner):
+    """Three healthy instances behind a proxy route; yields (orchestrator, fetch()) giving (status, body)."""
+    from omni_run import load_manifest, Orchestrator, ReverseProxy
+    import http.client
+
+    (temp_dir / "whoami.py").write_text(WHOAMI_SERVER)
+    write_manifest(temp_dir, f"""
+services:
+  worker:
+    replicas: 3
+    command: ["{sys.executable}", "whoami.py"]
+    env: {{WORKER_NAME: '${{replica.name}}'}}
+    ports: auto
+    health: {{type: tcp, port: http, interval: 100ms}}
+proxy:
+  address: 127.0.0.1:0
+  routes: {{/: worker}}
+""")
+    orchestrator = Orchestrator(omni_runner, load_manifest(temp_dir / "omni-run.yaml"))
+    for service in orchestrator.services.values():
+        orchestrator.start_service(service)
+    deadline = time.time() + 10
+    while time.time() < deadline and not all(s.health.healthy for s in orchestrator.services.values()):
+        time.sleep(0.05)
+    proxy = ReverseProxy.from_config(orchestrator)
+    proxy.start()
+
+    def fetch():
+        conn = http.client.HTTPConnection("127.0.0.1", proxy.port, timeout=10)
+        conn.request("GET", "/")
+        response = conn.getresponse()
+        body = response.read().decode()
+        conn.close()
+        return response.status, body
+
+    try:
+        yield orchestrator, fetch
+    finally:
+        proxy.stop()
+        orchestrator.shutdown()
+
+
+class TestReplicaSpec:
+    """Tests for expanding `replicas:` when the manifest is loaded."""
+
+    def _expanded(self, temp_dir):
+        from omni_run import load_manifest
+
+        write_manifest(temp_dir, """
+services:
+  worker:
+    replicas: 3
+    command: ./worker --id ${replica.index}
+    env: {WORKER_NAME: '${replica.name}', SHARDS: '${replica.count}', DB: '${service.db.port}'}
+    ports: {http: 8080, metrics: auto}
+    health: {port: http}
+  db: {command: ./db, ports: auto}
+  api:
+    command: ./api
+    depends_on: {worker: {condition: service_healthy, timeout: 5s}, db: null}
+""")
+        return load_manifest(temp_dir / "omni-run.yaml")
+
+    def test_instances(self, temp_dir):
+        """Test the instances' names, filled references and the service they replicate."""
+        manifest = self._expanded(temp_dir)
+        assert list(manifest.services) == ["worker-1", "worker-2", "worker-3", "db", "api"]
+        assert manifest.replicas == {"worker": ["worker-1", "worker-2", "worker-3"]}
+        second = manifest.services["worker-2"]
+        assert second.command == "./worker --id 2" and second.replica_of == "worker"
+        assert "replicas" not in second.raw and manifest.raw["services"]["worker"]["replicas"] == 3
+
+    def test_environment(self, temp_dir):
+        """Test ${replica.*} in the environment, the injected variables and references left for later."""
+        env = self._expanded(temp_dir).services["worker-2"].env
+        assert {k: env[k] for k in ("WORKER_NAME", "SHARDS", "DB", "OMNI_RUN_REPLICA", "OMNI_RUN_REPLICAS")} == {
+            "WORKER_NAME": "worker-2", "SHARDS": "3", "DB": "${service.db.port}", "OMNI_RUN_REPLICA": "2",
+            "OMNI_RUN_REPLICAS": "3"}
+
+    def test_ports(self, temp_dir):
+        """Test fixed ports counting up across the instances and auto ports kept."""
+        manifest = self._expanded(temp_dir)
+        assert [manifest.services[n].ports["http"].port for n in manifest.replicas["worker"]] == [8080, 8081, 8082]
+        assert manifest.services["worker-2"].ports["metrics"].strategy == "auto"
+
+    def test_dependents(self, temp_dir):
+        """Test that dependents wait on every instance and that the service's name selects all of them."""
+        manifest = self._expanded(temp_dir)
+        api = manifest.services["api"]
+        assert api.depends_on == ["worker-1", "worker-2", "worker-3", "db"]
+        assert {(d.condition, d.timeout) for n, d in api.conditions.items() if n != "db"} == {("service_healthy", 5.0)}
+        assert manifest.expand_names(["api", "worker"]) == ["api", "worker-1", "worker-2", "worker-3"]
+
+    def test_errors(self, temp_dir):
+        """Test invalid counts, unknown references and names taken by an instance."""
+        from omni_run import load_manifest, ManifestError
+
+        for block, message in [
+            ("worker: {command: 'true', replicas: 0}", "services.worker.replicas: expected a number of instances"),
+            ("worker: {command: 'true', replicas: -2}", "services.worker.replicas: expected a number of instances"),
+            ("worker: {command: 'run ${replica.id}', replicas: 2}",
+             r"services.worker.command: unknown template reference \$\{replica.id\}"),
+            ("worker: {command: 'true', replicas: 2}\n  worker-2: {command: 'true'}",
+             "services.worker-2: the name is taken by replica 2 of 'worker'"),
+        ]:
+            write_manifest(temp_dir, f"services:\n  {block}\n")
+            with pytest.raises(ManifestError, match=message):
+                load_manifest(temp_dir / "omni-run.yaml")
+
+
+@pytest.mark.skipif(sys.platform == "win32", reason="Uses POSIX process groups")
+class TestReplicaProxy:
+    """Tests for load-balancing proxy routes over the instances."""
+
+    def test_round_robin(self, balanced):
+        """Test that requests go to each running instance in turn."""
+        _, fetch = balanced
+        assert [fetch()[1] for _ in range(4)] == ["worker-1", "worker-2", "worker-3", "worker-1"]
+
+    def test_skips_stopped(self, balanced):
+        """Test that a stopped instance is skipped."""
+        orchestrator, fetch = balanced
+        orchestrator.stop_service(orchestrator.services["worker-3"])
+        assert [fetch()[1] for _ in range(4)] == ["worker-1", "worker-2", "worker-1", "worker-2"]
+
+    def test_none_running(self, balanced):
+        """Test the proxy's answer when no instance is running."""
+        orchestrator, fetch = balanced
+        for name in ("worker-1", "worker-2", "worker-3"):
+            orchestrator.stop_service(orchestrator.services[name])
+        assert fetch() == (502, "No instance of 'worker' is running (3 replicas)\n")
+
+    def test_service_reference(self, balanced):
+        """Test that ${service.<name>.port} must name one instance of a replicated service."""
+        from omni_run import ManifestError
+
+        orchestrator, _ = balanced
+        with pytest.raises(ManifestError, match="'worker' has 3 replicas; refer to one of them"):
+            orchestrator.templates.render("${service.worker.port}", "worker-1", {}, "env")
@@ -0,0 +1,410 @@
+"""
+Tests for the JSON-RPC protocol for editor extensions (`omni-run rpc`) in OmniRun.
+
+This module tests:
+- Content-Length framing, and messages that can't be read
+- `initialize`: protocol version and capability negotiation, and requests before it
+- Error responses for unknown methods, bad params and malformed requests
+- Detection results, services from the manifest and from a run
+- Running services: omni/up, following logs, lifecycle events, input, stop and shutdown
+- `omni-run rpc` on stdio, on a Unix socket and on a TCP port with a token
+"""
+
+import io
+import os
+import sys
+import time
+import socket
+import threading
+import subprocess
+import pytest
+from pathlib import Path
+
+from conftest import *
+
+
+def frame(message) -> bytes:
+    import json
+
+    body = json.dumps(message).encode()
+    return b"Content-Length: %d\r\n\r\n" % len(body) + body
+
+
+class RpcClient:
+    """Talks to a session over a socket pair; notifications are collected in `notifications`."""
+
+    def __init__(self, sock: socket.socket):
+        self.sock = sock
+        self.reader = sock.makefile("rb")
+        self.writer = sock.makefile("wb")
+        self.notifications = []
+        self.next_id = 0
+
+    def send(self, message):
+        from omni_run import write_rpc_message
+
+        write_rpc_message(self.writer, {"jsonrpc": "2.0", **message})
+
+    def read(self):
+        from omni_run import read_rpc_message
+
+        return read_rpc_message(self.reader)
+
+    def call(self, method, params=None):
+        self.next_id += 1
+        self.send({"id": self.next_id, "method": method, **({"params": params} if params is not None else {})})
+        while True:
+            message = self.read()
+            assert message is not None, "the session closed the connection"
+            if message.get("id") == self.next_id:
+                return message
+            self.notifications.append(message)
+
+    def wait_for(self, condition, timeout: float = 20):
+        """Read notifications until one matches."""
+        self.sock.settimeout(timeout)
+        for message in self.notifications:
+            if condition(message):
+                return message
+        while True:
+            message = self.read()
+            self.notifications.append(message)
+            if condition(message):
+                return message
+
+
+@pytest.fixture
+def rpc(temp_dir, omni_runner):
+    """Start a session on one end of a socket pair; returns (client, backend, the thread serving it)."""
+    import argparse
+    from omni_run import RpcBackend, RpcSession
+
+    args = argparse.Namespace(services=[], file=None, all=False, path=None, tag=None, max_depth=10, skip_install=True,
+                              backend=None, target=None)
+    backend = RpcBackend(omni_runner, args)
+    server, client = socket.socketpair()
+    session = RpcSession(backend, server.makefile("rb"), server.makefile("wb"))
+    runner = threading.Thread(target=session.run, daemon=True)
+    runner.start()
+    yield RpcClient(client), backend, runner
+    backend.stop()
+    client.close()
+    runner.join(timeout=5)
+    server.close()
+
+
+@pytest.fixture
+def rpc_socket(temp_dir):
+    """`omni-run rpc --socket` serving an api's manifest; yields (socket path, server process)."""
+    import omni_run
+
+    write_manifest(temp_dir, "services:\n  api: {command: ./api}\n")
+    path = Path("/tmp") / f"omni-rpc-{os.getpid()}.sock"  # Short enough for sun_path
+    server = subprocess.Popen([sys.executable, omni_run.__file__, "rpc", "-C", str(temp_dir), "--socket", str(path)],
+                              stdout=subprocess.PIPE, stderr=subprocess.STDOUT)
+    try:
+        deadline = time.time() + 20
+        while time.time() < deadline and not path.exists():
+            time.sleep(0.05)
+        yield path, server
+    finally:
+        if server.poll() is None:
+            server.terminate()
+            server.communicate(timeout=20)
+
+
+class TestRpcFraming:
+    """Tests for reading and writing framed messages."""
+
+    def test_write(self):
+        """Test the Content-Length header, counted in bytes."""
+        from omni_run import write_rpc_message
+
+        out = io.BytesIO()
+        write_rpc_message(out, {"id": 1, "name": "ünïcode"})
+        header, body = out.getvalue().split(b"\r\n\r\n")
+        assert header == b"Content-Length: %d" % len(body)
+
+    def test_read(self):
+        """Test headers in any case, blank lines between messages, end of input and a message cut short."""
+        from omni_run import read_rpc_message
+
+        stream = io.BytesIO(frame({"id": 1, "name": "ünïcode"}) +
+                            b"\r\ncontent-length: 2\r\nContent-Type: application/json\r\n\r\n{}")
+        assert read_rpc_message(stream) == {"id": 1, "name": "ünïcode"}
+        assert read_rpc_message(stream) == {}
+        assert read_rpc_message(stream) is None
+        assert read_rpc_message(io.BytesIO(b"Content-Length: 10\r\n\r\n{}")) is None  # Cut short
+
+    def test_invalid_json(self):
+        """Test that a body that isn't JSON can be answered and read past."""
+        from omni_run import read_rpc_message, RpcError
+
+        with pytest.raises(RpcError, match="invalid JSON") as error:
+            read_rpc_message(io.BytesIO(b"Content-Length: 3\r\n\r\n{x}"))
+        assert not error.value.fatal
+
+    def test_invalid_length(self):
+        """Test that a bad or negative Content-Length ends the stream with a parse error."""
+        from omni_run import read_rpc_message, RpcError
+
+        for value in ("ten", "-1"):
+            with pytest.raises(RpcError, match=f"invalid Content-Length: {value}") as error:
+                read_rpc_message(io.BytesIO(b"Content-Length: %s\r\n\r\n{}" % value.encode()))
+            assert error.value.fatal and error.value.code == -32700
+
+    def test_missing_length(self):
+        """Test that headers without a Content-Length end the stream, rather than pass for blank lines."""
+        from omni_run import read_rpc_message, RpcError
+
+        with pytest.raises(RpcError, match="without a Content-Length") as error:
+            read_rpc_message(io.BytesIO(b"Content-Type: application/json\r\n\r\n{}"))
+        assert error.value.fatal and error.value.code == -32700
+
+
+class TestRpcSession:
+    """Tests for the requests a session answers."""
+
+    def test_before_initialize(self, rpc):
+        """Test that requests before initialize are refused."""
+        client, _, _ = rpc
+        assert client.call("omni/services")["error"]["code"] == -32002
+
+    def test_unsupported_version(self, rpc):
+        """Test that initialize fails with the supported versions when none is shared."""
+        client, _, _ = rpc
+        failed = client.call("initialize", {"protocolVersions": [7, 8]})["error"]
+        assert failed["code"] == -32003 and failed["data"] == {"supported": [1]}
+
+    def test_initialize(self, rpc):
+        """Test version negotiation, capabilities, the initialized notification and a second initialize."""
+        from omni_run import OMNI_RUN_VERSION
+
+        client, _, _ = rpc
+        reply = client.call("initialize", {"protocolVersions": [1, 2], "clientInfo": {"name": "vscode"},
+                                           "capabilities": {"logs": True}})["result"]
+        assert reply["protocolVersion"] == 1 and reply["serverInfo"] == {"name": "omni-run", "version": OMNI_RUN_VERSION}
+        assert reply["capabilities"]["commands"] == ["up", "start", "stop", "restart"]
+        assert reply["capabilities"]["logs"] == {"history": True, "follow": True}
+        client.send({"method": "initialized", "params": {}})  # Notifications get no response
+        assert client.call("initialize", {})["error"]["message"] == "initialize was already called"
+
+    def test_errors(self, rpc):
+        """Test error responses for unknown methods and bad params."""
+        client, _, _ = rpc
+        client.call("initialize", {})
+        assert client.call("omni/nope")["error"] == {"code": -32601, "message": "unknown method 'omni/nope'"}
+        assert client.call("omni/logs", {"service": 3})["error"] == {"code": -32602, "message": "service: expected str"}
+        assert client.call("omni/logs", [])["error"]["code"] == -32602
+
+    def test_malformed(self, rpc):
+        """Test that malformed requests are answered and the session keeps going without a manifest."""
+        client, _, _ = rpc
+        client.call("initialize", {})
+        client.writer.write(frame({"id": 99, "method": "omni/services"}))  # No "jsonrpc": "2.0"
+        client.writer.write(b"Content-Length: 3\r\n\r\n{x}")
+        client.writer.flush()
+        assert client.read() == {"jsonrpc": "2.0", "id": 99,
+                                 "error": {"code": -32600, "message": "expected a JSON-RPC 2.0 request"}}
+        assert client.read()["error"]["code"] == -32700
+        assert client.call("omni/services")["error"]["code"] == -32001  # No manifest: still answering
+
+    def _project(self, temp_dir, rpc):
+        client, _, _ = rpc
+        (temp_dir / "api").mkdir()
+        (temp_dir / "api" / "go.mod").write_text("module example.com/api\n")
+        (temp_dir / "api" / "main.go").write_text("package main\n\nfunc main() {}\n")
+        write_manifest(temp_dir, "services:\n  api: {path: api, ports: {http: 18081}}\n  web: {command: ./web}\n")
+        client.call("initialize", {})
+        return client
+
+    def test_detect(self, temp_dir, rpc):
+        """Test detection results for a directory, none for the project root, and a missing directory."""
+        client = self._project(temp_dir, rpc)
+        detected = client.call("omni/detect", {"path": "api"})["result"]
+        assert detected["path"] == str((temp_dir / "api").resolve()) and detected["plan"]["runtime"] == "go"
+        assert client.call("omni/detect", {})["result"]["plan"] is None
+        assert "not a directory" in client.call("omni/detect", {"path": "nope"})["error"]["message"]
+
+    def test_services(self, temp_dir, rpc):
+        """Test services listed from the manifest before a run."""
+        client = self._project(temp_dir, rpc)
+        listing = client.call("omni/services")["result"]
+        assert listing["running"] is False and listing["manifest"] == str(temp_dir / "omni-run.yaml")
+        assert [(s["name"], s["state"], s["pid"]) for s in listing["services"]] == [("api", "stopped", None),
+                                                                                  ("web", "stopped", None)]
+
+    def test_before_run(self, temp_dir, rpc):
+        """Test logs, restarts and following before a run, and following without the logs capability."""
+        client = self._project(temp_dir, rpc)
+        assert client.call("omni/logs", {"service": "web"})["result"]["lines"] == []
+        assert client.call("omni/logs", {"service": "nope"})["error"]["message"] == "unknown service 'nope'"
+        assert client.call("omni/restart", {"service": "web"})["error"]["message"].startswith("no services are running")
+        follow = client.call("omni/logs", {"service": "web", "follow": True})["error"]
+        assert follow["message"] == "follow needs the logs capability in initialize"
+
+
+@pytest.mark.skipif(sys.platform == "win32", reason="Uses POSIX process groups")
+class TestRpcRun:
+    """Tests for running services through a session."""
+
+    def _running(self, temp_dir, rpc):
+        client, _, _ = rpc
+        echo = "import sys\nprint('\\033[32mready\\033[0m', flush=True)\nfor line in sys.stdin:\n    print('got ' + line.strip(), flush=True)\n"
+        (temp_dir / "echo.py").write_text(echo)
+        write_manifest(temp_dir, f"""
+services:
+  db:
+    command: ["{sys.executable}", "-c", "import time; print('db up', flush=True); time.sleep(60)"]
+  api:
+    command: ["{sys.executable}", "echo.py"]
+    depends_on: [db]
+""")
+        client.call("initialize", {"capabilities": {"logs": True, "events": True}})
+        assert client.call("omni/up", {"services": ["api"]})["result"] == {"services": ["db", "api"]}
+        return client
+
+    def _following(self, temp_dir, rpc):
+        client = self._running(temp_dir, rpc)
+        assert client.call("omni/logs", {"service": "api", "follow": True})["result"]["following"]
+        client.wait_for(lambda m: m.get("method") == "omni/log" and m["params"]["line"] == "ready")
+        return client
+
+    def _started(self, client):
+        client.wait_for(lambda m: m.get("method") == "omni/event" and m["params"]["service"] == "api" and
+                        m["params"]["type"] == "started")
+
+    def test_up(self, temp_dir, rpc):
+        """Test that omni/up starts the services with their dependencies, once."""
+        client = self._running(temp_dir, rpc)
+        assert client.call("omni/up")["error"]["message"].startswith("services are already running")
+
+    def test_follow(self, temp_dir, rpc):
+        """Test following a service's log without colors or other services' lines, and unfollowing it."""
+        client = self._following(temp_dir, rpc)
+        assert not any(m.get("method") == "omni/log" and m["params"]["service"] == "db" for m in client.notifications)
+        assert client.call("omni/unfollow", {})["result"] == {"following": []}
+
+    def test_services(self, temp_dir, rpc):
+        """Test the started event and the services listed from the run."""
+        client = self._running(temp_dir, rpc)
+        self._started(client)
+        listing = client.call("omni/services")["result"]
+        api = next(s for s in listing["services"] if s["name"] == "api")
+        assert listing["running"] and api["state"] in ("starting", "running") and api["pid"]
+
+    def test_input(self, temp_dir, rpc):
+        """Test sending a line to a service's stdin."""
+        client = self._following(temp_dir, rpc)
+        assert client.call("omni/input", {"service": "api", "text": "hello"})["result"] == {"service": "api", "sent": 5}
+        client.wait_for(lambda m: m.get("method") == "omni/log" and m["params"]["line"] == "got hello")
+
+    def test_history(self, temp_dir, rpc):
+        """Test the recent lines of a service's log."""
+        client = self._following(temp_dir, rpc)
+        history = client.call("omni/logs", {"service": "db", "lines": 5})["result"]["lines"]
+        assert [e["line"] for e in history if e["line"] == "db up"] == ["db up"] and history[0]["service"] == "db"
+
+    def test_restart(self, temp_dir, rpc):
+        """Test that a queued restart starts a new process."""
+        client = self._running(temp_dir, rpc)
+        self._started(client)
+        pid = next(s for s in client.call("omni/services")["result"]["services"] if s["name"] == "api")["pid"]
+        assert client.call("omni/restart", {"service": "api"})["result"] == {"service": "api", "queued": "restart"}
+        client.wait_for(lambda m: m.get("method") == "omni/event" and m["params"]["type"] == "started" and
+                        m["params"]["pid"] != pid)
+
+    def test_stop_and_shutdown(self, temp_dir, rpc):
+        """Test stopping the run, then shutdown and exit."""
+        _, backend, runner = rpc
+        client = self._running(temp_dir, rpc)
+        assert client.call("omni/stop", {})["result"] == {"stopping": True}
+        assert client.wait_for(lambda m: m.get("method") == "omni/exited")["params"] == {"exitCode": 0}
+        assert client.call("shutdown")["result"] is None
+        assert client.call("omni/services")["error"]["message"] == "the server was shut down; only exit remains"
+        client.send({"method": "exit"})
+        runner.join(timeout=5)
+        assert not runner.is_alive() and not backend.running()
+
+
+class TestRpcCommand:
+    """Tests for `omni-run rpc` as a process."""
+
+    INITIALIZE = {"jsonrpc": "2.0", "id": 1, "method": "initialize", "params": {"protocolVersion": 1}}
+
+    def test_stdio(self, temp_dir):
+        """Test a session over stdin/stdout, with omni-run's own messages kept off stdout."""
+        import omni_run
+
+        write_manifest(temp_dir, "services:\n  api: {command: ./api}\n")
+        messages = [self.INITIALIZE, {"jsonrpc": "2.0", "id": 2, "method": "omni/services"},
+                    {"jsonrpc": "2.0", "id": 3, "method": "shutdown"}, {"jsonrpc": "2.0", "method": "exit"}]
+        result = subprocess.run([sys.executable, omni_run.__file__, "rpc", "-C", str(temp_dir)],
+                                input=b"".join(frame(m) for m in messages), capture_output=True, timeout=60)
+        assert result.returncode == 0, result.stderr
+        stream = io.BytesIO(result.stdout)
+        replies = [omni_run.read_rpc_message(stream) for _ in range(3)]
+        assert omni_run.read_rpc_message(stream) is None
+        assert [r["id"] for r in replies] == [1, 2, 3]
+        assert [s["name"] for s in replies[1]["result"]["services"]] == ["api"]
+
+    def test_stdio_without_shutdown(self, temp_dir):
+        """Test that input ending without shutdown exits with code 1, as in LSP."""
+        import omni_run
+
+        write_manifest(temp_dir, "services:\n  api: {command: ./api}\n")
+        result = subprocess.run([sys.executable, omni_run.__file__, "rpc", "-C", str(temp_dir)],
+                                input=frame(self.INITIALIZE), capture_output=True, timeout=60)
+        assert result.returncode == 1
+
+    @pytest.mark.skipif(not hasattr(socket, "AF_UNIX"), reason="Needs Unix domain sockets")
+    def test_socket(self, rpc_socket):
+        """Test two clients on a Unix socket sharing one server."""
+        path, _ = rpc_socket
+        clients = []
+        for _ in range(2):
+            sock = socket.socket(socket.AF_UNIX, socket.SOCK_STREAM)
+            sock.connect(str(path))
+            clients.append(RpcClient(sock))
+        for client in clients:
+            assert client.call("initialize", {})["result"]["protocolVersion"] == 1
+            assert client.call("omni/services")["result"]["services"][0]["name"] == "api"
+        clients[0].send({"method": "exit"})
+        assert clients[0].read() is None
+        assert clients[1].call("omni/services")["result"]["running"] is False
+        clients[1].sock.close()
+
+    @pytest.mark.skipif(not hasattr(socket, "AF_UNIX"), reason="Needs Unix domain sockets")
+    def test_socket_removed(self, rpc_socket):
+        """Test the listening message, and that the socket is removed when the server stops."""
+        path, server = rpc_socket
+        server.terminate()
+        output = server.communicate(timeout=20)[0].decode()
+        assert f"JSON-RPC listening on {path}" in output and not path.exists()
+
+    def test_port_token(self, temp_dir):
+        """Test that a client on --port must pass the token printed on start to initialize."""
+        import re
+        import omni_run
+
+        write_manifest(temp_dir, "services:\n  api: {command: ./api}\n")
+        server = subprocess.Popen([sys.executable, omni_run.__file__, "rpc", "-C", str(temp_dir), "--port", "0"],
+                                  stdout=subprocess.PIPE, stderr=subprocess.STDOUT)
+        try:
+            output = ""
+            while "token" not in output:
+                line = server.stdout.readline().decode()
+                assert line, output
+                output += omni_run.ANSI_ESCAPE.sub("", line)
+            port = int(re.search(r"listening on 127\.0\.0\.1:(\d+)", output).group(1))
+            token = re.search(r'"token": "(\w+)"', output).group(1)
+            client = RpcClient(socket.create_connection(("127.0.0.1", port), timeout=20))
+            for params in ({}, {"token": "guess"}):
+                refused = client.call("initialize", params)["error"]
+                assert refused == {"code": -32004, "message": "missing or invalid token"}
+            assert client.call("omni/services")["error"]["code"] == -32002
+            assert client.call("initialize", {"token": token})["result"]["protocolVersion"] == 1
+            client.sock.close()
+        finally:
+            server.terminate()
+            server.communicate(timeout=20)
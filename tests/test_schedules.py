@@ -0,0 +1,220 @@
+"""
+Tests for scheduled tasks in OmniRun.
+
+This module tests:
+- Parsing cron expressions, macros and `@every`, and finding the next run
+- Parsing `schedules:` (task references, inline commands) and their errors
+- Overlap policies (skip, queue, kill) and timeouts in ScheduleRunner
+- Running schedules during `up`, and their state in status output and the dashboard
+"""
+
+import sys
+import json
+import time
+import pytest
+from pathlib import Path
+from datetime import datetime, timedelta
+
+from conftest import *
+
+
+def sleep_command(seconds: float) -> str:
+    return f"['{sys.executable}', '-c', 'import time; time.sleep({seconds})']"
+
+
+class TestCronSchedule:
+    """Tests for cron expressions."""
+
+    def test_next_after(self):
+        """Test ranges, steps, names, macros and @every."""
+        from omni_run import CronSchedule
+
+        friday = datetime(2026, 10, 16, 17, 50, 30)
+        weekdays = CronSchedule.parse("*/15 9-17 * * mon-fri")
+        assert weekdays.next_after(friday) == datetime(2026, 10, 19, 9, 0)
+        assert weekdays.next_after(datetime(2026, 10, 19, 9, 0)) == datetime(2026, 10, 19, 9, 15)
+        assert CronSchedule.parse("@hourly").next_after(friday) == datetime(2026, 10, 16, 18, 0)
+        assert CronSchedule.parse("0 0 1 jan *").next_after(friday) == datetime(2027, 1, 1, 0, 0)
+        assert CronSchedule.parse("0 0 29 2 *").next_after(friday) == datetime(2028, 2, 29, 0, 0)
+        assert CronSchedule.parse("5,10 * * * 7").next_after(friday) == datetime(2026, 10, 18, 0, 5)
+        assert CronSchedule.parse("@every 90s").next_after(friday) == friday + timedelta(seconds=90)
+
+        # With both day fields restricted, either one matching is enough
+        either = CronSchedule.parse("0 12 13 * fri")
+        assert either.next_after(datetime(2026, 10, 14)) == datetime(2026, 10, 16, 12, 0)
+        assert either.next_after(datetime(2026, 11, 7)) == datetime(2026, 11, 13, 12, 0)
+
+    def test_invalid_expressions(self):
+        """Test errors for field counts, out-of-range values, bad steps and impossible dates."""
+        from omni_run import CronSchedule
+
+        for expression, message in [("* * * *", "expected 5 fields"), ("60 * * * *", "minute: '60' is outside 0-59"),
+                                    ("*/0 * * * *", "minute: invalid step '0'"),
+                                    ("0 0 * * someday", "day of week: invalid value 'someday'"),
+                                    ("0 0 30 2 *", "never matches a date"), ("@every soon", "")]:
+            with pytest.raises(ValueError, match=message):
+                CronSchedule.parse(expression)
+
+
+class TestScheduleConfig:
+    """Tests for the `schedules:` block."""
+
+    def test_parse_schedules(self, temp_dir):
+        """Test schedules referencing a task and with an inline command."""
+        from omni_run import load_manifest
+
+        manifest = load_manifest(write_manifest(temp_dir, """
+services:
+  api: {command: 'true'}
+tasks:
+  generate: protoc --go_out=. api.proto
+schedules:
+  regen: {cron: "*/5 * * * *", task: generate}
+  warmup:
+    cron: "@every 30s"
+    command: curl -fsS http://localhost:8080/warmup
+    timeout: 10s
+    overlap: kill
+"""))
+        regen, warmup = manifest.schedules["regen"], manifest.schedules["warmup"]
+        assert regen.task is manifest.tasks["generate"] and regen.overlap == "skip"
+        assert regen.cron.expression == "*/5 * * * *"
+        assert (warmup.task.name, warmup.task.timeout, warmup.overlap) == ("warmup", 10, "kill")
+        assert warmup.cron.interval == 30
+
+    def test_invalid_schedules(self, temp_dir):
+        """Test missing and unknown tasks, bad cron and overlap values, and name clashes."""
+        from omni_run import load_manifest, ManifestError
+
+        for block, message in [("a: {task: gen}", "schedules.a: needs a cron expression"),
+                               ("a: {cron: '@daily'}", "schedules.a: needs either a task or a command"),
+                               ("a: {cron: '@daily', task: gen, command: make}", "needs either a task or a command"),
+                               ("a: {cron: '@daily', task: build}", "schedules.a.task: unknown task 'build'"),
+                               ("a: {cron: '@daily', task: gen, timeout: 5s}", "timeout only apply to a command"),
+                               ("a: {cron: '99 * * * *', task: gen}", "schedules.a.cron: minute"),
+                               ("a: {cron: '@daily', task: gen, overlap: wait}", "overlap: must be one of skip, queue, kill"),
+                               ("api: {cron: '@daily', task: gen}", "already used by a service")]:
+            write_manifest(temp_dir, f"services:\n  api: {{command: 'true'}}\ntasks:\n  gen: make\nschedules:\n  {block}\n")
+            with pytest.raises(ManifestError, match=message):
+                load_manifest(temp_dir / "omni-run.yaml")
+
+
+@pytest.mark.skipif(sys.platform == "win32", reason="Uses POSIX process groups")
+class TestScheduleRunner:
+    """Tests for running schedules with ScheduleRunner."""
+
+    def _runner(self, temp_dir, omni_runner, command, overlap="skip", timeout=None):
+        from omni_run import load_manifest, Orchestrator, ScheduleRunner
+
+        extra = f"\n    timeout: {timeout}" if timeout else ""
+        manifest = load_manifest(write_manifest(temp_dir, f"""
+services:
+  api: {{command: 'true'}}
+schedules:
+  job:
+    cron: "@every 1s"
+    command: {command}
+    overlap: {overlap}{extra}
+"""))
+        start = datetime(2026, 1, 1, 12, 0, 0)
+        return ScheduleRunner(Orchestrator(omni_runner, manifest), now=start), start
+
+    def _until(self, runner, now, condition, timeout=10):
+        deadline = time.time() + timeout
+        while not condition() and time.time() < deadline:
+            runner.tick(now)
+            time.sleep(0.05)
+        assert condition()
+
+    def _overlapping(self, temp_dir, omni_runner, overlap):
+        runner, start = self._runner(temp_dir, omni_runner, sleep_command(0.4), overlap)
+        job = runner.jobs["job"]
+        runner.tick(start)
+        assert job.process is None and job.next_run == start + timedelta(seconds=1)
+
+        runner.tick(start + timedelta(seconds=1))
+        first = job.process
+        assert first is not None
+        runner.tick(start + timedelta(seconds=2))
+        return runner, start, job, first
+
+    def test_skip(self, temp_dir, omni_runner, capsys):
+        """Test that a run due while the previous one is still going is skipped."""
+        runner, start, job, first = self._overlapping(temp_dir, omni_runner, "skip")
+        assert (job.queued, job.skipped) == (False, True)
+        self._until(runner, start, lambda: job.runs == 1)
+        assert job.last["status"] == "succeeded"
+        assert job.process is None
+        assert "skipped: the previous run" in capsys.readouterr().out
+
+    def test_queue(self, temp_dir, omni_runner, capsys):
+        """Test that a run due while the previous one is still going starts once it finishes."""
+        runner, start, job, first = self._overlapping(temp_dir, omni_runner, "queue")
+        assert (job.queued, job.skipped) == (True, False)
+        self._until(runner, start, lambda: job.runs == 1)
+        assert job.last["status"] == "succeeded"
+        assert job.process is not None and job.process is not first
+        self._until(runner, start, lambda: job.runs == 2)
+        assert "queued: starts when pid" in capsys.readouterr().out
+
+    def test_kill_previous_and_timeout(self, temp_dir, omni_runner, capsys):
+        """Test that overlap: kill stops the running run before starting again, and timeouts stop runs."""
+        runner, start = self._runner(temp_dir, omni_runner, sleep_command(30), "kill")
+        job = runner.jobs["job"]
+        runner.tick(start + timedelta(seconds=1))
+        first = job.process
+        runner.tick(start + timedelta(seconds=2))
+        self._until(runner, start, lambda: job.runs == 1 and job.process is not None)
+        assert job.last["status"] == "killed" and job.process is not first and job.failures == 0
+        runner.stop()
+        assert job.process is None and job.runs == 2
+
+        runner, start = self._runner(temp_dir, omni_runner, sleep_command(30), timeout="200ms")
+        job = runner.jobs["job"]
+        runner.tick(start + timedelta(seconds=1))
+        self._until(runner, start, lambda: job.runs == 1)
+        assert job.last["status"] == "timed out" and job.failures == 1
+        assert "timed out after 0.2s; stopping" in capsys.readouterr().out
+
+
+@pytest.mark.skipif(sys.platform == "win32", reason="Uses POSIX shell commands")
+class TestSchedulesDuringUp:
+    """Tests for schedules while `up` runs."""
+
+    def test_up_runs_schedules(self, temp_dir, omni_runner, capsys):
+        """Test that schedules fire while services run, with OMNI_RUN_SCHEDULE, and show in the snapshot."""
+        from omni_run import load_manifest, Orchestrator, Dashboard
+
+        manifest = load_manifest(write_manifest(temp_dir, """
+services:
+  api: {command: sleep 1.5}
+schedules:
+  tick:
+    cron: "@every 300ms"
+    command: echo "$OMNI_RUN_SCHEDULE" >> ticks.txt
+"""))
+        orchestrator = Orchestrator(omni_runner, manifest)
+        assert orchestrator.up() == 0
+        ticks = (temp_dir / "ticks.txt").read_text().split()
+        assert len(ticks) >= 2 and set(ticks) == {"tick"}
+
+        view = orchestrator.snapshot()["schedules"]["tick"]
+        assert view["cron"] == "@every 300ms" and view["runs"] >= len(ticks)
+        assert view["failures"] == 0 and view["last_run"] is not None
+        row, = Dashboard(orchestrator, orchestrator.logs).schedule_rows()
+        assert row.startswith("tick") and f"{view['last_run']['status']} at" in row
+
+    def test_status_output(self, temp_dir, capsys):
+        """Test the schedule summary and the JSON status document."""
+        from omni_run import run_subcommand, write_supervisor_state, schedule_summary
+
+        info = {"cron": "@hourly", "next_run": "2026-01-01T13:00:00", "pid": None, "runs": 3, "failures": 1,
+                "skipped": 2, "last_run": {"at": "2026-01-01T12:00:00", "status": "failed", "exit_code": 1, "duration": 2.5}}
+        assert schedule_summary(info) == "failed at 12:00:00 (2.5s), 1 failed, 2 skipped"
+        assert schedule_summary({**info, "pid": 42}) == "running (pid 42), 1 failed, 2 skipped"
+
+        write_manifest(temp_dir, "services:\n  api: {command: 'true'}\n")
+        (temp_dir / ".omni-run").mkdir()
+        write_supervisor_state(temp_dir / ".omni-run", {"services": {}, "schedules": {"regen": info}})
+        assert run_subcommand(["status", "-C", str(temp_dir), "--output", "json"]) == 3
+        assert json.loads(capsys.readouterr().out)["schedules"]["regen"]["runs"] == 3
@@ -0,0 +1,204 @@
+"""
+Tests for manifest schema validation in OmniRun.
+
+This module tests:
+- Unknown keys with did-you-mean suggestions, at every nesting level
+- Type errors with line and column of the offending value
+- Reporting every problem at once, and the manifest `version:`
+- Migrating older manifest versions when loaded, and `omni-run config migrate`
+- Warnings for unknown keys in the user config file
+"""
+
+import json
+import pytest
+from pathlib import Path
+
+from conftest import *
+
+
+class TestManifestSchema:
+    """Tests for validating manifests against the schema."""
+
+    def _error(self, temp_dir, content):
+        from omni_run import load_manifest, ManifestSchemaError
+
+        with pytest.raises(ManifestSchemaError) as info:
+            load_manifest(write_manifest(temp_dir, content))
+        return info.value
+
+    def test_unknown_keys_with_suggestions(self, temp_dir):
+        """Test that typos are rejected at their line and column with the closest known key."""
+        error = self._error(temp_dir, """
+services:
+  api:
+    comand: ./server
+    helth:
+      path: /healthz
+      intervall: 5s
+taks: {}
+""")
+        assert [(i.line, i.column) for i in error.issues] == [(4, 5), (5, 5), (8, 1)]
+        lines = str(error).splitlines()
+        assert lines[0] == "omni-run.yaml:4:5: services.api: unknown key(s) comand (did you mean command?)"
+        assert lines[1] == "omni-run.yaml:5:5: services.api: unknown key(s) helth (did you mean health?)"
+        assert lines[2] == "omni-run.yaml:8:1: unknown key(s) taks (did you mean tasks?)"
+
+        error = self._error(temp_dir, "services:\n  api:\n    command: x\n    health: {path: /h, intervall: 5s}\n")
+        assert "services.api.health: unknown key(s) intervall (did you mean interval?)" in str(error)
+        error = self._error(temp_dir, "services:\n  api: {command: x, zzz: 1}\n")
+        assert str(error).endswith("unknown key(s) zzz")
+
+    def test_type_errors(self, temp_dir):
+        """Test that values of the wrong type are located at their key, including inside lists."""
+        error = self._error(temp_dir, """
+services:
+  api:
+    command: x
+    env: {DEBUG: [1]}
+    restart: {max_restarts: many}
+    ports: [8080, {port: 9000, fallbak: false}]
+    hooks:
+      pre_start: [{command: migrate, timout: 1}]
+""")
+        messages = [f"{i.line}:{i.column} {i.where}: {i.message}" for i in error.issues]
+        assert messages == [
+            "5:11 services.api.env.DEBUG: expected a string or number, got a list",
+            "6:15 services.api.restart.max_restarts: expected an integer, got string 'many'",
+            "7:32 services.api.ports[1]: unknown key(s) fallbak (did you mean fallback?)",
+            "9:38 services.api.hooks.pre_start[0]: unknown key(s) timout (did you mean timeout?)",
+        ]
+        error = self._error(temp_dir, "services:\n  api:\n    command: x\n    health: {failure_threshold: true}\n")
+        assert "expected an integer, got boolean true" in str(error)
+
+    def test_valid_shorthands_accepted(self, temp_dir):
+        """Test that every documented shorthand form passes the schema."""
+        from omni_run import load_manifest
+
+        manifest = load_manifest(write_manifest(temp_dir, """
+version: 1
+startup_timeout: 30s
+services:
+  db: {command: [sleep, 100], ports: 5432, restart: always}
+  api:
+    command: ./server
+    ports: {http: auto, admin: {port: 9000, fallback: fail}}
+    depends_on: [db, {cache: port_open}]
+    hooks: {pre_start: ./migrate.sh, post_start: [[echo, one], {command: echo two, timeout: 5s}]}
+    tags: backend
+    install: false
+    env: {EMPTY:, N: 3}
+  cache: {command: x, ports: [6379], health: 'http://127.0.0.1:6379/', depends_on: {db: {condition: service_started, timeout: 10s}}}
+tasks:
+  build: [make, all]
+  test: {command: make test, depends_on: build}
+profiles:
+  ci: {env: {CI: true}, services: {api: {restart: {policy: on-failure}}}}
+proxy: {tls: true, routes: {/api: api}}
+"""))
+        assert manifest.version == 1
+        assert set(manifest.services) == {"db", "api", "cache"}
+
+    def test_version(self, temp_dir):
+        """Test that newer manifest versions are refused with an upgrade hint."""
+        error = self._error(temp_dir, "version: 3\nservices: {}\n")
+        assert str(error) == "omni-run.yaml:1:1: version: manifest version 3 needs a newer omni-run (this one reads up to 2)"
+        error = self._error(temp_dir, "version: one\n")
+        assert "version: must be one of 1, 2" in str(error)
+
+
+class TestMigrations:
+    """Tests for reading and rewriting older manifest versions."""
+
+    V1 = """\
+# Local stack
+version: 1
+services:
+  worker:
+    command: celery -A app worker
+    stop_signal: SIGINT
+    env: {QUEUE: default}
+    stop_timeout: 30s
+profiles:
+  ci: {services: {worker: {stop_timeout: 5s}}}
+"""
+
+    def test_load_migrates_in_memory(self, temp_dir):
+        """Test that services and profiles are migrated when loaded and the file is left alone."""
+        from omni_run import load_manifest, MANIFEST_VERSION
+
+        manifest = load_manifest(write_manifest(temp_dir, self.V1), profile="ci")
+        assert manifest.version == 1 and MANIFEST_VERSION == 2
+        assert manifest.migrations == ["services.worker: stop_signal and stop_timeout moved into stop:",
+                                       "profiles.ci.services.worker: stop_timeout moved into stop:"]
+        assert (manifest.services["worker"].stop_signal, manifest.services["worker"].stop_timeout) == (2, 5)
+        assert list(manifest.raw["services"]["worker"]) == ["command", "stop", "env"]
+        assert manifest.raw["version"] == 2
+        assert (temp_dir / "omni-run.yaml").read_text() == self.V1  # The file is left alone
+
+    def test_detected_version(self):
+        """Test versions detected from the keys in use, and a current manifest needing no migration."""
+        from omni_run import migrate_manifest, manifest_version
+
+        assert manifest_version({"services": {"a": {"command": "x", "stop_timeout": 1}}}) == 1
+        assert manifest_version({"services": {"a": {"command": "x", "stop": {"timeout": 1}}}}) == 2
+        assert manifest_version({"services": {}}) == 2
+        current = {"version": 2, "services": {}}
+        assert migrate_manifest(current) == (current, [])
+
+    def test_mixed_versions(self, temp_dir):
+        """Test that a service mixing old and new stop keys is rejected."""
+        error = TestManifestSchema()._error(temp_dir, "services:\n  a: {command: x, stop: {}, stop_timeout: 1}\n")
+        assert "services.a: unknown key(s) stop_timeout" in str(error)
+
+    def test_config_migrate_dry_run(self, temp_dir, capsys):
+        """Test that `config migrate` prints a diff and leaves the file alone."""
+        from omni_run import run_subcommand
+
+        write_manifest(temp_dir, self.V1)
+        assert run_subcommand(["config", "migrate", "-C", str(temp_dir)]) == 0
+        out = capsys.readouterr().out
+        assert "omni-run.yaml: manifest version 1 -> 2" in out
+        assert "-    stop_signal: SIGINT\n" in out and "+    stop:\n+      signal: SIGINT\n" in out
+        assert "--write" in out and (temp_dir / "omni-run.yaml").read_text() == self.V1
+
+    def test_config_migrate_write(self, temp_dir, capsys):
+        """Test that --write rewrites the manifest and keeps a backup."""
+        import yaml
+        from omni_run import run_subcommand, load_manifest
+
+        write_manifest(temp_dir, self.V1)
+        assert run_subcommand(["config", "migrate", "--write", "-C", str(temp_dir)]) == 0
+        assert "the original is in omni-run.yaml.bak" in capsys.readouterr().out
+        assert (temp_dir / "omni-run.yaml.bak").read_text() == self.V1
+        data = yaml.safe_load((temp_dir / "omni-run.yaml").read_text())
+        assert data["version"] == 2 and data["services"]["worker"]["stop"] == {"signal": "SIGINT", "timeout": "30s"}
+        assert load_manifest(temp_dir / "omni-run.yaml").services["worker"].stop_timeout == 30
+
+    def test_config_migrate_current(self, temp_dir, capsys):
+        """Test a manifest that is already current, and one that can't be read."""
+        from omni_run import run_subcommand
+
+        write_manifest(temp_dir, self.V1)
+        assert run_subcommand(["config", "migrate", "--write", "-C", str(temp_dir)]) == 0
+        capsys.readouterr()
+        assert run_subcommand(["config", "migrate", "-C", str(temp_dir)]) == 0
+        assert "already manifest version 2" in capsys.readouterr().out
+        write_manifest(temp_dir, "services: [a]\n")
+        assert run_subcommand(["config", "migrate", "-C", str(temp_dir)]) == 1
+
+
+class TestConfigKeys:
+    """Tests for unknown keys in the user config file."""
+
+    def test_unknown_config_keys_warned(self, temp_dir, capsys):
+        """Test that misspelled config keys are reported with a suggestion and otherwise ignored."""
+        from omni_run import OmniRun
+
+        config = temp_dir / "config.json"
+        config.write_text(json.dumps({"max_depht": 3, "logs": {"levle": "debug"}, "docker": {"images": {"node": "x"}}}))
+        launcher = OmniRun(str(temp_dir), config_file=str(config))
+        out = capsys.readouterr().out
+        assert "unknown config key max_depht (did you mean max_depth?)" in out
+        assert "unknown config key logs.levle (did you mean logs.level?)" in out
+        assert "docker.images" not in out
+        assert launcher.config["max_depth"] == 10
@@ -0,0 +1,196 @@
+"""
+Tests for manifest scripts (`scripts:`) in OmniRun.
+
+This module tests:
+- Parsing scripts: commands, descriptions, directories, services (and replicated ones) and invalid entries
+- Passing arguments on: appended to argument lists, quoted onto shell commands
+- `omni-run <script>` dispatch next to built-in commands and paths, and completion of script names
+- Running scripts with the project's or a service's environment, ports and templates, and the exit code
+"""
+
+import sys
+import json
+import pytest
+from pathlib import Path
+
+from conftest import *
+
+
+# Records its arguments, working directory and some variables in out.json, then exits with $EXIT_CODE
+RECORDER = """import json, os, sys
+json.dump({"args": sys.argv[1:], "cwd": os.getcwd(),
+           "env": {k: os.environ.get(k) for k in ("GREETING", "PORT", "DB_URL", "OMNI_RUN_SCRIPT", "OMNI_RUN_SERVICE")}},
+          open(os.path.join(os.environ["OUT_DIR"], "out.json"), "w"))
+sys.exit(int(os.environ.get("EXIT_CODE", "0")))
+"""
+
+
+class TestScriptSpec:
+    """Tests for parsing `scripts:`."""
+
+    def _scripts(self, temp_dir):
+        from omni_run import load_manifest
+
+        (temp_dir / "api").mkdir()
+        write_manifest(temp_dir, """
+services:
+  api: {path: api, command: ./api}
+  worker: {command: ./worker, replicas: 2}
+scripts:
+  fmt: gofmt -w .
+  lint: [ruff, check, .]
+  db:reset: {command: ./reset.sh, description: Drop and re-seed the database, service: api, path: db}
+  drain: {command: ./drain, service: worker}
+""")
+        return load_manifest(temp_dir / "omni-run.yaml").scripts
+
+    def test_entries(self, temp_dir):
+        """Test the command forms, descriptions, directories and services."""
+        scripts = self._scripts(temp_dir)
+        assert list(scripts) == ["fmt", "lint", "db:reset", "drain"]
+        assert (scripts["fmt"].path, scripts["fmt"].service) == (temp_dir.resolve(), None)
+        reset = scripts["db:reset"]
+        assert (reset.service, reset.path, reset.description) == ("api", (temp_dir / "api" / "db").resolve(),
+                                                                   "Drop and re-seed the database")
+
+    def test_replicated_service(self, temp_dir):
+        """Test that a replicated service runs the script as its first instance."""
+        assert self._scripts(temp_dir)["drain"].service == "worker-1"
+
+    def test_list_arguments(self, temp_dir):
+        """Test that arguments are appended to an argument list."""
+        assert self._scripts(temp_dir)["lint"].argv(["--fix", "src dir"]) == ["ruff", "check", ".", "--fix", "src dir"]
+
+    @pytest.mark.skipif(sys.platform == "win32", reason="Shell commands run under /bin/sh")
+    def test_shell_arguments(self, temp_dir):
+        """Test that arguments are quoted onto a shell command."""
+        scripts = self._scripts(temp_dir)
+        assert scripts["fmt"].argv([]) == ["/bin/sh", "-c", "gofmt -w ."]
+        assert scripts["fmt"].argv(["-l", "it's"]) == ["/bin/sh", "-c", "gofmt -w . -l 'it'\"'\"'s'"]
+
+    def test_errors(self, temp_dir):
+        """Test unknown services, missing commands, bad names and missing env files."""
+        from omni_run import load_manifest, ManifestError
+
+        for block, message in [("fmt: {service: nope, command: x}", "scripts.fmt.service: unknown service 'nope'"),
+                               ("fmt: {description: formats}", "scripts.fmt: needs a command"),
+                               ("-fmt: gofmt", "scripts.-fmt: use letters, digits"),
+                               ("fmt: {command: x, env_file: .env.nope}", "scripts.fmt.env_file: .* not found"),
+                               ("fmt: {command: x, args: [1]}", r"scripts.fmt: unknown key\(s\) args")]:
+            write_manifest(temp_dir, f"services:\n  api: {{command: ./api}}\nscripts:\n  {block}\n")
+            with pytest.raises(ManifestError, match=message):
+                load_manifest(temp_dir / "omni-run.yaml")
+
+
+class TestScriptDispatch:
+    """Tests for telling scripts from built-in commands and paths."""
+
+    def _scripts(self, temp_dir):
+        write_manifest(temp_dir, "scripts:\n  lint: {command: ruff check, description: Lint the code}\n"
+                                 "  db:reset: ./reset.sh\n  up: echo shadowed\n")
+        return str(temp_dir)
+
+    def test_rewrite(self, temp_dir, monkeypatch):
+        """Test rewriting `omni-run <script>`, with global options before it or from the current directory."""
+        from omni_run import script_subcommand
+
+        project = self._scripts(temp_dir)
+        assert script_subcommand(["-C", project, "lint", "--", "--fix"]) == ["script", "-C", project, "lint", "--", "--fix"]
+        assert script_subcommand([f"--project-dir={project}", "-v", "db:reset"]) == [
+            "script", f"--project-dir={project}", "-v", "db:reset"]
+        monkeypatch.chdir(temp_dir)
+        assert script_subcommand(["lint"]) == ["script", "lint"]
+
+    def test_left_alone(self, temp_dir):
+        """Test that unknown names, the legacy scanner's options and paths are left alone."""
+        from omni_run import script_subcommand
+
+        project = self._scripts(temp_dir)
+        assert script_subcommand(["-C", project, "nope"]) is None
+        assert script_subcommand(["-C", project, "--html", "x", "lint"]) is None  # Options of the legacy scanner
+        assert script_subcommand(["-C", project, "./lint"]) is None
+
+    def test_completion(self, temp_dir, monkeypatch):
+        """Test completing script names next to commands, and after `script`."""
+        from omni_run import complete_arguments
+
+        self._scripts(temp_dir)
+        monkeypatch.chdir(temp_dir)
+        candidates = dict(complete_arguments([""]))
+        assert candidates["lint"] == "script: Lint the code" and candidates["db:reset"] == "script: ./reset.sh"
+        assert not candidates["up"].startswith("script")
+        assert dict(complete_arguments(["script", "d"])) == {"db:reset": "./reset.sh"}
+
+
+class TestScriptCommand:
+    """Tests for running scripts."""
+
+    def _out(self, temp_dir: Path) -> dict:
+        return json.loads((temp_dir / "out.json").read_text())
+
+    def _recording(self, temp_dir, monkeypatch):
+        (temp_dir / "record.py").write_text(RECORDER)
+        (temp_dir / ".env").write_text("GREETING=hello\n")
+        (temp_dir / "api").mkdir()
+        monkeypatch.setenv("OUT_DIR", str(temp_dir))
+        write_manifest(temp_dir, f"""
+services:
+  api:
+    path: api
+    command: ./api
+    ports: {{http: 18080}}
+    env: {{GREETING: from-api}}
+scripts:
+  greet: ["{sys.executable}", "{temp_dir / 'record.py'}"]
+  migrate:
+    command: ["{sys.executable}", "{temp_dir / 'record.py'}", "--step"]
+    service: api
+    env: {{DB_URL: "postgres://localhost:${{service.api.port}}/app"}}
+  fail: {{command: ["{sys.executable}", "{temp_dir / 'record.py'}"], env: {{EXIT_CODE: "3"}}}}
+""")
+
+    def test_project_environment(self, temp_dir, monkeypatch):
+        """Test arguments after -- and the project's directory and .env layers."""
+        from omni_run import run_subcommand
+
+        self._recording(temp_dir, monkeypatch)
+        assert run_subcommand(["script", "-C", str(temp_dir), "greet", "--", "a b", "--flag"]) == 0
+        out = self._out(temp_dir)
+        assert out["args"] == ["a b", "--flag"] and out["cwd"] == str(temp_dir.resolve())
+        assert out["env"] == {"GREETING": "hello", "PORT": None, "DB_URL": None, "OMNI_RUN_SCRIPT": "greet",
+                              "OMNI_RUN_SERVICE": None}
+
+    def test_service_environment(self, temp_dir, monkeypatch):
+        """Test a service's directory, environment, ports and templates."""
+        from omni_run import run_subcommand
+
+        self._recording(temp_dir, monkeypatch)
+        assert run_subcommand(["script", "-C", str(temp_dir), "migrate", "2"]) == 0
+        out = self._out(temp_dir)
+        assert out["args"] == ["--step", "2"] and out["cwd"] == str((temp_dir / "api").resolve())
+        assert out["env"] == {"GREETING": "from-api", "PORT": "18080", "DB_URL": "postgres://localhost:18080/app",
+                              "OMNI_RUN_SCRIPT": "migrate", "OMNI_RUN_SERVICE": "api"}
+
+    def test_exit_code(self, temp_dir, monkeypatch):
+        """Test that the script's exit code is the command's."""
+        from omni_run import run_subcommand
+
+        self._recording(temp_dir, monkeypatch)
+        assert run_subcommand(["script", "-C", str(temp_dir), "fail"]) == 3
+
+    def test_unknown_script(self, temp_dir, monkeypatch, capsys):
+        """Test the suggestion for a misspelled script."""
+        from omni_run import run_subcommand
+
+        self._recording(temp_dir, monkeypatch)
+        assert run_subcommand(["script", "-C", str(temp_dir), "gret"]) == 1
+        assert "Unknown script 'gret'; did you mean 'greet'?" in capsys.readouterr().out
+
+    def test_listing(self, temp_dir, monkeypatch, capsys):
+        """Test listing the scripts without a name."""
+        from omni_run import run_subcommand
+
+        self._recording(temp_dir, monkeypatch)
+        assert run_subcommand(["script", "-C", str(temp_dir)]) == 0
+        listing = capsys.readouterr().out
+        assert "migrate" in listing and "api" in listing
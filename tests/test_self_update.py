@@ -0,0 +1,208 @@
+"""
+Tests for `omni-run self-update` in OmniRun.
+
+This module tests:
+- Ed25519 signature verification against the RFC 8032 test vectors
+- Picking the newest release of the stable and beta channels, and ordering prereleases
+- `--check` for scripts, installing a signed release over the old file, and refusing unverified or relabelled ones
+"""
+
+import os
+import sys
+import json
+import base64
+import hashlib
+import pytest
+from pathlib import Path
+
+from conftest import *
+
+
+RFC8032_SEED = bytes.fromhex("9d61b19deffd5a60ba844af492ec2cc44449c5697b326919703bac031cae7f60")
+RFC8032_PUBLIC = bytes.fromhex("d75a980182b10ab7d54bfed3c964073a0ee172f3daa62325af021a68f707511a")
+RFC8032_SIGNATURE = bytes.fromhex("e5564300c360ac729086e2cc806e828a84877f1eb8e5d974d873e065224901555f"
+                                  "b8821590a33bacc61e39701cf9b46bd25bf5f0595bbe24655141438e7a100b")
+
+
+def sign(seed: bytes, message: bytes):
+    """Sign as a release pipeline would (RFC 8032): (public key, signature)."""
+    from omni_run import ED25519_BASE, ED25519_L, ED25519_P, ed25519_multiply
+
+    def encode(point):
+        inverse = pow(point[2], ED25519_P - 2, ED25519_P)
+        x, y = point[0] * inverse % ED25519_P, point[1] * inverse % ED25519_P
+        return (y | (x & 1) << 255).to_bytes(32, "little")
+
+    digest = hashlib.sha512(seed).digest()
+    secret = (int.from_bytes(digest[:32], "little") & ((1 << 254) - 8)) | (1 << 254)
+    public = encode(ed25519_multiply(secret, ED25519_BASE))
+    r = int.from_bytes(hashlib.sha512(digest[32:] + message).digest(), "little") % ED25519_L
+    R = encode(ed25519_multiply(r, ED25519_BASE))
+    k = int.from_bytes(hashlib.sha512(R + public + message).digest(), "little") % ED25519_L
+    return public, R + ((r + k * secret) % ED25519_L).to_bytes(32, "little")
+
+
+def publish(temp_dir: Path, releases, signature_of=None) -> Path:
+    """Write a release list (tag, prerelease, script or None) with file:// assets and signatures."""
+    entries = []
+    for tag, prerelease, script in releases:
+        directory = temp_dir / "releases" / tag
+        directory.mkdir(parents=True)
+        assets = []
+        if script is not None:
+            (directory / "omni_run.py").write_bytes(script)
+            signature = (signature_of or (lambda data: sign(b"k" * 32, data)[1]))(script)
+            (directory / "omni_run.py.sig").write_text(base64.b64encode(signature).decode() + "\n")
+            assets = [{"name": name, "browser_download_url": (directory / name).as_uri()}
+                      for name in ("omni_run.py", "omni_run.py.sig")]
+        entries.append({"tag_name": tag, "prerelease": prerelease, "draft": False, "assets": assets,
+                        "html_url": f"https://example.test/releases/{tag}"})
+    listing = temp_dir / "releases.json"
+    listing.write_text(json.dumps(entries))
+    return listing
+
+
+def write_config(temp_dir: Path, listing: Path, public_key=None) -> Path:
+    config = temp_dir / "config.json"
+    config.write_text(json.dumps({"self_update": {"url": listing.as_uri(), "public_key": public_key}}))
+    return config
+
+
+RELEASE_KEY = base64.b64encode(sign(b"k" * 32, b"")[0]).decode()
+
+# A release script for v3.1.0
+NEW_SCRIPT = b"OMNI_RUN_VERSION = '3.1.0'\nprint('new')\n"
+
+
+class TestSignatures:
+    """Tests for Ed25519 verification."""
+
+    def test_rfc8032_vectors(self, temp_dir):
+        """Test the RFC 8032 test vectors, tampered messages and signatures, and keys of the wrong size."""
+        from omni_run import ed25519_verify
+
+        assert sign(RFC8032_SEED, b"") == (RFC8032_PUBLIC, RFC8032_SIGNATURE)
+        assert ed25519_verify(RFC8032_PUBLIC, b"", RFC8032_SIGNATURE)
+        assert not ed25519_verify(RFC8032_PUBLIC, b"x", RFC8032_SIGNATURE)
+        assert not ed25519_verify(RFC8032_PUBLIC, b"", RFC8032_SIGNATURE[:-1] + b"\x0c")
+        assert not ed25519_verify(RFC8032_PUBLIC[:31], b"", RFC8032_SIGNATURE)
+
+        public, signature = sign(b"\x01" * 32, b"print('hello')\n")
+        assert ed25519_verify(public, b"print('hello')\n", signature)
+        assert not ed25519_verify(RFC8032_PUBLIC, b"print('hello')\n", signature)
+
+
+class TestReleases:
+    """Tests for finding the release to install."""
+
+    def test_channels(self, temp_dir):
+        """Test that stable skips prereleases, beta includes them, and drafts and releases without the script."""
+        from omni_run import SelfUpdater, release_key
+
+        listing = publish(temp_dir, [("v3.1.0", False, b"pass\n"), ("v3.2.0-beta.1", True, b"pass\n"),
+                                     ("v3.3.0", False, None)])
+        entries = json.loads(listing.read_text())
+        entries.append({"tag_name": "v4.0.0", "draft": True, "assets": entries[0]["assets"]})
+        listing.write_text(json.dumps(entries))
+
+        stable = SelfUpdater(listing.as_uri()).latest()
+        assert (stable.version, stable.prerelease, stable.url) == ("3.1.0", False, "https://example.test/releases/v3.1.0")
+        assert SelfUpdater(listing.as_uri(), channel="beta").latest().version == "3.2.0-beta.1"
+        assert sorted(["3.1.0", "3.1.0-beta.2", "3.0.9", "3.1.0-beta.10"], key=release_key) == [
+            "3.0.9", "3.1.0-beta.2", "3.1.0-beta.10", "3.1.0"]
+
+
+class TestSelfUpdate:
+    """Tests for `omni-run self-update`."""
+
+    def test_check(self, temp_dir, capsys):
+        """Test exit codes and messages of --check when an update is or isn't available, and JSON output."""
+        from omni_run import run_subcommand, UPDATE_AVAILABLE_EXIT, ANSI_ESCAPE
+
+        config = write_config(temp_dir, publish(temp_dir, [("v3.0.0", False, b"pass\n"), ("v3.1.0-rc.1", True, b"pass\n")]))
+        assert run_subcommand(["self-update", "--check", "--config", str(config), "-C", str(temp_dir)]) == 0
+        out = ANSI_ESCAPE.sub("", capsys.readouterr().out)
+        assert "omni-run 3.0.0 is up to date (the latest stable release is 3.0.0)" in out
+
+        arguments = ["self-update", "--check", "--channel", "beta", "--config", str(config), "-C", str(temp_dir)]
+        assert run_subcommand(arguments) == UPDATE_AVAILABLE_EXIT
+        out = ANSI_ESCAPE.sub("", capsys.readouterr().out)
+        assert "omni-run 3.1.0-rc.1 is available on the beta channel (this is 3.0.0)" in out
+        assert run_subcommand(arguments + ["--output", "json"]) == UPDATE_AVAILABLE_EXIT
+        document = json.loads(capsys.readouterr().out)
+        assert (document["kind"], document["current"], document["latest"], document["available"]) == (
+            "update", "3.0.0", "3.1.0-rc.1", True)
+
+        missing = write_config(temp_dir, temp_dir / "nowhere.json")
+        assert run_subcommand(["self-update", "--check", "--config", str(missing), "-C", str(temp_dir)]) == 1
+        assert "Could not download file://" in capsys.readouterr().out
+
+    def _installed(self, temp_dir, monkeypatch):
+        import omni_run
+
+        installed = temp_dir / "bin" / "omni_run.py"
+        installed.parent.mkdir()
+        installed.write_text("old\n")
+        installed.chmod(0o751)
+        monkeypatch.setattr(omni_run, "update_target", lambda: installed)
+        monkeypatch.delenv("OMNI_RUN_RELEASE_KEY", raising=False)
+        return installed, ["self-update", "-C", str(temp_dir), "--config"]
+
+    def test_forged_signature(self, temp_dir, monkeypatch, capsys):
+        """Test refusing a release signed with another key."""
+        from omni_run import run_subcommand
+
+        _, command = self._installed(temp_dir, monkeypatch)
+        forged = write_config(temp_dir, publish(temp_dir / "forged", [("v3.1.0", False, b"print('evil')\n")],
+                                                signature_of=lambda data: sign(b"x" * 32, data)[1]), RELEASE_KEY)
+        assert run_subcommand(command + [str(forged)]) == 1
+        assert "does not match the release signing key; refusing to install it" in capsys.readouterr().out
+
+    def test_no_key(self, temp_dir, monkeypatch, capsys):
+        """Test refusing to install without a configured signing key."""
+        from omni_run import run_subcommand
+
+        installed, command = self._installed(temp_dir, monkeypatch)
+        listing = publish(temp_dir, [("v3.1.0", False, NEW_SCRIPT)])
+        assert run_subcommand(command + [str(write_config(temp_dir, listing))]) == 1
+        assert "No release signing key is configured" in capsys.readouterr().out
+        assert installed.read_text() == "old\n"
+
+    @pytest.mark.skipif(sys.platform == "win32", reason="Checks POSIX file permissions")
+    def test_install(self, temp_dir, monkeypatch, capsys):
+        """Test replacing the script with a signed release, keeping its permissions and leaving nothing behind."""
+        from omni_run import run_subcommand, ANSI_ESCAPE
+
+        installed, command = self._installed(temp_dir, monkeypatch)
+        monkeypatch.setenv("OMNI_RUN_RELEASE_KEY", RELEASE_KEY)
+        listing = publish(temp_dir, [("v3.1.0", False, NEW_SCRIPT)])
+        assert run_subcommand(command + [str(write_config(temp_dir, listing))]) == 0
+        out = ANSI_ESCAPE.sub("", capsys.readouterr().out)
+        assert f"Updated omni-run 3.0.0 -> 3.1.0 ({installed}, signature verified)" in out
+        assert installed.read_bytes() == NEW_SCRIPT
+        assert installed.stat().st_mode & 0o777 == 0o751
+        assert sorted(p.name for p in installed.parent.iterdir()) == ["omni_run.py"]
+
+    def test_unsigned(self, temp_dir, monkeypatch, capsys):
+        """Test refusing a release without a signature, even with --force."""
+        from omni_run import run_subcommand
+
+        _, command = self._installed(temp_dir, monkeypatch)
+        monkeypatch.setenv("OMNI_RUN_RELEASE_KEY", RELEASE_KEY)
+        listing = publish(temp_dir, [("v3.1.0", False, NEW_SCRIPT)])
+        entries = json.loads(listing.read_text())
+        entries[0]["assets"] = entries[0]["assets"][:1]
+        listing.write_text(json.dumps(entries))
+        assert run_subcommand(command + [str(write_config(temp_dir, listing)), "--force"]) == 1
+        assert "has no omni_run.py.sig; refusing to install an unsigned release" in capsys.readouterr().out
+
+    def test_relabelled(self, temp_dir, monkeypatch, capsys):
+        """Test refusing an older signed script published under a newer release's tag."""
+        from omni_run import run_subcommand
+
+        installed, command = self._installed(temp_dir, monkeypatch)
+        monkeypatch.setenv("OMNI_RUN_RELEASE_KEY", RELEASE_KEY)
+        listing = publish(temp_dir, [("v3.1.0", False, b"OMNI_RUN_VERSION = '2.9.0'\nprint('old')\n")])
+        assert run_subcommand(command + [str(write_config(temp_dir, listing))]) == 1
+        assert "omni_run.py is omni-run 2.9.0, not 3.1.0; refusing to install it" in capsys.readouterr().out
+        assert installed.read_text() == "old\n"
@@ -0,0 +1,129 @@
+"""
+Tests for service discovery variables and files in OmniRun.
+
+This module tests:
+- OMNI_SERVICE_<NAME>_HOST/PORT/URL variables for the other services with allocated ports
+- Named ports, https URLs for `tls:` services, and turning discovery off
+- The services.json discovery file, rewritten as ports are allocated
+"""
+
+import sys
+import json
+from pathlib import Path
+
+from conftest import *
+
+
+class TestDiscoveryEnv:
+    """Tests for the variables each service gets."""
+
+    def _orchestrator(self, temp_dir, omni_runner):
+        from omni_run import load_manifest, Orchestrator
+
+        write_manifest(temp_dir, """
+services:
+  api:
+    command: "true"
+    ports: {http: auto, admin: auto}
+  web-ui:
+    command: "true"
+    ports: auto
+    tls: true
+  worker:
+    command: "true"
+""")
+        return Orchestrator(omni_runner, load_manifest(temp_dir / "omni-run.yaml"))
+
+    def test_only_allocated_services(self, temp_dir, omni_runner):
+        """Test that services without allocated ports aren't advertised."""
+        orchestrator = self._orchestrator(temp_dir, omni_runner)
+        assert orchestrator.discovery_env(orchestrator.services["worker"].spec) == {}
+
+    def test_siblings_with_ports(self, temp_dir, omni_runner):
+        """Test the host, port and URL of each sibling, its named ports and https for tls services."""
+        orchestrator = self._orchestrator(temp_dir, omni_runner)
+        api, web = orchestrator.services["api"], orchestrator.services["web-ui"]
+        orchestrator.allocate_ports(api)
+        orchestrator.allocate_ports(web)
+        env = orchestrator.resolve_env(orchestrator.services["worker"].spec).env
+        http, admin = api.ports["http"], api.ports["admin"]
+        assert (env["OMNI_SERVICE_API_HOST"], env["OMNI_SERVICE_API_PORT"]) == ("127.0.0.1", str(http))
+        assert env["OMNI_SERVICE_API_URL"] == f"http://127.0.0.1:{http}"
+        assert (env["OMNI_SERVICE_API_PORT_HTTP"], env["OMNI_SERVICE_API_PORT_ADMIN"]) == (str(http), str(admin))
+        assert env["OMNI_SERVICE_WEB_UI_URL"] == f"https://127.0.0.1:{web.ports['http']}"
+        assert "OMNI_SERVICES_FILE" not in env
+
+    def test_not_its_own(self, temp_dir, omni_runner):
+        """Test that a service isn't given variables for itself."""
+        orchestrator = self._orchestrator(temp_dir, omni_runner)
+        api = orchestrator.services["api"]
+        orchestrator.allocate_ports(api)
+        orchestrator.allocate_ports(orchestrator.services["web-ui"])
+        own = orchestrator.discovery_env(api.spec)
+        assert "OMNI_SERVICE_API_PORT" not in own and "OMNI_SERVICE_WEB_UI_PORT" in own
+
+    def test_disabled(self, temp_dir, omni_runner):
+        """Test that `discovery: false` sets no variables."""
+        from omni_run import load_manifest, Orchestrator
+
+        write_manifest(temp_dir, """
+services:
+  api: {command: "true", ports: auto}
+  worker: {command: "true"}
+discovery: false
+""")
+        orchestrator = Orchestrator(omni_runner, load_manifest(temp_dir / "omni-run.yaml"))
+        orchestrator.allocate_ports(orchestrator.services["api"])
+        assert orchestrator.discovery_env(orchestrator.services["worker"].spec) == {}
+
+    def test_manifest_env_wins(self, temp_dir, omni_runner):
+        """Test that a manifest env overrides a discovered variable and leaves the others."""
+        from omni_run import load_manifest, Orchestrator
+
+        write_manifest(temp_dir, """
+services:
+  api: {command: "true", ports: auto}
+  worker: {command: "true", env: {OMNI_SERVICE_API_HOST: api.internal}}
+""")
+        orchestrator = Orchestrator(omni_runner, load_manifest(temp_dir / "omni-run.yaml"))
+        orchestrator.allocate_ports(orchestrator.services["api"])
+        env = orchestrator.resolve_env(orchestrator.services["worker"].spec).env
+        assert env["OMNI_SERVICE_API_HOST"] == "api.internal" and "OMNI_SERVICE_API_PORT" in env
+
+class TestDiscoveryFile:
+    """Tests for services.json."""
+
+    def test_written_on_allocation(self, temp_dir, omni_runner, capsys):
+        """Test the file and its variable, and a dependent service reading both while `up` runs."""
+        from omni_run import load_manifest, Orchestrator
+
+        write_manifest(temp_dir, f"""
+services:
+  api:
+    command: ["{sys.executable}", "-c", "import time; time.sleep(1)"]
+    ports: auto
+  worker:
+    command: ["{sys.executable}", "-c", "import json, os; print('found', os.environ['OMNI_SERVICE_API_URL'], json.load(open(os.environ['OMNI_SERVICES_FILE']))['services']['api']['port'])"]
+    depends_on: api
+discovery:
+  file: true
+""")
+        orchestrator = Orchestrator(omni_runner, load_manifest(temp_dir / "omni-run.yaml"))
+        orchestrator.up()
+        port = orchestrator.services["api"].ports["http"]
+        assert f"found http://127.0.0.1:{port} {port}" in capsys.readouterr().out
+
+        document = json.loads((temp_dir / ".omni-run" / "services.json").read_text())
+        assert document == {"services": {"api": {"host": "127.0.0.1", "port": port,
+                                                 "url": f"http://127.0.0.1:{port}", "ports": {"http": port}}}}
+
+    def test_custom_path(self, temp_dir, omni_runner):
+        """Test a discovery file at a path of its own."""
+        from omni_run import load_manifest, Orchestrator
+
+        write_manifest(temp_dir, "services:\n  api: {command: 'true', ports: 8080}\ndiscovery:\n  file: config/services.json\n")
+        orchestrator = Orchestrator(omni_runner, load_manifest(temp_dir / "omni-run.yaml"))
+        orchestrator.allocate_ports(orchestrator.services["api"])
+        path = temp_dir / "config" / "services.json"
+        assert "api" in json.loads(path.read_text())["services"]
+        assert orchestrator.discovery_env(orchestrator.services["api"].spec) == {"OMNI_SERVICES_FILE": str(path)}
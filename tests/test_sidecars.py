@@ -0,0 +1,177 @@
+"""
+Tests for database sidecars in OmniRun.
+
+This module tests:
+- Parsing `sidecars:` (image shorthand, kind inference, modes and options)
+- The docker and embedded commands, readiness probes and teardown hooks
+- Dependencies and connection URLs injected into the other services
+- Starting a sidecar before its services and stopping it once they exit
+"""
+
+import os
+import sys
+import pytest
+from pathlib import Path
+
+from conftest import *
+
+
+class TestSidecarConfig:
+    """Tests for the `sidecars:` block."""
+
+    def test_image_shorthand_and_kind_inference(self, temp_dir):
+        """Test that an image string picks the kind and its default credentials and URL variable."""
+        from omni_run import load_manifest
+
+        manifest = load_manifest(write_manifest(temp_dir, """
+sidecars:
+  db: postgres:16
+  cache: {image: "docker.io/library/redis:7-alpine"}
+  geo: {image: "postgis/postgis:16-3.4", url_env: GEO_DATABASE_URL, database: maps}
+services:
+  api:
+    command: "true"
+"""))
+        db, cache, geo = (manifest.services[n] for n in ("db", "cache", "geo"))
+        assert (db.sidecar, cache.sidecar, geo.sidecar) == ("postgres", "redis", "postgres")
+        assert db.tags == ["sidecar"] and db.backend == "host"
+        assert list(db.ports) == ["postgres"]
+
+        api = manifest.services["api"]
+        assert api.env["DATABASE_URL"] == "postgresql://postgres:postgres@${service.db.host}:${service.db.port}/app"
+        assert api.env["REDIS_URL"] == "redis://${service.cache.host}:${service.cache.port}/0"
+        assert api.env["GEO_DATABASE_URL"].endswith("${service.geo.port}/maps")
+        assert {n: c.condition for n, c in api.conditions.items()} == {
+            "db": "service_healthy", "cache": "service_healthy", "geo": "service_healthy"}
+
+    def test_service_settings_win(self, temp_dir):
+        """Test that a service's own env value and depends_on condition for a sidecar are kept."""
+        from omni_run import load_manifest
+
+        manifest = load_manifest(write_manifest(temp_dir, """
+sidecars:
+  db: {image: "mysql:8", password: s3cret, url_env: MYSQL_URL}
+services:
+  api:
+    command: "true"
+    env: {MYSQL_URL: "mysql://other"}
+    depends_on: {db: service_started}
+  worker:
+    command: "true"
+"""))
+        assert manifest.services["api"].env["MYSQL_URL"] == "mysql://other"
+        assert manifest.services["api"].conditions["db"].condition == "service_started"
+        assert manifest.services["worker"].env["MYSQL_URL"].startswith("mysql://root:s3cret@")
+
+    def test_invalid_sidecars(self, temp_dir):
+        """Test errors for unknown kinds, modes, keys, name clashes and shared URL variables."""
+        from omni_run import load_manifest, ManifestError
+
+        for block, message in [
+            ("sidecars: {db: 'cockroachdb/cockroach:v23'}", r"unknown kind 'cockroach' \(supported: postgres"),
+            ("sidecars: {db: {port: 5432}}", "needs an image or kind"),
+            ("sidecars: {db: {image: postgres, mode: vm}}", "mode: must be one of docker, embedded, auto"),
+            ("sidecars: {db: {kind: mysql, mode: embedded}}", "mysql has no embedded option"),
+            ("sidecars: {db: {image: postgres, volumes: [data]}}", r"unknown key\(s\) volumes"),
+            ("sidecars: {api: redis}", "sidecars.api: a service has the same name"),
+            ("sidecars: {a: postgres, b: postgres}", "DATABASE_URL is already set by 'a'"),
+        ]:
+            write_manifest(temp_dir, block + "\nservices:\n  api: {command: 'true'}\n")
+            with pytest.raises(ManifestError, match=message):
+                load_manifest(temp_dir / "omni-run.yaml")
+
+
+class TestSidecarServices:
+    """Tests for the services generated for sidecars."""
+
+    def test_docker_sidecar(self, temp_dir):
+        """Test the docker run command, exec readiness check and container cleanup."""
+        from omni_run import SidecarSpec, stack_id
+
+        sidecar = SidecarSpec.from_config("db", {"image": "postgres:16", "env": {"PGDATA": "/tmp/pg"}})
+        spec = sidecar.service(temp_dir)
+        container = f"omni-run-{stack_id(temp_dir)}-db"
+
+        assert spec.command == ["docker", "run", "--rm", "--name", container, "-p", "127.0.0.1:${PORT}:5432",
+                                "-e", "POSTGRES_USER", "-e", "POSTGRES_PASSWORD", "-e", "POSTGRES_DB",
+                                "-e", "PGDATA", "postgres:16"]
+        assert spec.env == {"POSTGRES_USER": "postgres", "POSTGRES_PASSWORD": "postgres", "POSTGRES_DB": "app",
+                            "PGDATA": "/tmp/pg"}
+        assert spec.health.type == "exec"
+        assert spec.health.command == ["docker", "exec", container, "pg_isready", "-h", "127.0.0.1",
+                                       "-U", "postgres", "-d", "app"]
+        assert [h.command for h in spec.hooks["post_stop"]] == [["docker", "rm", "-f", container]]
+        assert SidecarSpec.from_config("cache", {"kind": "redis"}).image == "redis:latest"
+
+    def test_embedded_sidecars(self, temp_dir):
+        """Test that embedded sidecars run the local server binary on a fresh data directory."""
+        from omni_run import SidecarSpec
+
+        redis = SidecarSpec.from_config("cache", {"kind": "redis", "mode": "embedded", "port": 6390}).service(temp_dir)
+        assert redis.command[:5] == ["redis-server", "--bind", "127.0.0.1", "--port", "${PORT}"]
+        assert redis.ports["redis"].port == 6390
+        assert (redis.health.type, redis.health.port_ref) == ("tcp", "redis")
+        assert not redis.hooks
+
+        pg = SidecarSpec.from_config("db", {"image": "postgres:16", "mode": "embedded"}).service(temp_dir)
+        data = str(temp_dir / ".omni-run" / "sidecars" / "db")
+        assert pg.command[:3] == ["postgres", "-D", data]
+        assert pg.hooks["pre_start"][0].command[-3:] == [data, "postgres", "app"]
+        assert pg.hooks["post_stop"][0].command[-1] == data
+
+    def test_auto_mode(self, temp_dir, monkeypatch):
+        """Test that auto mode prefers docker and falls back to an installed server binary."""
+        import shutil
+        from omni_run import SidecarSpec
+
+        installed = {"redis-server"}
+        monkeypatch.setattr(shutil, "which", lambda name: f"/usr/bin/{name}" if name in installed else None)
+        assert SidecarSpec.from_config("cache", {"kind": "redis", "mode": "auto"}).mode == "embedded"
+        installed.add("docker")
+        assert SidecarSpec.from_config("cache", {"kind": "redis", "mode": "auto"}).mode == "docker"
+
+
+FAKE_REDIS = """\
+import socket, sys
+port = int(sys.argv[sys.argv.index("--port") + 1])
+server = socket.socket()
+server.setsockopt(socket.SOL_SOCKET, socket.SO_REUSEADDR, 1)
+server.bind(("127.0.0.1", port))
+server.listen()
+print("ready to accept connections", flush=True)
+while True:
+    server.accept()[0].close()
+"""
+
+
+@pytest.mark.skipif(sys.platform == "win32", reason="Uses a POSIX shebang script as the server binary")
+class TestSidecarLifecycle:
+    """Tests for running services against a sidecar."""
+
+    def test_up_starts_sidecar_first_and_tears_it_down(self, temp_dir, omni_runner, monkeypatch, capsys):
+        """Test that the service starts once the sidecar is ready, sees its URL, and `up` ends with it."""
+        from omni_run import load_manifest, Orchestrator, ServiceState
+
+        bin_dir = temp_dir / "bin"
+        bin_dir.mkdir()
+        server = bin_dir / "redis-server"
+        server.write_text(f"#!{sys.executable}\n" + FAKE_REDIS)
+        server.chmod(0o755)
+        monkeypatch.setenv("PATH", f"{bin_dir}{os.pathsep}{os.environ['PATH']}")
+
+        orchestrator = Orchestrator(omni_runner, load_manifest(write_manifest(temp_dir, f"""
+sidecars:
+  cache: {{kind: redis, mode: embedded}}
+services:
+  job:
+    command: ["{sys.executable}", "-c", "import os; print('url', os.environ['REDIS_URL'])"]
+""")))
+        assert orchestrator.up() == 0
+        out = capsys.readouterr().out
+
+        port = orchestrator.services["cache"].ports["redis"]
+        assert f"url redis://127.0.0.1:{port}/0" in out
+        assert out.index("ready to accept connections") < out.index("url redis://")
+        assert orchestrator.services["job"].state == ServiceState.EXITED
+        assert not orchestrator.services["cache"].is_alive()
+        assert orchestrator.snapshot()["services"]["cache"]["sidecar"] == "redis"
@@ -0,0 +1,238 @@
+"""
+Tests for `omni-run test --smoke` in OmniRun.
+
+This module tests:
+- Parsing `smoke:` checks (list and mapping forms), their defaults and errors
+- HTTP checks: methods, headers, expected statuses and body patterns
+- Command checks with templates, their output and timeouts
+- Waiting for the stack, tearing it down and the aggregate exit code, as text and JSON
+"""
+
+import sys
+import json
+import pytest
+from pathlib import Path
+
+from conftest import *
+
+
+SERVER = """\
+import os
+from http.server import BaseHTTPRequestHandler, HTTPServer
+
+class Handler(BaseHTTPRequestHandler):
+    def do_GET(self):
+        status, body = (200, '{"status": "ok"}') if self.path == "/health" else (404, "no route " + self.path)
+        self.reply(status, body)
+
+    def do_POST(self):
+        length = int(self.headers.get("Content-Length") or 0)
+        self.reply(201, self.headers.get("X-Token", "") + " " + self.rfile.read(length).decode())
+
+    def reply(self, status, body):
+        self.send_response(status)
+        self.send_header("Content-Length", str(len(body)))
+        self.end_headers()
+        self.wfile.write(body.encode())
+
+    def log_message(self, *args):
+        pass
+
+HTTPServer(("127.0.0.1", int(os.environ["PORT"])), Handler).serve_forever()
+"""
+
+
+def run_test(temp_dir, *args):
+    from omni_run import run_subcommand
+    return run_subcommand(["test", "-C", str(temp_dir), "--skip-install", "-q", *args])
+
+
+class TestSmokeSpec:
+    """Tests for parsing the `smoke:` block."""
+
+    def _smoke(self, temp_dir):
+        from omni_run import load_manifest
+
+        return load_manifest(write_manifest(temp_dir, """
+services:
+  api: {command: "true"}
+smoke:
+  timeout: 30s
+  checks:
+    - http: http://localhost:${service.api.port}/health
+      body: '"status":\\s*"ok"'
+    - name: create
+      http: http://localhost:${service.api.port}/items
+      method: post
+      headers: {X-Token: abc}
+      data: '{"name": "x"}'
+      status: [201, 202]
+      timeout: 2s
+    - command: ./check.sh
+      path: scripts
+""")).smoke
+
+    def test_http_check(self, temp_dir):
+        """Test an HTTP check's default name and statuses, and its body pattern."""
+        smoke = self._smoke(temp_dir)
+        first = smoke.checks[0]
+        assert smoke.timeout == 30.0
+        assert first.name == "GET http://localhost:${service.api.port}/health" and first.status == []
+        assert first.body.search('{"status": "ok"}') and first.accepts(302) and not first.accepts(404)
+
+    def test_http_options(self, temp_dir):
+        """Test the method, headers, statuses and timeout of an HTTP check."""
+        create = self._smoke(temp_dir).checks[1]
+        assert (create.method, create.headers, create.status, create.timeout) == ("POST", {"X-Token": "abc"}, [201, 202], 2.0)
+        assert not create.accepts(200)
+
+    def test_command_check(self, temp_dir):
+        """Test a command check's name, directory and default timeout."""
+        script = self._smoke(temp_dir).checks[2]
+        assert (script.name, script.path, script.timeout) == ("./check.sh", (temp_dir / "scripts").resolve(), 10.0)
+
+    def test_list_form(self, temp_dir):
+        """Test checks given as a list, with the default overall timeout."""
+        from omni_run import load_manifest
+
+        smoke = load_manifest(write_manifest(temp_dir, "services:\n  api: {command: 'true'}\n"
+                                                       "smoke:\n  - command: [make, check]\n")).smoke
+        assert (smoke.checks[0].name, smoke.timeout) == ("make check", 120.0)
+
+    def test_invalid(self, temp_dir):
+        """Test checks with neither or both kinds, bad statuses, patterns and methods."""
+        from omni_run import load_manifest, ManifestError
+
+        for checks, message in [("[{name: x}]", r"smoke.checks\[0\]: needs either http \(a URL\) or command"),
+                                ("[{http: /, command: 'true'}]", "needs either http"),
+                                ("[{http: /, status: 99}]", r"smoke.checks\[0\].status: 99 is not an HTTP status"),
+                                ("[{http: /, body: '('}]", "body: invalid regex"),
+                                ("[{http: /, method: FETCH}]", "method: expected one of GET"),
+                                ("[{command: 'true', status: 200}]", "only apply to http checks"),
+                                ("[{command: 'true', timeout: soon}]", "timeout: Invalid duration")]:
+            write_manifest(temp_dir, f"services:\n  api: {{command: 'true'}}\nsmoke: {checks}\n")
+            with pytest.raises(ManifestError, match=message):
+                load_manifest(temp_dir / "omni-run.yaml")
+
+
+@pytest.mark.skipif(sys.platform == "win32", reason="Uses POSIX process groups")
+class TestSmokeRun:
+    """Tests for running the checks against the stack."""
+
+    def manifest(self, temp_dir):
+        (temp_dir / "server.py").write_text(SERVER)
+        return write_manifest(temp_dir, f"""
+services:
+  api:
+    command: ["{sys.executable}", "server.py"]
+    ports: auto
+    health: {{type: http, url: "http://127.0.0.1:${{service.api.port}}/health", interval: 100ms}}
+smoke:
+  - name: health
+    http: http://127.0.0.1:${{service.api.port}}/health
+    body: '"status": "ok"'
+  - name: create
+    http: http://127.0.0.1:${{service.api.port}}/items
+    method: POST
+    headers: {{X-Token: abc}}
+    data: hello
+    status: 201
+    body: ^abc hello$
+  - name: missing page
+    http: http://127.0.0.1:${{service.api.port}}/missing
+  - name: port check
+    command: ["{sys.executable}", "-c", "import sys; print('port', sys.argv[1]); sys.exit(sys.argv[1] == '')", "${{service.api.port}}"]
+  - name: broken script
+    command: echo migration 42 pending; exit 3
+  - name: slow
+    command: sleep 5
+    timeout: 300ms
+""")
+
+    def test_run(self, temp_dir, capsys):
+        """Test each check's outcome, the output of failed ones and the aggregate code."""
+        from omni_run import ANSI_ESCAPE
+
+        self.manifest(temp_dir)
+        assert run_test(temp_dir, "--smoke") == 1
+        out = ANSI_ESCAPE.sub("", capsys.readouterr().out)
+        assert "running 6 smoke check(s)" in out
+        assert "passed  health: HTTP 200" in out
+        assert "passed  create: HTTP 201" in out
+        assert "failed  missing page: expected HTTP 2xx or 3xx, got 404" in out and "no route /missing" in out
+        assert "passed  port check: exited with code 0" in out
+        assert "failed  broken script: exited with code 3" in out and "migration 42 pending" in out
+        assert "failed  slow: timed out after 0.3s" in out
+        assert "3 passed, 3 failed in" in out
+
+        assert run_test(temp_dir, "--smoke", "--check", "health", "--check", "port check") == 0
+        assert "2 passed, 0 failed" in ANSI_ESCAPE.sub("", capsys.readouterr().out)
+
+    def test_json(self, temp_dir, capsys):
+        """Test the `test` JSON document."""
+        self.manifest(temp_dir)
+        assert run_test(temp_dir, "--smoke", "--check", "health", "--check", "broken script", "--output", "json") == 1
+        document = json.loads(capsys.readouterr().out)
+        assert (document["kind"], document["ready"], document["passed"], document["failed"]) == ("test", True, 1, 1)
+        assert [(c["name"], c["type"], c["status"]) for c in document["checks"]] == [
+            ("health", "http", "passed"), ("broken script", "command", "failed")]
+        assert document["checks"][1]["output"] == ["migration 42 pending"]
+
+    def test_service_fails_to_start(self, temp_dir, capsys):
+        """Test that no check runs when a service fails to start, and its output is shown."""
+        from omni_run import ANSI_ESCAPE
+
+        write_manifest(temp_dir, f"""
+services:
+  api:
+    command: ["{sys.executable}", "-c", "print('cannot bind'); raise SystemExit(3)"]
+    health: {{type: tcp, port: 1, interval: 100ms}}
+    restart: never
+smoke:
+  - http: http://127.0.0.1:1/
+""")
+        assert run_test(temp_dir, "--smoke") == 1
+        out = ANSI_ESCAPE.sub("", capsys.readouterr().out)
+        assert "The stack did not become ready: api failed: exited with code 3\n  cannot bind" in out
+        assert "smoke check(s)" not in out
+
+    def test_service_crashes_during_checks(self, temp_dir, capsys):
+        """Test that a service exiting while the checks run fails the run after them."""
+        from omni_run import ANSI_ESCAPE
+
+        write_manifest(temp_dir, f"""
+services:
+  api:
+    command: ["{sys.executable}", "-c", "import time; time.sleep(0.5); print('lost connection'); raise SystemExit(2)"]
+    restart: never
+smoke:
+  - command: sleep 1
+""")
+        assert run_test(temp_dir, "--smoke") == 1
+        out = ANSI_ESCAPE.sub("", capsys.readouterr().out)
+        assert "passed  sleep 1" in out
+        assert "api failed during the checks: exited with code 2\n  lost connection" in out
+
+    def test_service_never_healthy(self, temp_dir, capsys):
+        """Test that --timeout bounds the wait for a service that never gets healthy."""
+        write_manifest(temp_dir, f"""
+services:
+  api:
+    command: ["{sys.executable}", "-c", "import time; time.sleep(30)"]
+    health: {{type: tcp, port: 1, interval: 100ms}}
+smoke:
+  - http: http://127.0.0.1:1/
+""")
+        assert run_test(temp_dir, "--smoke", "--timeout", "1s") == 1
+        assert "timed out after 1s waiting for api" in capsys.readouterr().out
+
+    def test_usage_errors(self, temp_dir, capsys):
+        """Test `test` without --smoke, without checks and with an unknown --check."""
+        write_manifest(temp_dir, "services:\n  api: {command: 'true'}\n")
+        assert run_test(temp_dir) == 2
+        assert "choose what to run" in capsys.readouterr().out
+        assert run_test(temp_dir, "--smoke") == 1
+        assert "smoke: no checks declared" in capsys.readouterr().out
+        write_manifest(temp_dir, "services:\n  api: {command: 'true'}\nsmoke:\n  - {name: a, command: 'true'}\n")
+        assert run_test(temp_dir, "--smoke", "--check", "b") == 1
+        assert "--check b: no such smoke check (declared: a)" in capsys.readouterr().out
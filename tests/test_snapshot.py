@@ -0,0 +1,269 @@
+"""
+Tests for `omni-run snapshot` and `omni-run restore` in OmniRun.
+
+This module tests:
+- Dump and load commands for docker and embedded sidecars, and failed dumps
+- Writing and reading snapshot archives, and files that aren't snapshots
+- Snapshotting a running stack and restoring it: the manifest, its ports and a sidecar's data
+"""
+
+import os
+import sys
+import json
+import time
+import threading
+import pytest
+from pathlib import Path
+
+from conftest import *
+
+
+# A redis-server that understands the commands snapshots use; keys start from seed.json, and
+# restored keys are written to restored.json. Each entry is [value, ttl in ms].
+FAKE_REDIS = """\
+import json, os, socket, sys
+port = int(sys.argv[sys.argv.index("--port") + 1])
+data = json.load(open("seed.json")) if os.path.exists("seed.json") else {}
+server = socket.socket()
+server.setsockopt(socket.SOL_SOCKET, socket.SO_REUSEADDR, 1)
+server.bind(("127.0.0.1", port))
+server.listen()
+bulk = lambda value: b"$%d\\r\\n%s\\r\\n" % (len(value), value)
+print("ready to accept connections", flush=True)
+while True:
+    connection = server.accept()[0]
+    reader = connection.makefile("rb")
+    for line in iter(reader.readline, b""):
+        args = [reader.read(int(reader.readline()[1:]) + 2)[:-2].decode() for _ in range(int(line[1:]))]
+        if args[0] == "SCAN":
+            reply = b"*2\\r\\n" + bulk(b"0") + b"*%d\\r\\n" % len(data) + b"".join(bulk(k.encode()) for k in data)
+        elif args[0] == "DUMP":
+            reply = bulk(("v:" + data[args[1]][0]).encode())
+        elif args[0] == "PTTL":
+            reply = b":%d\\r\\n" % data[args[1]][1]
+        else:
+            data[args[1]] = [args[3][2:], int(args[2])]
+            json.dump(data, open("restored.json", "w"))
+            reply = b"+OK\\r\\n"
+        connection.sendall(reply)
+    connection.close()
+"""
+
+
+@pytest.fixture
+def fake_pg_docker(temp_dir, monkeypatch):
+    """A `docker` on PATH whose pg_dump prints one row (or fails once `broken` exists); yields a postgres sidecar."""
+    from omni_run import SidecarSpec
+
+    docker = temp_dir / "bin" / "docker"
+    docker.parent.mkdir()
+    docker.write_text(f"""#!{sys.executable}
+import os, sys
+if "pg_dump" in sys.argv:
+    if os.path.exists("{temp_dir}/broken"):
+        sys.exit("pg_dump: error: connection refused")
+    sys.stdout.write("INSERT INTO users VALUES (1);\\n")
+else:
+    open("{temp_dir}/loaded.sql", "w").write(sys.stdin.read() + os.environ["PGPASSWORD"])
+""")
+    docker.chmod(0o755)
+    monkeypatch.setenv("PATH", f"{docker.parent}{os.pathsep}{os.environ['PATH']}")
+    yield SidecarSpec.from_config("db", {"image": "postgres:16", "password": "hunter2"})
+
+
+@pytest.fixture
+def snapshotted(temp_dir, omni_runner, monkeypatch, capsys):
+    """A snapshot `bug` of a running api and embedded redis sidecar; yields the manifest, the output and api's port."""
+    from omni_run import load_manifest, Orchestrator, read_supervisor_state, run_subcommand, ANSI_ESCAPE
+
+    server = temp_dir / "bin" / "redis-server"
+    server.parent.mkdir()
+    server.write_text(f"#!{sys.executable}\n" + FAKE_REDIS)
+    server.chmod(0o755)
+    monkeypatch.setenv("PATH", f"{server.parent}{os.pathsep}{os.environ['PATH']}")
+    manifest = f"""
+sidecars:
+  cache: {{kind: redis, mode: embedded}}
+services:
+  api:
+    command: ["{sys.executable}", "-c", "import os, time; open('seen', 'w').write(open('restored.json').read()
+      if os.path.exists('restored.json') else 'empty'); open('port', 'w').write(os.environ['PORT']);
+      time.sleep(60 if os.path.exists('keep') else 0)"]
+    ports: auto
+"""
+    write_manifest(temp_dir, manifest)
+    (temp_dir / "seed.json").write_text(json.dumps({"user:1": ["alice", -1], "session": ["abc", 90000]}))
+    (temp_dir / "keep").write_text("")
+
+    state_dir = temp_dir / ".omni-run"
+    orchestrator = Orchestrator(omni_runner, load_manifest(temp_dir / "omni-run.yaml"), state_dir=state_dir)
+    runner = threading.Thread(target=orchestrator.up)
+    runner.start()
+    try:
+        deadline = time.time() + 20
+        while time.time() < deadline and (read_supervisor_state(state_dir).get("services", {}).get("api") or {}).get(
+                "state") != "running":
+            time.sleep(0.1)
+        assert run_subcommand(["snapshot", "bug", "-C", str(temp_dir)]) == 0
+    finally:
+        orchestrator.request_shutdown()
+        runner.join(timeout=20)
+    yield manifest, ANSI_ESCAPE.sub("", capsys.readouterr().out), (temp_dir / "port").read_text()
+
+
+class TestSidecarData:
+    """Tests for dumping and loading sidecar databases."""
+
+    def test_commands(self, temp_dir):
+        """Test docker exec with the password passed by name, and embedded commands given the port."""
+        from omni_run import SidecarSpec, sidecar_data_command
+
+        postgres = SidecarSpec.from_config("db", "postgres:16")
+        container = postgres.container_name(temp_dir)
+        assert sidecar_data_command(postgres, temp_dir, 5432) == (
+            ["docker", "exec", "-i", "-e", "PGPASSWORD", container, "pg_dump", "-h", "127.0.0.1", "-U", "postgres",
+             "-d", "app", "--clean", "--if-exists", "--no-owner"], {"PGPASSWORD": "postgres"})
+        embedded = SidecarSpec.from_config("db", {"kind": "postgres", "mode": "embedded", "database": "shop"})
+        argv, _ = sidecar_data_command(embedded, temp_dir, 41000, load=True)
+        assert argv == ["psql", "-q", "-h", "127.0.0.1", "-U", "postgres", "-d", "shop", "-v", "ON_ERROR_STOP=1",
+                        "-p", "41000"]
+        mongo = SidecarSpec.from_config("docs", {"kind": "mongo", "mode": "embedded"})
+        assert sidecar_data_command(mongo, temp_dir, 41001) == (
+            ["mongodump", "--quiet", "--archive", "--db", "app", "--port", "41001"], {})
+        mysql = SidecarSpec.from_config("db", {"image": "mysql:8", "password": "secret"})
+        argv, env = sidecar_data_command(mysql, temp_dir, 3306, load=True)
+        assert argv[4:] == ["MYSQL_PWD", mysql.container_name(temp_dir), "mysql", "-h127.0.0.1", "-uroot", "app"]
+        assert env == {"MYSQL_PWD": "secret"}
+
+    @pytest.mark.skipif(sys.platform == "win32", reason="Uses a POSIX shebang script as docker")
+    def test_dump_through_docker(self, temp_dir, fake_pg_docker):
+        """Test a dump read from the container."""
+        from omni_run import dump_sidecar
+
+        assert dump_sidecar(fake_pg_docker, temp_dir, 5432) == b"INSERT INTO users VALUES (1);\n"
+
+    @pytest.mark.skipif(sys.platform == "win32", reason="Uses a POSIX shebang script as docker")
+    def test_load_through_docker(self, temp_dir, fake_pg_docker):
+        """Test loading a dump back on stdin, with the sidecar's password."""
+        from omni_run import load_sidecar
+
+        load_sidecar(fake_pg_docker, temp_dir, 5432, b"INSERT INTO users VALUES (1);\n")
+        assert (temp_dir / "loaded.sql").read_text() == "INSERT INTO users VALUES (1);\nhunter2"
+
+    def test_nothing_to_dump(self, temp_dir):
+        """Test that a sidecar without data to keep gives no dump."""
+        from omni_run import SidecarSpec, dump_sidecar
+
+        assert dump_sidecar(SidecarSpec.from_config("traces", {"kind": "jaeger"}), temp_dir, 4318) is None
+
+    @pytest.mark.skipif(sys.platform == "win32", reason="Uses a POSIX shebang script as docker")
+    def test_failed_dump(self, temp_dir, fake_pg_docker):
+        """Test that a failing dump reports the tool's exit code and error."""
+        from omni_run import dump_sidecar, ManifestError
+
+        (temp_dir / "broken").write_text("")
+        with pytest.raises(ManifestError, match="sidecars.db: pg_dump exited with code 1: pg_dump: error: connection refused"):
+            dump_sidecar(fake_pg_docker, temp_dir, 5432)
+
+
+class TestSnapshotFiles:
+    """Tests for the snapshot archive."""
+
+    def test_write_and_read(self, temp_dir):
+        """Test that metadata and members survive."""
+        from omni_run import write_snapshot, read_snapshot
+
+        path = temp_dir / ".omni-run" / "snapshots" / "bug.tar.gz"
+        metadata = {"version": 1, "services": {"api": {"ports": {"http": 8000}}}}
+        write_snapshot(path, metadata, {"manifest/omni-run.yaml": b"services: {}\n", "data/db.sql": b"\x00\x01"})
+        assert read_snapshot(path) == (metadata, {"manifest/omni-run.yaml": b"services: {}\n", "data/db.sql": b"\x00\x01"})
+
+    def test_unsupported_version(self, temp_dir):
+        """Test a snapshot from a newer omni-run."""
+        from omni_run import write_snapshot, read_snapshot, ManifestError
+
+        path = temp_dir / "bug.tar.gz"
+        write_snapshot(path, {"version": 99}, {})
+        with pytest.raises(ManifestError, match="bug.tar.gz: snapshot version 99 is not supported"):
+            read_snapshot(path)
+
+    def test_not_a_snapshot(self, temp_dir):
+        """Test a tarball without snapshot metadata, and a file that isn't a tarball."""
+        import tarfile
+        from omni_run import read_snapshot, ManifestError
+
+        path = temp_dir / "bug.tar.gz"
+        with tarfile.open(path, "w:gz"):
+            pass
+        with pytest.raises(ManifestError, match="not an omni-run snapshot"):
+            read_snapshot(path)
+        path.write_text("not a tarball")
+        with pytest.raises(ManifestError, match="cannot read the snapshot"):
+            read_snapshot(path)
+
+
+@pytest.mark.skipif(sys.platform == "win32", reason="Uses a POSIX shebang script as the server binary")
+class TestSnapshotRestore:
+    """Tests for `omni-run snapshot` and `omni-run restore`."""
+
+    def test_snapshot(self, temp_dir, snapshotted):
+        """Test what a snapshot reports saving, taken before the service saw any restored data."""
+        _, out, _ = snapshotted
+        assert "Saved snapshot bug to .omni-run/snapshots/bug.tar.gz" in out
+        assert "  cache: redis data," in out and "Restore it with `omni-run restore bug`" in out
+        assert (temp_dir / "seen").read_text() == "empty"
+
+    def _restored(self, temp_dir, manifest, capsys):
+        from omni_run import run_subcommand, ANSI_ESCAPE
+
+        for name in ("seed.json", "keep", ".omni-run/state.db"):
+            (temp_dir / name).unlink()
+        write_manifest(temp_dir, manifest.replace("ports: auto", "ports: auto\n    env: {DEBUG: 'true'}"))
+        assert run_subcommand(["restore", "bug", "-C", str(temp_dir)]) == 0
+        return ANSI_ESCAPE.sub("", capsys.readouterr().out)
+
+    def test_restore_manifest(self, temp_dir, snapshotted, capsys):
+        """Test that the snapshot's manifest replaces the changed one, which is kept as a backup."""
+        manifest, _, _ = snapshotted
+        out = self._restored(temp_dir, manifest, capsys)
+        assert "Restored omni-run.yaml from the snapshot (the previous one is in omni-run.yaml.bak)" in out
+        assert "differs from the snapshot" not in out
+        assert (temp_dir / "omni-run.yaml").read_text() == manifest
+        assert "DEBUG" in (temp_dir / "omni-run.yaml.bak").read_text()
+
+    def test_restore_data(self, temp_dir, snapshotted, capsys):
+        """Test that the sidecar's data is loaded before the service that waits for it starts."""
+        manifest, _, _ = snapshotted
+        out = self._restored(temp_dir, manifest, capsys)
+        assert "cache | restored" in out and "of data from the snapshot" in out
+        assert json.loads((temp_dir / "seen").read_text()) == {"user:1": ["alice", 0], "session": ["abc", 90000]}
+
+    def test_restore_ports(self, temp_dir, snapshotted, capsys):
+        """Test that services get the ports they had when the snapshot was taken."""
+        manifest, _, port = snapshotted
+        self._restored(temp_dir, manifest, capsys)
+        assert (temp_dir / "port").read_text() == port
+
+    def test_audited(self, temp_dir, snapshotted, capsys):
+        """Test that taking and restoring the snapshot are in the audit log."""
+        manifest, _, _ = snapshotted
+        self._restored(temp_dir, manifest, capsys)
+        audit = [json.loads(line) for line in (temp_dir / ".omni-run" / "audit.jsonl").read_text().splitlines()]
+        assert [(e["action"], e["params"].get("snapshot")) for e in audit if e["action"] in ("snapshot", "restore")] == [
+            ("snapshot", "bug.tar.gz"), ("restore", "bug.tar.gz")]
+
+    def test_refusals(self, temp_dir, capsys):
+        """Test a snapshot with nothing running, an unknown snapshot and restoring over a running stack."""
+        from omni_run import run_subcommand, write_snapshot, SUPERVISOR_PIDFILE
+
+        write_manifest(temp_dir, "services:\n  api: {command: 'true'}\n")
+        assert run_subcommand(["snapshot", "-C", str(temp_dir)]) == 1
+        assert "No services running" in capsys.readouterr().out
+        assert run_subcommand(["restore", "nope", "-C", str(temp_dir)]) == 1
+        assert "No snapshot 'nope'" in capsys.readouterr().out
+
+        write_snapshot(temp_dir / "bug.tar.gz", {"version": 1, "manifest": "omni-run.yaml", "services": {}}, {})
+        (temp_dir / ".omni-run").mkdir()
+        (temp_dir / ".omni-run" / SUPERVISOR_PIDFILE).write_text(str(os.getpid()))
+        assert run_subcommand(["restore", str(temp_dir / "bug.tar.gz"), "-C", str(temp_dir)]) == 1
+        assert f"already running under supervisor pid {os.getpid()}" in capsys.readouterr().out
@@ -0,0 +1,147 @@
+"""
+Tests for socket-passing restarts in OmniRun.
+
+This module tests:
+- `socket: true` ports and the systemd socket-activation environment (LISTEN_FDS, LISTEN_PID)
+- Replacing a service on its passed socket without refusing connections
+- Keeping the old process when its replacement fails
+"""
+
+import sys
+import socket
+import threading
+import time
+import pytest
+from pathlib import Path
+
+from conftest import *
+
+
+# Drains on SIGTERM like a well-behaved server: the connection being answered is finished first
+SERVER = """
+import os, select, signal, socket, sys
+if os.path.exists("broken"):
+    sys.exit(3)
+sock = socket.socket(fileno=3)
+stopping = []
+signal.signal(signal.SIGTERM, lambda *_: stopping.append(True))
+print("serving", os.getpid(), os.environ["LISTEN_PID"] == str(os.getpid()), os.environ["LISTEN_FDNAMES"], flush=True)
+while not stopping:
+    if not select.select([sock], [], [], 0.1)[0]:
+        continue
+    conn, _ = sock.accept()
+    conn.recv(1024)
+    conn.sendall(str(os.getpid()).encode())
+    conn.close()
+"""
+
+
+def fetch(port: int) -> str:
+    with socket.create_connection(("127.0.0.1", port), timeout=5) as conn:
+        conn.sendall(b"GET / HTTP/1.0\r\n\r\n")
+        return conn.recv(1024).decode()
+
+
+class TestSocketActivation:
+    """Tests for handing listening sockets to a child process."""
+
+    def test_socket_port_option(self, temp_dir):
+        """Test that ports opt into socket passing."""
+        from omni_run import PortSpec
+
+        assert PortSpec.from_config("api", "http", {"port": 8080, "socket": True}).socket is True
+        assert PortSpec.from_config("api", "http", 8080).socket is False
+
+    @pytest.mark.skipif(sys.platform == "win32", reason="Socket passing is POSIX only")
+    def test_child_gets_descriptor_three(self, temp_dir):
+        """Test that the listener arrives as fd 3 with LISTEN_FDS, LISTEN_FDNAMES and LISTEN_PID."""
+        import os
+        import subprocess
+        from omni_run import bind_listener, socket_activation
+
+        listener = bind_listener(0)
+        port = listener.getsockname()[1]
+        try:
+            argv, env, fds = socket_activation(
+                [sys.executable, "-c", "import os, socket; s = socket.socket(fileno=3); "
+                 "print(s.getsockname()[1], os.environ['LISTEN_FDS'], os.environ['LISTEN_FDNAMES'], "
+                 "os.environ['LISTEN_PID'] == str(os.getpid()), 'OMNI_RUN_LISTEN_FDS' in os.environ)"],
+                dict(os.environ), {"http": listener})
+            out = subprocess.run(argv, env=env, pass_fds=fds, capture_output=True, text=True, timeout=30).stdout
+        finally:
+            listener.close()
+        assert out.split() == [str(port), "1", "http", "True", "False"]
+
+
+@pytest.mark.skipif(sys.platform == "win32", reason="Socket passing is POSIX only")
+class TestSocketReplacement:
+    """Tests for restarting a service on the socket omni-run holds."""
+
+    def _up(self, temp_dir, omni_runner):
+        from omni_run import Orchestrator, load_manifest
+
+        (temp_dir / "server.py").write_text(SERVER)
+        (temp_dir / "omni-run.yaml").write_text(f"""
+services:
+  web:
+    command: ["{sys.executable}", server.py]
+    ports: {{http: {{port: auto, socket: true}}}}
+""")
+        orchestrator = Orchestrator(omni_runner, load_manifest(temp_dir / "omni-run.yaml"))
+        thread = threading.Thread(target=orchestrator.up, kwargs={"persistent": True})
+        thread.start()
+        web = orchestrator.services["web"]
+        deadline = time.time() + 10
+        while not (web.ports and web.is_alive()) and time.time() < deadline:
+            time.sleep(0.05)
+        return orchestrator, thread, web
+
+    def test_restart_keeps_accepting(self, temp_dir, omni_runner, capsys):
+        """Test that a restart starts the new process first and no connection is refused."""
+        orchestrator, thread, web = self._up(temp_dir, omni_runner)
+        port = web.ports["http"]
+        served, errors = set(), []
+
+        def hammer():
+            end = time.time() + 3
+            while time.time() < end:
+                try:
+                    served.add(fetch(port))
+                except OSError as e:
+                    errors.append(e)
+
+        try:
+            old_pid = int(fetch(port))
+            client = threading.Thread(target=hammer)
+            client.start()
+            time.sleep(0.5)
+            orchestrator.request("restart", "web")
+            client.join()
+        finally:
+            orchestrator.request_shutdown()
+            thread.join(timeout=30)
+
+        out = capsys.readouterr().out
+        assert errors == []
+        assert str(old_pid) in served and len(served) == 2
+        assert f"reloaded: pid {web.process.pid} replaced {old_pid}" in out
+        assert "serving" in out and "True http" in out
+        assert web.restarts == 1
+
+    def test_failed_replacement_keeps_old_process(self, temp_dir, omni_runner, capsys):
+        """Test that the old process keeps serving when the new one exits."""
+        orchestrator, thread, web = self._up(temp_dir, omni_runner)
+        port = web.ports["http"]
+        try:
+            old_pid = int(fetch(port))
+            (temp_dir / "broken").write_text("")
+            orchestrator.request("restart", "web")
+            deadline = time.time() + 10
+            while "reload failed" not in capsys.readouterr().out and time.time() < deadline:
+                time.sleep(0.1)
+            assert int(fetch(port)) == old_pid
+            assert web.process.pid == old_pid and web.is_alive()
+        finally:
+            orchestrator.request_shutdown()
+            thread.join(timeout=30)
+        assert not orchestrator.listeners
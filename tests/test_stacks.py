@@ -0,0 +1,162 @@
+"""
+Tests for running several stacks at once in OmniRun.
+
+This module tests:
+- Stack ids for projects of the same name, and the containers named after them
+- Port pools per stack, moving past pools other stacks hold, and dropping dead stacks from the registry
+- `omni-run status --all-stacks` listing two running stacks with stack-qualified service names
+"""
+
+import os
+import sys
+import json
+import time
+import threading
+import pytest
+from pathlib import Path
+
+from conftest import *
+
+
+class TestStackIds:
+    """Tests for naming stacks."""
+
+    def test_same_name_elsewhere(self, temp_dir):
+        """Test that checkouts with the same directory name get their own ids and container names."""
+        from omni_run import stack_id, SidecarSpec
+
+        first, second = temp_dir / "shop", temp_dir / "review" / "shop"
+        assert stack_id(first).startswith("shop-") and len(stack_id(first)) == len("shop-") + 8
+        assert stack_id(first) != stack_id(second)
+        assert stack_id(first) == stack_id(temp_dir / "review" / ".." / "shop")
+        assert stack_id(temp_dir / "my app!").startswith("my-app-")
+
+        sidecar = SidecarSpec.from_config("db", "postgres:16")
+        assert sidecar.container_name(first) != sidecar.container_name(second)
+        assert sidecar.container_name(second) == f"omni-run-{stack_id(second)}-db"
+
+
+class TestStackRegistry:
+    """Tests for the registry of running stacks and their port pools."""
+
+    def _registry(self, temp_dir):
+        from omni_run import StackRegistry
+
+        return StackRegistry.from_config({"stacks": {"registry": str(temp_dir / "stacks"),
+                                                     "port_pool": {"start": 41000, "end": 41299}}})
+
+    def _held(self, registry, temp_dir, pool):
+        from omni_run import stack_id
+
+        registry.directory.mkdir()
+        holder = {"id": stack_id(temp_dir / "other"), "pid": os.getpid(), "ports": list(pool)}
+        (registry.directory / f"{stack_id(temp_dir / 'other')}.json").write_text(json.dumps(holder))
+        dead = {"id": "gone-00000000", "pid": 2 ** 22 + 17, "ports": [41000, 41099]}
+        (registry.directory / "gone-00000000.json").write_text(json.dumps(dead))
+
+    def test_pool(self, temp_dir):
+        """Test that a stack's pool is one block of the range, the same each time."""
+        registry = self._registry(temp_dir)
+        low, high = registry.pool(temp_dir / "shop")
+        assert high - low == 99 and (low - 41000) % 100 == 0 and 41000 <= low <= 41200
+        assert registry.pool(temp_dir / "shop") == (low, high)
+
+    def test_next_pool_when_taken(self, temp_dir):
+        """Test that a stack moves to the next pool when a running stack holds its own."""
+        registry = self._registry(temp_dir)
+        low, high = registry.pool(temp_dir / "shop")
+        self._held(registry, temp_dir, (low, high))
+        moved = registry.pool(temp_dir / "shop")
+        assert moved != (low, high) and moved[0] == 41000 + (low - 41000 + 100) % 300
+
+    def test_dead_stacks(self, temp_dir):
+        """Test that stacks whose supervisor is gone are dropped from the registry."""
+        from omni_run import stack_id
+
+        registry = self._registry(temp_dir)
+        self._held(registry, temp_dir, registry.pool(temp_dir / "shop"))
+        assert [e["id"] for e in registry.stacks()] == [stack_id(temp_dir / "other")]
+        assert not (registry.directory / "gone-00000000.json").exists()
+
+    def test_allocate_from_pool(self, temp_dir):
+        """Test that automatic ports come from the stack's pool, and that pools can be turned off."""
+        from omni_run import StackRegistry, PortAllocator, PortSpec
+
+        pool = self._registry(temp_dir).pool(temp_dir / "shop")
+        allocator = PortAllocator(pool=pool)
+        ports = [allocator.allocate("api", PortSpec("http", "auto")) for _ in range(3)]
+        assert ports == sorted(set(ports)) and all(pool[0] <= p <= pool[1] for p in ports)
+        assert StackRegistry.from_config({"stacks": {"port_pool": None}}).pool(temp_dir / "shop") is None
+
+
+@pytest.fixture
+def two_stacks(temp_dir, capsys):
+    """Two checkouts named shop, run and stopped; yields their roots, the config, and `status --all-stacks` output."""
+    from omni_run import OmniRun, load_manifest, Orchestrator, run_subcommand, read_supervisor_state, ANSI_ESCAPE
+
+    config = temp_dir / "config.json"
+    config.write_text(json.dumps({"stacks": {"registry": str(temp_dir / "stacks")}}))
+    roots = [temp_dir / "shop", temp_dir / "review" / "shop"]
+    orchestrators, runners = [], []
+    for root in roots:
+        write_manifest(root, f"services:\n  api:\n    command: ['{sys.executable}', -c, 'import time; time.sleep(60)']"
+                             f"\n    ports: auto\n")
+        launcher = OmniRun(str(root), config_file=str(config))
+        orchestrator = Orchestrator(launcher, load_manifest(root / "omni-run.yaml"), state_dir=root / ".omni-run")
+        orchestrators.append(orchestrator)
+        runners.append(threading.Thread(target=orchestrator.up))
+    for runner in runners:
+        runner.start()
+    try:
+        deadline = time.time() + 20
+        while time.time() < deadline and not all(
+                (read_supervisor_state(root / ".omni-run").get("services", {}).get("api") or {}).get("state")
+                == "running" for root in roots):
+            time.sleep(0.1)
+        capsys.readouterr()
+        assert run_subcommand(["status", "--all-stacks", "--config", str(config)]) == 0
+        out = ANSI_ESCAPE.sub("", capsys.readouterr().out)
+        assert run_subcommand(["status", "--all-stacks", "--config", str(config), "--output", "json"]) == 0
+        document = json.loads(capsys.readouterr().out)
+    finally:
+        for orchestrator in orchestrators:
+            orchestrator.request_shutdown()
+        for runner in runners:
+            runner.join(timeout=20)
+    yield roots, config, out, document
+
+
+@pytest.mark.skipif(sys.platform == "win32", reason="Uses POSIX sleep processes as services")
+class TestAllStacks:
+    """Tests for `omni-run status --all-stacks`."""
+
+    def test_qualified_names(self, two_stacks):
+        """Test that each stack is listed with its root and stack-qualified service names."""
+        from omni_run import stack_id
+
+        roots, _, out, _ = two_stacks
+        for root in roots:
+            assert f"{stack_id(root)}/api" in out and str(root.resolve()) in out
+
+    def test_json_pools(self, two_stacks):
+        """Test that the stacks have pools of their own, each with its service's port in it."""
+        from omni_run import stack_id
+
+        roots, _, _, document = two_stacks
+        ids = [stack_id(root) for root in roots]
+        stacks = {s["id"]: s for s in document["stacks"]}
+        assert document["kind"] == "stacks" and sorted(stacks) == sorted(ids)
+        pools = [stacks[i]["ports"] for i in ids]
+        assert pools[0] != pools[1]
+        for stack, pool in zip(ids, pools):
+            port = stacks[stack]["services"]["api"]["ports"]["http"]
+            assert pool[0] <= port <= pool[1]
+
+    def test_unregistered_on_exit(self, temp_dir, two_stacks, capsys):
+        """Test that stopped stacks leave the registry and are no longer listed."""
+        from omni_run import run_subcommand
+
+        _, config, _, _ = two_stacks
+        assert list((temp_dir / "stacks").iterdir()) == []
+        assert run_subcommand(["status", "--all-stacks", "--config", str(config)]) == 3
+        assert "No stacks running on this machine" in capsys.readouterr().out
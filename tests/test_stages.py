@@ -0,0 +1,143 @@
+"""
+Tests for staged boot in OmniRun.
+
+This module tests:
+- Boot waves from `stages:`, `stage:` and `priority:`, and manifests that can't boot in them
+- `up` starting each wave once the one before is up, with stage delays and `parallel` limits
+- `omni-run explain` listing the waves
+"""
+
+import sys
+import time
+import pytest
+from pathlib import Path
+
+from conftest import *
+
+
+class TestBootWaves:
+    """Tests for where services boot."""
+
+    def test_waves(self, temp_dir):
+        """Test stages, priorities within a stage, unstaged services and sidecars."""
+        from omni_run import load_manifest, boot_wave, describe_wave
+
+        manifest = load_manifest(write_manifest(temp_dir, """
+stages:
+  - {name: infra, delay: 2s, parallel: 2}
+  - backends
+  - frontends
+services:
+  queue: {command: 'true', stage: infra}
+  api: {command: 'true', stage: backends, priority: 10}
+  worker: {command: 'true', stage: backends}
+  web: {command: 'true'}
+sidecars:
+  db: postgres:16
+"""))
+        stages = manifest.stages
+        assert [(s.name, s.delay, s.parallel) for s in stages] == [("infra", 2.0, 2), ("backends", 0.0, None),
+                                                                    ("frontends", 0.0, None)]
+        waves = {name: boot_wave(spec, stages) for name, spec in manifest.services.items()}
+        assert waves == {"queue": (0, 0), "db": (0, 0), "api": (1, -10), "worker": (1, 0), "web": (2, 0)}
+        assert describe_wave(waves["api"], stages) == "stage backends, priority 10"
+        assert describe_wave((0, -3), []) == "priority 3"
+
+    def test_invalid_stages(self, temp_dir):
+        """Test unknown and duplicate stages, a bad parallel, and depending on a later wave."""
+        from omni_run import load_manifest, ManifestError
+
+        for content, message in [
+                ("services:\n  api: {command: x, stage: infra}\n", "unknown stage 'infra' \\(the manifest has no stages:"),
+                ("stages: [a]\nservices:\n  api: {command: x, stage: b}\n", "stages: declares a"),
+                ("stages: [a, a]\nservices: {}\n", "stages\\[1\\]: stage 'a' is declared twice"),
+                ("stages: [{name: a, parallel: 0}]\nservices: {}\n", "stages\\[0\\].parallel: must be at least 1"),
+                ("stages: [infra, apps]\nservices:\n  db: {command: x, stage: infra, depends_on: [api]}\n"
+                 "  api: {command: x}\n",
+                 "services.db.depends_on: 'api' boots later \\(stage apps\\) than db \\(stage infra\\)"),
+                ("services:\n  db: {command: x, priority: 5, depends_on: [api]}\n  api: {command: x}\n",
+                 "'api' boots later \\(priority 0\\) than db \\(priority 5\\)")]:
+            with pytest.raises(ManifestError, match=message):
+                load_manifest(write_manifest(temp_dir, content))
+
+
+@pytest.fixture
+def staged_up(temp_dir, omni_runner, capsys):
+    """A finished `up` of three stages; yields the start and ready events in order, their times, and the output."""
+    from omni_run import load_manifest, Orchestrator, ANSI_ESCAPE
+
+    (temp_dir / "svc.py").write_text("""
+import sys, time
+name, linger = sys.argv[1], float(sys.argv[2])
+def note(event):
+    with open("events.log", "a") as f:
+        f.write(f"{time.time()} {name} {event}\\n")
+note("start")
+time.sleep(0.3)
+note("ready")
+open(name + ".ready", "w").close()
+time.sleep(linger)
+""")
+    health = "{type: exec, command: 'test -f %s.ready', interval: 50ms}"
+    manifest = load_manifest(write_manifest(temp_dir, f"""
+stages:
+  - {{name: infra, delay: 500ms, parallel: 1}}
+  - backends
+  - frontends
+services:
+  db: {{command: ['{sys.executable}', svc.py, db, '2'], stage: infra, health: {health % 'db'}}}
+  cache: {{command: ['{sys.executable}', svc.py, cache, '2'], stage: infra, health: {health % 'cache'}}}
+  api: {{command: ['{sys.executable}', svc.py, api, '0'], stage: backends}}
+  web: {{command: ['{sys.executable}', svc.py, web, '0']}}
+"""))
+    assert Orchestrator(omni_runner, manifest).up() == 0
+    events = [line.split() for line in (temp_dir / "events.log").read_text().splitlines()]
+    yield ([f"{name} {event}" for _, name, event in events], {f"{name} {event}": float(t) for t, name, event in events},
+           ANSI_ESCAPE.sub("", capsys.readouterr().out))
+
+
+class TestStagedUp:
+    """Tests for `up` with stages."""
+
+    def test_parallel_limit(self, staged_up):
+        """Test that infra, limited to one at a time, starts its second service once the first is ready."""
+        order, _, _ = staged_up
+        infra = [e for e in order if e.split()[0] in ("db", "cache")]
+        assert infra[1].endswith("ready") and infra[2].endswith("start")  # One infra service at a time
+
+    def test_delay_and_order(self, staged_up):
+        """Test that backends wait out the delay after infra is up, and frontends start after them."""
+        _, at, _ = staged_up
+        assert at["api start"] - max(at["db ready"], at["cache ready"]) >= 0.5
+        assert at["web start"] >= at["api start"]  # api has no health check: up once running
+
+    def test_stage_messages(self, staged_up):
+        """Test the messages for starting a stage, the delay, and the next stage."""
+        _, _, out = staged_up
+        assert "Starting stage infra: db, cache" in out
+        assert "stage infra is up; stage backends starts in 0.5s: api" in out
+        assert "stage backends is up; starting stage frontends: web" in out
+
+    def test_explain_and_startup_timeout(self, temp_dir, omni_runner, capsys):
+        """Test the waves `explain` prints, and a held service in the startup timeout report."""
+        from omni_run import run_subcommand, load_manifest, Orchestrator, ANSI_ESCAPE
+
+        write_manifest(temp_dir, f"""
+startup_timeout: 1s
+stages: [infra, apps]
+services:
+  db: {{command: ['{sys.executable}', '-c', 'import time; time.sleep(30)'], stage: infra,
+        health: {{type: exec, command: 'false', interval: 100ms, failure_threshold: 100}}}}
+  api: {{command: 'true'}}
+""")
+        run_subcommand(["explain", "-C", str(temp_dir)])
+        out = ANSI_ESCAPE.sub("", capsys.readouterr().out)
+        assert "Boot waves: stage infra (db) -> stage apps (api)" in out
+
+        orchestrator = Orchestrator(omni_runner, load_manifest(temp_dir / "omni-run.yaml"))
+        started = time.time()
+        assert orchestrator.up() == 1
+        assert time.time() - started < 10
+        out = ANSI_ESCAPE.sub("", capsys.readouterr().out)
+        assert "api boots after stage infra is up: db is starting" in out
+        assert orchestrator.services["api"].reason == "startup timed out"
@@ -0,0 +1,160 @@
+"""
+Tests for startup profiling and the startup budget in OmniRun.
+
+This module tests:
+- Recording phases per service, only until each is ready, and the totals
+- The flame-style breakdown: one time axis, open phases of services still starting, the slowest step
+- `up` printing the profile once every service is ready, with waiting on dependencies
+- The startup budget failing `up` with the breakdown, and --startup-budget
+"""
+
+import sys
+import time
+import threading
+import pytest
+from pathlib import Path
+
+from conftest import *
+
+
+LISTEN_AFTER = """import os, socket, sys, time
+time.sleep(float(sys.argv[1]))
+server = socket.create_server(("127.0.0.1", int(os.environ["PORT"])))
+time.sleep(60)
+"""
+
+
+@pytest.fixture
+def profiled_up(temp_dir, omni_runner, capsys):
+    """`up` with profiling, an api waiting on a slow db, until the profile; yields (orchestrator, output)."""
+    from omni_run import load_manifest, Orchestrator, ANSI_ESCAPE
+
+    (temp_dir / "listen.py").write_text(LISTEN_AFTER)
+    write_manifest(temp_dir, f"""
+services:
+  db:
+    command: ["{sys.executable}", "listen.py", "0.6"]
+    ports: auto
+    health: {{type: tcp, port: http, interval: 100ms}}
+  api:
+    command: ["{sys.executable}", "listen.py", "0"]
+    ports: auto
+    health: {{type: tcp, port: http, interval: 100ms}}
+    depends_on: {{db: {{condition: service_healthy}}}}
+""")
+    orchestrator = Orchestrator(omni_runner, load_manifest(temp_dir / "omni-run.yaml"))
+    runner = threading.Thread(target=orchestrator.up, kwargs={"profile_startup": True})
+    runner.start()
+    out = ""
+    try:
+        deadline = time.time() + 20
+        while time.time() < deadline and "Slowest step" not in out:
+            time.sleep(0.1)
+            out += ANSI_ESCAPE.sub("", capsys.readouterr().out)
+        time.sleep(0.5)
+    finally:
+        orchestrator.request_shutdown()
+        runner.join(timeout=20)
+    yield orchestrator, out + ANSI_ESCAPE.sub("", capsys.readouterr().out)
+
+
+class TestStartupProfiler:
+    """Tests for the profiler on its own."""
+
+    def _profiled(self, temp_dir):
+        from datetime import datetime
+        from omni_run import StartupProfiler, ServiceSpec, ManagedService, ServiceState
+
+        profiler = StartupProfiler(budget=10, started=1000.0)
+        api, web = (ManagedService(ServiceSpec(name=n, path=temp_dir, command="true")) for n in ("api", "web"))
+        profiler.record("api", "install", 1000.0, 1004.0)
+        profiler.record("api", "detect", 1004.0, 1004.5)
+        profiler.record("api", "build", 1004.5, 1006.0)
+        api.started_at, api.state = datetime.fromtimestamp(1006.0), ServiceState.HEALTHY
+        profiler.observe(api, now=1008.0)
+        profiler.record("api", "build", 1010.0, 1020.0)  # A restart after it was ready doesn't count
+        profiler.record("web", "wait", 1000.0, 1008.0)
+        web.started_at, web.state = datetime.fromtimestamp(1008.0), ServiceState.STARTING
+        profiler.observe(web, now=1009.0)
+        return profiler, api, web
+
+    def test_totals(self, temp_dir):
+        """Test the ready times and the totals in phase order, only until each service is ready."""
+        profiler, _, _ = self._profiled(temp_dir)
+        assert profiler.ready == {"api": 8.0}
+        assert profiler.totals("api") == {"install": 4.0, "detect": 0.5, "build": 1.5, "ready": 2.0}
+
+    def test_over_budget(self, temp_dir):
+        """Test the budget while services are still starting and once they are all ready."""
+        profiler, _, _ = self._profiled(temp_dir)
+        assert not profiler.over_budget(now=1009.0) and profiler.over_budget(now=1010.5)
+        profiler.finished = 1012.0
+        assert not profiler.over_budget(now=2000.0)
+
+    def test_report(self, temp_dir):
+        """Test phases on one axis, open phases, the legend and the slowest step."""
+        from omni_run import ANSI_ESCAPE
+
+        profiler, api, web = self._profiled(temp_dir)
+        lines = [ANSI_ESCAPE.sub("", line) for line in profiler.report([api, web], now=1010.0)]
+        assert lines[0] == "Startup profile (10.0s so far):"
+        assert lines[1] == ("  api     |" + "i" * 16 + "dd" + "b" * 6 + "r" * 8 + " " * 8 + "|   8.0s  "
+                            "install 4.0s, detect 0.5s, build 1.5s, ready 2.0s")
+        assert lines[2] == "  web     |" + "·" * 32 + "r" * 8 + "| not ready  wait 8.0s, ready 2.0s"
+        assert lines[3].startswith("  · waiting on dependencies  i installing")
+        assert lines[4] == "Slowest step: api installing (4.0s)"
+
+    def test_report_when_ready(self, temp_dir):
+        """Test the heading once every service is ready."""
+        from omni_run import ANSI_ESCAPE
+
+        profiler, api, web = self._profiled(temp_dir)
+        profiler.finished = 1012.0
+        assert ANSI_ESCAPE.sub("", profiler.report([api, web])[0]) == "Startup profile (ready in 12.0s):"
+
+
+@pytest.mark.skipif(sys.platform == "win32", reason="Uses POSIX process groups")
+class TestProfileStartup:
+    """Tests for profiling and budgeting `up`."""
+
+    def test_printed_once(self, profiled_up):
+        """Test that the profile is printed once, when every service is ready, and the profiler dropped."""
+        orchestrator, out = profiled_up
+        assert out.count("Startup profile (ready in ") == 1
+        assert orchestrator.profiler is None
+
+    def test_waiting_on_dependencies(self, profiled_up):
+        """Test that the api's time waiting on the db is shown."""
+        _, out = profiled_up
+        profiler_lines = {line.split("|")[0].strip(): line for line in out.splitlines() if line.startswith("  db ") or
+                          line.startswith("  api ")}
+        assert "|·" in profiler_lines["api"] and "wait " in profiler_lines["api"] and "ready " in profiler_lines["db"]
+
+    def test_budget(self, temp_dir, capsys):
+        """Test that running out of the budget fails `up` with the breakdown."""
+        from omni_run import run_subcommand, ANSI_ESCAPE
+
+        (temp_dir / "listen.py").write_text(LISTEN_AFTER)
+        write_manifest(temp_dir, f"""
+startup_budget: 1s
+services:
+  api:
+    command: ["{sys.executable}", "listen.py", "30"]
+    ports: auto
+    health: {{type: tcp, port: http, interval: 100ms}}
+""")
+        started = time.time()
+        assert run_subcommand(["up", "-C", str(temp_dir), "--skip-install", "--no-reload"]) == 1
+        assert time.time() - started < 15
+        out = ANSI_ESCAPE.sub("", capsys.readouterr().out)
+        assert "Startup budget of 1s ran out; not ready: api" in out
+        assert "Startup profile (" in out and "s so far):" in out
+        assert "  api     |" in out and "| not ready" in out
+
+    def test_invalid_budget(self, temp_dir, capsys):
+        """Test an invalid --startup-budget."""
+        from omni_run import run_subcommand
+
+        write_manifest(temp_dir, "services:\n  api: {command: ./api}\n")
+        assert run_subcommand(["up", "api", "-C", str(temp_dir), "--no-reload", "--startup-budget", "soon"]) == 1
+        assert "--startup-budget: " in capsys.readouterr().out
@@ -0,0 +1,236 @@
+"""
+Tests for the persistent state store in OmniRun.
+
+This module tests:
+- Recording ports, starts and stops, restarts and builds in .omni-run/state.db
+- Schema versioning: upgrading an older database, and refusing one from a newer omni-run
+- The environment a service started with, secrets and sensitive keys kept as digests
+- `up` keeping the store current and giving auto ports back on the next run
+- Container ids from the docker backend's cidfile
+- `omni-run status` showing history from another terminal, as text and JSON
+"""
+
+import sys
+import json
+import pytest
+from pathlib import Path
+from unittest.mock import patch, MagicMock
+
+from conftest import *
+
+
+class TestStateStore:
+    """Tests for the database itself."""
+
+    def test_records(self, temp_dir):
+        """Test that ports, starts, exits and restarts survive reopening the store."""
+        from omni_run import StateStore, LifecycleEvent, STATE_DB
+
+        store = StateStore(temp_dir / STATE_DB)
+        store.record_ports("api", {"http": 8080})
+        store(LifecycleEvent("started", "api", pid=41))
+        store(LifecycleEvent("exited", "api", exit_code=1))
+        store(LifecycleEvent("restarted", "api", pid=42))
+        store(LifecycleEvent("crashed", "api", "segfault", exit_code=139))
+        store.close()
+
+        store = StateStore.open(temp_dir)
+        api = store.service("api")
+        assert api["ports"] == {"http": 8080} and store.ports("worker") == {}
+        assert (api["starts"], api["restarts"], api["pid"], api["last_exit_code"], api["last_reason"]) == (
+            2, 1, None, 139, "segfault")
+        store.close()
+
+    def test_builds_and_restart_history(self, temp_dir):
+        """Test the last build and the restart history, which keeps the latest 50 restarts."""
+        from datetime import datetime
+        from omni_run import StateStore, STATE_DB
+
+        store = StateStore(temp_dir / STATE_DB)
+        for i in range(60):
+            store.record_restart("api", datetime(2024, 5, 1, 12, 0, i % 60), i, 0.5)
+        store.record_build("api", "abc123", False, 2.5)
+        store.close()
+
+        store = StateStore.open(temp_dir)
+        api = store.service("api")
+        assert (api["build_key"], api["build_hit"], api["build_seconds"]) == ("abc123", False, 2.5)
+        history = store.restart_history("api", limit=100)
+        assert len(history) == 50 and history[-1] == {"at": "2024-05-01T12:00:59", "exit_code": 59, "delay": 0.5}
+        store.close()
+
+    def test_schema_version(self, temp_dir):
+        """Test that a store written by a newer omni-run is refused, and that a missing one isn't created."""
+        import sqlite3
+        from omni_run import StateStore, STATE_DB, STATE_DB_VERSION
+
+        assert StateStore.open(temp_dir) is None
+        assert not (temp_dir / STATE_DB).exists()
+
+        StateStore(temp_dir / STATE_DB).close()
+        db = sqlite3.connect(str(temp_dir / STATE_DB))
+        assert db.execute("PRAGMA user_version").fetchone()[0] == STATE_DB_VERSION
+        db.execute(f"PRAGMA user_version = {STATE_DB_VERSION + 1}")
+        db.close()
+        with pytest.raises(sqlite3.DatabaseError, match="written by a newer omni-run"):
+            StateStore(temp_dir / STATE_DB)
+        assert StateStore.open(temp_dir) is None
+
+    def test_upgrade(self, temp_dir):
+        """Test a version 1 database keeping its rows and gaining the env columns."""
+        import sqlite3
+        from omni_run import StateStore, STATE_DB, STATE_DB_VERSION
+
+        db = sqlite3.connect(str(temp_dir / STATE_DB))
+        db.executescript(StateStore.SCHEMA[0] + "; INSERT INTO services (name, starts) VALUES ('api', 3); PRAGMA user_version = 1;")
+        db.close()
+
+        store = StateStore(temp_dir / STATE_DB)
+        assert store.service("api")["starts"] == 3 and store.env("api") is None
+        store.record_env("api", {"LOG_LEVEL": "debug"}, set())
+        store.close()
+        db = sqlite3.connect(str(temp_dir / STATE_DB))
+        assert db.execute("PRAGMA user_version").fetchone()[0] == STATE_DB_VERSION
+        db.close()
+
+    def test_recorded_env(self, temp_dir):
+        """Test that the variables layers set are recorded, with secrets and sensitive keys as digests."""
+        from omni_run import StateStore, EnvironmentResolver, STATE_DB, redacted_env
+
+        resolver = EnvironmentResolver({"HOME": "/home/dev"})
+        resolver.add("manifest", {"LOG_LEVEL": "debug", "DB_PASSWORD": "hunter2", "STRIPE": "sk_live"})
+        resolver.secrets.add("STRIPE")
+        values, redacted = redacted_env(resolver, b"key")
+        assert redacted == {"DB_PASSWORD", "STRIPE"} and "HOME" not in values
+        assert values["LOG_LEVEL"] == "debug" and values["DB_PASSWORD"].startswith("hmac-sha256:")
+        assert "hunter2" not in values["DB_PASSWORD"]
+
+        store = StateStore(temp_dir / STATE_DB)
+        store.record_env("api", values, redacted)
+        store.close()
+        store = StateStore.open(temp_dir)
+        recorded = store.env("api")
+        assert (recorded["values"], recorded["redacted"]) == (values, redacted) and recorded["recorded"]
+        store.close()
+
+class TestOrchestratorState:
+    """Tests for `up` keeping the store current."""
+
+    def _up(self, temp_dir, omni_runner):
+        from omni_run import load_manifest, Orchestrator
+
+        write_manifest(temp_dir, f"""
+services:
+  api:
+    command: ["{sys.executable}", "-c", "import sys; sys.exit(4)"]
+    ports: auto
+    restart: {{policy: on-failure, max_restarts: 1, backoff: 50ms, jitter: 0}}
+""")
+        orchestrator = Orchestrator(omni_runner, load_manifest(temp_dir / "omni-run.yaml"), state_dir=temp_dir / ".omni-run")
+        orchestrator.up()
+        return orchestrator
+
+    def test_up_records_history(self, temp_dir, omni_runner):
+        """Test starts, exit codes, restarts and ports recorded by `up`, which closes the store."""
+        from omni_run import StateStore
+
+        orchestrator = self._up(temp_dir, omni_runner)
+        assert orchestrator.store is None
+        store = StateStore.open(temp_dir / ".omni-run")
+        api = store.service("api")
+        port = orchestrator.services["api"].ports["http"]
+        assert (api["starts"], api["restarts"], api["last_exit_code"], api["ports"]) == (2, 1, 4, {"http": port})
+        assert [entry["exit_code"] for entry in store.restart_history("api")] == [4]
+        store.close()
+
+    def test_auto_ports_kept(self, temp_dir, omni_runner):
+        """Test that the next run gives a service the auto port it had before."""
+        port = self._up(temp_dir, omni_runner).services["api"].ports["http"]
+        assert self._up(temp_dir, omni_runner).services["api"].ports["http"] == port
+
+    def test_not_recorded_without_state_dir(self, temp_dir, omni_runner):
+        """Test that orchestrators without a state directory (tests, matrix stacks) leave no store."""
+        from omni_run import load_manifest, Orchestrator, STATE_DB
+
+        write_manifest(temp_dir, f"services:\n  once:\n    command: [\"{sys.executable}\", \"-c\", \"pass\"]\n")
+        Orchestrator(omni_runner, load_manifest(temp_dir / "omni-run.yaml")).up()
+        assert not (temp_dir / ".omni-run" / STATE_DB).exists()
+
+
+class TestContainerIds:
+    """Tests for the container a docker service runs in."""
+
+    def test_cidfile(self, temp_dir, omni_runner):
+        """Test that `docker run` writes a cidfile that container_id reads back."""
+        from omni_run import load_manifest, Orchestrator, HostBackend
+
+        (temp_dir / "main.py").write_text("print('hi')\n")
+        orchestrator = Orchestrator(omni_runner, load_manifest(write_manifest(temp_dir, "services:\n  api:\n    backend: docker\n")))
+        service = orchestrator.services["api"]
+        backend = orchestrator.backend_for(service)
+        cidfile = temp_dir / ".omni-run" / "containers" / "api.cid"
+        cidfile.parent.mkdir(parents=True)
+        cidfile.write_text("stale")
+
+        with patch("omni_run.shutil.which", return_value="/usr/bin/docker"), \
+             patch("omni_run.subprocess.run", return_value=MagicMock(returncode=0, stdout="", stderr="")):
+            argv, _, _ = backend.prepare(orchestrator, service)
+        assert argv[argv.index("--cidfile") + 1] == str(cidfile)
+        assert not cidfile.exists() and backend.container_id(orchestrator, service) is None
+
+        cidfile.write_text("4f1c2a9e8b7d\n")
+        assert backend.container_id(orchestrator, service) == "4f1c2a9e8b7d"
+        assert HostBackend().container_id(orchestrator, service) is None
+
+
+class TestStatusHistory:
+    """Tests for `omni-run status` reading the store."""
+
+    def _history(self, temp_dir):
+        from datetime import datetime
+        from omni_run import StateStore, LifecycleEvent, STATE_DB
+
+        write_manifest(temp_dir, "services:\n  api:\n    command: 'true'\n")
+        store = StateStore(temp_dir / ".omni-run" / STATE_DB)
+        store(LifecycleEvent("started", "api", pid=42, timestamp=datetime(2024, 5, 1, 9, 15, 0)))
+        store(LifecycleEvent("exited", "api", exit_code=2))
+        store.record_container("api", "4f1c2a9e8b7d0a1b2c3d")
+        store.record_build("api", "0123456789abcdef", True, 1.25)
+        store.record_restart("api", datetime(2024, 5, 1, 12, 30, 45), 2, 1.0)
+        store.close()
+
+    def test_status_without_supervisor(self, temp_dir, capsys):
+        """Test the history table and restarts from earlier runs when nothing is running."""
+        from omni_run import run_subcommand, ANSI_ESCAPE
+
+        self._history(temp_dir)
+        assert run_subcommand(["status", "-C", str(temp_dir)]) == 3
+        out = ANSI_ESCAPE.sub("", capsys.readouterr().out)
+        assert "No services running" in out and "STATE" not in out
+        row = out[out.index("LAST STARTED"):].split("\n")[1]
+        assert row.split() == ["api", "1", "0", "2024-05-01", "09:15:00", "code", "2", "4f1c2a9e8b7d",
+                               "cached", "0123456789ab", "(1.2s)"]
+        assert "12:30:45  exited with code 2, restarted after 1.0s" in out
+
+    def test_history_json(self, temp_dir, capsys):
+        """Test the full container id and the restart history in the JSON status."""
+        from omni_run import run_subcommand
+
+        self._history(temp_dir)
+        assert run_subcommand(["status", "-C", str(temp_dir), "--output", "json"]) == 3
+        history = json.loads(capsys.readouterr().out)["history"]
+        assert history["api"]["container_id"] == "4f1c2a9e8b7d0a1b2c3d"
+        assert history["api"]["restart_history"] == [{"at": "2024-05-01T12:30:45", "exit_code": 2, "delay": 1.0}]
+
+    def test_build_recorded(self, temp_dir):
+        """Test the build cache reporting misses and hits to its record callback."""
+        from omni_run import BuildCache, BuildRecipe
+
+        script = "open(__import__('os').path.join(r'{out}', 'bin'), 'w').write('x')"
+        recipe = BuildRecipe("go", temp_dir, [sys.executable, "-c", script], ["{out}"], "bin")
+        builds = []
+        cache = BuildCache(temp_dir / "cache")
+        cache.prepare(recipe, emit=lambda line: None, record=lambda *build: builds.append(build))
+        cache.prepare(recipe, emit=lambda line: None, record=lambda *build: builds.append(build))
+        assert [hit for _, hit, _ in builds] == [False, True]
+        assert builds[0][0] == builds[1][0] and builds[0][2] == builds[1][2]
@@ -0,0 +1,101 @@
+"""
+Tests for the static file server in OmniRun.
+
+This module tests:
+- Serving files and directory indexes, and refusing paths outside the root
+- SPA fallback to index.html for client-side routes
+- gzip for text responses, ETags with 304 responses, and cache headers
+- The `omni-run static` subcommand's argument checks
+"""
+
+import gzip
+import threading
+import urllib.request
+import urllib.error
+import pytest
+from pathlib import Path
+
+from conftest import *
+
+
+def write_site(root: Path):
+    (root / "assets").mkdir(parents=True)
+    (root / "index.html").write_text("<!doctype html><div id=app></div>\n")
+    (root / "assets" / "app.3f9a1c2e.js").write_text("console.log('app');\n" * 200)
+    (root / "assets" / "logo.png").write_bytes(b"\x89PNG" + b"\0" * 2000)
+    (root / "docs").mkdir()
+    (root / "docs" / "index.html").write_text("<h1>docs</h1>\n")
+
+
+def fetch(url: str, headers=None):
+    """(status, headers, body) for a GET, including error statuses."""
+    request = urllib.request.Request(url, headers=headers or {})
+    try:
+        with urllib.request.urlopen(request, timeout=5) as response:
+            return response.status, response.headers, response.read()
+    except urllib.error.HTTPError as e:
+        return e.code, e.headers, e.read()
+
+
+@pytest.fixture
+def site(temp_dir):
+    from omni_run import StaticFileServer
+
+    write_site(temp_dir / "public")
+    (temp_dir / "secret.txt").write_text("not served")
+    server = StaticFileServer(temp_dir / "public", port=0, quiet=True)
+    server.start()
+    threading.Thread(target=server.serve_forever, daemon=True).start()
+    yield server
+    server.stop()
+
+
+class TestStaticFileServer:
+    """Tests for StaticFileServer."""
+
+    def test_files_fallback_and_traversal(self, site):
+        """Test files, directory indexes, the SPA fallback for routes, and 404s for missing assets and ../ paths."""
+        status, headers, body = fetch(site.url + "docs/")
+        assert status == 200 and body == b"<h1>docs</h1>\n"
+        assert headers["Content-Type"] == "text/html; charset=utf-8"
+
+        status, headers, body = fetch(site.url + "dashboard/settings?tab=2")
+        assert status == 200 and b"id=app" in body and headers["Cache-Control"] == "no-cache"
+        assert fetch(site.url + "assets/missing.js")[0] == 404
+        assert fetch(site.url + "../secret.txt")[0] in (400, 404)
+        assert fetch(site.url + "%2e%2e/secret.txt")[0] == 404
+
+        site.spa = False
+        assert fetch(site.url + "dashboard")[0] == 404
+
+    def test_gzip_etag_and_cache_headers(self, site):
+        """Test gzip for accepted text, none for images, 304 for a matching ETag, and long caching of fingerprinted assets."""
+        url = site.url + "assets/app.3f9a1c2e.js"
+        status, headers, body = fetch(url, {"Accept-Encoding": "gzip"})
+        assert status == 200 and headers["Content-Encoding"] == "gzip"
+        assert gzip.decompress(body) == b"console.log('app');\n" * 200
+        assert headers["Cache-Control"] == "public, max-age=31536000, immutable"
+        assert headers["Vary"] == "Accept-Encoding" and headers["Last-Modified"]
+
+        status, headers, body = fetch(url)
+        assert "Content-Encoding" not in headers and len(body) == 4000
+        status, headers, _ = fetch(site.url + "assets/logo.png", {"Accept-Encoding": "gzip"})
+        assert "Content-Encoding" not in headers and headers["Cache-Control"] == "no-cache"
+
+        etag = fetch(site.url)[1]["ETag"]
+        status, _, body = fetch(site.url, {"If-None-Match": etag})
+        assert status == 304 and body == b""
+
+        site.gzip = False
+        assert "Content-Encoding" not in fetch(url, {"Accept-Encoding": "gzip"})[1]
+
+
+class TestStaticCommand:
+    """Tests for `omni-run static`."""
+
+    def test_missing_directory(self, temp_dir, capsys):
+        """Test that serving a directory that doesn't exist fails."""
+        from omni_run import run_subcommand
+
+        assert run_subcommand(["static", "dist", "-C", str(temp_dir), "--port", "0"]) == 1
+        assert "dist is not a directory" in capsys.readouterr().out
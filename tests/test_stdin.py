@@ -0,0 +1,202 @@
+"""
+Tests for routing input to services in OmniRun.
+
+This module tests:
+- Writing to a running service's stdin, and services that are stopped or unknown
+- `@<service>` switching, one-off lines and escapes in the StdinRouter `up` reads the terminal with
+- The attach socket: backlog, live output and forwarded input, and `omni-run attach` errors
+"""
+
+import sys
+import json
+import time
+import socket
+import threading
+import pytest
+from pathlib import Path
+
+from conftest import *
+
+pytestmark = pytest.mark.skipif(not hasattr(socket, "AF_UNIX"), reason="attach uses Unix domain sockets")
+
+ECHO = "import sys\nprint('ready', flush=True)\nfor line in sys.stdin: print('got', line.strip(), flush=True)"
+
+
+def echo_manifest(temp_dir: Path, *names: str) -> Path:
+    services = "".join(f"  {name}:\n    command: {json.dumps([sys.executable, '-c', ECHO])}\n" for name in names)
+    return write_manifest(temp_dir, "services:\n" + services)
+
+
+def wait_for(condition, timeout=10.0):
+    deadline = time.time() + timeout
+    while time.time() < deadline:
+        if condition():
+            return True
+        time.sleep(0.05)
+    return False
+
+
+def run_in_background(orchestrator):
+    thread = threading.Thread(target=orchestrator.up, kwargs={"persistent": True}, daemon=True)
+    thread.start()
+    assert wait_for(lambda: all(s.output and s.output[-1][2] == "ready" for s in orchestrator.services.values()))
+    return thread
+
+
+def lines(logs, name):
+    return [text for _, _, level, text in logs.history.get(name, ()) if level != "omni"]
+
+
+@pytest.fixture
+def routed(temp_dir, omni_runner):
+    """api and migrate running under `up`; yields a StdinRouter for them and the lines each has printed."""
+    from omni_run import load_manifest, Orchestrator, LogPipeline, StdinRouter
+
+    logs = LogPipeline(console=False, buffer=100)
+    orchestrator = Orchestrator(omni_runner, load_manifest(echo_manifest(temp_dir, "api", "migrate")), logs)
+    thread = run_in_background(orchestrator)
+    yield StdinRouter(orchestrator), lambda name: lines(logs, name)
+    orchestrator.request_shutdown()
+    thread.join(timeout=15)
+
+
+@pytest.fixture
+def attachable(temp_dir, omni_runner):
+    """api and worker running under `up` with an attach socket; yields the orchestrator and its state directory."""
+    from omni_run import load_manifest, Orchestrator, LogPipeline, WORKSPACE_DIR
+
+    state_dir = temp_dir / WORKSPACE_DIR
+    orchestrator = Orchestrator(omni_runner, load_manifest(echo_manifest(temp_dir, "api", "worker")),
+                                LogPipeline(console=False), state_dir=state_dir)
+    thread = run_in_background(orchestrator)
+    yield orchestrator, state_dir
+    orchestrator.request_shutdown()
+    thread.join(timeout=15)
+
+
+def attach(state_dir, request):
+    from omni_run import ATTACH_SOCKET
+
+    sock = socket.socket(socket.AF_UNIX, socket.SOCK_STREAM)
+    sock.settimeout(10)
+    sock.connect(str(state_dir / ATTACH_SOCKET))
+    sock.sendall(json.dumps(request).encode() + b"\n")
+    return sock, sock.makefile("r")
+
+
+class TestStdinRouter:
+    """Tests for sending typed lines to services."""
+
+    def test_service_not_running(self, temp_dir, omni_runner):
+        """Test that input for a service that hasn't started is refused."""
+        from omni_run import load_manifest, Orchestrator, ManifestError
+
+        orchestrator = Orchestrator(omni_runner, load_manifest(echo_manifest(temp_dir, "api")))
+        with pytest.raises(ManifestError, match="api is not running"):
+            orchestrator.send_input("api", "x\n")
+
+    def test_no_target(self, routed):
+        """Test that lines before any `@<service>` aren't sent anywhere."""
+        router, _ = routed
+        assert router.feed("hello").startswith("no service receives input; type @<service> to pick one of: api, migrate")
+        assert router.feed("@") == "no service receives input; type @<service> to pick one of: api, migrate"
+
+    def test_switching(self, routed):
+        """Test switching the target with `@<service>` and escaping a leading `@`."""
+        router, printed = routed
+        assert router.feed("@migrate") == "input now goes to migrate"
+        assert router.feed("y") is None
+        assert router.feed("@@literal") is None
+        assert router.feed("@") == "input goes to migrate"
+        assert wait_for(lambda: printed("migrate")[-1:] == ["got @literal"])
+        assert printed("migrate") == ["ready", "got y", "got @literal"]
+
+    def test_one_off_line(self, routed):
+        """Test that `@<service> text` sends one line without switching."""
+        router, printed = routed
+        assert router.feed("@migrate") == "input now goes to migrate"
+        assert router.feed("@api one off") is None
+        assert router.feed("@") == "input goes to migrate"
+        assert wait_for(lambda: printed("api") == ["ready", "got one off"])
+        assert printed("migrate") == ["ready"]
+
+    def test_unknown_service(self, routed):
+        """Test switching to, and sending to, a service that doesn't exist."""
+        from omni_run import ManifestError
+
+        router, _ = routed
+        assert router.feed("@nope") == "unknown service 'nope'; services: api, migrate"
+        with pytest.raises(ManifestError, match="Unknown service 'nope'"):
+            router.orchestrator.send_input("nope", "x\n")
+
+    def test_target_stopped(self, routed):
+        """Test that lines for a target that has stopped report it."""
+        router, _ = routed
+        assert router.feed("@migrate") == "input now goes to migrate"
+        router.orchestrator.request("stop", "migrate")
+        assert wait_for(lambda: not router.orchestrator.services["migrate"].is_alive())
+        assert router.feed("n") == "migrate is not running"
+
+
+class TestAttach:
+    """Tests for the attach socket and `omni-run attach`."""
+
+    def test_unknown_service(self, attachable):
+        """Test the error reply for a service that doesn't exist."""
+        _, state_dir = attachable
+        sock, reader = attach(state_dir, {"service": "nope"})
+        with sock:
+            assert json.loads(reader.readline()) == {"error": "unknown service 'nope'"}
+
+    def test_backlog_and_input(self, attachable):
+        """Test the reply, the backlog, and input forwarded to the attached service only."""
+        orchestrator, state_dir = attachable
+        sock, reader = attach(state_dir, {"service": "api", "lines": 5})
+        with sock:
+            assert json.loads(reader.readline()) == {"service": "api", "state": "running"}
+            assert reader.readline() == "ready\n"
+            sock.sendall(b"yes\n")
+            assert reader.readline() == "got yes\n"
+        assert not any(text == "got yes" for _, _, text in orchestrator.services["worker"].output)
+
+    def test_socket_removed(self, temp_dir, omni_runner):
+        """Test that the socket is removed when the run ends."""
+        from omni_run import load_manifest, Orchestrator, LogPipeline, WORKSPACE_DIR, ATTACH_SOCKET
+
+        state_dir = temp_dir / WORKSPACE_DIR
+        orchestrator = Orchestrator(omni_runner, load_manifest(echo_manifest(temp_dir, "api")),
+                                    LogPipeline(console=False), state_dir=state_dir)
+        thread = run_in_background(orchestrator)
+        assert (state_dir / ATTACH_SOCKET).exists()
+        orchestrator.request_shutdown()
+        thread.join(timeout=15)
+        assert not (state_dir / ATTACH_SOCKET).exists()
+
+    def test_attach_without_supervisor(self, temp_dir, capsys):
+        """Test `omni-run attach` when nothing is running."""
+        from omni_run import run_subcommand
+
+        echo_manifest(temp_dir, "api")
+        assert run_subcommand(["attach", "api", "-C", str(temp_dir)]) == 1
+        assert "No services running" in capsys.readouterr().out
+
+    def test_attach_unknown_service(self, temp_dir, attachable, capsys):
+        """Test `omni-run attach` to a service that doesn't exist."""
+        from omni_run import run_subcommand
+
+        assert run_subcommand(["attach", "nope", "-C", str(temp_dir)]) == 1
+        assert "unknown service 'nope'" in capsys.readouterr().out
+
+    def test_attach_detaches(self, temp_dir, attachable, capsys, monkeypatch):
+        """Test the backlog and detaching at end of input, leaving the service running."""
+        import io
+        from omni_run import run_subcommand, ANSI_ESCAPE
+
+        orchestrator, _ = attachable
+        monkeypatch.setattr(sys, "stdin", io.StringIO(""))
+        assert run_subcommand(["attach", "api", "-n", "1", "-C", str(temp_dir)]) == 0
+        out = ANSI_ESCAPE.sub("", capsys.readouterr().out)
+        assert "Attached to api (running): lines you type go to its stdin" in out
+        assert "\nready\n" in out
+        assert "Detached from api; it keeps running" in out
+        assert orchestrator.services["api"].is_alive()
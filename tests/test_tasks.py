@@ -0,0 +1,254 @@
+"""
+Tests for manifest tasks in OmniRun.
+
+This module tests:
+- Parsing `tasks:` (command shorthand, depends_on, env, timeout) and DAG validation
+- Levels and the critical path through a run
+- Running independent tasks in parallel up to the concurrency limit
+- Cancelling after a failure, --keep-going and task timeouts
+- Retries with backoff, and continue_on_error failures that don't fail the run
+- The `omni-run task` subcommand (list, --dry-run, run and summary)
+"""
+
+import sys
+import time
+import pytest
+from pathlib import Path
+
+from conftest import *
+
+
+def sleep_command(seconds: float, text: str = "") -> str:
+    return f"['{sys.executable}', '-c', 'import time; time.sleep({seconds}); print(\"{text}\")']"
+
+
+class TestTaskConfig:
+    """Tests for the `tasks:` block."""
+
+    def _tasks(self, temp_dir):
+        from omni_run import load_manifest
+
+        (temp_dir / "web").mkdir()
+        return load_manifest(write_manifest(temp_dir, """
+tasks:
+  generate: protoc --go_out=. api.proto
+  build:
+    command: [go, build, ./...]
+    depends_on: generate
+    env: {CGO_ENABLED: 0}
+    timeout: 2m
+    retries: 2
+    retry_backoff: 500ms
+    continue_on_error: true
+  bundle:
+    command: npm run build
+    path: web
+    depends_on: [generate]
+""")).tasks
+
+    def test_command_shorthand(self, temp_dir):
+        """Test that a bare command is a task run from the root with no retries, in manifest order."""
+        tasks = self._tasks(temp_dir)
+        assert list(tasks) == ["generate", "build", "bundle"]
+        assert tasks["generate"].command == "protoc --go_out=. api.proto"
+        assert tasks["generate"].path == temp_dir.resolve()
+        assert (tasks["generate"].retries, tasks["generate"].continue_on_error) == (0, False)
+
+    def test_mapping_options(self, temp_dir):
+        """Test env, timeout, retry and continue_on_error options and a list command."""
+        build = self._tasks(temp_dir)["build"]
+        assert build.env == {"CGO_ENABLED": "0"}
+        assert build.timeout == 120
+        assert (build.retries, build.retry_backoff, build.continue_on_error) == (2, 0.5, True)
+        assert build.describe() == "go build ./..."
+
+    def test_dependencies_and_path(self, temp_dir):
+        """Test depends_on as a name or a list, and a path relative to the root."""
+        tasks = self._tasks(temp_dir)
+        assert tasks["build"].depends_on == ["generate"]
+        assert tasks["bundle"].depends_on == ["generate"]
+        assert tasks["bundle"].path == (temp_dir / "web").resolve()
+
+    def test_invalid_tasks(self, temp_dir):
+        """Test unknown keys, missing commands, unknown dependencies and cycles."""
+        from omni_run import load_manifest, ManifestError
+
+        for block, message in [("a: {cmd: make}", r"tasks.a: unknown key\(s\) cmd"),
+                               ("a: {depends_on: b}", "tasks.a: needs a command"),
+                               ("a: {command: make, depends_on: b}", "tasks.a.depends_on: unknown task 'b'"),
+                               ("a: {command: make, depends_on: b}\n  b: {command: make, depends_on: a}",
+                                "Dependency cycle: a -> b -> a"),
+                               ("a: {command: make, timeout: soon}", "tasks.a.timeout"),
+                               ("a: {command: make, retries: -1}", "tasks.a.retries"),
+                               ("a: {command: make, retry_backoff: later}", "tasks.a.retry_backoff")]:
+            write_manifest(temp_dir, f"tasks:\n  {block}\n")
+            with pytest.raises(ManifestError, match=message):
+                load_manifest(temp_dir / "omni-run.yaml")
+
+    def test_levels_and_critical_path(self, temp_dir):
+        """Test grouping into levels and following the latest-finishing dependency."""
+        from omni_run import TaskSpec, TaskResult, task_levels, critical_path, resolve_start_order
+
+        tasks = {name: TaskSpec(name, temp_dir, "true", depends_on=deps) for name, deps in
+                 [("generate", []), ("lint", []), ("build", ["generate"]), ("test", ["build", "lint"])]}
+        assert task_levels(tasks, resolve_start_order(tasks, kind="task")) == [["generate", "lint"], ["build"], ["test"]]
+        assert resolve_start_order(tasks, ["build"], kind="task") == ["generate", "build"]
+
+        results = {"generate": TaskResult("generate", "succeeded", 0, started=0, finished=2),
+                   "lint": TaskResult("lint", "succeeded", 0, started=0, finished=4),
+                   "build": TaskResult("build", "succeeded", 0, started=2, finished=7),
+                   "test": TaskResult("test", "succeeded", 0, started=7, finished=9)}
+        assert critical_path(tasks, results) == ["generate", "build", "test"]
+        assert results["build"].duration == 5
+
+
+@pytest.mark.skipif(sys.platform == "win32", reason="Uses POSIX process groups")
+class TestTaskScheduler:
+    """Tests for running tasks with TaskScheduler."""
+
+    def _run(self, temp_dir, omni_runner, content, selected=None, **kwargs):
+        from omni_run import load_manifest, TaskScheduler
+
+        manifest = load_manifest(write_manifest(temp_dir, content))
+        return TaskScheduler(omni_runner, manifest, **kwargs).run(selected)
+
+    def test_parallel_within_concurrency_limit(self, temp_dir, omni_runner, capsys):
+        """Test that independent tasks overlap and dependents wait for their dependencies."""
+        results = self._run(temp_dir, omni_runner, f"""
+tasks:
+  a: {sleep_command(0.6, "a")}
+  b: {sleep_command(0.6, "b")}
+  c: {{command: {sleep_command(0.1, "c")}, depends_on: [a, b]}}
+""", jobs=2)
+        assert [r.status for r in results.values()] == ["succeeded"] * 3
+        assert results["b"].started < results["a"].finished
+        assert results["c"].started >= max(results["a"].finished, results["b"].finished)
+        assert "running: " in capsys.readouterr().out
+
+        serial = self._run(temp_dir, omni_runner, f"""
+tasks:
+  a: {sleep_command(0.3)}
+  b: {sleep_command(0.3)}
+""", jobs=1)
+        assert serial["b"].started >= serial["a"].finished
+
+    def test_failure_cancels_or_keeps_going(self, temp_dir, omni_runner, capsys):
+        """Test that a failure cancels pending tasks, and with keep_going only skips its dependents."""
+        content = f"""
+tasks:
+  broken: {{command: "exit 3"}}
+  test: {{command: "true", depends_on: broken}}
+  slow: {{command: {sleep_command(0.3)}, depends_on: broken}}
+  docs: {{command: "true"}}
+"""
+        results = self._run(temp_dir, omni_runner, content, jobs=1)
+        assert results["broken"].status == "failed"
+        assert results["broken"].exit_code == 3
+        assert results["test"].status == "skipped"
+        assert results["docs"].reason == "cancelled after an earlier failure"
+
+        results = self._run(temp_dir, omni_runner, content, jobs=1, keep_going=True)
+        assert results["test"].reason == "dependency 'broken' failed"
+        assert results["slow"].status == "skipped"
+        assert results["docs"].status == "succeeded"
+
+    def test_timeout_and_environment(self, temp_dir, omni_runner, capsys):
+        """Test that a task over its timeout is stopped, and tasks get env files, env and OMNI_RUN_TASK."""
+        (temp_dir / ".env").write_text("GREETING=hello\n")
+        results = self._run(temp_dir, omni_runner, f"""
+tasks:
+  hang: {{command: {sleep_command(30)}, timeout: 0.5s}}
+  env:
+    command: echo "$GREETING $TARGET $OMNI_RUN_TASK"
+    env: {{TARGET: world}}
+""", jobs=2)
+        assert results["hang"].status == "failed"
+        assert results["hang"].reason == "timed out after 0.5s"
+        assert results["hang"].duration < 10
+        out = capsys.readouterr().out
+        assert "hello world env" in out
+
+    def test_retries(self, temp_dir, omni_runner, capsys):
+        """Test a flaky task succeeding on a retry after a timeout, and backoff between attempts."""
+        counter = temp_dir / "attempts"
+        flaky = (f"['{sys.executable}', '-c', 'import pathlib, sys, time; p = pathlib.Path(sys.argv[1]); "
+                 f"n = int(p.read_text() or 0) + 1 if p.exists() else 1; p.write_text(str(n)); "
+                 f"time.sleep(30 if n == 1 else 0); sys.exit(0 if n == 3 else 1)', '{counter}']")
+        results = self._run(temp_dir, omni_runner, f"""
+tasks:
+  codegen: {{command: {flaky}, timeout: 0.5s, retries: 2, retry_backoff: 200ms}}
+  build: {{command: "true", depends_on: codegen}}
+""")
+        assert results["codegen"].status == "succeeded" and results["codegen"].attempts == 3
+        assert results["codegen"].duration >= 0.5 + 0.2 + 0.4
+        assert results["build"].status == "succeeded"
+        out = capsys.readouterr().out
+        assert "timed out after 0.5s; retrying in 0.2s (2 retry(s) left)" in out
+        assert "exited with code 1; retrying in 0.4s (1 retry(s) left)" in out
+        assert "(attempt 3/3)" in out
+
+    def test_continue_on_error(self, temp_dir, omni_runner, capsys):
+        """Test that a failure marked continue_on_error is ignored and its dependents still run."""
+        results = self._run(temp_dir, omni_runner, """
+tasks:
+  lint: {command: "exit 2", retries: 1, retry_backoff: 0, continue_on_error: true}
+  test: {command: "true", depends_on: lint}
+  docs: {command: "true"}
+""", jobs=1)
+        assert results["lint"].status == "ignored" and results["lint"].ok
+        assert results["lint"].reason == "exited with code 2 (after 2 attempts)"
+        assert results["test"].status == "succeeded" and results["docs"].status == "succeeded"
+        assert "continuing (continue_on_error)" in capsys.readouterr().out
+
+
+@pytest.mark.skipif(sys.platform == "win32", reason="Uses POSIX shell commands")
+class TestTaskCommand:
+    """Tests for the `omni-run task` subcommand."""
+
+    CONTENT = """
+tasks:
+  generate: "echo generated"
+  build: {command: "sleep 0.3; echo built", depends_on: generate}
+  lint: "true"
+  test: {command: "echo tested", depends_on: [build, lint]}
+"""
+
+    def test_list_and_dry_run(self, temp_dir, capsys):
+        """Test listing tasks and printing the levels that would run."""
+        from omni_run import run_subcommand
+
+        write_manifest(temp_dir, self.CONTENT)
+        assert run_subcommand(["task", "-C", str(temp_dir)]) == 0
+        out = capsys.readouterr().out
+        assert "generate" in out and "build, lint" in out and "echo tested" in out
+
+        assert run_subcommand(["task", "-C", str(temp_dir), "test", "--dry-run"]) == 0
+        assert capsys.readouterr().out.splitlines() == ["1: generate, lint", "2: build", "3: test"]
+
+        assert run_subcommand(["task", "-C", str(temp_dir), "deploy"]) == 1
+        assert "Unknown task 'deploy'" in capsys.readouterr().out
+        write_manifest(temp_dir, "services:\n  api: {command: 'true'}\n")
+        assert run_subcommand(["task", "-C", str(temp_dir)]) == 1
+        assert "defines no tasks" in capsys.readouterr().out
+
+    def test_run_prints_summary(self, temp_dir, capsys):
+        """Test that a run reports each task and the critical path, failing when any task fails."""
+        from omni_run import run_subcommand
+
+        write_manifest(temp_dir, self.CONTENT)
+        assert run_subcommand(["task", "-C", str(temp_dir), "test", "-j", "4"]) == 0
+        out = capsys.readouterr().out
+        assert "tested" in out
+        assert "Critical path: generate" in out and "-> build" in out and "-> test" in out
+        assert "4 succeeded in" in out
+
+        write_manifest(temp_dir, self.CONTENT.replace('"sleep 0.3; echo built"', '"exit 1"'))
+        assert run_subcommand(["task", "-C", str(temp_dir), "test", "-k"]) == 1
+        out = capsys.readouterr().out
+        assert "exited with code 1" in out
+        assert "dependency 'build' failed" in out
+        assert "2 succeeded, 1 failed, 1 skipped" in out
+
+        write_manifest(temp_dir, self.CONTENT.replace('lint: "true"', 'lint: {command: "exit 1", continue_on_error: true}'))
+        assert run_subcommand(["task", "-C", str(temp_dir), "test"]) == 0
+        assert "3 succeeded, 1 ignored in" in capsys.readouterr().out
@@ -0,0 +1,145 @@
+"""
+Tests for resource usage history in OmniRun.
+
+This module tests:
+- Sparklines and the telemetry ring buffer's statistics
+- The `telemetry:` interval and history settings
+- I/O counters for a process group
+- Sampling services while `up` runs, and the dashboard's usage sparklines
+- `omni-run status --stats` in text and JSON
+"""
+
+import os
+import sys
+import json
+import subprocess
+import pytest
+from pathlib import Path
+
+from conftest import *
+
+
+class TestTelemetryCollector:
+    """Tests for the in-memory usage history."""
+
+    def test_sparkline(self):
+        """Test scaling to the maximum or a ceiling, gaps and the width limit."""
+        from omni_run import sparkline
+
+        assert sparkline([0, 50, 100]) == "▁▅█"
+        assert sparkline([0, 50, None, 100], ceiling=200) == "▁▃ ▅"
+        assert sparkline([0, 0]) == "▁▁"
+        assert sparkline([1, 2, 3, 4, 5, 6, 7, 8, None, 1], width=3) == "█ ▂"
+
+    def test_ring_buffer_and_stats(self):
+        """Test that old samples are dropped and stats cover average, peak, latest and history."""
+        from omni_run import TelemetryCollector
+
+        telemetry = TelemetryCollector(interval=1, history=3)
+        assert telemetry.stats("api") is None
+        for i, (cpu, memory) in enumerate([(90, 900), (10, 100), (20, 200), (30, None)]):
+            telemetry.record("api", {"cpu": cpu, "memory": memory, "read_rate": None}, at=100 + i * 2)
+        assert telemetry.series("api", "cpu") == [10, 20, 30]
+
+        stats = telemetry.stats("api", points=2)
+        assert (stats["samples"], stats["window"]) == (3, 4)
+        assert stats["cpu"] == {"avg": 20.0, "max": 30, "last": 30}
+        assert stats["memory"] == {"avg": 150.0, "max": 200, "last": None}
+        assert stats["read_rate"] is None
+        assert stats["history"] == {"cpu": [20, 30], "memory": [200, None]}
+
+        assert telemetry.due(10) and not telemetry.due(10.5) and telemetry.due(11)
+
+    def test_config(self, temp_dir):
+        """Test the config defaults, the manifest override and invalid intervals."""
+        from omni_run import TelemetryCollector, load_manifest, ManifestError
+
+        default = TelemetryCollector.from_config({"telemetry": {"interval": None, "history": 300}})
+        assert (default.interval, default.history) == (2.0, 300)
+        manifest = load_manifest(write_manifest(temp_dir, "services:\n  api: {command: 'true'}\ntelemetry: {interval: 500ms}\n"))
+        configured = TelemetryCollector.from_config({"telemetry": {"interval": "5s", "history": 60}}, manifest)
+        assert (configured.interval, configured.history) == (0.5, 60)
+        for interval, message in [("soon", "telemetry.interval: Invalid duration"), ("0s", "must be positive")]:
+            with pytest.raises(ManifestError, match=message):
+                TelemetryCollector.from_config({"telemetry": {"interval": interval}})
+
+    @pytest.mark.skipif(not os.path.isdir("/proc"), reason="Needs procfs or psutil")
+    def test_process_io(self, temp_dir):
+        """Test that I/O counters are summed over a service's process group."""
+        from omni_run import read_process_io
+
+        process = subprocess.Popen([sys.executable, "-c", "import time; time.sleep(5)"], start_new_session=True)
+        try:
+            read, written = read_process_io(process.pid)
+            assert read >= 0 and written >= 0
+        finally:
+            process.kill()
+            process.wait()
+        assert read_process_io(process.pid) is None
+
+
+@pytest.mark.skipif(sys.platform == "win32", reason="Uses POSIX process groups")
+class TestUsageHistory:
+    """Tests for sampling while `up` runs."""
+
+    def test_up_samples_services(self, temp_dir, omni_runner):
+        """Test that samples are recorded per interval, I/O rates computed and stats snapshotted."""
+        from omni_run import load_manifest, Orchestrator, Dashboard
+
+        manifest = load_manifest(write_manifest(temp_dir, f"""
+services:
+  busy:
+    command: ["{sys.executable}", "-c", "import time\\nend = time.time() + 1.5\\nwhile time.time() < end: pass"]
+telemetry: {{interval: 200ms}}
+"""))
+        orchestrator = Orchestrator(omni_runner, manifest)
+        assert orchestrator.up() == 0
+        samples = orchestrator.telemetry.samples["busy"]
+        assert len(samples) >= 3
+        assert any((usage.get("cpu") or 0) > 10 for _, usage in samples)
+        assert {"cpu", "memory", "read_rate", "write_rate"} <= set(samples[-1][1])
+
+        stats = orchestrator.snapshot()["services"]["busy"]["stats"]
+        assert stats["samples"] == len(samples) and stats["memory"]["max"] > 0
+        lines = Dashboard(orchestrator, orchestrator.logs).usage_lines(width=10)
+        assert lines[0].startswith("cpu   ") and "(max " in lines[0] and lines[1].startswith("mem   ")
+
+
+class TestStatusStats:
+    """Tests for `omni-run status --stats`."""
+
+    def _sampled(self, temp_dir):
+        from omni_run import write_supervisor_state, SUPERVISOR_PIDFILE
+
+        write_manifest(temp_dir, "services:\n  api: {command: 'true'}\n")
+        state_dir = temp_dir / ".omni-run"
+        state_dir.mkdir()
+        stats = {"samples": 40, "window": 78.0, "cpu": {"avg": 12.5, "max": 80.0, "last": 5.0},
+                 "memory": {"avg": 2048.0, "max": 4096, "last": 4096}, "read_rate": None,
+                 "write_rate": {"avg": 1536.0, "max": 4096, "last": 0}, "history": {"cpu": [0, 50, 100], "memory": []}}
+        write_supervisor_state(state_dir, {"services": {
+            "api": {"state": "running", "pid": 1, "started_at": "2026-01-01T10:00:00", "stats": stats},
+            "worker": {"state": "running", "pid": 2, "started_at": "2026-01-01T10:00:00", "stats": None}}})
+        (state_dir / SUPERVISOR_PIDFILE).write_text(str(os.getpid()))
+
+    def test_stats_table(self, temp_dir, capsys):
+        """Test the stats columns for sampled and unsampled services."""
+        from omni_run import run_subcommand
+
+        self._sampled(temp_dir)
+        assert run_subcommand(["status", "-C", str(temp_dir), "--stats"]) == 0
+        out = capsys.readouterr().out
+        api = next(line for line in out.splitlines() if line.startswith("api") and "12.5%" in line)
+        assert api.split()[1:8] == ["12.5%", "80.0%", "2.0K", "4.0K", "-", "1.5K", "1m18s"]
+        assert api.endswith("▁▅█")
+        assert "no samples" in out
+
+    def test_stats_json(self, temp_dir, capsys):
+        """Test that the JSON status carries the stats field only with --stats."""
+        from omni_run import run_subcommand
+
+        self._sampled(temp_dir)
+        assert run_subcommand(["status", "-C", str(temp_dir), "--output", "json", "--stats"]) == 0
+        assert json.loads(capsys.readouterr().out)["services"]["api"]["stats"]["cpu"]["max"] == 80.0
+        assert run_subcommand(["status", "-C", str(temp_dir), "--output", "json"]) == 0
+        assert "stats" not in json.loads(capsys.readouterr().out)["services"]["api"]
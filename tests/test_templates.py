@@ -0,0 +1,158 @@
+"""
+Tests for manifest template variables in OmniRun.
+
+This module tests:
+- ${env.X}, ${project.root} and ${service.<name>...} references
+- Cross-service port references resolved at launch time
+- Cycle detection and unknown references
+- Templates in health-check URLs
+"""
+
+import sys
+import pytest
+from pathlib import Path
+
+from conftest import *
+
+
+class TestTemplateResolution:
+    """Tests for resolving template references against the orchestrator."""
+
+    def _orchestrator(self, temp_dir, omni_runner, content):
+        from omni_run import load_manifest, Orchestrator
+        return Orchestrator(omni_runner, load_manifest(write_manifest(temp_dir, content)))
+
+    def test_env_and_project_references(self, temp_dir, omni_runner):
+        """Test ${env.X} chains within a service and ${project.root}."""
+        orchestrator = self._orchestrator(temp_dir, omni_runner, """
+services:
+  api:
+    command: "true"
+    env:
+      HOST: localhost
+      BASE_URL: http://${env.HOST}:80
+      DATA: ${project.root}/data
+""")
+        env = orchestrator.resolve_env(orchestrator.manifest.services["api"]).env
+        assert env["BASE_URL"] == "http://localhost:80"
+        assert env["DATA"] == f"{temp_dir.resolve()}/data"
+
+    def test_service_port_reference_reserves_ports(self, temp_dir, omni_runner):
+        """Test that referencing a pending service's port allocates it once, ahead of its start."""
+        orchestrator = self._orchestrator(temp_dir, omni_runner, """
+services:
+  api:
+    command: "true"
+    ports:
+      http: auto
+      admin: auto
+  web:
+    command: ["echo", "${service.api.ports.admin}"]
+    env:
+      API_URL: http://${service.api.host}:${service.api.port}
+""")
+        web = orchestrator.manifest.services["web"]
+        argv, _, env = orchestrator.resolve_launch(web)
+        api = orchestrator.services["api"]
+        assert api.ports_reserved
+        assert env["API_URL"] == f"http://127.0.0.1:{api.ports['http']}"
+        assert argv == ["echo", str(api.ports["admin"])]
+
+    def test_cross_service_env_reference(self, temp_dir, omni_runner):
+        """Test ${service.<name>.env.X}, including the referenced service's own templates."""
+        orchestrator = self._orchestrator(temp_dir, omni_runner, """
+services:
+  db:
+    command: "true"
+    env:
+      NAME: app
+      URL: postgres://localhost/${env.NAME}
+  api:
+    command: "true"
+    env:
+      DATABASE_URL: ${service.db.env.URL}
+""")
+        env = orchestrator.resolve_env(orchestrator.manifest.services["api"]).env
+        assert env["DATABASE_URL"] == "postgres://localhost/app"
+
+    def test_cycle_detected(self, temp_dir, omni_runner):
+        """Test that references leading back to themselves are reported with the cycle."""
+        from omni_run import ManifestError
+
+        orchestrator = self._orchestrator(temp_dir, omni_runner, """
+services:
+  a:
+    command: "true"
+    env:
+      X: ${service.b.env.Y}
+  b:
+    command: "true"
+    env:
+      Y: ${service.a.env.X}
+""")
+        with pytest.raises(ManifestError, match=r"Template cycle: services.a.env.X -> services.b.env.Y -> services.a.env.X"):
+            orchestrator.resolve_env(orchestrator.manifest.services["a"])
+
+    def test_unknown_references(self, temp_dir, omni_runner):
+        """Test errors for unknown services, missing ports and unknown namespaces."""
+        from omni_run import ManifestError
+
+        orchestrator = self._orchestrator(temp_dir, omni_runner, """
+services:
+  a:
+    command: ["echo", "${service.nope.port}"]
+  b:
+    command: ["echo", "${service.a.port}"]
+  c:
+    command: ["echo", "${project.owner}"]
+""")
+        services = orchestrator.manifest.services
+        with pytest.raises(ManifestError, match="unknown service 'nope'"):
+            orchestrator.resolve_launch(services["a"])
+        with pytest.raises(ManifestError, match="service 'a' declares no ports"):
+            orchestrator.resolve_launch(services["b"])
+        with pytest.raises(ManifestError, match=r"unknown template reference \$\{project.owner\}"):
+            orchestrator.resolve_launch(services["c"])
+
+    def test_health_url_template(self, temp_dir, omni_runner):
+        """Test that health-check URLs can reference another service's port."""
+        orchestrator = self._orchestrator(temp_dir, omni_runner, """
+services:
+  api:
+    command: "true"
+    ports:
+      http: auto
+  web:
+    command: "true"
+    health: http://127.0.0.1:${service.api.port}/health
+""")
+        probe = orchestrator.templates.render_probe(orchestrator.manifest.services["web"].health, "web", {})
+        assert probe.url == f"http://127.0.0.1:{orchestrator.services['api'].ports['http']}/health"
+
+
+class TestTemplatedServices:
+    """Tests for services that reference each other at launch."""
+
+    def test_dependent_sees_dependency_port(self, temp_dir, omni_runner, capsys):
+        """Test that a service reads the port allocated to the service it depends on."""
+        from omni_run import load_manifest, Orchestrator
+
+        manifest = load_manifest(write_manifest(temp_dir, f"""
+services:
+  api:
+    command: ["{sys.executable}", "-c", "import os; print('api on', os.environ['PORT'])"]
+    ports:
+      http: auto
+  web:
+    command: ["{sys.executable}", "-c", "import os; print('web calls', os.environ['API_URL'])"]
+    depends_on: api
+    env:
+      API_URL: http://localhost:${{service.api.port}}
+"""))
+        orchestrator = Orchestrator(omni_runner, manifest)
+
+        assert orchestrator.up() == 0
+        port = orchestrator.services["api"].ports["http"]
+        out = capsys.readouterr().out
+        assert f"api on {port}" in out
+        assert f"web calls http://localhost:{port}" in out
@@ -0,0 +1,280 @@
+"""
+Tests for local HTTPS certificates in OmniRun.
+
+This module tests:
+- Creating the local CA and issuing certificates signed by it
+- Reusing certificates, and reissuing them for new hostnames, a new CA or near expiry
+- Trust store commands per OS
+- Service `tls:` certificates and the variables pointing at them
+- The proxy serving HTTPS that verifies against the local CA
+- The `omni-run tls` subcommand
+"""
+
+import sys
+import ssl
+import json
+import shutil
+import socket
+import threading
+import pytest
+from pathlib import Path
+
+from conftest import *
+
+pytestmark = pytest.mark.skipif(not shutil.which("openssl"), reason="Needs openssl to generate certificates")
+
+
+def https_get(port: int, host: str, cafile: Path):
+    """GET / from 127.0.0.1, verifying the certificate for `host` against only `cafile`."""
+    import http.client
+
+    context = ssl.create_default_context(cafile=str(cafile))
+    conn = http.client.HTTPSConnection(host, port, timeout=10, context=context)
+    conn.sock = context.wrap_socket(socket.create_connection(("127.0.0.1", port), timeout=10), server_hostname=host)
+    conn.request("GET", "/")
+    response = conn.getresponse()
+    data = response.read()
+    conn.close()
+    return response.status, data
+
+
+@pytest.fixture
+def proto_upstream():
+    """An HTTP server answering with the X-Forwarded-Proto it was sent; yields its port."""
+    from http.server import BaseHTTPRequestHandler, HTTPServer
+
+    class Handler(BaseHTTPRequestHandler):
+        def do_GET(self):
+            body = json.dumps({"proto": self.headers["X-Forwarded-Proto"]}).encode()
+            self.send_response(200)
+            self.send_header("Content-Length", str(len(body)))
+            self.end_headers()
+            self.wfile.write(body)
+
+        def log_message(self, *args):
+            pass
+
+    upstream = HTTPServer(("127.0.0.1", 0), Handler)
+    threading.Thread(target=upstream.serve_forever, daemon=True).start()
+    yield upstream.server_port
+    upstream.shutdown()
+    upstream.server_close()
+
+
+class TestLocalCA:
+    """Tests for the local certificate authority."""
+
+    def test_issue_and_reuse(self, temp_dir):
+        """Test that issued certificates verify against the CA and are reused while current."""
+        from omni_run import LocalCA
+
+        ca = LocalCA(temp_dir / "ca")
+        assert not ca.exists()
+        cert, key = ca.issue(temp_dir / "certs", "api", ["localhost", "api.localhost"])
+        assert ca.exists() and (cert.name, key.name) == ("api-cert.pem", "api-key.pem")
+        assert (temp_dir / "certs" / "api-cert.hosts").read_text().split() == ["api.localhost", "localhost"]
+        if sys.platform != "win32":
+            assert (key.stat().st_mode & 0o777, ca.key.stat().st_mode & 0o777) == (0o600, 0o600)
+
+        context = ssl.create_default_context(cafile=str(ca.cert))
+        context.load_cert_chain(str(cert), str(key))
+        assert "omni-run development CA" in ca.describe()["subject"]
+
+        mtime = cert.stat().st_mtime_ns
+        ca.issue(temp_dir / "certs", "api", ["api.localhost", "localhost"])
+        assert cert.stat().st_mtime_ns == mtime
+        ca.issue(temp_dir / "certs", "api", ["api.localhost", "localhost", "admin.localhost"])
+        assert "admin.localhost" in (temp_dir / "certs" / "api-cert.hosts").read_text()
+
+    def test_renewal(self, temp_dir):
+        """Test that certificates are reissued when the CA changes or they are close to expiry."""
+        from omni_run import LocalCA
+
+        ca = LocalCA(temp_dir / "ca")
+        cert, _ = ca.issue(temp_dir, "web", ["localhost"])
+        shutil.rmtree(temp_dir / "ca")
+        other = LocalCA(temp_dir / "ca")
+        assert not other.is_current(cert, ["localhost"])
+        other.issue(temp_dir, "web", ["localhost"])
+        assert other.is_current(cert, ["localhost"])
+
+        short = LocalCA(temp_dir / "ca", days=7)
+        short.issue(temp_dir, "web", ["web.localhost"])
+        assert not short.is_current(cert, ["web.localhost"])
+
+    def test_trust_commands(self, temp_dir, monkeypatch):
+        """Test the commands that install the CA on macOS and remove it on Windows."""
+        import omni_run
+        from omni_run import ca_trust_commands
+
+        cert = temp_dir / "rootCA.pem"
+        monkeypatch.setattr(omni_run.os, "geteuid", lambda: 0, raising=False)
+        assert ca_trust_commands(cert, system="Darwin") == [[
+            "security", "add-trusted-cert", "-d", "-r", "trustRoot", "-k", "/Library/Keychains/System.keychain", str(cert)]]
+        assert ca_trust_commands(cert, install=False, system="Windows") == [
+            ["certutil", "-delstore", "-user", "Root", "omni-run development CA"]]
+
+    def _linux(self, temp_dir, monkeypatch, *tools):
+        import omni_run
+
+        monkeypatch.setattr(omni_run.os, "geteuid", lambda: 0, raising=False)
+        monkeypatch.setattr(omni_run.Path, "home", lambda: temp_dir)
+        monkeypatch.setattr(omni_run.shutil, "which", lambda name: f"/usr/bin/{name}" if name in tools else None)
+        return temp_dir / "rootCA.pem"
+
+    def test_linux_trust_store(self, temp_dir, monkeypatch):
+        """Test copying the CA into a Debian-style trust store."""
+        from omni_run import ca_trust_commands
+
+        cert = self._linux(temp_dir, monkeypatch, "update-ca-certificates")
+        assert ca_trust_commands(cert, system="Linux") == [
+            ["cp", str(cert), "/usr/local/share/ca-certificates/omni-run-ca.crt"], ["update-ca-certificates"]]
+
+    def test_linux_nss_database(self, temp_dir, monkeypatch):
+        """Test removing the CA from the user's NSS database as well."""
+        from omni_run import ca_trust_commands
+
+        cert = self._linux(temp_dir, monkeypatch, "update-ca-certificates", "certutil")
+        (temp_dir / ".pki" / "nssdb").mkdir(parents=True)
+        assert ca_trust_commands(cert, install=False, system="Linux")[-1] == [
+            "certutil", "-d", f"sql:{temp_dir / '.pki' / 'nssdb'}", "-D", "-n", "omni-run development CA"]
+
+    def test_linux_without_tools(self, temp_dir, monkeypatch):
+        """Test that nothing is run on a Linux without trust store tools."""
+        from omni_run import ca_trust_commands
+
+        assert ca_trust_commands(self._linux(temp_dir, monkeypatch), system="Linux") == []
+
+@pytest.mark.skipif(sys.platform == "win32", reason="Uses POSIX shell commands")
+class TestServiceTLS:
+    """Tests for service `tls:` certificates."""
+
+    def test_parse_service_tls(self, temp_dir):
+        """Test the default hostnames, explicit lists and invalid values."""
+        from omni_run import load_manifest, ManifestError
+
+        manifest = load_manifest(write_manifest(temp_dir, """
+services:
+  api: {command: 'true', tls: true}
+  web: {command: 'true', tls: [app.localhost, "*.app.localhost"]}
+  worker: {command: 'true'}
+"""))
+        assert manifest.services["api"].tls == ["api.localhost", "localhost"]
+        assert manifest.services["web"].tls == ["app.localhost", "*.app.localhost"]
+        assert manifest.services["worker"].tls == []
+
+        write_manifest(temp_dir, "services:\n  api: {command: 'true', tls: []}\n")
+        with pytest.raises(ManifestError, match="services.api.tls: expected true or a list of hostnames"):
+            load_manifest(temp_dir / "omni-run.yaml")
+
+    def test_service_gets_certificate(self, temp_dir, omni_runner, capsys):
+        """Test that a service is started with a fresh certificate and the variables naming it."""
+        from omni_run import load_manifest, Orchestrator
+
+        omni_runner.config["tls"] = {"ca_dir": str(temp_dir / "ca")}
+        orchestrator = Orchestrator(omni_runner, load_manifest(write_manifest(temp_dir, """
+services:
+  api:
+    command: echo "cert=$TLS_CERT_FILE key=$TLS_KEY_FILE ca=$TLS_CA_FILE node=$NODE_EXTRA_CA_CERTS"
+    tls: true
+""")))
+        assert orchestrator.up() == 0
+        directory = temp_dir / ".omni-run" / "tls"
+        ca = temp_dir / "ca" / "rootCA.pem"
+        assert f"cert={directory / 'api-cert.pem'} key={directory / 'api-key.pem'} ca={ca} node={ca}" in capsys.readouterr().out
+        assert (directory / "api-cert.hosts").read_text().split() == ["api.localhost", "localhost"]
+
+
+@pytest.mark.skipif(sys.platform == "win32", reason="Uses POSIX process groups")
+class TestProxyTLS:
+    """Tests for the proxy's certificate from the local CA."""
+
+    def test_proxy_verifies_against_local_ca(self, temp_dir, omni_runner, proto_upstream):
+        """Test that tls: true serves a certificate for the route hosts a client trusting only the CA accepts."""
+        from omni_run import load_manifest, Orchestrator, ReverseProxy
+
+        omni_runner.config["tls"] = {"ca_dir": str(temp_dir / "ca")}
+        orchestrator = Orchestrator(omni_runner, load_manifest(write_manifest(temp_dir, """
+services:
+  api: {command: 'true', ports: auto}
+proxy:
+  address: 127.0.0.1:0
+  tls: true
+  routes:
+    api.localhost: api
+""")))
+        api = orchestrator.services["api"]
+        api.ports = {"http": proto_upstream}
+        api.is_alive = lambda: True
+        proxy = ReverseProxy.from_config(orchestrator)
+        proxy.start()
+        try:
+            status, body = https_get(proxy.port, "api.localhost", temp_dir / "ca" / "rootCA.pem")
+            assert status == 200 and json.loads(body) == {"proto": "https"}
+        finally:
+            proxy.stop()
+        hosts = (temp_dir / ".omni-run" / "proxy" / "proxy-cert.hosts").read_text().split()
+        assert hosts == ["api.localhost", "localhost"]
+
+    def test_invalid_tls_value(self, temp_dir, omni_runner):
+        """Test that an unknown tls string is rejected."""
+        from omni_run import load_manifest, Orchestrator, ReverseProxy, ManifestError
+
+        orchestrator = Orchestrator(omni_runner, load_manifest(write_manifest(temp_dir, """
+services:
+  api: {command: 'true', ports: auto}
+proxy:
+  tls: acme
+  routes: {api.localhost: api}
+""")))
+        with pytest.raises(ManifestError, match="proxy.tls: expected true, self-signed or a mapping"):
+            ReverseProxy.from_config(orchestrator)
+
+
+class TestTLSCommand:
+    """Tests for the `omni-run tls` subcommand."""
+
+    def test_status_without_ca(self, temp_dir, capsys, monkeypatch):
+        """Test status before the CA exists."""
+        from omni_run import run_subcommand
+
+        monkeypatch.setenv("OMNI_RUN_CAROOT", str(temp_dir / "ca"))
+        assert run_subcommand(["tls", "-C", str(temp_dir)]) == 0
+        assert "No local CA yet at" in capsys.readouterr().out
+
+    def test_cert(self, temp_dir, capsys, monkeypatch):
+        """Test issuing a certificate for wildcard and plain hostnames into --dir."""
+        from omni_run import run_subcommand
+
+        monkeypatch.setenv("OMNI_RUN_CAROOT", str(temp_dir / "ca"))
+        assert run_subcommand(["tls", "cert", "*.app.localhost", "app.localhost", "-C", str(temp_dir), "--dir", "certs"]) == 0
+        assert "Certificate for *.app.localhost, app.localhost" in capsys.readouterr().out
+        assert (temp_dir / "certs" / "wildcard.app.localhost-cert.pem").exists()
+
+    def test_cert_needs_hostname(self, temp_dir, capsys, monkeypatch):
+        """Test that `tls cert` without a hostname is a usage error."""
+        from omni_run import run_subcommand
+
+        monkeypatch.setenv("OMNI_RUN_CAROOT", str(temp_dir / "ca"))
+        assert run_subcommand(["tls", "cert", "-C", str(temp_dir)]) == 2
+        assert "name at least one hostname" in capsys.readouterr().out
+
+    def test_status(self, temp_dir, capsys, monkeypatch):
+        """Test status naming the CA and its fingerprint once it exists."""
+        from omni_run import run_subcommand, LocalCA
+
+        monkeypatch.setenv("OMNI_RUN_CAROOT", str(temp_dir / "ca"))
+        LocalCA(temp_dir / "ca").issue(temp_dir, "web", ["localhost"])
+        assert run_subcommand(["tls", "-C", str(temp_dir)]) == 0
+        out = capsys.readouterr().out
+        assert "CN = omni-run development CA" in out and "Fingerprint:" in out
+
+    def test_install_dry_run(self, temp_dir, capsys, monkeypatch):
+        """Test that a dry-run install prints the trust store command."""
+        import omni_run
+        from omni_run import run_subcommand
+
+        monkeypatch.setenv("OMNI_RUN_CAROOT", str(temp_dir / "ca"))
+        monkeypatch.setattr(omni_run.platform, "system", lambda: "Darwin")
+        assert run_subcommand(["tls", "install", "--dry-run", "-C", str(temp_dir)]) == 0
+        assert "security add-trusted-cert" in capsys.readouterr().out
@@ -0,0 +1,212 @@
+"""
+Tests for `omni-run up --tmux` in OmniRun.
+
+This module tests:
+- The tmux session: one titled pane per service attached to it, in start order or `tmux.order`
+- Layouts from --tmux-layout and `tmux.layout`, and invalid ones
+- Reusing the session of a running supervisor, and replacing one left over from a stopped one
+- A real tmux session following real services
+"""
+
+import os
+import sys
+import json
+import time
+import shutil
+import subprocess
+import pytest
+from pathlib import Path
+
+from conftest import *
+
+
+# Logs each call, prints a new pane id for -P, and keeps the sessions it has in a file
+FAKE_TMUX = """\
+import json, os, sys
+args = sys.argv[1:]
+state = os.environ["FAKE_TMUX_LOG"] + ".sessions"
+sessions = open(state).read().split() if os.path.exists(state) else []
+with open(os.environ["FAKE_TMUX_LOG"], "a") as log:
+    log.write(json.dumps(args) + "\\n")
+if args[0] == "has-session":
+    sys.exit(0 if args[2].lstrip("=") in sessions else 1)
+if args[0] == "new-session":
+    sessions.append(args[args.index("-s") + 1])
+if args[0] == "kill-session":
+    sessions.remove(args[2].lstrip("="))
+open(state, "w").write(" ".join(sessions))
+if "-P" in args:
+    print("%" + str(sum(1 for _ in open(os.environ["FAKE_TMUX_LOG"]))))
+"""
+
+
+@pytest.fixture
+def fake_tmux(temp_dir, monkeypatch):
+    """A `tmux` on PATH; returns a function giving the calls made so far."""
+    bin_dir, log = temp_dir / "bin", temp_dir / "tmux.log"
+    bin_dir.mkdir()
+    tmux = bin_dir / "tmux"
+    tmux.write_text(f"#!{sys.executable}\n" + FAKE_TMUX)
+    tmux.chmod(0o755)
+    monkeypatch.setenv("PATH", f"{bin_dir}{os.pathsep}{os.environ['PATH']}")
+    monkeypatch.setenv("FAKE_TMUX_LOG", str(log))
+    return lambda: [json.loads(line) for line in log.read_text().splitlines()] if log.exists() else []
+
+
+@pytest.fixture
+def tmux_up(temp_dir, monkeypatch):
+    """`up --tmux` on a tmux server of its own; yields panes() giving each pane's output by title."""
+    from omni_run import run_subcommand
+
+    monkeypatch.setenv("TMUX_TMPDIR", str(temp_dir))  # A tmux server of its own
+    monkeypatch.delenv("TMUX", raising=False)
+    write_manifest(temp_dir, f"""
+services:
+  api:
+    command: ["{sys.executable}", "-u", "-c", "import time; print('api says hi'); time.sleep(60)"]
+  web:
+    command: ["{sys.executable}", "-u", "-c", "import time; print('web says hi'); time.sleep(60)"]
+""")
+    session = f"omni-run-{temp_dir.resolve().name}".replace(".", "-")
+
+    def panes():
+        listing = subprocess.run(["tmux", "list-panes", "-t", session, "-F", "#{pane_id} #{pane_title}"],
+                                 capture_output=True, text=True).stdout.split()
+        return {title: subprocess.run(["tmux", "capture-pane", "-p", "-t", pane], capture_output=True,
+                                      text=True).stdout for pane, title in zip(listing[::2], listing[1::2])}
+
+    try:
+        assert run_subcommand(["up", "-C", str(temp_dir), "--tmux", "--skip-install", "--no-reload"]) == 0
+        yield panes
+    finally:
+        run_subcommand(["stop", "-C", str(temp_dir)])
+        subprocess.run(["tmux", "kill-server"], capture_output=True)
+
+
+@pytest.mark.skipif(sys.platform == "win32", reason="tmux is POSIX-only")
+class TestTmuxSession:
+    """Tests for the session `up --tmux` builds."""
+
+    def _stack(self, temp_dir, monkeypatch):
+        import omni_run
+
+        supervisor = {"pid": None}
+        monkeypatch.setattr(omni_run, "read_supervisor_pid", lambda state_dir: supervisor["pid"])
+
+        def spawn(launcher, manifest, args):
+            supervisor["pid"] = 4242
+            return 4242
+        monkeypatch.setattr(omni_run, "spawn_supervisor", spawn)
+        write_manifest(temp_dir, """
+services:
+  db: {command: ./db}
+  api: {command: ./api, depends_on: [db]}
+  web: {command: ./web, depends_on: [api]}
+""")
+        return supervisor
+
+    def _up(self, temp_dir, fake_tmux, monkeypatch):
+        from omni_run import run_subcommand
+
+        supervisor = self._stack(temp_dir, monkeypatch)
+        assert run_subcommand(["up", "-C", str(temp_dir), "--tmux", "--tmux-layout", "main-vertical"]) == 0
+        return supervisor, f"omni-run-{temp_dir.resolve().name}".replace(".", "-"), fake_tmux()
+
+    def test_started(self, temp_dir, fake_tmux, monkeypatch, capsys):
+        """Test that the supervisor is started and how to attach is shown."""
+        _, session, _ = self._up(temp_dir, fake_tmux, monkeypatch)
+        out = capsys.readouterr().out
+        assert "supervisor pid 4242" in out and f"Attach with `tmux attach -t {session}`" in out
+
+    def test_panes(self, temp_dir, fake_tmux, monkeypatch):
+        """Test one pane per service in start order, each attached to its service of the stack."""
+        _, session, calls = self._up(temp_dir, fake_tmux, monkeypatch)
+        created = [c for c in calls if c[0] in ("new-session", "split-window")]
+        assert created[0][created[0].index("-s") + 1] == session and [c[0] for c in created].count("split-window") == 2
+        commands = [c[-1].split() for c in created]
+        assert [c[c.index("attach") + 1] for c in commands] == ["db", "api", "web"]
+        assert all(["-C", str(temp_dir)] == c[c.index("-C"):c.index("-C") + 2] for c in commands)
+
+    def test_titles_and_layout(self, temp_dir, fake_tmux, monkeypatch):
+        """Test the pane titles, panes kept when their command exits, and the layout."""
+        _, session, calls = self._up(temp_dir, fake_tmux, monkeypatch)
+        assert [c[-1] for c in calls if c[0] == "select-pane" and "-T" in c] == ["db", "api", "web"]
+        assert ["set-option", "-w", "-t", session, "remain-on-exit", "on"] in calls
+        assert [c for c in calls if c[0] == "select-layout"][-1] == ["select-layout", "-t", session, "main-vertical"]
+
+    def test_reused(self, temp_dir, fake_tmux, monkeypatch, capsys):
+        """Test that the session of a running supervisor is reused as it is."""
+        from omni_run import run_subcommand
+
+        _, session, calls = self._up(temp_dir, fake_tmux, monkeypatch)
+        assert run_subcommand(["up", "-C", str(temp_dir), "--tmux"]) == 0
+        assert f"reusing tmux session {session}" in capsys.readouterr().out
+        assert len(fake_tmux()) == len(calls) + 1
+
+    def test_left_over_replaced(self, temp_dir, fake_tmux, monkeypatch):
+        """Test that a session left from a stopped supervisor is replaced, with `tmux:` from the config."""
+        from omni_run import run_subcommand
+
+        supervisor, _, before = self._up(temp_dir, fake_tmux, monkeypatch)
+        supervisor["pid"] = None
+        config = temp_dir / "config.yaml"
+        config.write_text("tmux: {layout: even-vertical, session: shop.dev, order: [web, nope]}\n")
+        assert run_subcommand(["up", "-C", str(temp_dir), "--tmux", "--config", str(config)]) == 0
+        calls = fake_tmux()[len(before):]
+        created = [c[-1].split() for c in calls if c[0] in ("new-session", "split-window")]
+        assert [c[c.index("attach") + 1] for c in created] == ["web", "db", "api"]
+        assert calls[1][0] == "new-session" and "shop-dev" in calls[1]
+        assert calls[-2] == ["select-layout", "-t", "shop-dev", "even-vertical"]
+
+    def _api(self, temp_dir, monkeypatch):
+        import omni_run
+
+        monkeypatch.setattr(omni_run, "spawn_supervisor", lambda launcher, manifest, args: 4242)
+        write_manifest(temp_dir, "services:\n  api: {command: ./api}\n")
+
+    def test_invalid_layout(self, temp_dir, fake_tmux, monkeypatch, capsys):
+        """Test that an unknown layout name is rejected before tmux is run."""
+        from omni_run import run_subcommand
+
+        self._api(temp_dir, monkeypatch)
+        assert run_subcommand(["up", "-C", str(temp_dir), "--tmux", "--tmux-layout", "grid"]) == 1
+        assert "tmux layout 'grid': expected one of tiled, even-horizontal" in capsys.readouterr().out
+        assert fake_tmux() == []
+
+    def test_custom_layout(self, temp_dir, fake_tmux, monkeypatch):
+        """Test that a layout string from tmux is passed on."""
+        from omni_run import run_subcommand
+
+        self._api(temp_dir, monkeypatch)
+        custom = "b25f,200x50,0,0{100x50,0,0,1,99x50,101,0,2}"
+        assert run_subcommand(["up", "-C", str(temp_dir), "--tmux", "--tmux-layout", custom]) == 0
+        assert fake_tmux()[-2] == ["select-layout", "-t", f"omni-run-{temp_dir.resolve().name}".replace(".", "-"),
+                                   custom]
+
+    def test_no_tmux(self, temp_dir, monkeypatch, capsys):
+        """Test tmux missing from PATH."""
+        from omni_run import run_subcommand
+
+        self._api(temp_dir, monkeypatch)
+        monkeypatch.setenv("PATH", str(temp_dir / "empty"))
+        assert run_subcommand(["up", "-C", str(temp_dir), "--tmux"]) == 1
+        assert "--tmux needs tmux on PATH" in capsys.readouterr().out
+
+
+@pytest.mark.skipif(sys.platform == "win32" or shutil.which("tmux") is None, reason="Needs tmux")
+class TestTmuxRun:
+    """Tests for a real tmux session."""
+
+    def test_pane_output(self, tmux_up):
+        """Test that each pane shows its service's output."""
+        deadline = time.time() + 30
+        while time.time() < deadline and not all(f"{n} says hi" in tmux_up().get(n, "") for n in ("api", "web")):
+            time.sleep(0.2)
+        assert all(f"{n} says hi" in tmux_up().get(n, "") for n in ("api", "web"))
+
+    def test_panes_stay(self, temp_dir, tmux_up):
+        """Test that the panes stay after `omni-run stop`."""
+        from omni_run import run_subcommand
+
+        run_subcommand(["stop", "-C", str(temp_dir)])
+        assert sorted(tmux_up()) == ["api", "web"]
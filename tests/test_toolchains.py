@@ -0,0 +1,365 @@
+"""
+Tests for runtime version-manager integration in OmniRun.
+
+This module tests:
+- Version pins from .tool-versions, .nvmrc, .python-version and go.mod
+- Version matching and command-to-runtime mapping
+- Resolving installs from PATH, nvm/pyenv/asdf directories and Go toolchain switching
+- Missing-version errors and pinned toolchains for orchestrated services
+- Downloading Node and Go releases with checksum verification, isolation and the `toolchain` subcommand
+"""
+
+import os
+import io
+import sys
+import json
+import hashlib
+import tarfile
+import threading
+import pytest
+from pathlib import Path
+
+from conftest import *
+
+def fake_tool(bin_dir: Path, name: str, output: str) -> Path:
+    bin_dir.mkdir(parents=True, exist_ok=True)
+    tool = bin_dir / name
+    tool.write_text(f"#!/bin/sh\necho '{output}'\n")
+    tool.chmod(0o755)
+    return tool
+
+
+def fake_env(temp_dir: Path) -> dict:
+    return {"HOME": str(temp_dir / "home"), "PATH": f"{temp_dir / 'bin'}:/usr/bin:/bin"}
+
+
+def release_archive(top: str, runtime: str, version: str) -> bytes:
+    """A .tar.gz laid out like an official release, with a bin/<runtime> script printing the version."""
+    buffer = io.BytesIO()
+    with tarfile.open(fileobj=buffer, mode="w:gz") as archive:
+        script = f"#!/bin/sh\necho '{'v' if runtime == 'node' else 'go version go'}{version}'\n".encode()
+        info = tarfile.TarInfo(f"{top}/bin/{runtime}")
+        info.size, info.mode = len(script), 0o755
+        archive.addfile(info, io.BytesIO(script))
+    return buffer.getvalue()
+
+
+class ReleaseServer:
+    """A local mirror serving Node and Go release indexes, checksums and archives."""
+
+    def __init__(self, corrupt: bool = False):
+        from http.server import BaseHTTPRequestHandler, HTTPServer
+        from omni_run import toolchain_platform
+
+        node, go = toolchain_platform("node"), toolchain_platform("go")
+        files = self.files = {"/node/index.json": json.dumps(
+            [{"version": f"v{v}", "files": [node]} for v in ("21.0.0", "20.11.1", "20.1.0")]).encode()}
+        sums = []
+        for version in ("20.11.1", "20.1.0"):
+            name = f"node-v{version}-{node}.tar.gz"
+            files[f"/node/v{version}/{name}"] = release_archive(f"node-v{version}-{node}", "node", version)
+            sums.append(f"{hashlib.sha256(files[f'/node/v{version}/{name}']).hexdigest()}  {name}")
+            files[f"/node/v{version}/SHASUMS256.txt"] = "\n".join(sums).encode()
+        releases = []
+        for version in ("1.23.0", "1.22.5", "1.22.0"):
+            name = f"go{version}.{go}.tar.gz"
+            files[f"/go/{name}"] = release_archive("go", "go", version)
+            digest = "0" * 64 if corrupt else hashlib.sha256(files[f"/go/{name}"]).hexdigest()
+            os_name, arch = go.split("-")
+            releases.append({"version": f"go{version}", "stable": True, "files": [
+                {"filename": name, "os": os_name, "arch": arch, "kind": "archive", "sha256": digest}]})
+        files["/go/"] = json.dumps(releases).encode()
+        requests = self.requests = []
+
+        class Handler(BaseHTTPRequestHandler):
+            def do_GET(self):
+                path = self.path.split("?")[0]
+                requests.append(path)
+                body = files.get(path)
+                self.send_response(200 if body is not None else 404)
+                self.end_headers()
+                self.wfile.write(body or b"")
+
+            def log_message(self, *args):
+                pass
+
+        self.server = HTTPServer(("127.0.0.1", 0), Handler)
+        url = f"http://127.0.0.1:{self.server.server_port}"
+        self.mirrors = {"node": f"{url}/node", "go": f"{url}/go"}
+        threading.Thread(target=self.server.serve_forever, daemon=True).start()
+
+    def close(self):
+        self.server.shutdown()
+        self.server.server_close()
+
+
+@pytest.fixture
+def releases():
+    server = ReleaseServer()
+    yield server
+    server.close()
+
+
+class TestVersionPins:
+    """Tests for finding and matching version pins."""
+
+    def test_pins_from_files(self, temp_dir):
+        """Test each pin file, the nearest one winning per runtime."""
+        from omni_run import find_version_pins
+
+        app = temp_dir / "apps" / "web"
+        app.mkdir(parents=True)
+        (temp_dir / ".tool-versions").write_text("nodejs 18.19.0\npython 3.11.7  # team default\nterraform 1.5.0\n")
+        (app / ".nvmrc").write_text("v20.11.1\n")
+        (app / "go.mod").write_text("module web\n\ngo 1.22\n")
+
+        pins = find_version_pins(app)
+        assert pins["node"].version == "20.11.1"
+        assert pins["node"].source == app.resolve() / ".nvmrc"
+        assert pins["python"].version == "3.11.7"
+        assert pins["go"].version == "1.22" and pins["go"].minimum
+        assert set(pins) == {"node", "python", "go"}
+
+    def test_go_toolchain_line_and_aliases(self, temp_dir):
+        """Test that go.mod toolchain lines win and aliases like lts/* are left to the manager."""
+        from omni_run import find_version_pins
+
+        (temp_dir / "go.mod").write_text("module x\n\ngo 1.21\ntoolchain go1.22.3\n")
+        (temp_dir / ".nvmrc").write_text("lts/iron\n")
+        (temp_dir / ".python-version").write_text("system\n")
+
+        pins = find_version_pins(temp_dir)
+        assert pins["go"].version == "1.22.3"
+        assert "node" not in pins and "python" not in pins
+
+    def test_version_satisfies(self):
+        """Test prefix matching and go.mod minimums."""
+        from pathlib import Path
+        from omni_run import ToolchainPin, version_satisfies
+
+        pin = ToolchainPin("node", "20", Path(".nvmrc"))
+        assert version_satisfies(pin, "v20.11.1")
+        assert not version_satisfies(pin, "v2.0.0")
+        assert not version_satisfies(pin, "v18.19.0")
+        minimum = ToolchainPin("go", "1.22", Path("go.mod"), minimum=True)
+        assert version_satisfies(minimum, "go version go1.23.0 linux/amd64")
+        assert not version_satisfies(minimum, "go1.21.9")
+
+    def test_command_runtime(self):
+        """Test mapping service commands to the runtime they launch."""
+        from omni_run import command_runtime
+
+        assert command_runtime("npm run dev") == "node"
+        assert command_runtime(["/usr/bin/python3.12", "app.py"]) == "python"
+        assert command_runtime("go run .") == "go"
+        assert command_runtime("./server --port 80") is None
+
+
+@pytest.mark.skipif(sys.platform == "win32", reason="Fake toolchains are shell scripts")
+class TestToolchainResolver:
+    """Tests for resolving pinned versions to installed toolchains."""
+
+    def test_path_toolchain_is_used_when_it_matches(self, temp_dir):
+        """Test that nothing changes when PATH (or a shim) already provides the version."""
+        from omni_run import ToolchainResolver
+
+        fake_tool(temp_dir / "bin", "node", "v20.11.1")
+        (temp_dir / ".nvmrc").write_text("20\n")
+
+        resolver = ToolchainResolver(env=fake_env(temp_dir))
+        assert [t.manager for t in resolver.resolve(temp_dir)] == ["path"]
+        assert resolver.environment(temp_dir) == {}
+
+    def test_prefers_newest_matching_manager_install(self, temp_dir):
+        """Test that the newest matching nvm install is put first on PATH."""
+        from omni_run import ToolchainResolver
+
+        fake_tool(temp_dir / "bin", "node", "v18.19.0")
+        versions = temp_dir / "home" / ".nvm" / "versions" / "node"
+        for version in ("v20.1.0", "v20.11.1", "v21.0.0"):
+            fake_tool(versions / version / "bin", "node", version)
+        (temp_dir / ".nvmrc").write_text("20\n")
+
+        resolver = ToolchainResolver(env=fake_env(temp_dir))
+        toolchain = resolver.resolve(temp_dir, strict=["node"])[0]
+        assert (toolchain.manager, toolchain.version) == ("nvm", "20.11.1")
+        path = resolver.environment(temp_dir)["PATH"].split(os.pathsep)
+        assert path[0] == str(versions / "v20.11.1" / "bin")
+        assert path[1] == str(temp_dir / "bin")
+
+    def test_asdf_and_pyenv_layouts(self, temp_dir):
+        """Test asdf installs (with Go's nested bin) and pyenv versions."""
+        from omni_run import ToolchainResolver
+
+        home = temp_dir / "home"
+        fake_tool(home / ".asdf" / "installs" / "golang" / "1.22.3" / "go" / "bin", "go", "go1.22.3")
+        fake_tool(home / ".pyenv" / "versions" / "3.12.1" / "bin", "python3", "Python 3.12.1")
+        (temp_dir / ".tool-versions").write_text("golang 1.22.3\npython 3.12\n")
+
+        env = fake_env(temp_dir)
+        env["GOTOOLCHAIN"] = "local"
+        found = {t.pin.runtime: t for t in ToolchainResolver(env=env).resolve(temp_dir)}
+        assert found["go"].manager == "asdf"
+        assert found["go"].bin_dir == home / ".asdf" / "installs" / "golang" / "1.22.3" / "go" / "bin"
+        assert (found["python"].manager, found["python"].version) == ("pyenv", "3.12.1")
+
+    def test_missing_version_errors_when_strict(self, temp_dir):
+        """Test the error for a missing runtime the service launches, and leniency for the others."""
+        from omni_run import ToolchainResolver, ToolchainError
+
+        fake_tool(temp_dir / "bin", "python3", "Python 3.11.7")
+        (temp_dir / ".python-version").write_text("3.9.18\n")
+
+        resolver = ToolchainResolver(env=fake_env(temp_dir))
+        assert resolver.resolve(temp_dir) == []
+        with pytest.raises(ToolchainError) as e:
+            resolver.resolve(temp_dir, strict=["python"])
+        message = str(e.value)
+        assert ".python-version: requires python 3.9.18, but it is not installed" in message
+        assert "python on PATH is 3.11.7" in message
+        assert "`pyenv install 3.9.18`" in message
+
+    def test_go_downloads_its_own_toolchain(self, temp_dir):
+        """Test that a go.mod pin is left to Go 1.21+ toolchain switching."""
+        from omni_run import ToolchainResolver
+
+        fake_tool(temp_dir / "bin", "go", "go version go1.21.5 linux/amd64")
+        (temp_dir / "go.mod").write_text("module x\n\ngo 1.23\n")
+
+        resolver = ToolchainResolver(env=fake_env(temp_dir))
+        assert [t.manager for t in resolver.resolve(temp_dir, strict=["go"])] == ["go"]
+        with pytest.raises(Exception, match="requires go 1.23 or later"):
+            ToolchainResolver(env=dict(fake_env(temp_dir), GOTOOLCHAIN="local")).resolve(temp_dir, strict=["go"])
+
+    def test_disabled(self, temp_dir):
+        """Test that toolchains.enabled: false ignores pins."""
+        from omni_run import ToolchainResolver
+
+        (temp_dir / ".nvmrc").write_text("4\n")
+        resolver = ToolchainResolver.from_config({"toolchains": {"enabled": False}})
+        assert resolver.resolve(temp_dir, strict=["node"]) == []
+
+
+@pytest.mark.skipif(sys.platform == "win32", reason="Fake toolchains are shell scripts")
+class TestServiceToolchains:
+    """Tests for pinned toolchains in orchestrated services."""
+
+    def test_service_runs_on_pinned_version(self, temp_dir, omni_runner, capsys):
+        """Test that a service command finds the pinned interpreter first on PATH."""
+        from omni_run import load_manifest, Orchestrator, ToolchainResolver
+
+        fake_tool(temp_dir / "bin", "python3", "Python 3.11.7")
+        fake_tool(temp_dir / "home" / ".pyenv" / "versions" / "3.9.18" / "bin", "python3", "Python 3.9.18")
+        (temp_dir / "api").mkdir()
+        (temp_dir / "api" / ".python-version").write_text("3.9\n")
+        manifest_path = temp_dir / "omni-run.yaml"
+        manifest_path.write_text("services:\n  api:\n    path: api\n    command: python3\n")
+
+        omni_runner._toolchains = ToolchainResolver(env=fake_env(temp_dir))
+        assert Orchestrator(omni_runner, load_manifest(manifest_path)).up() == 0
+        assert "Python 3.9.18" in capsys.readouterr().out
+
+    def test_missing_version_fails_the_service(self, temp_dir, omni_runner, capsys):
+        """Test that a missing pinned runtime stops the launch with the install hint."""
+        from omni_run import load_manifest, Orchestrator, ToolchainResolver, ManifestError
+
+        (temp_dir / ".nvmrc").write_text("12.22\n")
+        manifest_path = temp_dir / "omni-run.yaml"
+        manifest_path.write_text("services:\n  web:\n    command: npm start\n")
+
+        omni_runner._toolchains = ToolchainResolver(env=fake_env(temp_dir))
+        orchestrator = Orchestrator(omni_runner, load_manifest(manifest_path))
+        with pytest.raises(ManifestError, match="nvm install 12.22"):
+            orchestrator.up()
+
+
+@pytest.mark.skipif(sys.platform == "win32", reason="Fake toolchains are shell scripts")
+class TestToolchainDownloads:
+    """Tests for downloading official toolchains into ~/.omni-run/toolchains."""
+
+    def test_platform_names(self):
+        """Test the OS/architecture names Node and Go release archives use."""
+        from omni_run import toolchain_platform
+
+        assert toolchain_platform("node", "Linux", "x86_64") == "linux-x64"
+        assert toolchain_platform("go", "Linux", "x86_64") == "linux-amd64"
+        assert toolchain_platform("node", "Darwin", "arm64") == "darwin-arm64"
+        assert toolchain_platform("node", "Windows", "AMD64") == "win-x64"
+        assert toolchain_platform("go", "Windows", "AMD64") == "windows-amd64"
+
+    def test_download_node_and_go(self, temp_dir, releases):
+        """Test picking the newest matching release, verifying it, and reusing the install."""
+        from omni_run import ToolchainDownloader, ToolchainPin
+
+        downloader = ToolchainDownloader(temp_dir / "toolchains", releases.mirrors)
+        version, bin_dir = downloader.install(ToolchainPin("node", "20", temp_dir / ".nvmrc"))
+        assert version == "20.11.1" and bin_dir == temp_dir / "toolchains" / "node" / "20.11.1" / "bin"
+        assert os.popen(str(bin_dir / "node")).read().strip() == "v20.11.1"
+
+        fetched = len(releases.requests)
+        assert downloader.install(ToolchainPin("node", "20.11", temp_dir / ".nvmrc"))[0] == "20.11.1"
+        assert len(releases.requests) == fetched
+
+        # A go.mod minimum takes the newest patch of its minor version
+        version, bin_dir = downloader.install(ToolchainPin("go", "1.22", temp_dir / "go.mod", minimum=True))
+        assert version == "1.22.5" and (bin_dir / "go").exists()
+        assert [v for v, _ in downloader.installed("go")] == ["1.22.5"]
+        assert downloader.remove("go", "1.22.5") and downloader.installed("go") == []
+
+    def test_checksum_mismatch_and_missing_release(self, temp_dir):
+        """Test that a corrupt archive is rejected and unknown versions name the platform."""
+        from omni_run import ToolchainDownloader, ToolchainPin, ToolchainError
+
+        server = ReleaseServer(corrupt=True)
+        try:
+            downloader = ToolchainDownloader(temp_dir / "toolchains", server.mirrors)
+            with pytest.raises(ToolchainError, match="Checksum mismatch for .*go1.22.5"):
+                downloader.install(ToolchainPin("go", "1.22.5", temp_dir / "go.mod"))
+            assert downloader.installed("go") == []
+            with pytest.raises(ToolchainError, match="no node release matches 18 for"):
+                downloader.install(ToolchainPin("node", "18", temp_dir / ".nvmrc"))
+        finally:
+            server.close()
+
+    def test_resolver_downloads_and_isolates(self, temp_dir, releases):
+        """Test download: true for a missing version, and isolate: true ignoring a matching PATH install."""
+        from omni_run import ToolchainResolver
+
+        fake_tool(temp_dir / "bin", "node", "v20.11.1")
+        (temp_dir / ".nvmrc").write_text("20.1\n")
+        options = dict(env=fake_env(temp_dir), directory=temp_dir / "toolchains", mirrors=releases.mirrors)
+        with pytest.raises(Exception, match="set `toolchains.download: true`"):
+            ToolchainResolver(**options).resolve(temp_dir, strict=["node"])
+        toolchain, = ToolchainResolver(download=True, **options).resolve(temp_dir, strict=["node"])
+        assert (toolchain.manager, toolchain.version) == ("omni-run", "20.1.0")
+
+        (temp_dir / ".nvmrc").write_text("20.11\n")
+        assert ToolchainResolver(download=True, **options).resolve(temp_dir)[0].manager == "path"
+        isolated = ToolchainResolver(isolate=True, **options)
+        toolchain, = isolated.resolve(temp_dir, strict=["node"])
+        assert (toolchain.manager, toolchain.version) == ("omni-run", "20.11.1")
+        assert isolated.environment(temp_dir)["PATH"].startswith(str(temp_dir / "toolchains" / "node" / "20.11.1" / "bin"))
+
+    def test_toolchain_command(self, temp_dir, releases, capsys, monkeypatch):
+        """Test installing the project's pins, listing them and removing a version."""
+        import omni_run
+        from omni_run import run_subcommand
+
+        monkeypatch.setattr(omni_run, "TOOLCHAIN_DIR", temp_dir / "toolchains")
+        monkeypatch.setattr(omni_run, "TOOLCHAIN_SOURCES", releases.mirrors)
+        (temp_dir / ".nvmrc").write_text("20\n")
+        (temp_dir / "go.mod").write_text("module x\n\ngo 1.22.0\n")
+        assert run_subcommand(["toolchain", "install", "-C", str(temp_dir)]) == 0
+        out = capsys.readouterr().out
+        assert "node 20.11.1" in out and "go 1.22.5" in out
+
+        assert run_subcommand(["toolchain", "-C", str(temp_dir)]) == 0
+        out = capsys.readouterr().out
+        assert "Pins for" in out and ".nvmrc" in out
+        assert str(temp_dir / "toolchains" / "node" / "20.11.1") in out
+        assert str(temp_dir / "toolchains" / "go" / "1.22.5") in out
+
+        assert run_subcommand(["toolchain", "install", "ruby@3", "-C", str(temp_dir)]) == 2
+        assert "expected <runtime>@<version>" in capsys.readouterr().out
+        assert run_subcommand(["toolchain", "remove", "node@20.11.1", "-C", str(temp_dir)]) == 0
+        assert "Removed node 20.11.1" in capsys.readouterr().out
@@ -0,0 +1,154 @@
+"""
+Tests for the interactive dashboard in OmniRun.
+
+This module tests:
+- In-memory log buffers and console suppression
+- Service table rows and usage formatting
+- Keybindings for selection, scrolling, service actions and typing into a service's stdin
+- Refusing to start without a terminal
+"""
+
+import sys
+import time
+import pytest
+from pathlib import Path
+
+from conftest import *
+
+
+def make_dashboard(omni_runner, temp_dir, manifest_text):
+    from omni_run import Dashboard, LogPipeline, Orchestrator, load_manifest
+
+    (temp_dir / "omni-run.yaml").write_text(manifest_text)
+    logs = LogPipeline(console=False, buffer=100)
+    orchestrator = Orchestrator(omni_runner, load_manifest(temp_dir / "omni-run.yaml"), logs)
+    return Dashboard(orchestrator, logs)
+
+
+class TestLogBuffer:
+    """Tests for the log history the dashboard reads from."""
+
+    def test_buffer_keeps_recent_lines(self, capsys):
+        """Test that lines and status messages are buffered without printing."""
+        from omni_run import LogPipeline
+
+        logs = LogPipeline(console=False, buffer=3)
+        logs.register("api")
+        logs.status("api", "\033[1mstarting\033[0m")
+        for i in range(4):
+            logs.write("api", f"ERROR line {i}" if i == 3 else f"line {i}")
+
+        assert capsys.readouterr().out == ""
+        entries = [(level, text) for _, _, level, text in logs.history["api"]]
+        assert entries == [("info", "line 1"), ("info", "line 2"), ("error", "ERROR line 3")]
+
+    def test_no_buffer_by_default(self, capsys):
+        """Test that the console pipeline keeps no history."""
+        from omni_run import LogPipeline
+
+        logs = LogPipeline()
+        logs.write("api", "hello")
+        assert logs.history == {}
+        assert "hello" in capsys.readouterr().out
+
+
+class TestDashboard:
+    """Tests for dashboard rendering data and keybindings."""
+
+    def test_format_bytes(self):
+        """Test compact byte formatting."""
+        from omni_run import format_bytes
+
+        assert format_bytes(None) == "-"
+        assert format_bytes(512) == "512B"
+        assert format_bytes(1536) == "1.5K"
+        assert format_bytes(3 * 1024 ** 3) == "3.0G"
+
+    def test_rows(self, omni_runner, temp_dir):
+        """Test the service table for stopped and failed services."""
+        from omni_run import ServiceState
+
+        dash = make_dashboard(omni_runner, temp_dir, "services:\n  api:\n    command: 'true'\n  db:\n    command: 'true'\n")
+        db = dash.orchestrator.services["db"]
+        db.state, db.exit_code, db.restarts, db.ports = ServiceState.FAILED, 1, 2, {"http": 8080}
+
+        rows = dash.rows()
+        assert rows[0] == ["api", "pending", "-", "-", "0", "-", "-", "-"]
+        assert rows[1][:5] == ["db", "failed(1)", "-", "-", "2"]
+        assert rows[1][7] == "http=8080"
+
+    @pytest.mark.skipif(sys.platform == "win32", reason="POSIX sleep command")
+    def test_running_row_reports_usage(self, omni_runner, temp_dir):
+        """Test pid, memory and a CPU percentage for a running service."""
+        dash = make_dashboard(omni_runner, temp_dir, "services:\n  sleeper:\n    command: sleep 5\n")
+        service = dash.orchestrator.services["sleeper"]
+        dash.orchestrator.start_service(service)
+        try:
+            first = dash.rows()[0]
+            time.sleep(0.2)
+            second = dash.rows()[0]
+            assert first[2] == str(service.process.pid)
+            assert second[5].endswith("%")
+            assert second[6] != "-"
+        finally:
+            dash.orchestrator.stop_service(service, timeout=2)
+
+    def test_navigation_and_views(self, omni_runner, temp_dir):
+        """Test selection wrap-around, scrolling and the all-services view."""
+        dash = make_dashboard(omni_runner, temp_dir, "services:\n  api:\n    command: 'true'\n  db:\n    command: 'true'\n")
+        dash.logs.register("api")
+        dash.logs.register("db")
+        dash.logs.write("db", "db up")
+        dash.logs.write("api", "api up")
+
+        assert dash.handle_key("up") and dash.current == "db"
+        assert dash.log_lines() == [("db", "info", "db up")]
+        dash.handle_key("pageup", page=5)
+        assert dash.scroll == 5
+        dash.handle_key("t")
+        assert dash.scroll == 0
+
+        dash.handle_key("a")
+        assert [text for _, _, text in dash.log_lines()] == ["db up", "api up"]
+        assert dash.handle_key("q") is False
+
+    def test_action_keys_queue_commands(self, omni_runner, temp_dir):
+        """Test that r/s/S queue restart, stop and start for the selected service."""
+        dash = make_dashboard(omni_runner, temp_dir, "services:\n  api:\n    command: 'true'\n")
+        for key in ("r", "s", "S"):
+            dash.handle_key(key)
+
+        queued = [dash.orchestrator.commands.get_nowait() for _ in range(3)]
+        assert queued == [("restart", "api"), ("stop", "api"), ("start", "api")]
+        assert dash.message == "start requested for api"
+
+    def test_input_key_sends_a_line(self, omni_runner, temp_dir, monkeypatch):
+        """Test that i opens an input line for the selected service, which Enter sends and Esc cancels."""
+        dash = make_dashboard(omni_runner, temp_dir, "services:\n  api:\n    command: 'true'\n")
+        sent = []
+        monkeypatch.setattr(dash.orchestrator, "send_input", lambda name, text: sent.append((name, text)))
+        for key in ["i"] + list("yqs") + ["backspace", "enter"]:
+            assert dash.handle_key(key)
+        assert sent == [("api", "yq\n")] and dash.input is None
+        assert dash.message == "sent to api"
+
+        dash.handle_key("i")
+        dash.handle_key("x")
+        dash.handle_key("esc")
+        assert dash.input is None and sent == [("api", "yq\n")]
+        monkeypatch.undo()
+        for key in ("i", "n", "enter"):
+            dash.handle_key(key)
+        assert dash.message == "api is not running"
+
+
+class TestTuiCommand:
+    """Tests for the `tui` subcommand."""
+
+    def test_requires_terminal(self, temp_dir, capsys):
+        """Test that tui refuses to run without a TTY."""
+        from omni_run import run_subcommand
+
+        (temp_dir / "omni-run.yaml").write_text("services:\n  api:\n    command: 'true'\n")
+        assert run_subcommand(["tui", "-C", str(temp_dir)]) == 1
+        assert "interactive terminal" in capsys.readouterr().out
@@ -0,0 +1,233 @@
+"""
+Tests for monorepo workspace discovery in OmniRun.
+
+This module tests:
+- Node and Python project detectors
+- Nearest-project preference in runtime detection
+- Candidate scanning, ignored directories and project naming
+- Detection caching and mtime/hash invalidation
+- Tags, --path/--tag selection and `up --all` manifests
+"""
+
+import argparse
+import json
+import os
+import pytest
+from pathlib import Path
+
+from conftest import *
+
+
+def make_workspace(root: Path):
+    (root / "services" / "api").mkdir(parents=True)
+    (root / "services" / "api" / "go.mod").write_text("module api\n")
+    (root / "apps" / "web").mkdir(parents=True)
+    (root / "apps" / "web" / "package.json").write_text(json.dumps({"scripts": {"dev": "vite"}}))
+    (root / "apps" / "web" / "yarn.lock").write_text("")
+    (root / "packages" / "lib").mkdir(parents=True)
+    (root / "packages" / "lib" / "package.json").write_text(json.dumps({"name": "lib"}))
+    (root / "tools" / "seed").mkdir(parents=True)
+    (root / "tools" / "seed" / "requirements.txt").write_text("")
+    (root / "tools" / "seed" / "main.py").write_text("print('seed')\n")
+    (root / "apps" / "web" / "node_modules" / "dep").mkdir(parents=True)
+    (root / "apps" / "web" / "node_modules" / "dep" / "package.json").write_text(json.dumps({"scripts": {"start": "x"}}))
+
+
+def run_args(**overrides):
+    values = dict(file=None, services=[], all=False, path=None, tag=None, max_depth=10)
+    values.update(overrides)
+    return argparse.Namespace(**values)
+
+
+class TestProjectDetectors:
+    """Tests for the built-in Node and Python detectors."""
+
+    def test_node_scripts_and_package_manager(self, temp_dir):
+        """Test script preference, lockfile-based package managers and libraries."""
+        from omni_run import OmniRun
+
+        (temp_dir / "package.json").write_text(json.dumps({"scripts": {"dev": "vite", "start": "node server.js"}}))
+        (temp_dir / "pnpm-lock.yaml").write_text("")
+        plan = OmniRun(str(temp_dir)).detect_runtime(temp_dir)
+        assert (plan.runtime, plan.command) == ("node", ["pnpm", "run", "start"])
+
+        (temp_dir / "package.json").write_text(json.dumps({"name": "lib"}))
+        assert OmniRun(str(temp_dir)).detect_runtime(temp_dir) is None
+
+    def test_python_entry_points(self, temp_dir):
+        """Test manage.py, main.py and package __main__ entry points."""
+        from omni_run import OmniRun
+
+        (temp_dir / "pyproject.toml").write_text("[project]\nname = 'tool'\n")
+        assert OmniRun(str(temp_dir)).detect_runtime(temp_dir) is None
+
+        (temp_dir / "tool").mkdir()
+        (temp_dir / "tool" / "__main__.py").write_text("")
+        assert OmniRun(str(temp_dir)).detect_runtime(temp_dir).command[1:] == ["-m", "tool"]
+
+        (temp_dir / "manage.py").write_text("")
+        assert OmniRun(str(temp_dir)).detect_runtime(temp_dir).command[1:] == ["manage.py", "runserver"]
+
+    def test_nearest_project_wins(self, temp_dir):
+        """Test that a package inside a larger module is detected as itself."""
+        from omni_run import OmniRun
+
+        (temp_dir / "go.mod").write_text("module root\n")
+        web = temp_dir / "web"
+        web.mkdir()
+        (web / "package.json").write_text(json.dumps({"scripts": {"start": "node ."}}))
+
+        launcher = OmniRun(str(temp_dir))
+        assert launcher.detect_runtime(web).runtime == "node"
+        assert launcher.detect_runtime(temp_dir).runtime == "go"
+
+
+class TestWorkspaceDiscovery:
+    """Tests for scanning and caching."""
+
+    def test_discovers_runnable_projects(self, temp_dir):
+        """Test that runnable projects are found and libraries/node_modules are not."""
+        from omni_run import OmniRun, WorkspaceDiscovery
+
+        make_workspace(temp_dir)
+        projects = WorkspaceDiscovery(OmniRun(str(temp_dir)), temp_dir).discover()
+
+        by_rel = {p.rel: p for p in projects}
+        assert sorted(by_rel) == ["apps/web", "services/api", "tools/seed"]
+        assert by_rel["apps/web"].command == ["yarn", "run", "dev"]
+        assert by_rel["services/api"].tags == ["go", "services"]
+        assert by_rel["tools/seed"].name == "seed"
+
+    def test_gitignored_and_deep_directories_skipped(self, temp_dir):
+        """Test that .gitignore patterns and max_depth limit the scan."""
+        from omni_run import OmniRun, WorkspaceDiscovery
+
+        make_workspace(temp_dir)
+        (temp_dir / ".gitignore").write_text("tools/\n")
+        launcher = OmniRun(str(temp_dir))
+
+        rels = [p.rel for p in WorkspaceDiscovery(launcher, temp_dir).discover()]
+        assert "tools/seed" not in rels
+        assert WorkspaceDiscovery(launcher, temp_dir, max_depth=1).discover() == []
+
+    def test_duplicate_names_use_paths(self, temp_dir):
+        """Test that same-named projects are disambiguated by path."""
+        from omni_run import OmniRun, WorkspaceDiscovery
+
+        for group in ("apps", "services"):
+            (temp_dir / group / "api").mkdir(parents=True)
+            (temp_dir / group / "api" / "go.mod").write_text("module api\n")
+
+        names = sorted(p.name for p in WorkspaceDiscovery(OmniRun(str(temp_dir)), temp_dir).discover())
+        assert names == ["apps-api", "services-api"]
+
+    def _cached(self, temp_dir, monkeypatch):
+        from omni_run import OmniRun, WorkspaceDiscovery
+
+        make_workspace(temp_dir)
+        launcher = OmniRun(str(temp_dir))
+        discovery = WorkspaceDiscovery(launcher, temp_dir)
+        discovery.discover()
+        calls = []
+        original = launcher.detect_runtime
+        monkeypatch.setattr(launcher, "detect_runtime", lambda path: calls.append(path) or original(path))
+        return discovery, calls
+
+    def test_cache_reused(self, temp_dir, monkeypatch):
+        """Test that a second scan of an unchanged tree reuses the cached detection."""
+        discovery, calls = self._cached(temp_dir, monkeypatch)
+        assert (temp_dir / ".omni-run" / "workspace-cache.json").exists()
+
+        discovery.discover()
+        assert calls == []
+
+    def test_touched_file_revalidated_by_hash(self, temp_dir, monkeypatch):
+        """Test that a file with a new mtime but the same content keeps its cache entry."""
+        discovery, calls = self._cached(temp_dir, monkeypatch)
+        package_json = temp_dir / "apps" / "web" / "package.json"
+        stat = package_json.stat()
+        os.utime(package_json, ns=(stat.st_atime_ns, stat.st_mtime_ns + 10 ** 9))
+
+        discovery.discover()
+        assert calls == []
+
+    def test_changed_file_redetected(self, temp_dir, monkeypatch):
+        """Test that only the project whose file changed is detected again."""
+        discovery, calls = self._cached(temp_dir, monkeypatch)
+        (temp_dir / "apps" / "web" / "package.json").write_text(json.dumps({"scripts": {"start": "node ."}}))
+
+        projects = {p.rel: p for p in discovery.discover()}
+        assert calls == [(temp_dir / "apps" / "web").resolve()]
+        assert projects["apps/web"].command == ["yarn", "run", "start"]
+
+    def test_refresh_ignores_cache(self, temp_dir, monkeypatch):
+        """Test that refresh=True detects every project again."""
+        discovery, calls = self._cached(temp_dir, monkeypatch)
+
+        discovery.discover(refresh=True)
+        assert len(calls) >= 3
+
+
+class TestWorkspaceSelection:
+    """Tests for tags, selection and synthesized manifests."""
+
+    def test_tag_rules_and_selection(self, temp_dir):
+        """Test configured tag globs and --path/--tag filters."""
+        from omni_run import OmniRun, WorkspaceDiscovery, select_projects
+
+        make_workspace(temp_dir)
+        discovery = WorkspaceDiscovery(OmniRun(str(temp_dir)), temp_dir,
+                                       tag_rules={"backend": ["services/*", "tools/seed"]})
+        projects = discovery.discover()
+
+        assert [p.rel for p in select_projects(projects, tags=["backend"])] == ["services/api", "tools/seed"]
+        assert [p.rel for p in select_projects(projects, paths=["apps"])] == ["apps/web"]
+        assert [p.rel for p in select_projects(projects, paths=["*/api"], tags=["go"])] == ["services/api"]
+        assert select_projects(projects, paths=["apps"], tags=["go"]) == []
+
+    def test_up_all_without_manifest(self, temp_dir):
+        """Test that discovery builds a manifest when none exists."""
+        from omni_run import OmniRun, load_run_manifest, ManifestError
+
+        make_workspace(temp_dir)
+        launcher = OmniRun(str(temp_dir))
+        with pytest.raises(ManifestError, match="--all"):
+            load_run_manifest(launcher, run_args())
+
+        manifest, selected = load_run_manifest(launcher, run_args(all=True))
+        assert sorted(manifest.services) == ["api", "seed", "web"]
+        assert selected is None
+        assert manifest.services["api"].command is None
+
+        manifest, selected = load_run_manifest(launcher, run_args(tag=["python"]))
+        assert selected == ["seed"]
+
+    def test_all_merges_with_manifest(self, temp_dir):
+        """Test that manifest services take precedence over discovered projects at the same path."""
+        from omni_run import OmniRun, load_run_manifest, ManifestError
+
+        make_workspace(temp_dir)
+        (temp_dir / "omni-run.yaml").write_text(
+            "services:\n  backend:\n    path: services/api\n    command: ./run\n    tags: [core]\n")
+        launcher = OmniRun(str(temp_dir))
+
+        manifest, _ = load_run_manifest(launcher, run_args())
+        assert list(manifest.services) == ["backend"]
+
+        manifest, _ = load_run_manifest(launcher, run_args(all=True))
+        assert sorted(manifest.services) == ["backend", "seed", "web"]
+        assert manifest.services["backend"].command == "./run"
+
+        assert load_run_manifest(launcher, run_args(tag=["core"]))[1] == ["backend"]
+        with pytest.raises(ManifestError, match="No services match"):
+            load_run_manifest(launcher, run_args(tag=["nothing"]))
+
+    def test_workspace_command(self, temp_dir, capsys):
+        """Test the `workspace list` output."""
+        from omni_run import run_subcommand
+
+        make_workspace(temp_dir)
+        assert run_subcommand(["workspace", "-C", str(temp_dir), "--tag", "node"]) == 0
+        out = capsys.readouterr().out
+        assert "apps/web" in out and "yarn run dev" in out
+        assert "services/api" not in out